@@ -0,0 +1,107 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/oschwald/geoip2-golang"
+	"zgo.at/errors"
+)
+
+// ASN is an autonomous system, as looked up in the ASN database.
+type ASN struct {
+	Number uint32 // e.g. 16509
+	Org    string // e.g. "AMAZON-02"
+}
+
+// DatacenterASNs are the ASNs of hosting and cloud providers; pageviews from
+// these are very likely to be from bots, as there are few real visitors.
+var DatacenterASNs = map[uint32]string{
+	7224:   "Amazon",
+	14618:  "Amazon",
+	16509:  "Amazon",
+	8075:   "Microsoft",
+	15169:  "Google",
+	396982: "Google Cloud",
+	31898:  "Oracle Cloud",
+	14061:  "DigitalOcean",
+	16276:  "OVH",
+	24940:  "Hetzner",
+	213230: "Hetzner",
+	63949:  "Akamai (Linode)",
+	20473:  "Vultr",
+	51167:  "Contabo",
+	12876:  "Scaleway",
+	60781:  "Leaseweb",
+	9009:   "M247",
+	45102:  "Alibaba Cloud",
+	132203: "Tencent Cloud",
+}
+
+// Datacenter reports if this is the ASN of a hosting or cloud provider; see
+// DatacenterASNs.
+func (a ASN) Datacenter() bool {
+	_, ok := DatacenterASNs[a.Number]
+	return ok
+}
+
+var asndb atomic.Pointer[geoip2.Reader]
+
+// InitASNDB sets up the ASN database located at the given path; this needs to
+// be the MaxMind GeoLite2 ASN database, or the DB-IP ASN database in the
+// MaxMind-compatible format.
+//
+// ASNs aren't looked up if this isn't called, or if path is an empty string.
+func InitASNDB(path string) error {
+	if path == "" {
+		if old := asndb.Swap(nil); old != nil {
+			old.Close()
+		}
+		return nil
+	}
+
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "InitASNDB")
+	}
+	// ASN() returns an error for other database types; check it here so it
+	// doesn't fail on every lookup.
+	if _, err := db.ASN(net.IPv4(1, 1, 1, 1)); err != nil {
+		if _, ok := err.(geoip2.InvalidMethodError); ok {
+			db.Close()
+			return errors.Errorf("InitASNDB: %q is not an ASN database (type is %q)",
+				path, db.Metadata().DatabaseType)
+		}
+	}
+
+	if old := asndb.Swap(db); old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// LookupASN gets the ASN for the IP address.
+//
+// This returns an empty ASN if the ASN database isn't set up, if the IP isn't
+// in the database, or if it's a private or reserved IP; reserved IPs are
+// looked up if SetGeoLookupPrivate() is set, as for the GeoIP database.
+func LookupASN(ip string) ASN {
+	db := asndb.Load()
+	if db == nil {
+		return ASN{}
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil || (!geoLookupPrivate.Load() && reservedIP(addr)) {
+		return ASN{}
+	}
+
+	a, err := db.ASN(addr)
+	if err != nil || a == nil {
+		return ASN{}
+	}
+	return ASN{Number: uint32(a.AutonomousSystemNumber), Org: a.AutonomousSystemOrganization}
+}
@@ -0,0 +1,76 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/zstd/ztest"
+)
+
+func TestLookupASN(t *testing.T) {
+	asn := func(n uint32, org string) map[string]any {
+		return map[string]any{"autonomous_system_number": n, "autonomous_system_organization": org}
+	}
+	path := writeMMDB(t, "GeoLite2-ASN", map[string]map[string]any{
+		"3.0.0.0/15":  asn(16509, "AMAZON-02"),
+		"81.0.0.0/16": asn(1136, "KPN B.V."),
+		"10.0.0.0/8":  asn(64512, "Private"),
+	})
+
+	if have := LookupASN("3.1.2.3"); have != (ASN{}) {
+		t.Errorf("not initialized: %#v", have)
+	}
+	if err := InitASNDB(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { InitASNDB("") })
+
+	tests := []struct {
+		ip         string
+		want       ASN
+		datacenter bool
+	}{
+		{"3.1.2.3", ASN{16509, "AMAZON-02"}, true},
+		{"81.0.1.2", ASN{1136, "KPN B.V."}, false},
+		{"5.6.7.8", ASN{}, false},
+		{"10.1.2.3", ASN{}, false},
+		{"127.0.0.1", ASN{}, false},
+		{"not an IP", ASN{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			have := LookupASN(tt.ip)
+			if have != tt.want {
+				t.Errorf("\nhave: %#v\nwant: %#v", have, tt.want)
+			}
+			if d := have.Datacenter(); d != tt.datacenter {
+				t.Errorf("Datacenter(): %t", d)
+			}
+		})
+	}
+
+	t.Run("private", func(t *testing.T) {
+		SetGeoLookupPrivate(true)
+		defer SetGeoLookupPrivate(false)
+		if have, want := LookupASN("10.1.2.3"), (ASN{64512, "Private"}); have != want {
+			t.Errorf("\nhave: %#v\nwant: %#v", have, want)
+		}
+	})
+
+	t.Run("not ASN", func(t *testing.T) {
+		city := writeMMDB(t, "GeoLite2-City", map[string]map[string]any{
+			"3.0.0.0/15": {"country": map[string]any{"iso_code": "US"}},
+		})
+		err := InitASNDB(city)
+		if !ztest.ErrorContains(err, "not an ASN database") {
+			t.Fatal(err)
+		}
+		if have := LookupASN("3.1.2.3"); have != (ASN{16509, "AMAZON-02"}) {
+			t.Errorf("previous database not kept: %#v", have)
+		}
+	})
+}
@@ -0,0 +1,100 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"strings"
+
+	"zgo.at/isbot"
+)
+
+// Values for Hit.BotClass.
+const (
+	BotClassSearch  = "search"  // Search engine crawler.
+	BotClassPreview = "preview" // Link previews for social media and chat apps.
+	BotClassMonitor = "monitor" // Uptime monitor.
+	BotClassScraper = "scraper" // Client libraries, scanners, and automated browsers.
+	BotClassOther   = "other"   // Everything else.
+)
+
+// DefaultBotClasses is the class for Hit.Bot values; values that aren't in here
+// are BotClassOther. GlobalConfig.BotClasses takes precedence over this.
+var DefaultBotClasses = map[int]string{
+	isbot.BotClientLibrary:     BotClassScraper,
+	isbot.BotRangeAWS:          BotClassScraper,
+	isbot.BotRangeDigitalOcean: BotClassScraper,
+	isbot.BotRangeServersCom:   BotClassScraper,
+	isbot.BotRangeGoogleCloud:  BotClassScraper,
+	isbot.BotRangeHetzner:      BotClassScraper,
+	isbot.BotJSPhanton:         BotClassScraper,
+	isbot.BotJSNightmare:       BotClassScraper,
+	isbot.BotJSSelenium:        BotClassScraper,
+	isbot.BotJSWebDriver:       BotClassScraper,
+	BotWebdriver:               BotClassScraper,
+	BotScanner:                 BotClassScraper,
+	BotDatacenter:              BotClassScraper,
+	BotMonitor:                 BotClassMonitor,
+}
+
+// isbot uses BotKnownBot or BotLink for both search engines and link previews,
+// so these are told apart by the User-Agent; this is a case-insensitive
+// substring.
+var botClassUAs = []struct{ ua, class string }{
+	{"googlebot", BotClassSearch},
+	{"bingbot", BotClassSearch},
+	{"duckduckbot", BotClassSearch},
+	{"yandexbot", BotClassSearch},
+	{"baiduspider", BotClassSearch},
+	{"applebot", BotClassSearch},
+	{"yahoo! slurp", BotClassSearch},
+	{"petalbot", BotClassSearch},
+	{"seznambot", BotClassSearch},
+	{"qwantbot", BotClassSearch},
+
+	{"facebookexternalhit", BotClassPreview},
+	{"twitterbot", BotClassPreview},
+	{"slackbot", BotClassPreview},
+	{"linkedinbot", BotClassPreview},
+	{"discordbot", BotClassPreview},
+	{"whatsapp", BotClassPreview},
+	{"telegrambot", BotClassPreview},
+	{"skypeuripreview", BotClassPreview},
+	{"redditbot", BotClassPreview},
+	{"mastodon", BotClassPreview},
+	{"pinterestbot", BotClassPreview},
+	{"embedly", BotClassPreview},
+}
+
+// GetBotClass gets the class for the Hit.Bot value and User-Agent, which is
+// one of the BotClass* constants or a class from GlobalConfig.BotClasses. It
+// returns "" if this isn't a bot.
+//
+// The class is, in order: from GlobalConfig.BotClasses, from the User-Agent for
+// well-known search engines, link previews, and uptime monitors, from
+// DefaultBotClasses, or BotClassOther.
+func GetBotClass(ctx context.Context, bot int, ua string) string {
+	if bot <= isbot.NoBotNoMatch {
+		return ""
+	}
+	if c, ok := Config(ctx).BotClasses[bot]; ok {
+		return c
+	}
+	if ua != "" {
+		l := strings.ToLower(ua)
+		for _, c := range botClassUAs {
+			if strings.Contains(l, c.ua) {
+				return c.class
+			}
+		}
+		if _, ok := IsMonitor(ua); ok {
+			return BotClassMonitor
+		}
+	}
+	if c, ok := DefaultBotClasses[bot]; ok {
+		return c
+	}
+	return BotClassOther
+}
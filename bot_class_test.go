@@ -0,0 +1,100 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/isbot"
+	"zgo.at/zstd/zbool"
+)
+
+func TestGetBotClass(t *testing.T) {
+	tests := []struct {
+		bot  int
+		ua   string
+		want string
+	}{
+		{0, "", ""},
+		{isbot.NoBotNoMatch, "", ""},
+
+		{isbot.BotClientLibrary, "curl/8.5.0", BotClassScraper},
+		{isbot.BotRangeHetzner, "", BotClassScraper},
+		{isbot.BotJSSelenium, "", BotClassScraper},
+		{BotScanner, "", BotClassScraper},
+		{BotDatacenter, "", BotClassScraper},
+		{BotMonitor, "", BotClassMonitor},
+		{isbot.BotLink, "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", BotClassSearch},
+		{isbot.BotKnownBot, "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", BotClassSearch},
+		{isbot.BotLink, "facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", BotClassPreview},
+		{isbot.BotKnownBot, "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", BotClassPreview},
+		{isbot.BotLink, "Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)", BotClassMonitor},
+
+		// Unknown.
+		{isbot.BotLink, "Mozilla/5.0 (compatible; SomeBot/1.0; +https://example.com)", BotClassOther},
+		{isbot.BotBoty, "", BotClassOther},
+		{BotEmptyUA, "", BotClassOther},
+		{120, "", BotClassOther},
+	}
+
+	ctx := gctest.Context(nil)
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %s", tt.bot, tt.ua), func(t *testing.T) {
+			have := GetBotClass(ctx, tt.bot, tt.ua)
+			if have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+
+	t.Run("config", func(t *testing.T) {
+		ctx := gctest.Context(nil)
+		Config(ctx).BotClasses = map[int]string{
+			isbot.BotLink: "crawler",
+			120:           BotClassMonitor,
+		}
+
+		for _, tt := range []struct {
+			bot  int
+			ua   string
+			want string
+		}{
+			{isbot.BotLink, "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "crawler"},
+			{120, "", BotClassMonitor},
+			{isbot.BotKnownBot, "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", BotClassSearch},
+			{BotScanner, "", BotClassScraper},
+		} {
+			if have := GetBotClass(ctx, tt.bot, tt.ua); have != tt.want {
+				t.Errorf("%d: have %q; want %q", tt.bot, have, tt.want)
+			}
+		}
+	})
+}
+
+func TestHitBotClass(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/a", FirstVisit: zbool.Bool(true)},
+		Hit{Path: "/a", Bot: isbot.BotClientLibrary, UserAgentHeader: "curl/8.5.0"},
+		Hit{Path: "/a", Bot: isbot.BotLink, UserAgentHeader: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"},
+	)
+
+	var hits Hits
+	err := hits.TestList(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := make([]string, 0, len(hits))
+	for _, h := range hits {
+		have = append(have, fmt.Sprintf("%d:%s", h.Bot, h.BotClass))
+	}
+	if want := "[0: 4:scraper 3:search]"; fmt.Sprint(have) != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
@@ -6,12 +6,31 @@ package goatcounter
 
 import (
 	"context"
+	"strings"
 
 	"zgo.at/errors"
 	"zgo.at/zdb"
 	"zgo.at/zvalidate"
 )
 
+// CampaignFields are the fields query parameters can be mapped to with
+// SiteSettings.CampaignParams.
+//
+// "source" is recorded as the referrer, "campaign" as the campaign name.
+var CampaignFields = []string{"source", "campaign"}
+
+// campaignParams gets the query parameters mapped to field in
+// SiteSettings.CampaignParams, in the order they were added.
+func (ss SiteSettings) campaignParams(field string) []string {
+	var params []string
+	for _, p := range ss.CampaignParams {
+		if param, f, ok := strings.Cut(p, ":"); ok && f == field && param != "" {
+			params = append(params, param)
+		}
+	}
+	return params
+}
+
 type Campaign struct {
 	ID     int64  `db:"campaign_id" json:"campaign_id"`
 	SiteID int64  `db:"site_id" json:"site_id"`
@@ -7,13 +7,16 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/text/language"
 	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
 	"zgo.at/guru"
 	"zgo.at/z18n"
 	"zgo.at/zdb"
@@ -23,6 +26,7 @@ import (
 	"zgo.at/zstd/zcrypto"
 	"zgo.at/zstd/zint"
 	"zgo.at/zstd/zstring"
+	"zgo.at/zstd/ztime"
 	"zgo.at/zstd/ztype"
 	"zgo.at/zvalidate"
 )
@@ -76,6 +80,10 @@ show command:
                     csv       CSV (includes header).
                     json      JSON, as an array of objects.
                     html      HTML table.
+                    settings  Only the site settings, as a JSON document
+                              that can be used with -settings for create
+                              and update. Secrets are never included. Only
+                              for "site" and one -find.
 
 delete command:
 
@@ -114,6 +122,11 @@ create and update commands:
                     top navigation
                     Can be as ID ("1") or vhost ("stats.example.com").
 
+        -settings   Apply the settings from this JSON file ("-" for stdin),
+                    as printed by "show site -format=settings". Settings not
+                    in the file are kept at their current value. The settings
+                    are validated in the same way as on the settings page.
+
         Only or "create", as a convenience to create a new user:
 
             -user.email*      Your email address. Will be required to login.
@@ -155,6 +168,50 @@ create and update commands:
                         site_create  Creating new sites.
                         site_update  Updating existing sites.
 
+merge command:
+
+    Merge all pageviews from one site in to another site, and delete it. This is
+    useful if you accidentally created two sites for the same domain.
+
+    The stats of both sites are added up. This can take a while for larger
+    sites; it's safe to run it again with the same flags if it got
+    interrupted.
+
+    -from       Site to merge from; this site is deleted afterwards. Same format
+                as -find for site.
+
+    -into       Site to merge in to.
+
+    -settings   Which settings to use after the merge:
+
+                    target    Keep the settings of the -into site (default).
+                    source    Use the settings of the -from site.
+
+reindex command:
+
+    Rebuild the stats that are shown on the dashboard from the stored
+    pageviews. The stats are updated when pageviews are persisted, so this is
+    only needed to backfill them, for example after inserting pageviews in the
+    database directly.
+
+    It's safe to run this while GoatCounter is running, and to run it again if
+    it got interrupted.
+
+    -site       Site to reindex; can be given more than once. Same format as
+                -find for site. Default is all sites.
+
+    -since      Day to start at, as "2006-01-02" (UTC). Default is the day of
+                the first pageview.
+
+    -to         Last day to reindex, as "2006-01-02" (UTC). Default is the day
+                of the last pageview.
+
+                The stats that are stored in the site's timezone (browsers,
+                systems, locations, etc.) are reindexed for the same days in
+                that timezone.
+
+    -quiet      Don't print progress.
+
 migrate command:
 
     Run or print database migrations.
@@ -336,6 +393,8 @@ const helpDBCommands = `List of commands:
 
                         Valid tables are "site", "user", and "apitoken".
 
+     merge              Merge two sites.
+     reindex            Rebuild the dashboard stats from the pageviews.
      newdb              Create a new database.
      migrate            Run or view database migrations.
      schema-sqlite      Print the SQLite schema.
@@ -403,6 +462,10 @@ start:
 		return cmdDBShow(f, cmd, dbConnect, debug, createdb)
 	case "delete":
 		return cmdDBDelete(f, cmd, dbConnect, debug, createdb)
+	case "merge":
+		return cmdDBMerge(f, dbConnect, debug, createdb)
+	case "reindex":
+		return cmdDBReindex(f, dbConnect, debug, createdb)
 
 	case "create", "update":
 		tbl, err := getTable(&f, cmd)
@@ -636,6 +699,26 @@ func cmdDBShow(f zli.Flags, cmd string, dbConnect, debug *string, createdb *bool
 		return errors.New("nothing found")
 	}
 
+	if format.String() == "settings" {
+		if tbl != "site" {
+			return errors.New("-format=settings only works for sites")
+		}
+		if len(ids) > 1 {
+			return errors.New("-format=settings only works for one site")
+		}
+		var s goatcounter.Site
+		err := s.ByID(ctx, ids[0])
+		if err != nil {
+			return err
+		}
+		doc, err := s.Settings.Export()
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(zli.Stdout, string(doc))
+		return nil
+	}
+
 	dump, err := getFormat(format.String())
 	if err != nil {
 		return err
@@ -664,14 +747,99 @@ func cmdDBDelete(f zli.Flags, cmd string, dbConnect, debug *string, createdb *bo
 	return finder.Delete(ctx, *force)
 }
 
+func cmdDBMerge(f zli.Flags, dbConnect, debug *string, createdb *bool) error {
+	var (
+		from     = f.String("", "from")
+		into     = f.String("", "into")
+		settings = f.String(goatcounter.MergeKeepSettings, "settings")
+	)
+	db, ctx, err := dbParseFlag(f, dbConnect, debug, createdb)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	v := zvalidate.New()
+	v.Required("-from", from.String())
+	v.Required("-into", into.String())
+	v.Include("-settings", settings.String(), []string{goatcounter.MergeKeepSettings, goatcounter.MergeSourceSettings})
+	if v.HasErrors() {
+		return v
+	}
+
+	var src, dst goatcounter.Site
+	err = src.Find(ctx, from.String())
+	if err != nil {
+		return err
+	}
+	err = dst.Find(ctx, into.String())
+	if err != nil {
+		return err
+	}
+	return dst.Merge(ctx, &src, settings.String())
+}
+
+func cmdDBReindex(f zli.Flags, dbConnect, debug *string, createdb *bool) error {
+	var (
+		sites = f.StringList(nil, "site")
+		since = f.String("", "since")
+		to    = f.String("", "to")
+		quiet = f.Bool(false, "quiet")
+	)
+	db, ctx, err := dbParseFlag(f, dbConnect, debug, createdb)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var rng ztime.Range
+	v := zvalidate.New()
+	if since.Set() {
+		rng.Start = v.Date("-since", since.String(), "2006-01-02")
+	}
+	if to.Set() {
+		rng.End = v.Date("-to", to.String(), "2006-01-02")
+	}
+	if since.Set() && to.Set() && rng.End.Before(rng.Start) {
+		v.Append("-to", "before -since")
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	var list goatcounter.Sites
+	if sites.Set() {
+		err = list.Find(ctx, sites.StringsSplit(","))
+	} else {
+		err = list.UnscopedList(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := range list {
+		s := &list[i]
+		err := cron.Reindex(ctx, s, rng, func(day time.Time, n int) {
+			if !quiet.Bool() {
+				fmt.Fprintf(zli.Stdout, "site %d: %s: %d pageviews\n", s.ID, day.Format("2006-01-02"), n)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func cmdDBSite(f zli.Flags, cmd string, dbConnect, debug *string, createdb *bool) error {
 	// TODO(depr): The second values are for compat with <2.0
 	var (
-		vhost = f.String("", "vhost", "domain")
-		link  = f.String("", "link", "parent")
-		find  *[]string
-		email stringFlag
-		pwd   stringFlag
+		vhost    = f.String("", "vhost", "domain")
+		link     = f.String("", "link", "parent")
+		settings = f.String("", "settings")
+		find     *[]string
+		email    stringFlag
+		pwd      stringFlag
 	)
 	if cmd == "update" {
 		find = f.StringList(nil, "find").Pointer()
@@ -690,13 +858,30 @@ func cmdDBSite(f zli.Flags, cmd string, dbConnect, debug *string, createdb *bool
 		return errors.New("can't set both -link and -user.email")
 	}
 
+	var doc []byte
+	if settings.Set() {
+		doc, err = readSettings(settings.String())
+		if err != nil {
+			return err
+		}
+	}
+
 	if cmd == "create" {
-		return cmdDBSiteCreate(ctx, vhost.String(), email.String(), link.String(), pwd.String())
+		return cmdDBSiteCreate(ctx, vhost.String(), email.String(), link.String(), pwd.String(), doc)
+	}
+	return cmdDBSiteUpdate(ctx, *find, vhost, link, doc)
+}
+
+func readSettings(path string) ([]byte, error) {
+	fp, err := zli.InputOrFile(path, true)
+	if err != nil {
+		return nil, err
 	}
-	return cmdDBSiteUpdate(ctx, *find, vhost, link)
+	defer fp.Close()
+	return io.ReadAll(fp)
 }
 
-func cmdDBSiteCreate(ctx context.Context, vhost, email, link, pwd string) error {
+func cmdDBSiteCreate(ctx context.Context, vhost, email, link, pwd string, settings []byte) error {
 	v := zvalidate.New()
 	v.Required("-vhost", vhost)
 	v.Domain("-vhost", vhost)
@@ -736,6 +921,12 @@ func cmdDBSiteCreate(ctx context.Context, vhost, email, link, pwd string) error
 		if account.ID > 0 {
 			s.Parent, s.Settings, s.UserDefaults = &account.ID, account.Settings, account.UserDefaults
 		}
+		if settings != nil {
+			err := s.Settings.Import(settings)
+			if err != nil {
+				return err
+			}
+		}
 		err := s.Insert(ctx)
 		if err != nil {
 			return err
@@ -759,7 +950,7 @@ func cmdDBSiteCreate(ctx context.Context, vhost, email, link, pwd string) error
 }
 
 func cmdDBSiteUpdate(ctx context.Context, find []string,
-	vhost, link stringFlag,
+	vhost, link stringFlag, settings []byte,
 ) error {
 
 	v := zvalidate.New()
@@ -789,8 +980,16 @@ func cmdDBSiteUpdate(ctx context.Context, find []string,
 				}
 			}
 
-			if vhost.Set() {
-				s.Cname = ztype.Ptr(vhost.String())
+			if vhost.Set() || settings != nil {
+				if vhost.Set() {
+					s.Cname = ztype.Ptr(vhost.String())
+				}
+				if settings != nil {
+					err := s.Settings.Import(settings)
+					if err != nil {
+						return err
+					}
+				}
 				err := s.Update(ctx)
 				if err != nil {
 					return err
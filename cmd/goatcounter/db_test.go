@@ -5,6 +5,8 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
@@ -13,6 +15,7 @@ import (
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/zdb"
 	"zgo.at/zli"
+	"zgo.at/zstd/ztest"
 	"zgo.at/zstd/ztime"
 )
 
@@ -259,6 +262,144 @@ func grep(s, find string) bool {
 	return regexp.MustCompile(find).MatchString(s)
 }
 
+func TestDBSiteSettings(t *testing.T) {
+	exit, _, out, ctx, dbc := startTest(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	site.Settings.IgnoreIPs = goatcounter.Strings{"1.1.1.1"}
+	site.Settings.StripFragment = true
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runCmd(t, exit, "db", "show", "site", "-db="+dbc, "-find=1", "-format=settings")
+	wantExit(t, exit, out, 0)
+	doc := out.String()
+	if !strings.Contains(doc, `"strip_fragment": true`) || strings.Contains(doc, `"secret"`) {
+		t.Fatal(doc)
+	}
+	out.Reset()
+
+	file := filepath.Join(t.TempDir(), "settings.json")
+	err = os.WriteFile(file, []byte(doc), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runCmd(t, exit, "db", "create", "site", "-db="+dbc,
+		"-vhost=stats.stats", "-user.email=foo@foo.foo", "-user.password=password",
+		"-settings="+file)
+	wantExit(t, exit, out, 0)
+	out.Reset()
+
+	runCmd(t, exit, "db", "show", "site", "-db="+dbc, "-find=stats.stats", "-format=settings")
+	wantExit(t, exit, out, 0)
+	if d := ztest.Diff(out.String(), doc); d != "" {
+		t.Error(d)
+	}
+	out.Reset()
+
+	{ // Validated.
+		err = os.WriteFile(file, []byte(`{"data_retention": 1}`), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runCmd(t, exit, "db", "update", "site", "-db="+dbc, "-find=1", "-settings="+file)
+		wantExit(t, exit, out, 1)
+		if !strings.Contains(out.String(), "data_retention") {
+			t.Error(out.String())
+		}
+		out.Reset()
+	}
+}
+
+func TestDBMerge(t *testing.T) {
+	exit, _, out, ctx, dbc := startTest(t)
+
+	runCmd(t, exit, "db", "create", "site",
+		"-db="+dbc,
+		"-vhost=stats.stats",
+		"-user.email=foo@foo.foo",
+		"-user.password=password")
+	wantExit(t, exit, out, 0)
+	out.Reset()
+
+	gctest.StoreHits(ctx, t, false, goatcounter.Hit{Site: 1, FirstVisit: true})
+	gctest.StoreHits(ctx, t, false, goatcounter.Hit{Site: 2, FirstVisit: true})
+
+	runCmd(t, exit, "db", "merge", "-db="+dbc, "-from=stats.stats", "-into=1", "-settings=xxx")
+	wantExit(t, exit, out, 1)
+	if !strings.Contains(out.String(), "-settings") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "merge", "-db="+dbc, "-from=stats.stats", "-into=1")
+	wantExit(t, exit, out, 0)
+
+	have := zdb.DumpString(ctx, `select site_id, state from sites order by site_id`) +
+		zdb.DumpString(ctx, `select site_id, sum(total) as total from hit_counts group by site_id`)
+	want := `
+		site_id  state
+		1        a
+		2        d
+		site_id  total
+		1        2`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestDBReindex(t *testing.T) {
+	exit, _, out, ctx, dbc := startTest(t)
+
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Site: 1, FirstVisit: true, CreatedAt: ztime.FromString("2020-06-18 12:00:00")},
+		goatcounter.Hit{Site: 1, FirstVisit: true, CreatedAt: ztime.FromString("2020-06-19 12:00:00")})
+	err := zdb.Exec(ctx, `delete from hit_counts`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runCmd(t, exit, "db", "reindex", "-db="+dbc, "-since=2020-06-19", "-to=2020-06-18")
+	wantExit(t, exit, out, 1)
+	if !strings.Contains(out.String(), "-to") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "reindex", "-db="+dbc, "-site=1", "-since=2020-06-19")
+	wantExit(t, exit, out, 0)
+	if want := "site 1: 2020-06-19: 1 pageviews\n"; out.String() != want {
+		t.Errorf("\nhave: %q\nwant: %q", out.String(), want)
+	}
+	out.Reset()
+
+	have := zdb.DumpString(ctx, `select hour, total from hit_counts order by hour`)
+	want := `
+		hour                 total
+		2020-06-19 12:00:00  1`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	runCmd(t, exit, "db", "reindex", "-db="+dbc, "-quiet")
+	wantExit(t, exit, out, 0)
+	if out.String() != "" {
+		t.Error(out.String())
+	}
+
+	have = zdb.DumpString(ctx, `select hour, total from hit_counts order by hour`)
+	want = `
+		hour                 total
+		2020-06-18 12:00:00  1
+		2020-06-19 12:00:00  1`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
+
 func TestDBUser(t *testing.T) {
 	exit, _, out, ctx, dbc := startTest(t)
 
@@ -34,7 +34,7 @@ func cmdHelp(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 		}
 		if a == "all" {
 			topics = []string{"help", "version", "serve", "import",
-				"dashboard", "db", "monitor", "listen", "logfile", "debug"}
+				"dashboard", "db", "monitor", "replay", "listen", "logfile", "debug"}
 			break
 		}
 		topics = append(topics, strings.ToLower(a))
@@ -73,6 +73,7 @@ var usage = map[string]string{
 	"serve":     usageServe,
 	"saas":      usageSaas,
 	"monitor":   usageMonitor,
+	"replay":    usageReplay,
 	"import":    usageImport,
 	"dashboard": usageDashboard,
 	"db":        helpDB,
@@ -100,6 +101,7 @@ Commands:
   dashboard    Show dashboard statistics in the terminal.
   db           Modify the database and print database info.
   monitor      Monitor for pageviews.
+  replay       Replay pageviews to load test an instance.
 
 Extra help topics:
   listen       Detailed documentation on -listen and -tls flags.
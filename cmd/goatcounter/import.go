@@ -14,8 +14,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"zgo.at/errors"
@@ -69,6 +71,15 @@ Flags:
   -follow      Watch a file for new lines and import them. Existing lines are
                not processed.
 
+  -checkpoint  Record how far the import got in this file, and resume from
+               there if it already exists. The checkpoint is updated after
+               every batch of pageviews is sent, so if the import is
+               interrupted at most one batch is sent again on the next run.
+               Lines (or rows for CSV) are counted from the start of the file,
+               so the file must not be modified between runs; it's an error to
+               use a checkpoint for a different file. It can't be used with
+               -follow.
+
   -format      Log format; currently accepted values:
 
                    csv             GoatCounter CSV export (default)
@@ -208,13 +219,14 @@ func cmdImport(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 		silent   = f.Bool(false, "silent").Pointer()
 		follow   = f.Bool(false, "follow").Pointer()
 		exclude  = f.StringList(nil, "exclude").Pointer()
+		checkp   = f.String("", "checkpoint").Pointer()
 	)
 	err := f.Parse()
 	if err != nil {
 		return err
 	}
 
-	return func(debug, site, format, date, tyme, datetime string, silent, follow bool, exclude []string) error {
+	return func(debug, site, format, date, tyme, datetime, checkp string, silent, follow bool, exclude []string) error {
 		files := f.Args
 		if len(files) == 0 {
 			return fmt.Errorf("need a filename")
@@ -245,6 +257,21 @@ func cmdImport(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 
 		zlog.Config.SetDebug(debug)
 
+		var cp *importCheckpoint
+		if checkp != "" {
+			if follow {
+				return fmt.Errorf("cannot use -checkpoint with -follow")
+			}
+			var err error
+			cp, err = loadCheckpoint(checkp, files[0])
+			if err != nil {
+				return err
+			}
+			if cp.start > 0 && !silent {
+				fmt.Fprintf(zli.Stdout, "Resuming from %s: skipping %d lines\n", checkp, cp.start)
+			}
+		}
+
 		url := strings.TrimRight(site, "/")
 		if !zstring.HasPrefixes(url, "http://", "https://") {
 			url = "https://" + url
@@ -261,7 +288,7 @@ func cmdImport(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 
 		switch format {
 		default:
-			err = importLog(fp, ready, stop, url, key, files[0], format, date, tyme, datetime, follow, silent, exclude)
+			err = importLog(fp, ready, stop, url, key, files[0], format, date, tyme, datetime, follow, silent, exclude, cp)
 		case "csv":
 			ready <- struct{}{}
 			if follow {
@@ -270,18 +297,22 @@ func cmdImport(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 			if len(exclude) > 0 {
 				return fmt.Errorf("cannot use -exclude with -format=csv")
 			}
-			err = importCSV(fp, url, key, silent)
+			err = importCSV(fp, url, key, silent, cp)
 		}
 		return err
-	}(*debug, *site, *format, *date, *tyme, *datetime, *silent, *follow, *exclude)
+	}(*debug, *site, *format, *date, *tyme, *datetime, *checkp, *silent, *follow, *exclude)
 }
 
-func importCSV(fp io.ReadCloser, url, key string, silent bool) error {
-	n := 0
+func importCSV(fp io.ReadCloser, url, key string, silent bool, cp *importCheckpoint) error {
+	n, row := 0, 0
 	ctx := goatcounter.WithSite(context.Background(), &goatcounter.Site{})
 	hits := make([]handlers.APICountRequestHit, 0, 500)
 	_, err := goatcounter.Import(ctx, fp, false, false, func(hit goatcounter.Hit, final bool) {
 		if !final {
+			row++
+			if cp.skip(row) {
+				return
+			}
 			hits = append(hits, handlers.APICountRequestHit{
 				Path:      hit.Path,
 				Title:     hit.Title,
@@ -296,12 +327,16 @@ func importCSV(fp io.ReadCloser, url, key string, silent bool) error {
 			})
 		}
 
-		if len(hits) >= 500 || final {
+		if len(hits) >= 500 || (final && len(hits) > 0) {
 			err := importSend(url, key, silent, false, hits)
 			if err != nil {
 				fmt.Fprintln(zli.Stdout)
 				zli.Errorf(err)
 			}
+			err = cp.done(row, err)
+			if err != nil {
+				zli.Errorf(err)
+			}
 
 			n += len(hits)
 			if !silent {
@@ -318,6 +353,7 @@ func importLog(
 	fp io.ReadCloser,
 	ready chan<- struct{}, stop <-chan struct{},
 	url, key, file, format, date, tyme, datetime string, follow, silent bool, exclude []string,
+	cp *importCheckpoint,
 ) error {
 	var (
 		scan *logscan.Scanner
@@ -343,7 +379,7 @@ func importLog(
 	go func() {
 		for {
 			<-t.C
-			persistLog(hits, url, key, silent, follow)
+			persistLog(hits, url, key, silent, follow, cp)
 		}
 	}()
 
@@ -353,7 +389,7 @@ func importLog(
 		cancel()
 	}()
 
-	defer persistLog(hits, url, key, silent, follow)
+	defer persistLog(hits, url, key, silent, follow, cp)
 	ready <- struct{}{}
 	n := 0
 	for {
@@ -366,6 +402,10 @@ func importLog(
 			return err
 		}
 
+		if cp.skip(int(line.LineNo())) {
+			continue
+		}
+
 		hit := handlers.APICountRequestHit{
 			Line:      line.Line(),
 			LineNo:    line.LineNo(),
@@ -398,7 +438,7 @@ func importLog(
 		if len(hits) >= cap(hits) {
 			n += len(hits)
 			t.Reset(d)
-			persistLog(hits, url, key, silent, follow)
+			persistLog(hits, url, key, silent, follow, cp)
 			if !silent && !follow {
 				zli.ReplaceLinef("Imported %d rows", n)
 			}
@@ -409,7 +449,7 @@ func importLog(
 
 // Send everything off if we have 100 entries or if 10 seconds expired,
 // whichever happens first.
-func persistLog(hits <-chan handlers.APICountRequestHit, url, key string, silent, follow bool) {
+func persistLog(hits <-chan handlers.APICountRequestHit, url, key string, silent, follow bool, cp *importCheckpoint) {
 	l := len(hits)
 	if l == 0 {
 		return
@@ -423,6 +463,96 @@ func persistLog(hits <-chan handlers.APICountRequestHit, url, key string, silent
 	if err != nil {
 		zlog.Error(err)
 	}
+	err = cp.done(int(collect[len(collect)-1].LineNo), err)
+	if err != nil {
+		zlog.Error(err)
+	}
+}
+
+// importCheckpoint records the last line that was sent, so that an interrupted
+// import can be resumed. All methods are no-ops on a nil checkpoint.
+type importCheckpoint struct {
+	mu     sync.Mutex
+	path   string
+	start  int  // Line we resumed from.
+	failed bool // Sending a batch failed; don't advance past it anymore.
+
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// loadCheckpoint reads the checkpoint from path, or creates a new one if it
+// doesn't exist yet.
+func loadCheckpoint(path, file string) (*importCheckpoint, error) {
+	if file != "-" {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		file = abs
+	}
+
+	cp := &importCheckpoint{path: path, File: file}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint: %w", err)
+	}
+
+	err = json.Unmarshal(b, cp)
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint %q: %w", path, err)
+	}
+	if cp.File != file {
+		return nil, fmt.Errorf("checkpoint %q is for %q, not %q", path, cp.File, file)
+	}
+	cp.start = cp.Line
+	return cp, nil
+}
+
+// skip reports if this line was already imported in a previous run.
+func (cp *importCheckpoint) skip(line int) bool {
+	if cp == nil {
+		return false
+	}
+	return line <= cp.start
+}
+
+// done records that everything up to and including line was sent, unless
+// sendErr is set.
+func (cp *importCheckpoint) done(line int, sendErr error) error {
+	if cp == nil {
+		return nil
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if sendErr != nil {
+		cp.failed = true
+	}
+	if cp.failed || line <= cp.Line {
+		return nil
+	}
+	cp.Line = line
+
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so we never leave a half-written
+	// checkpoint if we get interrupted.
+	tmp := cp.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	err = os.Rename(tmp, cp.path)
+	if err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	return nil
 }
 
 var (
@@ -7,14 +7,20 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/handlers"
+	"zgo.at/json"
 	"zgo.at/zdb"
 	"zgo.at/zli"
 	"zgo.at/zstd/zslice"
@@ -243,3 +249,133 @@ func TestImport(t *testing.T) {
 	stopServer <- struct{}{}
 	mainDone.Wait()
 }
+
+// countServer is a stub for /api/v0/count which records the paths it got; it
+// fails all requests after the first failAfter requests.
+type countServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	paths     []string
+	reqs      int
+	failAfter int
+}
+
+func newCountServer(t *testing.T, failAfter int) *countServer {
+	s := &countServer{failAfter: failAfter}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.reqs++
+		if s.failAfter > 0 && s.reqs > s.failAfter {
+			w.WriteHeader(500)
+			return
+		}
+
+		var args handlers.APICountRequest
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, h := range args.Hits {
+			s.paths = append(s.paths, h.Path)
+		}
+		w.WriteHeader(202)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestImportCheckpoint(t *testing.T) {
+	zli.Stdout, zli.Stderr = io.Discard, io.Discard
+	defer func() { zli.Stdout, zli.Stderr = os.Stdout, os.Stderr }()
+
+	dir := t.TempDir()
+
+	csvFile := filepath.Join(dir, "export.csv")
+	csv := "2Path,Title,Event,UserAgent,Browser,System,Session,Bot,Referrer,Referrer scheme,Screen size,Location,FirstVisit,Date\n"
+	for i := 1; i <= 1200; i++ {
+		csv += fmt.Sprintf("/%d,,0,Mozilla/5.0,,,287fb97cbed4e4f-8e4f5c975b8fee06,0,,,,,1,2020-12-01T00:07:10Z\n", i)
+	}
+	logFile := filepath.Join(dir, "access_log")
+	var log string
+	for i := 1; i <= 250; i++ {
+		log += fmt.Sprintf(`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /%d HTTP/1.1" 200 2326 "-" "Mozilla/5.0"`+"\n", i)
+	}
+	for f, data := range map[string]string{csvFile: csv, logFile: log} {
+		err := os.WriteFile(f, []byte(data), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := func(t *testing.T, file, cpFile string, failAfter int) []string {
+		t.Helper()
+		srv := newCountServer(t, failAfter)
+		fp, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+
+		cp, err := loadCheckpoint(cpFile, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file == csvFile {
+			err = importCSV(fp, srv.URL, "key", true, cp)
+		} else {
+			err = importLog(fp, make(chan struct{}, 1), nil, srv.URL, "key", file,
+				"combined", "", "", "", false, true, nil, cp)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return srv.paths
+	}
+
+	tests := []struct {
+		name      string
+		file      string
+		failAfter int
+		first     int // Pageviews sent before "interrupting".
+		want      string
+	}{
+		{"csv", csvFile, 1, 500, `{"file":"` + csvFile + `","line":500}`},
+		{"log", logFile, 1, 100, `{"file":"` + logFile + `","line":100}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpFile := filepath.Join(dir, tt.name+".checkpoint")
+
+			got := run(t, tt.file, cpFile, tt.failAfter)
+			if len(got) != tt.first {
+				t.Fatalf("first run: sent %d", len(got))
+			}
+			b, _ := os.ReadFile(cpFile)
+			if string(b) != tt.want {
+				t.Errorf("checkpoint:\nhave: %s\nwant: %s", b, tt.want)
+			}
+
+			got = run(t, tt.file, cpFile, 0)
+			total := map[string]int{"csv": 1200, "log": 250}[tt.name]
+			if len(got) != total-tt.first {
+				t.Fatalf("resumed: sent %d; want %d", len(got), total-tt.first)
+			}
+			if got[0] != fmt.Sprintf("/%d", tt.first+1) {
+				t.Errorf("resumed at %q", got[0])
+			}
+
+			// Everything's done now.
+			if got = run(t, tt.file, cpFile, 0); len(got) != 0 {
+				t.Errorf("sent %d after finishing", len(got))
+			}
+		})
+	}
+
+	t.Run("wrong file", func(t *testing.T) {
+		_, err := loadCheckpoint(filepath.Join(dir, "csv.checkpoint"), logFile)
+		if !ztest.ErrorContains(err, "is for") {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
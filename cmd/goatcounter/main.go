@@ -19,6 +19,7 @@ import (
 	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/db/migrate/gomig"
+	_ "zgo.at/goatcounter/v2/kafkasink"
 	"zgo.at/zdb"
 	"zgo.at/zdb/drivers"
 	"zgo.at/zdb/drivers/go-sqlite3"
@@ -52,7 +53,7 @@ func cmdMain(f zli.Flags, ready chan<- struct{}, stop chan struct{}) {
 	defer mainDone.Done()
 
 	cmd, err := f.ShiftCommand("help", "version", "serve", "import",
-		"dashboard", "db", "monitor",
+		"dashboard", "db", "monitor", "replay",
 		"saas", "goat")
 	if zslice.ContainsAny(f.Args, "-h", "-help", "--help") {
 		f.Args = append([]string{cmd}, f.Args...)
@@ -86,6 +87,8 @@ func cmdMain(f zli.Flags, ready chan<- struct{}, stop chan struct{}) {
 		run = cmdSaas
 	case "monitor":
 		run = cmdMonitor
+	case "replay":
+		run = cmdReplay
 	case "import":
 		run = cmdImport
 	case "dashboard":
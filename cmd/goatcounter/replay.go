@@ -0,0 +1,383 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/json"
+	"zgo.at/zli"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zstring"
+)
+
+const usageReplay = `
+Replay pageviews against a GoatCounter instance to load test the ingestion.
+
+This reads pageviews as newline-delimited JSON, in the same format as returned
+by the /api/v0/hits endpoint, and sends them to /count at the given rate:
+
+    $ goatcounter replay -site=http://stats.localhost:8081 -qps=500 hits.ndjson
+
+Use - to read from stdin. All pageviews are read in to memory before sending so
+reading the file never limits the rate.
+
+Don't point this at a production instance: all pageviews are recorded as new
+pageviews.
+
+Flags:
+
+  -debug       Modules to debug, comma-separated or 'all' for all modules.
+               See "goatcounter help debug" for a list of modules.
+
+  -site        Site to send the pageviews to, as an URL (e.g.
+               "http://stats.localhost:8081"). Required.
+
+  -qps         Target requests per second; 0 means as fast as possible in
+               closed-loop mode. Default: 10.
+
+  -concurrency
+               Maximum number of requests in flight. Default: 4.
+
+  -mode        How to send requests:
+
+                   open     Start a new request every 1/qps seconds,
+                            regardless of how long earlier requests take.
+                            Requests that would exceed -concurrency are
+                            dropped and reported, so the schedule never
+                            slips. Use this to find the point where latency
+                            starts to grow. This is the default.
+
+                   closed   Every worker sends the next request as soon as
+                            its previous one finished, up to -qps. Use this to
+                            find the maximum throughput.
+
+  -loop        Replay the input n times. Default: 1.
+
+Requests that get a 429 or 503 response are reported as "throttled"; this is
+the server shedding load because it can't keep up (e.g. the pageview buffer is
+full), rather than an error in the request.
+`
+
+func cmdReplay(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
+	defer func() { ready <- struct{}{} }()
+
+	var (
+		debug       = f.String("", "debug").Pointer()
+		site        = f.String("", "site").Pointer()
+		qps         = f.Float64(10, "qps").Pointer()
+		concurrency = f.Int(4, "concurrency").Pointer()
+		mode        = f.String("open", "mode").Pointer()
+		loop        = f.Int(1, "loop").Pointer()
+	)
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+
+	return func(debug, site, mode string, qps float64, concurrency, loop int) error {
+		zlog.Config.SetDebug(debug)
+
+		files := f.Args
+		if len(files) == 0 {
+			return fmt.Errorf("need a filename")
+		}
+		if len(files) > 1 {
+			return fmt.Errorf("can only specify one filename")
+		}
+		if site == "" {
+			return fmt.Errorf("-site must be set")
+		}
+		if mode != "open" && mode != "closed" {
+			return fmt.Errorf("-mode must be open or closed, not %q", mode)
+		}
+		if concurrency < 1 {
+			return fmt.Errorf("-concurrency must be 1 or more")
+		}
+		if qps < 0 || (qps == 0 && mode == "open") {
+			return fmt.Errorf("-qps must be larger than 0")
+		}
+
+		url := strings.TrimRight(site, "/")
+		if !zstring.HasPrefixes(url, "http://", "https://") {
+			url = "https://" + url
+		}
+
+		var fp io.ReadCloser
+		if files[0] == "-" {
+			fp = io.NopCloser(os.Stdin)
+		} else {
+			file, err := os.Open(files[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			fp = file
+			if strings.HasSuffix(files[0], ".gz") {
+				fp, err = gzip.NewReader(file)
+				if err != nil {
+					return errors.Errorf("could not read as gzip: %w", err)
+				}
+			}
+			defer fp.Close()
+		}
+
+		rows, err := readReplay(fp)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return fmt.Errorf("no pageviews in %q", files[0])
+		}
+		orig := rows
+		for i := 1; i < loop; i++ {
+			rows = append(rows, orig...)
+		}
+
+		stats := replay(replayOptions{
+			url:         url + "/count",
+			qps:         qps,
+			concurrency: concurrency,
+			closed:      mode == "closed",
+			stop:        stop,
+		}, rows)
+		fmt.Fprint(zli.Stdout, stats.String())
+		return nil
+	}(*debug, *site, *mode, *qps, *concurrency, *loop)
+}
+
+// readReplay reads NDJSON export rows.
+func readReplay(fp io.Reader) ([]goatcounter.ExportRow, error) {
+	var (
+		rows []goatcounter.ExportRow
+		scan = bufio.NewScanner(fp)
+		n    int
+	)
+	scan.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scan.Scan() {
+		n++
+		line := bytes.TrimSpace(scan.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var row goatcounter.ExportRow
+		err := json.Unmarshal(line, &row)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, scan.Err()
+}
+
+type replayOptions struct {
+	url         string
+	qps         float64
+	concurrency int
+	closed      bool
+	client      *http.Client
+	stop        <-chan struct{}
+}
+
+type replayStats struct {
+	mu sync.Mutex
+
+	sent      int // Requests sent.
+	errors    int // Network errors and 4xx/5xx responses, except throttled.
+	throttled int // 429 and 503 responses.
+	dropped   int // Not sent because -concurrency was reached in open mode.
+	status    map[int]int
+	latency   []time.Duration
+	elapsed   time.Duration
+}
+
+func (s *replayStats) add(status int, took time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sent++
+	switch {
+	case err != nil:
+		s.errors++
+		return
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		s.throttled++
+	case status >= 400:
+		s.errors++
+	}
+	s.status[status]++
+	s.latency = append(s.latency, took)
+}
+
+func (s *replayStats) percentile(p float64) time.Duration {
+	if len(s.latency) == 0 {
+		return 0
+	}
+	return s.latency[int(float64(len(s.latency)-1)*p)]
+}
+
+func (s *replayStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pct := func(n int) float64 {
+		if s.sent == 0 {
+			return 0
+		}
+		return float64(n) / float64(s.sent) * 100
+	}
+
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "sent:       %d requests in %s (%.1f/s)\n",
+		s.sent, s.elapsed.Round(time.Millisecond), float64(s.sent)/s.elapsed.Seconds())
+	fmt.Fprintf(b, "errors:     %d (%.1f%%)\n", s.errors, pct(s.errors))
+	fmt.Fprintf(b, "throttled:  %d (%.1f%%)\n", s.throttled, pct(s.throttled))
+	if s.dropped > 0 {
+		fmt.Fprintf(b, "dropped:    %d (client reached -concurrency)\n", s.dropped)
+	}
+
+	codes := make([]int, 0, len(s.status))
+	for c := range s.status {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+	status := make([]string, 0, len(codes))
+	for _, c := range codes {
+		status = append(status, fmt.Sprintf("%d: %d", c, s.status[c]))
+	}
+	fmt.Fprintf(b, "status:     %s\n", strings.Join(status, ", "))
+
+	slices.Sort(s.latency)
+	fmt.Fprintf(b, "latency:    p50=%s p90=%s p99=%s max=%s\n",
+		s.percentile(.5).Round(time.Microsecond), s.percentile(.9).Round(time.Microsecond),
+		s.percentile(.99).Round(time.Microsecond), s.percentile(1).Round(time.Microsecond))
+	return b.String()
+}
+
+// replay sends all rows to opts.url.
+func replay(opts replayOptions, rows []goatcounter.ExportRow) *replayStats {
+	if opts.client == nil {
+		opts.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	var (
+		stats    = &replayStats{status: make(map[int]int)}
+		sem      = make(chan struct{}, opts.concurrency)
+		wg       sync.WaitGroup
+		interval time.Duration
+	)
+	if opts.qps > 0 {
+		interval = time.Duration(float64(time.Second) / opts.qps)
+	}
+
+	start := time.Now()
+	next := start
+outer:
+	for _, row := range rows {
+		if interval > 0 {
+			select {
+			case <-opts.stop:
+				break outer
+			case <-time.After(time.Until(next)):
+			}
+			next = next.Add(interval)
+		}
+
+		if opts.closed {
+			select {
+			case <-opts.stop:
+				break outer
+			case sem <- struct{}{}:
+			}
+			// Don't try to catch up after waiting for a free worker, as that
+			// would send a burst above the target rate.
+			if now := time.Now(); next.Before(now) {
+				next = now
+			}
+		} else {
+			select {
+			case sem <- struct{}{}:
+			default:
+				stats.mu.Lock()
+				stats.dropped++
+				stats.mu.Unlock()
+				continue
+			}
+		}
+
+		wg.Add(1)
+		go func(row goatcounter.ExportRow) {
+			defer func() { <-sem; wg.Done() }()
+			s := time.Now()
+			status, err := replaySend(opts.client, opts.url, row)
+			if err != nil {
+				zlog.Module("replay").Debug(err)
+			}
+			stats.add(status, time.Since(s), err)
+		}(row)
+	}
+	wg.Wait()
+	stats.elapsed = time.Since(start)
+	return stats
+}
+
+func replaySend(c *http.Client, url string, row goatcounter.ExportRow) (int, error) {
+	hit := goatcounter.Hit{
+		Path:  row.Path,
+		Title: row.Title,
+		Ref:   row.Ref,
+		Event: row.Event == "true",
+	}
+	if row.Size != "" {
+		err := hit.Size.UnmarshalText([]byte(row.Size))
+		if err != nil {
+			return 0, err
+		}
+	}
+	body, err := json.Marshal(hit)
+	if err != nil {
+		return 0, err
+	}
+
+	r, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("User-Agent", row.UserAgent)
+	// Keep the sessions roughly intact, as the session is derived from the
+	// User-Agent and IP address.
+	if !row.Session.IsZero() {
+		r.Header.Set("X-Forwarded-For", replayIP(row))
+	}
+
+	resp, err := c.Do(r)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// replayIP gets a fake IP address in 10.0.0.0/8 for the session.
+func replayIP(row goatcounter.ExportRow) string {
+	b := binary.BigEndian.AppendUint64(nil, row.Session[0]^row.Session[1])
+	return fmt.Sprintf("10.%d.%d.%d", b[5], b[6], b[7])
+}
@@ -0,0 +1,195 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/json"
+)
+
+type replayServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	times    []time.Time
+	bodies   []string
+	inFlight atomic.Int32
+	maxIn    atomic.Int32
+}
+
+func newReplayServer(t *testing.T, delay time.Duration, status func(n int) int) *replayServer {
+	s := &replayServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		for {
+			m := s.maxIn.Load()
+			if n <= m || s.maxIn.CompareAndSwap(m, n) {
+				break
+			}
+		}
+
+		b, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.times = append(s.times, time.Now())
+		s.bodies = append(s.bodies, string(b))
+		c := len(s.times)
+		s.mu.Unlock()
+
+		time.Sleep(delay)
+		if status != nil {
+			w.WriteHeader(status(c))
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func replayRows(n int) []goatcounter.ExportRow {
+	rows := make([]goatcounter.ExportRow, n)
+	for i := range rows {
+		rows[i] = goatcounter.ExportRow{Path: "/x", UserAgent: "Mozilla/5.0"}
+	}
+	return rows
+}
+
+func TestReplayRate(t *testing.T) {
+	for _, closed := range []bool{false, true} {
+		name := "open"
+		if closed {
+			name = "closed"
+		}
+		t.Run(name, func(t *testing.T) {
+			srv := newReplayServer(t, 0, nil)
+			stats := replay(replayOptions{url: srv.URL, qps: 100, concurrency: 4, closed: closed}, replayRows(40))
+
+			if stats.sent != 40 || stats.errors != 0 || stats.dropped != 0 {
+				t.Fatalf("sent=%d errors=%d dropped=%d", stats.sent, stats.errors, stats.dropped)
+			}
+
+			// 40 requests at 100/s: the first is sent immediately, so it should
+			// take 390ms. Allow some leeway for slow CI machines.
+			srv.mu.Lock()
+			took := srv.times[len(srv.times)-1].Sub(srv.times[0])
+			srv.mu.Unlock()
+			if took < 350*time.Millisecond || took > 600*time.Millisecond {
+				t.Errorf("took %s; want ~390ms", took)
+			}
+		})
+	}
+}
+
+func TestReplayClosed(t *testing.T) {
+	srv := newReplayServer(t, 20*time.Millisecond, nil)
+	stats := replay(replayOptions{url: srv.URL, concurrency: 2, closed: true}, replayRows(10))
+
+	if stats.sent != 10 || stats.dropped != 0 {
+		t.Fatalf("sent=%d dropped=%d", stats.sent, stats.dropped)
+	}
+	if m := srv.maxIn.Load(); m > 2 {
+		t.Errorf("max in flight: %d", m)
+	}
+	// 5 rounds of 2 requests that take 20ms each.
+	if stats.elapsed < 100*time.Millisecond {
+		t.Errorf("elapsed %s; want at least 100ms", stats.elapsed)
+	}
+}
+
+func TestReplayOpen(t *testing.T) {
+	// Server is slower than the rate, so the open loop should drop requests
+	// rather than slowing down.
+	srv := newReplayServer(t, 50*time.Millisecond, nil)
+	stats := replay(replayOptions{url: srv.URL, qps: 100, concurrency: 1}, replayRows(10))
+
+	if stats.dropped == 0 {
+		t.Errorf("nothing dropped")
+	}
+	if stats.sent+stats.dropped != 10 {
+		t.Errorf("sent=%d dropped=%d", stats.sent, stats.dropped)
+	}
+	if m := srv.maxIn.Load(); m > 1 {
+		t.Errorf("max in flight: %d", m)
+	}
+	if stats.elapsed > 250*time.Millisecond {
+		t.Errorf("elapsed %s; schedule slipped", stats.elapsed)
+	}
+}
+
+func TestReplayStats(t *testing.T) {
+	srv := newReplayServer(t, 0, func(n int) int {
+		switch n % 4 {
+		case 0:
+			return 429
+		case 1:
+			return 400
+		}
+		return 200
+	})
+	stats := replay(replayOptions{url: srv.URL, qps: 1000, concurrency: 1, closed: true}, replayRows(8))
+
+	if stats.errors != 2 || stats.throttled != 2 || stats.status[200] != 4 {
+		t.Errorf("errors=%d throttled=%d status=%v", stats.errors, stats.throttled, stats.status)
+	}
+	out := stats.String()
+	for _, want := range []string{"sent:       8 requests", "errors:     2 (25.0%)",
+		"throttled:  2 (25.0%)", "status:     200: 4, 400: 2, 429: 2", "latency:    p50="} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q not in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestReplayCmd(t *testing.T) {
+	exit, _, out, _, _ := startTest(t)
+
+	srv := newReplayServer(t, 0, nil)
+
+	file := filepath.Join(t.TempDir(), "hits.ndjson")
+	var b strings.Builder
+	for _, r := range []goatcounter.ExportRow{
+		{Path: "/a", Title: "A", UserAgent: "Mozilla/5.0", Size: "1920,1080,1"},
+		{Path: "/b", Event: "true", Ref: "https://example.com", Session: goatcounter.TestSession},
+		{Path: "/a"},
+	} {
+		j, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Write(j)
+		b.WriteString("\n")
+	}
+	err := os.WriteFile(file, []byte(b.String()), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runCmd(t, exit, "replay", "-site="+srv.URL, "-qps=100", "-loop=2", file)
+	wantExit(t, exit, out, 0)
+	if !strings.Contains(out.String(), "sent:       6 requests") {
+		t.Error(out.String())
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.bodies) != 6 {
+		t.Fatalf("len(bodies) = %d", len(srv.bodies))
+	}
+	for _, want := range []string{`"p":"/a"`, `"t":"A"`, `"s":"1920,1080,1"`, `"e":true`, `"r":"https://example.com"`} {
+		if !strings.Contains(strings.Join(srv.bodies, "\n"), want) {
+			t.Errorf("%s not sent:\n%s", want, strings.Join(srv.bodies, "\n"))
+		}
+	}
+}
@@ -5,16 +5,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
 	"os/signal"
 	"os/user"
+	"regexp"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -29,6 +33,7 @@ import (
 	"zgo.at/goatcounter/v2/acme"
 	"zgo.at/goatcounter/v2/cron"
 	"zgo.at/goatcounter/v2/handlers"
+	"zgo.at/goatcounter/v2/proxyproto"
 	"zgo.at/z18n"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
@@ -115,24 +120,430 @@ Flags:
                version built-in; you only need this if you want to use a
                newer/different version, or if you want to record regions.
 
+  -geodb-format  Format of the -geodb database:
+
+                   maxmind   MaxMind GeoIP2 or GeoLite2 (default).
+                   dbip      DB-IP in the mmdb format; the free "lite"
+                             versions don't include region codes, so only
+                             the country is recorded.
+
+  -geodb-concurrency
+               Maximum number of concurrent lookups in the -geodb database, so
+               a spike in pageviews doesn't pile up on it; 0 means no limit.
+               Default: 0.
+
+  -geodb-wait  Milliseconds to wait for a free slot if -geodb-concurrency is
+               reached; the location is recorded as unknown after that. Use 0
+               to never wait. Default: 50.
+
+  -geodb-degrade-country
+               Only record the country and not the region once there are this
+               many requests to /count in progress, to shed work under load;
+               the region is recorded again once it drops below half of this.
+               0 means never. Default: 0.
+
+  -geodb-degrade-off
+               Don't look up the location at all once there are this many
+               requests to /count in progress, as in -geodb-degrade-country.
+               0 means never. Default: 0.
+
+               This can't be used with -hit-sink-regions, as pageviews without
+               a location would be stored in the default sink.
+
+               The current mode is reported as "geo" in /status.
+
+  -geodb-update
+               Download a new GeoIP database from this URL on a schedule, for
+               example for MaxMind GeoLite2:
+
+                 https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-City&license_key={license_key}&suffix=tar.gz
+
+               The URL can be a mmdb file, a gzip-compressed mmdb file, or a
+               tar.gz with a mmdb file. The database is written to -geodb if
+               it's set, and only used once it's fully downloaded and
+               verified; the previous database is kept if it fails. The
+               status is in /status. Default: not set.
+
+  -geodb-update-key
+               Replace {license_key} in -geodb-update with this. Default: not
+               set.
+
+  -geodb-update-every
+               Hours between updates. Default: 168 (once a week).
+
+  -geodb-update-retries
+               Number of times to retry a failed download; the wait between
+               retries starts at -geodb-update-backoff seconds and doubles
+               after every retry. Default: 5 retries, 60 seconds backoff.
+
+  -geodb-update-backoff
+               See -geodb-update-retries.
+
+  -geodb-private
+               Also look up private, loopback, link-local, and reserved IP
+               addresses in the -geodb database; by default they're recorded
+               without a location, as they're not in the standard databases.
+               This is only useful for custom databases; this also applies to
+               -asndb.
+
+  -asndb       Path to mmdb ASN database, such as MaxMind GeoLite2 ASN, to
+               record the network of visitors for sites with "Network (ASN)"
+               collection enabled, and to flag pageviews from hosting
+               providers as bots (97) for sites with "Flag hosting providers"
+               enabled. Default: not set, which disables both.
+
   -ratelimit   Set rate limits for various actions; the syntax is
                "name:num-requests/seconds"; multiple values are separated by
                a comma. The defaults are:
 
                    count:4/1            4 requests / second
+                   count-error:10/60   10 requests / minute, per site and visitor
                    api:4/1              4 requests / seconds
                    api-count:60/120    60 requests / 2 minutes
+                   api-active:30/60    30 requests / minute
                    export:1/3600        1 requests / hour
                    login:20/60         20 requests / minute
+                   site-create:10/3600 10 sites / hour, for -unknown-site create
+                                       and verify
+                   site-verify:60/3600 60 DNS lookups / hour, for -unknown-site
+                                       verify
 
                If one of the names is omitted it will fall back to the default
                value; for example "-ratelimit export:3/3600,api:100/1" will use
                the default for "count", "login", etc.
 
+  -decode-errors
+               Log at most this many identical errors for malformed /count
+               requests per site in the window, as "num/seconds"; any more are
+               collapsed in to a single summary line at the end of the window.
+               Default: 5/60.
+
+  -hit-sink    Where to store pageviews, as "name" or "name:connect". The
+               default "sql" stores them in the hits table of -db; other sinks
+               need to be compiled in with goatcounter.RegisterHitSink(). The
+               stats tables are always stored in -db. Default: sql.
+
+               "kafka" publishes them to a Kafka topic; the options are in the
+               URL query format, for example:
+
+                   kafka:brokers=localhost:9092&topic=goatcounter&db=true
+
+               See the kafkasink package documentation for all options.
+
+  -hit-sink-regions
+               File with a sink for every region, to store pageviews in a
+               different sink depending on the visitor's country. Every line
+               is "sink [region] [sink]", with the sink as in -hit-sink, or
+               "countries [region] [country codes...]":
+
+                   sink      eu kafka:brokers=kafka.eu.example.com:9092&topic=gc
+                   countries eu AT BE BG CY CZ DE DK EE ES FI FR GR HR HU IE ...
+
+               Pageviews with an unknown location or from other countries are
+               stored in -hit-sink. The stats tables are still stored in -db,
+               so the aggregated stats for all regions are in one database.
+               If one region fails only the pageviews for that region are
+               retried. Default: not set.
+
+  -hit-sink-secondary
+               Also store pageviews in this sink, as in -hit-sink; can be
+               added more than once. Every secondary sink is written in the
+               background with its own backlog and retries, so a failing
+               secondary sink doesn't hold up -hit-sink or new pageviews. The
+               delivery state is shown on /bosmang/metrics. Default: not set.
+
+  -memstore-max
+               Maximum number of pageviews to keep in memory until they're
+               persisted (see -store-every); 0 means no limit. Pageviews over
+               the limit are written to -memstore-overflow, or dropped if
+               that's not set. Default: 0.
+
+  -memstore-drop
+               What to drop if -memstore-max is reached and -memstore-overflow
+               is full or not set:
+
+                 new   Drop new pageviews.
+                 old   Drop the oldest pageviews in memory to make room.
+
+               Default: new.
+
+  -memstore-overflow
+               File to write pageviews that don't fit in -memstore-max to,
+               rather than dropping them. This is a ring buffer of
+               -memstore-overflow-size MB; pageviews are moved back to memory
+               when there is room again, and are kept on restarts.
+
+               The IP address, User-Agent, and language headers are encrypted
+               with a key that's stored with the sessions on shutdown; if the
+               key is lost (e.g. after a crash) these pageviews are still
+               stored, but as anonymous pageviews without a session. Default:
+               not set.
+
+  -memstore-overflow-size
+               Maximum size of -memstore-overflow in MB. Default: 64.
+
+  -memstore-drain
+               Move at most this many pageviews from -memstore-overflow back
+               to memory every -store-every seconds, so a large backlog is
+               processed gradually; 0 means up to -memstore-max. Default: 1000.
+
+  -flush-batch Maximum number of pageviews to write to -hit-sink in one
+               transaction; larger batches (e.g. after the database was
+               unavailable for a while) are split and written one after the
+               other. A batch that fails is retried on the next -store-every,
+               without the batches that were already written; the retried
+               pageviews count toward -memstore-max. 0 means no limit.
+               Default: 10000.
+
+  -flush-batch-size
+               Maximum size of a batch as in -flush-batch, in KB; this is the
+               approximate size of the database rows. 0 means no limit.
+               Default: 0.
+
+  -cache-ttl   Maximum age in minutes for entries in the in-memory caches for
+               sessions and sampling, overriding the default for every cache;
+               0 uses the defaults (4 hours for sessions). Nonces of signed
+               pageviews are always kept for as long as the signature is
+               valid. Default: 0.
+
+  -cache-budget
+               Maximum number of entries in all in-memory caches combined;
+               entries are evicted early if there are more. 0 means no limit.
+               Default: 0.
+
+  -cache-interval
+               Evict expired entries from the in-memory caches every this many
+               seconds; this is also when -cache-budget is enforced, so the
+               caches can grow beyond the budget in between. Default: 60.
+
+  -session-hash
+               Hash algorithm for the session hashes of the IP address and
+               User-Agent: "sha256" or "blake2b". Default: sha256.
+
+  -session-pepper
+               File with a secret "pepper" that's added to every session hash
+               (as the HMAC key for sha256, or the key for blake2b, which can
+               be at most 64 bytes). This is never stored in the database, so
+               it can be kept and rotated outside of GoatCounter. Trailing
+               newlines are removed. Default: $GOATCOUNTER_SESSION_PEPPER, or
+               no pepper if that's not set.
+
+               Changing -session-hash or the pepper starts new sessions for all
+               visitors.
+
+  -session-grace
+               The salt for the session hashes is rotated every 4 hours; the
+               previous salt is still checked for this many minutes after the
+               rotation, so that visitors who were active just before it keep
+               their session. Between 1 and 240. Default: 240.
+
+  -active-window
+               Minutes a visitor is counted as reading a page after their last
+               pageview, for /api/v0/stats/active. Between 1 and 60. Default: 5.
+
+  -count-bots  Bot categories that are still counted as pageviews, as a
+               comma-separated list of isbot.Result values (e.g. "3,4"). These
+               pageviews are still stored as a bot, but are included in the
+               dashboard totals. Default: not set; bots are never counted.
+
+  -bot-classes Class to store for bot categories, as a comma-separated list of
+               category:class (e.g. "5:search,150:other"). The class is a
+               coarser grouping of the isbot.Result values: search, preview,
+               monitor, scraper, or other, but any lower-case name can be
+               used. This overrides the built-in classes, including the ones
+               detected from the User-Agent.
+
+  -ignored-status
+               HTTP status code for /count requests that are deliberately not
+               recorded, such as for IPs in the site's ignore list; this can
+               be 200 or 202. The X-Goatcounter header always explains why the
+               pageview was ignored. Default: 202.
+
+  -max-ignore-ips
+               Maximum number of entries in a site's "Ignore IPs" setting; 0
+               means no limit. Default: 1000.
+
+  -count-min-body
+               Ignore POST requests to /count with a Content-Length below this
+               many bytes without reading the body; this is sent the same
+               status code as -ignored-status. Requests without a
+               Content-Length are always read, as are requests that don't need
+               a body: with query parameters or the hit in the path, or for
+               sites that take the path from the Referer or have a default
+               path. Use 0 to disable. Default: 1.
+
+  -count-pad
+               Pad the response time of /count to at least this many
+               milliseconds, so that how long it takes doesn't reveal if the
+               pageview was ignored, detected as a bot, etc. Requests are sent
+               as soon as they're done if more than 1,000 requests are already
+               being padded. Maximum of 5000. Default: 0 (disabled).
+
+  -count-max-age
+               Let browsers cache CORS preflight (OPTIONS) requests to the
+               /count endpoints for this many seconds, which are sent for
+               POST requests with a JSON body or X-Goatcounter-* headers.
+               Browsers may use a lower maximum; 0 doesn't send the
+               Access-Control-Max-Age header. Default: 7200.
+
+  -count-compress-min
+               Compress JSON responses from the /count endpoints, such as
+               /count/stream, with gzip if they're at least this many bytes
+               and the client accepts it; smaller responses and the GIF are
+               never compressed. Use -1 to disable. Default: 1024.
+
+  -import-max-ratio
+               Maximum ratio of the decompressed to the compressed size for
+               gzip or zstd compressed uploads to /api/v0/import; the upload
+               is stopped with a 413 once it's larger than this. Use 0 to
+               reject compressed uploads. Default: 100.
+
+  -count-prefix
+               Also serve /count and /count.js under this path prefix, for a
+               reverse proxy on your site's domain that forwards requests for
+               e.g. /_stats/count to GoatCounter. The embed code on the
+               dashboard and in the documentation includes the prefix.
+               Default: not set.
+
+  -client-ip-header
+               Read the client IP for pageviews from this header before
+               looking at X-Forwarded-For, for example X-Client-Real-IP. Only
+               use this if a proxy always sets the header, as anyone can send
+               it otherwise. Default: not set.
+
+  -client-ip-proxies
+               Only use -client-ip-header, -tls-header, and X-Forwarded-Proto
+               for connections from these proxies; comma-separated list of IP
+               addresses or CIDR ranges. Without this the headers are trusted
+               from everyone. Default: not set.
+
+  -proxy-protocol
+               Read the client address from the PROXY protocol (v1 or v2)
+               header that TCP load balancers such as HAProxy or AWS NLB send
+               at the start of the connection. Only enable this if
+               GoatCounter is behind such a load balancer, as anyone can send
+               the header otherwise. Connections from -client-ip-proxies must
+               send the header; other connections are used as-is. This also
+               applies to the port 80 redirect with -tls=rdr. Default: false.
+
+  -client-ip-precedence
+               Which IP to use if -client-ip-header and X-Forwarded-For are
+               both set and have a different IP; "header" or
+               "forwarded-for". Default: header.
+
+  -client-ip-conflict
+               Add "X-Goatcounter: ip header conflict" to the /count
+               response if -client-ip-header and X-Forwarded-For have a
+               different IP, to debug the proxy configuration.
+
+  -tls-header  Read the TLS version and cipher suite from this header if TLS
+               is terminated at a proxy, for sites that collect it. The value
+               should be the version and cipher suite separated by a space,
+               for example with nginx:
+
+                 proxy_set_header X-TLS "$ssl_protocol $ssl_cipher";
+
+               The cipher suite can be the IANA name (e.g.
+               TLS_AES_128_GCM_SHA256) or the number (e.g. 0x1301); other
+               names (such as the OpenSSL names nginx uses for TLS 1.2) are
+               stored as unknown. Default: not set, which means it's only
+               collected for TLS connections directly to GoatCounter.
+
+  -count-min-tls
+               Reject requests to /count sent with a TLS version below this
+               with a 426 and "X-Goatcounter-Code: tls_version"; can be 1.0,
+               1.1, 1.2, or 1.3. The version is read from -tls-header if TLS
+               is terminated at a proxy. Requests over plain HTTP or with an
+               unknown version are also rejected. Default: not set, which
+               accepts every version.
+
+  -unknown-site
+               What to do with /count requests for a host that doesn't match
+               any site:
+
+                 gif      Send the GIF as if the pageview was recorded, so it
+                          won't tell which sites exist.
+                 404      Send a 404 with "X-Goatcounter: unknown site".
+                 create   Create a new site for the host, in the first
+                          account.
+                 verify   Create a new site for the host with the default
+                          settings, if it has a TXT record on
+                          _goatcounter.[host] with the value
+                          "goatcounter-verify". Send the GIF otherwise.
+
+               The number of sites that are created is limited by the
+               "site-create" -ratelimit, and the DNS lookups for "verify" by the
+               "site-verify" -ratelimit. If there is just one site then it's
+               used for all hosts, except with "create" and "verify".
+               Default: gif.
+
+  -ip-host     What to do with /count requests where the Host is an IPv4 or
+               IPv6 address rather than a domain, which are usually from
+               scanners:
+
+                 default  Handle it like any other host, as configured by
+                          -unknown-site.
+                 drop     Send the GIF with "X-Goatcounter: host is an IP
+                          address", without recording anything.
+                 [id]     Record it in the site with this ID, so the traffic
+                          can be looked at separately. Dropped if the site
+                          doesn't exist.
+
+               Default: default.
+
+  -empty-ua    What to do with /count requests without a User-Agent header:
+
+                 detect   Flag it as a bot with a short User-Agent (7), like
+                          any other User-Agent that's too short.
+                 bot      Flag it as a bot with a "no User-Agent" category
+                          (99), so it can be counted separately with
+                          -count-bots.
+                 drop     Don't record it; this is sent the same status code
+                          as -ignored-status.
+                 count    Count it as a regular pageview.
+
+               Default: detect, rather than count: requests without a
+               User-Agent were always flagged as bots, and counting them by
+               default would start counting most scripts as pageviews.
+
+  -sync-count  Write pageviews from /count and /count/stream to the database
+               before sending the response, instead of buffering them in
+               memory and writing them every -store-every seconds. This is
+               slower, but useful for server-side callers that want to know the
+               pageview was stored. What to do if the write fails:
+
+                 off      Don't write right away (the default).
+                 gif      Return the GIF as if it was stored; the pageview is
+                          lost. /count/stream rejects the line with
+                          storage_error.
+                 error    Return a 503 with "X-Goatcounter: storage error", so
+                          it can be retried. /count/stream stops at the first
+                          line that fails, and returns the result with a 503.
+
+  -monitor-uas File with User-Agents of uptime monitors that are flagged as a
+               bot (98) for sites with "Flag uptime monitors" enabled; one
+               case-insensitive substring per line. This replaces the built-in
+               list, so it can be updated without a new release. See
+               pack/monitors.txt in the source for the format.
+
   -api-max     Maximum number of items /api/ endpoints will return. Set to 0 for
                the defaults (200 for paths, 100 for everything else), or <0 for
                no limit.
 
+  -export-concurrency
+               Maximum number of exports that can run at the same time for all
+               sites; this includes CSV exports that are streamed like
+               /api/v0/export/aggregate. 0 means no limit. Default: 0.
+
+  -export-concurrency-site
+               Maximum number of exports that can run at the same time for a
+               single site, as in -export-concurrency. 0 means no limit.
+               Default: 2.
+
+  -export-wait Seconds to wait for a free slot if -export-concurrency or
+               -export-concurrency-site is reached; the export is rejected with
+               a 429 after that. Use 0 to never wait. Default: 1.
+
   -websocket   Use a websocket to send data. The advantage of this is that the
                perceived performance is quite a bit better, especially with a
                lot of data, since things can be loaded "lazily". The downside is
@@ -146,6 +557,11 @@ Flags:
 
   -dev         Start in "dev mode".
 
+  -local-refs  Record referrers from localhost, loopback addresses, and
+               file:// as "(local)", for testing the integration during
+               development; by default localhost is ignored as spam and the
+               others are stored as-is. Can only be used with -dev.
+
   -debug       Modules to debug, comma-separated or 'all' for all modules.
                See "goatcounter help debug" for a list of modules.
 
@@ -154,8 +570,13 @@ Environment:
   TMPDIR       Directory for temporary files; only used to store CSV exports at
                the moment. On Windows it will use the first non-empty value of
                %TMP%, %TEMP%, and %USERPROFILE%.
+
+  GOATCOUNTER_SESSION_PEPPER
+               Pepper for the session hashes, if -session-pepper isn't set.
 `
 
+var reBotClass = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
 func cmdServe(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 	v := zvalidate.New()
 
@@ -163,17 +584,116 @@ func cmdServe(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 		// TODO(depr): -port is for compat with <2.0
 		port         = f.Int(0, "public-port", "port").Pointer()
 		domainStatic = f.String("", "static").Pointer()
+		countBots    = f.String("", "count-bots").Pointer()
+		botClasses   = f.String("", "bot-classes").Pointer()
+		ignored      = f.Int(202, "ignored-status").Pointer()
+		maxIgnore    = f.Int(1000, "max-ignore-ips").Pointer()
+		minBody      = f.Int(1, "count-min-body").Pointer()
+		ipHeader     = f.String("", "client-ip-header").Pointer()
+		ipProxies    = f.String("", "client-ip-proxies").Pointer()
+		ipPrec       = f.String(goatcounter.ClientIPPrecedenceHeader, "client-ip-precedence").Pointer()
+		ipConflict   = f.Bool(false, "client-ip-conflict").Pointer()
+		proxyProto   = f.Bool(false, "proxy-protocol").Pointer()
+		unknownSite  = f.String(goatcounter.UnknownSiteGIF, "unknown-site").Pointer()
+		ipHost       = f.String(goatcounter.IPHostDefault, "ip-host").Pointer()
+		emptyUA      = f.String(goatcounter.EmptyUADetect, "empty-ua").Pointer()
+		syncCount    = f.String(goatcounter.SyncCountOff, "sync-count").Pointer()
+		tlsHeader    = f.String("", "tls-header").Pointer()
+		countMinTLS  = f.String("", "count-min-tls").Pointer()
+		countPrefix  = f.String("", "count-prefix").Pointer()
+		countPad     = f.Int(0, "count-pad").Pointer()
+		maxAge       = f.Int(7200, "count-max-age").Pointer()
+		compressMin  = f.Int(1024, "count-compress-min").Pointer()
+		importRatio  = f.Int(100, "import-max-ratio").Pointer()
+		monitorUAs   = f.String("", "monitor-uas").Pointer()
+		localRefs    = f.Bool(false, "local-refs").Pointer()
 	)
 	dbConnect, dbConn, dev, automigrate, listen, flagTLS, from, websocket, apiMax, err := flagsServe(f, &v)
 	if err != nil {
 		return err
 	}
 
-	return func(port int, domainStatic string) error {
+	return func(port int, domainStatic, countBots, botClasses string, ignored, maxIgnore, minBody int, ipHeader, ipProxies, ipPrec string, ipConflict, proxyProto bool, unknownSite, ipHost, emptyUA, syncCount, tlsHeader, countMinTLS, countPrefix string, countPad, maxAge, compressMin, importRatio int, monitorUAs string, localRefs bool) error {
 		if flagTLS == "" {
 			flagTLS = map[bool]string{true: "http", false: "acme,rdr"}[dev]
 		}
 
+		var bots []int
+		if countBots != "" {
+			for _, b := range strings.Split(countBots, ",") {
+				bots = append(bots, int(v.Integer("-count-bots", strings.TrimSpace(b))))
+			}
+		}
+		var classes map[int]string
+		if botClasses != "" {
+			classes = make(map[int]string)
+			for _, b := range strings.Split(botClasses, ",") {
+				bot, class, ok := strings.Cut(strings.TrimSpace(b), ":")
+				if !ok || !reBotClass.MatchString(class) {
+					v.Append("-bot-classes", fmt.Sprintf("invalid entry %q", b))
+					continue
+				}
+				classes[int(v.Integer("-bot-classes", bot))] = class
+			}
+		}
+		if ignored != 200 && ignored != 202 {
+			v.Append("-ignored-status", "must be 200 or 202")
+		}
+		v.Include("-client-ip-precedence", ipPrec, goatcounter.ClientIPPrecedences)
+		v.Include("-unknown-site", unknownSite, goatcounter.UnknownSites)
+		var ipHostSite int64
+		if ipHost != goatcounter.IPHostDefault && ipHost != goatcounter.IPHostDrop {
+			n, err := strconv.ParseInt(ipHost, 10, 64)
+			if err != nil || n <= 0 {
+				v.Append("-ip-host", "must be default, drop, or a site ID")
+			}
+			ipHostSite = n
+			ipHost = goatcounter.IPHostSite
+		}
+		v.Include("-empty-ua", emptyUA, goatcounter.EmptyUAs)
+		v.Include("-sync-count", syncCount, goatcounter.SyncCounts)
+		minTLS, ok := map[string]uint16{"": 0, "1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11,
+			"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}[countMinTLS]
+		if !ok {
+			v.Append("-count-min-tls", "must be 1.0, 1.1, 1.2, or 1.3")
+		}
+		if countPrefix != "" && (!strings.HasPrefix(countPrefix, "/") || strings.HasSuffix(countPrefix, "/")) {
+			v.Append("-count-prefix", "must start with a / and not end with a /")
+		}
+		v.Range("-count-pad", int64(countPad), 0, 5000)
+		v.Range("-count-max-age", int64(maxAge), 0, 86400)
+		v.Range("-count-compress-min", int64(compressMin), -1, 1<<20)
+		v.Range("-import-max-ratio", int64(importRatio), 0, 10000)
+		if monitorUAs != "" {
+			if err := goatcounter.LoadMonitors(monitorUAs); err != nil {
+				v.Append("-monitor-uas", err.Error())
+			}
+		}
+		if localRefs && !dev {
+			v.Append("-local-refs", "can only be used with -dev")
+		}
+
+		var proxies []netip.Prefix
+		if ipProxies != "" {
+			for _, p := range strings.Split(ipProxies, ",") {
+				p = strings.TrimSpace(p)
+				if !strings.ContainsRune(p, '/') {
+					a, err := netip.ParseAddr(p)
+					if err != nil {
+						v.Append("-client-ip-proxies", fmt.Sprintf("invalid IP address: %q", p))
+						continue
+					}
+					p = netip.PrefixFrom(a, a.BitLen()).String()
+				}
+				pp, err := netip.ParsePrefix(p)
+				if err != nil {
+					v.Append("-client-ip-proxies", fmt.Sprintf("invalid CIDR range: %q", p))
+					continue
+				}
+				proxies = append(proxies, pp.Masked())
+			}
+		}
+
 		var domainCount, urlStatic string
 		if domainStatic != "" {
 			if p := strings.Index(domainStatic, ":"); p > -1 {
@@ -206,6 +726,31 @@ func cmdServe(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 		c.URLStatic = urlStatic
 		c.DomainCount = domainCount
 		c.Websocket = websocket
+		c.CountBots = bots
+		c.BotClasses = classes
+		c.IgnoredStatus = ignored
+		c.MaxIgnoreIPs = maxIgnore
+		c.CountMinBody = int64(minBody)
+		c.ClientIPHeader = http.CanonicalHeaderKey(ipHeader)
+		c.ClientIPProxies = proxies
+		c.ClientIPPrecedence = ipPrec
+		c.ClientIPConflict = ipConflict
+		c.ProxyProtocol = proxyProto
+		c.UnknownSite = unknownSite
+		c.IPHost = ipHost
+		c.IPHostSiteID = ipHostSite
+		c.EmptyUA = emptyUA
+		c.SyncCount = syncCount
+		c.CountMinTLS = minTLS
+		c.CountPrefix = countPrefix
+		c.CountPad = time.Duration(countPad) * time.Millisecond
+		c.CountMaxAge = time.Duration(maxAge) * time.Second
+		c.CountCompressMin = compressMin
+		c.ImportMaxRatio = importRatio
+		c.LocalRefs = localRefs
+		if tlsHeader != "" {
+			c.TLSHeader = http.CanonicalHeaderKey(tlsHeader)
+		}
 
 		// Set up HTTP handler and servers.
 		hosts := map[string]http.Handler{
@@ -236,7 +781,7 @@ func cmdServe(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 			}
 			ready <- struct{}{}
 		})
-	}(*port, *domainStatic)
+	}(*port, *domainStatic, *countBots, *botClasses, *ignored, *maxIgnore, *minBody, *ipHeader, *ipProxies, *ipPrec, *ipConflict, *proxyProto, *unknownSite, *ipHost, *emptyUA, *syncCount, *tlsHeader, *countMinTLS, *countPrefix, *countPad, *maxAge, *compressMin, *importRatio, *monitorUAs, *localRefs)
 }
 
 func doServe(ctx context.Context, db zdb.DB,
@@ -246,7 +791,11 @@ func doServe(ctx context.Context, db zdb.DB,
 
 	var sig = make(chan os.Signal, 1)
 	zlog.Module("startup").Debug(getVersion())
-	ch, err := zhttp.Serve(listenTLS, stop, &http.Server{
+	serve := zhttp.Serve
+	if goatcounter.Config(ctx).ProxyProtocol {
+		serve = serveProxyProtocol(goatcounter.Config(ctx).ClientIPProxies)
+	}
+	ch, err := serve(listenTLS, stop, &http.Server{
 		Addr:        listen,
 		Handler:     zhttp.HostRoute(hosts),
 		TLSConfig:   tlsc,
@@ -275,6 +824,16 @@ func doServe(ctx context.Context, db zdb.DB,
 			zlog.Error(err)
 		}
 		goatcounter.Memstore.StoreSessions(db)
+		err = goatcounter.Memstore.Sink().Close()
+		if err != nil {
+			zlog.Error(err)
+		}
+		if o := goatcounter.Memstore.Overflow(); o != nil {
+			err = o.Close()
+			if err != nil {
+				zlog.Error(err)
+			}
+		}
 	})
 
 	time.Sleep(200 * time.Millisecond) // Only show message if it doesn't exit in 200ms.
@@ -301,8 +860,150 @@ func doServe(ctx context.Context, db zdb.DB,
 	return nil
 }
 
+// serveProxyProtocol is like zhttp.Serve(), but reads the PROXY protocol header
+// on connections from the trusted addresses, for both the server and the port
+// 80 redirect.
+//
+// This can't use zhttp.Serve() as there's no way to wrap its listener; listen
+// is the only difference, everything else should be kept the same.
+func serveProxyProtocol(trusted []netip.Prefix) func(uint8, chan struct{}, *http.Server) (chan struct{}, error) {
+	listen := func(addr string) (net.Listener, error) {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return &proxyproto.Listener{Listener: ln, Trusted: trusted}, nil
+	}
+
+	return func(flags uint8, stop chan struct{}, server *http.Server) (chan struct{}, error) {
+		server.Addr = strings.TrimPrefix(server.Addr, "*")
+		host, port, err := net.SplitHostPort(server.Addr)
+		if err != nil {
+			host, port = server.Addr, "443"
+		}
+		if server.ReadHeaderTimeout == 0 {
+			server.ReadHeaderTimeout = 10 * time.Second
+		}
+		if server.ReadTimeout == 0 {
+			server.ReadTimeout = 60 * time.Second
+		}
+		if server.WriteTimeout == 0 {
+			server.WriteTimeout = 60 * time.Second
+		}
+		if server.IdleTimeout == 0 {
+			server.IdleTimeout = 120 * time.Second
+		}
+		if server.ErrorLog == nil {
+			server.ErrorLog = zhttp.LogWrap("http: TLS handshake", "http2: received GOAWAY",
+				"http2: server: error reading preface", "http2: timeout waiting for SETTINGS",
+				"http: URL query contains semicolon", "write tcp ")
+		}
+
+		ln, err := listen(server.Addr)
+		if err != nil {
+			if errors.Is(err, os.ErrPermission) {
+				fmt.Fprintf(os.Stderr, "\nPermission denied to bind to port %s; on Linux, try:\n", port)
+				fmt.Fprintf(os.Stderr, "    %s\n", setcapCmd())
+			}
+			return nil, fmt.Errorf("serveProxyProtocol: %w", err)
+		}
+		server.Addr = ln.Addr().String()
+
+		ch := make(chan struct{}, 1)
+		go func() {
+			s := make(chan os.Signal, 1)
+			signal.Notify(s, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+			select {
+			case <-s:
+			case <-stop:
+			}
+			err := server.Shutdown(context.Background())
+			if err != nil {
+				zlog.Errorf("serveProxyProtocol shutdown: %s", err)
+			}
+			ln.Close()
+			signal.Stop(s)
+			ch <- struct{}{}
+			close(ch)
+		}()
+
+		go func() {
+			var err error
+			if server.TLSConfig != nil {
+				err = server.ServeTLS(ln, "", "")
+			} else {
+				err = server.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				zlog.Errorf("serveProxyProtocol: %s", err)
+				os.Exit(66)
+			}
+		}()
+
+		if flags&zhttp.ServeRedirect != 0 {
+			go func() {
+				ln, err := listen(host + ":80")
+				if err == nil {
+					err = http.Serve(ln, zhttp.HandlerRedirectHTTP(port))
+				}
+				if err != nil && err != http.ErrServerClosed {
+					zlog.Errorf("serveProxyProtocol: redirect 80: %s", err)
+					if errors.Is(err, os.ErrPermission) {
+						fmt.Fprintf(os.Stderr,
+							"\x1b[1mWARNING: No permission to bind to port 80, not setting up port 80 → %s redirect\x1b[0m\n", port)
+						fmt.Fprintf(os.Stderr, "WARNING: On Linux, try:\n")
+						fmt.Fprintf(os.Stderr, "    %s\n", setcapCmd())
+					}
+				}
+			}()
+		}
+
+		ch <- struct{}{}
+		return ch, nil
+	}
+}
+
+// setcapCmd gets the command to allow binding to ports below 1024, as in
+// zhttp.Serve().
+func setcapCmd() string {
+	argv0, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		argv0 = os.Args[0]
+	}
+	cmd := "setcap 'cap_net_bind_service=+ep' " + argv0
+	for _, su := range []string{"doas", "sudo"} {
+		if _, err := exec.LookPath(su); err == nil {
+			return su + " " + cmd
+		}
+	}
+	return `su -c "` + cmd + `"`
+}
+
 const defaultDB = "sqlite+db/goatcounter.sqlite3"
 
+// setRatelimit sets the rate limits from the -ratelimit flag.
+func setRatelimit(flag string) error {
+	for _, r := range strings.Split(flag, ",") {
+		name, spec, _ := strings.Cut(r, ":")
+		reqs, secs, _ := strings.Cut(spec, "/")
+
+		v := zvalidate.New()
+		v.Required("name", name)
+		v.Required("requests", reqs)
+		v.Required("seconds", secs)
+		name = v.Include("name", name, []string{"count", "count-error", "api", "api-count", "api-active", "export",
+			"login", "site-create", "site-verify"})
+		r := v.Integer("requests", reqs)
+		s := v.Integer("seconds", secs)
+		if v.HasErrors() {
+			return fmt.Errorf("invalid -ratelimit flag: %q: %w", flag, v)
+		}
+
+		handlers.SetRateLimit(name, int(r), s)
+	}
+	return nil
+}
+
 func flagsServe(f zli.Flags, v *zvalidate.Validator) (string, string, bool, bool, string, string, string, bool, int, error) {
 	var (
 		dbConnect   = f.String(defaultDB, "db").Pointer()
@@ -316,8 +1017,41 @@ func flagsServe(f zli.Flags, v *zvalidate.Validator) (string, string, bool, bool
 		errors      = f.String("", "errors").Pointer()
 		from        = f.String("", "email-from").Pointer()
 		geodb       = f.String("", "geodb").Pointer()
+		geodbFormat = f.String(goatcounter.GeoFormatMaxMind, "geodb-format").Pointer()
+		geodbConc   = f.Int(0, "geodb-concurrency").Pointer()
+		geodbWait   = f.Int(50, "geodb-wait").Pointer()
+		geodbDegC   = f.Int(0, "geodb-degrade-country").Pointer()
+		geodbDegOff = f.Int(0, "geodb-degrade-off").Pointer()
+		geodbPriv   = f.Bool(false, "geodb-private").Pointer()
+		asndb       = f.String("", "asndb").Pointer()
+		geoUpdate   = f.String("", "geodb-update").Pointer()
+		geoKey      = f.String("", "geodb-update-key").Pointer()
+		geoEvery    = f.Int(168, "geodb-update-every").Pointer()
+		geoRetries  = f.Int(5, "geodb-update-retries").Pointer()
+		geoBackoff  = f.Int(60, "geodb-update-backoff").Pointer()
 		ratelimit   = f.String("", "ratelimit").Pointer()
+		decodeErrs  = f.String("5/60", "decode-errors").Pointer()
+		hitSink     = f.String("sql", "hit-sink").Pointer()
+		hitRegions  = f.String("", "hit-sink-regions").Pointer()
+		hitSecond   = f.StringList(nil, "hit-sink-secondary").Pointer()
+		msMax       = f.Int(0, "memstore-max").Pointer()
+		msDrop      = f.String(goatcounter.DropNew, "memstore-drop").Pointer()
+		msOverflow  = f.String("", "memstore-overflow").Pointer()
+		msOvSize    = f.Int(64, "memstore-overflow-size").Pointer()
+		msDrain     = f.Int(1000, "memstore-drain").Pointer()
+		flushRows   = f.Int(10_000, "flush-batch").Pointer()
+		flushSize   = f.Int(0, "flush-batch-size").Pointer()
+		cacheTTL    = f.Int(0, "cache-ttl").Pointer()
+		cacheBudget = f.Int(0, "cache-budget").Pointer()
+		cacheEvery  = f.Int(60, "cache-interval").Pointer()
+		sessHash    = f.String(goatcounter.SessionHashSHA256, "session-hash").Pointer()
+		sessPepper  = f.String("", "session-pepper").Pointer()
+		sessGrace   = f.Int(240, "session-grace").Pointer()
+		activeWin   = f.Int(5, "active-window").Pointer()
 		apiMax      = f.Int(0, "api-max").Pointer()
+		exportConc  = f.Int(0, "export-concurrency").Pointer()
+		exportSite  = f.Int(2, "export-concurrency-site").Pointer()
+		exportWait  = f.Int(1, "export-wait").Pointer()
 		storeEvery  = f.Int(10, "store-every").Pointer()
 		websocket   = f.Bool(false, "websocket").Pointer()
 	)
@@ -341,28 +1075,131 @@ func flagsServe(f zli.Flags, v *zvalidate.Validator) (string, string, bool, bool
 
 	v.Range("-store-every", int64(*storeEvery), 1, 0)
 	cron.SetPersistInterval(time.Duration(*storeEvery) * time.Second)
+	v.Range("-flush-batch", int64(*flushRows), 0, 0)
+	v.Range("-flush-batch-size", int64(*flushSize), 0, 0)
+	goatcounter.Memstore.SetFlushBatch(goatcounter.FlushBatch{Rows: *flushRows, Bytes: *flushSize * 1024})
 
-	goatcounter.InitGeoDB(*geodb)
+	geoPath := *geodb
+	if _, err := os.Stat(geoPath); *geoUpdate != "" && err != nil {
+		geoPath = "" // Use the built-in database until it's downloaded.
+	}
+	goatcounter.InitGeoDB(geoPath, v.Include("-geodb-format", *geodbFormat, goatcounter.GeoFormats))
+	v.Range("-geodb-concurrency", int64(*geodbConc), 0, 0)
+	v.Range("-geodb-wait", int64(*geodbWait), 0, 0)
+	goatcounter.SetGeoConcurrency(*geodbConc, time.Duration(*geodbWait)*time.Millisecond)
+	v.Range("-geodb-degrade-country", int64(*geodbDegC), 0, 0)
+	v.Range("-geodb-degrade-off", int64(*geodbDegOff), 0, 0)
+	if *geodbDegOff > 0 && *hitRegions != "" {
+		v.Append("-geodb-degrade-off", "can't be used with -hit-sink-regions, as pageviews without a location are stored in the default sink")
+	}
+	goatcounter.SetGeoDegrade(*geodbDegC, *geodbDegOff)
+	goatcounter.SetGeoLookupPrivate(*geodbPriv)
+	v.Range("-export-concurrency", int64(*exportConc), 0, 0)
+	v.Range("-export-concurrency-site", int64(*exportSite), 0, 0)
+	v.Range("-export-wait", int64(*exportWait), 0, 0)
+	goatcounter.SetExportConcurrency(*exportConc, *exportSite, time.Duration(*exportWait)*time.Second)
+	if err := goatcounter.InitASNDB(*asndb); err != nil {
+		v.Append("-asndb", err.Error())
+	}
+	if *geoUpdate != "" {
+		v.URL("-geodb-update", *geoUpdate)
+		v.Range("-geodb-update-every", int64(*geoEvery), 1, 0)
+		v.Range("-geodb-update-retries", int64(*geoRetries), 0, 0)
+		v.Range("-geodb-update-backoff", int64(*geoBackoff), 1, 0)
+		if !v.HasErrors() {
+			goatcounter.GeoUpdate{
+				URL:     *geoUpdate,
+				Key:     *geoKey,
+				Path:    *geodb,
+				Format:  *geodbFormat,
+				Every:   time.Duration(*geoEvery) * time.Hour,
+				Retries: *geoRetries,
+				Backoff: time.Duration(*geoBackoff) * time.Second,
+			}.Start(context.Background())
+		}
+	}
 
 	if *ratelimit != "" {
-		for _, r := range strings.Split(*ratelimit, ",") {
-			name, spec, _ := strings.Cut(r, ":")
-			reqs, secs, _ := strings.Cut(spec, "/")
-
-			v := zvalidate.New()
-			v.Required("name", name)
-			v.Required("requests", reqs)
-			v.Required("seconds", secs)
-			name = v.Include("name", name, []string{"count", "api", "api-count", "export", "login"})
-			r := v.Integer("requests", reqs)
-			s := v.Integer("seconds", secs)
-			if v.HasErrors() {
-				return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax,
-					fmt.Errorf("invalid -ratelimit flag: %q: %w", *ratelimit, v)
+		err := setRatelimit(*ratelimit)
+		if err != nil {
+			return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax, err
+		}
+	}
+
+	flagDecodeErrors(*decodeErrs, v)
+
+	if *hitSink != "sql" || *hitRegions != "" || len(*hitSecond) > 0 {
+		sink, err := goatcounter.NewHitSink(*hitSink)
+		if err != nil {
+			return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax, err
+		}
+		if *hitRegions != "" {
+			conf, err := os.ReadFile(*hitRegions)
+			if err != nil {
+				return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax, err
+			}
+			sink, err = goatcounter.OpenRegionSink(sink, conf)
+			if err != nil {
+				return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax, err
+			}
+		}
+		if len(*hitSecond) > 0 {
+			sec := make([]goatcounter.SecondarySink, 0, len(*hitSecond))
+			for _, spec := range *hitSecond {
+				s, err := goatcounter.NewHitSink(spec)
+				if err != nil {
+					return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax, err
+				}
+				name, _, _ := strings.Cut(spec, ":")
+				sec = append(sec, goatcounter.SecondarySink{Name: fmt.Sprintf("%d-%s", len(sec)+1, name), Sink: s})
+			}
+			sink = goatcounter.NewMultiSink(sink, sec...)
+		}
+		goatcounter.Memstore.SetSink(sink)
+	}
+
+	v.Range("-cache-ttl", int64(*cacheTTL), 0, 0)
+	v.Range("-cache-budget", int64(*cacheBudget), 0, 0)
+	v.Range("-cache-interval", int64(*cacheEvery), 1, 0)
+	goatcounter.SetMemCachePolicy(time.Duration(*cacheTTL)*time.Minute, *cacheBudget)
+	if *cacheEvery > 0 {
+		goatcounter.StartMemCacheJanitor(time.Duration(*cacheEvery) * time.Second)
+	}
+
+	{
+		pepper := []byte(os.Getenv("GOATCOUNTER_SESSION_PEPPER"))
+		if *sessPepper != "" {
+			p, err := os.ReadFile(*sessPepper)
+			if err != nil {
+				v.Append("-session-pepper", err.Error())
 			}
+			pepper = bytes.TrimRight(p, "\r\n")
+		}
+		h, err := goatcounter.NewSessionHasher(v.Include("-session-hash", *sessHash, goatcounter.SessionHashes), pepper)
+		if err != nil {
+			v.Append("-session-hash", err.Error())
+		}
+		goatcounter.Memstore.SetSessionHasher(h)
 
-			handlers.SetRateLimit(name, int(r), s)
+		v.Range("-session-grace", int64(*sessGrace), 1, int64(goatcounter.SaltRotation/time.Minute))
+		goatcounter.Memstore.SetSaltGrace(time.Duration(*sessGrace) * time.Minute)
+	}
+	v.Range("-active-window", int64(*activeWin), 1, 60)
+	goatcounter.Memstore.SetActiveWindow(time.Duration(*activeWin) * time.Minute)
+
+	if *msMax > 0 || *msOverflow != "" {
+		v.Range("-memstore-max", int64(*msMax), 1, 0)
+		v.Include("-memstore-drop", *msDrop, goatcounter.DropPolicies)
+		v.Range("-memstore-drain", int64(*msDrain), 0, 0)
+		l := goatcounter.MemstoreLimit{Max: *msMax, Drop: *msDrop, Drain: *msDrain}
+		if *msOverflow != "" && !v.HasErrors() {
+			v.Range("-memstore-overflow-size", int64(*msOvSize), 1, 0)
+			l.Overflow, err = goatcounter.OpenOverflow(*msOverflow, int64(*msOvSize)*1024*1024)
+			if err != nil {
+				return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax, err
+			}
 		}
+		goatcounter.Memstore.SetLimit(l)
 	}
 
 	return *dbConnect, *dbConn, *dev, *automigrate, *listen, *flagTLS, *from, *websocket, *apiMax, err
@@ -463,6 +1300,22 @@ func setupReload() {
 	}()
 }
 
+func flagDecodeErrors(decodeErrs string, v *zvalidate.Validator) {
+	num, secs, ok := strings.Cut(decodeErrs, "/")
+	if !ok {
+		v.Append("-decode-errors", "must be as num/seconds")
+		return
+	}
+	n := v.Integer("-decode-errors", num)
+	s := v.Integer("-decode-errors", secs)
+	v.Range("-decode-errors", n, 0, 0)
+	v.Range("-decode-errors", s, 1, 0)
+	if v.HasErrors() {
+		return
+	}
+	handlers.SetDecodeErrorLog(int(n), time.Duration(s)*time.Second)
+}
+
 func flagErrors(errors string, v *zvalidate.Validator) {
 	switch {
 	default:
@@ -5,9 +5,15 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"testing"
+
+	"zgo.at/zstd/ztest"
+	"zgo.at/zvalidate"
 )
 
 func TestServe(t *testing.T) {
@@ -39,3 +45,89 @@ func TestServe(t *testing.T) {
 	stop <- struct{}{}
 	mainDone.Wait()
 }
+
+func TestSetRatelimit(t *testing.T) {
+	// Same as the defaults, so other tests aren't affected.
+	tests := []struct {
+		flag, wantErr string
+	}{
+		{"count:4/1", ""},
+		{"count:4/1,api-count:60/120,site-create:10/3600", ""},
+		{"site-verify:60/3600", ""},
+		{"login:20/60,count-error:10/60", ""},
+		{"foo:1/1", "must be one of"},
+		{"count:x/1", "requests"},
+		{"count:1", "seconds"},
+		{":1/1", "name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			err := setRatelimit(tt.flag)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Errorf("wrong error: %v", err)
+			}
+		})
+	}
+}
+
+func TestFlagDecodeErrors(t *testing.T) {
+	defer flagDecodeErrors("5/60", new(zvalidate.Validator)) // Restore the default.
+
+	tests := []struct {
+		flag, wantErr string
+	}{
+		{"5/60", ""},
+		{"0/60", ""},
+		{"-1/60", "-decode-errors: must be 0 or higher"},
+		{"5/0", "-decode-errors: must be 1 or higher"},
+		{"x/60", "-decode-errors: must be a whole number"},
+		{"5", "-decode-errors: must be as num/seconds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			v := zvalidate.New()
+			flagDecodeErrors(tt.flag, &v)
+			if !ztest.ErrorContains(v.ErrorOrNil(), tt.wantErr) {
+				t.Errorf("wrong error: %v", v.ErrorOrNil())
+			}
+		})
+	}
+}
+
+func TestServeProxyProtocol(t *testing.T) {
+	exit, _, _, _, dbc := startTest(t)
+
+	ready := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	go runCmdStop(t, exit, ready, stop, "serve",
+		"-db="+dbc,
+		"-listen=localhost:31875",
+		"-tls=http",
+		"-proxy-protocol")
+	<-ready
+
+	status := func(header string) int {
+		c, err := net.Dial("tcp", "localhost:31875")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "%sGET /status HTTP/1.0\r\nHost: localhost\r\n\r\n", header)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if have := status("PROXY TCP4 192.0.2.1 127.0.0.1 12345 31875\r\n"); have != 200 {
+		t.Errorf("with header: %d", have)
+	}
+	if have := status(""); have != 400 {
+		t.Errorf("without header: %d", have)
+	}
+
+	stop <- struct{}{}
+	mainDone.Wait()
+}
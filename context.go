@@ -7,6 +7,7 @@ package goatcounter
 import (
 	"context"
 	"fmt"
+	"net/netip"
 	"time"
 
 	"zgo.at/z18n"
@@ -34,6 +35,8 @@ var (
 	keyChangedTitles   = &struct{ n string }{""}
 	keyCacheSitesProxy = &struct{ n string }{""}
 	keyCacheI18n       = &struct{ n string }{""}
+	keyNewPaths        = &struct{ n string }{""}
+	keyNewRefs         = &struct{ n string }{""}
 
 	keyConfig = &struct{ n string }{""}
 )
@@ -49,8 +52,185 @@ type GlobalConfig struct {
 	Websocket      bool
 	EmailFrom      string
 	BcryptMinCost  bool
+
+	// Bot categories (as isbot.Result) that are still counted as pageviews.
+	CountBots []int
+
+	// Hit.BotClass for bot categories (as isbot.Result), which takes
+	// precedence over the DefaultBotClasses; see GetBotClass().
+	BotClasses map[int]string
+
+	// Maximum ratio of the decompressed to compressed size for compressed
+	// bodies for /api/v0/import; compressed bodies are rejected if this is 0.
+	ImportMaxRatio int
+
+	// Status code for /count requests that are ignored, such as for ignored
+	// IPs; 0 means 202.
+	IgnoredStatus int
+
+	// Maximum number of entries in SiteSettings.IgnoreIPs; 0 is unlimited.
+	MaxIgnoreIPs int
+
+	// Also serve /count.js and the /count endpoints under this path prefix
+	// (e.g. "/_stats/count"), for a reverse proxy on the site's own domain.
+	// This is also used for the embed code.
+	CountPrefix string
+
+	// Pad the response time of /count to at least this long, so it doesn't
+	// reveal which code path was taken; 0 disables it.
+	CountPad time.Duration
+
+	// Access-Control-Max-Age for CORS preflight requests to the /count
+	// endpoints; 0 doesn't send it, and browsers use their default of 5
+	// seconds.
+	CountMaxAge time.Duration
+
+	// Compress JSON responses from the /count endpoints with gzip if they're
+	// at least this many bytes and the client accepts it; -1 disables it.
+	CountCompressMin int
+
+	// POST requests to /count with a Content-Length below this are ignored
+	// without decoding the body; 0 disables the check.
+	CountMinBody int64
+
+	// Header to read the client IP from in /count, before X-Forwarded-For;
+	// disabled if empty. It's only used for connections from ClientIPProxies,
+	// or all connections if that's empty.
+	//
+	// ClientIPProxies also applies to X-Forwarded-Proto for
+	// SiteSettings.RequireHTTPS and TLSHeader.
+	ClientIPHeader  string
+	ClientIPProxies []netip.Prefix
+
+	// Which IP to use if both ClientIPHeader and X-Forwarded-For are set and
+	// have a different IP; one of the ClientIPPrecedence* constants. The
+	// default is ClientIPPrecedenceHeader.
+	ClientIPPrecedence string
+
+	// Add "X-Goatcounter: ip header conflict" to /count responses if
+	// ClientIPHeader and X-Forwarded-For have a different IP.
+	ClientIPConflict bool
+
+	// Read the client address from the PROXY protocol header on connections
+	// from ClientIPProxies, or all connections if that's empty.
+	ProxyProtocol bool
+
+	// Header to read the TLS version and cipher suite from for CollectTLS if
+	// TLS is terminated at a proxy, as "<version> <cipher>"; e.g. "TLSv1.3
+	// TLS_AES_128_GCM_SHA256". It's not collected for these connections if
+	// this is empty.
+	TLSHeader string
+
+	// Reject /count requests sent with a TLS version below this (e.g.
+	// tls.VersionTLS12), with the version from TLSHeader if TLS is terminated
+	// at a proxy. Requests without TLS or with an unknown version are also
+	// rejected. 0 disables the check.
+	CountMinTLS uint16
+
+	// What to do with /count requests for a host that doesn't match any site;
+	// one of the UnknownSite* constants. The default is UnknownSiteGIF.
+	UnknownSite string
+
+	// What to do with /count requests where the Host is an IP address rather
+	// than a domain, such as from scanners; one of the IPHost* constants. The
+	// default is IPHostDefault.
+	IPHost string
+
+	// Site to record /count requests for IP hosts in, with IPHostSite.
+	IPHostSiteID int64
+
+	// What to do with /count requests without a User-Agent header; one of the
+	// EmptyUA* constants. The default is EmptyUADetect, which is what happened
+	// before this was added, rather than EmptyUACount.
+	EmptyUA string
+
+	// Write pageviews from /count to the database before sending the
+	// response instead of adding them to the memstore, and what to do if
+	// that fails; one of the SyncCount* constants. The default is
+	// SyncCountOff.
+	SyncCount string
+
+	// Record referrers from localhost, loopback addresses, and file:// as
+	// LocalRefLabel, instead of dropping them as spam or storing them as-is.
+	// This is for testing the integration during development, and should
+	// never be enabled in production.
+	LocalRefs bool
 }
 
+// Values for GlobalConfig.UnknownSite.
+const (
+	UnknownSiteGIF    = "gif"    // Return the GIF as if the pageview was counted.
+	UnknownSite404    = "404"    // Return a 404 with the X-Goatcounter header.
+	UnknownSiteCreate = "create" // Create a new site for the host; self-hosted only.
+	UnknownSiteVerify = "verify" // Create a new site if the host has the VerifyTXT record; self-hosted only.
+)
+
+// UnknownSites lists all valid values for GlobalConfig.UnknownSite.
+var UnknownSites = []string{UnknownSiteGIF, UnknownSite404, UnknownSiteCreate, UnknownSiteVerify}
+
+// Values for GlobalConfig.IPHost.
+const (
+	IPHostDefault = "default" // Handle it like any other host.
+	IPHostDrop    = "drop"    // Send the GIF without recording anything.
+	IPHostSite    = "site"    // Record it in the site in IPHostSiteID.
+)
+
+// VerifyTXT is the TXT record that's required on "_goatcounter.[host]" to
+// create a site for the host with UnknownSiteVerify.
+const VerifyTXT = "goatcounter-verify"
+
+// Values for GlobalConfig.ClientIPPrecedence.
+const (
+	ClientIPPrecedenceHeader    = "header"        // Use ClientIPHeader.
+	ClientIPPrecedenceForwarded = "forwarded-for" // Use X-Forwarded-For.
+)
+
+// ClientIPPrecedences lists all valid values for
+// GlobalConfig.ClientIPPrecedence.
+var ClientIPPrecedences = []string{ClientIPPrecedenceHeader, ClientIPPrecedenceForwarded}
+
+// Values for GlobalConfig.EmptyUA.
+const (
+	EmptyUADetect = "detect" // Use the bot detection, which flags it as isbot.BotShort.
+	EmptyUABot    = "bot"    // Flag as BotEmptyUA.
+	EmptyUADrop   = "drop"   // Don't record it.
+	EmptyUACount  = "count"  // Count as a regular pageview.
+)
+
+// EmptyUAs lists all valid values for GlobalConfig.EmptyUA.
+var EmptyUAs = []string{EmptyUADetect, EmptyUABot, EmptyUADrop, EmptyUACount}
+
+// Values for GlobalConfig.SyncCount.
+const (
+	SyncCountOff   = "off"   // Add to the memstore, which is written in the background.
+	SyncCountGIF   = "gif"   // Write right away, and return the GIF if that fails.
+	SyncCountError = "error" // Write right away, and return a 503 if that fails.
+)
+
+// SyncCounts lists all valid values for GlobalConfig.SyncCount.
+var SyncCounts = []string{SyncCountOff, SyncCountGIF, SyncCountError}
+
+// BotEmptyUA is the Hit.Bot value for pageviews without a User-Agent with
+// EmptyUABot, so they can be counted separately from other bots with
+// CountBots.
+const BotEmptyUA = 99
+
+// BotMonitor is the Hit.Bot value for uptime monitors with
+// SiteSettings.FlagMonitors.
+const BotMonitor = 98
+
+// BotDatacenter is the Hit.Bot value for pageviews from the network of a
+// hosting provider with SiteSettings.FlagDatacenter.
+const BotDatacenter = 97
+
+// BotScanner is the Hit.Bot value for pageviews for one of the
+// SiteSettings.DenyPathRegexps with SiteSettings.DenyPathsBot.
+const BotScanner = 96
+
+// BotWebdriver is the Hit.Bot value for pageviews with Hit.Webdriver set with
+// WebdriverBot.
+const BotWebdriver = 95
+
 // WithSite adds the site to the context.
 func WithSite(ctx context.Context, s *Site) context.Context {
 	return context.WithValue(ctx, ctxkey.Site, s)
@@ -161,6 +341,12 @@ func CopyContextValues(ctx context.Context) context.Context {
 	if c := ctx.Value(keyChangedTitles); c != nil {
 		n = context.WithValue(n, keyChangedTitles, c.(*zcache.Cache))
 	}
+	if c := ctx.Value(keyNewPaths); c != nil {
+		n = context.WithValue(n, keyNewPaths, c.(*zcache.Cache))
+	}
+	if c := ctx.Value(keyNewRefs); c != nil {
+		n = context.WithValue(n, keyNewRefs, c.(*zcache.Cache))
+	}
 	if c := ctx.Value(keyCacheSitesProxy); c != nil {
 		n = context.WithValue(n, keyCacheSitesProxy, c.(*zcache.Proxy))
 	}
@@ -202,6 +388,8 @@ func NewCache(ctx context.Context) context.Context {
 	ctx = context.WithValue(ctx, keyCacheCampaigns, zcache.New(24*time.Hour, 15*time.Minute))
 	ctx = context.WithValue(ctx, keyCacheI18n, zcache.New(zcache.NoExpiration, zcache.NoExpiration))
 	ctx = context.WithValue(ctx, keyChangedTitles, zcache.New(48*time.Hour, 1*time.Hour))
+	ctx = context.WithValue(ctx, keyNewPaths, zcache.New(25*time.Hour, 1*time.Hour))
+	ctx = context.WithValue(ctx, keyNewRefs, zcache.New(25*time.Hour, 1*time.Hour))
 	return ctx
 }
 
@@ -282,6 +470,18 @@ func cacheChangedTitles(ctx context.Context) *zcache.Cache {
 	}
 	return zcache.New(0, 0)
 }
+func cacheNewPaths(ctx context.Context) *zcache.Cache {
+	if c := ctx.Value(keyNewPaths); c != nil {
+		return c.(*zcache.Cache)
+	}
+	return zcache.New(0, 0)
+}
+func cacheNewRefs(ctx context.Context) *zcache.Cache {
+	if c := ctx.Value(keyNewRefs); c != nil {
+		return c.(*zcache.Cache)
+	}
+	return zcache.New(0, 0)
+}
 func cacheSitesHost(ctx context.Context) *zcache.Proxy {
 	if c := ctx.Value(keyCacheSitesProxy); c != nil {
 		return c.(*zcache.Proxy)
@@ -0,0 +1,116 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// CountryDay is the key for the country_uniques table; the country is the
+// ISO-3166-1 code, without the region.
+type CountryDay struct {
+	Day     string // As 2006-01-02.
+	Country string
+}
+
+// StoreCountryUniques merges the estimators with the ones that are already
+// stored for the site, for CollectCountryUniques.
+//
+// Estimators can be merged in any order and the same session can be added more
+// than once, so this gives the same result if there are several servers
+// persisting pageviews for the site, or when the stats are reindexed.
+func StoreCountryUniques(ctx context.Context, siteID int64, u map[CountryDay]*HLL) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		forUpdate := ""
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			forUpdate = " for update"
+		}
+		for k, h := range u {
+			var stored HLL
+			err := zdb.Get(ctx, &stored, `/* StoreCountryUniques */
+				select hll from country_uniques where site_id = ? and day = ? and location = ?`+forUpdate,
+				siteID, k.Day, k.Country)
+			if err != nil && !zdb.ErrNoRows(err) {
+				return err
+			}
+			h.Merge(stored)
+
+			err = zdb.Exec(ctx, `/* StoreCountryUniques */
+				insert into country_uniques (site_id, day, location, hll) values (?, ?, ?, ?)
+				on conflict(site_id, day, location) do update set hll = excluded.hll`,
+				siteID, k.Day, k.Country, h)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}), "StoreCountryUniques")
+}
+
+// ListCountryUniques lists the estimated number of unique visitors per country
+// in the given time period, from CollectCountryUniques; the total is the
+// estimate for all countries.
+//
+// Visitors are counted once for the whole period, rather than once for every
+// day. The estimates have an error of about HLLError.
+func (h *HitStats) ListCountryUniques(ctx context.Context, rng ztime.Range, limit, offset int) (int, error) {
+	var (
+		user = MustGetUser(ctx)
+		rows []struct {
+			Location string `db:"location"`
+			HLL      HLL    `db:"hll"`
+		}
+	)
+	err := zdb.Select(ctx, &rows, `/* HitStats.ListCountryUniques */
+		select location, hll from country_uniques
+		where site_id = :site and day >= :start and day <= :end`,
+		zdb.P{"site": MustGetSite(ctx).ID, "start": asUTCDate(ctx, user, rng.Start), "end": asUTCDate(ctx, user, rng.End)})
+	if err != nil {
+		return 0, errors.Wrap(err, "HitStats.ListCountryUniques")
+	}
+
+	var (
+		total     HLL
+		countries = make(map[string]*HLL)
+	)
+	for _, r := range rows {
+		total.Merge(r.HLL)
+		c, ok := countries[r.Location]
+		if !ok {
+			c = new(HLL)
+			countries[r.Location] = c
+		}
+		c.Merge(r.HLL)
+	}
+
+	h.Stats = make([]HitStat, 0, len(countries))
+	for code, c := range countries {
+		var l Location
+		err := l.ByCode(ctx, code)
+		if err != nil {
+			return 0, errors.Wrap(err, "HitStats.ListCountryUniques")
+		}
+		h.Stats = append(h.Stats, HitStat{ID: code, Name: l.CountryName, Count: c.Estimate()})
+	}
+	slices.SortFunc(h.Stats, func(a, b HitStat) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	h.Stats = h.Stats[min(offset, len(h.Stats)):]
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:limit]
+	}
+	return total.Estimate(), nil
+}
@@ -0,0 +1,175 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"zgo.at/blackmail"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+)
+
+const (
+	// Pageviews are counted in buckets of this size; the last full bucket is
+	// compared to the average of the buckets in the window before it.
+	alertBucket = 10 * time.Minute
+
+	// Don't alert if the average is less than this many pageviews per bucket,
+	// as a few pageviews on a quiet site shouldn't trigger anything.
+	alertMinBaseline = 5
+
+	// Minimum time between two alerts for the same site.
+	alertDebounce = time.Hour
+
+	// Maximum number of buckets to keep; this is the maximum window of 168
+	// hours plus the last bucket.
+	alertMaxBuckets = int(168*time.Hour/alertBucket) + 1
+)
+
+type (
+	// alerter keeps track of the pageviews for every site as they're
+	// persisted, so we don't need to query the database.
+	alerter struct {
+		mu    sync.Mutex
+		sites map[int64]*alertSite
+	}
+	alertSite struct {
+		start    time.Time // Start of the current bucket.
+		current  int       // Pageviews in the current bucket.
+		buckets  []int     // Previous buckets, oldest first.
+		checked  time.Time // Value of start when we last checked.
+		state    string    // Current state: "", "spike", or "drop".
+		lastSent time.Time
+	}
+	alert struct {
+		site     goatcounter.Site
+		kind     string
+		at       time.Time
+		count    int
+		baseline float64
+	}
+)
+
+var alerts = &alerter{sites: make(map[int64]*alertSite)}
+
+// record n pageviews for the site.
+func (a *alerter) record(siteID int64, n int, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.sites[siteID]
+	if !ok {
+		s = &alertSite{}
+		a.sites[siteID] = s
+	}
+	s.roll(now, alertMaxBuckets)
+	s.current += n
+}
+
+// check all sites we know about, returning the alerts to send.
+func (a *alerter) check(ctx context.Context, now time.Time) []alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var send []alert
+	for siteID, s := range a.sites {
+		var site goatcounter.Site
+		err := site.ByID(ctx, siteID)
+		if err != nil || !site.Settings.Alert.Enabled() {
+			delete(a.sites, siteID)
+			continue
+		}
+
+		c := site.Settings.Alert
+		window := int(time.Duration(c.Window) * time.Hour / alertBucket)
+		s.roll(now, alertMaxBuckets)
+		if s.start.Equal(s.checked) || len(s.buckets) <= window {
+			continue
+		}
+		s.checked = s.start
+
+		last := s.buckets[len(s.buckets)-1]
+		var total int
+		for _, n := range s.buckets[len(s.buckets)-1-window : len(s.buckets)-1] {
+			total += n
+		}
+		baseline := float64(total) / float64(window)
+		if baseline < alertMinBaseline {
+			continue
+		}
+
+		var kind string
+		switch {
+		case c.Spike > 0 && float64(last) > baseline*(1+float64(c.Spike)/100):
+			kind = "spike"
+		case c.Drop > 0 && float64(last) < baseline*(1-float64(c.Drop)/100):
+			kind = "drop"
+		}
+
+		// Only alert once until it's back to normal.
+		prev := s.state
+		s.state = kind
+		if kind == "" || kind == prev || now.Sub(s.lastSent) < alertDebounce {
+			continue
+		}
+		s.lastSent = now
+		send = append(send, alert{site: site, kind: kind, at: s.start.Add(-alertBucket), count: last, baseline: baseline})
+	}
+	return send
+}
+
+// roll moves to the bucket for now. No more than keep previous buckets are
+// stored.
+func (s *alertSite) roll(now time.Time, keep int) {
+	b := now.Truncate(alertBucket)
+	if s.start.IsZero() || b.Before(s.start) { // Time went backwards; start over.
+		*s = alertSite{start: b, checked: b, lastSent: s.lastSent}
+		return
+	}
+	if !b.After(s.start) {
+		return
+	}
+
+	s.buckets = append(s.buckets, s.current)
+	s.current = 0
+	gap := int(b.Sub(s.start)/alertBucket) - 1 // Buckets without any pageviews.
+	if gap > keep {
+		gap = keep
+	}
+	for ; gap > 0; gap-- {
+		s.buckets = append(s.buckets, 0)
+	}
+	s.start = b
+	if len(s.buckets) > keep {
+		s.buckets = append(s.buckets[:0], s.buckets[len(s.buckets)-keep:]...)
+	}
+}
+
+// sendAlerts sends the alerts to all admins of the site.
+func sendAlerts(ctx context.Context, send []alert) error {
+	errs := errors.NewGroup(10)
+	for _, a := range send {
+		var users goatcounter.Users
+		err := users.List(ctx, a.site.ID)
+		if errs.Append(err) {
+			continue
+		}
+
+		what := map[string]string{"spike": "Spike", "drop": "Drop"}[a.kind]
+		text := fmt.Sprintf("%s in pageviews for %s: %d pageviews in the 10 minutes from %s UTC, compared to an average of %.0f over the previous %d hours.\n",
+			what, a.site.Display(ctx), a.count, a.at.UTC().Format("2006-01-02 15:04"),
+			a.baseline, a.site.Settings.Alert.Window)
+		for _, u := range users.Admins() {
+			errs.Append(blackmail.Send(fmt.Sprintf("%s in pageviews for %s", what, a.site.Display(ctx)),
+				blackmail.From("GoatCounter alerts", goatcounter.Config(ctx).EmailFrom),
+				blackmail.To(u.Email),
+				blackmail.BodyText([]byte(text))))
+		}
+	}
+	return errs.ErrorOrNil()
+}
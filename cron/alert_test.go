@@ -0,0 +1,103 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"zgo.at/blackmail"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestAlert(t *testing.T) {
+	ctx := gctest.DB(t)
+	goatcounter.Config(ctx).EmailFrom = "test@goatcounter.localhost.com"
+	buf := new(bytes.Buffer)
+	blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(buf))
+
+	site := goatcounter.MustGetSite(ctx)
+	site.Settings.Alert = goatcounter.Alert{Spike: 100, Drop: 50, Window: 1}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	// Send n pageviews in the bucket starting at min minutes after start.
+	send := func(min, n int) {
+		t.Helper()
+		now := start.Add(time.Duration(min)*time.Minute + time.Minute)
+		ztime.SetNow(t, now.Format("2006-01-02 15:04:05"))
+		for i := 0; i < n; i++ {
+			goatcounter.Memstore.Append(goatcounter.Hit{Site: site.ID, Path: "/a", CreatedAt: now})
+		}
+		err := cron.TaskPersistAndStat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitPersistAndStat()
+	}
+	sent := func() []string {
+		t.Helper()
+		var subj []string
+		for _, l := range strings.Split(buf.String(), "\r\n") {
+			if strings.HasPrefix(l, "Subject: ") {
+				subj = append(subj, strings.TrimPrefix(l, "Subject: "))
+			}
+		}
+		buf.Reset()
+		return subj
+	}
+
+	// Need a full window before sending anything.
+	for m := 0; m < 60; m += 10 {
+		send(m, 10)
+	}
+	if s := sent(); len(s) > 0 {
+		t.Fatalf("sent before full window: %v", s)
+	}
+
+	// Spike; the alert is sent once the bucket is done.
+	send(60, 10)
+	send(70, 30)
+	if s := sent(); len(s) > 0 {
+		t.Fatalf("sent before bucket is done: %v", s)
+	}
+	send(80, 10)
+	if s := sent(); len(s) != 1 || !strings.HasPrefix(s[0], "Spike in pageviews") {
+		t.Fatalf("no spike alert: %v", s)
+	}
+
+	// Another spike less than an hour later is ignored.
+	send(90, 30)
+	for m := 100; m < 170; m += 10 {
+		send(m, 10)
+	}
+	if s := sent(); len(s) > 0 {
+		t.Fatalf("not debounced: %v", s)
+	}
+
+	// Outage; no pageviews at all, and within the threshold doesn't send
+	// anything.
+	send(170, 6)
+	send(180, 0)
+	if s := sent(); len(s) > 0 {
+		t.Fatalf("sent for change below threshold: %v", s)
+	}
+	send(190, 0)
+	if s := sent(); len(s) != 1 || !strings.HasPrefix(s[0], "Drop in pageviews") {
+		t.Fatalf("no drop alert: %v", s)
+	}
+	send(200, 0)
+	if s := sent(); len(s) > 0 {
+		t.Fatalf("sent again while still down: %v", s)
+	}
+}
@@ -22,15 +22,16 @@ func updateBrowserStats(ctx context.Context, hits []goatcounter.Hit) error {
 			pathID    int64
 		}
 		grouped := map[string]gt{}
+		loc := goatcounter.MustGetSite(ctx).Settings.Timezone.Loc()
 		for _, h := range hits {
-			if h.Bot > 0 {
+			if !h.CountsAsPageview(ctx) {
 				continue
 			}
 			if h.BrowserID == 0 {
 				continue
 			}
 
-			day := h.CreatedAt.Format("2006-01-02")
+			day := h.CreatedAt.In(loc).Format("2006-01-02")
 			k := day + strconv.FormatInt(h.BrowserID, 10) + strconv.FormatInt(h.PathID, 10)
 			v := grouped[k]
 			if v.count == 0 {
@@ -40,7 +41,7 @@ func updateBrowserStats(ctx context.Context, hits []goatcounter.Hit) error {
 			}
 
 			if h.FirstVisit {
-				v.count += 1
+				v.count += h.Weight()
 			}
 			grouped[k] = v
 		}
@@ -11,6 +11,8 @@ import (
 
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/tz"
+	"zgo.at/zdb"
 	"zgo.at/zstd/ztime"
 )
 
@@ -73,3 +75,65 @@ func TestBrowserStats(t *testing.T) {
 		t.Errorf("\nwant: %s\nout:  %s", want, out)
 	}
 }
+
+func TestBrowserStatsTimezone(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	site.Settings.Timezone = tz.MustNew("NL", "Europe/Amsterdam")
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		createdAt time.Time
+		wantDay   string
+	}{
+		// Day boundary; UTC+2 in the summer.
+		{time.Date(2019, 8, 31, 21, 59, 0, 0, time.UTC), "2019-08-31"},
+		{time.Date(2019, 8, 31, 22, 01, 0, 0, time.UTC), "2019-09-01"},
+
+		// Moves to UTC+2 on 31 March 01:00 UTC.
+		{time.Date(2019, 3, 30, 22, 30, 0, 0, time.UTC), "2019-03-30"},
+		{time.Date(2019, 3, 30, 23, 30, 0, 0, time.UTC), "2019-03-31"},
+		{time.Date(2019, 3, 31, 22, 30, 0, 0, time.UTC), "2019-04-01"},
+
+		// Moves to UTC+1 on 27 October 01:00 UTC.
+		{time.Date(2019, 10, 26, 22, 30, 0, 0, time.UTC), "2019-10-27"},
+		{time.Date(2019, 10, 27, 22, 30, 0, 0, time.UTC), "2019-10-27"},
+		{time.Date(2019, 10, 27, 23, 30, 0, 0, time.UTC), "2019-10-28"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.createdAt.Format(time.RFC3339), func(t *testing.T) {
+			err := zdb.Exec(ctx, `delete from browser_stats`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gctest.StoreHits(ctx, t, false, goatcounter.Hit{
+				Site: site.ID, CreatedAt: tt.createdAt, UserAgentHeader: "Firefox/68.0", FirstVisit: true})
+
+			var days []time.Time
+			err = zdb.Select(ctx, &days, `select day from browser_stats`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(days) != 1 || days[0].Format("2006-01-02") != tt.wantDay {
+				t.Errorf("have %v; want %s", days, tt.wantDay)
+			}
+		})
+	}
+
+	// Also uses the site's timezone when listing.
+	var stats goatcounter.HitStats
+	at := time.Date(2019, 10, 27, 23, 30, 0, 0, time.UTC)
+	err = stats.ListBrowsers(ctx, ztime.NewRange(at).To(at), nil, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Stats) != 1 {
+		t.Errorf("wrong stats: %v", stats)
+	}
+}
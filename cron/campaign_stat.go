@@ -23,12 +23,13 @@ func updateCampaignStats(ctx context.Context, hits []goatcounter.Hit) error {
 			pathID     int64
 		}
 		grouped := map[string]gt{}
+		loc := goatcounter.MustGetSite(ctx).Settings.Timezone.Loc()
 		for _, h := range hits {
-			if h.Bot > 0 || h.CampaignID == nil || *h.CampaignID == 0 {
+			if !h.CountsAsPageview(ctx) || h.CampaignID == nil || *h.CampaignID == 0 {
 				continue
 			}
 
-			day := h.CreatedAt.Format("2006-01-02")
+			day := h.CreatedAt.In(loc).Format("2006-01-02")
 			k := day + strconv.FormatInt(*h.CampaignID, 10) + h.Ref + strconv.FormatInt(h.PathID, 10)
 			v := grouped[k]
 			if v.count == 0 {
@@ -39,7 +40,7 @@ func updateCampaignStats(ctx context.Context, hits []goatcounter.Hit) error {
 			}
 
 			if h.FirstVisit {
-				v.count += 1
+				v.count += h.Weight()
 			}
 			grouped[k] = v
 		}
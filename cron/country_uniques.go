@@ -0,0 +1,42 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"strings"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+)
+
+func updateCountryUniques(ctx context.Context, hits []goatcounter.Hit) error {
+	site := goatcounter.MustGetSite(ctx)
+	if !site.Settings.Collect.Has(goatcounter.CollectCountryUniques) {
+		return nil
+	}
+
+	var (
+		grouped = make(map[goatcounter.CountryDay]*goatcounter.HLL)
+		loc     = site.Settings.Timezone.Loc()
+	)
+	for _, h := range hits {
+		if !h.CountsAsPageview(ctx) || h.Session.IsZero() {
+			continue
+		}
+		country, _, _ := strings.Cut(h.Location, "-")
+		k := goatcounter.CountryDay{Day: h.CreatedAt.In(loc).Format("2006-01-02"), Country: country}
+		u, ok := grouped[k]
+		if !ok {
+			u = new(goatcounter.HLL)
+			grouped[k] = u
+		}
+		u.AddSession(h.Session) // Can't be scaled by Hit.Weight().
+	}
+	if len(grouped) == 0 {
+		return nil
+	}
+	return errors.Wrap(goatcounter.StoreCountryUniques(ctx, site.ID, grouped), "cron.updateCountryUniques")
+}
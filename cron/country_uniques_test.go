@@ -0,0 +1,60 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztime"
+)
+
+func TestCountryUniques(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+	rng := ztime.NewRange(now).To(now)
+
+	hits := func(n int, loc string, off uint64) []goatcounter.Hit {
+		h := make([]goatcounter.Hit, 0, n)
+		for i := 0; i < n; i++ {
+			h = append(h, goatcounter.Hit{Site: site.ID, CreatedAt: now, Location: loc,
+				Session: zint.Uint128{9, off + uint64(i)}})
+		}
+		return h
+	}
+	list := func() string {
+		var stats goatcounter.HitStats
+		total, err := stats.ListCountryUniques(ctx, rng, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%d %v", total, stats.Stats)
+	}
+
+	// Not collected by default.
+	gctest.StoreHits(ctx, t, false, hits(3, "NZ", 0)...)
+	if h := list(); h != "0 []" {
+		t.Errorf("have %q", h)
+	}
+
+	site.Settings.Collect.Set(goatcounter.CollectCountryUniques)
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gctest.StoreHits(ctx, t, false, hits(3, "NZ-AUK", 0)...)
+	gctest.StoreHits(ctx, t, false, append(hits(3, "NZ", 0), hits(5, "ID", 100)...)...)
+	want := "8 [{ID Indonesia 5 <nil>} {NZ New Zealand 3 <nil>}]"
+	if h := list(); h != want {
+		t.Errorf("\nhave: %s\nwant: %s", h, want)
+	}
+}
@@ -34,6 +34,7 @@ var Tasks = []Task{
 	{"rm old exports", oldExports, 1 * time.Hour},
 	{"cycle sessions", sessions, 1 * time.Minute},
 	{"send email reports", emailReports, 1 * time.Hour},
+	{"send stats hooks", statsHooks, 5 * time.Minute},
 	{"persist hits", persistAndStat, time.Duration(persistInterval.Load())},
 }
 
@@ -111,6 +112,7 @@ func TaskACME() error           { return bgrun.RunTask("cron:renewACME") }
 func TaskSessions() error       { return bgrun.RunTask("cron:sessions") }
 func TaskEmailReports() error   { return bgrun.RunTask("cron:emailReports") }
 func TaskPersistAndStat() error { return bgrun.RunTask("cron:persistAndStat") }
+func TaskStatsHooks() error     { return bgrun.RunTask("cron:statsHooks") }
 func WaitOldExports()           { bgrun.Wait("cron:oldExports") }
 func WaitDataRetention()        { bgrun.Wait("cron:dataRetention") }
 func WaitVacuumOldSites()       { bgrun.Wait("cron:vacuumDeleted") }
@@ -118,3 +120,4 @@ func WaitACME()                 { bgrun.Wait("cron:renewACME") }
 func WaitSessions()             { bgrun.Wait("cron:sessions") }
 func WaitEmailReports()         { bgrun.Wait("cron:emailReports") }
 func WaitPersistAndStat()       { bgrun.Wait("cron:persistAndStat") }
+func WaitStatsHooks()           { bgrun.Wait("cron:statsHooks") }
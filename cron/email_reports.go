@@ -172,6 +172,9 @@ func reportText(ctx context.Context, site goatcounter.Site, user goatcounter.Use
 		for i, p := range args.Pages {
 			path := p.Path
 			if p.Event {
+				if p.Label != "" {
+					path = p.Label
+				}
 				path += " (e)"
 			}
 
@@ -27,7 +27,7 @@ func updateHitStats(ctx context.Context, hits []goatcounter.Hit) error {
 		}
 		grouped := map[string]gt{}
 		for _, h := range hits {
-			if h.Bot > 0 {
+			if !h.CountsAsPageview(ctx) {
 				continue
 			}
 
@@ -52,7 +52,7 @@ func updateHitStats(ctx context.Context, hits []goatcounter.Hit) error {
 
 			hour, _ := strconv.ParseInt(h.CreatedAt.Format("15"), 10, 8)
 			if h.FirstVisit {
-				v.count[hour] += 1
+				v.count[hour] += h.Weight()
 			}
 			grouped[k] = v
 		}
@@ -11,6 +11,7 @@ import (
 
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/isbot"
 	"zgo.at/zstd/zjson"
 	"zgo.at/zstd/ztest"
 	"zgo.at/zstd/ztime"
@@ -189,3 +190,73 @@ func TestHitStatsNoCollect(t *testing.T) {
 		}]}`,
 	)
 }
+
+func TestHitStatsCountBots(t *testing.T) {
+	ctx := gctest.DB(t)
+	goatcounter.Config(ctx).CountBots = []int{int(isbot.BotLink)}
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Path: "/a", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Path: "/a", FirstVisit: true, Bot: int(isbot.BotLink)},
+		{Site: site.ID, CreatedAt: now, Path: "/a", FirstVisit: true, Bot: int(isbot.BotKnownBot)},
+	}...)
+
+	var stats goatcounter.HitLists
+	display, _, err := stats.List(ctx,
+		ztime.NewRange(now.Add(-1*time.Hour)).To(now.Add(1*time.Hour)),
+		nil, nil, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if display != 2 {
+		t.Errorf("display is %d, want 2", display)
+	}
+
+	// Should still be stored as a bot.
+	var hits goatcounter.Hits
+	err = hits.TestList(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := fmt.Sprintf("%d %d %d", hits[0].Bot, hits[1].Bot, hits[2].Bot)
+	if want := "0 3 5"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestHitStatsSampleWeight(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Path: "/a", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Path: "/a", FirstVisit: true, SampleWeight: 4},
+	}...)
+
+	var stats goatcounter.HitLists
+	display, _, err := stats.List(ctx,
+		ztime.NewRange(now.Add(-1*time.Hour)).To(now.Add(1*time.Hour)),
+		nil, nil, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if display != 5 {
+		t.Errorf("display is %d, want 5", display)
+	}
+
+	// Stored, so that a reindex gives the same result.
+	var hits goatcounter.Hits
+	err = hits.TestList(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := fmt.Sprintf("%d %d", hits[0].SampleWeight, hits[1].SampleWeight)
+	if want := "1 4"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
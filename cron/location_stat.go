@@ -22,12 +22,13 @@ func updateLocationStats(ctx context.Context, hits []goatcounter.Hit) error {
 			pathID   int64
 		}
 		grouped := map[string]gt{}
+		loc := goatcounter.MustGetSite(ctx).Settings.Timezone.Loc()
 		for _, h := range hits {
-			if h.Bot > 0 {
+			if !h.CountsAsPageview(ctx) {
 				continue
 			}
 
-			day := h.CreatedAt.Format("2006-01-02")
+			day := h.CreatedAt.In(loc).Format("2006-01-02")
 			k := day + h.Location + strconv.FormatInt(h.PathID, 10)
 			v := grouped[k]
 			if v.count == 0 {
@@ -43,7 +44,7 @@ func updateLocationStats(ctx context.Context, hits []goatcounter.Hit) error {
 			(&goatcounter.Location{}).ByCode(ctx, h.Location)
 
 			if h.FirstVisit {
-				v.count += 1
+				v.count += h.Weight()
 			}
 			grouped[k] = v
 		}
@@ -24,7 +24,7 @@ func updateRefCounts(ctx context.Context, hits []goatcounter.Hit) error {
 		}
 		grouped := map[string]gt{}
 		for _, h := range hits {
-			if h.Bot > 0 {
+			if !h.CountsAsPageview(ctx) {
 				continue
 			}
 
@@ -38,7 +38,7 @@ func updateRefCounts(ctx context.Context, hits []goatcounter.Hit) error {
 			}
 
 			if h.FirstVisit {
-				v.total += 1
+				v.total += h.Weight()
 			}
 			grouped[k] = v
 		}
@@ -0,0 +1,174 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Stats tables with the column that's used to group them by time, and the
+// function to update it.
+//
+// The tables with local set store the days in the site's timezone rather than
+// UTC.
+var reindexTables = []struct {
+	table, column string
+	local         bool
+	update        func(context.Context, []goatcounter.Hit) error
+}{
+	{"hit_counts", "hour", false, updateHitCounts},
+	{"ref_counts", "hour", false, updateRefCounts},
+	{"hit_stats", "day", false, updateHitStats},
+	{"browser_stats", "day", true, updateBrowserStats},
+	{"system_stats", "day", true, updateSystemStats},
+	{"location_stats", "day", true, updateLocationStats},
+	{"language_stats", "day", true, updateLanguageStats},
+	{"size_stats", "day", true, updateSizeStats},
+	{"campaign_stats", "day", true, updateCampaignStats},
+	{"country_uniques", "day", true, updateCountryUniques},
+}
+
+// Reindex rebuilds the stats tables of the site from the hits table, for every
+// day in the range. The tables that are stored in UTC are rebuilt per UTC day,
+// and the tables that are stored in the site's timezone per day in that
+// timezone, so a day is always rebuilt from all its pageviews. If the start or
+// end of the range is zero it uses the day of the first or last hit.
+//
+// The stats are updated when pageviews are persisted, so this is only needed
+// to backfill them; for example for hits inserted directly in the database, or
+// if the stats got out of sync because of an error.
+//
+// Days that may have pageviews removed because of SiteSettings.SessionRetention
+// are skipped.
+//
+// The progress callback is called after every day, if it's not nil.
+func Reindex(ctx context.Context, site *goatcounter.Site, rng ztime.Range, progress func(day time.Time, n int)) error {
+	ctx = goatcounter.WithSite(ctx, site)
+
+	if rng.Start.IsZero() {
+		err := zdb.Get(ctx, &rng.Start, `select created_at from hits where site_id=$1 order by created_at asc limit 1`, site.ID)
+		if zdb.ErrNoRows(err) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "cron.Reindex")
+		}
+	}
+	// Don't remove the stats for days that are missing pageviews because of
+	// the SessionRetention.
+	if r := site.Settings.SessionRetention; r > 0 {
+		keep := ztime.Now().UTC().Add(-time.Duration(r) * 24 * time.Hour).Truncate(24 * time.Hour).Add(24 * time.Hour)
+		if rng.Start.Before(keep) {
+			rng.Start = keep
+		}
+	}
+	if rng.End.IsZero() {
+		err := zdb.Get(ctx, &rng.End, `select created_at from hits where site_id=$1 order by created_at desc limit 1`, site.ID)
+		if zdb.ErrNoRows(err) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "cron.Reindex")
+		}
+	}
+
+	// Include the days in the site's timezone at the start and end, which may
+	// be before or after the UTC days.
+	var (
+		loc   = site.Settings.Timezone.Loc()
+		first = rng.Start.UTC().Truncate(24 * time.Hour)
+		last  = rng.End.UTC()
+	)
+	if d := reindexDate(rng.Start.In(loc)); d.Before(first) {
+		first = d
+	}
+	if d := reindexDate(rng.End.In(loc)); d.After(last) {
+		last = d
+	}
+	for day := first; !day.After(last); day = day.Add(24 * time.Hour) {
+		n, err := reindexDay(ctx, site, day)
+		if err != nil {
+			return errors.Wrapf(err, "cron.Reindex %s", day.Format("2006-01-02"))
+		}
+		if progress != nil {
+			progress(day, n)
+		}
+	}
+
+	site.ClearCache(ctx, true)
+	return nil
+}
+
+// reindexDate gets the date of t, as midnight UTC.
+func reindexDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// reindexDay rebuilds the stats for the UTC day and the same day in the site's
+// timezone; it returns the number of pageviews in the UTC day.
+func reindexDay(ctx context.Context, site *goatcounter.Site, day time.Time) (int, error) {
+	loc := site.Settings.Timezone.Loc()
+	passes := []struct {
+		local bool
+		rng   ztime.Range
+	}{
+		{false, ztime.NewRange(day).To(day.AddDate(0, 0, 1))},
+		{true, ztime.NewRange(time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc).UTC()).
+			To(time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, loc).UTC())},
+	}
+	// Do everything at once if the site's timezone is UTC.
+	sameDay := passes[1].rng.Start.Equal(day) && passes[1].rng.End.Equal(passes[0].rng.End)
+	if sameDay {
+		passes = passes[:1]
+	}
+
+	var n int
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		for _, p := range passes {
+			var update []func(context.Context, []goatcounter.Hit) error
+			for _, t := range reindexTables {
+				if t.local != p.local && !sameDay {
+					continue
+				}
+				start, end := day.Format("2006-01-02"), day.AddDate(0, 0, 1).Format("2006-01-02")
+				if t.column == "hour" {
+					start, end = day.Format("2006-01-02 15:04:05"), day.AddDate(0, 0, 1).Format("2006-01-02 15:04:05")
+				}
+				err := zdb.Exec(ctx, `delete from `+t.table+` where site_id=$1 and `+t.column+` >= $2 and `+t.column+` < $3`,
+					site.ID, start, end)
+				if err != nil {
+					return errors.Wrap(err, t.table)
+				}
+				update = append(update, t.update)
+			}
+
+			var hits goatcounter.Hits
+			err := hits.ListRange(ctx, p.rng)
+			if err != nil {
+				return err
+			}
+			if !p.local {
+				n = len(hits)
+			}
+			if len(hits) == 0 {
+				continue
+			}
+			for _, f := range update {
+				err := f(ctx, hits)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return n, err
+}
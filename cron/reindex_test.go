@@ -0,0 +1,198 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/tz"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestReindex(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := goatcounter.MustGetSite(ctx)
+
+	var (
+		day1 = ztime.FromString("2020-06-18 12:00:00")
+		day2 = ztime.FromString("2020-06-19 23:30:00")
+		day3 = ztime.FromString("2020-06-21 00:10:00")
+		ua   = "Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0"
+	)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{CreatedAt: day1, Path: "/a", FirstVisit: zbool.Bool(true), UserAgentHeader: ua},
+		goatcounter.Hit{CreatedAt: day1, Path: "/a", FirstVisit: zbool.Bool(false), UserAgentHeader: ua},
+		goatcounter.Hit{CreatedAt: day1, Path: "/b", FirstVisit: zbool.Bool(true), Ref: "https://example.com"},
+		goatcounter.Hit{CreatedAt: day2, Path: "/a", FirstVisit: zbool.Bool(true), Location: "NL"},
+		goatcounter.Hit{CreatedAt: day2, Path: "/b", FirstVisit: zbool.Bool(true), Ref: "https://example.com"},
+		goatcounter.Hit{CreatedAt: day3, Path: "/a", FirstVisit: zbool.Bool(true), Size: goatcounter.Floats{1920, 1080, 1}},
+		goatcounter.Hit{CreatedAt: day3, Path: "/c", FirstVisit: zbool.Bool(true), Bot: 3},
+	)
+
+	var (
+		rollup = func() string {
+			return zdb.DumpString(ctx, `select path_id, hour, total from hit_counts order by hour, path_id`) +
+				zdb.DumpString(ctx, `select path_id, ref_id, hour, total from ref_counts order by hour, path_id, ref_id`) +
+				zdb.DumpString(ctx, `select path_id, day, stats from hit_stats order by day, path_id`) +
+				zdb.DumpString(ctx, `select path_id, browser_id, day, count from browser_stats order by day, path_id, browser_id`) +
+				zdb.DumpString(ctx, `select path_id, location, day, count from location_stats order by day, path_id, location`) +
+				zdb.DumpString(ctx, `select path_id, width, day, count from size_stats order by day, path_id, width`)
+		}
+		want = rollup()
+	)
+
+	// Compare the rollups against the raw pageviews; only first visits are
+	// counted, and bots excluded.
+	check := func(t *testing.T) {
+		t.Helper()
+		have := rollup()
+		if d := ztest.Diff(have, want); d != "" {
+			t.Error(d)
+		}
+
+		var raw, total int
+		err := zdb.Get(ctx, &raw, `select count(*) from hits where site_id=$1 and first_visit=1 and bot=0`, site.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = zdb.Get(ctx, &total, `select coalesce(sum(total), 0) from hit_counts where site_id=$1`, site.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw != 5 || total != raw {
+			t.Errorf("raw=%d; rollup=%d", raw, total)
+		}
+	}
+
+	t.Run("all", func(t *testing.T) {
+		for _, tbl := range []string{"hit_counts", "ref_counts", "hit_stats", "browser_stats", "location_stats", "size_stats"} {
+			err := zdb.Exec(ctx, `delete from `+tbl)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var days []string
+		err := cron.Reindex(ctx, site, ztime.Range{}, func(day time.Time, n int) {
+			days = append(days, day.Format("2006-01-02"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(days) != 4 || days[0] != "2020-06-18" || days[3] != "2020-06-21" {
+			t.Errorf("days: %v", days)
+		}
+		check(t)
+	})
+
+	t.Run("again", func(t *testing.T) {
+		err := cron.Reindex(ctx, site, ztime.Range{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+
+	t.Run("range", func(t *testing.T) {
+		err := zdb.Exec(ctx, `update hit_counts set total=total+10`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = cron.Reindex(ctx, site, ztime.NewRange(day2).To(day2), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var total int
+		err = zdb.Get(ctx, &total, `select sum(total) from hit_counts where site_id=$1`, site.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 5+30 { // Three rows on day1 and day3 aren't reindexed.
+			t.Errorf("total=%d", total)
+		}
+
+		err = cron.Reindex(ctx, site, ztime.NewRange(day1).To(day3), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+}
+
+func TestReindexTimezone(t *testing.T) {
+	for _, zone := range []string{"Europe/Amsterdam", "America/New_York"} {
+		t.Run(zone, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			site := goatcounter.MustGetSite(ctx)
+			site.Settings.Timezone = tz.MustNew("", zone)
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Pageviews around the UTC and local day boundaries; UTC+2 and UTC-4
+			// in June.
+			ua := "Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0"
+			var hits []goatcounter.Hit
+			for _, c := range []string{"2020-06-18 01:30:00", "2020-06-18 03:30:00", "2020-06-18 12:00:00",
+				"2020-06-18 21:30:00", "2020-06-18 22:30:00", "2020-06-19 02:00:00", "2020-06-19 23:30:00"} {
+				hits = append(hits, goatcounter.Hit{CreatedAt: ztime.FromString(c), Path: "/a",
+					FirstVisit: zbool.Bool(true), UserAgentHeader: ua, Location: "NL"})
+			}
+			gctest.StoreHits(ctx, t, false, hits...)
+
+			var (
+				rollup = func() string {
+					return zdb.DumpString(ctx, `select path_id, hour, total from hit_counts order by hour, path_id`) +
+						zdb.DumpString(ctx, `select path_id, day, stats from hit_stats order by day, path_id`) +
+						zdb.DumpString(ctx, `select path_id, browser_id, day, count from browser_stats order by day, path_id, browser_id`) +
+						zdb.DumpString(ctx, `select path_id, location, day, count from location_stats order by day, path_id, location`) +
+						zdb.DumpString(ctx, `select day, location from country_uniques order by day, location`)
+				}
+				want = rollup()
+			)
+			check := func(t *testing.T) {
+				t.Helper()
+				if d := ztest.Diff(rollup(), want); d != "" {
+					t.Error(d)
+				}
+			}
+
+			t.Run("day", func(t *testing.T) {
+				for _, d := range []string{"2020-06-18 12:00:00", "2020-06-19 12:00:00"} {
+					day := ztime.FromString(d)
+					err := cron.Reindex(ctx, site, ztime.NewRange(day).To(day), nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					check(t)
+				}
+			})
+
+			t.Run("all", func(t *testing.T) {
+				for _, tbl := range []string{"hit_counts", "ref_counts", "hit_stats", "browser_stats", "location_stats", "country_uniques"} {
+					err := zdb.Exec(ctx, `delete from `+tbl)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				err := cron.Reindex(ctx, site, ztime.Range{}, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				check(t)
+			})
+		})
+	}
+}
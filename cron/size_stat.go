@@ -22,8 +22,9 @@ func updateSizeStats(ctx context.Context, hits []goatcounter.Hit) error {
 			pathID int64
 		}
 		grouped := map[string]gt{}
+		loc := goatcounter.MustGetSite(ctx).Settings.Timezone.Loc()
 		for _, h := range hits {
-			if h.Bot > 0 {
+			if !h.CountsAsPageview(ctx) {
 				continue
 			}
 
@@ -32,7 +33,7 @@ func updateSizeStats(ctx context.Context, hits []goatcounter.Hit) error {
 				width = int(h.Size[0]) // TODO: apply scaling?
 			}
 
-			day := h.CreatedAt.Format("2006-01-02")
+			day := h.CreatedAt.In(loc).Format("2006-01-02")
 			k := day + strconv.Itoa(width) + strconv.FormatInt(h.PathID, 10)
 			v := grouped[k]
 			if v.count == 0 {
@@ -42,7 +43,7 @@ func updateSizeStats(ctx context.Context, hits []goatcounter.Hit) error {
 			}
 
 			if h.FirstVisit {
-				v.count += 1
+				v.count += h.Weight()
 			}
 			grouped[k] = v
 		}
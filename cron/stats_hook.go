@@ -0,0 +1,181 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+const (
+	// Wait this long after the end of a period before sending it, so that
+	// the last pageviews are persisted.
+	statsHookDelay = time.Minute
+
+	// Maximum number of periods to send if we're behind, e.g. after the
+	// server was down or the endpoint kept failing; older periods are
+	// skipped.
+	statsHookBacklog = 24
+
+	// Maximum number of paths and refs to send.
+	statsHookLimit = 1000
+)
+
+var statsHookClient = &http.Client{Timeout: 10 * time.Second}
+
+type (
+	statsHookBody struct {
+		Site  int64                 `json:"site"`
+		Start time.Time             `json:"start"`
+		End   time.Time             `json:"end"`
+		Total int                   `json:"total"`
+		Paths []statsHookPath       `json:"paths,omitempty"`
+		Refs  []goatcounter.HitStat `json:"refs,omitempty"`
+	}
+	statsHookPath struct {
+		Path  string `json:"path"`
+		Title string `json:"title"`
+		Event bool   `json:"event"`
+		Count int    `json:"count"`
+	}
+)
+
+// statsHooks sends the totals for all sites with a StatsHook that are due.
+//
+// The end of the last period that was sent is stored, and if a request fails
+// it's tried again on the next run.
+func statsHooks(ctx context.Context) error {
+	var sites goatcounter.Sites
+	err := sites.UnscopedList(ctx)
+	if err != nil {
+		return errors.Errorf("cron.statsHooks: %w", err)
+	}
+
+	now := ztime.Now().UTC()
+	errs := errors.NewGroup(10)
+	for _, s := range sites {
+		if !s.Settings.StatsHook.Enabled() {
+			continue
+		}
+		errs.Append(sendStatsHook(goatcounter.WithSite(ctx, &s), s, now))
+	}
+	return errs.ErrorOrNil()
+}
+
+func sendStatsHook(ctx context.Context, site goatcounter.Site, now time.Time) error {
+	var (
+		every = time.Duration(site.Settings.StatsHook.Interval) * time.Hour
+		end   = now.Add(-statsHookDelay).Truncate(every)
+		start = end.Add(-every)
+		key   = fmt.Sprintf("stats-hook-%d", site.ID)
+	)
+
+	var last string
+	err := zdb.Get(ctx, &last, `select value from store where key=?`, key)
+	if err != nil && !zdb.ErrNoRows(err) {
+		return errors.Errorf("cron.sendStatsHook: site=%d: %w", site.ID, err)
+	}
+	if t, err := time.Parse(time.RFC3339, last); err == nil {
+		start = t
+	}
+	if min := end.Add(-statsHookBacklog * every); start.Before(min) {
+		start = min
+	}
+
+	for ; !start.Add(every).After(end); start = start.Add(every) {
+		err := postStatsHook(ctx, site, start, start.Add(every))
+		if err != nil {
+			return errors.Errorf("cron.sendStatsHook: site=%d: %w", site.ID, err)
+		}
+
+		err = zdb.TX(ctx, func(ctx context.Context) error {
+			err := zdb.Exec(ctx, `delete from store where key=?`, key)
+			if err != nil {
+				return err
+			}
+			return zdb.Exec(ctx, `insert into store (key, value) values (?, ?)`,
+				key, start.Add(every).Format(time.RFC3339))
+		})
+		if err != nil {
+			return errors.Errorf("cron.sendStatsHook: site=%d: %w", site.ID, err)
+		}
+	}
+	return nil
+}
+
+// postStatsHook sends the totals from start up to (but not including) end. It
+// doesn't send anything if there are no pageviews.
+func postStatsHook(ctx context.Context, site goatcounter.Site, start, end time.Time) error {
+	var (
+		h    = site.Settings.StatsHook
+		rng  = ztime.NewRange(start).To(end.Add(-time.Nanosecond))
+		body = statsHookBody{Site: site.ID, Start: start, End: end}
+	)
+
+	var total goatcounter.HitList
+	err := total.SiteTotalUTC(ctx, rng)
+	if err != nil {
+		return err
+	}
+	if total.Count == 0 {
+		return nil
+	}
+	body.Total = total.Count
+
+	for _, d := range h.Dimensions {
+		switch d {
+		case "paths":
+			var pages goatcounter.HitLists
+			err := pages.ListCounts(ctx, rng, statsHookLimit)
+			if err != nil {
+				return err
+			}
+			body.Paths = make([]statsHookPath, 0, len(pages))
+			for _, p := range pages {
+				body.Paths = append(body.Paths, statsHookPath{Path: p.Path, Title: p.Title, Event: bool(p.Event), Count: p.Count})
+			}
+		case "refs":
+			var refs goatcounter.HitStats
+			err := refs.ListTopRefs(ctx, rng, nil, statsHookLimit, 0)
+			if err != nil {
+				return err
+			}
+			body.Refs = refs.Stats
+		}
+	}
+
+	d, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(d))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GoatCounter/"+goatcounter.Version)
+	req.Header.Set("X-Goatcounter-Signature", goatcounter.SignStatsHook(h.Secret, d, ztime.Now()))
+
+	resp, err := statsHookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("%s returned %s", h.URL, resp.Status)
+	}
+	return nil
+}
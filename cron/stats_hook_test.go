@@ -0,0 +1,147 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestStatsHooks(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	type body struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+		Total int       `json:"total"`
+		Paths []struct {
+			Path  string `json:"path"`
+			Count int    `json:"count"`
+		} `json:"paths"`
+		Refs []struct {
+			Name  string `json:"name"`
+			Count int    `json:"count"`
+		} `json:"refs"`
+	}
+	var (
+		mu     sync.Mutex
+		bodies []body
+		fail   atomic.Bool
+	)
+	site := goatcounter.MustGetSite(ctx)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(500)
+			return
+		}
+		d, _ := io.ReadAll(r.Body)
+		err := goatcounter.VerifyPathSignature(site.Settings.StatsHook.Secret, string(d),
+			r.Header.Get("X-Goatcounter-Signature"), ztime.Now())
+		if err != nil {
+			t.Errorf("signature: %s", err)
+		}
+		var b body
+		if err := json.Unmarshal(d, &b); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		bodies = append(bodies, b)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	site.Settings.StatsHook = goatcounter.StatsHook{URL: srv.URL, Dimensions: goatcounter.Strings{"paths", "refs"}}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(site.Settings.StatsHook.Secret) < 16 {
+		t.Fatalf("no secret: %q", site.Settings.StatsHook.Secret)
+	}
+
+	run := func(now string) []body {
+		t.Helper()
+		ztime.SetNow(t, now)
+		err := cron.TaskStatsHooks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitStatsHooks()
+		mu.Lock()
+		defer mu.Unlock()
+		b := bodies
+		bodies = nil
+		return b
+	}
+	store := func(at string, paths ...string) {
+		t.Helper()
+		created := ztime.FromString(at)
+		ztime.SetNow(t, at)
+		hits := make([]goatcounter.Hit, 0, len(paths))
+		for _, p := range paths {
+			hits = append(hits, goatcounter.Hit{Site: site.ID, Path: p, FirstVisit: true, CreatedAt: created,
+				Ref: "https://example.com"})
+		}
+		gctest.StoreHits(ctx, t, false, hits...)
+	}
+
+	store("2020-06-18 11:30:00", "/a")
+	store("2020-06-18 12:10:00", "/a", "/a", "/b")
+
+	// Only the last full hour is sent the first time.
+	b := run("2020-06-18 13:05:00")
+	if len(b) != 1 {
+		t.Fatalf("%d requests", len(b))
+	}
+	if !b[0].Start.Equal(ztime.FromString("2020-06-18 12:00:00")) || !b[0].End.Equal(ztime.FromString("2020-06-18 13:00:00")) {
+		t.Errorf("wrong period: %s – %s", b[0].Start, b[0].End)
+	}
+	if b[0].Total != 3 {
+		t.Errorf("total: %d", b[0].Total)
+	}
+	if len(b[0].Paths) != 2 || b[0].Paths[0].Path != "/a" || b[0].Paths[0].Count != 2 ||
+		b[0].Paths[1].Path != "/b" || b[0].Paths[1].Count != 1 {
+		t.Errorf("paths: %+v", b[0].Paths)
+	}
+	if len(b[0].Refs) != 1 || b[0].Refs[0].Name != "example.com" || b[0].Refs[0].Count != 3 {
+		t.Errorf("refs: %+v", b[0].Refs)
+	}
+
+	// Already sent.
+	if b := run("2020-06-18 13:30:00"); len(b) != 0 {
+		t.Errorf("%d requests", len(b))
+	}
+	// No pageviews.
+	if b := run("2020-06-18 14:05:00"); len(b) != 0 {
+		t.Errorf("%d requests", len(b))
+	}
+
+	// Retried on the next run if it fails.
+	store("2020-06-18 14:10:00", "/c")
+	fail.Store(true)
+	if b := run("2020-06-18 15:05:00"); len(b) != 0 {
+		t.Errorf("%d requests", len(b))
+	}
+	fail.Store(false)
+	b = run("2020-06-18 16:05:00")
+	if len(b) != 1 {
+		t.Fatalf("%d requests", len(b))
+	}
+	if !b[0].Start.Equal(ztime.FromString("2020-06-18 14:00:00")) || b[0].Total != 1 ||
+		len(b[0].Paths) != 1 || b[0].Paths[0].Path != "/c" {
+		t.Errorf("%+v", b[0])
+	}
+}
@@ -63,13 +63,17 @@ func dataRetention(ctx context.Context) error {
 	}
 
 	for _, s := range sites {
-		if s.Settings.DataRetention <= 0 {
-			continue
+		if s.Settings.DataRetention > 0 {
+			err = s.DeleteOlderThan(ctx, s.Settings.DataRetention)
+			if err != nil {
+				zlog.Module("cron").Field("site", s.ID).Error(err)
+			}
 		}
-
-		err = s.DeleteOlderThan(ctx, s.Settings.DataRetention)
-		if err != nil {
-			zlog.Module("cron").Field("site", s.ID).Error(err)
+		if s.Settings.SessionRetention > 0 {
+			err = s.DeleteHitsOlderThan(ctx, s.Settings.SessionRetention)
+			if err != nil {
+				zlog.Module("cron").Field("site", s.ID).Error(err)
+			}
 		}
 	}
 
@@ -80,22 +84,23 @@ func persistAndStat(ctx context.Context) error {
 	l := zlog.Module("cron")
 	l.Debug("persistAndStat started")
 
+	// The hits are returned on errors too if only some pageviews were stored;
+	// update the stats for those and return the error at the end.
 	hits, err := goatcounter.Memstore.Persist(ctx)
-	if err != nil {
-		return err
-	}
 	if len(hits) > 0 {
 		l = l.Since("memstore")
 	}
 
 	grouped := make(map[int64][]goatcounter.Hit)
 	for _, h := range hits {
-		if h.Bot > 0 {
+		if !h.CountsAsPageview(ctx) {
 			continue
 		}
 		grouped[h.Site] = append(grouped[h.Site], h)
 	}
+	now := ztime.Now()
 	for siteID, hits := range grouped {
+		alerts.record(siteID, len(hits), now)
 		err := UpdateStats(ctx, nil, siteID, hits)
 		if err != nil {
 			l.Fields(zlog.F{
@@ -108,6 +113,12 @@ func persistAndStat(ctx context.Context) error {
 	if len(hits) > 0 {
 		l.Since("stats").FieldsSince().Debugf("persisted %d hits", len(hits))
 	}
+
+	if send := alerts.check(ctx, now); len(send) > 0 {
+		if err := sendAlerts(ctx, send); err != nil {
+			l.Error(err)
+		}
+	}
 	return err
 }
 
@@ -134,6 +145,7 @@ func UpdateStats(ctx context.Context, site *goatcounter.Site, siteID int64, hits
 		updateLanguageStats,
 		updateSizeStats,
 		updateCampaignStats,
+		updateCountryUniques,
 	}
 
 	for _, f := range funs {
@@ -199,7 +211,7 @@ func vacuumDeleted(ctx context.Context) error {
 			for _, t := range []string{"hits", "paths",
 				"hit_counts", "ref_counts",
 				"browser_stats", "system_stats", "hit_stats", "location_stats", "language_stats", "size_stats",
-				"campaign_stats", "exports", "api_tokens", "users", "sites"} {
+				"campaign_stats", "country_uniques", "js_errors", "exports", "api_tokens", "users", "sites"} {
 
 				err := zdb.Exec(ctx, fmt.Sprintf(`delete from %s where site_id=%d`, t, s.ID))
 				if err != nil {
@@ -216,7 +228,6 @@ func vacuumDeleted(ctx context.Context) error {
 }
 
 func sessions(ctx context.Context) error {
-	goatcounter.Memstore.EvictSessions()
 	goatcounter.Memstore.RefreshSalt()
 	return nil
 }
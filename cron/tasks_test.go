@@ -65,3 +65,68 @@ func TestDataRetention(t *testing.T) {
 		t.Errorf("\ngot:  %s\nwant: %s", out, want)
 	}
 }
+
+func TestSessionRetention(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.Site{Code: "bbbb", Settings: goatcounter.SiteSettings{DataRetention: 31, SessionRetention: 7}}
+	err := site.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = goatcounter.WithSite(ctx, &site)
+
+	now := time.Now().UTC()
+	past := now.Add(-10 * 24 * time.Hour)
+
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Path: "/a", FirstVisit: zbool.Bool(true)},
+		{Site: site.ID, CreatedAt: past, Path: "/a", FirstVisit: zbool.Bool(true)},
+		{Site: site.ID, CreatedAt: past, Path: "/b", FirstVisit: zbool.Bool(true)},
+	}...)
+
+	err = cron.TaskDataRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitDataRetention()
+
+	var hits goatcounter.Hits
+	err = hits.TestList(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 {
+		t.Errorf("len(hits) is %d\n%v", len(hits), hits)
+	}
+
+	// Stats are kept.
+	var stats goatcounter.HitLists
+	display, more, err := stats.List(ctx,
+		ztime.NewRange(past.Add(-1*24*time.Hour)).To(now),
+		nil, nil, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := fmt.Sprintf("%d %t %v", display, more, err)
+	want := `3 false <nil>`
+	if out != want {
+		t.Errorf("\ngot:  %s\nwant: %s", out, want)
+	}
+
+	// Reindexing doesn't remove the stats for days without pageviews.
+	err = cron.Reindex(ctx, &site, ztime.Range{Start: past}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = goatcounter.HitLists{}
+	display, _, err = stats.List(ctx,
+		ztime.NewRange(past.Add(-1*24*time.Hour)).To(now),
+		nil, nil, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if display != 3 {
+		t.Errorf("display after reindex: %d", display)
+	}
+}
@@ -0,0 +1 @@
+alter table hits add column prev_path_id integer default null;
@@ -0,0 +1,2 @@
+alter table hits add column tls_version integer not null default 0;
+alter table hits add column tls_cipher  integer not null default 0;
@@ -0,0 +1 @@
+alter table hits add column type varchar not null default 'pageview';
@@ -0,0 +1 @@
+alter table hits add column tz_offset integer default null;
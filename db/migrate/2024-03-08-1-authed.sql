@@ -0,0 +1 @@
+alter table hits add column authed integer default null;
@@ -0,0 +1,3 @@
+alter table hits add column perf_ttfb integer default null;
+alter table hits add column perf_dcl  integer default null;
+alter table hits add column perf_load integer default null;
@@ -0,0 +1 @@
+alter table hits add column languages varchar not null default '';
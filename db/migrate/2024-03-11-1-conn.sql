@@ -0,0 +1 @@
+alter table hits add column conn varchar not null default '';
@@ -0,0 +1,2 @@
+alter table hits add column asn integer not null default 0;
+alter table hits add column asn_org varchar not null default '';
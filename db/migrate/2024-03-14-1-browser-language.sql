@@ -0,0 +1 @@
+alter table hits add column browser_language varchar;
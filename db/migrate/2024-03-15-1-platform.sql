@@ -0,0 +1 @@
+alter table hits add column platform varchar not null default 'web';
@@ -0,0 +1 @@
+alter table hits add column bot_class varchar not null default '';
@@ -0,0 +1 @@
+alter table hits add column event_value double precision default null;
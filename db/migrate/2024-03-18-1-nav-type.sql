@@ -0,0 +1 @@
+alter table hits add column nav_type varchar not null default '';
@@ -0,0 +1 @@
+alter table hits add column source_name varchar not null default '';
@@ -0,0 +1 @@
+alter table hits add column session_throttled integer not null default 0;
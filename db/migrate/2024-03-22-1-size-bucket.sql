@@ -0,0 +1 @@
+alter table hits add column size_bucket varchar not null default '';
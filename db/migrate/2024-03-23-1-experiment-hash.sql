@@ -0,0 +1 @@
+alter table hits add column experiment_hash varchar not null default '';
@@ -0,0 +1 @@
+alter table hits add column sample_weight integer not null default 1;
@@ -0,0 +1,9 @@
+select
+	path_id,
+	coalesce(sum(case when hour >= :start then total end), 0) as cur,
+	coalesce(sum(case when hour <= :prevend then total end), 0) as prev
+from hit_counts
+where
+	site_id = :site and path_id in (:paths) and
+	hour >= :prevstart and hour <= :end
+group by path_id
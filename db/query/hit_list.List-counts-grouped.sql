@@ -0,0 +1,8 @@
+select sum(total) as total, path_id, paths.path, paths.title, paths.event from hit_counts
+join paths using (path_id)
+where
+	hit_counts.site_id = :site and
+	{{:filter path_id in (:filter) and}}
+	hour>=:start and hour<=:end
+group by path_id, paths.path, paths.title, paths.event
+order by total desc, path_id desc
@@ -0,0 +1,13 @@
+select
+	paths.path_id,
+	paths.path,
+	paths.title,
+	paths.event,
+	sum(total) as count
+from hit_counts
+join paths using (path_id)
+where
+	hit_counts.site_id = :site and hour >= :start and hour <= :end
+group by paths.path_id, paths.path, paths.title, paths.event
+order by count desc, paths.path_id desc
+limit :limit
@@ -0,0 +1,15 @@
+select
+	hits.path_id,
+	paths.path             as event,
+	count(*)               as count,
+	sum(hits.event_value)  as total,
+	avg(hits.event_value)  as average
+from hits
+join paths using (path_id)
+where
+	hits.site_id = :site and hits.bot in (:bots) and hits.event_value is not null and
+	hits.created_at >= :start and hits.created_at <= :end
+	{{:filter and hits.path_id in (:filter)}}
+group by hits.path_id, paths.path
+order by total desc, event asc
+limit :limit
@@ -0,0 +1,12 @@
+with x as (
+	select coalesce(sum(total), 0) as count
+	from ref_counts
+	left join refs using (ref_id)
+	where
+		site_id = :site and hour >= :start and hour <= :end
+		{{:filter and path_id in (:filter)}}
+		{{:has_domain and (refs.ref is null or refs.ref not like :ref)}}
+	group by ref_id
+	having coalesce(sum(total), 0) < :min
+)
+select coalesce(sum(count), 0) from x
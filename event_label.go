@@ -0,0 +1,70 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Maximum number of entries in SiteSettings.EventLabels.
+const MaxEventLabels = 500
+
+// EventLabels maps event names to a label to display in the dashboard and
+// aggregate exports, such as "btn_cta_click" to "Clicked signup button". The
+// event names are still stored as they're sent.
+//
+// The text format is one mapping per line, as "name -> label".
+type EventLabels map[string]string
+
+// eventLabelSep separates the name and label in the text format; whitespace
+// around it is ignored.
+const eventLabelSep = "->"
+
+func (e EventLabels) String() string {
+	names := make([]string, 0, len(e))
+	for n := range e {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+
+	b := new(strings.Builder)
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(n + " " + eventLabelSep + " " + e[n])
+	}
+	return b.String()
+}
+
+func (e EventLabels) MarshalText() ([]byte, error) { return []byte(e.String()), nil }
+
+func (e *EventLabels) UnmarshalText(v []byte) error {
+	n := make(EventLabels)
+	for i, line := range strings.Split(string(v), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, label, ok := strings.Cut(line, eventLabelSep)
+		if !ok {
+			return fmt.Errorf("line %d: no %q in %q", i+1, eventLabelSep, line)
+		}
+		n[strings.TrimSpace(name)] = strings.TrimSpace(label)
+	}
+	*e = n
+	return nil
+}
+
+// EventLabel gets the label for an event name from EventLabels, or the name
+// as-is if there is no label for it.
+func (ss SiteSettings) EventLabel(name string) string {
+	if l, ok := ss.EventLabels[name]; ok {
+		return l
+	}
+	return name
+}
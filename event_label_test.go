@@ -0,0 +1,104 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestEventLabels(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	err := site.Settings.EventLabels.UnmarshalText([]byte("btn_cta_click -> Clicked signup\n\n  /a->Not an event  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := site.Settings.EventLabels.String(), "/a -> Not an event\nbtn_cta_click -> Clicked signup"; have != want {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+	err = site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2019, 8, 10, 14, 0, 0, 0, time.UTC)
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "btn_cta_click", Event: true, FirstVisit: true, CreatedAt: now},
+		Hit{Path: "btn_cta_click", Event: true, FirstVisit: true, CreatedAt: now},
+		Hit{Path: "other_click", Event: true, FirstVisit: true, CreatedAt: now},
+		Hit{Path: "/a", FirstVisit: true, CreatedAt: now})
+	rng := ztime.NewRange(now.Add(-time.Hour)).To(now.Add(time.Hour))
+
+	t.Run("list", func(t *testing.T) {
+		var stats HitLists
+		_, _, err := stats.List(ctx, rng, nil, nil, 10, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		for _, s := range stats {
+			fmt.Fprintf(&b, "%s %q %d\n", s.Path, s.Label, s.Count)
+		}
+		want := "btn_cta_click \"Clicked signup\" 2\n/a \"\" 1\nother_click \"\" 1\n"
+		if have := b.String(); have != want {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+	})
+
+	t.Run("export", func(t *testing.T) {
+		var b strings.Builder
+		_, err := ExportAggregate(ctx, &b, rng, []string{"path"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ztest.NormalizeIndent(`
+			date,path,pageviews,visitors
+			2019-08-10,/a,1,1
+			2019-08-10,Clicked signup,2,2
+			2019-08-10,other_click,1,1`) + "\n"
+		if d := ztest.Diff(b.String(), want); d != "" {
+			t.Error(d)
+		}
+	})
+
+	t.Run("stored", func(t *testing.T) {
+		var paths []string
+		err := zdb.Select(ctx, &paths, `select path from paths order by path`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := strings.Join(paths, " "), "/a btn_cta_click other_click"; have != want {
+			t.Errorf("\nhave: %q\nwant: %q", have, want)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		ss := SiteSettings{EventLabels: make(EventLabels)}
+		ss.Defaults(ctx)
+		for i := 0; i <= MaxEventLabels; i++ {
+			ss.EventLabels[fmt.Sprintf("e%d", i)] = "label"
+		}
+		err := ss.Validate(ctx)
+		if !ztest.ErrorContains(err, fmt.Sprintf("can have at most %d entries", MaxEventLabels)) {
+			t.Errorf("wrong error: %v", err)
+		}
+
+		ss.EventLabels = EventLabels{"e": ""}
+		err = ss.Validate(ctx)
+		if !ztest.ErrorContains(err, "name and label must be set") {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
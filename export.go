@@ -5,18 +5,26 @@
 package goatcounter
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/csv"
 	"fmt"
 	"io"
 	"os"
 	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"zgo.at/blackmail"
 	"zgo.at/errors"
+	"zgo.at/guru"
+	"zgo.at/json"
 	"zgo.at/zdb"
 	"zgo.at/zlog"
 	"zgo.at/zstd/zbool"
@@ -329,6 +337,81 @@ func Import(
 	return &firstHitAt, nil
 }
 
+// ImportJSON imports pageviews from newline-delimited JSON, with an ExportRow
+// on every line as returned by /api/v0/hits. Session IDs are mapped to new ones
+// like Import() does.
+//
+// If lookupIP is set the location is looked up from the "ip" field if it's
+// set, instead of using the "location" field; this is useful to get consistent
+// locations for old pageviews with the current GeoIP database. The IP address
+// is never stored, and the location is only kept if the site collects it.
+// The "ip" field is ignored if lookupIP isn't set.
+//
+// Lines that can't be imported are skipped, and passed to lineErr; errors
+// reading fp stop the import. The number of imported pageviews is returned,
+// and the new FirstHitAt if it changed, also if there's an error.
+func ImportJSON(
+	ctx context.Context, fp io.Reader, lookupIP bool,
+	persist func(Hit, bool), lineErr func(line int, err error),
+) (int, *time.Time, error) {
+	site := MustGetSite(ctx)
+
+	var (
+		scan       = bufio.NewScanner(fp)
+		sessions   = make(map[zint.Uint128]zint.Uint128)
+		n          = 0
+		firstHitAt = site.FirstHitAt
+	)
+	scan.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scan.Scan(); line++ {
+		l := bytes.TrimSpace(scan.Bytes())
+		if len(l) == 0 {
+			continue
+		}
+
+		var row importRow
+		err := json.Unmarshal(l, &row)
+		if err != nil {
+			lineErr(line, err)
+			continue
+		}
+		hit, err := row.Hit(ctx, site.ID)
+		if err != nil {
+			lineErr(line, err)
+			continue
+		}
+		if lookupIP && row.IP != "" {
+			hit.Location = ""
+			if site.Settings.Collect.Has(CollectLocation) {
+				hit.Location = (Location{}).LookupIP(ctx, row.IP)
+			}
+		}
+		if hit.CreatedAt.Before(firstHitAt) {
+			firstHitAt = hit.CreatedAt
+		}
+
+		s, ok := sessions[row.Session]
+		if !ok {
+			sessions[row.Session] = Memstore.SessionID()
+			s = sessions[row.Session]
+		}
+		hit.Session = s
+
+		persist(hit, false)
+		n++
+	}
+	persist(Hit{}, true)
+
+	var first *time.Time
+	if !firstHitAt.Equal(site.FirstHitAt) {
+		first = &firstHitAt
+	}
+	if err := scan.Err(); err != nil {
+		return n, first, errors.Wrap(err, "goatcounter.ImportJSON")
+	}
+	return n, first, nil
+}
+
 // TODO: would be nice to have generic csv marshal/unmarshaler, so you can do:
 //
 //    Path string `csv:"1"`
@@ -343,25 +426,25 @@ func Import(
 // https://github.com/jszwec/csvutil
 
 type ExportRow struct { // Fields in order!
-	ID     int64 `db:"hit_id"`
-	SiteID int64 `db:"site_id"`
-
-	Path  string `db:"path"`
-	Title string `db:"title"`
-	Event string `db:"event"`
-
-	UserAgent string `db:"ua"`
-	Browser   string `db:"browser"`
-	System    string `db:"system"`
-
-	Session    zint.Uint128 `db:"session"`
-	Bot        string       `db:"bot"`
-	Ref        string       `db:"ref"`
-	RefScheme  string       `db:"ref_s"`
-	Size       string       `db:"size"`
-	Location   string       `db:"loc"`
-	FirstVisit string       `db:"first"`
-	CreatedAt  string       `db:"created_at"`
+	ID     int64 `db:"hit_id" json:"id"`
+	SiteID int64 `db:"site_id" json:"site_id"`
+
+	Path  string `db:"path" json:"path"`
+	Title string `db:"title" json:"title"`
+	Event string `db:"event" json:"event"`
+
+	UserAgent string `db:"ua" json:"user_agent"`
+	Browser   string `db:"browser" json:"browser"`
+	System    string `db:"system" json:"system"`
+
+	Session    zint.Uint128 `db:"session" json:"session"`
+	Bot        string       `db:"bot" json:"bot"`
+	Ref        string       `db:"ref" json:"ref"`
+	RefScheme  string       `db:"ref_s" json:"ref_scheme"`
+	Size       string       `db:"size" json:"size"`
+	Location   string       `db:"loc" json:"location"`
+	FirstVisit string       `db:"first" json:"first_visit"`
+	CreatedAt  string       `db:"created_at" json:"created_at"`
 }
 
 func (row *ExportRow) Read(line []string) error {
@@ -425,6 +508,13 @@ func (row ExportRow) Hit(ctx context.Context, siteID int64) (Hit, error) {
 	return hit, v.ErrorOrNil()
 }
 
+// importRow is an ExportRow for ImportJSON(), with the IP address to look up
+// the location from.
+type importRow struct {
+	ExportRow
+	IP string `json:"ip"`
+}
+
 type ExportRows []ExportRow
 
 // Export all hits for a site, including bot requests.
@@ -434,7 +524,22 @@ func (h *ExportRows) Export(ctx context.Context, limit, paginate int64) (int64,
 	}
 
 	err := zdb.Select(ctx, h, `
-		select
+		select `+exportRowsQuery+`
+		where hits.site_id=$1 and hit_id>$2
+		order by hit_id asc
+		limit $3`,
+		MustGetSite(ctx).ID, paginate, limit)
+
+	last := paginate
+	if len(*h) > 0 {
+		hh := *h
+		last = hh[len(hh)-1].ID
+	}
+
+	return last, errors.Wrap(err, "Hits.List")
+}
+
+const exportRowsQuery = `
 			hits.hit_id,
 			hits.site_id,
 
@@ -458,17 +563,365 @@ func (h *ExportRows) Export(ctx context.Context, limit, paginate int64) (int64,
 		left join refs     using (ref_id)
 		left join sizes    using (size_id)
 		left join browsers using (browser_id)
-		left join systems  using (system_id)
-		where hits.site_id=$1 and hit_id>$2
-		order by hit_id asc
-		limit $3`,
-		MustGetSite(ctx).ID, paginate, limit)
+		left join systems  using (system_id)`
 
-	last := paginate
-	if len(*h) > 0 {
-		hh := *h
-		last = hh[len(hh)-1].ID
+// ListCursor lists hits for a site ordered by (created_at, hit_id), starting
+// after the position in cursor; an empty cursor starts at the first hit.
+//
+// This returns the cursor for the next page, and if there are more rows after
+// this page. The cursor is opaque and stable: new hits are appended after the
+// last row, so paging forward never returns duplicates or skips rows even if
+// hits are added in the meanwhile (hits imported with a created_at before the
+// cursor won't be seen).
+func (h *ExportRows) ListCursor(ctx context.Context, cursor string, limit int) (string, bool, error) {
+	if limit < 1 || limit > 5000 {
+		limit = 5000
 	}
 
-	return last, errors.Wrap(err, "Hits.List")
+	var (
+		after   time.Time
+		afterID int64
+	)
+	if cursor != "" {
+		var err error
+		after, afterID, err = parseExportCursor(cursor)
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	err := zdb.Select(ctx, h, `/* ExportRows.ListCursor */
+		select `+exportRowsQuery+`
+		where hits.site_id = :site
+		{{:cursor and (hits.created_at > :after or (hits.created_at = :after and hits.hit_id > :after_id))}}
+		order by hits.created_at asc, hits.hit_id asc
+		limit :limit`,
+		zdb.P{
+			"site":     MustGetSite(ctx).ID,
+			"cursor":   cursor != "",
+			"after":    after,
+			"after_id": afterID,
+			"limit":    limit + 1,
+		})
+	if err != nil {
+		return "", false, errors.Wrap(err, "ExportRows.ListCursor")
+	}
+
+	more := len(*h) > limit
+	if more {
+		*h = (*h)[:limit]
+	}
+	if len(*h) == 0 {
+		return cursor, false, nil
+	}
+
+	last := (*h)[len(*h)-1]
+	t, err := time.Parse(time.RFC3339, last.CreatedAt)
+	if err != nil {
+		t, err = time.Parse("2006-01-02 15:04:05", last.CreatedAt)
+		if err != nil {
+			return "", false, errors.Wrap(err, "ExportRows.ListCursor")
+		}
+	}
+	return exportCursor(t, last.ID), more, nil
+}
+
+// exportCursor creates a cursor for ListCursor(). This includes the fractional
+// seconds, as PostgreSQL stores created_at with microsecond precision;
+// truncating it would return the rows in the same second again or skip them.
+func exportCursor(t time.Time, id int64) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(t.UTC().Format(time.RFC3339Nano) + "," + strconv.FormatInt(id, 10)))
+}
+
+func parseExportCursor(cursor string) (time.Time, int64, error) {
+	invalid := guru.Errorf(400, "invalid cursor: %q", cursor)
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, invalid
+	}
+	ts, id, ok := strings.Cut(string(b), ",")
+	if !ok {
+		return time.Time{}, 0, invalid
+	}
+	t, err1 := time.Parse(time.RFC3339Nano, ts)
+	i, err2 := strconv.ParseInt(id, 10, 64)
+	if err1 != nil || err2 != nil {
+		return time.Time{}, 0, invalid
+	}
+	return t, i, nil
+}
+
+// Dimensions to group by in ExportAggregate.
+const (
+	ExportGroupPath     = "path"
+	ExportGroupRef      = "ref"
+	ExportGroupLocation = "location"
+	ExportGroupType     = "type"
+)
+
+var ExportGroups = []string{ExportGroupPath, ExportGroupRef, ExportGroupLocation, ExportGroupType}
+
+var exportGroupColumns = map[string]string{
+	ExportGroupPath:     "paths.path",
+	ExportGroupRef:      "coalesce(refs.ref, '')",
+	ExportGroupLocation: "substr(hits.location, 0, 3)",
+	ExportGroupType:     "hits.type",
+}
+
+// Columns to count the visitors for SiteSettings.MinVisitors.
+var exportGroupIDs = map[string]string{
+	ExportGroupPath: "path_id",
+	ExportGroupRef:  "ref_id",
+}
+
+// ExportAggregate writes the number of pageviews and visitors per day in rng to
+// w as CSV, grouped by the dimensions in group.
+//
+// The columns are the date, the group dimensions in the order given, and
+// "pageviews" and "visitors". This is counted the same as the dashboard: bots
+// are excluded unless they're in CountBots, visitors are the pageviews that
+// are a first visit, and locations are grouped by country. Days are in UTC.
+//
+// Downloads and outbound links are only included when grouping by
+// ExportGroupType, so they're never counted as pageviews.
+//
+// Paths and referrers with fewer visitors than the site's MinVisitors in rng
+// are written as BelowThresholdLabel, and events are written with their label
+// from the site's EventLabels.
+//
+// The visitors are left empty if the site doesn't collect sessions, as every
+// pageview is counted as a first visit and there are no unique visitors.
+//
+// Rows are written as they're read from the database, so the full result is
+// never buffered. It returns the number of rows written, excluding the header.
+func ExportAggregate(ctx context.Context, w io.Writer, rng ztime.Range, group []string) (int, error) {
+	v := NewValidate(ctx)
+	seen := make(map[string]struct{}, len(group))
+	for _, g := range group {
+		v.Include("group", g, ExportGroups)
+		if _, ok := seen[g]; ok {
+			v.Append("group", fmt.Sprintf("%q given more than once", g))
+		}
+		seen[g] = struct{}{}
+	}
+	if rng.Start.IsZero() || rng.End.IsZero() {
+		v.Append("range", "must set start and end")
+	}
+	if v.HasErrors() {
+		return 0, v
+	}
+
+	day := "date(hits.created_at)"
+	if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+		day = "to_char(hits.created_at, 'YYYY-MM-DD')"
+	}
+	var (
+		settings    = MustGetSite(ctx).Settings
+		minVisitors = settings.MinVisitors
+		noSessions  = !settings.Collect.Has(CollectSession)
+		cols        = make([]string, 0, len(group)+1)
+		types       = []string{HitTypePageview}
+	)
+	if _, ok := seen[ExportGroupType]; ok {
+		types = HitTypes
+	}
+	cols = append(cols, day)
+	for _, g := range group {
+		col := exportGroupColumns[g]
+		if id, ok := exportGroupIDs[g]; ok && minVisitors > 0 {
+			col = `case when hits.` + id + ` in (
+				select ` + id + ` from hits as h
+				where h.site_id = :site and h.bot in (:bots) and h.type in (:types) and
+					h.created_at >= :start and h.created_at <= :end
+				group by ` + id + ` having sum(h.first_visit) >= :min
+			) then ` + col + ` else :below end`
+		}
+		cols = append(cols, col)
+	}
+	var order []string
+	for i := range cols {
+		order = append(order, strconv.Itoa(i+1))
+	}
+
+	rows, err := zdb.Query(ctx, `/* ExportAggregate */
+		select
+			`+strings.Join(cols, ", ")+`,
+			count(*)              as pageviews,
+			sum(hits.first_visit) as visitors,
+			max(paths.event)      as event
+		from hits
+		join paths     using (path_id)
+		left join refs using (ref_id)
+		where
+			hits.site_id = :site and hits.bot in (:bots) and hits.type in (:types) and
+			hits.created_at >= :start and hits.created_at <= :end
+		group by `+strings.Join(order, ", ")+`
+		order by `+strings.Join(order, ", "),
+		zdb.P{
+			"site":  MustGetSite(ctx).ID,
+			"bots":  append([]int{0}, Config(ctx).CountBots...),
+			"start": rng.Start,
+			"end":   rng.End,
+			"min":   minVisitors,
+			"below": BelowThresholdLabel,
+			"types": types,
+		})
+	if err != nil {
+		return 0, errors.Wrap(err, "ExportAggregate")
+	}
+	defer rows.Close()
+
+	c := csv.NewWriter(w)
+	c.Write(append(append([]string{"date"}, group...), "pageviews", "visitors"))
+
+	var (
+		n       int
+		event   bool
+		pathCol = slices.Index(group, ExportGroupPath) + 1 // 0 if not grouped by path.
+		rec     = make([]string, len(cols)+2)
+		dest    = make([]any, len(rec), len(rec)+1)
+	)
+	for i := range rec {
+		dest[i] = &rec[i]
+	}
+	dest = append(dest, &event)
+	for rows.Next() {
+		err := rows.Scan(dest...)
+		if err != nil {
+			return n, errors.Wrap(err, "ExportAggregate")
+		}
+		if event && pathCol > 0 {
+			rec[pathCol] = settings.EventLabel(rec[pathCol])
+		}
+		if noSessions {
+			rec[len(rec)-1] = ""
+		}
+		c.Write(rec)
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, errors.Wrap(err, "ExportAggregate")
+	}
+
+	c.Flush()
+	return n, errors.Wrap(c.Error(), "ExportAggregate")
+}
+
+// ExportFlow writes the number of transitions from one path to another in rng
+// to w as CSV, for building flow (Sankey) diagrams.
+//
+// A transition is two consecutive pageviews in the same session that are less
+// than the session timeout apart. Events, downloads and outbound links, bots,
+// reloads of the same path, and pageviews without a session aren't included. The columns are "from", "to",
+// and "count".
+//
+// Only transitions from at least minVisitors sessions are included, so that it
+// never shows the paths of individual visitors. Rows are sorted by the count,
+// highest first. It returns the number of rows written, excluding the header.
+func ExportFlow(ctx context.Context, w io.Writer, rng ztime.Range, minVisitors int) (int, error) {
+	v := NewValidate(ctx)
+	v.Range("min_visitors", int64(minVisitors), 2, 0)
+	if rng.Start.IsZero() || rng.End.IsZero() {
+		v.Append("range", "must set start and end")
+	}
+	if v.HasErrors() {
+		return 0, v
+	}
+
+	rows, err := zdb.Query(ctx, `/* ExportFlow */
+		select hits.session, hits.path_id, paths.path, hits.created_at
+		from hits
+		join paths using (path_id)
+		where
+			hits.site_id = :site and hits.bot in (:bots) and paths.event = 0 and
+			hits.type = :pageview and hits.session is not null and
+			hits.created_at >= :start and hits.created_at <= :end
+		order by hits.session, hits.created_at`,
+		zdb.P{
+			"site":     MustGetSite(ctx).ID,
+			"bots":     append([]int{0}, Config(ctx).CountBots...),
+			"start":    rng.Start,
+			"end":      rng.End,
+			"pageview": HitTypePageview,
+		})
+	if err != nil {
+		return 0, errors.Wrap(err, "ExportFlow")
+	}
+	defer rows.Close()
+
+	type (
+		transition struct{ from, to int64 }
+		flow       struct {
+			count, sessions int
+			last            zint.Uint128 // Last session that was counted in sessions.
+		}
+	)
+	var (
+		timeout = memCacheTTLFor("sessions")
+		paths   = make(map[int64]string)
+		flows   = make(map[transition]*flow)
+		prev    struct {
+			Session   zint.Uint128 `db:"session"`
+			PathID    int64        `db:"path_id"`
+			Path      string       `db:"path"`
+			CreatedAt time.Time    `db:"created_at"`
+		}
+		cur = prev
+	)
+	for rows.Next() {
+		err := rows.Scan(&cur)
+		if err != nil {
+			return 0, errors.Wrap(err, "ExportFlow")
+		}
+		paths[cur.PathID] = cur.Path
+
+		if cur.Session == prev.Session && !cur.Session.IsZero() && cur.PathID != prev.PathID &&
+			(timeout == 0 || cur.CreatedAt.Sub(prev.CreatedAt) < timeout) {
+			t := transition{from: prev.PathID, to: cur.PathID}
+			f, ok := flows[t]
+			if !ok {
+				f = &flow{}
+				flows[t] = f
+			}
+			f.count++
+			if f.last != cur.Session {
+				f.sessions++
+				f.last = cur.Session
+			}
+		}
+		prev = cur
+	}
+	if err := rows.Err(); err != nil {
+		return 0, errors.Wrap(err, "ExportFlow")
+	}
+
+	type row struct {
+		from, to string
+		count    int
+	}
+	list := make([]row, 0, len(flows))
+	for t, f := range flows {
+		if f.sessions >= minVisitors {
+			list = append(list, row{from: paths[t.from], to: paths[t.to], count: f.count})
+		}
+	}
+	slices.SortFunc(list, func(a, b row) int {
+		if c := cmp.Compare(b.count, a.count); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.from, b.from); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.to, b.to)
+	})
+
+	c := csv.NewWriter(w)
+	c.Write([]string{"from", "to", "count"})
+	for _, r := range list {
+		c.Write([]string{r.from, r.to, strconv.Itoa(r.count)})
+	}
+	c.Flush()
+	return len(list), errors.Wrap(c.Error(), "ExportFlow")
 }
@@ -0,0 +1,36 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestExportCursor(t *testing.T) {
+	for _, tt := range []time.Time{
+		time.Date(2019, 6, 18, 0, 0, 0, 0, time.UTC),
+		time.Date(2019, 6, 18, 0, 0, 0, 123456000, time.UTC),
+		time.Date(2019, 6, 18, 2, 0, 0, 999999000, time.FixedZone("", 7200)),
+	} {
+		ts, id, err := parseExportCursor(exportCursor(tt, 42))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ts.Equal(tt) || id != 42 {
+			t.Errorf("have %s, %d; want %s, 42", ts, id, tt)
+		}
+	}
+
+	for _, c := range []string{"", "xxx", base64.RawURLEncoding.EncodeToString([]byte("1560816000,1")),
+		base64.RawURLEncoding.EncodeToString([]byte("2019-06-18T00:00:00Z")),
+		base64.RawURLEncoding.EncodeToString([]byte("2019-06-18T00:00:00Z,x"))} {
+		_, _, err := parseExportCursor(c)
+		if err == nil {
+			t.Errorf("no error for %q", c)
+		}
+	}
+}
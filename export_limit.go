@@ -0,0 +1,166 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zgo.at/errors"
+)
+
+// ErrExportBusy is returned from AcquireExport() if there are too many
+// concurrent exports; see SetExportConcurrency().
+var ErrExportBusy = errors.New("too many concurrent exports")
+
+type exportLimit struct {
+	global  chan struct{} // nil if there is no global limit.
+	perSite int
+	wait    time.Duration
+
+	mu      sync.Mutex
+	sites   map[int64]*exportSite
+	running int
+	queued  int
+}
+
+type exportSite struct {
+	sem  chan struct{}
+	refs int // Running and queued exports for this site.
+}
+
+var exportLimiter atomic.Pointer[exportLimit]
+
+func init() { SetExportConcurrency(0, 0, 0) }
+
+// SetExportConcurrency limits the number of exports that can run at the same
+// time to global for all sites, and perSite for every site. There is no limit
+// if it's 0.
+//
+// Exports wait up to wait for a free slot; after that they fail with
+// ErrExportBusy. A wait of 0 fails right away.
+func SetExportConcurrency(global, perSite int, wait time.Duration) {
+	l := &exportLimit{perSite: perSite, wait: wait, sites: make(map[int64]*exportSite)}
+	if global > 0 {
+		l.global = make(chan struct{}, global)
+	}
+	exportLimiter.Store(l)
+}
+
+// ExportJobs gets the number of running exports, and the number of exports
+// waiting for a free slot.
+func ExportJobs() (running, queued int) {
+	l := exportLimiter.Load()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.running, l.queued
+}
+
+// AcquireExport gets a slot to run an export for the site; the returned
+// function releases it, and must be called once the export is finished.
+//
+// This is used for exports in the background as well as exports that are
+// streamed as part of the response, which keep the slot until they're sent.
+func AcquireExport(ctx context.Context, siteID int64) (func(), error) {
+	l := exportLimiter.Load()
+
+	l.mu.Lock()
+	var site *exportSite
+	if l.perSite > 0 {
+		site = l.sites[siteID]
+		if site == nil {
+			site = &exportSite{sem: make(chan struct{}, l.perSite)}
+			l.sites[siteID] = site
+		}
+		site.refs++
+	}
+	l.queued++
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.wait > 0 {
+		t := time.NewTimer(l.wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	var siteSem chan struct{}
+	if site != nil {
+		siteSem = site.sem
+	}
+	// Wait for the site first, so that a site with many exports doesn't take
+	// all the global slots while it's waiting.
+	err := acquireExportSlot(ctx, siteSem, timeout)
+	if err == nil {
+		err = acquireExportSlot(ctx, l.global, timeout)
+		if err != nil && siteSem != nil {
+			<-siteSem
+		}
+	}
+
+	l.mu.Lock()
+	l.queued--
+	if err != nil {
+		l.unrefSite(siteID, site)
+		l.mu.Unlock()
+		return nil, errors.Wrap(err, "AcquireExport")
+	}
+	l.running++
+	l.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if l.global != nil {
+				<-l.global
+			}
+			if siteSem != nil {
+				<-siteSem
+			}
+			l.mu.Lock()
+			l.running--
+			l.unrefSite(siteID, site)
+			l.mu.Unlock()
+		})
+	}, nil
+}
+
+// unrefSite removes the semaphore for the site once no export uses it. Must
+// hold the lock.
+func (l *exportLimit) unrefSite(siteID int64, site *exportSite) {
+	if site == nil {
+		return
+	}
+	site.refs--
+	if site.refs == 0 {
+		delete(l.sites, siteID)
+	}
+}
+
+// acquireExportSlot takes a slot from sem, waiting until timeout if it's not
+// nil. A nil sem has no limit.
+func acquireExportSlot(ctx context.Context, sem chan struct{}, timeout <-chan time.Time) error {
+	if sem == nil {
+		return nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return nil
+	default:
+	}
+	if timeout == nil {
+		return ErrExportBusy
+	}
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-timeout:
+		return ErrExportBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
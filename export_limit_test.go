@@ -0,0 +1,121 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireExport(t *testing.T) {
+	defer SetExportConcurrency(0, 0, 0)
+	ctx := context.Background()
+
+	acquire := func(t *testing.T, siteID int64, wantErr error) func() {
+		t.Helper()
+		release, err := AcquireExport(ctx, siteID)
+		if !errors.Is(err, wantErr) {
+			t.Fatalf("site %d: have error %v; want %v", siteID, err, wantErr)
+		}
+		return release
+	}
+	jobs := func(t *testing.T, wantRunning, wantQueued int) {
+		t.Helper()
+		if r, q := ExportJobs(); r != wantRunning || q != wantQueued {
+			t.Errorf("running %d, queued %d; want %d, %d", r, q, wantRunning, wantQueued)
+		}
+	}
+
+	t.Run("no limit", func(t *testing.T) {
+		SetExportConcurrency(0, 0, 0)
+		for i := 0; i < 10; i++ {
+			defer acquire(t, 1, nil)()
+		}
+		jobs(t, 10, 0)
+	})
+
+	t.Run("per site", func(t *testing.T) {
+		SetExportConcurrency(0, 2, 0)
+		r1 := acquire(t, 1, nil)
+		r2 := acquire(t, 1, nil)
+		acquire(t, 1, ErrExportBusy)
+		r3 := acquire(t, 2, nil)
+		jobs(t, 3, 0)
+
+		r1()
+		r1() // Releasing twice shouldn't free another slot.
+		r4 := acquire(t, 1, nil)
+		acquire(t, 1, ErrExportBusy)
+
+		r2()
+		r3()
+		r4()
+		jobs(t, 0, 0)
+		if l := exportLimiter.Load(); len(l.sites) != 0 {
+			t.Errorf("sites not removed: %v", l.sites)
+		}
+	})
+
+	t.Run("global", func(t *testing.T) {
+		SetExportConcurrency(2, 2, 0)
+		r1 := acquire(t, 1, nil)
+		r2 := acquire(t, 2, nil)
+		acquire(t, 3, ErrExportBusy)
+		jobs(t, 2, 0)
+
+		// Failing on the global limit should release the site slot.
+		r1()
+		r3 := acquire(t, 2, nil)
+		acquire(t, 1, ErrExportBusy)
+		r2()
+		r4 := acquire(t, 1, nil)
+		r3()
+		r4()
+		jobs(t, 0, 0)
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		SetExportConcurrency(0, 1, time.Second)
+		r1 := acquire(t, 1, nil)
+
+		done := make(chan func())
+		go func() {
+			release, err := AcquireExport(ctx, 1)
+			if err != nil {
+				t.Error(err)
+			}
+			done <- release
+		}()
+		for i := 0; ; i++ {
+			if _, q := ExportJobs(); q == 1 {
+				break
+			}
+			if i > 100 {
+				t.Fatal("not queued")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		jobs(t, 1, 1)
+
+		r1()
+		r2 := <-done
+		jobs(t, 1, 0)
+		r2()
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		SetExportConcurrency(0, 1, 10*time.Millisecond)
+		defer acquire(t, 1, nil)()
+
+		start := time.Now()
+		acquire(t, 1, ErrExportBusy)
+		if d := time.Since(start); d < 10*time.Millisecond {
+			t.Errorf("didn't wait: %s", d)
+		}
+		jobs(t, 1, 0)
+	})
+}
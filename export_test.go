@@ -6,6 +6,7 @@ package goatcounter_test
 
 import (
 	"compress/gzip"
+	"fmt"
 	"os"
 	"strings"
 	"testing"
@@ -15,8 +16,11 @@ import (
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/zdb"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/zint"
 	"zgo.at/zstd/zjson"
 	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
 )
 
 func TestExport(t *testing.T) {
@@ -143,3 +147,364 @@ func TestExport(t *testing.T) {
 		}
 	})
 }
+
+func TestImportJSONLookupIP(t *testing.T) {
+	rows := `{"path":"/a","event":"false","bot":"0","first_visit":"true","session":"1-1","created_at":"2020-06-18T14:42:00Z","location":"NL","ip":"1.2.3.4"}
+{"path":"/b","event":"false","bot":"0","first_visit":"true","session":"1-2","created_at":"2020-06-18T14:43:00Z","location":"NL"}
+`
+
+	tests := []struct {
+		name     string
+		lookupIP bool
+		collect  zint.Bitflag16
+		want     string
+	}{
+		{"off", false, 0, "NL NL"},
+		{"lookup", true, 0, "AU NL"},
+		{"no location", true, goatcounter.CollectLocation | goatcounter.CollectLocationRegion, " "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			site := goatcounter.MustGetSite(ctx)
+			site.Settings.Collect &^= tt.collect
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, _, err := goatcounter.ImportJSON(ctx, strings.NewReader(rows), tt.lookupIP,
+				func(hit goatcounter.Hit, final bool) {
+					if final {
+						return
+					}
+					if hit.RemoteAddr != "" {
+						t.Errorf("RemoteAddr set: %q", hit.RemoteAddr)
+					}
+					goatcounter.Memstore.Append(hit)
+				},
+				func(line int, err error) { t.Errorf("line %d: %s", line, err) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Fatalf("imported %d", n)
+			}
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var have []string
+			err = zdb.Select(ctx, &have, `select location from hits order by hit_id`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h := strings.Join(have, " "); h != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportRowsListCursor(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	now := time.Date(2019, 6, 18, 0, 0, 0, 0, time.UTC)
+	store := func(n int) {
+		hits := make([]goatcounter.Hit, n)
+		for i := range hits {
+			// Two hits per second, to make sure ties are broken by ID.
+			hits[i] = goatcounter.Hit{Path: "/x", CreatedAt: now.Add(time.Duration(i/2) * time.Second)}
+		}
+		now = now.Add(time.Duration(n) * time.Second)
+		gctest.StoreHits(ctx, t, false, hits...)
+	}
+	store(10)
+
+	var (
+		seen   = make(map[int64]int)
+		cursor string
+		pages  int
+	)
+	for {
+		var rows goatcounter.ExportRows
+		next, more, err := rows.ListCursor(ctx, cursor, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range rows {
+			seen[r.ID]++
+		}
+		cursor = next
+		pages++
+
+		// New hits arrive while paging.
+		if pages <= 2 {
+			store(4)
+		}
+		if !more {
+			break
+		}
+	}
+
+	if len(seen) != 18 {
+		t.Errorf("seen %d hits, want 18", len(seen))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("hit %d seen %d times", id, n)
+		}
+	}
+
+	// Nothing new: should return same cursor.
+	var rows goatcounter.ExportRows
+	next, more, err := rows.ListCursor(ctx, cursor, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != cursor || more || len(rows) != 0 {
+		t.Errorf("next=%q; more=%t; len=%d", next, more, len(rows))
+	}
+
+	_, _, err = rows.ListCursor(ctx, "not a cursor", 3)
+	if err == nil {
+		t.Error("err is nil for invalid cursor")
+	}
+}
+
+func TestExportAggregate(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	d1 := time.Date(2019, 6, 18, 14, 0, 0, 0, time.UTC)
+	d2 := time.Date(2019, 6, 19, 9, 0, 0, 0, time.UTC)
+	hit := func(path, ref, loc string, created time.Time, first bool) goatcounter.Hit {
+		return goatcounter.Hit{Path: path, Ref: ref, Location: loc, CreatedAt: created,
+			Session: goatcounter.TestSession, FirstVisit: zbool.Bool(first)}
+	}
+	gctest.StoreHits(ctx, t, false,
+		hit("/a", "https://example.com/x", "NL-NH", d1, true),
+		hit("/a", "https://example.com/x", "NL-ZH", d1, false),
+		hit("/a", "", "ID", d1, true),
+		hit("/b", "https://example.com/x", "NL", d1, true),
+		hit("/a", "", "ID", d2, true),
+		hit("/b", "", "", d2, false),
+		goatcounter.Hit{Path: "/a", CreatedAt: d2, Bot: 150, Session: goatcounter.TestSession, FirstVisit: true},
+		goatcounter.Hit{Path: "/a.pdf", CreatedAt: d1, Type: goatcounter.HitTypeDownload, Session: goatcounter.TestSession, FirstVisit: true},
+		hit("/a", "", "", d2.AddDate(0, 0, 10), true), // Outside range.
+	)
+
+	rng := ztime.NewRange(d1.Add(-time.Hour)).To(d2.Add(time.Hour))
+	tests := []struct {
+		group   []string
+		want    string
+		wantErr string
+	}{
+		{nil, `
+			date,pageviews,visitors
+			2019-06-18,4,3
+			2019-06-19,2,1`, ""},
+		{[]string{"path"}, `
+			date,path,pageviews,visitors
+			2019-06-18,/a,3,2
+			2019-06-18,/b,1,1
+			2019-06-19,/a,1,1
+			2019-06-19,/b,1,0`, ""},
+		{[]string{"path", "ref"}, `
+			date,path,ref,pageviews,visitors
+			2019-06-18,/a,,1,1
+			2019-06-18,/a,example.com/x,2,1
+			2019-06-18,/b,example.com/x,1,1
+			2019-06-19,/a,,1,1
+			2019-06-19,/b,,1,0`, ""},
+		{[]string{"location", "path"}, `
+			date,location,path,pageviews,visitors
+			2019-06-18,ID,/a,1,1
+			2019-06-18,NL,/a,2,1
+			2019-06-18,NL,/b,1,1
+			2019-06-19,,/b,1,0
+			2019-06-19,ID,/a,1,1`, ""},
+		{[]string{"type"}, `
+			date,type,pageviews,visitors
+			2019-06-18,download,1,1
+			2019-06-18,pageview,4,3
+			2019-06-19,pageview,2,1`, ""},
+
+		{[]string{"browser"}, "", `group: must be one of`},
+		{[]string{"path", "path"}, "", `group: "path" given more than once`},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.group, "-"), func(t *testing.T) {
+			var b strings.Builder
+			n, err := goatcounter.ExportAggregate(ctx, &b, rng, tt.group)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+
+			want := ztest.NormalizeIndent(tt.want) + "\n"
+			if d := ztest.Diff(b.String(), want); d != "" {
+				t.Error(d)
+			}
+			if l := strings.Count(want, "\n") - 1; n != l {
+				t.Errorf("n=%d; want %d", n, l)
+			}
+		})
+	}
+
+	t.Run("min_visitors", func(t *testing.T) {
+		site := goatcounter.MustGetSite(ctx)
+		defer func() {
+			site.Settings.MinVisitors = 0
+			if err := site.Update(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}()
+
+		tests := []struct {
+			min   int
+			group []string
+			want  string
+		}{
+			{2, []string{"path"}, `
+				date,path,pageviews,visitors
+				2019-06-18,(below threshold),1,1
+				2019-06-18,/a,3,2
+				2019-06-19,(below threshold),1,0
+				2019-06-19,/a,1,1`},
+			{3, []string{"path", "ref"}, `
+				date,path,ref,pageviews,visitors
+				2019-06-18,(below threshold),(below threshold),1,1
+				2019-06-18,/a,(below threshold),3,2
+				2019-06-19,(below threshold),(below threshold),1,0
+				2019-06-19,/a,(below threshold),1,1`},
+			{3, []string{"location"}, `
+				date,location,pageviews,visitors
+				2019-06-18,ID,1,1
+				2019-06-18,NL,3,2
+				2019-06-19,,1,0
+				2019-06-19,ID,1,1`},
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%d-%s", tt.min, strings.Join(tt.group, "-")), func(t *testing.T) {
+				site.Settings.MinVisitors = tt.min
+				err := site.Update(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var b strings.Builder
+				_, err = goatcounter.ExportAggregate(ctx, &b, rng, tt.group)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if d := ztest.Diff(b.String(), ztest.NormalizeIndent(tt.want)+"\n"); d != "" {
+					t.Error(d)
+				}
+			})
+		}
+	})
+
+	t.Run("no sessions", func(t *testing.T) {
+		site := goatcounter.MustGetSite(ctx)
+		site.Settings.Collect ^= goatcounter.CollectSession
+		err := site.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			site.Settings.Collect |= goatcounter.CollectSession
+			if err := site.Update(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}()
+
+		var b strings.Builder
+		_, err = goatcounter.ExportAggregate(ctx, &b, rng, []string{"path"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ztest.NormalizeIndent(`
+			date,path,pageviews,visitors
+			2019-06-18,/a,3,
+			2019-06-18,/b,1,
+			2019-06-19,/a,1,
+			2019-06-19,/b,1,`) + "\n"
+		if d := ztest.Diff(b.String(), want); d != "" {
+			t.Error(d)
+		}
+	})
+}
+
+func TestExportFlow(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	start := time.Date(2019, 6, 18, 14, 0, 0, 0, time.UTC)
+	var hits []goatcounter.Hit
+	visit := func(session uint64, paths ...string) {
+		t := start
+		for _, p := range paths {
+			if p == "" { // Wait longer than the session timeout.
+				t = t.Add(goatcounter.SessionTimeout + time.Minute)
+				continue
+			}
+			hits = append(hits, goatcounter.Hit{Path: p, CreatedAt: t,
+				Session: zint.Uint128{goatcounter.TestSession[0], session}})
+			t = t.Add(time.Minute)
+		}
+	}
+	visit(1, "/a", "/b", "/c")
+	visit(2, "/a", "/b", "/b", "/c") // Reload of /b
+	visit(3, "/a", "/b", "", "/c")   // New visit after the timeout.
+	visit(4, "/a", "/b", "/a", "/b")
+	visit(5, "/a", "/c")
+	hits = append(hits,
+		goatcounter.Hit{Path: "/a", CreatedAt: start, Bot: 150, Session: zint.Uint128{0, 10}},
+		goatcounter.Hit{Path: "/b", CreatedAt: start.Add(time.Minute), Bot: 150, Session: zint.Uint128{0, 10}},
+		goatcounter.Hit{Path: "click", Event: true, CreatedAt: start.Add(time.Minute), Session: zint.Uint128{0, 5}},
+	)
+	gctest.StoreHits(ctx, t, false, hits...)
+
+	rng := ztime.NewRange(start.Add(-time.Hour)).To(start.Add(24 * time.Hour))
+	tests := []struct {
+		min     int
+		want    string
+		wantErr string
+	}{
+		{2, `
+			from,to,count
+			/a,/b,5
+			/b,/c,2`, ""},
+		{3, `
+			from,to,count
+			/a,/b,5`, ""},
+		{5, `
+			from,to,count`, ""},
+		{1, "", "min_visitors: must be 2 or higher"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var b strings.Builder
+			n, err := goatcounter.ExportFlow(ctx, &b, rng, tt.min)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+
+			want := ztest.NormalizeIndent(tt.want) + "\n"
+			if d := ztest.Diff(b.String(), want); d != "" {
+				t.Error(d)
+			}
+			if l := strings.Count(want, "\n") - 1; n != l {
+				t.Errorf("n=%d; want %d", n, l)
+			}
+		})
+	}
+}
@@ -28,7 +28,7 @@ var pgSQL = false
 
 func init() {
 	sqlite3.DefaultHook(goatcounter.SQLiteHook)
-	goatcounter.InitGeoDB("")
+	goatcounter.InitGeoDB("", "")
 }
 
 // Context creates a new test context.
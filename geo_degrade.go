@@ -0,0 +1,87 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Geo lookup modes; see SetGeoDegrade().
+const (
+	GeoModeFull    = "full"    // Country and region, as configured for the site.
+	GeoModeCountry = "country" // Country only.
+	GeoModeOff     = "off"     // No lookups; the location is recorded as unknown.
+)
+
+var geoModes = []string{GeoModeFull, GeoModeCountry, GeoModeOff}
+
+type geoDegrade struct {
+	country, off int // Thresholds for the modes; 0 is never.
+
+	mu       sync.Mutex
+	inflight int
+	mode     int // Index in geoModes.
+}
+
+var geoDegrader atomic.Pointer[geoDegrade]
+
+func init() { SetGeoDegrade(0, 0) }
+
+// SetGeoDegrade records only the country for the location once there are
+// country or more requests to /count in progress, and doesn't look up the
+// location at all once there are off or more. A threshold of 0 disables the
+// mode, which is the default.
+//
+// The full mode is restored once the load drops below half the threshold, so
+// it doesn't flip back and forth if the load hovers around it.
+func SetGeoDegrade(country, off int) {
+	geoDegrader.Store(&geoDegrade{country: country, off: off})
+}
+
+// GeoLoad records a request that may look up the location; the returned
+// function must be called once it's finished.
+func GeoLoad() func() {
+	g := geoDegrader.Load()
+	g.add(1)
+
+	var once sync.Once
+	return func() { once.Do(func() { g.add(-1) }) }
+}
+
+// GeoMode gets the current geo lookup mode, as one of the GeoMode* constants,
+// and the number of requests that are in progress.
+func GeoMode() (mode string, inflight int) {
+	g := geoDegrader.Load()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return geoModes[g.mode], g.inflight
+}
+
+func (g *geoDegrade) add(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inflight += n
+
+	// Degrade as soon as a threshold is reached, but only restore once the
+	// load is at half of the threshold.
+	up, down := g.level(g.inflight), g.level(g.inflight*2)
+	switch {
+	case up > g.mode:
+		g.mode = up
+	case down < g.mode:
+		g.mode = down
+	}
+}
+
+func (g *geoDegrade) level(n int) int {
+	switch {
+	case g.off > 0 && n >= g.off:
+		return 2
+	case g.country > 0 && n >= g.country:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"testing"
+)
+
+func TestGeoDegrade(t *testing.T) {
+	defer SetGeoDegrade(0, 0)
+
+	var held []func()
+	load := func(t *testing.T, n int, wantMode string) {
+		t.Helper()
+		for ; n > 0; n-- {
+			held = append(held, GeoLoad())
+		}
+		for ; n < 0; n++ {
+			held[len(held)-1]()
+			held = held[:len(held)-1]
+		}
+		if mode, inflight := GeoMode(); mode != wantMode || inflight != len(held) {
+			t.Errorf("mode %q with %d in progress; want %q with %d", mode, inflight, wantMode, len(held))
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		SetGeoDegrade(0, 0)
+		load(t, 1000, GeoModeFull)
+		load(t, -1000, GeoModeFull)
+	})
+
+	t.Run("degrade", func(t *testing.T) {
+		SetGeoDegrade(4, 8)
+		load(t, 3, GeoModeFull)
+		load(t, 1, GeoModeCountry)
+		load(t, 3, GeoModeCountry)
+		load(t, 1, GeoModeOff)
+		load(t, 10, GeoModeOff)
+
+		// Restored once it's below half the threshold.
+		load(t, -14, GeoModeOff)
+		load(t, -1, GeoModeCountry)
+		load(t, -1, GeoModeCountry)
+		load(t, -1, GeoModeFull)
+		load(t, 1, GeoModeFull)
+		load(t, -2, GeoModeFull)
+	})
+
+	t.Run("only off", func(t *testing.T) {
+		SetGeoDegrade(0, 2)
+		load(t, 1, GeoModeFull)
+		load(t, 1, GeoModeOff)
+		load(t, -1, GeoModeOff)
+		load(t, -1, GeoModeFull)
+	})
+
+	t.Run("done twice", func(t *testing.T) {
+		SetGeoDegrade(2, 0)
+		done := GeoLoad()
+		done()
+		done()
+		if _, inflight := GeoMode(); inflight != 0 {
+			t.Errorf("inflight is %d", inflight)
+		}
+	})
+}
@@ -9,10 +9,10 @@ import (
 	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
-	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -85,6 +85,8 @@ func (h api) mount(r chi.Router, db zdb.DB) {
 					return rateLimits.export(r)
 				case "/api/v0/count":
 					return rateLimits.apiCount(r)
+				case "/api/v0/stats/active":
+					return rateLimits.apiActive(r)
 				}
 			},
 		}),
@@ -96,13 +98,26 @@ func (h api) mount(r chi.Router, db zdb.DB) {
 	a.Get("/api/v0/me", zhttp.Wrap(h.me))
 
 	a.Post("/api/v0/export", zhttp.Wrap(h.export))
+	a.Get("/api/v0/export/aggregate", zhttp.Wrap(h.exportAggregate))
+	a.Get("/api/v0/export/flow", zhttp.Wrap(h.exportFlow))
 	a.Get("/api/v0/export/{id}", zhttp.Wrap(h.exportGet))
 	a.Get("/api/v0/export/{id}/download", zhttp.Wrap(h.exportDownload))
 
 	a.Post("/api/v0/count", zhttp.Wrap(h.count))
+	a.Post("/api/v0/import", zhttp.Wrap(h.importHits))
+	r.With(
+		middleware.AllowContentType("application/octet-stream"),
+		mware.Ratelimit(mware.RatelimitOptions{
+			Client: mware.RatelimitIP,
+			Store:  mware.NewRatelimitMemory(),
+			Limit:  rateLimits.apiCount,
+		}),
+	).Post("/api/v0/count/binary", zhttp.Wrap(h.countBinary))
+	a.Get("/api/v0/hits", zhttp.Wrap(h.rawHits))
 
 	a.Get("/api/v0/paths", zhttp.Wrap(h.paths))
 	a.Get("/api/v0/stats/total", zhttp.Wrap(h.countTotal))
+	a.Get("/api/v0/stats/active", zhttp.Wrap(h.active))
 	a.Get("/api/v0/stats/hits", zhttp.Wrap(h.hits))
 	a.Get("/api/v0/stats/hits/{path_id}", zhttp.Wrap(h.refs))
 	a.Get("/api/v0/stats/{page}", zhttp.Wrap(h.stats))
@@ -308,8 +323,12 @@ func (h api) me(w http.ResponseWriter, r *http.Request) error {
 // This starts a new export in the background; this can only be done once an
 // hour.
 //
+// This returns a 429 with a Retry-After header if too many exports are already
+// running.
+//
 // Request body: apiExportRequest
 // Response 202: zgo.at/goatcounter/v2.Export
+// Response 429: zgo.at/goatcounter/v2/handlers.apiError
 func (h api) export(w http.ResponseWriter, r *http.Request) error {
 	err := h.auth(r, w, goatcounter.APIPermExport)
 	if err != nil {
@@ -322,14 +341,23 @@ func (h api) export(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	release, err := goatcounter.AcquireExport(r.Context(), Site(r.Context()).ID)
+	if err != nil {
+		return exportBusy(w, err)
+	}
+
 	var export goatcounter.Export
 	fp, err := export.Create(r.Context(), req.StartFromHitID)
 	if err != nil {
+		release()
 		return err
 	}
 
 	ctx := goatcounter.CopyContextValues(r.Context())
-	bgrun.MustRunFunction(fmt.Sprintf("export api:%d", export.SiteID), func() { export.Run(ctx, fp, false) })
+	bgrun.MustRunFunction(fmt.Sprintf("export api:%d", export.SiteID), func() {
+		defer release()
+		export.Run(ctx, fp, false)
+	})
 
 	w.WriteHeader(http.StatusAccepted)
 	return zhttp.JSON(w, export)
@@ -422,6 +450,8 @@ type APICountRequest struct {
 	// By default it's an error to send pageviews that don't have either a
 	// Session or UserAgent and IP set. This avoids accidental errors.
 	//
+	// This is never an error if the site doesn't collect sessions.
+	//
 	// When this is set it will just continue without recording sessions for
 	// pageviews that don't have these parameters set.
 	NoSessions bool `json:"no_sessions"`
@@ -465,6 +495,11 @@ type APICountRequestHit struct {
 	// Query parameters for this pageview, used to get campaign parameters.
 	Query string `json:"query" query:"q"`
 
+	// Source to attribute this pageview to instead of the referrer, for
+	// example for a QR code; this is ignored unless it's in the site's
+	// ref_sources setting.
+	RefSource string `json:"ref_source"`
+
 	// Hint if this should be considered a bot; should be one of the JSBot*`
 	// constants from isbot; note the backend may override this if it
 	// detects a bot using another method.
@@ -531,19 +566,66 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	if goatcounter.Maintenance() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return zhttp.JSON(w, apiError{Error: "maintenance"})
+	}
+
 	var args APICountRequest
 	_, err = h.dec.Decode(r, &args)
 	if err != nil {
 		return err
 	}
+	return h.countHits(w, r, args, 500)
+}
+
+// POST /api/v0/count/binary count
+// Count pageviews in the binary format.
+//
+// This is identical to POST /api/v0/count, but the request body is in a
+// compact binary format that's cheaper to decode; this is intended for
+// sending large amounts of pageviews from a backend. The Content-Type must be
+// application/octet-stream. See the documentation on
+// APICountRequest.MarshalBinary() in the source for details on the format.
+//
+// The maximum amount of pageviews per request is 5000.
+//
+// Response 202: {empty}
+func (h api) countBinary(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("/api/v0/count/binary")
+	defer m.Done()
+
+	err := h.auth(r, w, goatcounter.APIPermCount)
+	if err != nil {
+		return err
+	}
+
+	if goatcounter.Maintenance() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return zhttp.JSON(w, apiError{Error: "maintenance"})
+	}
+
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 16<<20))
+	if err != nil {
+		return guru.Errorf(400, "reading body: %s", err)
+	}
+	var args APICountRequest
+	err = args.UnmarshalBinary(b)
+	if err != nil {
+		w.WriteHeader(400)
+		return zhttp.JSON(w, apiError{Error: err.Error()})
+	}
+	return h.countHits(w, r, args, 5000)
+}
 
+func (h api) countHits(w http.ResponseWriter, r *http.Request, args APICountRequest, max int) error {
 	if len(args.Hits) == 0 {
 		w.WriteHeader(400)
 		return zhttp.JSON(w, apiError{Error: "no hits"})
 	}
-	if len(args.Hits) > 500 {
+	if len(args.Hits) > max {
 		w.WriteHeader(400)
-		return zhttp.JSON(w, apiError{Error: "maximum amount of pageviews in one batch is 500"})
+		return zhttp.JSON(w, apiError{Error: fmt.Sprintf("maximum amount of pageviews in one batch is %d", max)})
 	}
 	if args.Filter == nil {
 		args.Filter = []string{"ip"}
@@ -560,9 +642,11 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 		firstHitAt = site.FirstHitAt
 	)
 	for i, a := range args.Hits {
-		if filterIP && a.IP != "" && slices.Contains(site.Settings.IgnoreIPs, a.IP) {
-			filter = append(filter, i)
-			continue
+		if filterIP && a.IP != "" {
+			if _, ok := site.Settings.IgnoredIP(a.IP); ok {
+				filter = append(filter, i)
+				continue
+			}
 		}
 
 		if a.Location == "" && a.IP != "" {
@@ -576,6 +660,7 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 			Event:           a.Event,
 			Size:            a.Size,
 			Query:           a.Query,
+			RefSource:       a.RefSource,
 			Bot:             a.Bot,
 			CreatedAt:       a.CreatedAt.UTC(),
 			UserAgentHeader: a.UserAgent,
@@ -594,13 +679,13 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 			hit.UserSessionID = a.Session
 		case hit.UserAgentHeader != "" && a.IP != "":
 			// Handle as usual in memstore.
-		case !args.NoSessions:
+		case !args.NoSessions && site.Settings.Collect.Has(goatcounter.CollectSession):
 			errs[i] = "session or browser/IP not set; use no_sessions if you don't want to track unique visits"
 			continue
 		}
 
 		hit.Defaults(r.Context(), true) // don't get UA/Path; memstore will do that.
-		err = hit.Validate(r.Context(), true)
+		err := hit.Validate(r.Context(), true)
 		if err != nil {
 			errs[i] = err.Error()
 			continue
@@ -644,6 +729,234 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.JSON(w, respOK)
 }
 
+type (
+	apiRawHitsRequest struct {
+		// Maximum number of hits to get {range: 1-100, default: 100}.
+		Limit int `json:"limit" query:"limit"`
+
+		// Cursor to continue from; use the cursor from the previous response
+		// to get the next page. Omit to start at the first hit.
+		Cursor string `json:"cursor" query:"cursor"`
+	}
+	apiRawHitsResponse struct {
+		// Hits, ordered by creation date.
+		Hits goatcounter.ExportRows `json:"hits"`
+
+		// Cursor for the next page; this is the same as the cursor that was
+		// sent if there are no new hits.
+		Cursor string `json:"cursor"`
+
+		// More hits after this?
+		More bool `json:"more"`
+	}
+)
+
+// GET /api/v0/hits export
+// List raw pageviews.
+//
+// This lists all pageviews as they're stored, including bots, in the same
+// format as the CSV export. Use the returned cursor to page through them; this
+// is stable even if new pageviews arrive while paging.
+//
+// Query: apiRawHitsRequest
+// Response 200: apiRawHitsResponse
+func (h api) rawHits(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermExport)
+	if err != nil {
+		return err
+	}
+
+	args := apiRawHitsRequest{Limit: 100}
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	if h.apiMax > 0 && args.Limit > h.apiMax {
+		args.Limit = h.apiMax
+	}
+	if args.Limit < 1 {
+		args.Limit = 1
+	}
+
+	var hits goatcounter.ExportRows
+	cursor, more, err := hits.ListCursor(r.Context(), args.Cursor, args.Limit)
+	if err != nil {
+		return err
+	}
+	if hits == nil {
+		hits = goatcounter.ExportRows{}
+	}
+	return zhttp.JSON(w, apiRawHitsResponse{Hits: hits, Cursor: cursor, More: more})
+}
+
+type apiExportAggregateRequest struct {
+	// Start date {date, default: one week ago}.
+	Start time.Time `json:"start" query:"start"`
+
+	// End date {date, default: current time}.
+	End time.Time `json:"end" query:"end"`
+
+	// Dimensions to group by, in this order, as a comma-separated list; can be
+	// "path", "ref", "location", and "type" {default: path}.
+	Group goatcounter.Strings `json:"group" query:"group"`
+}
+
+// GET /api/v0/export/aggregate export
+// Export daily totals.
+//
+// This exports the number of pageviews and visitors per day as CSV, grouped by
+// the given dimensions; the columns are "date", the dimensions in the order
+// given, "pageviews", and "visitors". Days are in UTC, and bots are excluded.
+// The visitors are empty if the site doesn't collect sessions.
+//
+// Downloads and outbound links are only included when grouping by "type".
+//
+// Unlike the full export this is generated while it's being sent, and is much
+// smaller for long date ranges. It counts as a running export until it's sent.
+//
+// Query: apiExportAggregateRequest
+// Response 200 (text/csv): {data}
+// Response 429: zgo.at/goatcounter/v2/handlers.apiError
+func (h api) exportAggregate(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermExport)
+	if err != nil {
+		return err
+	}
+
+	args := apiExportAggregateRequest{Group: goatcounter.Strings{goatcounter.ExportGroupPath}}
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	if args.Start.IsZero() {
+		args.Start = ztime.AddPeriod(ztime.Now(), -7, ztime.Day)
+	}
+	if args.End.IsZero() {
+		args.End = ztime.Now()
+	}
+	rng := ztime.NewRange(args.Start).To(args.End)
+
+	// Only set the headers once the CSV is written, so that any errors before
+	// that are still sent as JSON.
+	cw := &headerWriter{ResponseWriter: w, set: func(hdr http.Header) {
+		hdr.Set("Content-Type", "text/csv; charset=utf-8")
+		_ = header.SetContentDisposition(hdr, header.DispositionArgs{
+			Type: header.TypeAttachment,
+			Filename: fmt.Sprintf("goatcounter-%s-%s-%s.csv", Site(r.Context()).Code,
+				rng.Start.Format("20060102"), rng.End.Format("20060102")),
+		})
+	}}
+	release, err := goatcounter.AcquireExport(r.Context(), Site(r.Context()).ID)
+	if err != nil {
+		return exportBusy(w, err)
+	}
+	defer release()
+
+	_, err = goatcounter.ExportAggregate(r.Context(), cw, rng, args.Group)
+	if err != nil && !cw.wrote {
+		return err
+	}
+	if err != nil { // Too late to send an error.
+		zlog.Field("site", Site(r.Context()).ID).Error(err)
+	}
+	return nil
+}
+
+type apiExportFlowRequest struct {
+	// Start date {date, default: one week ago}.
+	Start time.Time `json:"start" query:"start"`
+
+	// End date {date, default: current time}.
+	End time.Time `json:"end" query:"end"`
+
+	// Only include transitions from at least this many sessions; must be at
+	// least 2 {default: 5}.
+	MinVisitors int `json:"min_visitors" query:"min_visitors"`
+}
+
+// GET /api/v0/export/flow export
+// Export the flow of visitors between pages.
+//
+// This exports the number of times visitors went from one page to another as
+// CSV, for building flow diagrams; the columns are "from", "to", and "count".
+// Only consecutive pageviews in the same session are counted, and bots and
+// events are excluded.
+//
+// Transitions from fewer than min_visitors sessions aren't included, so this
+// never shows the paths of individual visitors.
+//
+// Query: apiExportFlowRequest
+// Response 200 (text/csv): {data}
+// Response 429: zgo.at/goatcounter/v2/handlers.apiError
+func (h api) exportFlow(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermExport)
+	if err != nil {
+		return err
+	}
+
+	args := apiExportFlowRequest{MinVisitors: 5}
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	if args.Start.IsZero() {
+		args.Start = ztime.AddPeriod(ztime.Now(), -7, ztime.Day)
+	}
+	if args.End.IsZero() {
+		args.End = ztime.Now()
+	}
+	rng := ztime.NewRange(args.Start).To(args.End)
+
+	cw := &headerWriter{ResponseWriter: w, set: func(hdr http.Header) {
+		hdr.Set("Content-Type", "text/csv; charset=utf-8")
+		_ = header.SetContentDisposition(hdr, header.DispositionArgs{
+			Type: header.TypeAttachment,
+			Filename: fmt.Sprintf("goatcounter-flow-%s-%s-%s.csv", Site(r.Context()).Code,
+				rng.Start.Format("20060102"), rng.End.Format("20060102")),
+		})
+	}}
+	release, err := goatcounter.AcquireExport(r.Context(), Site(r.Context()).ID)
+	if err != nil {
+		return exportBusy(w, err)
+	}
+	defer release()
+
+	_, err = goatcounter.ExportFlow(r.Context(), cw, rng, args.MinVisitors)
+	if err != nil && !cw.wrote {
+		return err
+	}
+	if err != nil { // Too late to send an error.
+		zlog.Field("site", Site(r.Context()).ID).Error(err)
+	}
+	return nil
+}
+
+// Seconds to wait before retrying an export that was rejected because there are
+// too many running.
+const exportRetryAfter = 30
+
+// exportBusy sends a 429 if err is ErrExportBusy, or returns err as-is.
+func exportBusy(w http.ResponseWriter, err error) error {
+	if !errors.Is(err, goatcounter.ErrExportBusy) {
+		return err
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(exportRetryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	return zhttp.JSON(w, apiError{Error: "too many exports are running; try again later"})
+}
+
+// headerWriter calls set() before the first write.
+type headerWriter struct {
+	http.ResponseWriter
+	set   func(http.Header)
+	wrote bool
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.wrote = true
+		w.set(w.Header())
+	}
+	return w.ResponseWriter.Write(b)
+}
+
 type apiSitesResponse struct {
 	Sites goatcounter.Sites `json:"sites"`
 }
@@ -1034,6 +1347,62 @@ func (h api) countTotal(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.JSON(w, tc)
 }
 
+type (
+	apiActiveRequest struct {
+		// Path to count the visitors for {required}.
+		Path string `json:"path" query:"path"`
+	}
+	apiActiveResponse struct {
+		Path string `json:"path"`
+
+		// Number of visitors whose last pageview was for this path in the
+		// last Window seconds. This is always 0 if the site doesn't collect
+		// sessions.
+		Count int `json:"count"`
+
+		// Length of the window in seconds; this is set with -active-window.
+		Window int `json:"window"`
+	}
+)
+
+// GET /api/v0/stats/active stats
+// Count the number of visitors currently on a page.
+//
+// This counts the sessions whose last pageview was for the path in the last few
+// minutes, from the pageviews in memory rather than the database, so it's only
+// available for the last few minutes. Pageviews are included once they're
+// persisted, every 10 seconds by default. Events and bots aren't counted, and
+// visitors aren't counted at all if sessions aren't collected.
+//
+// This has a lower rate limit than other endpoints: 30 requests per minute by
+// default.
+//
+// Query: apiActiveRequest
+// Response 200: apiActiveResponse
+func (h api) active(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("/api/v0/stats/*")
+	defer m.Done()
+
+	err := h.auth(r, w, goatcounter.APIPermStats)
+	if err != nil {
+		return err
+	}
+
+	var args apiActiveRequest
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	v := zvalidate.New()
+	v.Required("path", args.Path)
+	v.Len("path", args.Path, 0, goatcounter.MaxPathLen)
+	if v.HasErrors() {
+		return v
+	}
+
+	n, window := goatcounter.Memstore.Active(Site(r.Context()).ID, args.Path)
+	return zhttp.JSON(w, apiActiveResponse{Path: args.Path, Count: n, Window: int(window / time.Second)})
+}
+
 type (
 	apiStatsRequest struct {
 		// Start time, should be rounded to the hour {datetime, default: one week ago}.
@@ -0,0 +1,180 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zstd/zbool"
+)
+
+// Binary format for POST /api/v0/count/binary.
+const (
+	binaryVersion1 = 1
+
+	binaryNoSessions = 1 << 0 // APICountRequest.NoSessions
+	binaryNoFilter   = 1 << 1 // Don't filter by IP; APICountRequest.Filter is empty.
+)
+
+// MarshalBinary encodes the request in the binary format for
+// /api/v0/count/binary.
+//
+// The first byte is the version (currently always 1), followed by a byte with
+// flags (1 for "no_sessions", and 2 to not filter by IP). After that the hits
+// follow until the end of the data, each prefixed with the length of the hit
+// as an uvarint.
+//
+// Every hit is encoded as the following fields in this order; strings are
+// prefixed with the length in bytes as an uvarint:
+//
+//	path, title, ref, query, user_agent, location, ip, session   strings
+//	event                                                        byte; 0 or 1
+//	bot                                                          uvarint
+//	created_at                                                   varint; UNIX timestamp, or 0 for the current time
+//	size                                                         uvarint with the number of values, and that many float64s as little-endian
+func (a APICountRequest) MarshalBinary() ([]byte, error) {
+	var flags byte
+	if a.NoSessions {
+		flags |= binaryNoSessions
+	}
+	if a.Filter != nil && len(a.Filter) == 0 {
+		flags |= binaryNoFilter
+	} else if len(a.Filter) > 1 || (len(a.Filter) == 1 && a.Filter[0] != "ip") {
+		return nil, errors.Errorf("APICountRequest.MarshalBinary: unsupported Filter: %v", a.Filter)
+	}
+
+	b := []byte{binaryVersion1, flags}
+	var rec []byte
+	for _, h := range a.Hits {
+		rec = rec[:0]
+		for _, s := range []string{h.Path, h.Title, h.Ref, h.Query, h.UserAgent, h.Location, h.IP, h.Session} {
+			rec = binary.AppendUvarint(rec, uint64(len(s)))
+			rec = append(rec, s...)
+		}
+		if h.Event {
+			rec = append(rec, 1)
+		} else {
+			rec = append(rec, 0)
+		}
+		rec = binary.AppendUvarint(rec, uint64(h.Bot))
+		var t int64
+		if !h.CreatedAt.IsZero() {
+			t = h.CreatedAt.Unix()
+		}
+		rec = binary.AppendVarint(rec, t)
+		rec = binary.AppendUvarint(rec, uint64(len(h.Size)))
+		for _, f := range h.Size {
+			rec = binary.LittleEndian.AppendUint64(rec, math.Float64bits(f))
+		}
+
+		b = binary.AppendUvarint(b, uint64(len(rec)))
+		b = append(b, rec...)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes the binary format; see MarshalBinary().
+func (a *APICountRequest) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("binary count request: too short")
+	}
+	if data[0] != binaryVersion1 {
+		return fmt.Errorf("binary count request: unknown version %d", data[0])
+	}
+	flags := data[1]
+	if flags&^(binaryNoSessions|binaryNoFilter) != 0 {
+		return fmt.Errorf("binary count request: unknown flags %#x", flags)
+	}
+	a.NoSessions = flags&binaryNoSessions != 0
+	if flags&binaryNoFilter != 0 {
+		a.Filter = []string{}
+	}
+
+	data = data[2:]
+	for i := 0; len(data) > 0; i++ {
+		n, l := binary.Uvarint(data)
+		if l <= 0 || n > uint64(len(data)-l) {
+			return fmt.Errorf("binary count request: hit %d: invalid length", i)
+		}
+		h, err := decodeBinaryHit(data[l : l+int(n)])
+		if err != nil {
+			return fmt.Errorf("binary count request: hit %d: %w", i, err)
+		}
+		a.Hits = append(a.Hits, h)
+		data = data[l+int(n):]
+	}
+	return nil
+}
+
+func decodeBinaryHit(b []byte) (APICountRequestHit, error) {
+	var (
+		h   APICountRequestHit
+		err error
+	)
+	uvarint := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		n, l := binary.Uvarint(b)
+		if l <= 0 {
+			err = fmt.Errorf("invalid uvarint")
+			return 0
+		}
+		b = b[l:]
+		return n
+	}
+	str := func() string {
+		n := uvarint()
+		if err != nil {
+			return ""
+		}
+		if n > uint64(len(b)) {
+			err = fmt.Errorf("string too long")
+			return ""
+		}
+		s := string(b[:n])
+		b = b[n:]
+		return s
+	}
+
+	h.Path, h.Title, h.Ref, h.Query = str(), str(), str(), str()
+	h.UserAgent, h.Location, h.IP, h.Session = str(), str(), str(), str()
+	if err == nil {
+		if len(b) == 0 || b[0] > 1 {
+			return h, fmt.Errorf("invalid event")
+		}
+		h.Event, b = zbool.Bool(b[0] == 1), b[1:]
+	}
+	h.Bot = int(uvarint())
+	if err == nil {
+		t, l := binary.Varint(b)
+		if l <= 0 {
+			return h, fmt.Errorf("invalid created_at")
+		}
+		if t != 0 {
+			h.CreatedAt = time.Unix(t, 0).UTC()
+		}
+		b = b[l:]
+	}
+	n := uvarint()
+	if err != nil {
+		return h, err
+	}
+	if n > uint64(len(b)/8) {
+		return h, fmt.Errorf("invalid size")
+	}
+	for i := uint64(0); i < n; i++ {
+		h.Size = append(h.Size, math.Float64frombits(binary.LittleEndian.Uint64(b)))
+		b = b[8:]
+	}
+	if len(b) > 0 {
+		return h, fmt.Errorf("trailing data")
+	}
+	return h, nil
+}
@@ -0,0 +1,198 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/metrics"
+	"zgo.at/zhttp"
+	"zgo.at/zlog"
+)
+
+// Maximum number of line errors in the response for /api/v0/import.
+const maxImportErrors = 50
+
+type apiImportResponse struct {
+	// Number of imported pageviews.
+	Imported int `json:"imported"`
+
+	// Lines that weren't imported, as "line N: error"; at most 50 are listed.
+	Errors []string `json:"errors,omitempty"`
+
+	// Error that stopped the import; pageviews before this were imported.
+	Error string `json:"error,omitempty"`
+}
+
+// POST /api/v0/import count
+// Import pageviews from newline-delimited JSON.
+//
+// Every line is a pageview in the same format as returned by /api/v0/hits, so
+// pageviews can be copied between sites. Pageviews are read and imported while
+// the body is being received, so there is no limit on the size.
+//
+// The body can be compressed with "Content-Encoding: gzip" or "zstd". It's
+// rejected with a 413 once the decompressed data is more than -import-max-ratio
+// times the compressed size, which is 100 by default.
+//
+// Lines that can't be imported are skipped and listed in the response;
+// everything else is imported.
+//
+// With "?lookup_ip=true" the location is looked up from the "ip" field on every
+// line that has one, rather than using the "location" field. The IP address is
+// discarded after the lookup, and the location follows the site's settings for
+// collecting the location and region.
+//
+// Request body (application/x-ndjson): {data}
+// Response 200: apiImportResponse
+func (h api) importHits(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("/api/v0/import")
+	defer m.Done()
+
+	err := h.auth(r, w, goatcounter.APIPermCount)
+	if err != nil {
+		return err
+	}
+
+	if goatcounter.Maintenance() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return zhttp.JSON(w, apiError{Error: "maintenance"})
+	}
+
+	body, err := decompressBody(r, goatcounter.Config(r.Context()).ImportMaxRatio)
+	if err != nil {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return zhttp.JSON(w, apiError{Error: err.Error()})
+	}
+	defer body.Close()
+
+	var (
+		ctx  = r.Context()
+		site = Site(ctx)
+		res  apiImportResponse
+	)
+	n, firstHitAt, err := goatcounter.ImportJSON(ctx, body, r.URL.Query().Get("lookup_ip") == "true",
+		func(hit goatcounter.Hit, final bool) {
+			if final {
+				return
+			}
+			goatcounter.Memstore.Append(hit)
+
+			// Spread out the load a bit.
+			if goatcounter.Memstore.Len() >= 5000 {
+				err := cron.TaskPersistAndStat()
+				if err != nil {
+					zlog.Error(err)
+				}
+				cron.WaitPersistAndStat()
+			}
+		},
+		func(line int, err error) {
+			if len(res.Errors) < maxImportErrors {
+				res.Errors = append(res.Errors, fmt.Sprintf("line %d: %s", line, strings.TrimSpace(err.Error())))
+			}
+		})
+	res.Imported = n
+
+	if firstHitAt != nil {
+		err := site.UpdateFirstHitAt(ctx, *firstHitAt)
+		if err != nil {
+			zlog.Error(err)
+		}
+	}
+
+	if err != nil {
+		if errors.Is(err, errDecompressRatio) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		// Don't include the function names from errors.Wrap().
+		for e := errors.Unwrap(err); e != nil; e = errors.Unwrap(e) {
+			err = e
+		}
+		res.Error = err.Error()
+	}
+	return zhttp.JSON(w, res)
+}
+
+var errDecompressRatio = errors.New("decompressed body is too large compared to the compressed size")
+
+// decompressBody gets the request body, decompressed according to the
+// Content-Encoding header: gzip, zstd, or identity (the default).
+//
+// Reading the body fails with errDecompressRatio once the decompressed size is
+// more than maxRatio times the compressed size, to guard against compression
+// bombs. Compressed bodies are rejected if maxRatio is 0.
+func decompressBody(r *http.Request, maxRatio int) (io.ReadCloser, error) {
+	enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if enc == "" || enc == "identity" {
+		return r.Body, nil
+	}
+	if maxRatio <= 0 {
+		return nil, fmt.Errorf("compressed bodies are not accepted")
+	}
+
+	c := &countReader{r: r.Body}
+	switch enc {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(c)
+		if err != nil {
+			return nil, fmt.Errorf("reading gzip: %w", err)
+		}
+		return &ratioReader{r: gz, close: gz.Close, c: c, ratio: int64(maxRatio)}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(c, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("reading zstd: %w", err)
+		}
+		return &ratioReader{r: zr, close: func() error { zr.Close(); return nil }, c: c, ratio: int64(maxRatio)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q; supported are gzip and zstd", enc)
+	}
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ratioReader reads the decompressed data from r, until it's more than ratio
+// times the size of the compressed data read from c.
+//
+// The first 64K of compressed data counts as 64K, so small bodies aren't
+// rejected just because of the fixed overhead.
+type ratioReader struct {
+	r     io.Reader
+	close func() error
+	c     *countReader
+	ratio int64
+	n     int64
+}
+
+func (r *ratioReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.n > r.ratio*max(r.c.n, 64*1024) {
+		return n, errDecompressRatio
+	}
+	return n, err
+}
+
+func (r *ratioReader) Close() error { return r.close() }
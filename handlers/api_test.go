@@ -6,16 +6,20 @@ package handlers
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+	"zgo.at/bgrun"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/json"
@@ -380,28 +384,37 @@ func TestAPICount(t *testing.T) {
 	perm := goatcounter.APIPermCount
 
 	for _, tt := range tests {
-		t.Run("", func(t *testing.T) {
-			ctx := gctest.DB(t)
-			site := Site(ctx)
-			site.Settings.IgnoreIPs = []string{"1.1.1.1"}
-			err := site.Update(ctx)
-			if err != nil {
-				t.Fatal(err)
-			}
+		for _, bin := range []bool{false, true} {
+			t.Run(map[bool]string{false: "json", true: "binary"}[bin], func(t *testing.T) {
+				ctx := gctest.DB(t)
+				site := Site(ctx)
+				site.Settings.IgnoreIPs = []string{"1.1.1.1"}
+				err := site.Update(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
 
-			r, rr := newAPITest(ctx, t, "POST", "/api/v0/count",
-				bytes.NewReader(zjson.MustMarshal(tt.body)), perm)
+				r, rr := newAPITest(ctx, t, "POST", "/api/v0/count",
+					bytes.NewReader(zjson.MustMarshal(tt.body)), perm)
+				if bin {
+					b, err := tt.body.MarshalBinary()
+					if err != nil {
+						t.Fatal(err)
+					}
+					r, rr = newAPITest(ctx, t, "POST", "/api/v0/count/binary", bytes.NewReader(b), perm)
+					r.Header.Set("Content-Type", "application/octet-stream")
+				}
 
-			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
-			ztest.Code(t, rr, tt.wantCode)
-			if d := ztest.Diff(rr.Body.String(), tt.wantRet, ztest.DiffJSON); d != "" {
-				t.Errorf("\nout:  %s\nwant: %s", rr.Body.String(), tt.wantRet)
-			}
+				newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+				ztest.Code(t, rr, tt.wantCode)
+				if d := ztest.Diff(rr.Body.String(), tt.wantRet, ztest.DiffJSON); d != "" {
+					t.Errorf("\nout:  %s\nwant: %s", rr.Body.String(), tt.wantRet)
+				}
 
-			gctest.StoreHits(ctx, t, false)
+				gctest.StoreHits(ctx, t, false)
 
-			tt.want = strings.TrimSpace(strings.ReplaceAll(tt.want, "\t", ""))
-			have := strings.TrimSpace(zdb.DumpString(ctx, `
+				tt.want = strings.TrimSpace(strings.ReplaceAll(tt.want, "\t", ""))
+				have := strings.TrimSpace(zdb.DumpString(ctx, `
 				select
 					hits.hit_id,
 					hits.site_id,
@@ -428,17 +441,97 @@ func TestAPICount(t *testing.T) {
 				join browsers using (browser_id)
 				join systems  using (system_id)
 				order by hit_id asc`))
-			if strings.Count(have, "\n") == 0 { // No data, only the header.
-				have = ""
-			}
+				if strings.Count(have, "\n") == 0 { // No data, only the header.
+					have = ""
+				}
 
-			if d := ztest.Diff(have, tt.want); d != "" {
-				t.Errorf(d)
-			}
-		})
+				if d := ztest.Diff(have, tt.want); d != "" {
+					t.Errorf(d)
+				}
+			})
+		}
 	}
 }
 
+func TestAPICountBinary(t *testing.T) {
+	t.Run("roundtrip", func(t *testing.T) {
+		want := APICountRequest{NoSessions: true, Filter: []string{}, Hits: []APICountRequestHit{
+			{Path: "/foo"},
+			{Path: "/bar", Title: "Bar", Ref: "https://example.com", Event: true, Query: "a=b",
+				Size: goatcounter.Floats{1920, 1080, 1.5}, Bot: 150, UserAgent: "Mozilla/5.0",
+				Location: "NL", IP: "1.2.3.4", Session: "sess",
+				CreatedAt: time.Date(2020, 1, 18, 14, 42, 0, 0, time.UTC)},
+			{Path: strings.Repeat("/x", 500), Title: "€ 𝄞"},
+		}}
+		b, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var have APICountRequest
+		err = have.UnmarshalBinary(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("\nhave: %#v\nwant: %#v", have, want)
+		}
+
+		// Default filter.
+		b, _ = APICountRequest{Hits: []APICountRequestHit{{Path: "/foo"}}}.MarshalBinary()
+		have = APICountRequest{}
+		err = have.UnmarshalBinary(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have.Filter != nil || have.NoSessions {
+			t.Errorf("%#v", have)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		valid, _ := APICountRequest{Hits: []APICountRequestHit{{Path: "/foo", Size: goatcounter.Floats{1, 2}}}}.MarshalBinary()
+		tests := []struct {
+			in      []byte
+			wantErr string
+		}{
+			{nil, "too short"},
+			{[]byte{2, 0}, "unknown version 2"},
+			{[]byte{0, 0}, "unknown version 0"},
+			{[]byte{1, 0x80}, "unknown flags"},
+			{valid[:len(valid)-1], "hit 0: invalid length"},
+			{append([]byte{1, 0, 1}, 0xff), "hit 0: invalid uvarint"},
+			{append([]byte{1, 0, 2}, 5, 'a'), "hit 0: string too long"},
+			{append(append([]byte{}, valid[:2]...), append([]byte{valid[2] + 1}, append(valid[3:], 0)...)...), "hit 0: trailing data"},
+		}
+		for _, tt := range tests {
+			t.Run("", func(t *testing.T) {
+				var have APICountRequest
+				err := have.UnmarshalBinary(tt.in)
+				if !ztest.ErrorContains(err, tt.wantErr) {
+					t.Errorf("\nhave: %v\nwant: %s", err, tt.wantErr)
+				}
+			})
+		}
+
+		_, err := APICountRequest{Filter: []string{"other"}}.MarshalBinary()
+		if !ztest.ErrorContains(err, "unsupported Filter") {
+			t.Error(err)
+		}
+	})
+
+	t.Run("endpoint", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		r, rr := newAPITest(ctx, t, "POST", "/api/v0/count/binary", bytes.NewReader([]byte{9, 0}), goatcounter.APIPermCount)
+		r.Header.Set("Content-Type", "application/octet-stream")
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 400)
+		if !strings.Contains(rr.Body.String(), "unknown version 9") {
+			t.Error(rr.Body.String())
+		}
+	})
+}
+
 func TestAPISitesCreate(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18 12:13:14")
 	now := ztime.Now()
@@ -571,6 +664,53 @@ func TestAPISitesUpdate(t *testing.T) {
 	}
 }
 
+func TestAPIActive(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := Site(ctx)
+	t.Cleanup(func() { goatcounter.Memstore.Reset() })
+
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+	goatcounter.Memstore.Append(
+		goatcounter.Hit{Site: site.ID, Path: "/a", UserAgentHeader: "test", RemoteAddr: "1.1.1.1", CreatedAt: ztime.Now()},
+		goatcounter.Hit{Site: site.ID, Path: "/a", UserAgentHeader: "test", RemoteAddr: "2.2.2.2", CreatedAt: ztime.Now()},
+		goatcounter.Hit{Site: site.ID, Path: "/b", UserAgentHeader: "test", RemoteAddr: "3.3.3.3", CreatedAt: ztime.Now()})
+	_, err := goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		now      string
+		query    string
+		perm     zint.Bitflag64
+		wantCode int
+		want     string
+	}{
+		{"active", "2020-06-18 12:01:00", "path=/a", goatcounter.APIPermStats, 200,
+			`{"path": "/a", "count": 2, "window": 300}`},
+		{"other path", "2020-06-18 12:01:00", "path=/b", goatcounter.APIPermStats, 200,
+			`{"path": "/b", "count": 1, "window": 300}`},
+		{"expired", "2020-06-18 12:06:00", "path=/a", goatcounter.APIPermStats, 200,
+			`{"path": "/a", "count": 0, "window": 300}`},
+		{"no path", "2020-06-18 12:01:00", "", goatcounter.APIPermStats, 400,
+			`{"errors": {"path": ["must be set"]}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ztime.SetNow(t, tt.now)
+			r, rr := newAPITest(ctx, t, "GET", "/api/v0/stats/active?"+tt.query, nil, tt.perm)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			if d := ztest.Diff(rr.Body.String(), tt.want, ztest.DiffJSON); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
 func TestAPIPaths(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18 12:13:14")
 
@@ -1052,3 +1192,256 @@ func TestAPIStatsDetail(t *testing.T) {
 		})
 	}
 }
+
+func TestAPIRawHits(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", CreatedAt: now},
+		goatcounter.Hit{Path: "/b", CreatedAt: now.Add(time.Second)},
+		goatcounter.Hit{Path: "/c", CreatedAt: now.Add(2 * time.Second)})
+
+	get := func(query string, wantCode int) apiRawHitsResponse {
+		t.Helper()
+		r, rr := newAPITest(ctx, t, "GET", "/api/v0/hits?"+query, nil, goatcounter.APIPermExport)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, wantCode)
+
+		var resp apiRawHitsResponse
+		if wantCode == 200 {
+			zjson.MustUnmarshal(rr.Body.Bytes(), &resp)
+		}
+		return resp
+	}
+	paths := func(resp apiRawHitsResponse) string {
+		var p []string
+		for _, h := range resp.Hits {
+			p = append(p, h.Path)
+		}
+		return fmt.Sprintf("%s %t", strings.Join(p, " "), resp.More)
+	}
+
+	resp := get("limit=2", 200)
+	if have, want := paths(resp), "/a /b true"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+	resp = get("limit=2&cursor="+resp.Cursor, 200)
+	if have, want := paths(resp), "/c false"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	get("cursor=xxx", 400)
+
+	// Clamped to -api-max.
+	r, rr := newAPITest(ctx, t, "GET", "/api/v0/hits?limit=3", nil, goatcounter.APIPermExport)
+	NewBackend(zdb.MustGetDB(ctx), nil, true, true, false, "example.com", 10, 2).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+	resp = apiRawHitsResponse{}
+	zjson.MustUnmarshal(rr.Body.Bytes(), &resp)
+	if have, want := paths(resp), "/a /b true"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestAPIExportAggregate(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", CreatedAt: now, FirstVisit: true, Session: goatcounter.TestSession},
+		goatcounter.Hit{Path: "/a", CreatedAt: now, Ref: "https://example.com", Session: goatcounter.TestSession},
+		goatcounter.Hit{Path: "/b", CreatedAt: now.Add(24 * time.Hour), Session: goatcounter.TestSession})
+
+	get := func(query string, wantCode int) *httptest.ResponseRecorder {
+		t.Helper()
+		r, rr := newAPITest(ctx, t, "GET", "/api/v0/export/aggregate?start=2020-06-18T00:00:00Z&end=2020-06-20T00:00:00Z&"+query,
+			nil, goatcounter.APIPermExport)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, wantCode)
+		return rr
+	}
+
+	rr := get("", 200)
+	if ct := rr.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type: %q", ct)
+	}
+	want := "date,path,pageviews,visitors\n2020-06-18,/a,2,1\n2020-06-19,/b,1,0\n"
+	if d := ztest.Diff(rr.Body.String(), want); d != "" {
+		t.Error(d)
+	}
+
+	rr = get("group=path,ref", 200)
+	want = "date,path,ref,pageviews,visitors\n2020-06-18,/a,,1,1\n2020-06-18,/a,example.com,1,0\n2020-06-19,/b,,1,0\n"
+	if d := ztest.Diff(rr.Body.String(), want); d != "" {
+		t.Error(d)
+	}
+
+	rr = get("group=browser", 400)
+	if !strings.Contains(rr.Body.String(), "must be one of") {
+		t.Error(rr.Body.String())
+	}
+}
+
+func TestAPIExportFlow(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	var hits []goatcounter.Hit
+	for i := uint64(0); i < 3; i++ {
+		s := zint.Uint128{goatcounter.TestSession[0], i}
+		hits = append(hits,
+			goatcounter.Hit{Path: "/a", CreatedAt: now, Session: s},
+			goatcounter.Hit{Path: "/b", CreatedAt: now.Add(time.Minute), Session: s})
+	}
+	gctest.StoreHits(ctx, t, false, hits...)
+
+	get := func(query string, wantCode int) *httptest.ResponseRecorder {
+		t.Helper()
+		r, rr := newAPITest(ctx, t, "GET", "/api/v0/export/flow?start=2020-06-18T00:00:00Z&end=2020-06-20T00:00:00Z&"+query,
+			nil, goatcounter.APIPermExport)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, wantCode)
+		return rr
+	}
+
+	rr := get("", 200)
+	if ct := rr.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type: %q", ct)
+	}
+	if d := ztest.Diff(rr.Body.String(), "from,to,count\n"); d != "" {
+		t.Error(d)
+	}
+
+	rr = get("min_visitors=3", 200)
+	if d := ztest.Diff(rr.Body.String(), "from,to,count\n/a,/b,3\n"); d != "" {
+		t.Error(d)
+	}
+
+	rr = get("min_visitors=1", 400)
+	if !strings.Contains(rr.Body.String(), "must be 2 or higher") {
+		t.Error(rr.Body.String())
+	}
+}
+
+func TestAPIExportConcurrency(t *testing.T) {
+	ctx := gctest.DB(t)
+	goatcounter.SetExportConcurrency(0, 1, 0)
+	defer goatcounter.SetExportConcurrency(0, 0, 0)
+
+	export := func(method, url string, wantCode int) {
+		t.Helper()
+		r, rr := newAPITest(ctx, t, method, url, nil, goatcounter.APIPermExport)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, wantCode)
+		if wantCode == 429 {
+			if h := rr.Header().Get("Retry-After"); h != "30" {
+				t.Errorf("Retry-After: %q", h)
+			}
+		}
+	}
+	status := func(want string) {
+		t.Helper()
+		r, rr := newTest(ctx, "GET", "/status", nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("status doesn't contain %q:\n%s", want, rr.Body.String())
+		}
+	}
+
+	release, err := goatcounter.AcquireExport(ctx, Site(ctx).ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status(`"exports":{"queued":0,"running":1}`)
+	export("GET", "/api/v0/export/aggregate", 429)
+	export("GET", "/api/v0/export/flow", 429)
+	export("POST", "/api/v0/export", 429)
+
+	release()
+	status(`"exports":{"queued":0,"running":0}`)
+	export("GET", "/api/v0/export/aggregate", 200)
+	export("POST", "/api/v0/export", 202)
+	bgrun.Wait("")
+	status(`"exports":{"queued":0,"running":0}`)
+}
+
+func TestAPIImport(t *testing.T) {
+	ndjson := func(paths ...string) []byte {
+		b := new(bytes.Buffer)
+		for i, p := range paths {
+			fmt.Fprintf(b, `{"path":%q,"event":"false","bot":"0","first_visit":"true","session":"1-%x","created_at":"2020-06-18T14:42:00Z"}`+"\n", p, i)
+		}
+		return b.Bytes()
+	}
+	gz := func(b []byte) []byte {
+		out := new(bytes.Buffer)
+		w := gzip.NewWriter(out)
+		w.Write(b)
+		w.Close()
+		return out.Bytes()
+	}
+	zst := func(b []byte) []byte {
+		w, _ := zstd.NewWriter(nil)
+		defer w.Close()
+		return w.EncodeAll(b, nil)
+	}
+
+	tests := []struct {
+		name     string
+		enc      string
+		body     []byte
+		wantCode int
+		wantRet  string
+		want     string
+	}{
+		{"identity", "", ndjson("/a", "/b"), 200, `{"imported":2}`, "/a /b"},
+		{"gzip", "gzip", gz(ndjson("/a", "/b")), 200, `{"imported":2}`, "/a /b"},
+		{"zstd", "zstd", zst(ndjson("/a", "/b")), 200, `{"imported":2}`, "/a /b"},
+		{"line error", "gzip", gz(append(ndjson("/a"), "{}\nnot json\n"...)), 200,
+			`{"imported":1,"errors":["line 2: path: must be set.","line 3: invalid character 'o' in literal null (expecting 'u')"]}`, "/a"},
+
+		{"bad gzip", "gzip", []byte("not gzip"), 415, `{"error":"reading gzip: unexpected EOF"}`, ""},
+		{"unsupported", "br", ndjson("/a"), 415, `{"error":"unsupported Content-Encoding \"br\"; supported are gzip and zstd"}`, ""},
+		{"ratio", "gzip", gz(bytes.Repeat([]byte("\n"), 20<<20)), 413,
+			`{"imported":0,"error":"decompressed body is too large compared to the compressed size"}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			goatcounter.Config(ctx).ImportMaxRatio = 100
+
+			r, rr := newAPITest(ctx, t, "POST", "/api/v0/import", bytes.NewReader(tt.body), goatcounter.APIPermCount)
+			if tt.enc != "" {
+				r.Header.Set("Content-Encoding", tt.enc)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+			if d := ztest.Diff(rr.Body.String(), tt.wantRet, ztest.DiffJSON); d != "" {
+				t.Error(d)
+			}
+
+			gctest.StoreHits(ctx, t, false)
+			var have []string
+			err := zdb.Select(ctx, &have, `select path from hits join paths using (path_id) order by hit_id`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h := strings.Join(have, " "); h != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", h, tt.want)
+			}
+		})
+	}
+
+	t.Run("no compression", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		goatcounter.Config(ctx).ImportMaxRatio = 0
+
+		r, rr := newAPITest(ctx, t, "POST", "/api/v0/import", bytes.NewReader(gz(ndjson("/a"))), goatcounter.APIPermCount)
+		r.Header.Set("Content-Encoding", "gzip")
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 415)
+	})
+}
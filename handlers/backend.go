@@ -7,6 +7,7 @@ package handlers
 import (
 	"net/http"
 	"slices"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -21,7 +22,7 @@ import (
 
 func NewBackend(db zdb.DB, acmeh http.HandlerFunc, dev, goatcounterCom, websocket bool, domainStatic string, dashTimeout, apiMax int) chi.Router {
 	r := chi.NewRouter()
-	backend{dashTimeout, websocket}.Mount(r, db, dev, domainStatic, dashTimeout, apiMax)
+	backend{dashTimeout: dashTimeout, websocket: websocket}.Mount(r, db, dev, domainStatic, dashTimeout, apiMax)
 
 	if acmeh != nil {
 		r.Get("/.well-known/acme-challenge/{key}", acmeh)
@@ -37,6 +38,7 @@ func NewBackend(db zdb.DB, acmeh http.HandlerFunc, dev, goatcounterCom, websocke
 type backend struct {
 	dashTimeout int
 	websocket   bool
+	deps        countDeps // Uses the globals if nil.
 }
 
 func (h backend) Mount(r chi.Router, db zdb.DB, dev bool, domainStatic string, dashTimeout, apiMax int) {
@@ -45,6 +47,7 @@ func (h backend) Mount(r chi.Router, db zdb.DB, dev bool, domainStatic string, d
 	}
 
 	r.Use(
+		keepPeer,
 		mware.RealIP(),
 		mware.WrapWriter(),
 		mware.Unpanic("zgo.at/goatcounter/v2/handlers.add"),
@@ -56,7 +59,19 @@ func (h backend) Mount(r chi.Router, db zdb.DB, dev bool, domainStatic string, d
 		r.Use(mware.RequestLog(nil, "/count"))
 	}
 	if true {
-		r.Use(middleware.NewCompressor(5).Handler)
+		// The JSON responses from /count are compressed with countJSON(),
+		// which skips tiny responses.
+		compress := middleware.NewCompressor(5).Handler
+		r.Use(func(next http.Handler) http.Handler {
+			c := compress(next)
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if isCount(r) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				c.ServeHTTP(w, r)
+			})
+		})
 	}
 
 	fsys, err := zfs.EmbedOrDir(goatcounter.Templates, "", dev)
@@ -71,6 +86,7 @@ func (h backend) Mount(r chi.Router, db zdb.DB, dev bool, domainStatic string, d
 	website{fsys, false}.MountShared(r)
 	newAPI(apiMax).mount(r, db)
 	vcounter{static}.mount(r)
+	countScript{static}.mount(r)
 
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		zhttp.ErrPage(w, r, guru.New(404, T(r.Context(), "error/not-found|Not Found")))
@@ -111,6 +127,33 @@ func (h backend) Mount(r chi.Router, db zdb.DB, dev bool, domainStatic string, d
 		}))
 		rate.Get("/count", zhttp.Wrap(h.count))
 		rate.Post("/count", zhttp.Wrap(h.count)) // to support navigator.sendBeacon (JS)
+		rate.Get("/count/p/{hit}", zhttp.Wrap(h.count))
+		rate.Post("/count/stream", zhttp.Wrap(h.countStream))
+
+		// Separate limit for errors, per site and visitor, so a page that
+		// throws in a loop doesn't use up the limit for pageviews.
+		rr.With(mware.Ratelimit(mware.RatelimitOptions{
+			Client: func(r *http.Request) string {
+				var site int64
+				if s := goatcounter.GetSite(r.Context()); s != nil {
+					site = s.ID
+				}
+				return strconv.FormatInt(site, 10) + extractClientIP(r) + r.UserAgent()
+			},
+			Store: mware.NewRatelimitMemory(),
+			Limit: func(r *http.Request) (int, int64) {
+				if dev {
+					return 1 << 30, 1
+				}
+				return rateLimits.countError(r)
+			},
+		})).Post("/count/error", zhttp.Wrap(h.countError))
+
+		// Not rate limited, as browsers send these only once every
+		// -count-max-age.
+		rr.Options("/count", zhttp.Wrap(h.countPreflight))
+		rr.Options("/count/stream", zhttp.Wrap(h.countPreflight))
+		rr.Options("/count/error", zhttp.Wrap(h.countPreflight))
 	}
 
 	{
@@ -138,6 +181,7 @@ func (h backend) Mount(r chi.Router, db zdb.DB, dev bool, domainStatic string, d
 		{
 			af := a.With(loggedIn, addz18n())
 			settings{}.mount(af)
+			af.With(requireAccess(goatcounter.AccessSettings)).Post("/count/normalize", zhttp.Wrap(h.countNormalize))
 
 			Newi18n().mount(af)
 		}
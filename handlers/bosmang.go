@@ -39,6 +39,7 @@ func (h bosmang) mount(r chi.Router, db zdb.DB) {
 	a.Get("/bosmang/error", zhttp.Wrap(h.error))
 	a.Get("/bosmang/bgrun", zhttp.Wrap(h.bgrun))
 	a.Post("/bosmang/bgrun/{task}", zhttp.Wrap(h.runTask))
+	a.Post("/bosmang/maintenance", zhttp.Wrap(h.maintenance))
 	a.Get("/bosmang/metrics", zhttp.Wrap(h.metrics))
 	a.Handle("/bosmang/profile*", zprof.NewHandler(zprof.Prefix("/bosmang/profile")))
 
@@ -101,16 +102,42 @@ func (h bosmang) runTask(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.SeeOther(w, "/bosmang/bgrun")
 }
 
+func (h bosmang) maintenance(w http.ResponseWriter, r *http.Request) error {
+	on := r.FormValue("enable") == "true"
+	goatcounter.SetMaintenance(on)
+	if !on {
+		zhttp.Flash(w, "Maintenance mode disabled")
+		return zhttp.SeeOther(w, "/settings/server")
+	}
+
+	// Write out the pageviews that were already accepted; new ones are
+	// rejected from now on.
+	bgrun.RunFunction("maintenance:drain", func() {
+		err := cron.TaskPersistAndStat()
+		if err != nil {
+			zlog.Error(err)
+		}
+	})
+	zhttp.Flash(w, "Maintenance mode enabled; new pageviews are rejected until it's disabled")
+	return zhttp.SeeOther(w, "/settings/server")
+}
+
 func (h bosmang) metrics(w http.ResponseWriter, r *http.Request) error {
 	by := "sum"
 	if b := r.URL.Query().Get("by"); b != "" {
 		by = b
 	}
+	var sinks []goatcounter.SinkStat
+	if ms, ok := goatcounter.Memstore.Sink().(*goatcounter.MultiSink); ok {
+		sinks = ms.Stats()
+	}
 	return zhttp.Template(w, "bosmang_metrics.gohtml", struct {
 		Globals
 		Metrics metrics.Metrics
 		By      string
-	}{newGlobals(w, r), metrics.List().Sort(by), by})
+		Caches  []goatcounter.MemCacheStat
+		Sinks   []goatcounter.SinkStat
+	}{newGlobals(w, r), metrics.List().Sort(by), by, goatcounter.ListMemCaches(), sinks})
 }
 
 func (h bosmang) sites(w http.ResponseWriter, r *http.Request) error {
@@ -5,16 +5,38 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
-	"encoding/json"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
-	"golang.org/x/text/language"
+	"github.com/go-chi/chi/v5"
+	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/metrics"
 	"zgo.at/isbot"
+	"zgo.at/zdb"
 	"zgo.at/zhttp"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/znet"
 	"zgo.at/zstd/ztime"
 )
 
@@ -26,9 +48,237 @@ var gif = []byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x1, 0x0, 0x1, 0x0, 0x80,
 	0x1, 0x0, 0x2c, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x0, 0x0, 0x2, 0x2, 0x4c,
 	0x1, 0x0, 0x3b}
 
+// Reasons a pageview sent to /count wasn't recorded, for the
+// X-Goatcounter-Code header.
+//
+// Unlike the message in the X-Goatcounter header these are stable, so clients
+// can rely on them. Don't change existing values.
+const (
+	countPrefetch      = "prefetch"       // Prefetch request from the browser.
+	countEmptyBody     = "empty_body"     // POST body is below -count-min-body.
+	countIgnoredIP     = "ignored_ip"     // IP is in the site's ignore list.
+	countBlockedUA     = "blocked_ua"     // User-Agent is in SiteSettings.BlockUserAgentSubstrings.
+	countHTTPSRequired = "https_required" // Sent over HTTP with RequireHTTPS set.
+	countDecodeError   = "decode_error"   // Can't decode the parameters.
+	countInvalidBot    = "invalid_bot"    // Invalid value for "b".
+	countPathTooLong   = "path_too_long"  // Path is longer than MaxPathLen, and LongPaths is reject.
+	countHitTooLong    = "hit_too_long"   // Encoded hit in /count/p/ is too long.
+	countInvalid       = "invalid"        // Hit didn't validate.
+	countDropped       = "dropped"        // Dropped by a HitHook.
+	countMaintenance   = "maintenance"    // Instance is in maintenance mode.
+	countBadSignature  = "bad_signature"  // Missing, invalid, or expired signature.
+	countUnknownSite   = "unknown_site"   // No site for this host; see -unknown-site.
+	countIPHost        = "ip_host"        // Host is an IP address; see -ip-host.
+	countBadSession    = "bad_session"    // Missing or invalid edge session token.
+	countEmptyUA       = "empty_ua"       // No User-Agent header; see -empty-ua.
+	countInvalidType   = "invalid_type"   // Unknown type, and RejectUnknownTypes is set.
+	countTestMode      = "test_mode"      // Site is in test mode; see SiteSettings.TestMode.
+	countReplay        = "replay"         // Nonce in the signature was already used.
+	countSampled       = "sampled"        // Not recorded because of SiteSettings.SampleRate.
+	countStreamLimit   = "stream_limit"   // Too many pageviews or too large body for /count/stream.
+	countErrorTooLarge = "too_large"      // Body for /count/error is larger than maxErrorBody.
+	countNoPath        = "no_path"        // No path, SiteSettings.PathFromReferer can't get it from the Referer, and there is no DefaultPath.
+	countDuplicate     = "duplicate"      // Same request ID and path as a recent pageview; see requestIDs.
+	countStorageError  = "storage_error"  // Writing to the database failed, with -sync-count=error.
+	countTLSVersion    = "tls_version"    // TLS version is below -count-min-tls.
+	countDeniedPath    = "denied_path"    // Path matches SiteSettings.DenyPathRegexps.
+	countMissingHeader = "missing_header" // SiteSettings.RequireHeader is missing or has the wrong value.
+	countWebdriver     = "webdriver"      // Hit.Webdriver is set, and SiteSettings.Webdriver is drop.
+	countShortDwell    = "short_dwell"    // Hit.DwellMs is below SiteSettings.MinDwellMs, or missing with RequireDwell.
+	countBadAuth       = "bad_auth"       // Invalid API key with SiteSettings.ServerClients.
+	countInvalidValue  = "invalid_value"  // Hit.EventValue is out of range, or set on a pageview.
+
+	// Only for /count/error, as pageviews from bots are recorded with the bot
+	// flag set.
+	countBot = "bot"
+
+	// Only for /count/normalize, as the memstore runs after the response is
+	// sent.
+	countNotStored = "not_stored"
+
+	// Only with SiteSettings.DebugHeaders set to minimal, instead of the other
+	// codes.
+	countIgnored = "ignored"
+	countErrored = "error"
+)
+
+// countReason sets the X-Goatcounter and X-Goatcounter-Code headers to explain
+// why a pageview wasn't recorded.
+func countReason(w http.ResponseWriter, code, msg string, args ...any) {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	w.Header().Add("X-Goatcounter", msg)
+	w.Header().Set("X-Goatcounter-Code", code)
+}
+
+// debugHeaders limits the X-Goatcounter and X-Goatcounter-Code headers to
+// SiteSettings.DebugHeaders. This is done when the headers are written, so the
+// handlers can always set them.
+type debugHeaders struct {
+	http.ResponseWriter
+	level   string
+	ignored int // Status for ignored pageviews; see ignoredStatus().
+	done    bool
+}
+
+func newDebugHeaders(w http.ResponseWriter, r *http.Request, site *goatcounter.Site) http.ResponseWriter {
+	if site == nil || site.Settings.DebugHeaders == "" || site.Settings.DebugHeaders == goatcounter.DebugHeadersFull {
+		return w
+	}
+	return &debugHeaders{ResponseWriter: w, level: site.Settings.DebugHeaders, ignored: ignoredStatus(r.Context())}
+}
+
+func (w *debugHeaders) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *debugHeaders) WriteHeader(status int) {
+	w.limit(status)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *debugHeaders) Write(b []byte) (int, error) {
+	w.limit(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *debugHeaders) limit(status int) {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	h := w.Header()
+	if w.level == goatcounter.DebugHeadersOff || h.Get("X-Goatcounter-Code") == "" {
+		// Notes about recorded pageviews are always removed.
+		h.Del("X-Goatcounter")
+		h.Del("X-Goatcounter-Code")
+		return
+	}
+	code := countIgnored
+	if status >= 400 && status != w.ignored {
+		code = countErrored
+	}
+	h.Set("X-Goatcounter", code)
+	h.Set("X-Goatcounter-Code", code)
+}
+
+// countDeps are the dependencies of the count handler, so they can be replaced
+// in tests.
+type countDeps interface {
+	// Append the pageview to the memstore.
+	Append(hits ...goatcounter.Hit)
+
+	// Persist writes the pageview to the database right away, for
+	// GlobalConfig.SyncCount.
+	Persist(ctx context.Context, hit goatcounter.Hit) error
+
+	// Now gets the current time.
+	Now() time.Time
+
+	// LookupIP gets the ISO-3166-2 location code for the IP, or "" if it's
+	// unknown.
+	LookupIP(ctx context.Context, ip string) string
+
+	// LookupCountry is like LookupIP, but only looks up the ISO-3166-1
+	// country code.
+	LookupCountry(ctx context.Context, ip string) string
+
+	// LookupASN gets the ASN for the IP, or an empty ASN if it's unknown.
+	LookupASN(ip string) goatcounter.ASN
+
+	// Bot detects bots from the request.
+	Bot(r *http.Request) isbot.Result
+}
+
+// globalCountDeps uses the global Memstore, ztime.Now(), the GeoIP and ASN
+// databases, and isbot.
+type globalCountDeps struct{}
+
+func (globalCountDeps) Append(hits ...goatcounter.Hit)      { goatcounter.Memstore.Append(hits...) }
+func (globalCountDeps) Now() time.Time                      { return ztime.Now() }
+func (globalCountDeps) Bot(r *http.Request) isbot.Result    { return isbot.Bot(r) }
+func (globalCountDeps) LookupASN(ip string) goatcounter.ASN { return goatcounter.LookupASN(ip) }
+func (globalCountDeps) LookupIP(ctx context.Context, ip string) string {
+	return (goatcounter.Location{}).LookupIP(ctx, ip)
+}
+func (globalCountDeps) LookupCountry(ctx context.Context, ip string) string {
+	return (goatcounter.Location{}).LookupCountryIP(ctx, ip)
+}
+func (globalCountDeps) Persist(ctx context.Context, hit goatcounter.Hit) error {
+	return goatcounter.Memstore.PersistHit(ctx, hit)
+}
+
+// maxCountPad is the maximum number of requests that are padded at the same
+// time for -count-pad; requests after that aren't padded, rather than keeping
+// even more goroutines and connections around under load.
+const maxCountPad = 1000
+
+var countPadding = make(chan struct{}, maxCountPad)
+
+// padResponse waits until d has passed since start; it returns early if the
+// request is cancelled or if there are more than maxCountPad waiting already.
+//
+// The response is sent when the handler returns, since the GIF is smaller than
+// the ResponseWriter's buffer.
+func padResponse(ctx context.Context, start time.Time, d time.Duration) {
+	wait := time.Until(start.Add(d))
+	if wait <= 0 {
+		return
+	}
+	select {
+	case countPadding <- struct{}{}:
+		defer func() { <-countPadding }()
+	default:
+		return
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// countPreflight responds to CORS preflight requests for the /count endpoints,
+// which browsers send for POST requests with a JSON body or one of the
+// X-Goatcounter-* headers.
+//
+// Browsers cache this for GlobalConfig.CountMaxAge, rather than sending a
+// preflight before every pageview.
+func (h backend) countPreflight(w http.ResponseWriter, r *http.Request) error {
+	headers := []string{"Content-Type", "Authorization", "X-Goatcounter-Signature", "X-Goatcounter-Session"}
+	if s := goatcounter.GetSite(r.Context()); s != nil && s.Settings.RequireHeader != "" {
+		headers = append(headers, s.Settings.RequireHeader)
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if d := goatcounter.Config(r.Context()).CountMaxAge; d > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(d.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// maxPathHit is the maximum length of the base64-encoded hit sent to
+// /count/p/{hit}.
+const maxPathHit = 2048
+
 func (h backend) count(w http.ResponseWriter, r *http.Request) error {
+	deps := h.deps
+	if deps == nil {
+		deps = globalCountDeps{}
+	}
+
 	m := metrics.Start("/count")
 	defer m.Done()
+	defer goatcounter.GeoLoad()()
+
+	if d := goatcounter.Config(r.Context()).CountPad; d > 0 {
+		defer padResponse(r.Context(), time.Now(), d)
+	}
 
 	if r.Method == "GET" {
 		metrics.Start("/count GET").Done()
@@ -39,99 +289,1777 @@ func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 	w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
 
 	// Note this works in both HTTP/1.1 and HTTP/2, as the Go HTTP/2 server
-	// picks up on this and sends the GOAWAY frame.
+	// picks up on this and sends the GOAWAY frame. Connection-specific headers
+	// aren't allowed in HTTP/3 (RFC 9114 section 4.2), so it's not sent there.
 	// TODO: it would be better to set a short idle timeout, but this isn't
 	// really something that can be configured per-handler at the moment.
 	// https://github.com/golang/go/issues/16100
-	w.Header().Set("Connection", "close")
+	if r.ProtoMajor < 3 {
+		w.Header().Set("Connection", "close")
+	}
+
+	if goatcounter.Maintenance() {
+		countReason(w, countMaintenance, "maintenance")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return zhttp.Bytes(w, gif)
+	}
 
-	bot := isbot.Bot(r)
+	site := Site(r.Context())
+	w = newDebugHeaders(w, r, site)
+	bot := deps.Bot(r)
 	// Don't track pages fetched with the browser's prefetch algorithm.
 	if bot == isbot.BotPrefetch {
+		countReason(w, countPrefetch, "ignored because it's a prefetch request")
+		return botResponse(w, site)
+	}
+
+	// ContentLength is -1 for chunked requests; we don't know the size yet and
+	// just let the decoder deal with it.
+	if m := goatcounter.Config(r.Context()).CountMinBody; r.Method == "POST" && m > 0 &&
+		r.ContentLength >= 0 && r.ContentLength < m && !countBodyOptional(r, site) {
+		countReason(w, countEmptyBody, "empty body")
+		w.WriteHeader(ignoredStatus(r.Context()))
 		return zhttp.Bytes(w, gif)
 	}
 
-	cip := extractClientIP(r)
+	hit, bot, rej := countRequest(w, r, deps, site, bot)
+	if rej != nil {
+		return rej.write(w)
+	}
 
-	site := Site(r.Context())
-	for _, ip := range site.Settings.IgnoreIPs {
-		if ip == cip {
-			w.Header().Add("X-Goatcounter", fmt.Sprintf("ignored because %q is in the IP ignore list", ip))
-			w.WriteHeader(http.StatusAccepted)
+	// Hit is sent as base64-encoded JSON in the path, for when the query
+	// string gets stripped and fetch or sendBeacon aren't allowed.
+	var body io.Reader = r.Body
+	if enc := chi.URLParam(r, "hit"); enc != "" {
+		if len(enc) > maxPathHit {
+			countReason(w, countHitTooLong, "ignored because the encoded hit is longer than %d bytes (%d bytes)",
+				maxPathHit, len(enc))
+			w.WriteHeader(http.StatusRequestURITooLong)
+			return zhttp.Bytes(w, gif)
+		}
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(enc, "="))
+		if err != nil {
+			decodeErrors.log(site.ID, err)
+			countReason(w, countDecodeError, "error decoding parameters: %s", err)
+			w.WriteHeader(400)
+			return zhttp.Bytes(w, gif)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	err := decodeCountHit(r, site, body, &hit)
+	if err != nil {
+		decodeErrors.log(site.ID, err)
+		countReason(w, countDecodeError, "error decoding parameters: %s", err)
+		w.WriteHeader(400)
+		return zhttp.Bytes(w, gif)
+	}
+	if hit.Path == "" && site.Settings.PathFromReferer {
+		u, err := refererPage(r, site)
+		switch {
+		case err == nil:
+			hit.Path, hit.Query = u.Path, u.RawQuery
+			if hit.Path == "" {
+				hit.Path = "/"
+			}
+			w.Header().Add("X-Goatcounter", "path from Referer")
+		case site.Settings.DefaultPath == "": // Otherwise use the DefaultPath in checkHit().
+			countReason(w, countNoPath, "no path: %s", err)
+			w.WriteHeader(400)
 			return zhttp.Bytes(w, gif)
 		}
 	}
 
+	note, rej := countHit(r, deps, site, &hit, bot, r.Header.Get("X-Goatcounter-Signature"))
+	if note != "" {
+		w.Header().Add("X-Goatcounter", note)
+	}
+	if t := truncation(site, hit); t != nil {
+		w.Header().Add("X-Goatcounter", fmt.Sprintf("path_length=%d; truncated_length=%d", t.Length, t.Truncated))
+	}
+	if rej != nil {
+		return rej.write(w)
+	}
+
+	err = storeHit(r, deps, hit)
+	if err != nil && goatcounter.Config(r.Context()).SyncCount == goatcounter.SyncCountError {
+		countReason(w, countStorageError, "storage error")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return zhttp.Bytes(w, gif)
+	}
+	if hit.Bot != 0 {
+		return botResponse(w, site)
+	}
+	return zhttp.Bytes(w, gif)
+}
+
+// storeHit adds the hit to the memstore, or writes it right away with
+// GlobalConfig.SyncCount. Errors are logged.
+func storeHit(r *http.Request, deps countDeps, hit goatcounter.Hit) error {
+	switch goatcounter.Config(r.Context()).SyncCount {
+	case goatcounter.SyncCountGIF, goatcounter.SyncCountError:
+		err := deps.Persist(r.Context(), hit)
+		if err != nil {
+			zlog.FieldsRequest(r).Error(err)
+		}
+		return err
+	default:
+		deps.Append(hit)
+		return nil
+	}
+}
+
+// countRequest checks the request and creates a hit with everything that's
+// derived from the request rather than the parameters.
+func countRequest(w http.ResponseWriter, r *http.Request, deps countDeps, site *goatcounter.Site, bot isbot.Result) (goatcounter.Hit, isbot.Result, *countRejection) {
+	if min := goatcounter.Config(r.Context()).CountMinTLS; min > 0 {
+		if v, _ := connTLS(r); v < min {
+			return goatcounter.Hit{}, bot, &countRejection{countTLSVersion, http.StatusUpgradeRequired,
+				fmt.Sprintf("TLS version %s is below the minimum of %s", tlsVersionName(v), tls.VersionName(min))}
+		}
+	}
+
+	server, rej := serverClient(r, site)
+	if rej != nil {
+		return goatcounter.Hit{}, bot, rej
+	}
+	if server {
+		bot = isbot.NoBotNoMatch // Detection is based on the browser.
+	}
+
+	if r.UserAgent() == "" && !server {
+		switch goatcounter.Config(r.Context()).EmptyUA {
+		case goatcounter.EmptyUADrop:
+			return goatcounter.Hit{}, bot, &countRejection{countEmptyUA, ignoredStatus(r.Context()),
+				"ignored because the User-Agent is empty"}
+		case goatcounter.EmptyUABot:
+			bot = goatcounter.BotEmptyUA
+		case goatcounter.EmptyUACount:
+			bot = isbot.IPRange(r.RemoteAddr) // Still check the IP.
+		}
+	}
+
+	cip, conflict := clientIP(r)
+	if conflict && goatcounter.Config(r.Context()).ClientIPConflict {
+		w.Header().Add("X-Goatcounter", "ip header conflict")
+	}
+
+	if ip, ok := site.Settings.IgnoredIP(cip); ok {
+		return goatcounter.Hit{}, bot, &countRejection{countIgnoredIP, ignoredStatus(r.Context()),
+			fmt.Sprintf("ignored because %q is in the IP ignore list", ip)}
+	}
+
+	if _, ok := site.Settings.BlockedUA(r.UserAgent()); ok {
+		return goatcounter.Hit{}, bot, &countRejection{countBlockedUA, ignoredStatus(r.Context()), "blocked ua"}
+	}
+	if site.Settings.FlagMonitors {
+		if _, ok := goatcounter.IsMonitor(r.UserAgent()); ok {
+			bot = goatcounter.BotMonitor
+		}
+	}
+
+	var asn goatcounter.ASN
+	if site.Settings.Collect.Has(goatcounter.CollectASN) || (site.Settings.FlagDatacenter && !isbot.Is(bot)) {
+		asn = deps.LookupASN(cip)
+	}
+	if site.Settings.FlagDatacenter && !server && !isbot.Is(bot) && asn.Datacenter() {
+		bot = goatcounter.BotDatacenter
+	}
+
+	if site.Settings.RequireHTTPS && !isHTTPS(r) {
+		return goatcounter.Hit{}, bot, &countRejection{countHTTPSRequired, ignoredStatus(r.Context()), "https required"}
+	}
+
 	hit := goatcounter.Hit{
 		Site:            site.ID,
 		UserAgentHeader: r.UserAgent(),
-		CreatedAt:       ztime.Now(),
+		CreatedAt:       deps.Now(),
 		RemoteAddr:      cip,
+		RefHidden:       !server && refHidden(r),
+		ServerClient:    server,
 	}
-	if site.Settings.Collect.Has(goatcounter.CollectLocation) {
-		var l goatcounter.Location
-		hit.Location = l.LookupIP(r.Context(), cip)
+	if site.Settings.ClientHints && !server && site.Settings.Collect.Has(goatcounter.CollectUserAgent) {
+		// Will only be sent on the next request.
+		w.Header().Set("Accept-CH", goatcounter.AcceptClientHints)
+		hit.ClientHints = goatcounter.ClientHintsFromHeader(r.Header)
 	}
-
-	if site.Settings.Collect.Has(goatcounter.CollectLanguage) {
-		tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
-		if len(tags) > 0 {
-			base, c := tags[0].Base()
-			if c == language.Exact || c == language.High {
-				l := base.ISO3()
-				hit.Language = &l
+	if site.Settings.Collect.Has(goatcounter.CollectTLS) {
+		hit.TLSVersion, hit.TLSCipher = connTLS(r)
+	}
+	if site.Settings.Collect.Has(goatcounter.CollectNavType) {
+		hit.FetchSite = fetchSite(r)
+	}
+	switch {
+	// Still count it, but don't collect anything that's derived from the IP or
+	// can identify the visitor.
+	case !hasConsent(r, site.Settings.ConsentCookie):
+		hit.Anonymous = true
+		hit.RemoteAddr = ""
+	// Need the cleaned referrer to decide, so it's done in the memstore.
+	case site.Settings.CollectExternalOnly:
+		if site.Settings.Collect.Has(goatcounter.CollectLanguage) {
+			hit.AcceptLanguage = r.Header.Get("Accept-Language")
+			hit.CookieLanguage = languageCookie(r, site.Settings.LanguageCookie)
+		}
+	default:
+		if site.Settings.Collect.Has(goatcounter.CollectLocation) {
+			// Look up less under load; see goatcounter.SetGeoDegrade().
+			switch mode, _ := goatcounter.GeoMode(); mode {
+			case goatcounter.GeoModeFull:
+				hit.Location = deps.LookupIP(r.Context(), cip)
+			case goatcounter.GeoModeCountry:
+				hit.Location = deps.LookupCountry(r.Context(), cip)
 			}
 		}
+		if site.Settings.Collect.Has(goatcounter.CollectASN) {
+			hit.ASN, hit.ASNOrg = asn.Number, asn.Org
+		}
+		if site.Settings.Collect.Has(goatcounter.CollectLanguage) {
+			hit.SetLanguage(site.Settings, r.Header.Get("Accept-Language"),
+				languageCookie(r, site.Settings.LanguageCookie))
+		}
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&hit)
+	if d := site.Settings.VisitorCookie; d > 0 && !server && !hit.Anonymous && !site.Settings.EdgeSessions && site.Settings.Collect.Has(goatcounter.CollectSession) {
+		hit.UserSessionID = visitorToken(w, r, d)
+	}
+	return hit, bot, nil
+}
+
+// serverClient reports if the request is from a server-side client with
+// SiteSettings.ServerClients.
+//
+// This needs an API key with the count permission in the Authorization header,
+// or a signature in X-Goatcounter-Signature if the site requires signatures;
+// the signature is verified in countHit(). Requests with an invalid API key are
+// rejected, rather than handled as a browser.
+func serverClient(r *http.Request, site *goatcounter.Site) (bool, *countRejection) {
+	if !site.Settings.ServerClients {
+		return false, nil
+	}
+	if r.Header.Get("Authorization") == "" {
+		return site.Settings.RequireSignature && r.Header.Get("X-Goatcounter-Signature") != "", nil
+	}
+
+	key, err := tokenFromHeader(r, nil)
 	if err != nil {
-		w.Header().Add("X-Goatcounter", fmt.Sprintf("error decoding parameters: %s", err))
-		w.WriteHeader(400)
-		return zhttp.Bytes(w, gif)
+		return false, &countRejection{countBadAuth, http.StatusUnauthorized, err.Error()}
 	}
-	if hit.Bot > 0 && hit.Bot < 150 {
-		w.Header().Add("X-Goatcounter", fmt.Sprintf("wrong value: b=%d", hit.Bot))
-		w.WriteHeader(400)
-		return zhttp.Bytes(w, gif)
+	var token goatcounter.APIToken
+	err = token.ByToken(r.Context(), key)
+	if err != nil {
+		if !zdb.ErrNoRows(err) {
+			zlog.FieldsRequest(r).Error(err)
+		}
+		return false, &countRejection{countBadAuth, http.StatusUnauthorized, "unknown API key"}
 	}
-	if len(hit.Path) > 2048 {
-		w.Header().Add("X-Goatcounter", fmt.Sprintf("ignored because path is longer than 2048 bytes (%d bytes)",
-			len(r.RequestURI)))
-		w.WriteHeader(http.StatusRequestURITooLong)
-		return zhttp.Bytes(w, gif)
+	if !token.Permissions.Has(goatcounter.APIPermCount) {
+		return false, &countRejection{countBadAuth, http.StatusForbidden, "API key doesn't have the count permission"}
+	}
+	return true, nil
+}
+
+// refHidden reports if an empty referrer in the pageview was likely removed by
+// the browser, rather than the visitor opening the page directly.
+//
+// The Referer header for the /count request is the page URL: browsers don't
+// send referrers from HTTPS to HTTP pages, and if browsers that send
+// Sec-Fetch-Site don't send a Referer header at all they're likely configured
+// to never send referrers.
+func refHidden(r *http.Request) bool {
+	ref := r.Header.Get("Referer")
+	if ref == "" {
+		return r.Header.Get("Sec-Fetch-Site") != ""
+	}
+	return strings.HasPrefix(strings.ToLower(ref), "http://")
+}
+
+// countHit checks and finishes a decoded hit; the note explains what was
+// changed, and is also returned if the hit is rejected.
+//
+// sig is the signature from the X-Goatcounter-Signature header, which takes
+// precedence over Hit.Signature.
+func countHit(r *http.Request, deps countDeps, site *goatcounter.Site, hit *goatcounter.Hit, bot isbot.Result, sig string) (string, *countRejection) {
+	note, nonce, rej := checkCountHit(r, deps, site, hit, bot, sig)
+	if rej != nil {
+		return note, rej
+	}
+
+	if nonce != "" {
+		if err := signatureNonces.use(site.ID, nonce, deps.Now()); err != nil {
+			return note, &countRejection{countReplay, http.StatusForbidden, err.Error()}
+		}
+	}
+
+	if hit.RequestID != "" && requestIDs.seen(site.ID, hit.RequestID, hit.Path, deps.Now()) {
+		return note, &countRejection{countDuplicate, ignoredStatus(r.Context()), "duplicate request ID; not stored"}
+	}
+
+	if site.Settings.InTestMode() {
+		hit, reason := goatcounter.Memstore.Preview(r.Context(), *hit)
+		testModeLog.add(site.ID, testLogEntry{Hit: hit, Reason: reason, Note: note})
+		return note, &countRejection{countTestMode, ignoredStatus(r.Context()), "test mode; not stored"}
+	}
+
+	hit.SampleWeight = pathSamples.weight(site, *hit, deps.Now())
+	if hit.SampleWeight == 0 {
+		return note, &countRejection{countSampled, ignoredStatus(r.Context()), "sampled; not stored"}
+	}
+	return note, nil
+}
+
+// checkCountHit is the part of countHit() that doesn't keep any state, so it
+// can also be used for /count/normalize. The signature nonce is returned
+// rather than used.
+func checkCountHit(r *http.Request, deps countDeps, site *goatcounter.Site, hit *goatcounter.Hit, bot isbot.Result, sig string) (note, nonce string, rej *countRejection) {
+	origPath := hit.Path // checkHit() may truncate it.
+	note = canonicalPath(r, site, hit)
+	n, rej := checkHit(r.Context(), site, hit)
+	if n != "" && note != "" {
+		note += "; " + n
+	} else if n != "" {
+		note = n
+	}
+	if rej != nil {
+		return note, "", rej
+	}
+
+	if h := site.Settings.RequireHeader; h != "" && !hit.ServerClient &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get(h)), []byte(site.Settings.RequireHeaderValue)) != 1 {
+		return note, "", &countRejection{countMissingHeader, http.StatusForbidden, "missing required header"}
+	}
+
+	if site.Settings.RequireSignature {
+		if sig == "" {
+			sig = hit.Signature
+		}
+		err := goatcounter.VerifyPathSignature(site.Settings.SignatureSecret, origPath, sig, deps.Now())
+		nonce = goatcounter.SignatureNonce(sig)
+		if err == nil && nonce == "" && site.Settings.RequireNonce {
+			err = errors.New("no nonce")
+		}
+		if err != nil {
+			return note, "", &countRejection{countBadSignature, http.StatusForbidden, "bad signature"}
+		}
+	}
+
+	if site.Settings.EdgeSessions && !hit.ServerClient {
+		session, ok := edgeSession(r, site.Settings.EdgeSessionSecret)
+		if !ok {
+			return note, "", &countRejection{countBadSession, http.StatusForbidden, "bad session token"}
+		}
+		// Prefix so it can't clash with tokens from the visitor cookie.
+		hit.UserSessionID = "edge:" + session
 	}
 
 	if isbot.Is(bot) { // Prefer the backend detection.
 		hit.Bot = int(bot)
 	}
 
-	err = hit.Validate(r.Context(), true)
+	if rej := finishHit(r.Context(), hit); rej != nil {
+		return note, "", rej
+	}
+	return note, nonce, nil
+}
+
+// Limits for /count/stream.
+const (
+	maxStreamBody = 1 << 20         // Maximum size of the body, in bytes.
+	maxStreamHits = 500             // Maximum number of pageviews.
+	streamIdle    = 5 * time.Minute // Maximum time between two pageviews.
+)
+
+// countStream records every line of a newline-delimited JSON body as a
+// pageview as soon as it's received, so a single request can be kept open for
+// an entire session.
+//
+// The response is sent once the body is closed, and lists the lines that
+// weren't recorded.
+func (h backend) countStream(w http.ResponseWriter, r *http.Request) error {
+	deps := h.deps
+	if deps == nil {
+		deps = globalCountDeps{}
+	}
+
+	m := metrics.Start("/count/stream")
+	defer m.Done()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+
+	if goatcounter.Maintenance() {
+		countReason(w, countMaintenance, "maintenance")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return nil
+	}
+
+	site := Site(r.Context())
+	w = newDebugHeaders(w, r, site)
+	bot := deps.Bot(r)
+	if bot == isbot.BotPrefetch {
+		countReason(w, countPrefetch, "ignored because it's a prefetch request")
+		w.WriteHeader(ignoredStatus(r.Context()))
+		return nil
+	}
+	base, bot, rej := countRequest(w, r, deps, site, bot)
+	if rej != nil {
+		countReason(w, rej.code, rej.msg)
+		w.WriteHeader(rej.status)
+		return nil
+	}
+
+	var (
+		rc     = http.NewResponseController(w)
+		scan   = bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxStreamBody))
+		res    countStreamResult
+		n      int
+		status = 200
+	)
+	scan.Buffer(make([]byte, 0, 4096), maxStreamBody)
+	for line := 1; ; line++ {
+		// The server's timeouts are for the entire request; errors are
+		// ignored as not every ResponseWriter supports this.
+		_ = rc.SetReadDeadline(time.Now().Add(streamIdle))
+		_ = rc.SetWriteDeadline(time.Now().Add(streamIdle))
+		// The scanner returns the partial last line on errors.
+		if !scan.Scan() || scan.Err() != nil {
+			break
+		}
+		l := bytes.TrimSpace(scan.Bytes())
+		if len(l) == 0 {
+			continue
+		}
+		if n++; n > maxStreamHits {
+			res.reject(line, countStreamLimit, fmt.Sprintf("more than %d pageviews", maxStreamHits))
+			break
+		}
+
+		hit := base
+		hit.CreatedAt = deps.Now()
+		err := json.Unmarshal(l, &hit)
+		if err != nil {
+			decodeErrors.log(site.ID, err)
+			res.reject(line, countDecodeError, fmt.Sprintf("error decoding parameters: %s", err))
+			continue
+		}
+		_, rej := countHit(r, deps, site, &hit, bot, "")
+		if t := truncation(site, hit); t != nil {
+			t.Line = line
+			res.Truncated = append(res.Truncated, *t)
+		}
+		if rej != nil {
+			res.reject(line, rej.code, rej.msg)
+			continue
+		}
+		if err := storeHit(r, deps, hit); err != nil {
+			res.reject(line, countStorageError, "storage error")
+			// Don't bother with the rest if the database is down.
+			if goatcounter.Config(r.Context()).SyncCount == goatcounter.SyncCountError {
+				status = http.StatusServiceUnavailable
+				break
+			}
+			continue
+		}
+		res.Recorded++
+	}
+	if err := scan.Err(); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			res.reject(0, countStreamLimit, fmt.Sprintf("body is larger than %d bytes", maxStreamBody))
+		} else {
+			res.reject(0, countDecodeError, fmt.Sprintf("error reading body: %s", err))
+		}
+	}
+	return countJSON(w, r, status, res)
+}
+
+// countJSON writes the JSON for the /count endpoints with the status code,
+// compressed with gzip if the client accepts it and it's at least
+// GlobalConfig.CountCompressMin bytes.
+func countJSON(w http.ResponseWriter, r *http.Request, status int, v any) error {
+	var (
+		buf bytes.Buffer
+		enc = json.NewEncoder(&buf)
+	)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
 	if err != nil {
-		w.Header().Add("X-Goatcounter", fmt.Sprintf("not valid: %s", err))
-		w.WriteHeader(400)
-		return zhttp.Bytes(w, gif)
+		return err
 	}
 
-	goatcounter.Memstore.Append(hit)
-	return zhttp.Bytes(w, gif)
+	w.Header().Add("Vary", "Accept-Encoding")
+	minSize := goatcounter.Config(r.Context()).CountCompressMin
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if minSize < 0 || buf.Len() < minSize || !acceptsGzip(r) {
+		w.WriteHeader(status)
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	gz := gzip.NewWriter(w)
+	_, err = gz.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return gz.Close()
 }
 
-// Extract client IP in case of goatcounter sitting on top of one or more proxies
-// https://gist.github.com/17twenty/c815680c9c585cd9c16e62cbee7317b6
-func extractClientIP(r *http.Request) string {
-	ffips := r.Header.Get(forwardedForHeader)
-	rip := r.RemoteAddr
+// acceptsGzip reports if the Accept-Encoding header allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(e, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		n, err := strconv.ParseFloat(q, 64)
+		return err == nil && n > 0
+	}
+	return false
+}
 
-	if ffips == "" {
-		return rip
+// refererPage gets the page from the Referer header, for
+// SiteSettings.PathFromReferer. It must be for the site's LinkDomain or the
+// host the request was sent to.
+func refererPage(r *http.Request, site *goatcounter.Site) (*url.URL, error) {
+	ref := r.Header.Get("Referer")
+	if ref == "" {
+		return nil, errors.New("no Referer header")
+	}
+	u, err := url.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Referer header %q", ref)
+	}
+	if !strings.EqualFold(u.Hostname(), znet.RemovePort(r.Host)) && !site.IsOwnHost(u.Hostname()) {
+		return nil, fmt.Errorf("host %q in the Referer isn't for this site", u.Host)
+	}
+	return u, nil
+}
+
+// canonicalPath sets the path to Hit.Canonical, for
+// SiteSettings.CanonicalPaths. It must be a path or an URL for the LinkDomain or
+// the host in the Referer, and at most MaxPathLen bytes; the path is kept
+// otherwise. The note explains what was changed.
+func canonicalPath(r *http.Request, site *goatcounter.Site, hit *goatcounter.Hit) string {
+	c := hit.Canonical
+	hit.Canonical = ""
+	switch {
+	case c == "":
+		return ""
+	case !site.Settings.CanonicalPaths:
+		return "canonical ignored as it's not enabled for this site"
+	case hit.Event.Bool():
+		return "canonical ignored for events"
+	case len(c) > goatcounter.MaxPathLen:
+		return fmt.Sprintf("canonical longer than %d bytes; ignored", goatcounter.MaxPathLen)
+	}
+
+	u, err := url.Parse(c)
+	if err != nil || u.Opaque != "" || (u.Scheme == "" && u.Host == "" && !strings.HasPrefix(u.Path, "/")) {
+		return fmt.Sprintf("invalid canonical %q; ignored", truncateRunes(c, 50))
+	}
+	if u.Scheme != "" || u.Host != "" {
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Sprintf("invalid canonical %q; ignored", truncateRunes(c, 50))
+		}
+		own := site.IsOwnHost(u.Hostname())
+		if ref, err := url.Parse(r.Header.Get("Referer")); !own && err == nil {
+			own = ref.Host != "" && strings.EqualFold(ref.Hostname(), u.Hostname())
+		}
+		if !own {
+			return fmt.Sprintf("host %q in the canonical isn't for this site; ignored", truncateRunes(u.Host, 50))
+		}
+	}
+
+	hit.Path = u.Path
+	if hit.Path == "" {
+		hit.Path = "/"
+	}
+	return "path from canonical"
+}
+
+// countStreamResult is the response for /count/stream.
+type countStreamResult struct {
+	Recorded  int                 `json:"recorded"`            // Number of recorded pageviews.
+	Rejected  []countStreamReject `json:"rejected,omitempty"`  // Lines that weren't recorded.
+	Truncated []countTruncation   `json:"truncated,omitempty"` // Lines with a truncated path; see SiteSettings.ReportTruncation.
+}
+
+// countStreamReject is a line from /count/stream that wasn't recorded.
+type countStreamReject struct {
+	Line   int    `json:"line,omitempty"` // Line number, starting at 1; 0 if it's not for a line.
+	Code   string `json:"code"`           // As in X-Goatcounter-Code.
+	Reason string `json:"reason"`         // As in X-Goatcounter.
+}
+
+func (r *countStreamResult) reject(line int, code, reason string) {
+	r.Rejected = append(r.Rejected, countStreamReject{Line: line, Code: code, Reason: reason})
+}
+
+// Maximum size of the body for /count/error, in bytes.
+const maxErrorBody = 16 << 10
+
+// countError records a JavaScript error, as sent by window.onerror.
+//
+// The body is a JSON object with the message, source, line, and col; errors
+// from bots and prefetch requests are ignored.
+func (h backend) countError(w http.ResponseWriter, r *http.Request) error {
+	deps := h.deps
+	if deps == nil {
+		deps = globalCountDeps{}
+	}
+
+	m := metrics.Start("/count/error")
+	defer m.Done()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+
+	if goatcounter.Maintenance() {
+		countReason(w, countMaintenance, "maintenance")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return nil
+	}
+
+	site := Site(r.Context())
+	w = newDebugHeaders(w, r, site)
+	bot := deps.Bot(r)
+	if bot == isbot.BotPrefetch {
+		countReason(w, countPrefetch, "ignored because it's a prefetch request")
+		w.WriteHeader(ignoredStatus(r.Context()))
+		return nil
+	}
+	_, bot, rej := countRequest(w, r, deps, site, bot)
+	if rej != nil {
+		countReason(w, rej.code, rej.msg)
+		w.WriteHeader(rej.status)
+		return nil
+	}
+	if isbot.Is(bot) {
+		countReason(w, countBot, "ignored because it's a bot")
+		w.WriteHeader(ignoredStatus(r.Context()))
+		return nil
+	}
+
+	var jsErr goatcounter.JSError
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxErrorBody)).Decode(&jsErr)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			countReason(w, countErrorTooLarge, "body is larger than %d bytes", maxErrorBody)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		countReason(w, countDecodeError, "error decoding body: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
 	}
 
-	rip = ffips
-	ips := strings.Split(rip, ", ")
-	if len(ips) > 1 {
-		rip = ips[0]
+	jsErr.Site = site.ID
+	jsErr.UserAgentHeader = r.UserAgent()
+	jsErr.CreatedAt = deps.Now()
+	err = jsErr.Defaults(r.Context())
+	if err != nil {
+		return err
+	}
+	err = jsErr.Validate(r.Context())
+	if err != nil {
+		countReason(w, countInvalid, "not valid: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	err = jsErr.Insert(r.Context())
+	if err != nil {
+		return err
 	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// botResponse sends the response for requests from bots, which is a 204
+// without the GIF if SiteSettings.BotNoContent is set.
+func botResponse(w http.ResponseWriter, site *goatcounter.Site) error {
+	if !site.Settings.BotNoContent {
+		return zhttp.Bytes(w, gif)
+	}
+	w.Header().Del("Content-Type")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// countRejection is why a pageview sent to /count isn't recorded.
+type countRejection struct {
+	code   string
+	status int
+	msg    string
+}
+
+func (c countRejection) write(w http.ResponseWriter) error {
+	countReason(w, c.code, c.msg)
+	w.WriteHeader(c.status)
+	return zhttp.Bytes(w, gif)
+}
+
+// checkHit checks the hit right after decoding it.
+//
+// Unknown types are rejected or recorded as pageviews depending on
+// SiteSettings.RejectUnknownTypes, out of range TZOffsets and load times are
+// ignored, Authed is ignored unless SiteSettings.RecordAuth is set, load times
+// and the connection type are ignored unless CollectPerf and CollectConnection
+// are set, unknown connection types are ignored, the size bucket is ignored
+// unless CollectSizeBucket is set or if it's unknown, webdriver is rejected or
+// flagged as BotWebdriver depending on SiteSettings.Webdriver, pageviews with a
+// DwellMs below SiteSettings.MinDwellMs are rejected, EventValue is ignored
+// unless SiteSettings.CollectEventValue is set and out of range values or
+// values on pageviews are rejected, paths matching the DenyPathRegexps are
+// rejected or flagged as BotScanner, and paths longer than MaxPathLen are
+// handled depending on SiteSettings.LongPaths; the note explains what was
+// changed.
+//
+// The path is normalized later, in Hit.Defaults().
+func checkHit(ctx context.Context, site *goatcounter.Site, hit *goatcounter.Hit) (note string, rej *countRejection) {
+	if hit.Bot > 0 && hit.Bot < 150 && !site.Settings.ClientBots.Has(hit.Bot) {
+		return "", &countRejection{countInvalidBot, 400, fmt.Sprintf("wrong value: b=%d", hit.Bot)}
+	}
+
+	if hit.Webdriver.Bool() {
+		switch site.Settings.Webdriver {
+		case goatcounter.WebdriverDrop:
+			return "", &countRejection{countWebdriver, ignoredStatus(ctx), "browser is controlled by automation"}
+		case goatcounter.WebdriverBot:
+			if hit.Bot == 0 {
+				hit.Bot = goatcounter.BotWebdriver
+			}
+		}
+	}
+
+	var notes []string
+	if hit.Path == "" && !hit.Event.Bool() && site.Settings.DefaultPath != "" {
+		hit.Path = site.Settings.DefaultPath
+		notes = append(notes, fmt.Sprintf("no path; recorded as %q", hit.Path))
+	}
+	switch {
+	case hit.Type == "":
+		hit.Type = goatcounter.HitTypePageview
+	case !slices.Contains(goatcounter.HitTypes, hit.Type):
+		if site.Settings.RejectUnknownTypes {
+			return "", &countRejection{countInvalidType, 400, fmt.Sprintf("unknown type: %q", hit.Type)}
+		}
+		notes = append(notes, fmt.Sprintf("unknown type %q recorded as %s", hit.Type, goatcounter.HitTypePageview))
+		hit.Type = goatcounter.HitTypePageview
+	}
+
+	if o := hit.TZOffset; o != nil && (*o < -goatcounter.MaxTZOffset || *o > goatcounter.MaxTZOffset) {
+		notes = append(notes, fmt.Sprintf("tz_offset %d out of range; ignored", *o))
+		hit.TZOffset = nil
+	}
+
+	if d := hit.DwellMs; d != nil && (*d < 0 || *d > goatcounter.MaxDwell) {
+		notes = append(notes, fmt.Sprintf("dwell_ms %d out of range; ignored", *d))
+		hit.DwellMs = nil
+	}
+	if site.Settings.MinDwellMs > 0 && !hit.Event.Bool() {
+		switch {
+		case hit.DwellMs == nil && site.Settings.RequireDwell && !hit.ServerClient:
+			return "", &countRejection{countShortDwell, ignoredStatus(ctx), "no dwell_ms"}
+		case hit.DwellMs != nil && *hit.DwellMs < site.Settings.MinDwellMs:
+			return "", &countRejection{countShortDwell, ignoredStatus(ctx),
+				fmt.Sprintf("dwell_ms %d is below the minimum of %d", *hit.DwellMs, site.Settings.MinDwellMs)}
+		}
+	}
+
+	if v := hit.EventValue; v != nil {
+		switch {
+		case !site.Settings.CollectEventValue:
+			notes = append(notes, "value ignored as it's not collected for this site")
+			hit.EventValue = nil
+		case !hit.Event.Bool():
+			return "", &countRejection{countInvalidValue, 400, "value can only be set for events"}
+		case math.IsNaN(*v) || *v < -goatcounter.MaxEventValue || *v > goatcounter.MaxEventValue:
+			return "", &countRejection{countInvalidValue, 400, fmt.Sprintf("value %g out of range", *v)}
+		}
+	}
+
+	if hit.PerfTTFB != nil || hit.PerfDCL != nil || hit.PerfLoad != nil {
+		if site.Settings.Collect.Has(goatcounter.CollectPerf) {
+			for _, p := range []struct {
+				name string
+				v    **int
+			}{{"ttfb", &hit.PerfTTFB}, {"dcl", &hit.PerfDCL}, {"load", &hit.PerfLoad}} {
+				if *p.v != nil && (**p.v < 0 || **p.v > goatcounter.MaxPerf) {
+					notes = append(notes, fmt.Sprintf("%s %d out of range; ignored", p.name, **p.v))
+					*p.v = nil
+				}
+			}
+		} else {
+			notes = append(notes, "load times ignored as they're not collected for this site")
+			hit.PerfTTFB, hit.PerfDCL, hit.PerfLoad = nil, nil, nil
+		}
+	}
+
+	if hit.Conn != "" {
+		switch {
+		case !site.Settings.Collect.Has(goatcounter.CollectConnection):
+			notes = append(notes, "conn ignored as it's not collected for this site")
+			hit.Conn = ""
+		case !slices.Contains(goatcounter.ConnTypes, hit.Conn):
+			notes = append(notes, fmt.Sprintf("unknown conn %q; ignored", truncateRunes(hit.Conn, 20)))
+			hit.Conn = ""
+		}
+	}
+
+	if hit.SizeBucket != "" {
+		switch {
+		case !site.Settings.Collect.Has(goatcounter.CollectSizeBucket):
+			notes = append(notes, "size_bucket ignored as it's not collected for this site")
+			hit.SizeBucket = ""
+		case !slices.Contains(goatcounter.SizeBuckets, hit.SizeBucket):
+			notes = append(notes, fmt.Sprintf("unknown size_bucket %q; ignored", truncateRunes(hit.SizeBucket, 20)))
+			hit.SizeBucket = ""
+		}
+	}
+
+	if hit.Platform != "" && !slices.Contains(goatcounter.Platforms, hit.Platform) {
+		notes = append(notes, fmt.Sprintf("unknown platform %q; ignored", truncateRunes(hit.Platform, 20)))
+		hit.Platform = ""
+	}
+
+	if len(hit.RequestID) > maxRequestID {
+		notes = append(notes, fmt.Sprintf("rid longer than %d bytes; ignored", maxRequestID))
+		hit.RequestID = ""
+	}
+
+	if hit.Authed != nil && !site.Settings.RecordAuth {
+		notes = append(notes, "auth ignored as it's not enabled for this site")
+		hit.Authed = nil
+	}
+
+	if !hit.Event.Bool() {
+		if _, ok := site.Settings.DeniedPath(hit.Path); ok {
+			if !site.Settings.DenyPathsBot {
+				return "", &countRejection{countDeniedPath, ignoredStatus(ctx), "denied path"}
+			}
+			notes = append(notes, "denied path; recorded as bot")
+			hit.Bot = goatcounter.BotScanner
+		}
+	}
+
+	if l := len(hit.Path); l > goatcounter.MaxPathLen {
+		switch site.Settings.LongPaths {
+		case goatcounter.LongPathsTruncate:
+			hit.Path, hit.TruncatedFrom = truncateRunes(hit.Path, goatcounter.MaxPathLen), l
+			notes = append(notes, fmt.Sprintf("path truncated to %d bytes (%d bytes)", len(hit.Path), l))
+		case goatcounter.LongPathsBucket:
+			hit.Path = goatcounter.LongPathBucket
+			notes = append(notes, fmt.Sprintf("path is longer than %d bytes (%d bytes); recorded as %s",
+				goatcounter.MaxPathLen, l, goatcounter.LongPathBucket))
+		default:
+			return "", &countRejection{countPathTooLong, http.StatusRequestURITooLong,
+				fmt.Sprintf("ignored because path is longer than %d bytes (%d bytes)", goatcounter.MaxPathLen, l)}
+		}
+	}
+	return strings.Join(notes, "; "), nil
+}
+
+// countTruncation is the length of a truncated path, for
+// SiteSettings.ReportTruncation.
+type countTruncation struct {
+	Line      int `json:"line,omitempty"`   // Line number for /count/stream.
+	Length    int `json:"length"`           // Length of the path that was sent, in bytes.
+	Truncated int `json:"truncated_length"` // Length of the stored path, in bytes.
+}
+
+// truncation gets the length of the path if it was truncated and the site has
+// ReportTruncation set, or nil otherwise.
+func truncation(site *goatcounter.Site, hit goatcounter.Hit) *countTruncation {
+	if !site.Settings.ReportTruncation || hit.TruncatedFrom == 0 {
+		return nil
+	}
+	return &countTruncation{Length: hit.TruncatedFrom, Truncated: len(hit.Path)}
+}
+
+// truncateRunes truncates s to at most n bytes, without cutting a UTF-8
+// sequence in half.
+func truncateRunes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// finishHit runs the HitHooks and validates the hit before it's added to the
+// memstore.
+func finishHit(ctx context.Context, hit *goatcounter.Hit) *countRejection {
+	// Run before validation, as hooks may modify the hit.
+	err := goatcounter.RunHitHooks(ctx, hit)
+	if err != nil {
+		return &countRejection{countDropped, ignoredStatus(ctx), fmt.Sprintf("dropped by %s", err)}
+	}
+
+	err = hit.Validate(ctx, true)
+	if err != nil {
+		return &countRejection{countInvalid, 400, fmt.Sprintf("not valid: %s", err)}
+	}
+	return nil
+}
+
+// countNormalize shows what would be stored for a pageview, without storing
+// it. It accepts the same parameters as /count, and goes through the same
+// checks up to the point where the pageview is added to the memstore.
+func (h backend) countNormalize(w http.ResponseWriter, r *http.Request) error {
+	deps := h.deps
+	if deps == nil {
+		deps = globalCountDeps{}
+	}
+
+	site := Site(r.Context())
+	bot := deps.Bot(r)
+	if bot == isbot.BotPrefetch {
+		return countJSON(w, r, 200, countPreview{Code: countPrefetch, Reason: "ignored because it's a prefetch request"})
+	}
+	hit, bot, rej := countRequest(w, r, deps, site, bot)
+	if rej != nil {
+		return countJSON(w, r, 200, countPreview{Code: rej.code, Reason: rej.msg})
+	}
+
+	err := decodeCountHit(r, site, r.Body, &hit)
+	if err != nil {
+		return countJSON(w, r, 400, countPreview{Code: countDecodeError, Reason: fmt.Sprintf("error decoding parameters: %s", err)})
+	}
+
+	note, _, rej := checkCountHit(r, deps, site, &hit, bot, r.Header.Get("X-Goatcounter-Signature"))
+	if rej != nil {
+		return countJSON(w, r, 200, countPreview{Path: hit.Path, Event: bool(hit.Event), Code: rej.code, Reason: rej.msg})
+	}
+
+	hit, reason := goatcounter.Memstore.Preview(r.Context(), hit)
+	p := countPreview{
+		Path:      hit.Path,
+		Event:     bool(hit.Event),
+		Ref:       hit.Ref,
+		PrevPath:  hit.PrevPath,
+		Recorded:  reason == "",
+		Reason:    reason,
+		Note:      note,
+		Truncated: truncation(site, hit),
+	}
+	if hit.RefScheme != nil {
+		p.RefScheme = *hit.RefScheme
+	}
+	if !p.Recorded {
+		p.Code = countNotStored
+	}
+	return countJSON(w, r, 200, p)
+}
+
+// countPreview is the response for /count/normalize.
+type countPreview struct {
+	Path      string `json:"path"`                 // Path as it would be stored.
+	Event     bool   `json:"event"`                // Stored as an event.
+	Ref       string `json:"ref,omitempty"`        // Referrer or campaign.
+	RefScheme string `json:"ref_scheme,omitempty"` // h (HTTP), g (generated), c (campaign), o (other).
+	PrevPath  string `json:"prev_path,omitempty"`  // For internal navigation; see SiteSettings.InternalNavigation.
+	Recorded  bool   `json:"recorded"`             // Would be recorded.
+	Code      string `json:"code,omitempty"`       // X-Goatcounter-Code, or "not_stored" if it's rejected later.
+	Reason    string `json:"reason,omitempty"`     // Why it wouldn't be recorded.
+	Note      string `json:"note,omitempty"`       // Changes to the path, as in the X-Goatcounter header.
+
+	Truncated *countTruncation `json:"truncated,omitempty"` // See SiteSettings.ReportTruncation.
+}
+
+// isForm reports if the request body is form-encoded.
+func isForm(r *http.Request) bool {
+	ct, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	return r.Method == "POST" && strings.EqualFold(strings.TrimSpace(ct), "application/x-www-form-urlencoded")
+}
+
+// countBodyOptional reports if the body for /count can be empty, because the
+// hit is in the query or path, or the path can be taken from the Referer or
+// DefaultPath.
+func countBodyOptional(r *http.Request, site *goatcounter.Site) bool {
+	return r.URL.RawQuery != "" || chi.URLParam(r, "hit") != "" ||
+		site.Settings.PathFromReferer || site.Settings.DefaultPath != ""
+}
+
+// decodeCountHit decodes the hit for /count from the query parameters and the
+// body (JSON or a form), or both.
+//
+// If both are sent then the fields that are in both are used from the one in
+// SiteSettings.CountPrecedence, and the others from either one; this way
+// clients can move from one to the other gradually.
+func decodeCountHit(r *http.Request, site *goatcounter.Site, body io.Reader, hit *goatcounter.Hit) error {
+	var (
+		query = r.URL.Query()
+		fromQ = func() error {
+			if len(query) == 0 {
+				return nil
+			}
+			return decodeValuesHit(query, hit)
+		}
+		fromB = func() error {
+			if isForm(r) && chi.URLParam(r, "hit") == "" {
+				return decodeFormHit(r, hit)
+			}
+			err := json.NewDecoder(body).Decode(hit)
+			if errors.Is(err, io.EOF) && countBodyOptional(r, site) {
+				return nil // Empty body; use the query, or get the path from the Referer or DefaultPath.
+			}
+			return err
+		}
+	)
+
+	// The one that takes precedence is decoded last, so it overwrites the
+	// fields that are in both.
+	first, last := fromQ, fromB
+	if site.Settings.CountPrecedence == goatcounter.CountPrecedenceQuery {
+		first, last = fromB, fromQ
+	}
+	if err := first(); err != nil {
+		return err
+	}
+	return last()
+}
+
+// decodeFormHit decodes a form-encoded hit, for clients that can't send JSON.
+// The field names are the same as the JSON ones.
+func decodeFormHit(r *http.Request, hit *goatcounter.Hit) error {
+	err := r.ParseForm()
+	if err != nil {
+		return err
+	}
+	return decodeValuesHit(r.PostForm, hit)
+}
+
+// decodeValuesHit decodes a hit from a form or query parameters. Only the
+// fields that are in f are set.
+func decodeValuesHit(f url.Values, hit *goatcounter.Hit) error {
+	for _, p := range []struct {
+		name string
+		v    *string
+	}{
+		{"p", &hit.Path}, {"t", &hit.Title}, {"r", &hit.Ref}, {"q", &hit.Query}, {"rnd", &hit.Random},
+		{"sig", &hit.Signature}, {"type", &hit.Type}, {"conn", &hit.Conn}, {"rid", &hit.RequestID},
+		{"platform", &hit.Platform}, {"canonical", &hit.Canonical}, {"ref_source", &hit.RefSource},
+		{"size_bucket", &hit.SizeBucket},
+	} {
+		if f.Has(p.name) {
+			*p.v = f.Get(p.name)
+		}
+	}
+	if e := f.Get("e"); e != "" {
+		err := hit.Event.UnmarshalText([]byte(e))
+		if err != nil {
+			return fmt.Errorf("e: %w", err)
+		}
+	}
+	if s := f.Get("s"); s != "" {
+		err := hit.Size.UnmarshalText([]byte(s))
+		if err != nil {
+			return fmt.Errorf("s: %w", err)
+		}
+	}
+	if w := f.Get("webdriver"); w != "" {
+		err := hit.Webdriver.UnmarshalText([]byte(w))
+		if err != nil {
+			return fmt.Errorf("webdriver: %w", err)
+		}
+	}
+	if a := f.Get("auth"); a != "" {
+		hit.Authed = new(zbool.Bool)
+		err := hit.Authed.UnmarshalText([]byte(a))
+		if err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	if o := f.Get("tz_offset"); o != "" {
+		n, err := strconv.Atoi(o)
+		if err != nil {
+			return fmt.Errorf("tz_offset: %w", err)
+		}
+		hit.TZOffset = &n
+	}
+	for _, p := range []struct {
+		name string
+		v    **int
+	}{{"ttfb", &hit.PerfTTFB}, {"dcl", &hit.PerfDCL}, {"load", &hit.PerfLoad}, {"dwell_ms", &hit.DwellMs}} {
+		if v := f.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", p.name, err)
+			}
+			*p.v = &n
+		}
+	}
+	if v := f.Get("value"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("value: %w", err)
+		}
+		hit.EventValue = &n
+	}
+	if b := f.Get("b"); b != "" {
+		var err error
+		hit.Bot, err = strconv.Atoi(b)
+		if err != nil {
+			return fmt.Errorf("b: %w", err)
+		}
+	}
+	return nil
+}
+
+// fetchSite gets the Sec-Fetch-Site header if the request is a navigation.
+//
+// This is only the case for server-side clients that pass on the headers of the
+// page request; browsers send the header for the /count request itself, which
+// says nothing about how the visitor got to the page.
+func fetchSite(r *http.Request) string {
+	if r.Header.Get("Sec-Fetch-Mode") != "navigate" {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(r.Header.Get("Sec-Fetch-Site")))
+}
+
+// hasConsent reports if the visitor consented to data collection; this is
+// always true if the site doesn't have a consent cookie configured.
+func hasConsent(r *http.Request, c goatcounter.ConsentCookie) bool {
+	if !c.Enabled() {
+		return true
+	}
+	cookie, err := r.Cookie(c.Name)
+	if err != nil {
+		return false
+	}
+	return c.Accepted(cookie.Value)
+}
+
+// languageCookie gets the value of the cookie with the language the visitor
+// chose, or "" if there is no such cookie.
+func languageCookie(r *http.Request, name string) string {
+	if name == "" {
+		return ""
+	}
+	c, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// visitorCookie is the name of the cookie with the visitor token.
+const visitorCookie = "goatcounter_visitor"
+
+// visitorToken gets the visitor token from the cookie, or generates a new one
+// and sets the cookie to expire after days if there isn't a valid one.
+//
+// This is SameSite=None, as /count is usually a cross-site request from the
+// site's pages; browsers only accept that with Secure.
+//
+// The token is used as Hit.UserSessionID, so it identifies the visitor only as
+// long as the session is in the memstore: sessions not seen for
+// SessionTimeout (4 hours) are evicted, after which the same token starts a new
+// session and is counted as a new visit.
+func visitorToken(w http.ResponseWriter, r *http.Request, days int) string {
+	if c, err := r.Cookie(visitorCookie); err == nil && validVisitorToken(c.Value) {
+		return c.Value
+	}
+
+	t := zcrypto.Secret128()
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookie,
+		Value:    t,
+		Path:     "/",
+		MaxAge:   days * 86400,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	return t
+}
+
+// validVisitorToken reports if this looks like a token from visitorToken();
+// anything else is replaced, so arbitrary values can't be used as the session.
+func validVisitorToken(t string) bool {
+	if len(t) < 16 || len(t) > 32 {
+		return false
+	}
+	for _, c := range t {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// ignoredStatus gets the status code for pageviews we deliberately don't
+// record.
+func ignoredStatus(ctx context.Context) int {
+	if s := goatcounter.Config(ctx).IgnoredStatus; s != 0 {
+		return s
+	}
+	return http.StatusAccepted
+}
+
+// keyPeer is the RemoteAddr before it's replaced by mware.RealIP().
+var keyPeer = &struct{ n string }{""}
+
+// keepPeer stores the address of the connection in the context, so it's still
+// available after mware.RealIP().
+func keepPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keyPeer, r.RemoteAddr)))
+	})
+}
+
+// trustedPeer reports if the connection is from one of the ClientIPProxies.
+func trustedPeer(r *http.Request, proxies []netip.Prefix) bool {
+	if len(proxies) == 0 {
+		return true
+	}
+	peer, _ := r.Context().Value(keyPeer).(string)
+	a, err := netip.ParseAddr(znet.RemovePort(peer))
+	if err != nil {
+		return false
+	}
+	a = a.Unmap()
+	for _, p := range proxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// edgeSession gets the session from the X-Goatcounter-Session header, which is
+// only trusted from the ClientIPProxies.
+func edgeSession(r *http.Request, secret string) (string, bool) {
+	token := r.Header.Get("X-Goatcounter-Session")
+	if token == "" || !trustedPeer(r, goatcounter.Config(r.Context()).ClientIPProxies) {
+		return "", false
+	}
+	session, err := goatcounter.VerifySessionToken(secret, token)
+	return session, err == nil
+}
+
+// isHTTPS reports if the request was sent over HTTPS, either directly or to a
+// proxy that sets X-Forwarded-Proto. The header is only trusted from the
+// ClientIPProxies.
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" || !trustedPeer(r, goatcounter.Config(r.Context()).ClientIPProxies) {
+		return false
+	}
+	// Multiple proxies may append their own value; the first is the one the
+	// client connected to.
+	proto, _, _ = strings.Cut(proto, ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// connTLS gets the TLS version and cipher suite of the connection, or from the
+// TLSHeader if TLS is terminated at one of the ClientIPProxies. Values that
+// aren't known are 0.
+func connTLS(r *http.Request) (version, cipher uint16) {
+	if r.TLS != nil {
+		return r.TLS.Version, r.TLS.CipherSuite
+	}
+	c := goatcounter.Config(r.Context())
+	if c.TLSHeader == "" || !trustedPeer(r, c.ClientIPProxies) {
+		return 0, 0
+	}
+	v, ciph, _ := strings.Cut(strings.TrimSpace(r.Header.Get(c.TLSHeader)), " ")
+	return parseTLSVersion(v), parseTLSCipher(strings.TrimSpace(ciph))
+}
+
+// parseTLSVersion parses a TLS version as "TLSv1.3" (nginx, HAProxy), "tls1.3"
+// (Caddy), or a number such as "0x0304".
+func parseTLSVersion(s string) uint16 {
+	if n, err := strconv.ParseUint(s, 0, 16); err == nil {
+		return uint16(n)
+	}
+	switch strings.Replace(strings.ToLower(s), "v", "", 1) {
+	case "tls1", "tls1.0":
+		return tls.VersionTLS10
+	case "tls1.1":
+		return tls.VersionTLS11
+	case "tls1.2":
+		return tls.VersionTLS12
+	case "tls1.3":
+		return tls.VersionTLS13
+	}
+	return 0
+}
+
+// tlsVersionName gets the name of the TLS version, or "unknown" if it's 0.
+func tlsVersionName(v uint16) string {
+	if v == 0 {
+		return "unknown"
+	}
+	return tls.VersionName(v)
+}
+
+// parseTLSCipher parses a cipher suite as the IANA name, or a number such as
+// "0x1301".
+func parseTLSCipher(s string) uint16 {
+	if n, err := strconv.ParseUint(s, 0, 16); err == nil {
+		return uint16(n)
+	}
+	for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if strings.EqualFold(c.Name, s) {
+			return c.ID
+		}
+	}
+	return 0
+}
+
+// Extract client IP in case of goatcounter sitting on top of one or more proxies
+// https://gist.github.com/17twenty/c815680c9c585cd9c16e62cbee7317b6
+func extractClientIP(r *http.Request) string {
+	ip, _ := clientIP(r)
+	return ip
+}
+
+// clientIP gets the client IP, and reports if the IPs in ClientIPHeader and
+// X-Forwarded-For are different; which one is used depends on
+// ClientIPPrecedence.
+func clientIP(r *http.Request) (string, bool) {
+	var (
+		c    = goatcounter.Config(r.Context())
+		ffip = forwardedFor(r)
+		hip  string
+	)
+	if c.ClientIPHeader != "" && trustedPeer(r, c.ClientIPProxies) {
+		hip = strings.TrimSpace(r.Header.Get(c.ClientIPHeader))
+	}
+
+	switch {
+	case hip == "" && ffip == "":
+		return r.RemoteAddr, false
+	case hip == "":
+		return ffip, false
+	case ffip == "":
+		return hip, false
+	}
+
+	conflict := !sameIP(hip, ffip)
+	if conflict && c.ClientIPPrecedence == goatcounter.ClientIPPrecedenceForwarded {
+		return ffip, true
+	}
+	return hip, conflict
+}
+
+// forwardedFor gets the first IP from X-Forwarded-For, or "" if it's not set.
+func forwardedFor(r *http.Request) string {
+	ffips := r.Header.Get(forwardedForHeader)
+	if ffips == "" {
+		return ""
+	}
+	ip, _, _ := strings.Cut(ffips, ", ")
+	return ip
+}
+
+// sameIP reports if a and b are the same IP address, ignoring the notation.
+func sameIP(a, b string) bool {
+	aa, err1 := netip.ParseAddr(a)
+	bb, err2 := netip.ParseAddr(b)
+	if err1 != nil || err2 != nil {
+		return a == b
+	}
+	return aa.Unmap() == bb.Unmap()
+}
+
+var decodeErrors = newErrorLog("decode error", 5, time.Minute)
+
+// SetDecodeErrorLog sets how many identical decode errors for a site are logged
+// within the window before they're collapsed in to a single summary line.
+func SetDecodeErrorLog(threshold int, window time.Duration) {
+	decodeErrors = newErrorLog("decode error", threshold, window)
+}
+
+// errorLog aggregates identical errors per site, so a misbehaving client that
+// sends garbage in a loop doesn't flood the logs with one line per request.
+//
+// The first threshold errors in a window are logged as usual; after that
+// they're only counted, and a summary is logged when the window ends.
+type errorLog struct {
+	name      string
+	threshold int
+	window    time.Duration
+
+	mu   sync.Mutex
+	seen map[errorLogKey]*errorLogEntry
+}
+
+type (
+	errorLogKey struct {
+		site int64
+		msg  string
+	}
+	errorLogEntry struct {
+		n     int
+		timer *time.Timer
+	}
+)
+
+func newErrorLog(name string, threshold int, window time.Duration) *errorLog {
+	return &errorLog{
+		name:      name,
+		threshold: threshold,
+		window:    window,
+		seen:      make(map[errorLogKey]*errorLogEntry),
+	}
+}
+
+func (e *errorLog) log(siteID int64, err error) {
+	k := errorLogKey{site: siteID, msg: err.Error()}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ent, ok := e.seen[k]
+	if !ok {
+		ent = &errorLogEntry{}
+		ent.timer = time.AfterFunc(e.window, func() { e.flush(k) })
+		e.seen[k] = ent
+	}
+	ent.n++
+	if ent.n <= e.threshold {
+		zlog.Module("count").Field("site", siteID).Printf("%s: %s", e.name, k.msg)
+	}
+}
+
+// flush logs the summary for k, if anything was suppressed.
+func (e *errorLog) flush(k errorLogKey) {
+	e.mu.Lock()
+	ent, ok := e.seen[k]
+	delete(e.seen, k)
+	e.mu.Unlock()
+
+	if ok && ent.n > e.threshold {
+		zlog.Module("count").Field("site", k.site).Printf("%d %ss from site %d in the last %s: %s",
+			ent.n, e.name, k.site, e.window, k.msg)
+	}
+}
+
+// flushAll logs all pending summaries without waiting for the window to end.
+func (e *errorLog) flushAll() {
+	e.mu.Lock()
+	keys := make([]errorLogKey, 0, len(e.seen))
+	for k, ent := range e.seen {
+		ent.timer.Stop()
+		keys = append(keys, k)
+	}
+	e.mu.Unlock()
+
+	for _, k := range keys {
+		e.flush(k)
+	}
+}
+
+// testModeLog keeps the last pageviews for sites in test mode; see
+// SiteSettings.TestMode.
+var testModeLog = newTestLog(100)
+
+// testLog is a ring buffer of the last max pageviews per site.
+type testLog struct {
+	max int
+
+	mu    sync.Mutex
+	sites map[int64][]testLogEntry
+}
+
+type testLogEntry struct {
+	Hit    goatcounter.Hit // As it would be stored.
+	Reason string          // Why it wouldn't be stored, if anything.
+	Note   string          // Changes to the path, as in the X-Goatcounter header.
+}
+
+func newTestLog(max int) *testLog {
+	return &testLog{max: max, sites: make(map[int64][]testLogEntry)}
+}
+
+func (l *testLog) add(siteID int64, e testLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	log := l.sites[siteID]
+	if len(log) >= l.max {
+		log = log[len(log)-l.max+1:]
+	}
+	l.sites[siteID] = append(log, e)
+}
+
+// list gets the entries for the site, newest first.
+func (l *testLog) list(siteID int64) []testLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	log := l.sites[siteID]
+	list := make([]testLogEntry, len(log))
+	for i, e := range log {
+		list[len(log)-1-i] = e
+	}
+	return list
+}
+
+func init() {
+	goatcounter.RegisterMemCache("nonces", signatureNonces, 2*goatcounter.SignatureMaxAge)
+	goatcounter.RegisterMemCache("samples", pathSamples, time.Hour)
+	goatcounter.RegisterMemCache("requests", requestIDs, 2*requestIDWindow)
+}
+
+// signatureNonces are the nonces of signed pageviews; see
+// SiteSettings.RequireNonce.
+var signatureNonces = newNonceCache(100_000)
+
+// nonceCache remembers the nonces from signatures, so every signed pageview
+// can only be sent once.
+//
+// The nonces are kept in two generations which are rotated every
+// 2×SignatureMaxAge, so a nonce is remembered for at least as long as the
+// signature is valid. To bound the memory new nonces are rejected once a site
+// has max nonces in the current generation.
+type nonceCache struct {
+	max int
+
+	mu        sync.Mutex
+	rotated   time.Time
+	cur, prev map[int64]map[string]struct{}
+}
+
+func newNonceCache(max int) *nonceCache {
+	return &nonceCache{
+		max:  max,
+		cur:  make(map[int64]map[string]struct{}),
+		prev: make(map[int64]map[string]struct{}),
+	}
+}
+
+// use records the nonce for the site, or returns an error if it was already
+// used.
+func (c *nonceCache) use(siteID int64, nonce string, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rotate(now)
+	if _, ok := c.cur[siteID][nonce]; ok {
+		return errors.New("nonce already used")
+	}
+	if _, ok := c.prev[siteID][nonce]; ok {
+		return errors.New("nonce already used")
+	}
+	if len(c.cur[siteID]) >= c.max {
+		return errors.New("too many nonces; try again later")
+	}
+	if c.cur[siteID] == nil {
+		c.cur[siteID] = make(map[string]struct{})
+	}
+	c.cur[siteID][nonce] = struct{}{}
+	return nil
+}
+
+func (c *nonceCache) rotate(now time.Time) {
+	if w := 2 * goatcounter.SignatureMaxAge; now.Sub(c.rotated) >= w {
+		if now.Sub(c.rotated) >= 2*w {
+			c.cur = make(map[int64]map[string]struct{})
+		}
+		c.prev, c.cur, c.rotated = c.cur, make(map[int64]map[string]struct{}), now
+	}
+}
+
+// Len gets the number of nonces.
+func (c *nonceCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for _, g := range []map[int64]map[string]struct{}{c.cur, c.prev} {
+		for _, s := range g {
+			n += len(s)
+		}
+	}
+	return n
+}
+
+// Evict rotates the generations, so they're freed even if there are no new
+// nonces. The ttl is ignored, as the nonces need to be kept for as long as the
+// signature is valid.
+func (c *nonceCache) Evict(now time.Time, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotate(now)
+}
+
+// pathSamples are the pageview counts for SiteSettings.SampleRate.
+var pathSamples = newPathSampler(100_000)
+
+// pathSampler counts the pageviews for every path in the current hour, to
+// decide which pageviews to keep with SiteSettings.SampleRate.
+//
+// To bound the memory at most max paths are counted every hour; pageviews for
+// paths after that are always kept.
+type pathSampler struct {
+	max int
+
+	mu     sync.Mutex
+	window time.Time
+	paths  map[sampleKey]int
+}
+
+type sampleKey struct {
+	siteID int64
+	path   string
+	event  bool
+}
+
+func newPathSampler(max int) *pathSampler {
+	return &pathSampler{max: max, paths: make(map[sampleKey]int)}
+}
+
+// weight gets the Hit.SampleWeight for the pageview, or 0 if it shouldn't be
+// recorded.
+//
+// The first SampleThreshold pageviews for a path in the hour are always kept
+// with a weight of 1, and after that every SampleRate-th pageview with a weight
+// of SampleRate, so the stats still add up to about the real number.
+func (s *pathSampler) weight(site *goatcounter.Site, hit goatcounter.Hit, now time.Time) int {
+	rate, threshold := site.Settings.SampleRate, site.Settings.SampleThreshold
+	if rate <= 1 {
+		return 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w := now.Truncate(time.Hour); !w.Equal(s.window) {
+		s.window, s.paths = w, make(map[sampleKey]int)
+	}
+
+	k := sampleKey{siteID: site.ID, path: hit.Path, event: bool(hit.Event)}
+	n, ok := s.paths[k]
+	if !ok && len(s.paths) >= s.max {
+		return 1
+	}
+	n++
+	s.paths[k] = n
+	switch {
+	case n <= threshold:
+		return 1
+	case (n-threshold)%rate == 0:
+		return rate
+	default:
+		return 0
+	}
+}
+
+// Len gets the number of paths.
+func (s *pathSampler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.paths)
+}
+
+// Evict removes the counts if the hour is over or if they're older than ttl;
+// pageviews are always kept until a path has SampleThreshold pageviews again.
+func (s *pathSampler) Evict(now time.Time, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !now.Truncate(time.Hour).Equal(s.window) || now.Sub(s.window) >= ttl {
+		s.window, s.paths = now.Truncate(time.Hour), make(map[sampleKey]int)
+	}
+}
+
+// Limits for Hit.RequestID.
+const (
+	maxRequestID    = 128             // Maximum length, in bytes.
+	requestIDWindow = 5 * time.Second // Minimum time an ID is remembered.
+)
+
+// requestIDs are the request IDs of recent pageviews; see requestIDCache.
+var requestIDs = newRequestIDCache(100_000, requestIDWindow)
+
+// requestIDCache remembers the request IDs of recent pageviews, so that a
+// pageview that's sent more than once with the same ID and path is only
+// recorded once; for example when a CDN sends the same request to both the
+// shield and the edge. This doesn't include the IP address, as that's different
+// for every copy.
+//
+// The IDs are kept in two generations which are rotated every window, so an ID
+// is remembered for at least window. To bound the memory no new IDs are
+// remembered once there are max IDs in the current generation; these pageviews
+// are always recorded.
+type requestIDCache struct {
+	max    int
+	window time.Duration
+
+	mu        sync.Mutex
+	rotated   time.Time
+	cur, prev map[requestIDKey]struct{}
+}
+
+type requestIDKey struct {
+	siteID   int64
+	id, path string
+}
+
+func newRequestIDCache(max int, window time.Duration) *requestIDCache {
+	return &requestIDCache{
+		max:    max,
+		window: window,
+		cur:    make(map[requestIDKey]struct{}),
+		prev:   make(map[requestIDKey]struct{}),
+	}
+}
+
+// seen records the request ID for the site and path, and reports if it was
+// already recorded.
+func (c *requestIDCache) seen(siteID int64, id, path string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rotate(now)
+	k := requestIDKey{siteID: siteID, id: id, path: path}
+	if _, ok := c.cur[k]; ok {
+		return true
+	}
+	if _, ok := c.prev[k]; ok {
+		return true
+	}
+	if len(c.cur) < c.max {
+		c.cur[k] = struct{}{}
+	}
+	return false
+}
+
+func (c *requestIDCache) rotate(now time.Time) {
+	if now.Sub(c.rotated) >= c.window {
+		if now.Sub(c.rotated) >= 2*c.window {
+			c.cur = make(map[requestIDKey]struct{})
+		}
+		c.prev, c.cur, c.rotated = c.cur, make(map[requestIDKey]struct{}), now
+	}
+}
+
+// Len gets the number of request IDs.
+func (c *requestIDCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.cur) + len(c.prev)
+}
 
-	return rip
+// Evict rotates the generations, so they're freed even if there are no new
+// pageviews. The ttl is ignored, as the window is already short.
+func (c *requestIDCache) Evict(now time.Time, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotate(now)
 }
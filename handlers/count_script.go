@@ -0,0 +1,106 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"zgo.at/zhttp"
+	"zgo.at/zstd/zfs"
+)
+
+// countScript serves /count.site.js: count.js with the site's configuration
+// set, so that it can be embedded without a data-goatcounter attribute or
+// window.goatcounter.endpoint.
+type countScript struct{ files fs.FS }
+
+// siteScriptConfig is the configuration that's set in /count.site.js. This is
+// public, so it must never include secrets such as
+// SiteSettings.SignatureSecret.
+type siteScriptConfig struct {
+	Endpoint string `json:"endpoint"`
+}
+
+type siteScript struct {
+	conf    string
+	version string
+	body    []byte
+}
+
+var siteScripts struct {
+	mu    sync.Mutex
+	sites map[int64]siteScript
+}
+
+func (h countScript) mount(r chi.Router) {
+	r.Get("/count.site.js", zhttp.Wrap(h.script))
+}
+
+// GET /count.site.js
+//
+// The version is sent as the ETag; requests with ?v=[version] are cached for
+// 30 days rather than an hour, so the embed code can use that to always get
+// the latest version once the configuration changes.
+func (h countScript) script(w http.ResponseWriter, r *http.Request) error {
+	s := h.get(r)
+
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+	w.Header().Set("ETag", `"`+s.version+`"`)
+	if r.URL.Query().Get("v") == s.version {
+		w.Header().Set("Cache-Control", "public, max-age=2592000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+
+	if r.Header.Get("If-None-Match") == `"`+s.version+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	return zhttp.Bytes(w, s.body)
+}
+
+// get the script for this site, generating it if the configuration changed.
+func (h countScript) get(r *http.Request) siteScript {
+	site := Site(r.Context())
+	conf, err := json.Marshal(siteScriptConfig{
+		Endpoint: site.CountURL(r.Context()),
+	})
+	if err != nil {
+		panic(err) // Should never happen.
+	}
+
+	siteScripts.mu.Lock()
+	defer siteScripts.mu.Unlock()
+	if s, ok := siteScripts.sites[site.ID]; ok && s.conf == string(conf) {
+		return s
+	}
+
+	// Values in window.goatcounter that are set on the page take precedence.
+	body := append([]byte("// Settings for "+site.Display(r.Context())+"\n"+
+		";(function() {\n"+
+		"\tvar set = "), conf...)
+	body = append(body, []byte("\n"+
+		"\twindow.goatcounter = window.goatcounter || {}\n"+
+		"\tfor (var k in set)\n"+
+		"\t\tif (window.goatcounter[k] === undefined)\n"+
+		"\t\t\twindow.goatcounter[k] = set[k]\n"+
+		"})();\n\n")...)
+	body = append(body, zfs.MustReadFile(h.files, "count.js")...)
+
+	sum := sha256.Sum256(body)
+	s := siteScript{conf: string(conf), version: hex.EncodeToString(sum[:8]), body: body}
+	if siteScripts.sites == nil {
+		siteScripts.sites = make(map[int64]siteScript)
+	}
+	siteScripts.sites[site.ID] = s
+	return s
+}
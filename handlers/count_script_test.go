@@ -0,0 +1,82 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztype"
+)
+
+func TestCountScript(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := Site(ctx)
+	site.Settings.RequireSignature = true
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(t *testing.T, path, etag string) (string, string, string) {
+		t.Helper()
+		r, rr := newTest(ctx, "GET", path, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		if etag == "" {
+			ztest.Code(t, rr, 200)
+		} else {
+			ztest.Code(t, rr, 304)
+		}
+		return rr.Body.String(), rr.Header().Get("ETag"), rr.Header().Get("Cache-Control")
+	}
+
+	body, etag, cache := get(t, "/count.site.js", "")
+	want := `var set = {"endpoint":"` + site.CountURL(ctx) + `"}`
+	if !strings.Contains(body, want) {
+		t.Errorf("doesn't contain %q in:\n%s", want, body)
+	}
+	if !strings.Contains(body, "window.goatcounter.count = function(vars)") {
+		t.Error("doesn't contain count.js")
+	}
+	if strings.Contains(body, site.Settings.SignatureSecret) {
+		t.Error("contains signature secret")
+	}
+	if cache != "public, max-age=3600" {
+		t.Errorf("Cache-Control: %q", cache)
+	}
+
+	get(t, "/count.site.js", etag)
+	_, _, cache = get(t, "/count.site.js?v="+strings.Trim(etag, `"`), "")
+	if cache != "public, max-age=2592000, immutable" {
+		t.Errorf("Cache-Control with version: %q", cache)
+	}
+
+	// Changes with the configuration.
+	site.Cname = ztype.Ptr("stats.example.com")
+	err = site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = site.UpdateCnameSetupAt(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = goatcounter.WithSite(ctx, site)
+	body, etag2, _ := get(t, "/count.site.js", "")
+	if etag2 == etag {
+		t.Error("ETag didn't change")
+	}
+	want = `var set = {"endpoint":"` + site.CountURL(ctx) + `"}`
+	if !strings.Contains(body, want) || !strings.Contains(want, "stats.example.com") {
+		t.Errorf("doesn't contain %q in:\n%s", want, body)
+	}
+}
@@ -5,11 +5,27 @@
 package handlers
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,6 +33,9 @@ import (
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/isbot"
 	"zgo.at/zdb"
+	"zgo.at/zhttp/mware"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zbool"
 	"zgo.at/zstd/zcrypto"
 	"zgo.at/zstd/zint"
 	"zgo.at/zstd/zjson"
@@ -171,6 +190,12 @@ func TestBackendCount(t *testing.T) {
 			if tt.hit.UserAgentHeader == "" {
 				tt.hit.UserAgentHeader = "GoatCounter test runner/1.0"
 			}
+			if tt.hit.Type == "" {
+				tt.hit.Type = goatcounter.HitTypePageview
+			}
+			if tt.hit.Platform == "" {
+				tt.hit.Platform = goatcounter.PlatformWeb
+			}
 			h.CreatedAt = h.CreatedAt.In(time.UTC)
 			if d := ztest.Diff(string(zjson.MustMarshal(h)), string(zjson.MustMarshal(tt.hit)), ztest.DiffJSON); d != "" {
 				t.Error(d)
@@ -326,3 +351,4564 @@ func TestBackendCountSessions(t *testing.T) {
 	want = []int{1, 1, 2, 3, 3, 1, 2, 1, 3, 4, 5}
 	checkSess(append(hits1, hits2...), want)
 }
+
+// Pageviews for the code subdomain and custom domain of a site are in the same
+// session.
+func TestBackendCountSessionsHost(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := Site(ctx)
+
+	for _, host := range []string{site.Code + "." + goatcounter.Config(ctx).Domain, *site.Cname} {
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+		r.Host = host
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0")
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+	}
+	_, err := goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hits goatcounter.Hits
+	err = hits.TestList(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 {
+		t.Fatalf("len(hits) = %d", len(hits))
+	}
+	if hits[0].Session != hits[1].Session || !hits[0].FirstVisit || hits[1].FirstVisit {
+		t.Errorf("not one session:\n%s %t\n%s %t", hits[0].Session, hits[0].FirstVisit,
+			hits[1].Session, hits[1].FirstVisit)
+	}
+}
+
+func TestBackendCountDecodeErrors(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	out := zlog.Config.Outputs
+	zlog.Config.SetOutputs(func(l zlog.Log) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, l.Msg)
+	})
+	defer func() { zlog.Config.SetOutputs(out...) }()
+	getLogs := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, logs...)
+	}
+
+	ctx := gctest.DB(t)
+	decodeErrors = newErrorLog("decode error", 3, time.Hour)
+	defer SetDecodeErrorLog(5, time.Minute)
+
+	for i := 0; i < 50; i++ {
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader("not json"))
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 400)
+	}
+	if l := getLogs(); len(l) != 3 {
+		t.Errorf("wanted 3 log lines before the window ends, got %d:\n%s", len(l), strings.Join(l, "\n"))
+	}
+
+	decodeErrors.flushAll()
+	l := getLogs()
+	if len(l) != 4 {
+		t.Fatalf("wanted 4 log lines after the window ends, got %d:\n%s", len(l), strings.Join(l, "\n"))
+	}
+	want := "50 decode errors from site 1 in the last 1h0m0s: invalid character 'o' in literal null (expecting 'u')"
+	if l[3] != want {
+		t.Errorf("wrong summary\nhave: %s\nwant: %s", l[3], want)
+	}
+
+	// A short window should flush on its own.
+	mu.Lock()
+	logs = nil
+	mu.Unlock()
+	decodeErrors = newErrorLog("decode error", 1, 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		decodeErrors.log(1, errors.New("oops"))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if l := getLogs(); len(l) != 2 || l[1] != "10 decode errors from site 1 in the last 10ms: oops" {
+		t.Errorf("wrong logs:\n%s", strings.Join(l, "\n"))
+	}
+}
+
+func TestBackendCountIgnoredStatus(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.IgnoreIPs = []string{"1.2.3.4"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		status, want int
+	}{
+		{0, 202},
+		{202, 202},
+		{200, 200},
+	} {
+		t.Run("", func(t *testing.T) {
+			goatcounter.Config(ctx).IgnoredStatus = tt.status
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.Header.Set("X-Forwarded-For", "1.2.3.4")
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.want)
+
+			if h := rr.Header().Get("X-Goatcounter"); !strings.Contains(h, "ignored because") {
+				t.Errorf("X-Goatcounter header: %q", h)
+			}
+			if n := goatcounter.Memstore.Len(); n != 0 {
+				t.Errorf("%d hits in memstore", n)
+			}
+		})
+	}
+}
+
+func TestBackendCountDebugHeaders(t *testing.T) {
+	send := map[string]struct {
+		body, ip string
+		status   int
+	}{
+		"recorded": {`{"p": "/x", "conn": "4g"}`, "", 200}, // Note that conn isn't collected.
+		"ignored":  {`{"p": "/x"}`, "1.2.3.4", 202},
+		"rejected": {`not json`, "", 400},
+	}
+	tests := []struct {
+		level, send       string
+		wantMsg, wantCode string
+	}{
+		{"", "recorded", "conn ignored as it's not collected for this site", ""},
+		{"", "ignored", `ignored because "1.2.3.4" is in the IP ignore list`, "ignored_ip"},
+		{"", "rejected", "error decoding parameters: invalid character 'o' in literal null (expecting 'u')", "decode_error"},
+		{"full", "ignored", `ignored because "1.2.3.4" is in the IP ignore list`, "ignored_ip"},
+
+		{"minimal", "recorded", "", ""},
+		{"minimal", "ignored", "ignored", "ignored"},
+		{"minimal", "rejected", "error", "error"},
+
+		{"off", "recorded", "", ""},
+		{"off", "ignored", "", ""},
+		{"off", "rejected", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level+"-"+tt.send, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			site := Site(ctx)
+			site.Settings.IgnoreIPs = []string{"1.2.3.4"}
+			site.Settings.DebugHeaders = tt.level
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := send[tt.send]
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(s.body))
+			if s.ip != "" {
+				r.Header.Set("X-Forwarded-For", s.ip)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, s.status)
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if h := rr.Header().Get("X-Goatcounter"); h != tt.wantMsg {
+				t.Errorf("X-Goatcounter\nhave: %q\nwant: %q", h, tt.wantMsg)
+			}
+			if h := rr.Header().Get("X-Goatcounter-Code"); h != tt.wantCode {
+				t.Errorf("X-Goatcounter-Code\nhave: %q\nwant: %q", h, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestBackendCountConsentCookie(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.Collect |= goatcounter.CollectLanguage | goatcounter.CollectLocation | goatcounter.CollectSession
+	site.Settings.ConsentCookie = goatcounter.ConsentCookie{Name: "consent", Value: "yes"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, cookie string
+		wantAnon     bool
+	}{
+		{"accepted", "yes", false},
+		{"declined", "no", true},
+		{"missing", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/`+tt.name+`"}`))
+			r.Header.Set("X-Forwarded-For", "51.171.91.33")
+			r.Header.Set("Accept-Language", "en-US,en;q=0.5")
+			r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0")
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "consent", Value: tt.cookie})
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("len(hits) = %d", len(hits))
+			}
+
+			h := hits[0]
+			if tt.wantAnon {
+				if h.Location != "" || h.Language != nil || !h.Session.IsZero() || !h.FirstVisit.Bool() {
+					t.Errorf("not anonymous: location=%q language=%v session=%s first=%t",
+						h.Location, ztype.Deref(h.Language, "<nil>"), h.Session, h.FirstVisit)
+				}
+			} else {
+				if h.Location != "IE" || ztype.Deref(h.Language, "") != "eng" || h.Session.IsZero() {
+					t.Errorf("missing data: location=%q language=%v session=%s",
+						h.Location, ztype.Deref(h.Language, "<nil>"), h.Session)
+				}
+			}
+		})
+	}
+}
+
+func TestBackendCountLanguage(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.Collect |= goatcounter.CollectLanguage
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []string{"", "*", "xx, asdf, !!!"} {
+		t.Run(tt, func(t *testing.T) {
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.Header.Set("Accept-Language", tt)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("len(hits) = %d", len(hits))
+			}
+			if hits[0].Language != nil {
+				t.Errorf("Language = %q", *hits[0].Language)
+			}
+		})
+	}
+}
+
+func TestBackendCountLanguages(t *testing.T) {
+	tests := []struct {
+		collect  zint.Bitflag16
+		enabled  bool
+		header   string
+		wantLang string
+		want     string
+	}{
+		{goatcounter.CollectLanguage, true, "en-US, en-GB;q=0.9, nl;q=0.5", "eng", "eng, nld"},
+		{goatcounter.CollectLanguage, true, "en-US, en-GB;q=0.9", "eng", "eng"},
+		{goatcounter.CollectLanguage, false, "en-US, en-GB;q=0.9, nl;q=0.5", "eng", ""},
+		{0, true, "en-US, en-GB;q=0.9, nl;q=0.5", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.Settings.Collect = goatcounter.CollectReferrer | tt.collect
+			site.Settings.CollectLanguages = tt.enabled
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.Header.Set("Accept-Language", tt.header)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits goatcounter.Hits
+			err = hits.TestList(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("len(hits) = %d", len(hits))
+			}
+			if have := ztype.Deref(hits[0].Language, ""); have != tt.wantLang {
+				t.Errorf("Language: %q; want %q", have, tt.wantLang)
+			}
+			if have := hits[0].Languages.String(); have != tt.want {
+				t.Errorf("Languages: %q; want %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendCountBrowserLanguage(t *testing.T) {
+	tests := []struct {
+		name         string
+		collect      zint.Bitflag16
+		browser      bool // CollectBrowserLanguage
+		externalOnly bool // CollectExternalOnly
+		cookie       string
+		wantLang     string
+		wantBrowser  string
+	}{
+		{"agree", goatcounter.CollectLanguage, true, false, "en-GB", "eng", ""},
+		{"disagree", goatcounter.CollectLanguage, true, false, "nl", "nld", "eng"},
+		{"no cookie", goatcounter.CollectLanguage, true, false, "", "eng", ""},
+		{"invalid cookie", goatcounter.CollectLanguage, true, false, "xx-invalid!", "eng", ""},
+		{"not enabled", goatcounter.CollectLanguage, false, false, "nl", "nld", ""},
+		{"not collected", 0, true, false, "nl", "", ""},
+		{"external only", goatcounter.CollectLanguage, true, true, "nl", "nld", "eng"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.LinkDomain = "example.com"
+			site.Settings.Collect = goatcounter.CollectReferrer | tt.collect
+			site.Settings.LanguageCookie = "lang"
+			site.Settings.CollectBrowserLanguage = tt.browser
+			site.Settings.CollectExternalOnly = tt.externalOnly
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x", "r": "https://example.org"}`))
+			r.Header.Set("Accept-Language", "en-US, en-GB;q=0.9")
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "lang", Value: tt.cookie})
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits goatcounter.Hits
+			err = hits.TestList(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("len(hits) = %d", len(hits))
+			}
+			if have := ztype.Deref(hits[0].Language, ""); have != tt.wantLang {
+				t.Errorf("Language: %q; want %q", have, tt.wantLang)
+			}
+			if have := ztype.Deref(hits[0].BrowserLanguage, ""); have != tt.wantBrowser {
+				t.Errorf("BrowserLanguage: %q; want %q", have, tt.wantBrowser)
+			}
+		})
+	}
+}
+
+func TestBackendCountClientIPHeader(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.IgnoreIPs = []string{"9.9.9.9"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		header, proxies, peer string
+		wantIgnored           bool
+	}{
+		{"", "", "192.0.2.1:1234", false},                                // Not configured.
+		{"X-Client-Real-IP", "", "192.0.2.1:1234", true},                 // Trust everyone.
+		{"X-Client-Real-IP", "192.0.2.0/24", "192.0.2.1:1234", true},     // Trusted proxy.
+		{"X-Client-Real-IP", "10.0.0.1/32", "192.0.2.1:1234", false},     // Not a trusted proxy.
+		{"X-Other", "", "192.0.2.1:1234", false},                         // Different header.
+		{"X-Client-Real-IP", "2001:db8::/32", "[2001:db8::1]:443", true}, // IPv6
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			c := goatcounter.Config(ctx)
+			c.ClientIPHeader = http.CanonicalHeaderKey(tt.header)
+			c.ClientIPProxies = nil
+			if tt.proxies != "" {
+				c.ClientIPProxies = []netip.Prefix{netip.MustParsePrefix(tt.proxies)}
+			}
+			defer func() { c.ClientIPHeader, c.ClientIPProxies = "", nil }()
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.RemoteAddr = tt.peer
+			r.Header.Set("X-Client-Real-IP", "9.9.9.9")
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+
+			ignored := strings.Contains(rr.Header().Get("X-Goatcounter"), "ignored because")
+			if ignored != tt.wantIgnored {
+				t.Errorf("ignored=%t; want %t (X-Goatcounter: %q)", ignored, tt.wantIgnored, rr.Header().Get("X-Goatcounter"))
+			}
+			_, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBackendCountClientIPConflict(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	c := goatcounter.Config(ctx)
+	c.ClientIPHeader = "X-Client-Real-Ip"
+	defer func() { c.ClientIPHeader, c.ClientIPPrecedence, c.ClientIPConflict = "", "", false }()
+
+	tests := []struct {
+		name, header, forwarded, prec string
+		want                          string
+		wantConflict                  bool
+	}{
+		{"only header", "9.9.9.9", "", "", "9.9.9.9", false},
+		{"only forwarded", "", "8.8.8.8, 10.0.0.1", "", "8.8.8.8", false},
+		{"neither", "", "", "", "192.0.2.1:1234", false},
+
+		{"agree", "9.9.9.9", "9.9.9.9, 10.0.0.1", "", "9.9.9.9", false},
+		{"agree notation", "::ffff:9.9.9.9", "9.9.9.9", "", "::ffff:9.9.9.9", false},
+		{"agree forwarded", "9.9.9.9", "9.9.9.9", goatcounter.ClientIPPrecedenceForwarded, "9.9.9.9", false},
+
+		{"conflict default", "9.9.9.9", "8.8.8.8", "", "9.9.9.9", true},
+		{"conflict header", "9.9.9.9", "8.8.8.8, 10.0.0.1", goatcounter.ClientIPPrecedenceHeader, "9.9.9.9", true},
+		{"conflict forwarded", "9.9.9.9", "8.8.8.8, 10.0.0.1", goatcounter.ClientIPPrecedenceForwarded, "8.8.8.8", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.ClientIPPrecedence = tt.prec
+			for _, flag := range []bool{false, true} {
+				c.ClientIPConflict = flag
+
+				r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+				r.RemoteAddr = "192.0.2.1:1234"
+				if tt.header != "" {
+					r.Header.Set("X-Client-Real-IP", tt.header)
+				}
+				if tt.forwarded != "" {
+					r.Header.Set("X-Forwarded-For", tt.forwarded)
+				}
+
+				ip, conflict := clientIP(r)
+				if ip != tt.want || conflict != tt.wantConflict {
+					t.Errorf("have %q %t; want %q %t", ip, conflict, tt.want, tt.wantConflict)
+				}
+
+				newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+				ztest.Code(t, rr, 200)
+				hits, err := goatcounter.Memstore.Persist(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(hits) != 1 {
+					t.Fatalf("recorded %d hits", len(hits))
+				}
+
+				flagged := slices.Contains(rr.Header().Values("X-Goatcounter"), "ip header conflict")
+				if want := flag && tt.wantConflict; flagged != want {
+					t.Errorf("flag=%t: flagged=%t; want %t (X-Goatcounter: %q)", flag, flagged, want, rr.Header().Values("X-Goatcounter"))
+				}
+			}
+		})
+	}
+}
+
+func TestBackendCountRequireHTTPS(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.RequireHTTPS = true
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		tls          bool
+		proto        string
+		proxies      string
+		wantRecorded bool
+	}{
+		{"https", true, "", "", true},
+		{"http", false, "", "", false},
+		{"forwarded https", false, "https", "", true},
+		{"forwarded http", false, "http", "", false},
+		{"forwarded multiple", false, "https, http", "", true},
+		{"trusted proxy", false, "https", "192.0.2.0/24", true},
+		{"untrusted proxy", false, "https", "10.0.0.0/8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := goatcounter.Config(ctx)
+			c.ClientIPProxies = nil
+			if tt.proxies != "" {
+				c.ClientIPProxies = []netip.Prefix{netip.MustParsePrefix(tt.proxies)}
+			}
+			defer func() { c.ClientIPProxies = nil }()
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.RemoteAddr = "192.0.2.1:1234"
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorded := len(hits) == 1
+			if recorded != tt.wantRecorded {
+				t.Errorf("recorded=%t; want %t", recorded, tt.wantRecorded)
+			}
+			if h := rr.Header().Get("X-Goatcounter"); !tt.wantRecorded && h != "https required" {
+				t.Errorf("X-Goatcounter: %q", h)
+			}
+		})
+	}
+}
+
+func TestBackendCountClientHints(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	send := func() (*httptest.ResponseRecorder, goatcounter.Hit) {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+		r.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36")
+		r.Header.Set("Sec-CH-UA", `"Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99"`)
+		r.Header.Set("Sec-CH-UA-Platform", `"Windows"`)
+		r.Header.Set("Sec-CH-UA-Platform-Version", `"15.0.0"`)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+
+		hits, err := goatcounter.Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 1 {
+			t.Fatalf("len(hits) = %d", len(hits))
+		}
+		return rr, hits[0]
+	}
+
+	rr, hit := send()
+	if h := rr.Header().Get("Accept-CH"); h != "" {
+		t.Errorf("Accept-CH set with setting off: %q", h)
+	}
+	if !hit.ClientHints.IsZero() {
+		t.Errorf("hints read with setting off: %#v", hit.ClientHints)
+	}
+
+	site := Site(ctx)
+	site.Settings.ClientHints = true
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr, hit = send()
+	if h := rr.Header().Get("Accept-CH"); h != goatcounter.AcceptClientHints {
+		t.Errorf("Accept-CH: %q", h)
+	}
+	var system string
+	err = zdb.Get(ctx, &system, `select name || ' ' || version from systems where system_id = $1`, hit.SystemID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if system != "Windows 11" {
+		t.Errorf("system: %q", system)
+	}
+}
+
+func TestBackendCountMinBody(t *testing.T) {
+	ctx := gctest.DB(t)
+	goatcounter.Config(ctx).CountMinBody = 1
+	defer func() { goatcounter.Config(ctx).CountMinBody = 0 }()
+
+	tests := []struct {
+		name       string
+		body       string
+		chunked    bool
+		wantCode   int
+		wantHeader string
+	}{
+		{"zero", "", false, 202, "empty body"},
+		{"chunked", `{"p": "/x"}`, true, 200, ""},
+		{"chunked empty", "", true, 400, "error decoding parameters"},
+		{"normal", `{"p": "/x"}`, false, 200, ""},
+		{"query", "", false, 200, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := "/count"
+			if tt.name == "query" {
+				url += "?p=/q"
+			}
+			r, rr := newTest(ctx, "POST", url, strings.NewReader(tt.body))
+			r.ContentLength = int64(len(tt.body))
+			if tt.chunked {
+				r.ContentLength = -1
+				r.TransferEncoding = []string{"chunked"}
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			h := rr.Header().Get("X-Goatcounter")
+			if tt.wantHeader == "" && h != "" || !strings.HasPrefix(h, tt.wantHeader) {
+				t.Errorf("X-Goatcounter: %q", h)
+			}
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[bool]int{true: 1, false: 0}[tt.wantCode == 200]; len(hits) != want {
+				t.Errorf("len(hits) = %d; want %d", len(hits), want)
+			}
+		})
+	}
+
+	t.Run("minimum", func(t *testing.T) {
+		goatcounter.Config(ctx).CountMinBody = 12
+		body := `{"p": "/x"}` // 11 bytes
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(body))
+		r.ContentLength = int64(len(body))
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 202)
+		if h := rr.Header().Get("X-Goatcounter"); h != "empty body" {
+			t.Errorf("X-Goatcounter: %q", h)
+		}
+	})
+}
+
+func TestBackendCountPathFromReferer(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		body     string
+		referer  string
+		wantCode int
+		wantX    string
+		wantPath string
+	}{
+		{"body", true, `{"p": "/x"}`, "https://example.com/page", 200, "", "/x"},
+		{"empty body", true, "", "https://example.com/page?utm_campaign=foo", 200, "", "/page"},
+		{"no path", true, `{"t": "Title"}`, "https://www.example.com/page", 200, "", "/page"},
+		{"same host", true, "", "https://gctest.test/other", 200, "", "/other"},
+		{"root", true, "", "https://example.com", 200, "", "/"},
+
+		{"no referer", true, "", "", 400, "no_path", ""},
+		{"other site", true, "", "https://example.org/page", 400, "no_path", ""},
+		{"not http", true, "", "javascript:alert(1)", 400, "no_path", ""},
+		{"disabled", false, "", "https://example.com/page", 202, "empty_body", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			goatcounter.Config(ctx).CountMinBody = 1 // Default for -count-min-body.
+			defer func() { goatcounter.Config(ctx).CountMinBody = 0 }()
+
+			site := Site(ctx)
+			site.LinkDomain = "example.com"
+			site.Settings.PathFromReferer = tt.enabled
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantX {
+				t.Errorf("X-Goatcounter-Code: have %q; want %q (%s)", have, tt.wantX, rr.Header().Get("X-Goatcounter"))
+			}
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var have string
+			if len(hits) > 0 {
+				have = hits[0].Path
+			}
+			if have != tt.wantPath {
+				t.Errorf("path: have %q; want %q", have, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestBackendCountDefaultPath(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultPath string
+		fromReferer bool
+		body        string
+		referer     string
+		wantCode    int
+		wantPath    string
+	}{
+		{"provided", "/(no path)", false, `{"p": "/x"}`, "", 200, "/x"},
+		{"no path", "/(no path)", false, `{"t": "Title"}`, "", 200, "/(no path)"},
+		{"empty body", "/(no path)", false, "", "", 200, "/(no path)"},
+		{"event", "/(no path)", false, `{"e": true}`, "", 400, ""},
+		{"from referer", "/(no path)", true, "", "https://example.com/page", 200, "/page"},
+		{"bad referer", "/(no path)", true, "", "https://example.org/page", 200, "/(no path)"},
+
+		{"not set", "", false, `{"t": "Title"}`, "", 400, ""},
+		{"not set referer", "", true, "", "https://example.org/page", 400, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			goatcounter.Config(ctx).CountMinBody = 1 // Default for -count-min-body.
+			defer func() { goatcounter.Config(ctx).CountMinBody = 0 }()
+
+			site := Site(ctx)
+			site.LinkDomain = "example.com"
+			site.Settings.DefaultPath = tt.defaultPath
+			site.Settings.PathFromReferer = tt.fromReferer
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var have string
+			if len(hits) > 0 {
+				have = hits[0].Path
+			}
+			if have != tt.wantPath {
+				t.Errorf("path: have %q; want %q", have, tt.wantPath)
+			}
+
+			x := strings.Join(rr.Header().Values("X-Goatcounter"), "; ")
+			if noted := strings.Contains(x, "no path; recorded as"); noted != (tt.defaultPath != "" && tt.wantPath == tt.defaultPath) {
+				t.Errorf("X-Goatcounter: %q", x)
+			}
+		})
+	}
+}
+
+func TestBackendCountReasonCode(t *testing.T) {
+	ctx := gctest.DB(t)
+	goatcounter.Config(ctx).CountMinBody = 1
+	defer func() { goatcounter.Config(ctx).CountMinBody = 0 }()
+
+	site := Site(ctx)
+	site.Settings.IgnoreIPs = []string{"1.2.3.4"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		setup    func(*http.Request)
+		wantCode string
+	}{
+		{"recorded", `{"p": "/x"}`, nil, ""},
+		{"prefetch", `{"p": "/x"}`, func(r *http.Request) { r.Header.Set("Purpose", "prefetch") }, "prefetch"},
+		{"empty body", ``, nil, "empty_body"},
+		{"ignored ip", `{"p": "/x"}`, func(r *http.Request) { r.Header.Set("X-Forwarded-For", "1.2.3.4") }, "ignored_ip"},
+		{"decode error", `{"p": `, nil, "decode_error"},
+		{"invalid bot", `{"p": "/x", "b": 10}`, nil, "invalid_bot"},
+		{"path too long", `{"p": "/` + strings.Repeat("x", 2048) + `"}`, nil, "path_too_long"},
+		{"invalid", `{"p": ""}`, nil, "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			r.ContentLength = int64(len(tt.body))
+			if tt.setup != nil {
+				tt.setup(r)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			_, _ = goatcounter.Memstore.Persist(ctx)
+
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantCode {
+				t.Errorf("X-Goatcounter-Code: have %q; want %q (X-Goatcounter: %q)",
+					have, tt.wantCode, rr.Header().Get("X-Goatcounter"))
+			}
+			if tt.wantCode != "" && rr.Header().Get("X-Goatcounter") == "" {
+				t.Error("X-Goatcounter not set")
+			}
+		})
+	}
+
+	t.Run("https required", func(t *testing.T) {
+		site.Settings.RequireHTTPS = true
+		err := site.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		if have := rr.Header().Get("X-Goatcounter-Code"); have != "https_required" {
+			t.Errorf("X-Goatcounter-Code: %q", have)
+		}
+	})
+}
+
+func TestBackendCountPath(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	enc := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name     string
+		hit      string
+		wantCode int
+		wantPath string
+		wantGC   string
+	}{
+		{"valid", enc(`{"p": "/x?a=b&c=d", "t": "Title"}`), 200, "/x?a=b&c=d", ""},
+		{"padded", base64.URLEncoding.EncodeToString([]byte(`{"p": "/pad"}`)), 200, "/pad", ""},
+		{"long", enc(`{"p": "/` + strings.Repeat("a", 1500) + `"}`), 200, "/" + strings.Repeat("a", 1500), ""},
+		{"oversized", enc(`{"p": "/` + strings.Repeat("a", 1600) + `"}`), 414, "", "hit_too_long"},
+		{"malformed", "a$b", 400, "", "decode_error"},
+		{"standard base64", base64.StdEncoding.EncodeToString([]byte(`{"p": "/~~~"}`)), 400, "", "decode_error"},
+		{"not json", enc(`/x`), 400, "", "decode_error"},
+		{"invalid", enc(`{"p": ""}`), 400, "", "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, rr := newTest(ctx, "GET", "/count/p/"+tt.hit, nil)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantGC {
+				t.Errorf("X-Goatcounter-Code: have %q; want %q (X-Goatcounter: %q)",
+					have, tt.wantGC, rr.Header().Get("X-Goatcounter"))
+			}
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantPath == "" {
+				if len(hits) != 0 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+				return
+			}
+			if len(hits) != 1 {
+				t.Fatalf("len(hits) = %d", len(hits))
+			}
+			if hits[0].Path != tt.wantPath {
+				t.Errorf("path: %q", hits[0].Path)
+			}
+			if rr.Header().Get("Content-Type") != "image/gif" {
+				t.Errorf("Content-Type: %q", rr.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestBackendCountVisitorCookie(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	send := func(cookie, ip string) (*http.Cookie, goatcounter.Hit) {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+		r.Header.Set("X-Forwarded-For", ip)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "goatcounter_visitor", Value: cookie})
+		}
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+
+		hits, err := goatcounter.Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 1 {
+			t.Fatalf("len(hits) = %d", len(hits))
+		}
+		var c *http.Cookie
+		for _, cc := range rr.Result().Cookies() {
+			if cc.Name == "goatcounter_visitor" {
+				c = cc
+			}
+		}
+		return c, hits[0]
+	}
+
+	if c, _ := send("", "1.1.1.1"); c != nil {
+		t.Fatalf("cookie set with setting off: %v", c)
+	}
+
+	site := Site(ctx)
+	site.Settings.VisitorCookie = 30
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, first := send("", "2.2.2.2")
+	if c == nil {
+		t.Fatal("no cookie")
+	}
+	if !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteNoneMode || c.MaxAge != 30*86400 {
+		t.Errorf("wrong cookie: %s", c)
+	}
+	if !first.FirstVisit {
+		t.Error("first hit not a first visit")
+	}
+
+	// Different IP, but the same cookie: returning visitor.
+	c2, returning := send(c.Value, "3.3.3.3")
+	if c2 != nil {
+		t.Errorf("cookie set again: %s", c2)
+	}
+	if returning.FirstVisit || returning.Session != first.Session {
+		t.Errorf("not a returning visitor: FirstVisit=%t; session %s != %s",
+			returning.FirstVisit, returning.Session, first.Session)
+	}
+
+	// The session is gone after it's evicted; the same cookie is a new visit.
+	goatcounter.Memstore.EvictSessions(ztime.Now().Add(goatcounter.SessionTimeout+time.Minute), goatcounter.SessionTimeout)
+	if _, h := send(c.Value, "3.3.3.3"); !h.FirstVisit || h.Session == first.Session {
+		t.Errorf("same session after eviction: FirstVisit=%t; session %s", h.FirstVisit, h.Session)
+	}
+
+	// Invalid tokens get replaced.
+	if c, _ := send("../x", "3.3.3.3"); c == nil || c.Value == "../x" {
+		t.Errorf("invalid token not replaced: %v", c)
+	}
+
+	// Don't set anything without consent.
+	site.Settings.ConsentCookie = goatcounter.ConsentCookie{Name: "consent"}
+	err = site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, h := send("", "4.4.4.4"); c != nil || !h.Session.IsZero() {
+		t.Errorf("cookie set without consent: %v; session %s", c, h.Session)
+	}
+}
+
+func TestBackendCountHooks(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	var (
+		order    []string
+		internal = regexp.MustCompile(`^/internal/`)
+		titles   = map[string]string{"/page": "Lookup title"}
+	)
+	goatcounter.RegisterHitHook("reject", func(ctx context.Context, h *goatcounter.Hit) error {
+		order = append(order, "reject")
+		if internal.MatchString(h.Path) {
+			return errors.New("internal path")
+		}
+		return nil
+	})
+	goatcounter.RegisterHitHook("enrich", func(ctx context.Context, h *goatcounter.Hit) error {
+		order = append(order, "enrich")
+		if t, ok := titles[h.Path]; ok {
+			h.Title = t
+		}
+		return nil
+	})
+	t.Cleanup(func() {
+		goatcounter.UnregisterHitHook("reject")
+		goatcounter.UnregisterHitHook("enrich")
+	})
+
+	tests := []struct {
+		path, wantCode, wantMsg, wantTitle string
+		wantOrder                          []string
+	}{
+		{"/page", "", "", "Lookup title", []string{"reject", "enrich"}},
+		{"/other", "", "", "", []string{"reject", "enrich"}},
+		{"/internal/x", "dropped", `dropped by hook "reject": internal path`, "", []string{"reject"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			order = nil
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "`+tt.path+`"}`))
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantCode {
+				t.Errorf("X-Goatcounter-Code: have %q; want %q", have, tt.wantCode)
+			}
+			if have := rr.Header().Get("X-Goatcounter"); have != tt.wantMsg {
+				t.Errorf("X-Goatcounter: have %q; want %q", have, tt.wantMsg)
+			}
+			if !reflect.DeepEqual(order, tt.wantOrder) {
+				t.Errorf("order: have %v; want %v", order, tt.wantOrder)
+			}
+
+			if tt.wantCode != "" {
+				if len(hits) != 0 {
+					t.Fatalf("recorded %d hits", len(hits))
+				}
+				return
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if hits[0].Title != tt.wantTitle {
+				t.Errorf("title: have %q; want %q", hits[0].Title, tt.wantTitle)
+			}
+		})
+	}
+}
+
+func TestBackendCountForm(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	tests := []struct {
+		name, ct, body, wantCode string
+		want                     goatcounter.Hit
+	}{
+		{"form", "application/x-www-form-urlencoded",
+			url.Values{"p": {"/form"}, "t": {"Title"}, "r": {"https://example.com"}, "s": {"1920,1080,2"}}.Encode(),
+			"", goatcounter.Hit{Path: "/form", Title: "Title", Ref: "example.com", Size: goatcounter.Floats{1920, 1080, 2}}},
+		{"form charset", "application/x-www-form-urlencoded; charset=utf-8",
+			url.Values{"p": {"event"}, "e": {"true"}}.Encode(),
+			"", goatcounter.Hit{Path: "event", Event: true}},
+		{"missing path", "application/x-www-form-urlencoded",
+			url.Values{"t": {"Title"}}.Encode(),
+			"invalid", goatcounter.Hit{}},
+		{"invalid bot", "application/x-www-form-urlencoded",
+			url.Values{"p": {"/form"}, "b": {"x"}}.Encode(),
+			"decode_error", goatcounter.Hit{}},
+		{"json", "application/json", `{"p": "/json", "t": "JSON"}`,
+			"", goatcounter.Hit{Path: "/json", Title: "JSON"}},
+		{"json no content-type", "", `{"p": "/json"}`,
+			"", goatcounter.Hit{Path: "/json"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			if tt.ct != "" {
+				r.Header.Set("Content-Type", tt.ct)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantCode {
+				t.Fatalf("X-Goatcounter-Code: have %q; want %q (X-Goatcounter: %q)",
+					have, tt.wantCode, rr.Header().Get("X-Goatcounter"))
+			}
+			if tt.wantCode != "" {
+				if len(hits) != 0 {
+					t.Fatalf("recorded %d hits", len(hits))
+				}
+				return
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			h := hits[0]
+			if h.Path != tt.want.Path || h.Title != tt.want.Title || h.Ref != tt.want.Ref ||
+				h.Event != tt.want.Event || !reflect.DeepEqual(h.Size, tt.want.Size) {
+				t.Errorf("\nhave: %q %q %q %t %v\nwant: %q %q %q %t %v",
+					h.Path, h.Title, h.Ref, h.Event, h.Size,
+					tt.want.Path, tt.want.Title, tt.want.Ref, tt.want.Event, tt.want.Size)
+			}
+		})
+	}
+}
+
+func TestBackendCountPrecedence(t *testing.T) {
+	tests := []struct {
+		name, precedence, query, ct, body string
+		wantPath, wantTitle               string
+	}{
+		{"body only", "", "", "application/json", `{"p": "/body", "t": "Body"}`, "/body", "Body"},
+		{"query only", "", "p=/query&t=Query", "", "", "/query", "Query"},
+		{"query only, query precedence", "query", "p=/query&t=Query", "", "", "/query", "Query"},
+
+		{"both", "", "p=/query&t=Query", "application/json", `{"p": "/body", "t": "Body"}`, "/body", "Body"},
+		{"both, body precedence", "body", "p=/query&t=Query", "application/json", `{"p": "/body", "t": "Body"}`, "/body", "Body"},
+		{"both, query precedence", "query", "p=/query&t=Query", "application/json", `{"p": "/body", "t": "Body"}`, "/query", "Query"},
+		{"both, form", "query", "p=/query", "application/x-www-form-urlencoded", "p=/body&t=Body", "/query", "Body"},
+
+		{"fallback to query", "", "p=/query&t=Query", "application/json", `{"p": "/body"}`, "/body", "Query"},
+		{"fallback to body", "query", "p=/query", "application/json", `{"p": "/body", "t": "Body"}`, "/query", "Body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			site := Site(ctx)
+			site.Settings.CountPrecedence = tt.precedence
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count?"+tt.query, strings.NewReader(tt.body))
+			if tt.ct != "" {
+				r.Header.Set("Content-Type", tt.ct)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if h := hits[0]; h.Path != tt.wantPath || h.Title != tt.wantTitle {
+				t.Errorf("\nhave: %q %q\nwant: %q %q", h.Path, h.Title, tt.wantPath, tt.wantTitle)
+			}
+		})
+	}
+}
+
+func TestBackendCountMaintenance(t *testing.T) {
+	ctx := gctest.DB(t)
+	t.Cleanup(func() { goatcounter.SetMaintenance(false) })
+
+	u := User(ctx)
+	u.Access = goatcounter.UserAccesses{"all": goatcounter.AccessSuperuser}
+	err := u.Update(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toggle := func(t *testing.T, enable string) {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/bosmang/maintenance", strings.NewReader("enable="+enable))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		login(t, r)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+	}
+	count := func(t *testing.T) (*httptest.ResponseRecorder, []goatcounter.Hit) {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		hits, err := goatcounter.Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr, hits
+	}
+
+	toggle(t, "true")
+	if !goatcounter.Maintenance() {
+		t.Fatal("maintenance mode not enabled")
+	}
+
+	rr, hits := count(t)
+	ztest.Code(t, rr, 503)
+	if have := rr.Header().Get("X-Goatcounter"); have != "maintenance" {
+		t.Errorf("X-Goatcounter: %q", have)
+	}
+	if have := rr.Header().Get("X-Goatcounter-Code"); have != "maintenance" {
+		t.Errorf("X-Goatcounter-Code: %q", have)
+	}
+	if len(hits) != 0 {
+		t.Errorf("recorded %d hits", len(hits))
+	}
+
+	// Dashboard still works.
+	r, rr := newTest(ctx, "GET", "/", nil)
+	login(t, r)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	toggle(t, "false")
+	if goatcounter.Maintenance() {
+		t.Fatal("maintenance mode not disabled")
+	}
+	rr, hits = count(t)
+	ztest.Code(t, rr, 200)
+	if len(hits) != 1 {
+		t.Errorf("recorded %d hits", len(hits))
+	}
+}
+
+func TestBackendCountSignature(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2023-11-14 22:13:20")
+
+	site := Site(ctx)
+	site.Settings.RequireSignature = true
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := site.Settings.SignatureSecret
+	if secret == "" {
+		t.Fatal("SignatureSecret not set")
+	}
+
+	now := ztime.Now()
+	tests := []struct {
+		name, header, body, wantCode string
+	}{
+		{"valid header", goatcounter.SignPath(secret, "/x", now), `{"p": "/x"}`, ""},
+		{"valid body", "", `{"p": "/x", "sig": "` + goatcounter.SignPath(secret, "/x", now) + `"}`, ""},
+		{"missing", "", `{"p": "/x"}`, "bad_signature"},
+		{"expired", goatcounter.SignPath(secret, "/x", now.Add(-time.Hour)), `{"p": "/x"}`, "bad_signature"},
+		{"other path", goatcounter.SignPath(secret, "/other", now), `{"p": "/x"}`, "bad_signature"},
+		{"forged", goatcounter.SignPath("forged", "/x", now), `{"p": "/x"}`, "bad_signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			if tt.header != "" {
+				r.Header.Set("X-Goatcounter-Signature", tt.header)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantCode {
+				t.Fatalf("X-Goatcounter-Code: have %q; want %q", have, tt.wantCode)
+			}
+			if tt.wantCode == "" {
+				ztest.Code(t, rr, 200)
+				if len(hits) != 1 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+				return
+			}
+
+			ztest.Code(t, rr, 403)
+			if have := rr.Header().Get("X-Goatcounter"); have != "bad signature" {
+				t.Errorf("X-Goatcounter: %q", have)
+			}
+			if len(hits) != 0 {
+				t.Errorf("recorded %d hits", len(hits))
+			}
+		})
+	}
+}
+
+func TestBackendCountRequireHeader(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2023-11-14 22:13:20")
+
+	site := Site(ctx)
+	site.Settings.RequireHeader = "X-My-Embed"
+	site.Settings.RequireHeaderValue = "v1-embed"
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, header, value string
+		requireSig, sign    bool
+		wantCode            string
+	}{
+		{"correct", "X-My-Embed", "v1-embed", false, false, ""},
+		{"header case", "x-my-embed", "v1-embed", false, false, ""},
+		{"wrong value", "X-My-Embed", "v2-embed", false, false, "missing_header"},
+		{"value case", "X-My-Embed", "V1-EMBED", false, false, "missing_header"},
+		{"empty value", "X-My-Embed", "", false, false, "missing_header"},
+		{"missing", "", "", false, false, "missing_header"},
+		{"other header", "X-Other", "v1-embed", false, false, "missing_header"},
+
+		// With signatures both need to be valid.
+		{"signed", "X-My-Embed", "v1-embed", true, true, ""},
+		{"signed, missing", "", "", true, true, "missing_header"},
+		{"unsigned", "X-My-Embed", "v1-embed", true, false, "bad_signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site.Settings.RequireSignature = tt.requireSig
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			if tt.sign {
+				r.Header.Set("X-Goatcounter-Signature", goatcounter.SignPath(site.Settings.SignatureSecret, "/x", ztime.Now()))
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantCode {
+				t.Fatalf("X-Goatcounter-Code: have %q; want %q", have, tt.wantCode)
+			}
+			if tt.wantCode == "" {
+				ztest.Code(t, rr, 200)
+				if len(hits) != 1 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+				return
+			}
+
+			ztest.Code(t, rr, 403)
+			if tt.wantCode == "missing_header" {
+				if have := rr.Header().Get("X-Goatcounter"); have != "missing required header" {
+					t.Errorf("X-Goatcounter: %q", have)
+				}
+			}
+			if len(hits) != 0 {
+				t.Errorf("recorded %d hits", len(hits))
+			}
+		})
+	}
+}
+
+func TestBackendCountNonce(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2023-11-14 22:13:20")
+	signatureNonces = newNonceCache(100)
+	defer func() { signatureNonces = newNonceCache(100_000) }()
+
+	site := Site(ctx)
+	site.Settings.RequireSignature = true
+	site.Settings.RequireNonce = true
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := site.Settings.SignatureSecret
+
+	send := func(t *testing.T, sig, wantCode string) {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+		r.Header.Set("X-Goatcounter-Signature", sig)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		hits, err := goatcounter.Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := rr.Header().Get("X-Goatcounter-Code"); have != wantCode {
+			t.Fatalf("X-Goatcounter-Code: have %q; want %q (%s)", have, wantCode, rr.Header().Get("X-Goatcounter"))
+		}
+		if wantCode == "" {
+			ztest.Code(t, rr, 200)
+			if len(hits) != 1 {
+				t.Errorf("recorded %d hits", len(hits))
+			}
+			return
+		}
+		ztest.Code(t, rr, 403)
+		if len(hits) != 0 {
+			t.Errorf("recorded %d hits", len(hits))
+		}
+	}
+
+	sig := goatcounter.SignPathNonce(secret, "/x", "nonce-111", ztime.Now())
+	send(t, sig, "")
+	send(t, sig, "replay")
+	send(t, goatcounter.SignPathNonce(secret, "/x", "nonce-111", ztime.Now().Add(time.Second)), "replay")
+	send(t, goatcounter.SignPathNonce(secret, "/x", "nonce-222", ztime.Now()), "")
+	send(t, goatcounter.SignPath(secret, "/x", ztime.Now()), "bad_signature")
+
+	// Still remembered at the end of the signature's window.
+	ztime.SetNow(t, "2023-11-14 22:23:20")
+	send(t, sig, "replay")
+
+	// Can be used again after the window.
+	ztime.SetNow(t, "2023-11-14 23:13:20")
+	send(t, goatcounter.SignPathNonce(secret, "/x", "nonce-111", ztime.Now()), "")
+}
+
+func TestCountRequestID(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	site := goatcounter.Site{ID: 1}
+	site.Settings.Defaults(context.Background())
+	ctx := goatcounter.WithSite(goatcounter.NewConfig(context.Background()), &site)
+
+	deps := &fakeCountDeps{now: now}
+	send := func(body, ip string, wantCode int, wantX string) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/count", strings.NewReader(body)).WithContext(ctx)
+		r.RemoteAddr = ip + ":5678"
+		rr := httptest.NewRecorder()
+		err := backend{deps: deps}.count(rr, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ztest.Code(t, rr, wantCode)
+		if have := rr.Header().Get("X-Goatcounter-Code"); have != wantX {
+			t.Errorf("X-Goatcounter-Code: have %q; want %q (%s)", have, wantX, rr.Header().Get("X-Goatcounter"))
+		}
+	}
+
+	// Same request from the CDN shield and edge.
+	send(`{"p": "/x", "rid": "TestCountRequestID-1"}`, "1.2.3.4", 200, "")
+	send(`{"p": "/x", "rid": "TestCountRequestID-1"}`, "5.6.7.8", 202, countDuplicate)
+	if len(deps.hits) != 1 {
+		t.Fatalf("appended %d hits", len(deps.hits))
+	}
+
+	// Different path or ID, or no ID.
+	send(`{"p": "/y", "rid": "TestCountRequestID-1"}`, "5.6.7.8", 200, "")
+	send(`{"p": "/x", "rid": "TestCountRequestID-2"}`, "5.6.7.8", 200, "")
+	send(`{"p": "/x"}`, "1.2.3.4", 200, "")
+	send(`{"p": "/x"}`, "1.2.3.4", 200, "")
+	if len(deps.hits) != 5 {
+		t.Fatalf("appended %d hits", len(deps.hits))
+	}
+
+	// Recorded again after the window.
+	deps.now = now.Add(2 * requestIDWindow)
+	send(`{"p": "/x", "rid": "TestCountRequestID-1"}`, "5.6.7.8", 200, "")
+	if len(deps.hits) != 6 {
+		t.Fatalf("appended %d hits", len(deps.hits))
+	}
+}
+
+func TestRequestIDCache(t *testing.T) {
+	var (
+		c   = newRequestIDCache(2, time.Second)
+		now = time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	)
+	seen := func(site int64, id, path string, now time.Time, want bool) {
+		t.Helper()
+		if have := c.seen(site, id, path, now); have != want {
+			t.Errorf("%d %s %s: %t", site, id, path, have)
+		}
+	}
+
+	seen(1, "a", "/x", now, false)
+	seen(1, "a", "/x", now, true)
+	seen(2, "a", "/x", now, false)
+	seen(1, "b", "/x", now, false) // Over the limit: not remembered.
+	seen(1, "b", "/x", now, false)
+
+	// Previous generation is still checked.
+	now = now.Add(time.Second)
+	seen(1, "a", "/x", now, true)
+	seen(1, "b", "/x", now, false)
+	seen(1, "b", "/x", now, true)
+
+	now = now.Add(time.Second)
+	seen(1, "a", "/x", now, false)
+
+	// Evict rotates the generations without new pageviews.
+	c.Evict(now.Add(2*time.Second), 0)
+	if c.Len() != 0 {
+		t.Errorf("Len: %d", c.Len())
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	var (
+		c   = newNonceCache(2)
+		now = time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	)
+	use := func(site int64, nonce string, now time.Time, wantErr string) {
+		t.Helper()
+		err := c.use(site, nonce, now)
+		if !ztest.ErrorContains(err, wantErr) {
+			t.Errorf("%d %s: %v", site, nonce, err)
+		}
+	}
+
+	use(1, "a", now, "")
+	use(1, "b", now, "")
+	use(1, "c", now, "too many nonces")
+	use(2, "a", now, "")
+	use(1, "a", now, "already used")
+
+	// Previous generation is still checked, but the limit is for the current
+	// generation only.
+	now = now.Add(2 * goatcounter.SignatureMaxAge)
+	use(1, "a", now, "already used")
+	use(1, "c", now, "")
+	use(1, "d", now, "")
+	use(1, "e", now, "too many nonces")
+
+	now = now.Add(2 * goatcounter.SignatureMaxAge)
+	use(1, "a", now, "")
+	use(1, "c", now, "already used")
+
+	now = now.Add(4 * goatcounter.SignatureMaxAge)
+	use(1, "c", now, "")
+	if l := len(c.cur[1]) + len(c.prev[1]); l != 1 {
+		t.Errorf("%d nonces", l)
+	}
+
+	// Evict rotates the generations without new nonces, but never before the
+	// signature expires.
+	c.Evict(now.Add(goatcounter.SignatureMaxAge), 0)
+	if c.Len() != 1 {
+		t.Errorf("%d nonces", c.Len())
+	}
+	c.Evict(now.Add(4*goatcounter.SignatureMaxAge), 0)
+	if c.Len() != 0 {
+		t.Errorf("%d nonces", c.Len())
+	}
+}
+
+func TestBackendCountEdgeSession(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.EdgeSessions = true
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := site.Settings.EdgeSessionSecret
+	if secret == "" {
+		t.Fatal("EdgeSessionSecret not set")
+	}
+
+	var (
+		tokenA = goatcounter.SignSession(secret, "aaaaaaaaaaaaaaaa")
+		tokenB = goatcounter.SignSession(secret, "bbbbbbbbbbbbbbbb")
+	)
+	tests := []struct {
+		name, token, peer, proxies, ua string
+		wantCode                       string
+	}{
+		{"a", tokenA, "192.0.2.1:1234", "", "Mozilla/5.0 a", ""},
+		{"a other IP and UA", tokenA, "192.0.2.2:1234", "", "Mozilla/5.0 b", ""},
+		{"b", tokenB, "192.0.2.1:1234", "", "Mozilla/5.0 a", ""},
+		{"trusted proxy", tokenA, "192.0.2.1:1234", "192.0.2.0/24", "Mozilla/5.0 a", ""},
+
+		{"missing", "", "192.0.2.1:1234", "", "Mozilla/5.0 a", "bad_session"},
+		{"unsigned", "aaaaaaaaaaaaaaaa", "192.0.2.1:1234", "", "Mozilla/5.0 a", "bad_session"},
+		{"spoofed", goatcounter.SignSession("forged", "aaaaaaaaaaaaaaaa"), "192.0.2.1:1234", "", "Mozilla/5.0 a", "bad_session"},
+		{"untrusted proxy", tokenA, "192.0.2.1:1234", "10.0.0.0/8", "Mozilla/5.0 a", "bad_session"},
+	}
+
+	sessions := make(map[string]zint.Uint128)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := goatcounter.Config(ctx)
+			c.ClientIPProxies = nil
+			if tt.proxies != "" {
+				c.ClientIPProxies = []netip.Prefix{netip.MustParsePrefix(tt.proxies)}
+			}
+			defer func() { c.ClientIPProxies = nil }()
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.RemoteAddr = tt.peer
+			r.Header.Set("User-Agent", tt.ua)
+			if tt.token != "" {
+				r.Header.Set("X-Goatcounter-Session", tt.token)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantCode {
+				t.Fatalf("X-Goatcounter-Code: have %q; want %q (%s)", have, tt.wantCode, rr.Header().Get("X-Goatcounter"))
+			}
+			if tt.wantCode != "" {
+				ztest.Code(t, rr, 403)
+				if len(hits) != 0 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+				return
+			}
+
+			ztest.Code(t, rr, 200)
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if hits[0].Session.IsZero() {
+				t.Fatal("no session")
+			}
+			session, _, _ := strings.Cut(tt.token, ".")
+			if prev, ok := sessions[session]; ok && prev != hits[0].Session {
+				t.Errorf("different session for the same token: %s and %s", prev, hits[0].Session)
+			}
+			for k, v := range sessions {
+				if k != session && v == hits[0].Session {
+					t.Errorf("same session for different tokens: %s", v)
+				}
+			}
+			sessions[session] = hits[0].Session
+		})
+	}
+}
+
+func TestBackendCountEmptyUA(t *testing.T) {
+	tests := []struct {
+		policy   string
+		ua       string
+		wantCode string
+		wantBot  int
+	}{
+		{"", "", "", isbot.BotShort},
+		{goatcounter.EmptyUADetect, "", "", isbot.BotShort},
+		{goatcounter.EmptyUABot, "", "", goatcounter.BotEmptyUA},
+		{goatcounter.EmptyUADrop, "", "empty_ua", 0},
+		{goatcounter.EmptyUACount, "", "", 0},
+
+		// Only applies to empty User-Agents.
+		{goatcounter.EmptyUABot, "Go-http-client/1.1", "", isbot.BotShort},
+		{goatcounter.EmptyUADrop, "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.ua, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			goatcounter.Config(ctx).EmptyUA = tt.policy
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.Header.Set("User-Agent", tt.ua)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantCode {
+				t.Fatalf("X-Goatcounter-Code: have %q; want %q", have, tt.wantCode)
+			}
+			if tt.wantCode != "" {
+				ztest.Code(t, rr, 202)
+				if len(hits) != 0 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+				return
+			}
+
+			ztest.Code(t, rr, 200)
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if hits[0].Bot != tt.wantBot {
+				t.Errorf("Bot: have %d; want %d", hits[0].Bot, tt.wantBot)
+			}
+			if counts := hits[0].CountsAsPageview(ctx); counts != (tt.wantBot == 0) {
+				t.Errorf("CountsAsPageview: %t", counts)
+			}
+		})
+	}
+}
+
+func TestBackendCountClientBots(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.ClientBots = goatcounter.BotRange{Min: 100, Max: 119}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := goatcounter.Site{Code: "other"}
+	err = other.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		site     *goatcounter.Site
+		bot      int
+		wantCode string
+	}{
+		{site, 100, ""},
+		{site, 119, ""},
+		{site, 150, ""},
+		{site, 99, "invalid_bot"},
+		{site, 120, "invalid_bot"},
+		{site, 5, "invalid_bot"},
+		{&other, 100, "invalid_bot"},
+		{&other, 150, ""},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d", tt.site.Code, tt.bot), func(t *testing.T) {
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(fmt.Sprintf(`{"p": "/x", "b": %d}`, tt.bot)))
+			r.Host = tt.site.Code + "." + goatcounter.Config(ctx).Domain
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantCode {
+				t.Fatalf("X-Goatcounter-Code: have %q; want %q", have, tt.wantCode)
+			}
+			if tt.wantCode != "" {
+				ztest.Code(t, rr, 400)
+				if len(hits) != 0 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+				return
+			}
+
+			ztest.Code(t, rr, 200)
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if hits[0].Bot != tt.bot {
+				t.Errorf("Bot: have %d; want %d", hits[0].Bot, tt.bot)
+			}
+		})
+	}
+}
+
+func TestBackendCountUnknownSite(t *testing.T) {
+	tests := []struct {
+		mode         string
+		wantStatus   int
+		wantCode     string
+		wantRecorded bool
+	}{
+		{"", 200, "", false},
+		{goatcounter.UnknownSiteGIF, 200, "", false},
+		{goatcounter.UnknownSite404, 404, "unknown_site", false},
+		{goatcounter.UnknownSiteCreate, 200, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			goatcounter.Config(ctx).UnknownSite = tt.mode
+			// Otherwise it uses the only site; creating only works when
+			// self-hosting.
+			goatcounter.Config(ctx).GoatcounterCom = tt.mode != goatcounter.UnknownSiteCreate
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.Host = "unknown.example.com"
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ztest.Code(t, rr, tt.wantStatus)
+			if have := rr.Header().Get("Content-Type"); have != "image/gif" {
+				t.Errorf("Content-Type: %q", have)
+			}
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantCode {
+				t.Errorf("X-Goatcounter-Code: have %q; want %q", have, tt.wantCode)
+			}
+			if tt.wantCode != "" && rr.Header().Get("X-Goatcounter") != "unknown site" {
+				t.Errorf("X-Goatcounter: %q", rr.Header().Get("X-Goatcounter"))
+			}
+
+			var site goatcounter.Site
+			err = site.ByHost(ctx, "unknown.example.com")
+			if tt.wantRecorded {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if site.Parent == nil || *site.Parent != Site(ctx).ID {
+					t.Errorf("wrong parent: %v", site.Parent)
+				}
+				if len(hits) != 1 || hits[0].Site != site.ID {
+					t.Errorf("hits not recorded for the new site: %v", hits)
+				}
+			} else {
+				if !zdb.ErrNoRows(err) {
+					t.Errorf("site exists: %v", err)
+				}
+				if len(hits) != 0 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+			}
+		})
+	}
+
+	t.Run("secrets", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		goatcounter.Config(ctx).UnknownSite = goatcounter.UnknownSiteCreate
+		goatcounter.Config(ctx).GoatcounterCom = false
+
+		account := Site(ctx)
+		account.Settings.Public = "secret"
+		account.Settings.Secret = "accountsecret"
+		account.Settings.RequireSignature = true
+		account.Settings.EdgeSessions = true
+		account.Settings.ExperimentParams = goatcounter.Strings{"variant"}
+		account.Settings.StatsHook.URL = "https://example.com/hook"
+		account.Settings.StatsHook.Interval = 24
+		err := account.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+		r.Host = "unknown.example.com"
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		_, _ = goatcounter.Memstore.Persist(ctx)
+		ztest.Code(t, rr, 403) // No signature, but the site is created.
+
+		var site goatcounter.Site
+		err = site.ByHost(ctx, "unknown.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if site.Settings.Public != "secret" || !site.Settings.RequireSignature || site.Settings.StatsHook.URL == "" {
+			t.Errorf("settings not copied: %#v", site.Settings)
+		}
+		for _, s := range [][]string{
+			{"secret", site.Settings.Secret, account.Settings.Secret},
+			{"signature_secret", site.Settings.SignatureSecret, account.Settings.SignatureSecret},
+			{"edge_session_secret", site.Settings.EdgeSessionSecret, account.Settings.EdgeSessionSecret},
+			{"experiment_secret", site.Settings.ExperimentSecret, account.Settings.ExperimentSecret},
+			{"stats_hook.secret", site.Settings.StatsHook.Secret, account.Settings.StatsHook.Secret},
+		} {
+			if s[1] == "" || s[1] == s[2] {
+				t.Errorf("%s: %q; account has %q", s[0], s[1], s[2])
+			}
+		}
+	})
+
+	// Still use the only site if there's just one.
+	t.Run("one site", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		goatcounter.Config(ctx).UnknownSite = goatcounter.UnknownSite404
+		goatcounter.Config(ctx).GoatcounterCom = false
+
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+		r.Host = "unknown.example.com"
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		_, _ = goatcounter.Memstore.Persist(ctx)
+		ztest.Code(t, rr, 200)
+	})
+}
+
+func TestBackendCountIPHost(t *testing.T) {
+	count := func(t *testing.T, ctx context.Context, host string) (*httptest.ResponseRecorder, []goatcounter.Hit) {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+		r.Host = host
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		hits, err := goatcounter.Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ztest.Code(t, rr, 200)
+		return rr, hits
+	}
+	hosts := []string{"192.0.2.1", "192.0.2.1:8080", "[2001:db8::1]", "[2001:db8::1]:8080"}
+
+	t.Run("catch-all", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		catchAll := goatcounter.Site{Code: "catch-all", Parent: &Site(ctx).ID}
+		err := catchAll.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		goatcounter.Config(ctx).IPHost = goatcounter.IPHostSite
+		goatcounter.Config(ctx).IPHostSiteID = catchAll.ID
+
+		for _, h := range hosts {
+			_, hits := count(t, ctx, h)
+			if len(hits) != 1 || hits[0].Site != catchAll.ID {
+				t.Errorf("%s: %v", h, hits)
+			}
+		}
+
+		// Regular hosts aren't affected.
+		_, hits := count(t, ctx, "gctest.localhost")
+		if len(hits) != 1 || hits[0].Site != Site(ctx).ID {
+			t.Errorf("%v", hits)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		goatcounter.Config(ctx).IPHost = goatcounter.IPHostDrop
+
+		for _, h := range hosts {
+			rr, hits := count(t, ctx, h)
+			if len(hits) != 0 {
+				t.Errorf("%s: recorded %v", h, hits)
+			}
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != "ip_host" {
+				t.Errorf("%s: X-Goatcounter-Code: %q", h, have)
+			}
+			if have := rr.Header().Get("Content-Type"); have != "image/gif" {
+				t.Errorf("%s: Content-Type: %q", h, have)
+			}
+		}
+	})
+
+	t.Run("catch-all doesn't exist", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		goatcounter.Config(ctx).IPHost = goatcounter.IPHostSite
+		goatcounter.Config(ctx).IPHostSiteID = 999
+
+		rr, hits := count(t, ctx, "192.0.2.1")
+		if len(hits) != 0 || rr.Header().Get("X-Goatcounter-Code") != "ip_host" {
+			t.Errorf("%v %v", hits, rr.Header())
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		goatcounter.Config(ctx).GoatcounterCom = false
+
+		// Uses the only site.
+		_, hits := count(t, ctx, "192.0.2.1")
+		if len(hits) != 1 || hits[0].Site != Site(ctx).ID {
+			t.Errorf("%v", hits)
+		}
+	})
+}
+
+func TestBackendCountUnknownSiteVerify(t *testing.T) {
+	origLookup, origCreate, origVerify := lookupTXT, rateLimits.siteCreate, rateLimits.siteVerify
+	t.Cleanup(func() {
+		lookupTXT, rateLimits.siteCreate, rateLimits.siteVerify = origLookup, origCreate, origVerify
+		siteCreateRate, siteVerifyRate = mware.NewRatelimitMemory(), mware.NewRatelimitMemory()
+		unverifiedHosts.Reset()
+	})
+	var lookups []string
+	lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		lookups = append(lookups, name)
+		switch name {
+		case "_goatcounter.verified.example.com", "_goatcounter.verified-1.example.com",
+			"_goatcounter.verified-2.example.com", "_goatcounter.verified-3.example.com":
+			return []string{"v=spf1 -all", goatcounter.VerifyTXT}, nil
+		case "_goatcounter.wrong.example.com":
+			return []string{"goatcounter-verify=other"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	count := func(t *testing.T, ctx context.Context, host string) []goatcounter.Hit {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+		r.Host = host
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		hits, err := goatcounter.Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ztest.Code(t, rr, 200)
+		return hits
+	}
+	setup := func(t *testing.T) context.Context {
+		ctx := gctest.DB(t)
+		goatcounter.Config(ctx).UnknownSite = goatcounter.UnknownSiteVerify
+		goatcounter.Config(ctx).GoatcounterCom = false
+		siteCreateRate, siteVerifyRate = mware.NewRatelimitMemory(), mware.NewRatelimitMemory()
+		unverifiedHosts.Reset()
+		lookups = nil
+		return ctx
+	}
+
+	t.Run("verified", func(t *testing.T) {
+		ctx := setup(t)
+		account := Site(ctx)
+		account.Settings.Public = "public"
+		err := account.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hits := count(t, ctx, "verified.example.com:8080")
+
+		var site goatcounter.Site
+		err = site.ByHost(ctx, "verified.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if site.Parent == nil || *site.Parent != account.ID {
+			t.Errorf("wrong parent: %v", site.Parent)
+		}
+		if site.Settings.Public != "private" {
+			t.Errorf("settings not the defaults: %q", site.Settings.Public)
+		}
+		if len(hits) != 1 || hits[0].Site != site.ID {
+			t.Errorf("hits not recorded for the new site: %v", hits)
+		}
+	})
+
+	t.Run("unverified", func(t *testing.T) {
+		ctx := setup(t)
+		for _, host := range []string{"unverified.example.com", "wrong.example.com"} {
+			t.Run(host, func(t *testing.T) {
+				hits := count(t, ctx, host)
+
+				var site goatcounter.Site
+				err := site.ByHost(ctx, host)
+				if !zdb.ErrNoRows(err) {
+					t.Errorf("site exists: %v", err)
+				}
+				if len(hits) != 0 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+			})
+		}
+
+		// Failed lookups are cached.
+		count(t, ctx, "unverified.example.com")
+		count(t, ctx, "wrong.example.com")
+		want := []string{"_goatcounter.unverified.example.com", "_goatcounter.wrong.example.com"}
+		if !slices.Equal(lookups, want) {
+			t.Errorf("\nhave: %v\nwant: %v", lookups, want)
+		}
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		ctx := setup(t)
+		SetRateLimit("site-create", 2, 3600)
+
+		// Hosts that aren't verified don't count towards the limit.
+		var have []string
+		for _, host := range []string{"unverified.example.com", "verified-1.example.com", "wrong.example.com",
+			"verified-2.example.com", "verified-3.example.com"} {
+			hits := count(t, ctx, host)
+			var site goatcounter.Site
+			if err := site.ByHost(ctx, host); err == nil {
+				have = append(have, fmt.Sprintf("%s:%d", host, len(hits)))
+			}
+		}
+		// Existing sites still work.
+		hits := count(t, ctx, "verified-1.example.com")
+		if len(hits) != 1 {
+			t.Errorf("recorded %d hits for existing site", len(hits))
+		}
+
+		want := []string{"verified-1.example.com:1", "verified-2.example.com:1"}
+		if !slices.Equal(have, want) {
+			t.Errorf("\nhave: %v\nwant: %v", have, want)
+		}
+
+	})
+
+	t.Run("verify rate limit", func(t *testing.T) {
+		ctx := setup(t)
+		SetRateLimit("site-verify", 2, 3600)
+
+		for _, host := range []string{"unverified.example.com", "wrong.example.com", "verified.example.com"} {
+			count(t, ctx, host)
+		}
+
+		// No DNS lookups once the rate limit is reached.
+		want := []string{"_goatcounter.unverified.example.com", "_goatcounter.wrong.example.com"}
+		if !slices.Equal(lookups, want) {
+			t.Errorf("\nhave: %v\nwant: %v", lookups, want)
+		}
+		var site goatcounter.Site
+		if err := site.ByHost(ctx, "verified.example.com"); !zdb.ErrNoRows(err) {
+			t.Errorf("site created after the rate limit: %v", err)
+		}
+	})
+}
+
+type fakeCountDeps struct {
+	now        time.Time
+	bot        isbot.Result
+	loc        string
+	asn        goatcounter.ASN
+	hits       []goatcounter.Hit
+	persistErr error
+
+	countryLookups int
+}
+
+func (d *fakeCountDeps) Append(hits ...goatcounter.Hit)                 { d.hits = append(d.hits, hits...) }
+func (d *fakeCountDeps) Now() time.Time                                 { return d.now }
+func (d *fakeCountDeps) Bot(r *http.Request) isbot.Result               { return d.bot }
+func (d *fakeCountDeps) LookupIP(ctx context.Context, ip string) string { return d.loc }
+func (d *fakeCountDeps) LookupCountry(ctx context.Context, ip string) string {
+	d.countryLookups++
+	c, _, _ := strings.Cut(d.loc, "-")
+	return c
+}
+func (d *fakeCountDeps) LookupASN(ip string) goatcounter.ASN { return d.asn }
+func (d *fakeCountDeps) Persist(ctx context.Context, hit goatcounter.Hit) error {
+	if d.persistErr != nil {
+		return d.persistErr
+	}
+	d.hits = append(d.hits, hit)
+	return nil
+}
+
+// Test the count handler without the database, GeoIP, or memstore.
+func TestCountDeps(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		body     string
+		bot      isbot.Result
+		setup    func(*goatcounter.Site)
+		wantCode int
+		wantX    string
+		want     string
+	}{
+		{"happy", `{"p": "/x", "t": "Title", "r": "https://example.com"}`, isbot.NoBotNoMatch, nil, 200, "",
+			`/x Title https://example.com bot=0 loc=NZ 2023-06-01 12:00:00 +0000 UTC`},
+		{"no location", `{"p": "/x"}`, isbot.NoBotNoMatch, func(s *goatcounter.Site) {
+			s.Settings.Collect &^= goatcounter.CollectLocation | goatcounter.CollectLocationRegion
+		}, 200, "", `/x   bot=0 loc= 2023-06-01 12:00:00 +0000 UTC`},
+
+		{"ignore IP", `{"p": "/x"}`, isbot.NoBotNoMatch, func(s *goatcounter.Site) {
+			s.Settings.IgnoreIPs = goatcounter.Strings{"1.2.3.0/24"}
+		}, 202, countIgnoredIP, ""},
+
+		{"bot backend", `{"p": "/x"}`, isbot.BotClientLibrary, nil, 200, "",
+			`/x   bot=4 loc=NZ 2023-06-01 12:00:00 +0000 UTC`},
+		{"bot client", `{"p": "/x", "b": 150}`, isbot.NoBotNoMatch, nil, 200, "",
+			`/x   bot=150 loc=NZ 2023-06-01 12:00:00 +0000 UTC`},
+		{"bot prefer backend", `{"p": "/x", "b": 150}`, isbot.BotClientLibrary, nil, 200, "",
+			`/x   bot=4 loc=NZ 2023-06-01 12:00:00 +0000 UTC`},
+		{"bot invalid", `{"p": "/x", "b": 5}`, isbot.NoBotNoMatch, nil, 400, countInvalidBot, ""},
+		{"bot prefetch", `{"p": "/x"}`, isbot.BotPrefetch, nil, 200, countPrefetch, ""},
+
+		{"decode error", `{"p": `, isbot.NoBotNoMatch, nil, 400, countDecodeError, ""},
+		{"decode error type", `{"p": 1}`, isbot.NoBotNoMatch, nil, 400, countDecodeError, ""},
+		{"invalid", `{"p": ""}`, isbot.NoBotNoMatch, nil, 400, countInvalid, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site := goatcounter.Site{ID: 1}
+			site.Settings.Defaults(context.Background())
+			if tt.setup != nil {
+				tt.setup(&site)
+				site.Settings.Defaults(context.Background())
+			}
+			ctx := goatcounter.WithSite(goatcounter.NewConfig(context.Background()), &site)
+
+			deps := &fakeCountDeps{now: now, bot: tt.bot, loc: "NZ"}
+			r := httptest.NewRequest("POST", "/count", strings.NewReader(tt.body)).WithContext(ctx)
+			r.RemoteAddr = "1.2.3.4:5678"
+			rr := httptest.NewRecorder()
+			err := backend{deps: deps}.count(rr, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ztest.Code(t, rr, tt.wantCode)
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantX {
+				t.Errorf("X-Goatcounter-Code: have %q; want %q (%s)", have, tt.wantX, rr.Header().Get("X-Goatcounter"))
+			}
+			if tt.want == "" {
+				if len(deps.hits) != 0 {
+					t.Errorf("appended %d hits", len(deps.hits))
+				}
+				return
+			}
+			if len(deps.hits) != 1 {
+				t.Fatalf("appended %d hits", len(deps.hits))
+			}
+			h := deps.hits[0]
+			have := fmt.Sprintf("%s %s %s bot=%d loc=%s %s", h.Path, h.Title, h.Ref, h.Bot, h.Location, h.CreatedAt)
+			if have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountSyncCount(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		mode      string
+		fail      bool
+		wantCode  int
+		wantX     string
+		wantStore bool
+	}{
+		{goatcounter.SyncCountOff, false, 200, "", true},
+		{goatcounter.SyncCountOff, true, 200, "", true}, // Persist isn't used.
+		{goatcounter.SyncCountGIF, false, 200, "", true},
+		{goatcounter.SyncCountGIF, true, 200, "", false},
+		{goatcounter.SyncCountError, false, 200, "", true},
+		{goatcounter.SyncCountError, true, 503, countStorageError, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%t", tt.mode, tt.fail), func(t *testing.T) {
+			site := goatcounter.Site{ID: 1}
+			site.Settings.Defaults(context.Background())
+			ctx := goatcounter.WithSite(goatcounter.NewConfig(context.Background()), &site)
+			goatcounter.Config(ctx).SyncCount = tt.mode
+
+			deps := &fakeCountDeps{now: now}
+			if tt.fail {
+				deps.persistErr = errors.New("database is on fire")
+			}
+			r := httptest.NewRequest("POST", "/count", strings.NewReader(`{"p": "/x"}`)).WithContext(ctx)
+			r.RemoteAddr = "1.2.3.4:5678"
+			rr := httptest.NewRecorder()
+			err := backend{deps: deps}.count(rr, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ztest.Code(t, rr, tt.wantCode)
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantX {
+				t.Errorf("X-Goatcounter-Code: have %q; want %q (%s)", have, tt.wantX, rr.Header().Get("X-Goatcounter"))
+			}
+			if tt.wantX != "" && rr.Header().Get("X-Goatcounter") != "storage error" {
+				t.Errorf("X-Goatcounter: %q", rr.Header().Get("X-Goatcounter"))
+			}
+			if have := len(deps.hits) == 1; have != tt.wantStore {
+				t.Errorf("stored %d hits", len(deps.hits))
+			}
+			if rr.Body.Len() != len(gif) {
+				t.Errorf("body is not the GIF: %q", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestCountGeoDegrade(t *testing.T) {
+	defer goatcounter.SetGeoDegrade(0, 0)
+	goatcounter.SetGeoDegrade(3, 5)
+
+	site := goatcounter.Site{ID: 1}
+	site.Settings.Defaults(context.Background())
+	ctx := goatcounter.WithSite(goatcounter.NewConfig(context.Background()), &site)
+	deps := &fakeCountDeps{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC), loc: "NZ-AUK"}
+
+	var held []func()
+	count := func(t *testing.T, load int, want string) {
+		t.Helper()
+		for ; len(held) < load; held = append(held, goatcounter.GeoLoad()) {
+		}
+		for ; len(held) > load; held = held[:len(held)-1] {
+			held[len(held)-1]()
+		}
+
+		deps.hits = nil
+		r := httptest.NewRequest("POST", "/count", strings.NewReader(`{"p": "/x"}`)).WithContext(ctx)
+		r.RemoteAddr = "1.2.3.4:5678"
+		rr := httptest.NewRecorder()
+		err := backend{deps: deps}.count(rr, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ztest.Code(t, rr, 200)
+		if len(deps.hits) != 1 {
+			t.Fatalf("appended %d hits", len(deps.hits))
+		}
+		if have := deps.hits[0].Location; have != want {
+			t.Errorf("load %d: location %q; want %q", load, have, want)
+		}
+	}
+
+	count(t, 0, "NZ-AUK")
+	count(t, 1, "NZ-AUK")
+	count(t, 2, "NZ") // Including this request.
+	count(t, 4, "")
+	count(t, 2, "NZ")
+	count(t, 0, "NZ-AUK")
+
+	if deps.countryLookups != 2 {
+		t.Errorf("%d country lookups; want 2", deps.countryLookups)
+	}
+	if mode, inflight := goatcounter.GeoMode(); mode != goatcounter.GeoModeFull || inflight != 0 {
+		t.Errorf("mode %q with %d in progress after the requests", mode, inflight)
+	}
+}
+
+func TestCountASN(t *testing.T) {
+	var (
+		now         = time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+		datacenter  = goatcounter.ASN{Number: 16509, Org: "AMAZON-02"}
+		residential = goatcounter.ASN{Number: 1136, Org: "KPN B.V."}
+	)
+	tests := []struct {
+		name    string
+		asn     goatcounter.ASN
+		bot     isbot.Result
+		collect bool
+		flag    bool
+		want    string
+	}{
+		{"not collected", residential, isbot.NoBotNoMatch, false, false, "bot=0 asn=0 org="},
+		{"residential", residential, isbot.NoBotNoMatch, true, false, "bot=0 asn=1136 org=KPN B.V."},
+		{"datacenter", datacenter, isbot.NoBotNoMatch, true, false, "bot=0 asn=16509 org=AMAZON-02"},
+		{"unknown", goatcounter.ASN{}, isbot.NoBotNoMatch, true, true, "bot=0 asn=0 org="},
+
+		{"flag residential", residential, isbot.NoBotNoMatch, true, true, "bot=0 asn=1136 org=KPN B.V."},
+		{"flag datacenter", datacenter, isbot.NoBotNoMatch, true, true, "bot=97 asn=16509 org=AMAZON-02"},
+		{"flag not collected", datacenter, isbot.NoBotNoMatch, false, true, "bot=97 asn=0 org="},
+		{"flag prefer backend", datacenter, isbot.BotClientLibrary, true, true, "bot=4 asn=16509 org=AMAZON-02"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site := goatcounter.Site{ID: 1}
+			site.Settings.Defaults(context.Background())
+			if tt.collect {
+				site.Settings.Collect.Set(goatcounter.CollectASN)
+			}
+			site.Settings.FlagDatacenter = tt.flag
+			ctx := goatcounter.WithSite(goatcounter.NewConfig(context.Background()), &site)
+
+			deps := &fakeCountDeps{now: now, bot: tt.bot, asn: tt.asn}
+			r := httptest.NewRequest("POST", "/count", strings.NewReader(`{"p": "/x"}`)).WithContext(ctx)
+			r.RemoteAddr = "1.2.3.4:5678"
+			rr := httptest.NewRecorder()
+			err := backend{deps: deps}.count(rr, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ztest.Code(t, rr, 200)
+			if len(deps.hits) != 1 {
+				t.Fatalf("appended %d hits", len(deps.hits))
+			}
+			h := deps.hits[0]
+			if have := fmt.Sprintf("bot=%d asn=%d org=%s", h.Bot, h.ASN, h.ASNOrg); have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendCountNormalize(t *testing.T) {
+	tests := []struct {
+		body             url.Values
+		wantPath         string
+		wantCode, reason string
+	}{
+		{url.Values{"p": {"/page/?utm_source=x&id=1"}}, "/page/?id=1", "", ""},
+		{url.Values{"p": {"/page/#section"}}, "/page", "", ""},
+		{url.Values{"p": {"/click"}, "e": {"true"}}, "click", "", ""},
+		{url.Values{"p": {"/x"}, "q": {"utm_campaign=launch"}}, "/x", "", ""},
+		{url.Values{"p": {"/favicon.ico"}}, "/favicon.ico", "not_stored", "ignored path"},
+		{url.Values{"p": {"/x"}, "r": {"http://localhost/"}}, "/x", "not_stored", `referrer "localhost" is on the spam list`},
+		{url.Values{"p": {"/x"}, "b": {"5"}}, "/x", "invalid_bot", "wrong value: b=5"},
+		{url.Values{"p": {""}}, "", "invalid", "not valid: path: must be set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body.Encode(), func(t *testing.T) {
+			ctx := gctest.DB(t)
+			site := Site(ctx)
+			site.Settings.StripFragment = true
+			site.Settings.InternalRefs = goatcounter.InternalRefsKeep
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count/normalize", strings.NewReader(tt.body.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			login(t, r)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+
+			var preview countPreview
+			zjson.MustUnmarshal(rr.Body.Bytes(), &preview)
+			if preview.Path != tt.wantPath || preview.Code != tt.wantCode || !strings.HasPrefix(preview.Reason, tt.reason) {
+				t.Fatalf("wrong preview\nhave: %#v\nwant: path=%q code=%q reason=%q",
+					preview, tt.wantPath, tt.wantCode, tt.reason)
+			}
+			if preview.Recorded != (tt.wantCode == "") {
+				t.Errorf("Recorded: %t", preview.Recorded)
+			}
+			if goatcounter.Memstore.Len() != 0 {
+				t.Fatal("added to the memstore")
+			}
+
+			// Compare with what /count actually records.
+			r, rr = newTest(ctx, "POST", "/count", strings.NewReader(tt.body.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != strings.TrimPrefix(preview.Code, "not_stored") {
+				t.Errorf("X-Goatcounter-Code: have %q; preview %q", have, preview.Code)
+			}
+			if !preview.Recorded {
+				if len(hits) != 0 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+				return
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if hits[0].Path != preview.Path || bool(hits[0].Event) != preview.Event || hits[0].Ref != preview.Ref {
+				t.Errorf("preview doesn't match\nhave: %q %t %q\nwant: %q %t %q",
+					preview.Path, preview.Event, preview.Ref, hits[0].Path, hits[0].Event, hits[0].Ref)
+			}
+		})
+	}
+
+	t.Run("decode error", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		r, rr := newTest(ctx, "POST", "/count/normalize", strings.NewReader(`{"p": `))
+		login(t, r)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 400)
+		if ct := rr.Result().Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("Content-Type: %q", ct)
+		}
+
+		var preview countPreview
+		zjson.MustUnmarshal(rr.Body.Bytes(), &preview)
+		if preview.Code != countDecodeError {
+			t.Errorf("code %q", preview.Code)
+		}
+	})
+
+	// Everything that's checked for /count is checked for the preview, not
+	// just the parameters.
+	t.Run("count checks", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		normalize := func(t *testing.T, url string) countPreview {
+			t.Helper()
+			r, rr := newTest(ctx, "POST", url, nil)
+			r.RemoteAddr = "1.2.3.4:5678"
+			login(t, r)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+			var preview countPreview
+			zjson.MustUnmarshal(rr.Body.Bytes(), &preview)
+			return preview
+		}
+
+		if p := normalize(t, "/count/normalize?p=/query"); p.Path != "/query" || !p.Recorded {
+			t.Errorf("query parameters: %#v", p)
+		}
+
+		site := Site(ctx)
+		site.Settings.IgnoreIPs = goatcounter.Strings{"1.2.3.4"}
+		err := site.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := normalize(t, "/count/normalize?p=/query"); p.Code != countIgnoredIP || p.Recorded {
+			t.Errorf("ignored IP: %#v", p)
+		}
+		if goatcounter.Memstore.Len() != 0 {
+			t.Fatal("added to the memstore")
+		}
+	})
+}
+
+func TestBackendCountTLS(t *testing.T) {
+	tests := []struct {
+		name        string
+		collect     bool
+		tls         *tls.ConnectionState
+		header      string // Value for X-TLS; not configured if empty.
+		proxies     string
+		wantVersion uint16
+		wantCipher  uint16
+	}{
+		{"not collected", false, &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}, "", "", 0, 0},
+		{"direct", true, &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}, "", "", tls.VersionTLS13, tls.TLS_AES_128_GCM_SHA256},
+		{"http", true, nil, "", "", 0, 0},
+
+		{"proxy", true, nil, "TLSv1.2 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		{"proxy numbers", true, nil, "0x0304 0x1302", "", tls.VersionTLS13, tls.TLS_AES_256_GCM_SHA384},
+		{"proxy caddy", true, nil, "tls1.3 TLS_CHACHA20_POLY1305_SHA256", "", tls.VersionTLS13, tls.TLS_CHACHA20_POLY1305_SHA256},
+		{"proxy openssl name", true, nil, "TLSv1.2 ECDHE-RSA-AES128-GCM-SHA256", "", tls.VersionTLS12, 0},
+		{"trusted proxy", true, nil, "TLSv1.3 TLS_AES_128_GCM_SHA256", "192.0.2.0/24", tls.VersionTLS13, tls.TLS_AES_128_GCM_SHA256},
+		{"untrusted proxy", true, nil, "TLSv1.3 TLS_AES_128_GCM_SHA256", "10.0.0.0/8", 0, 0},
+		{"proxy not collected", false, nil, "TLSv1.3 TLS_AES_128_GCM_SHA256", "", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			if tt.collect {
+				site.Settings.Collect.Set(goatcounter.CollectTLS)
+			}
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := goatcounter.Config(ctx)
+			if tt.header != "" {
+				c.TLSHeader = "X-Tls"
+			}
+			if tt.proxies != "" {
+				c.ClientIPProxies = []netip.Prefix{netip.MustParsePrefix(tt.proxies)}
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.RemoteAddr = "192.0.2.1:1234"
+			r.TLS = tt.tls
+			// Always send the header, to make sure it's not read if it's not
+			// configured.
+			r.Header.Set("X-Tls", "TLSv1.3 TLS_AES_128_GCM_SHA256")
+			if tt.header != "" {
+				r.Header.Set("X-Tls", tt.header)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits goatcounter.Hits
+			err = hits.TestList(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if hits[0].TLSVersion != tt.wantVersion || hits[0].TLSCipher != tt.wantCipher {
+				t.Errorf("\nhave: %#04x %#04x\nwant: %#04x %#04x",
+					hits[0].TLSVersion, hits[0].TLSCipher, tt.wantVersion, tt.wantCipher)
+			}
+		})
+	}
+}
+
+func TestBackendCountMinTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		tls      *tls.ConnectionState
+		header   string // Value for X-TLS; not configured if empty.
+		wantCode int
+	}{
+		{"below", &tls.ConnectionState{Version: tls.VersionTLS11}, "", 426},
+		{"at", &tls.ConnectionState{Version: tls.VersionTLS12}, "", 200},
+		{"above", &tls.ConnectionState{Version: tls.VersionTLS13}, "", 200},
+		{"http", nil, "", 426},
+
+		{"proxy below", nil, "TLSv1.1 TLS_RSA_WITH_AES_128_CBC_SHA", 426},
+		{"proxy at", nil, "TLSv1.2", 200},
+		{"proxy above", nil, "TLSv1.3 TLS_AES_128_GCM_SHA256", 200},
+		{"proxy unknown", nil, "SSLv3", 426},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			c := goatcounter.Config(ctx)
+			c.CountMinTLS = tls.VersionTLS12
+			if tt.header != "" {
+				c.TLSHeader = "X-Tls"
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.TLS = tt.tls
+			if tt.header != "" {
+				r.Header.Set("X-Tls", tt.header)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			code := rr.Header().Get("X-Goatcounter-Code")
+			if tt.wantCode == 426 && code != "tls_version" {
+				t.Errorf("X-Goatcounter-Code: %q", code)
+			}
+			if tt.wantCode == 200 && code != "" {
+				t.Errorf("X-Goatcounter-Code: %q; X-Goatcounter: %q", code, rr.Header().Values("X-Goatcounter"))
+			}
+
+			_, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBackendCountLongPaths(t *testing.T) {
+	var (
+		atLimit = "/" + strings.Repeat("a", 2047)
+		// Truncating at 2048 bytes would cut the € (3 bytes) in half.
+		beyond = "/" + strings.Repeat("a", 2046) + "€"
+	)
+	tests := []struct {
+		policy, path string
+		wantCode     int
+		wantPath     string
+		wantHeader   string
+	}{
+		{"", atLimit, 200, atLimit, ""},
+		{"", beyond, 414, "", "ignored because path is longer than 2048 bytes (2050 bytes)"},
+		{goatcounter.LongPathsReject, atLimit, 200, atLimit, ""},
+		{goatcounter.LongPathsReject, beyond, 414, "", "ignored because path is longer than 2048 bytes (2050 bytes)"},
+		{goatcounter.LongPathsTruncate, atLimit, 200, atLimit, ""},
+		{goatcounter.LongPathsTruncate, beyond, 200, beyond[:2047], "path truncated to 2047 bytes (2050 bytes)"},
+		{goatcounter.LongPathsBucket, atLimit, 200, atLimit, ""},
+		{goatcounter.LongPathsBucket, beyond, 200, "/__long__", "path is longer than 2048 bytes (2050 bytes); recorded as /__long__"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d", tt.policy, len(tt.path)), func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.Settings.LongPaths = tt.policy
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "`+tt.path+`"}`))
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+			if have := rr.Header().Get("X-Goatcounter"); have != tt.wantHeader {
+				t.Errorf("X-Goatcounter\nhave: %q\nwant: %q", have, tt.wantHeader)
+			}
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantPath == "" {
+				if len(hits) != 0 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+				return
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if hits[0].Path != tt.wantPath {
+				t.Errorf("path: %q", hits[0].Path)
+			}
+		})
+	}
+}
+
+func TestBackendCountReportTruncation(t *testing.T) {
+	long := "/" + strings.Repeat("a", 2046) + "€"
+	for _, report := range []bool{false, true} {
+		t.Run(fmt.Sprintf("%t", report), func(t *testing.T) {
+			ctx := gctest.DB(t)
+			site := Site(ctx)
+			site.Settings.LongPaths, site.Settings.ReportTruncation = goatcounter.LongPathsTruncate, report
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Run("count", func(t *testing.T) {
+				r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "`+long+`"}`))
+				newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+				ztest.Code(t, rr, 200)
+
+				want := []string{"path truncated to 2047 bytes (2050 bytes)"}
+				if report {
+					want = append(want, "path_length=2050; truncated_length=2047")
+				}
+				if have := rr.Header().Values("X-Goatcounter"); !reflect.DeepEqual(have, want) {
+					t.Errorf("X-Goatcounter\nhave: %q\nwant: %q", have, want)
+				}
+				_, err := goatcounter.Memstore.Persist(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			t.Run("stream", func(t *testing.T) {
+				deps := &fakeCountDeps{now: ztime.Now(), bot: isbot.NoBotNoMatch}
+				r, rr := newTest(ctx, "POST", "/count/stream", strings.NewReader("{\"p\": \"/a\"}\n{\"p\": \""+long+"\"}\n"))
+				err := backend{deps: deps}.countStream(rr, r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ztest.Code(t, rr, 200)
+
+				var have bytes.Buffer
+				err = json.Compact(&have, rr.Body.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := `{"recorded":2}`
+				if report {
+					want = `{"recorded":2,"truncated":[{"line":2,"length":2050,"truncated_length":2047}]}`
+				}
+				if have.String() != want {
+					t.Errorf("\nhave: %s\nwant: %s", have.String(), want)
+				}
+			})
+
+			t.Run("normalize", func(t *testing.T) {
+				r, rr := newTest(ctx, "POST", "/count/normalize", strings.NewReader(url.Values{"p": {long}}.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				login(t, r)
+				newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+				ztest.Code(t, rr, 200)
+
+				var preview countPreview
+				zjson.MustUnmarshal(rr.Body.Bytes(), &preview)
+				var want *countTruncation
+				if report {
+					want = &countTruncation{Length: 2050, Truncated: 2047}
+				}
+				if !reflect.DeepEqual(preview.Truncated, want) {
+					t.Errorf("\nhave: %#v\nwant: %#v", preview.Truncated, want)
+				}
+			})
+		})
+	}
+}
+
+func TestBackendCountType(t *testing.T) {
+	tests := []struct {
+		typ        string
+		reject     bool
+		wantCode   int
+		wantType   string
+		wantHeader string
+	}{
+		{"", false, 200, "pageview", ""},
+		{"pageview", false, 200, "pageview", ""},
+		{"download", false, 200, "download", ""},
+		{"outbound", false, 200, "outbound", ""},
+		{"download", true, 200, "download", ""},
+		{"video", false, 200, "pageview", `unknown type "video" recorded as pageview`},
+		{"video", true, 400, "", `unknown type: "video"`},
+		{"Download", true, 400, "", `unknown type: "Download"`},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %t", tt.typ, tt.reject), func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.Settings.RejectUnknownTypes = tt.reject
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := url.Values{"p": {"/file.pdf"}, "type": {tt.typ}}
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(body.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+			if have := rr.Header().Get("X-Goatcounter"); have != tt.wantHeader {
+				t.Errorf("X-Goatcounter\nhave: %q\nwant: %q", have, tt.wantHeader)
+			}
+			if tt.wantCode != 200 {
+				if have := rr.Header().Get("X-Goatcounter-Code"); have != "invalid_type" {
+					t.Errorf("X-Goatcounter-Code: %q", have)
+				}
+			}
+
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits goatcounter.Hits
+			err = hits.TestList(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantType == "" {
+				if len(hits) != 0 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+				return
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if hits[0].Type != tt.wantType {
+				t.Errorf("type: %q", hits[0].Type)
+			}
+			if counts := hits[0].CountsAsPageview(ctx); counts != (tt.wantType == "pageview") {
+				t.Errorf("CountsAsPageview: %t", counts)
+			}
+		})
+	}
+}
+
+func TestBackendCountBotNoContent(t *testing.T) {
+	firefox := "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0"
+	tests := []struct {
+		name      string
+		noContent bool
+		ua        string
+		header    http.Header
+		body      string
+		wantCode  int
+	}{
+		{"human", false, firefox, nil, `{"p": "/x"}`, 200},
+		{"human no content", true, firefox, nil, `{"p": "/x"}`, 200},
+		{"bot", false, "curl/8.0", nil, `{"p": "/x"}`, 200},
+		{"bot no content", true, "curl/8.0", nil, `{"p": "/x"}`, 204},
+		{"client bot no content", true, firefox, nil, `{"p": "/x", "b": 150}`, 204},
+		{"prefetch", false, firefox, http.Header{"Purpose": {"prefetch"}}, `{"p": "/x"}`, 200},
+		{"prefetch no content", true, firefox, http.Header{"Purpose": {"prefetch"}}, `{"p": "/x"}`, 204},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.Settings.BotNoContent = tt.noContent
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			r.Header.Set("User-Agent", tt.ua)
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			if rr.Header().Get("Access-Control-Allow-Origin") != "*" {
+				t.Errorf("no CORS header")
+			}
+			if tt.wantCode == 204 {
+				if rr.Body.Len() != 0 || rr.Header().Get("Content-Type") != "" {
+					t.Errorf("body or Content-Type: %q, %q", rr.Body.String(), rr.Header().Get("Content-Type"))
+				}
+			} else {
+				if rr.Body.String() != string(gif) || rr.Header().Get("Content-Type") != "image/gif" {
+					t.Errorf("not the GIF: %q, %q", rr.Body.String(), rr.Header().Get("Content-Type"))
+				}
+			}
+
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBackendCountTZOffset(t *testing.T) {
+	tests := []struct {
+		body       string
+		want       *int
+		wantHeader string
+	}{
+		{`{"p": "/x"}`, nil, ""},
+		{`{"p": "/x", "tz_offset": 0}`, ztype.Ptr(0), ""},
+		{`{"p": "/x", "tz_offset": 120}`, ztype.Ptr(120), ""},
+		{`{"p": "/x", "tz_offset": -300}`, ztype.Ptr(-300), ""},
+		{`{"p": "/x", "tz_offset": 840}`, ztype.Ptr(840), ""},
+		{`{"p": "/x", "tz_offset": -840}`, ztype.Ptr(-840), ""},
+		{`{"p": "/x", "tz_offset": 841}`, nil, "tz_offset 841 out of range; ignored"},
+		{`{"p": "/x", "tz_offset": -841}`, nil, "tz_offset -841 out of range; ignored"},
+		{`{"p": "/x", "tz_offset": 100000}`, nil, "tz_offset 100000 out of range; ignored"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+			if have := rr.Header().Get("X-Goatcounter"); have != tt.wantHeader {
+				t.Errorf("X-Goatcounter\nhave: %q\nwant: %q", have, tt.wantHeader)
+			}
+
+			_, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits goatcounter.Hits
+			err = hits.TestList(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if have := hits[0].TZOffset; !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("TZOffset\nhave: %v\nwant: %v", ztype.Deref(have, -1), ztype.Deref(tt.want, -1))
+			}
+			if hits[0].CreatedAt.Location() != time.UTC {
+				t.Errorf("CreatedAt not in UTC: %s", hits[0].CreatedAt)
+			}
+		})
+	}
+}
+
+func TestBackendCountAuth(t *testing.T) {
+	tests := []struct {
+		body, contentType string
+		enabled           bool
+		wantCode          int
+		want              *zbool.Bool
+		wantHeader        string
+	}{
+		{`{"p": "/x"}`, "", true, 200, nil, ""},
+		{`{"p": "/x", "auth": 1}`, "", true, 200, ztype.Ptr(zbool.Bool(true)), ""},
+		{`{"p": "/x", "auth": 0}`, "", true, 200, ztype.Ptr(zbool.Bool(false)), ""},
+		{`{"p": "/x", "auth": true}`, "", true, 200, ztype.Ptr(zbool.Bool(true)), ""},
+		{`p=/x&auth=1`, "application/x-www-form-urlencoded", true, 200, ztype.Ptr(zbool.Bool(true)), ""},
+		{`p=/x&auth=0`, "application/x-www-form-urlencoded", true, 200, ztype.Ptr(zbool.Bool(false)), ""},
+		{`{"p": "/x", "auth": 1}`, "", false, 200, nil, "auth ignored as it's not enabled for this site"},
+
+		{`{"p": "/x", "auth": "user@example.com"}`, "", true, 400, nil, ""},
+		{`{"p": "/x", "auth": "1"}`, "", true, 400, nil, ""},
+		{`{"p": "/x", "auth": 42}`, "", true, 400, nil, ""},
+		{`{"p": "/x", "auth": {"id": 1}}`, "", true, 400, nil, ""},
+		{`p=/x&auth=12345`, "application/x-www-form-urlencoded", true, 400, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%t", tt.body, tt.enabled), func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.Settings.RecordAuth = tt.enabled
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+			if tt.wantCode != 200 {
+				if c := rr.Header().Get("X-Goatcounter-Code"); c != "decode_error" {
+					t.Errorf("X-Goatcounter-Code: %q", c)
+				}
+				return
+			}
+			if have := rr.Header().Get("X-Goatcounter"); have != tt.wantHeader {
+				t.Errorf("X-Goatcounter\nhave: %q\nwant: %q", have, tt.wantHeader)
+			}
+
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits goatcounter.Hits
+			err = hits.TestList(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if have := hits[0].Authed; !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("Authed\nhave: %v\nwant: %v", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendCountPathRewrites(t *testing.T) {
+	rewrites := goatcounter.PathRewrites{
+		{Pattern: `/\d+(/|$)`, Replace: "/:id$1"},
+		{Pattern: `^/(en|de)/`, Replace: "/"},
+		{Pattern: `^/long/`, Replace: "/" + strings.Repeat("a", 2048)},
+	}
+	tests := []struct {
+		at, path, wantPath string
+		event              bool
+	}{
+		{"", "/user/12345/profile", "/user/:id/profile", false},
+		{"count", "/de/user/12345/profile", "/user/:id/profile", false},
+		{"count", "/docs", "/docs", false},
+		{"count", "/user/12345", "/user/12345", true},
+		{"display", "/user/12345/profile", "/user/12345/profile", false},
+
+		// Length policy applies to the rewritten path.
+		{"count", "/long/x", "/__long__", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.at+" "+tt.path, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.Settings.PathRewrites = rewrites
+			site.Settings.PathRewriteAt = tt.at
+			site.Settings.LongPaths = goatcounter.LongPathsBucket
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(fmt.Sprintf(`{"p": %q, "e": %t}`, tt.path, tt.event)))
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			want := tt.wantPath
+			if tt.event {
+				want = strings.TrimLeft(want, "/")
+			}
+			if hits[0].Path != want {
+				t.Errorf("\nhave: %q\nwant: %q", hits[0].Path, want)
+			}
+		})
+	}
+}
+
+func TestBackendCountTestMode(t *testing.T) {
+	ztime.SetNow(t, "2023-06-01 12:00:00")
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.TestMode, site.Settings.TestModeMinutes = true, 30
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := site.Settings.TestModeUntil.Format("15:04"); have != "12:30" {
+		t.Fatalf("TestModeUntil: %s", have)
+	}
+	defer func() { testModeLog = newTestLog(100) }()
+
+	deps := &fakeCountDeps{now: ztime.Now(), bot: isbot.NoBotNoMatch, loc: "NZ"}
+	for _, body := range []string{
+		`{"p": "/page?utm_source=x&id=1", "t": "Title"}`,
+		`{"p": "/favicon.ico"}`,
+		`{"p": "/bot", "b": 150}`,
+	} {
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(body))
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0")
+		err := backend{deps: deps}.count(rr, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ztest.Code(t, rr, 202)
+		if have := rr.Header().Get("X-Goatcounter-Code"); have != countTestMode {
+			t.Errorf("X-Goatcounter-Code: %q", have)
+		}
+	}
+
+	if len(deps.hits) != 0 {
+		t.Fatalf("appended %d hits", len(deps.hits))
+	}
+	if goatcounter.Memstore.Len() != 0 {
+		t.Fatal("added to the memstore")
+	}
+	var n int
+	err = zdb.Get(ctx, &n, `select count(*) from hits`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("%d hits in the database", n)
+	}
+
+	var have []string
+	for _, e := range testModeLog.list(site.ID) {
+		have = append(have, fmt.Sprintf("%s %s bot=%d loc=%s %q", e.Hit.Path, e.Hit.Title, e.Hit.Bot, e.Hit.Location, e.Reason))
+	}
+	want := []string{
+		`/bot  bot=150 loc=NZ ""`,
+		`/favicon.ico  bot=0 loc=NZ "ignored path"`,
+		`/page?id=1 Title bot=0 loc=NZ ""`,
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+
+	r, rr := newTest(ctx, "GET", "/settings/test-mode", nil)
+	login(t, r)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+	if !strings.Contains(rr.Body.String(), "/page?id=1") {
+		t.Errorf("path not in the log page:\n%s", rr.Body.String())
+	}
+
+	// Stored as usual once it expires.
+	ztime.SetNow(t, "2023-06-01 12:31:00")
+	deps.now = ztime.Now()
+	r, rr = newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/after"}`))
+	err = backend{deps: deps}.count(rr, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ztest.Code(t, rr, 200)
+	if len(deps.hits) != 1 {
+		t.Fatalf("appended %d hits", len(deps.hits))
+	}
+	err = site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if site.Settings.TestMode || !site.Settings.TestModeUntil.IsZero() {
+		t.Errorf("not disabled: %t %s", site.Settings.TestMode, site.Settings.TestModeUntil)
+	}
+}
+
+func TestBackendCountConnection(t *testing.T) {
+	tests := []struct {
+		proto        string
+		major, minor int
+		want         string
+	}{
+		{"HTTP/1.1", 1, 1, "close"},
+		{"HTTP/2.0", 2, 0, "close"},
+		{"HTTP/3.0", 3, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proto, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			deps := &fakeCountDeps{now: ztime.Now(), bot: isbot.NoBotNoMatch}
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.Proto, r.ProtoMajor, r.ProtoMinor = tt.proto, tt.major, tt.minor
+			err := backend{deps: deps}.count(rr, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ztest.Code(t, rr, 200)
+
+			if have := rr.Header().Get("Connection"); have != tt.want {
+				t.Errorf("Connection: %q; want %q", have, tt.want)
+			}
+			if len(deps.hits) != 1 {
+				t.Errorf("appended %d hits", len(deps.hits))
+			}
+		})
+	}
+}
+
+func TestBackendCountSample(t *testing.T) {
+	ctx := gctest.DB(t)
+	pathSamples = newPathSampler(100)
+	defer func() { pathSamples = newPathSampler(100_000) }()
+
+	site := Site(ctx)
+	site.Settings.SampleRate = 4
+	site.Settings.SampleThreshold = 3
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(path string, n int) int {
+		var kept int
+		for i := 0; i < n; i++ {
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "`+path+`"}`))
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			switch c := rr.Header().Get("X-Goatcounter-Code"); c {
+			case "":
+				kept++
+			case countSampled:
+			default:
+				t.Fatalf("X-Goatcounter-Code: %q", c)
+			}
+		}
+		return kept
+	}
+
+	if kept := send("/rare", 3); kept != 3 {
+		t.Errorf("rare path: kept %d", kept)
+	}
+	if kept := send("/hot", 43); kept != 13 {
+		t.Errorf("hot path: kept %d", kept)
+	}
+
+	hits, err := goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 16 {
+		t.Errorf("recorded %d hits", len(hits))
+	}
+
+	// The sampled pageviews stand for the ones that were dropped.
+	var total int
+	for _, h := range hits {
+		total += h.Weight()
+	}
+	if total != 46 {
+		t.Errorf("total weight %d; want 46", total)
+	}
+}
+
+func TestPathSampler(t *testing.T) {
+	var (
+		s    = newPathSampler(2)
+		now  = time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+		site = &goatcounter.Site{ID: 1}
+	)
+	site.Settings.SampleRate, site.Settings.SampleThreshold = 2, 1
+
+	weight := func(path string, now time.Time, want int) {
+		t.Helper()
+		if have := s.weight(site, goatcounter.Hit{Path: path}, now); have != want {
+			t.Errorf("%s: have %d; want %d", path, have, want)
+		}
+	}
+
+	weight("/a", now, 1)
+	weight("/a", now, 0)
+	weight("/a", now, 2)
+	weight("/a", now, 0)
+
+	// Not counted once there are too many paths.
+	weight("/b", now, 1)
+	weight("/c", now, 1)
+	weight("/c", now, 1)
+	weight("/b", now, 0)
+
+	// Counted from 0 in the next hour.
+	now = now.Add(time.Hour)
+	weight("/a", now, 1)
+	weight("/a", now, 0)
+	if s.Len() != 1 {
+		t.Errorf("%d paths", s.Len())
+	}
+
+	// Evicted in the background.
+	s.Evict(now, time.Hour)
+	if s.Len() != 1 {
+		t.Errorf("%d paths", s.Len())
+	}
+	s.Evict(now.Add(time.Hour), time.Hour)
+	if s.Len() != 0 {
+		t.Errorf("%d paths", s.Len())
+	}
+}
+
+func TestBackendCountStream(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantHits string
+		want     string
+	}{
+		{"multiple",
+			"{\"p\": \"/a\"}\n\n{\"p\": \"/b\", \"q\": \"?x=1\"}\n{\"p\": \"click\", \"e\": true}",
+			"/a /b click",
+			`{"recorded":3}`},
+		{"malformed",
+			"{\"p\": \"/a\"}\n{\"p\": \"/b\n{\"p\": \"/c\"}\n{\"p\": \"/d\", \"b\": 1}\n",
+			"/a /c",
+			`{"recorded":2,"rejected":[` +
+				`{"line":2,"code":"decode_error","reason":"error decoding parameters: unexpected end of JSON input"},` +
+				`{"line":4,"code":"invalid_bot","reason":"wrong value: b=1"}]}`},
+		{"too many",
+			strings.Repeat("{\"p\": \"/a\"}\n", maxStreamHits+2),
+			strings.TrimSpace(strings.Repeat("/a ", maxStreamHits)),
+			`{"recorded":500,"rejected":[{"line":501,"code":"stream_limit","reason":"more than 500 pageviews"}]}`},
+		{"too large",
+			"{\"p\": \"/a\"}\n{\"p\": \"/" + strings.Repeat("x", maxStreamBody) + "\"}\n",
+			"/a",
+			`{"recorded":1,"rejected":[{"code":"stream_limit","reason":"body is larger than 1048576 bytes"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			deps := &fakeCountDeps{now: ztime.Now(), bot: isbot.NoBotNoMatch}
+			r, rr := newTest(ctx, "POST", "/count/stream", strings.NewReader(tt.body))
+			err := backend{deps: deps}.countStream(rr, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ztest.Code(t, rr, 200)
+
+			var have bytes.Buffer
+			err = json.Compact(&have, rr.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have.String() != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have.String(), tt.want)
+			}
+			var paths []string
+			for _, h := range deps.hits {
+				paths = append(paths, h.Path)
+			}
+			if have := strings.Join(paths, " "); have != tt.wantHits {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestBackendCountStreamSyncCount(t *testing.T) {
+	body := "{\"p\": \"/a\"}\n{\"p\": \"/b\"}\n"
+	tests := []struct {
+		mode     string
+		fail     bool
+		wantCode int
+		wantHits string
+		want     string
+	}{
+		{goatcounter.SyncCountOff, true, 200, "/a /b", `{"recorded":2}`}, // Persist isn't used.
+		{goatcounter.SyncCountGIF, false, 200, "/a /b", `{"recorded":2}`},
+		{goatcounter.SyncCountGIF, true, 200, "",
+			`{"recorded":0,"rejected":[` +
+				`{"line":1,"code":"storage_error","reason":"storage error"},` +
+				`{"line":2,"code":"storage_error","reason":"storage error"}]}`},
+		{goatcounter.SyncCountError, false, 200, "/a /b", `{"recorded":2}`},
+		{goatcounter.SyncCountError, true, 503, "",
+			`{"recorded":0,"rejected":[{"line":1,"code":"storage_error","reason":"storage error"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%t", tt.mode, tt.fail), func(t *testing.T) {
+			ctx := gctest.DB(t)
+			goatcounter.Config(ctx).SyncCount = tt.mode
+
+			deps := &fakeCountDeps{now: ztime.Now(), bot: isbot.NoBotNoMatch}
+			if tt.fail {
+				deps.persistErr = errors.New("database is on fire")
+			}
+			r, rr := newTest(ctx, "POST", "/count/stream", strings.NewReader(body))
+			err := backend{deps: deps}.countStream(rr, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ztest.Code(t, rr, tt.wantCode)
+
+			var have bytes.Buffer
+			err = json.Compact(&have, rr.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have.String() != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have.String(), tt.want)
+			}
+			var paths []string
+			for _, h := range deps.hits {
+				paths = append(paths, h.Path)
+			}
+			if have := strings.Join(paths, " "); have != tt.wantHits {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestBackendCountCompress(t *testing.T) {
+	var (
+		tiny  = `{"p": "/a"}`
+		large = strings.Repeat("{\"p\": \"/a\", \"b\": 1}\n", 20)
+	)
+	tests := []struct {
+		name, path, body, accept string
+		min                      int
+		wantGzip                 bool
+	}{
+		{"large", "/count/stream", large, "gzip", 256, true},
+		{"large with q", "/count/stream", large, "br;q=1.0, gzip;q=0.8", 256, true},
+		{"large q=0", "/count/stream", large, "gzip;q=0", 256, false},
+		{"large not accepted", "/count/stream", large, "", 256, false},
+		{"large disabled", "/count/stream", large, "gzip", -1, false},
+		{"tiny", "/count/stream", tiny, "gzip", 256, false},
+		{"tiny no minimum", "/count/stream", tiny, "gzip", 0, true},
+		{"pixel", "/count", tiny, "gzip", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			goatcounter.Config(ctx).CountCompressMin = tt.min
+
+			r, rr := newTest(ctx, "POST", tt.path, strings.NewReader(tt.body))
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+			_, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			enc := rr.Header().Get("Content-Encoding")
+			if have := enc == "gzip"; have != tt.wantGzip {
+				t.Fatalf("Content-Encoding: %q; want gzip: %t", enc, tt.wantGzip)
+			}
+			if tt.path == "/count" {
+				return
+			}
+
+			body := rr.Body.Bytes()
+			if tt.wantGzip {
+				gz, err := gzip.NewReader(rr.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err = io.ReadAll(gz)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var res countStreamResult
+			err = json.Unmarshal(body, &res)
+			if err != nil {
+				t.Fatalf("%s: %q", err, body)
+			}
+			if res.Recorded+len(res.Rejected) == 0 {
+				t.Errorf("empty result: %q", body)
+			}
+		})
+	}
+}
+
+func TestBackendCountPrefix(t *testing.T) {
+	ctx := gctest.DB(t)
+	goatcounter.Config(ctx).CountPrefix = "/_stats"
+
+	tests := []struct {
+		method, path string
+		wantCode     int
+		wantHit      string
+	}{
+		{"POST", "/_stats/count", 200, "/a"},
+		{"GET", "/_stats/count/p/eyJwIjoiL2EifQ", 200, "/a"},
+		{"POST", "/count", 200, "/a"},
+		{"POST", "/_stats/counter", 404, ""},
+		{"POST", "/_statscount", 404, ""},
+		{"GET", "/_stats/count.jsx", 404, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			r, rr := newTest(ctx, tt.method, tt.path, strings.NewReader(`{"p": "/a"}`))
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var have string
+			if len(hits) > 0 {
+				have = hits[0].Path
+			}
+			if have != tt.wantHit {
+				t.Errorf("have %q; want %q", have, tt.wantHit)
+			}
+		})
+	}
+
+	t.Run("snippet", func(t *testing.T) {
+		snippet := func(t *testing.T, want ...string) {
+			t.Helper()
+			r, rr := newTest(ctx, "GET", "/help/start", nil)
+			login(t, r)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+			for _, w := range want {
+				if !strings.Contains(rr.Body.String(), w) {
+					t.Errorf("%s not in body", w)
+				}
+			}
+		}
+
+		u := Site(ctx).URL(ctx)
+		snippet(t,
+			`data-goatcounter="`+u+`/_stats/count"`,
+			`async src="`+u+`/_stats/count.js"`,
+			`script.setAttribute('src', '`+u+`/_stats/count.js');`,
+			`script.setAttribute('data-goatcounter', '`+u+`/_stats/count');`)
+
+		goatcounter.Config(ctx).CountPrefix = ""
+		defer func() { goatcounter.Config(ctx).CountPrefix = "/_stats" }()
+		dc := Site(ctx).Domain(ctx)
+		snippet(t,
+			`data-goatcounter="`+u+`/count"`,
+			`async src="//`+dc+`/count.js"`)
+	})
+}
+
+func TestBackendCountHiddenRef(t *testing.T) {
+	tests := []struct {
+		name     string
+		hidden   bool
+		header   map[string]string
+		ref      string
+		wantRef  string
+		wantHide bool
+	}{
+		{"direct", true, map[string]string{"Referer": "https://example.com/page", "Sec-Fetch-Site": "cross-site"}, "", "", false},
+		{"no signals", true, nil, "", "", false},
+		{"downgrade", true, map[string]string{"Referer": "http://example.com/page"}, "", "(referrer hidden)", true},
+		{"stripped", true, map[string]string{"Sec-Fetch-Site": "cross-site"}, "", "(referrer hidden)", true},
+		{"has ref", true, map[string]string{"Referer": "http://example.com/page"}, "https://other.com", "other.com", true},
+		{"disabled", false, map[string]string{"Referer": "http://example.com/page"}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.Settings.HiddenRefs = tt.hidden
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x", "r": "`+tt.ref+`"}`))
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("%d hits", len(hits))
+			}
+			if hits[0].Ref != tt.wantRef {
+				t.Errorf("Ref: %q; want %q", hits[0].Ref, tt.wantRef)
+			}
+			if hits[0].RefHidden != tt.wantHide {
+				t.Errorf("RefHidden: %t; want %t", hits[0].RefHidden, tt.wantHide)
+			}
+		})
+	}
+}
+
+func TestBackendCountBlockedUA(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.BlockUserAgentSubstrings = goatcounter.Strings{"headlesschrome", "CURL"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ua          string
+		wantBlocked bool
+	}{
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.0.0 Safari/537.36", true},
+		{"curl/8.4.0", true},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", false},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", false},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.Header.Set("User-Agent", tt.ua)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantBlocked {
+				ztest.Code(t, rr, 202)
+				if h := rr.Header().Get("X-Goatcounter"); h != "blocked ua" {
+					t.Errorf("X-Goatcounter header: %q", h)
+				}
+				if h := rr.Header().Get("X-Goatcounter-Code"); h != "blocked_ua" {
+					t.Errorf("X-Goatcounter-Code header: %q", h)
+				}
+				if len(hits) != 0 {
+					t.Errorf("%d hits", len(hits))
+				}
+			} else {
+				ztest.Code(t, rr, 200)
+				if len(hits) != 1 {
+					t.Errorf("%d hits", len(hits))
+				}
+			}
+		})
+	}
+}
+
+func TestBackendCountDeniedPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		bot      bool // Set DenyPathsBot
+		wantCode int
+		wantBot  int
+	}{
+		{"/wp-login.php", false, 202, 0},
+		{"/.env", false, 202, 0},
+		{"/admin/.git/config", false, 202, 0},
+		{"/cgi-bin/test.asp", false, 202, 0},
+		{"/", false, 200, 0},
+		{"/php-tutorial", false, 200, 0},
+		{"/blog/environment.html", false, 200, 0},
+		{"/.env", true, 200, goatcounter.BotScanner},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.Settings.DenyPathRegexps = goatcounter.Lines{`\.(php|asp|env)$`, `/\.git(/|$)`}
+			site.Settings.DenyPathsBot = tt.bot
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "`+tt.path+`"}`))
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCode == 202 {
+				if h := rr.Header().Get("X-Goatcounter"); h != "denied path" {
+					t.Errorf("X-Goatcounter header: %q", h)
+				}
+				if h := rr.Header().Get("X-Goatcounter-Code"); h != "denied_path" {
+					t.Errorf("X-Goatcounter-Code header: %q", h)
+				}
+				if len(hits) != 0 {
+					t.Errorf("%d hits", len(hits))
+				}
+				return
+			}
+			if len(hits) != 1 {
+				t.Fatalf("%d hits", len(hits))
+			}
+			if hits[0].Bot != tt.wantBot {
+				t.Errorf("bot: %d; want %d", hits[0].Bot, tt.wantBot)
+			}
+		})
+	}
+}
+
+func TestBackendCountWebdriver(t *testing.T) {
+	tests := []struct {
+		policy   string
+		body     string
+		wantCode int
+		wantBot  int
+	}{
+		{goatcounter.WebdriverIgnore, `{"p": "/a", "webdriver": true}`, 200, 0},
+		{goatcounter.WebdriverBot, `{"p": "/a", "webdriver": true}`, 200, goatcounter.BotWebdriver},
+		{goatcounter.WebdriverBot, `{"p": "/a", "webdriver": true, "b": 153}`, 200, 153},
+		{goatcounter.WebdriverBot, `{"p": "/a", "webdriver": false}`, 200, 0},
+		{goatcounter.WebdriverBot, `{"p": "/a"}`, 200, 0},
+		{goatcounter.WebdriverDrop, `{"p": "/a", "webdriver": true}`, 202, 0},
+		{goatcounter.WebdriverDrop, `{"p": "/a"}`, 200, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.body, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.Settings.Webdriver = tt.policy
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCode == 202 {
+				if h := rr.Header().Get("X-Goatcounter-Code"); h != "webdriver" {
+					t.Errorf("X-Goatcounter-Code header: %q", h)
+				}
+				if len(hits) != 0 {
+					t.Errorf("%d hits", len(hits))
+				}
+				return
+			}
+			if len(hits) != 1 {
+				t.Fatalf("%d hits", len(hits))
+			}
+			if hits[0].Bot != tt.wantBot {
+				t.Errorf("bot: %d; want %d", hits[0].Bot, tt.wantBot)
+			}
+		})
+	}
+
+	t.Run("form", func(t *testing.T) {
+		ctx := gctest.DB(t)
+
+		site := Site(ctx)
+		site.Settings.Webdriver = goatcounter.WebdriverBot
+		err := site.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader("p=/a&webdriver=1"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+
+		hits, err := goatcounter.Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 1 || hits[0].Bot != goatcounter.BotWebdriver {
+			t.Errorf("%v", hits)
+		}
+
+		r, rr = newTest(ctx, "POST", "/count", strings.NewReader("p=/a&webdriver=yes-please"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		if h := rr.Header().Get("X-Goatcounter-Code"); h != "decode_error" {
+			t.Errorf("X-Goatcounter-Code header: %q", h)
+		}
+	})
+}
+
+func TestBackendCountMinDwell(t *testing.T) {
+	tests := []struct {
+		name     string
+		require  bool
+		body     string
+		wantCode string
+	}{
+		{"below", false, `{"p": "/x", "dwell_ms": 2999}`, "short_dwell"},
+		{"zero", false, `{"p": "/x", "dwell_ms": 0}`, "short_dwell"},
+		{"at", false, `{"p": "/x", "dwell_ms": 3000}`, ""},
+		{"above", false, `{"p": "/x", "dwell_ms": 12345}`, ""},
+		{"missing", false, `{"p": "/x"}`, ""},
+		{"negative", false, `{"p": "/x", "dwell_ms": -1}`, ""},
+		{"event", false, `{"p": "click", "e": true, "dwell_ms": 10}`, ""},
+
+		{"required, missing", true, `{"p": "/x"}`, "short_dwell"},
+		{"required, negative", true, `{"p": "/x", "dwell_ms": -1}`, "short_dwell"},
+		{"required, too large", true, `{"p": "/x", "dwell_ms": 86400001}`, "short_dwell"},
+		{"required, at", true, `{"p": "/x", "dwell_ms": 3000}`, ""},
+		{"required, event", true, `{"p": "click", "e": true}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.Settings.MinDwellMs = 3000
+			site.Settings.RequireDwell = tt.require
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantCode {
+				t.Fatalf("X-Goatcounter-Code: have %q; want %q (%s)", have, tt.wantCode, rr.Header().Get("X-Goatcounter"))
+			}
+			if tt.wantCode == "" {
+				ztest.Code(t, rr, 200)
+				if len(hits) != 1 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+				return
+			}
+			ztest.Code(t, rr, 202)
+			if len(hits) != 0 {
+				t.Errorf("recorded %d hits", len(hits))
+			}
+		})
+	}
+}
+
+func TestBackendCountNavType(t *testing.T) {
+	tests := []struct {
+		name       string
+		off        bool // Don't enable CollectNavType.
+		site, mode string
+		ref        string
+		want       string
+	}{
+		{"none", false, "none", "navigate", "https://other.com/x", "direct"},
+		{"same-origin", false, "same-origin", "navigate", "", "internal"},
+		{"same-site", false, "same-site", "navigate", "", "external"},
+		{"cross-site", false, "cross-site", "navigate", "https://example.com/x", "external"},
+		{"unknown", false, "whatever", "navigate", "", "direct"},
+
+		// Fall back to the referrer.
+		{"no header", false, "", "", "", "direct"},
+		{"no header, own ref", false, "", "", "https://example.com/x", "internal"},
+		{"no header, www", false, "", "", "https://www.example.com/x", "internal"},
+		{"no header, ref", false, "", "", "https://other.com/x", "external"},
+		{"not navigate", false, "cross-site", "no-cors", "https://example.com/x", "internal"},
+
+		{"off", true, "none", "navigate", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.LinkDomain = "example.com"
+			if !tt.off {
+				site.Settings.Collect.Set(goatcounter.CollectNavType)
+			}
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(fmt.Sprintf(`{"p": "/x", "r": %q}`, tt.ref)))
+			if tt.site != "" {
+				r.Header.Set("Sec-Fetch-Site", tt.site)
+			}
+			if tt.mode != "" {
+				r.Header.Set("Sec-Fetch-Mode", tt.mode)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var have string
+			err = zdb.Get(ctx, &have, `select nav_type from hits`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendCountEventValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		off      bool // Don't enable CollectEventValue.
+		body     string
+		wantCode string
+		want     string // Stored event_value.
+	}{
+		{"event", false, `{"p": "order", "e": true, "value": 42.5}`, "", "42.5"},
+		{"negative", false, `{"p": "refund", "e": true, "value": -10}`, "", "-10"},
+		{"no value", false, `{"p": "order", "e": true}`, "", "NULL"},
+		{"form", false, "p=order&e=1&value=19.99", "", "19.99"},
+		{"pageview", false, `{"p": "/x", "value": 1}`, "invalid_value", ""},
+		{"too large", false, `{"p": "order", "e": true, "value": 1e10}`, "invalid_value", ""},
+		{"form inf", false, "p=order&e=1&value=-Inf", "invalid_value", ""},
+
+		{"off", true, `{"p": "order", "e": true, "value": 42.5}`, "", "NULL"},
+		{"off, pageview", true, `{"p": "/x", "value": 1}`, "", "NULL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.Settings.CollectEventValue = !tt.off
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			if !strings.HasPrefix(tt.body, "{") {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantCode {
+				t.Fatalf("X-Goatcounter-Code: have %q; want %q (%s)", have, tt.wantCode, rr.Header().Get("X-Goatcounter"))
+			}
+			if tt.wantCode != "" {
+				ztest.Code(t, rr, 400)
+				if len(hits) != 0 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+				return
+			}
+			ztest.Code(t, rr, 200)
+			have := strings.TrimSpace(zdb.DumpString(ctx, `select event_value from hits`))
+			if want := "event_value\n" + tt.want; have != want {
+				t.Errorf("\nhave: %q\nwant: %q", have, want)
+			}
+		})
+	}
+}
+
+func TestBackendCountServerClients(t *testing.T) {
+	tests := []struct {
+		name       string
+		off        bool   // Don't enable ServerClients.
+		requireSig bool   // Set RequireSignature.
+		auth       string // "key", "export-key", "bad-key", "sig", "bad-sig"
+		ua         string
+		wantCode   string
+	}{
+		{"key", false, false, "key", "", ""},
+		{"key, curl", false, false, "key", "curl/8.5.0", ""},
+		{"sig", false, true, "sig", "", ""},
+
+		{"no auth", false, false, "", "", "empty_ua"},
+		{"no auth, ua", false, false, "", "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0", "missing_header"},
+		{"bad key", false, false, "bad-key", "", "bad_auth"},
+		{"no count permission", false, false, "export-key", "", "bad_auth"},
+		{"sig not required", false, false, "sig", "", "empty_ua"},
+		{"bad sig", false, true, "bad-sig", "", "bad_signature"},
+		{"disabled", true, false, "key", "", "empty_ua"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			ztime.SetNow(t, "2023-11-14 22:13:20")
+			goatcounter.Config(ctx).EmptyUA = goatcounter.EmptyUADrop
+
+			site := Site(ctx)
+			site.Settings.ServerClients = !tt.off
+			site.Settings.RequireSignature = tt.requireSig
+			site.Settings.RequireHeader = "X-My-Embed"
+			site.Settings.RequireHeaderValue = "v1-embed"
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+			r.Header.Set("User-Agent", tt.ua)
+			switch tt.auth {
+			case "key", "export-key":
+				perm := goatcounter.APIPermCount
+				if tt.auth == "export-key" {
+					perm = goatcounter.APIPermExport
+				}
+				token := goatcounter.APIToken{SiteID: site.ID, UserID: User(ctx).ID, Name: "test", Permissions: perm}
+				err := token.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Header.Set("Authorization", "Bearer "+token.Token)
+			case "bad-key":
+				r.Header.Set("Authorization", "Bearer nope")
+			case "sig":
+				r.Header.Set("X-Goatcounter-Signature", goatcounter.SignPath(site.Settings.SignatureSecret, "/x", ztime.Now()))
+			case "bad-sig":
+				r.Header.Set("X-Goatcounter-Signature", goatcounter.SignPath("other", "/x", ztime.Now()))
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			hits, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantCode {
+				t.Fatalf("X-Goatcounter-Code: have %q; want %q (%s)", have, tt.wantCode, rr.Header().Get("X-Goatcounter"))
+			}
+			if tt.wantCode != "" {
+				if len(hits) != 0 {
+					t.Errorf("recorded %d hits", len(hits))
+				}
+				return
+			}
+			ztest.Code(t, rr, 200)
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if hits[0].Bot != 0 {
+				t.Errorf("bot: %d", hits[0].Bot)
+			}
+		})
+	}
+}
+
+func TestBackendCountMonitors(t *testing.T) {
+	tests := []struct {
+		ua      string
+		wantOff int // Bot with FlagMonitors disabled.
+		wantOn  int // Bot with FlagMonitors enabled.
+	}{
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", 0, 0},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 StatusCake", 0, goatcounter.BotMonitor},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Checkly/1.0", 0, goatcounter.BotMonitor},
+		{"Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)", isbot.BotLink, goatcounter.BotMonitor},
+	}
+	for _, enabled := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%t %s", enabled, tt.ua), func(t *testing.T) {
+				ctx := gctest.DB(t)
+				site := Site(ctx)
+				site.Settings.FlagMonitors = enabled
+				err := site.Update(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+				r.Header.Set("User-Agent", tt.ua)
+				newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+				ztest.Code(t, rr, 200)
+
+				hits, err := goatcounter.Memstore.Persist(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(hits) != 1 {
+					t.Fatalf("%d hits", len(hits))
+				}
+
+				want := tt.wantOff
+				if enabled {
+					want = tt.wantOn
+				}
+				if hits[0].Bot != want {
+					t.Errorf("Bot: have %d; want %d", hits[0].Bot, want)
+				}
+			})
+		}
+	}
+}
+
+func TestBackendCountPerf(t *testing.T) {
+	perf := func(ttfb, dcl, load *int) string {
+		f := func(v *int) string {
+			if v == nil {
+				return "nil"
+			}
+			return strconv.Itoa(*v)
+		}
+		return f(ttfb) + " " + f(dcl) + " " + f(load)
+	}
+
+	tests := []struct {
+		body, contentType string
+		enabled           bool
+		want              string
+		wantHeader        string
+	}{
+		{`{"p": "/x"}`, "", true, "nil nil nil", ""},
+		{`{"p": "/x", "ttfb": 120, "dcl": 450, "load": 900}`, "", true, "120 450 900", ""},
+		{`{"p": "/x", "load": 0}`, "", true, "nil nil 0", ""},
+		{`p=/x&ttfb=120&dcl=450&load=900`, "application/x-www-form-urlencoded", true, "120 450 900", ""},
+
+		{`{"p": "/x", "ttfb": -5, "dcl": 450, "load": 900}`, "", true, "nil 450 900", "ttfb -5 out of range; ignored"},
+		{`{"p": "/x", "ttfb": 120, "dcl": 450, "load": 600000}`, "", true, "120 450 nil", "load 600000 out of range; ignored"},
+		{`{"p": "/x", "ttfb": 120, "load": 60000}`, "", true, "120 nil 60000", ""},
+
+		{`{"p": "/x", "ttfb": 120, "dcl": 450, "load": 900}`, "", false, "nil nil nil",
+			"load times ignored as they're not collected for this site"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%t", tt.body, tt.enabled), func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			if tt.enabled {
+				site.Settings.Collect |= goatcounter.CollectPerf
+			}
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+			if have := rr.Header().Get("X-Goatcounter"); have != tt.wantHeader {
+				t.Errorf("X-Goatcounter\nhave: %q\nwant: %q", have, tt.wantHeader)
+			}
+
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits goatcounter.Hits
+			err = hits.TestList(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if have := perf(hits[0].PerfTTFB, hits[0].PerfDCL, hits[0].PerfLoad); have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendCountPad(t *testing.T) {
+	ctx := gctest.DB(t)
+	goatcounter.Config(ctx).CountPad = 50 * time.Millisecond
+	defer func() {
+		goatcounter.Config(ctx).CountPad = 0
+		goatcounter.Memstore.Persist(ctx)
+	}()
+
+	send := func(t *testing.T, ua string) time.Duration {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+		r.Header.Set("User-Agent", ua)
+		start := time.Now()
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		return time.Since(start)
+	}
+
+	t.Run("padded", func(t *testing.T) {
+		for _, ua := range []string{"Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0", "curl/7.8", ""} {
+			if took := send(t, ua); took < 50*time.Millisecond {
+				t.Errorf("%q: took %s", ua, took)
+			}
+		}
+	})
+
+	t.Run("full", func(t *testing.T) {
+		for i := 0; i < maxCountPad; i++ {
+			countPadding <- struct{}{}
+		}
+		defer func() {
+			for i := 0; i < maxCountPad; i++ {
+				<-countPadding
+			}
+		}()
+		if took := send(t, "curl/7.8"); took >= 50*time.Millisecond {
+			t.Errorf("took %s", took)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		goatcounter.Config(ctx).CountPad = 0
+		if took := send(t, "curl/7.8"); took >= 50*time.Millisecond {
+			t.Errorf("took %s", took)
+		}
+	})
+}
+
+func TestBackendCountConn(t *testing.T) {
+	tests := []struct {
+		body, contentType string
+		enabled           bool
+		want              string
+		wantHeader        string
+	}{
+		{`{"p": "/x"}`, "", true, "", ""},
+		{`{"p": "/x", "conn": "4g"}`, "", true, "4g", ""},
+		{`{"p": "/x", "conn": "slow-2g"}`, "", true, "slow-2g", ""},
+		{`p=/x&conn=3g`, "application/x-www-form-urlencoded", true, "3g", ""},
+		{`{"p": "/x", "conn": "5g"}`, "", true, "", `unknown conn "5g"; ignored`},
+		{`{"p": "/x", "conn": "4G"}`, "", true, "", `unknown conn "4G"; ignored`},
+		{`{"p": "/x", "conn": "4g"}`, "", false, "", "conn ignored as it's not collected for this site"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%t", tt.body, tt.enabled), func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			if tt.enabled {
+				site.Settings.Collect |= goatcounter.CollectConnection
+			}
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+			if have := rr.Header().Get("X-Goatcounter"); have != tt.wantHeader {
+				t.Errorf("X-Goatcounter\nhave: %q\nwant: %q", have, tt.wantHeader)
+			}
+
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits goatcounter.Hits
+			err = hits.TestList(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if have := hits[0].Conn; have != tt.want {
+				t.Errorf("have %q; want %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendCountSizeBucket(t *testing.T) {
+	tests := []struct {
+		body, contentType string
+		enabled           bool
+		want              string
+		wantHeader        string
+	}{
+		{`{"p": "/x"}`, "", true, "", ""},
+		{`{"p": "/x", "size_bucket": "sm"}`, "", true, "sm", ""},
+		{`{"p": "/x", "size_bucket": "xl"}`, "", true, "xl", ""},
+		{`p=/x&size_bucket=md`, "application/x-www-form-urlencoded", true, "md", ""},
+		{`{"p": "/x", "size_bucket": "xxl"}`, "", true, "", `unknown size_bucket "xxl"; ignored`},
+		{`{"p": "/x", "size_bucket": "LG"}`, "", true, "", `unknown size_bucket "LG"; ignored`},
+		{`{"p": "/x", "size_bucket": "lg"}`, "", false, "", "size_bucket ignored as it's not collected for this site"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%t", tt.body, tt.enabled), func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			if tt.enabled {
+				site.Settings.Collect |= goatcounter.CollectSizeBucket
+			}
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+			if have := rr.Header().Get("X-Goatcounter"); have != tt.wantHeader {
+				t.Errorf("X-Goatcounter\nhave: %q\nwant: %q", have, tt.wantHeader)
+			}
+
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits goatcounter.Hits
+			err = hits.TestList(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if have := hits[0].SizeBucket; have != tt.want {
+				t.Errorf("have %q; want %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendCountPlatform(t *testing.T) {
+	tests := []struct {
+		body, contentType, ua string
+		appUAs                goatcounter.Strings
+		want                  string
+		wantHeader            string
+	}{
+		{`{"p": "/x"}`, "", "", nil, "web", ""},
+		{`{"p": "/x", "platform": "app"}`, "", "", nil, "app", ""},
+		{`{"p": "/x", "platform": "web"}`, "", "", nil, "web", ""},
+		{`p=/x&platform=app`, "application/x-www-form-urlencoded", "", nil, "app", ""},
+		{`{"p": "/x", "platform": "tv"}`, "", "", nil, "web", `unknown platform "tv"; ignored`},
+		{`{"p": "/x", "platform": "App"}`, "", "", nil, "web", `unknown platform "App"; ignored`},
+
+		// User-Agent.
+		{`{"p": "/x"}`, "", "Mozilla/5.0 (iPhone) MyApp/2.1", goatcounter.Strings{"myapp/"}, "app", ""},
+		{`{"p": "/x"}`, "", "Mozilla/5.0 (iPhone) Safari/604.1", goatcounter.Strings{"myapp/"}, "web", ""},
+		{`{"p": "/x", "platform": "web"}`, "", "Mozilla/5.0 (iPhone) MyApp/2.1", goatcounter.Strings{"MyApp/"}, "web", ""},
+		{`{"p": "/x", "platform": "tv"}`, "", "Mozilla/5.0 (iPhone) MyApp/2.1", goatcounter.Strings{"MyApp/"}, "app", `unknown platform "tv"; ignored`},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%s", tt.body, tt.ua), func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.Settings.AppUserAgentSubstrings = tt.appUAs
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.ua != "" {
+				r.Header.Set("User-Agent", tt.ua)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+			if have := rr.Header().Get("X-Goatcounter"); have != tt.wantHeader {
+				t.Errorf("X-Goatcounter\nhave: %q\nwant: %q", have, tt.wantHeader)
+			}
+
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits goatcounter.Hits
+			err = hits.TestList(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if have := hits[0].Platform; have != tt.want {
+				t.Errorf("have %q; want %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendCountCanonical(t *testing.T) {
+	long := "/" + strings.Repeat("x", goatcounter.MaxPathLen)
+	tests := []struct {
+		name, body, referer string
+		disabled            bool
+		wantPath            string
+		wantHeader          string
+	}{
+		{"no canonical", `{"p": "/x?a=1"}`, "", false, "/x?a=1", ""},
+		{"path", `{"p": "/x?a=1", "canonical": "/page"}`, "", false, "/page", "path from canonical"},
+		{"link domain", `{"p": "/x", "canonical": "https://example.com/page?b=2"}`, "", false, "/page", "path from canonical"},
+		{"www", `{"p": "/x", "canonical": "https://www.example.com/page"}`, "", false, "/page", "path from canonical"},
+		{"referer", `{"p": "/x", "canonical": "https://app.example.org/page"}`, "https://app.example.org/x", false, "/page", "path from canonical"},
+		{"host only", `{"p": "/x", "canonical": "https://example.com"}`, "", false, "/", "path from canonical"},
+		{"normalized", `{"p": "/x", "canonical": "/page/index.html"}`, "", false, "/page", "path from canonical"},
+
+		// Fallback to the path.
+		{"disabled", `{"p": "/x", "canonical": "/page"}`, "", true, "/x", "canonical ignored as it's not enabled for this site"},
+		{"cross-origin", `{"p": "/x", "canonical": "https://other.example.net/page"}`, "https://example.com/x", false, "/x",
+			`host "other.example.net" in the canonical isn't for this site; ignored`},
+		{"protocol-relative", `{"p": "/x", "canonical": "//other.example.net/page"}`, "", false, "/x",
+			`invalid canonical "//other.example.net/page"; ignored`},
+		{"relative", `{"p": "/x", "canonical": "page"}`, "", false, "/x", `invalid canonical "page"; ignored`},
+		{"scheme", `{"p": "/x", "canonical": "javascript:alert(1)"}`, "", false, "/x", `invalid canonical "javascript:alert(1)"; ignored`},
+		{"too long", `{"p": "/x", "canonical": "` + long + `"}`, "", false, "/x", "canonical longer than 2048 bytes; ignored"},
+		{"event", `{"p": "click", "e": true, "canonical": "/page"}`, "", false, "click", "canonical ignored for events"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site(ctx)
+			site.LinkDomain = "example.com"
+			site.Settings.CanonicalPaths = !tt.disabled
+			site.Settings.IndexFiles = goatcounter.Strings{"index.html"}
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "POST", "/count", strings.NewReader(tt.body))
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+			if have := rr.Header().Get("X-Goatcounter"); have != tt.wantHeader {
+				t.Errorf("X-Goatcounter\nhave: %q\nwant: %q", have, tt.wantHeader)
+			}
+
+			_, err = goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits goatcounter.Hits
+			err = hits.TestList(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != 1 {
+				t.Fatalf("recorded %d hits", len(hits))
+			}
+			if have := hits[0].Path; have != tt.wantPath {
+				t.Errorf("have %q; want %q", have, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestBackendCountError(t *testing.T) {
+	long := strings.Repeat("x", goatcounter.MaxJSErrorMessage+100)
+	tests := []struct {
+		name     string
+		body     string
+		bot      isbot.Result
+		wantCode int
+		wantX    string
+		want     string
+	}{
+		{"valid", `{"p": "/a", "message": "Uncaught TypeError: x is undefined", "source": "https://example.com/app.js", "line": 12, "col": 5}`,
+			isbot.NoBotNoMatch, 204, "",
+			`/a|Uncaught TypeError: x is undefined|https://example.com/app.js|12|5`},
+		{"sanitize", `{"message": "  multi\nline\u0000 ", "line": -1}`,
+			isbot.NoBotNoMatch, 204, "",
+			`|multi line||0|0`},
+		{"truncate", `{"message": "` + long + `", "source": "` + long + `"}`,
+			isbot.NoBotNoMatch, 204, "",
+			`|` + long[:goatcounter.MaxJSErrorMessage] + `|` + long[:goatcounter.MaxJSErrorSource] + `|0|0`},
+
+		{"no message", `{"source": "app.js"}`, isbot.NoBotNoMatch, 400, "invalid", ""},
+		{"malformed", `{"message": `, isbot.NoBotNoMatch, 400, "decode_error", ""},
+		{"too large", `{"message": "` + strings.Repeat("x", maxErrorBody) + `"}`, isbot.NoBotNoMatch, 413, "too_large", ""},
+		{"bot", `{"message": "x"}`, isbot.BotClientLibrary, 202, "bot", ""},
+		{"prefetch", `{"message": "x"}`, isbot.BotPrefetch, 202, "prefetch", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			deps := &fakeCountDeps{now: ztime.Now(), bot: tt.bot}
+			r, rr := newTest(ctx, "POST", "/count/error", strings.NewReader(tt.body))
+			err := backend{deps: deps}.countError(rr, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ztest.Code(t, rr, tt.wantCode)
+			if have := rr.Header().Get("X-Goatcounter-Code"); have != tt.wantX {
+				t.Errorf("X-Goatcounter-Code\nhave: %q\nwant: %q", have, tt.wantX)
+			}
+
+			var rows []string
+			err = zdb.Select(ctx, &rows, `select path || '|' || message || '|' || source || '|' || line || '|' || col
+				from js_errors where site_id=?`, Site(ctx).ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := strings.Join(rows, "\n"); have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+
+	t.Run("ratelimit", func(t *testing.T) {
+		ctx := gctest.DB(t)
+
+		h := NewBackend(zdb.MustGetDB(ctx), nil, false, true, false, "example.com", 10, 0)
+		for i := 1; i <= 11; i++ {
+			r, rr := newTest(ctx, "POST", "/count/error", strings.NewReader(`{"message": "x"}`))
+			r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0")
+			h.ServeHTTP(rr, r)
+			want := 204
+			if i == 11 {
+				want = 429
+			}
+			ztest.Code(t, rr, want)
+		}
+
+		// Doesn't affect the limit for pageviews.
+		r, rr := newTest(ctx, "POST", "/count", strings.NewReader(`{"p": "/x"}`))
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0")
+		h.ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+		_, err := goatcounter.Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBackendCountPreflight(t *testing.T) {
+	tests := []struct {
+		path          string
+		maxAge        time.Duration
+		requireHeader string
+		wantMaxAge    string
+		wantHeaders   string
+	}{
+		{"/count", 2 * time.Hour, "", "7200",
+			"Content-Type, Authorization, X-Goatcounter-Signature, X-Goatcounter-Session"},
+		{"/count/stream", 10 * time.Minute, "", "600",
+			"Content-Type, Authorization, X-Goatcounter-Signature, X-Goatcounter-Session"},
+		{"/count/error", 0, "", "",
+			"Content-Type, Authorization, X-Goatcounter-Signature, X-Goatcounter-Session"},
+		{"/count", time.Hour, "X-Proxy-Token", "3600",
+			"Content-Type, Authorization, X-Goatcounter-Signature, X-Goatcounter-Session, X-Proxy-Token"},
+		{"/_stats/count", time.Hour, "", "3600",
+			"Content-Type, Authorization, X-Goatcounter-Signature, X-Goatcounter-Session"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			goatcounter.Config(ctx).CountMaxAge = tt.maxAge
+			goatcounter.Config(ctx).CountPrefix = "/_stats"
+			site := Site(ctx)
+			site.Settings.RequireHeader, site.Settings.RequireHeaderValue = tt.requireHeader, "x"
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "OPTIONS", tt.path, nil)
+			r.Header.Set("Origin", "https://example.com")
+			r.Header.Set("Access-Control-Request-Method", "POST")
+			r.Header.Set("Access-Control-Request-Headers", "content-type")
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 204)
+
+			want := map[string]string{
+				"Access-Control-Allow-Origin":  "*",
+				"Access-Control-Allow-Methods": "GET, POST, OPTIONS",
+				"Access-Control-Allow-Headers": tt.wantHeaders,
+				"Access-Control-Max-Age":       tt.wantMaxAge,
+			}
+			for k, w := range want {
+				if h := rr.Header().Get(k); h != w {
+					t.Errorf("%s\nhave: %q\nwant: %q", k, h, w)
+				}
+			}
+			if goatcounter.Memstore.Len() != 0 {
+				t.Error("added to the memstore")
+			}
+		})
+	}
+}
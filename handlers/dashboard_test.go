@@ -5,9 +5,13 @@
 package handlers
 
 import (
+	"context"
 	"testing"
 	"time"
 
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zint"
 	"zgo.at/zstd/ztime"
 )
 
@@ -20,6 +24,22 @@ func TestDashboard(t *testing.T) {
 			wantCode: 200,
 			wantBody: "<strong>No data received</strong>",
 		},
+		{
+			name:     "sessions",
+			setup:    dashboardHits(true),
+			router:   newBackend,
+			auth:     true,
+			wantCode: 200,
+			wantBody: "<span>3</span> visits",
+		},
+		{
+			name:     "no sessions",
+			setup:    dashboardHits(false),
+			router:   newBackend,
+			auth:     true,
+			wantCode: 200,
+			wantBody: "<span>3</span> pageviews",
+		},
 	}
 
 	for _, tt := range tests {
@@ -27,6 +47,25 @@ func TestDashboard(t *testing.T) {
 	}
 }
 
+// dashboardHits stores three pageviews for the dashboard, from different
+// visitors.
+func dashboardHits(sessions bool) func(context.Context, *testing.T) {
+	return func(ctx context.Context, t *testing.T) {
+		if !sessions {
+			site := Site(ctx)
+			site.Settings.Collect &^= goatcounter.CollectSession
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		gctest.StoreHits(ctx, t, false,
+			goatcounter.Hit{Path: "/a", Session: zint.Uint128{1, 1}, FirstVisit: true},
+			goatcounter.Hit{Path: "/a", Session: zint.Uint128{2, 2}, FirstVisit: true},
+			goatcounter.Hit{Path: "/b", Session: zint.Uint128{3, 3}, FirstVisit: true})
+	}
+}
+
 func TestTimeRange(t *testing.T) {
 	tests := []struct {
 		rng, now, wantStart, wantEnd string
@@ -20,13 +20,17 @@ import (
 )
 
 var rateLimits = struct {
-	count, api, apiCount, export, login func(*http.Request) (int, int64)
+	count, countError, api, apiCount, apiActive, export, login, siteCreate, siteVerify func(*http.Request) (int, int64)
 }{
-	count:    mware.RatelimitLimit(4, 1),
-	api:      mware.RatelimitLimit(4, 1),
-	apiCount: mware.RatelimitLimit(60, 120),
-	export:   mware.RatelimitLimit(1, 3600),
-	login:    mware.RatelimitLimit(20, 60),
+	count:      mware.RatelimitLimit(4, 1),
+	countError: mware.RatelimitLimit(10, 60),
+	api:        mware.RatelimitLimit(4, 1),
+	apiCount:   mware.RatelimitLimit(60, 120),
+	apiActive:  mware.RatelimitLimit(30, 60),
+	export:     mware.RatelimitLimit(1, 3600),
+	login:      mware.RatelimitLimit(20, 60),
+	siteCreate: mware.RatelimitLimit(10, 3600),
+	siteVerify: mware.RatelimitLimit(60, 3600),
 }
 
 // Set the rate limits.
@@ -35,14 +39,22 @@ func SetRateLimit(name string, reqs int, secs int64) {
 	switch strings.ToLower(name) {
 	case "count":
 		rateLimits.count = r
+	case "counterror", "count-error":
+		rateLimits.countError = r
 	case "api":
 		rateLimits.api = r
 	case "apicount", "api-count":
 		rateLimits.apiCount = r
+	case "apiactive", "api-active":
+		rateLimits.apiActive = r
 	case "export":
 		rateLimits.export = r
 	case "login":
 		rateLimits.login = r
+	case "sitecreate", "site-create":
+		rateLimits.siteCreate = r
+	case "siteverify", "site-verify":
+		rateLimits.siteVerify = r
 	default:
 		panic(fmt.Sprintf("handlers.SetRateLimit: invalid name: %q", name))
 	}
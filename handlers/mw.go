@@ -7,9 +7,12 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"runtime"
+	"slices"
 	"strings"
 	"time"
 
@@ -19,10 +22,12 @@ import (
 	"zgo.at/json"
 	"zgo.at/termtext"
 	"zgo.at/z18n"
+	zcache2 "zgo.at/zcache/v2"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
 	"zgo.at/zhttp/auth"
 	"zgo.at/zhttp/header"
+	"zgo.at/zhttp/mware"
 	"zgo.at/zlog"
 	"zgo.at/zstd/znet"
 	"zgo.at/zstd/zruntime"
@@ -110,10 +115,18 @@ func addctx(db zdb.DB, loadSite bool, dashTimeout int) func(http.Handler) http.H
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 
+			if p, ok := countPrefixPath(r.URL.Path, goatcounter.Config(ctx).CountPrefix); ok {
+				u := *r.URL
+				u.Path, u.RawPath = p, ""
+				r.URL = &u
+			}
+
 			// Intercept /status here so it works everywhere.
 			if r.URL.Path == "/status" {
 				info, _ := zdb.Info(ctx)
-				j, err := json.Marshal(map[string]any{
+				running, queued := goatcounter.ExportJobs()
+				geoMode, geoInflight := goatcounter.GeoMode()
+				status := map[string]any{
 					"uptime":   ztime.Now().Sub(Started).Round(time.Second).String(),
 					"version":  goatcounter.Version,
 					"database": zdb.SQLDialect(ctx).String() + " " + string(info.Version),
@@ -122,7 +135,13 @@ func addctx(db zdb.DB, loadSite bool, dashTimeout int) func(http.Handler) http.H
 					"GOARCH":   runtime.GOARCH,
 					"race":     zruntime.Race,
 					"cgo":      zruntime.CGO,
-				})
+					"exports":  map[string]int{"running": running, "queued": queued},
+					"geo":      map[string]any{"mode": geoMode, "inflight": geoInflight},
+				}
+				if geo, ok := goatcounter.GeoUpdateInfo(); ok {
+					status["geodb_update"] = geo
+				}
+				j, err := json.Marshal(status)
 				if err != nil {
 					http.Error(w, err.Error(), 500)
 					return
@@ -167,13 +186,25 @@ func addctx(db zdb.DB, loadSite bool, dashTimeout int) func(http.Handler) http.H
 
 			// Load site from domain.
 			if loadSite {
-				var s goatcounter.Site // code
-				err := s.ByHost(r.Context(), r.Host)
+				var (
+					s   goatcounter.Site // code
+					err error
+				)
+				if isCount(r) && isIPHost(r.Host) && ipHostMode(r.Context()) != goatcounter.IPHostDefault {
+					if !ipHostSite(w, r, &s) {
+						return
+					}
+				} else {
+					err = s.ByHost(r.Context(), r.Host)
+				}
 
 				// If there's just one site then we can just serve that; most
 				// people probably have just one site so it's all grand. Do
 				// print a warning in the console though.
-				if err != nil && !goatcounter.Config(r.Context()).GoatcounterCom {
+				// Create a new site instead of using the one site, if enabled.
+				create := isCount(r) && (goatcounter.Config(r.Context()).UnknownSite == goatcounter.UnknownSiteCreate ||
+					goatcounter.Config(r.Context()).UnknownSite == goatcounter.UnknownSiteVerify)
+				if err != nil && !goatcounter.Config(r.Context()).GoatcounterCom && !create {
 					var sites goatcounter.Sites
 					err2 := sites.UnscopedList(r.Context())
 					if err2 == nil && len(sites) == 1 {
@@ -195,6 +226,12 @@ func addctx(db zdb.DB, loadSite bool, dashTimeout int) func(http.Handler) http.H
 					}
 				}
 
+				if err != nil && zdb.ErrNoRows(err) && isCount(r) {
+					if !unknownSite(w, r, &s) {
+						return
+					}
+					err = nil
+				}
 				if err != nil {
 					if zdb.ErrNoRows(err) {
 						err = guru.Errorf(400, "no site at this domain (%q)", r.Host)
@@ -218,6 +255,201 @@ func addctx(db zdb.DB, loadSite bool, dashTimeout int) func(http.Handler) http.H
 	}
 }
 
+// isCount reports if this is a request to one of the /count endpoints.
+func isCount(r *http.Request) bool {
+	return r.URL.Path == "/count" || strings.HasPrefix(r.URL.Path, "/count/")
+}
+
+// countPrefixPath gets the path without the prefix if it's for /count.js,
+// /count.site.js, or one of the /count endpoints under GlobalConfig.CountPrefix.
+func countPrefixPath(path, prefix string) (string, bool) {
+	if prefix == "" {
+		return "", false
+	}
+	p, ok := strings.CutPrefix(path, prefix)
+	if !ok || (p != "/count" && p != "/count.js" && p != "/count.site.js" && !strings.HasPrefix(p, "/count/")) {
+		return "", false
+	}
+	return p, true
+}
+
+// unknownSite handles /count requests for a host that doesn't match any site,
+// as configured with -unknown-site. It returns true if the request should
+// continue with the site in s.
+func unknownSite(w http.ResponseWriter, r *http.Request, s *goatcounter.Site) bool {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch goatcounter.Config(r.Context()).UnknownSite {
+	case goatcounter.UnknownSite404:
+		w.Header().Set("Content-Type", "image/gif")
+		countReason(w, countUnknownSite, "unknown site")
+		w.WriteHeader(404)
+		w.Write(gif)
+		return false
+
+	case goatcounter.UnknownSiteCreate, goatcounter.UnknownSiteVerify:
+		if !goatcounter.Config(r.Context()).GoatcounterCom {
+			ok, err := createSite(r, znet.RemovePort(r.Host), s)
+			if ok {
+				return true
+			}
+			if err != nil {
+				zlog.FieldsRequest(r).Error(err)
+			}
+		}
+		fallthrough
+
+	// Don't tell which sites exist.
+	default:
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(gif)
+		return false
+	}
+}
+
+// isIPHost reports if the Host header is an IPv4 or IPv6 address, with or
+// without a port.
+func isIPHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	_, err := netip.ParseAddr(host)
+	return err == nil
+}
+
+func ipHostMode(ctx context.Context) string {
+	if m := goatcounter.Config(ctx).IPHost; m != "" {
+		return m
+	}
+	return goatcounter.IPHostDefault
+}
+
+// ipHostSite handles /count requests where the Host is an IP address, as
+// configured with -ip-host. It returns true if the request should continue
+// with the site in s.
+func ipHostSite(w http.ResponseWriter, r *http.Request, s *goatcounter.Site) bool {
+	if ipHostMode(r.Context()) == goatcounter.IPHostSite {
+		err := s.ByID(r.Context(), goatcounter.Config(r.Context()).IPHostSiteID)
+		if err == nil {
+			return true
+		}
+		zlog.FieldsRequest(r).Error(err)
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "image/gif")
+	countReason(w, countIPHost, "host is an IP address")
+	w.Write(gif)
+	return false
+}
+
+var (
+	// lookupTXT gets the TXT records for the host.
+	lookupTXT = net.DefaultResolver.LookupTXT
+
+	siteCreateRate = mware.NewRatelimitMemory()
+	siteVerifyRate = mware.NewRatelimitMemory()
+
+	// Hosts that failed verifyHost(), so a stream of requests for the same
+	// host doesn't do a DNS lookup for every request.
+	unverifiedHosts = zcache2.New[string, struct{}](time.Minute, 5*time.Minute)
+)
+
+// verifyHost reports if the host has the goatcounter.VerifyTXT record on
+// _goatcounter.[host].
+func verifyHost(ctx context.Context, host string) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	txt, err := lookupTXT(ctx, "_goatcounter."+host)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(txt, goatcounter.VerifyTXT)
+}
+
+// createSite creates a new site for the host, in the first account, with the
+// settings of the account except the secrets. It reports if the site was
+// created; with UnknownSiteVerify sites are only created for hosts with the
+// VerifyTXT record, and they get the default settings rather than the settings
+// of the account.
+//
+// Sites are created for at most the "site-create" rate limit, for all hosts.
+// The DNS lookups for UnknownSiteVerify have their own "site-verify" rate limit,
+// so random hosts can't be used to make an unlimited number of DNS lookups, or
+// to use up the site-create limit for hosts that are never created.
+func createSite(r *http.Request, host string, s *goatcounter.Site) (bool, error) {
+	ctx := r.Context()
+	verify := goatcounter.Config(ctx).UnknownSite == goatcounter.UnknownSiteVerify
+	if verify {
+		if _, ok := unverifiedHosts.Get(host); ok {
+			return false, nil
+		}
+	}
+
+	if verify {
+		n, period := rateLimits.siteVerify(r)
+		if ok, _ := siteVerifyRate.Grant("", n, period); !ok {
+			return false, errors.Errorf("createSite %q: rate limit of %d DNS lookups per %ds reached", host, n, period)
+		}
+		if !verifyHost(ctx, host) {
+			unverifiedHosts.Set(host, struct{}{})
+			return false, nil
+		}
+	}
+
+	var sites goatcounter.Sites
+	err := sites.UnscopedList(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "createSite")
+	}
+	var account *goatcounter.Site
+	for i := range sites {
+		if sites[i].Parent == nil && (account == nil || sites[i].ID < account.ID) {
+			account = &sites[i]
+		}
+	}
+	if account == nil {
+		return false, errors.New("createSite: no sites")
+	}
+
+	// Copy the settings through Export() so the secrets aren't copied; every
+	// site gets its own from Defaults().
+	newSite := goatcounter.Site{Cname: &host, Parent: &account.ID}
+	if !verify {
+		doc, err := account.Settings.Export()
+		if err != nil {
+			return false, errors.Wrap(err, "createSite")
+		}
+		err = newSite.Settings.Import(doc)
+		if err != nil {
+			return false, errors.Wrap(err, "createSite")
+		}
+	}
+
+	n, period := rateLimits.siteCreate(r)
+	if ok, _ := siteCreateRate.Grant("", n, period); !ok {
+		return false, errors.Errorf("createSite %q: rate limit of %d sites per %ds reached", host, n, period)
+	}
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		err := newSite.Insert(ctx)
+		if err != nil {
+			return err
+		}
+		return newSite.UpdateCnameSetupAt(ctx)
+	})
+	if err != nil {
+		// May have been created in the meantime by another request.
+		if err2 := s.ByHost(ctx, host); err2 == nil {
+			return true, nil
+		}
+		return false, errors.Wrapf(err, "createSite %q", host)
+	}
+
+	zlog.Module("site").Printf("created site %d for unknown host %q in account %d", newSite.ID, host, account.ID)
+	*s = newSite
+	return true, nil
+}
+
 func noSites(db zdb.DB, w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		w.Header().Set("Location", "/")
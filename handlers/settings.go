@@ -26,6 +26,7 @@ import (
 	"zgo.at/goatcounter/v2/acme"
 	"zgo.at/goatcounter/v2/cron"
 	"zgo.at/guru"
+	"zgo.at/tz"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
 	"zgo.at/zhttp/header"
@@ -70,6 +71,7 @@ func (h settings) mount(r chi.Router) {
 		}))
 		set.Post("/settings/main", zhttp.Wrap(h.mainSave))
 		set.Get("/settings/main/ip", zhttp.Wrap(h.ip))
+		set.Get("/settings/test-mode", zhttp.Wrap(h.testMode))
 		set.Get("/settings/change-code", zhttp.Wrap(h.changeCode))
 		set.Post("/settings/change-code", zhttp.Wrap(h.changeCode))
 
@@ -134,8 +136,9 @@ func (h settings) main(verr *zvalidate.Validator) zhttp.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		return zhttp.Template(w, "settings_main.gohtml", struct {
 			Globals
-			Validate *zvalidate.Validator
-		}{newGlobals(w, r), verr})
+			Validate  *zvalidate.Validator
+			Timezones []*tz.Zone
+		}{newGlobals(w, r), verr, tz.Zones})
 	}
 }
 
@@ -166,6 +169,9 @@ func (h settings) mainSave(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	site := Site(r.Context())
+	if site.Settings.InTestMode() { // Keep the expiry if it's already enabled.
+		args.Settings.TestModeUntil = site.Settings.TestModeUntil
+	}
 	site.Settings = args.Settings
 	site.LinkDomain = args.LinkDomain
 
@@ -212,6 +218,14 @@ func (h settings) mainSave(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.SeeOther(w, "/settings")
 }
 
+func (h settings) testMode(w http.ResponseWriter, r *http.Request) error {
+	site := Site(r.Context())
+	return zhttp.Template(w, "settings_testmode.gohtml", struct {
+		Globals
+		Log []testLogEntry
+	}{newGlobals(w, r), testModeLog.list(site.ID)})
+}
+
 func (h settings) changeCode(w http.ResponseWriter, r *http.Request) error {
 	if r.Method == "GET" {
 		return zhttp.Template(w, "settings_changecode.gohtml", struct {
@@ -645,15 +659,31 @@ func (h settings) exportStart(w http.ResponseWriter, r *http.Request) error {
 		return v
 	}
 
+	release, err := goatcounter.AcquireExport(r.Context(), Site(r.Context()).ID)
+	if err != nil {
+		if !errors.Is(err, goatcounter.ErrExportBusy) {
+			return err
+		}
+		zhttp.FlashError(w, T(r.Context(), "error/export-busy|There are too many exports running right now; try again in a few minutes."))
+		return zhttp.SeeOther(w, "/settings/export")
+	}
+
 	var export goatcounter.Export
 	fp, err := export.Create(r.Context(), startFrom)
 	if err != nil {
+		release()
 		return err
 	}
 
 	ctx := goatcounter.CopyContextValues(r.Context())
-	bgrun.RunFunction(fmt.Sprintf("export web:%d", Site(ctx).ID),
-		func() { export.Run(ctx, fp, true) })
+	err = bgrun.RunFunction(fmt.Sprintf("export web:%d", Site(ctx).ID), func() {
+		defer release()
+		export.Run(ctx, fp, true)
+	})
+	if err != nil {
+		release()
+		return err
+	}
 
 	zhttp.Flash(w, T(r.Context(), "notify/export-started-in-background|Export started in the background; you’ll get an email with a download link when it’s done."))
 	return zhttp.SeeOther(w, "/settings/export")
@@ -922,14 +952,15 @@ func (h settings) bosmang(w http.ResponseWriter, r *http.Request) error {
 	info, _ := zdb.Info(r.Context())
 	return zhttp.Template(w, "settings_server.gohtml", struct {
 		Globals
-		Uptime   string
-		Version  string
-		Database string
-		Go       string
-		GOOS     string
-		GOARCH   string
-		Race     bool
-		Cgo      bool
+		Uptime      string
+		Version     string
+		Database    string
+		Go          string
+		GOOS        string
+		GOARCH      string
+		Race        bool
+		Cgo         bool
+		Maintenance bool
 	}{newGlobals(w, r),
 		ztime.Now().Sub(Started).Round(time.Second).String(),
 		goatcounter.Version,
@@ -939,5 +970,6 @@ func (h settings) bosmang(w http.ResponseWriter, r *http.Request) error {
 		runtime.GOARCH,
 		zruntime.Race,
 		zruntime.CGO,
+		goatcounter.Maintenance(),
 	})
 }
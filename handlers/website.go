@@ -520,6 +520,8 @@ func (h website) help(w http.ResponseWriter, r *http.Request) error {
 		MetaDesc    string
 		CountDomain string
 		SiteURL     string
+		CountURL    string
+		CountJSURL  string
 		SiteDomain  string
 		FromWWW     bool
 
@@ -527,7 +529,8 @@ func (h website) help(w http.ResponseWriter, r *http.Request) error {
 		Validate *zvalidate.Validator
 		Args     any
 	}{newGlobals(w, r), "help", cp, "Documentation – GoatCounter",
-		dc, site.URL(r.Context()), site.Domain(r.Context()), h.fromWWW,
+		dc, site.URL(r.Context()), site.CountURL(r.Context()), site.CountJSURL(r.Context(), dc),
+		site.Domain(r.Context()), h.fromWWW,
 		nil, nil})
 }
 
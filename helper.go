@@ -46,6 +46,12 @@ var Templates embed.FS
 //go:embed pack/GeoLite2-Country.mmdb.gz
 var GeoDB []byte
 
+// MonitorsDB contains the default list of uptime monitor User-Agents; see
+// LoadMonitors().
+//
+//go:embed pack/monitors.txt
+var MonitorsDB []byte
+
 // State column values.
 const (
 	StateActive  = "a"
@@ -56,12 +62,14 @@ const (
 var States = []string{StateActive, StateRequest, StateDeleted}
 
 var SQLiteHook = func(c *sqlite3.SQLiteConn) error {
-	return c.RegisterFunc("percent_diff", func(start, final int) float64 {
-		if start == 0 {
-			return math.Inf(0)
-		}
-		return (float64(final - start)) / float64(start) * 100.0
-	}, true)
+	return c.RegisterFunc("percent_diff", percentDiff, true)
+}
+
+func percentDiff(start, final int) float64 {
+	if start == 0 {
+		return math.Inf(0)
+	}
+	return (float64(final - start)) / float64(start) * 100.0
 }
 
 // TODO: Move to zdb
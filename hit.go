@@ -5,13 +5,20 @@
 package goatcounter
 
 import (
+	"cmp"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/url"
 	"slices"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"golang.org/x/text/language"
 	"zgo.at/errors"
 	"zgo.at/zdb"
 	"zgo.at/zstd/zbool"
@@ -19,11 +26,66 @@ import (
 	"zgo.at/zstd/ztime"
 )
 
+// Values for Hit.Type.
+const (
+	HitTypePageview = "pageview"
+	HitTypeDownload = "download" // Downloads of PDFs, media, etc.
+	HitTypeOutbound = "outbound" // Clicks on links to other sites; the path is the destination.
+)
+
+// HitTypes lists all valid values for Hit.Type.
+var HitTypes = []string{HitTypePageview, HitTypeDownload, HitTypeOutbound}
+
+// Values for Hit.Platform.
+const (
+	PlatformWeb = "web" // Website.
+	PlatformApp = "app" // In-app webview or native SDK.
+)
+
+// Platforms lists all valid values for Hit.Platform.
+var Platforms = []string{PlatformWeb, PlatformApp}
+
+// Values for Hit.NavType.
+const (
+	NavTypeDirect   = "direct"   // Typed in, bookmark, etc.
+	NavTypeInternal = "internal" // Link from the site itself.
+	NavTypeExternal = "external" // Link from another site.
+)
+
+// MaxTZOffset is the maximum value for Hit.TZOffset in either direction (14
+// hours).
+const MaxTZOffset = 14 * 60
+
+// ConnTypes lists all valid values for Hit.Conn; these are the values for
+// navigator.connection.effectiveType.
+var ConnTypes = []string{"slow-2g", "2g", "3g", "4g"}
+
+// SizeBuckets lists all valid values for Hit.SizeBucket; these are for the CSS
+// (min-width: …) breakpoints 640px, 1024px, and 1440px, so "sm" is below 640px
+// and "xl" is 1440px or more.
+var SizeBuckets = []string{"sm", "md", "lg", "xl"}
+
+// MaxLanguages is the maximum number of languages in Hit.Languages.
+const MaxLanguages = 5
+
+// MaxPerf is the maximum value for the Hit.Perf* load times, in milliseconds;
+// anything longer is almost certainly wrong (e.g. a tab that was in the
+// background), and is ignored.
+const MaxPerf = 60_000
+
+// MaxDwell is the maximum value for Hit.DwellMs, in milliseconds.
+const MaxDwell = 24 * 60 * 60 * 1000
+
+// MaxEventValue is the maximum value for Hit.EventValue in either direction;
+// negative values are allowed for things like refunds.
+const MaxEventValue = 1_000_000_000
+
 type Hit struct {
 	ID         int64        `db:"hit_id" json:"-"`
 	Site       int64        `db:"site_id" json:"-"`
 	PathID     int64        `db:"path_id" json:"-"`
 	RefID      int64        `db:"ref_id" json:"-"`
+	PrevPathID *int64       `db:"prev_path_id" json:"-"`
 	SizeID     *int64       `db:"size_id" json:"-"`
 	BrowserID  int64        `db:"browser_id" json:"-"`
 	SystemID   int64        `db:"system_id" json:"-"`
@@ -37,23 +99,125 @@ type Hit struct {
 	Size  Floats     `db:"-" json:"s,omitempty"`
 	Query string     `db:"-" json:"q,omitempty"`
 	Bot   int        `db:"bot" json:"b,omitempty"`
+	Type  string     `db:"type" json:"type,omitempty"` // One of the HitType* constants.
+
+	// Coarse class of Bot, such as BotClassSearch; empty if it's not a bot.
+	// See GetBotClass().
+	BotClass string `db:"bot_class" json:"-"`
+
+	// Visitor's UTC offset in minutes, east of UTC (e.g. 120 for UTC+2), as
+	// reported by the client; nil if unknown. CreatedAt is always UTC.
+	TZOffset *int `db:"tz_offset" json:"tz_offset,omitempty"`
+
+	// Visitor is logged in to the site, as reported by the client; nil if
+	// unknown or if SiteSettings.RecordAuth is off. This is only ever a
+	// boolean, never an identifier.
+	Authed *zbool.Bool `db:"authed" json:"auth,omitempty"`
+
+	// Page load times in milliseconds, as reported by the client; nil if
+	// unknown or if CollectPerf is off. These are the Navigation Timing
+	// responseStart (time to first byte), domContentLoadedEventEnd, and
+	// loadEventEnd.
+	PerfTTFB *int `db:"perf_ttfb" json:"ttfb,omitempty"`
+	PerfDCL  *int `db:"perf_dcl" json:"dcl,omitempty"`
+	PerfLoad *int `db:"perf_load" json:"load,omitempty"`
+
+	// Effective connection type as reported by the client, as one of
+	// ConnTypes; empty if unknown or if CollectConnection is off.
+	Conn string `db:"conn" json:"conn,omitempty"`
+
+	// Coarse screen size as reported by the client, as one of SizeBuckets;
+	// empty if unknown or if CollectSizeBucket is off. This is an
+	// alternative to Size that's much harder to fingerprint.
+	SizeBucket string `db:"size_bucket" json:"size_bucket,omitempty"`
+
+	// Platform the pageview is from, as one of Platforms. This is set from
+	// the client, or PlatformApp if the User-Agent matches
+	// SiteSettings.AppUserAgentSubstrings, and PlatformWeb otherwise.
+	Platform string `db:"platform" json:"platform,omitempty"`
+
+	// How the visitor got to the page, as one of the NavType* constants;
+	// empty if CollectNavType is off. See Hit.setNavType().
+	NavType string `db:"nav_type" json:"-"`
+
+	// Friendly name for the referrer host, such as "Twitter" for "t.co", or
+	// the registered domain if it's not known; empty if there is no
+	// referrer. See SiteSettings.SourceName().
+	SourceName string `db:"source_name" json:"-"`
+
+	// Hash of the SiteSettings.ExperimentParams in the query, salted with
+	// SiteSettings.ExperimentSecret; empty if none of the parameters are set.
+	// See Hit.setExperiment().
+	ExperimentHash string `db:"experiment_hash" json:"-"`
+
+	// Number of pageviews this pageview stands for: SiteSettings.SampleRate
+	// if the others were dropped by the sampling, or 1 (or 0) if it wasn't
+	// sampled. See Hit.Weight().
+	SampleWeight int `db:"sample_weight" json:"-"`
+
+	// Source to attribute the pageview to instead of the referrer or
+	// utm_source, such as "qr-poster" for a QR code. This is sent by the
+	// client separately from the referrer, and is ignored unless it's in
+	// SiteSettings.RefSources.
+	RefSource string `db:"-" json:"ref_source,omitempty"`
+
+	// No session was started because the site's SessionRateLimit was
+	// exceeded; the pageview is stored, but it's not counted as a visitor.
+	SessionThrottled zbool.Bool `db:"session_throttled" json:"-"`
+
+	// The browser is controlled by automation (navigator.webdriver), as
+	// reported by the client; what's done with it depends on
+	// SiteSettings.Webdriver. This can't be verified: anyone can send it, or
+	// leave it out.
+	Webdriver zbool.Bool `db:"-" json:"webdriver,omitempty"`
+
+	// How long the page was visible before the pageview was sent, in
+	// milliseconds, as reported by the client; nil if unknown. This is only
+	// used for SiteSettings.MinDwellMs and isn't stored.
+	DwellMs *int `db:"-" json:"dwell_ms,omitempty"`
+
+	// Numeric value of an event, such as an order total, as reported by the
+	// client; nil if unknown or if SiteSettings.CollectEventValue is off. This
+	// is only stored for events.
+	EventValue *float64 `db:"event_value" json:"value,omitempty"`
 
 	RefScheme       *string    `db:"ref_scheme" json:"-"`
 	UserAgentHeader string     `db:"-" json:"-"`
 	Location        string     `db:"location" json:"-"`
 	Language        *string    `db:"language" json:"-"`
+	Languages       Strings    `db:"languages" json:"-"`        // See SiteSettings.CollectLanguages
+	BrowserLanguage *string    `db:"browser_language" json:"-"` // See SiteSettings.CollectBrowserLanguage
 	FirstVisit      zbool.Bool `db:"first_visit" json:"-"`
 	CreatedAt       time.Time  `db:"created_at" json:"-"`
+	TLSVersion      uint16     `db:"tls_version" json:"-"` // tls.Version* constant; see CollectTLS
+	TLSCipher       uint16     `db:"tls_cipher" json:"-"`  // tls.TLS_* cipher suite constant; see CollectTLS
+	ASN             uint32     `db:"asn" json:"-"`         // Autonomous system number; see CollectASN
+	ASNOrg          string     `db:"asn_org" json:"-"`     // Autonomous system organisation; see CollectASN
 
-	RefURL *url.URL `db:"-" json:"-"`   // Parsed Ref
-	Random string   `db:"-" json:"rnd"` // Browser cache buster, as they don't always listen to Cache-Control
+	RefURL    *url.URL `db:"-" json:"-"`                   // Parsed Ref
+	PrevPath  string   `db:"-" json:"-"`                   // Previous path for internal navigation; see SiteSettings.InternalNavigation
+	Random    string   `db:"-" json:"rnd"`                 // Browser cache buster, as they don't always listen to Cache-Control
+	Signature string   `db:"-" json:"sig,omitempty"`       // See SiteSettings.RequireSignature
+	RequestID string   `db:"-" json:"rid,omitempty"`       // Only recorded once per path if sent more than once
+	RefDomain string   `db:"-" json:"-"`                   // Registered domain of RefURL, e.g. "example.co.uk"
+	Canonical string   `db:"-" json:"canonical,omitempty"` // Used as the path; see SiteSettings.CanonicalPaths
 
 	// Some values we need to pass from the HTTP handler to memstore
-	RemoteAddr    string `db:"-" json:"-"`
-	UserSessionID string `db:"-" json:"-"`
+	RemoteAddr     string      `db:"-" json:"-"`
+	UserSessionID  string      `db:"-" json:"-"`
+	AcceptLanguage string      `db:"-" json:"-"` // Only if lookup is deferred; see SiteSettings.CollectExternalOnly
+	CookieLanguage string      `db:"-" json:"-"` // Only if lookup is deferred; see SiteSettings.LanguageCookie
+	Anonymous      bool        `db:"-" json:"-"` // No consent; see SiteSettings.ConsentCookie
+	RefHidden      bool        `db:"-" json:"-"` // Empty referrer was likely removed; see SiteSettings.HiddenRefs
+	ClientHints    ClientHints `db:"-" json:"-"` // Only if SiteSettings.ClientHints is set
+	ServerClient   bool        `db:"-" json:"-"` // Authenticated server-side client; see SiteSettings.ServerClients
+	FetchSite      string      `db:"-" json:"-"` // Sec-Fetch-Site header of the navigation; see CollectNavType
+	TruncatedFrom  int         `db:"-" json:"-"` // Length of the path before it was truncated; see LongPathsTruncate
 
 	// Don't process in memstore; for merging paths.
 	noProcess bool `db:"-" json:"-"`
+	// Don't insert anything in the database; see Memstore.Preview().
+	preview bool `db:"-" json:"-"`
 }
 
 func (h *Hit) Ignore() bool {
@@ -73,6 +237,147 @@ func (h *Hit) Ignore() bool {
 	return false
 }
 
+// CountsAsPageview reports if this hit should be included in the pageview
+// stats.
+//
+// Bots are never counted, unless their category is in the CountBots list of
+// the GlobalConfig; these are still stored with the bot flag set, so they can
+// be told apart from regular pageviews.
+//
+// Downloads and outbound links (see Hit.Type) are never counted; they're
+// stored with their type and can be segmented with ExportGroupType.
+func (h Hit) CountsAsPageview(ctx context.Context) bool {
+	if !h.isPageview() {
+		return false
+	}
+	return h.Bot == 0 || slices.Contains(Config(ctx).CountBots, h.Bot)
+}
+
+// isPageview reports if the Hit.Type is a pageview; it's blank before
+// Defaults().
+func (h Hit) isPageview() bool {
+	return h.Type == "" || h.Type == HitTypePageview
+}
+
+// Weight gets the number of pageviews this pageview is counted as in the
+// stats; see SampleWeight.
+func (h Hit) Weight() int {
+	if h.SampleWeight < 1 {
+		return 1
+	}
+	return h.SampleWeight
+}
+
+// HasExternalRef reports if this hit has a referrer from outside the site's
+// LinkDomain, comparing the host in the same way as InternalNavigation.
+//
+// Referrers that aren't an URL, such as campaigns, are always external. There's
+// no way to tell internal navigation apart if the LinkDomain isn't set, so URLs
+// are never external in that case.
+//
+// This should be called after Defaults(), as it relies on the referrer being
+// cleaned up.
+func (h Hit) HasExternalRef(site Site) bool {
+	switch {
+	case h.Ref == "":
+		return false
+	case h.RefURL == nil || h.RefURL.Host == "":
+		return true
+	case site.LinkDomainURL(false) == "":
+		return false
+	}
+	return !site.IsOwnHost(h.RefURL.Hostname())
+}
+
+// ParseLanguage gets the ISO-639-3 language code from an Accept-Language
+// header; it returns nil if there is no language with at least the min
+// confidence.
+//
+// Entries that don't identify an actual language are skipped: the "*" wildcard
+// (which is parsed as "mul"), "und", "zxx", "mis", and private-use codes.
+func ParseLanguage(header string, min language.Confidence) *string {
+	l := ParseLanguages(header, min, 1)
+	if len(l) == 0 {
+		return nil
+	}
+	return &l[0]
+}
+
+// ParseLanguages is like ParseLanguage(), but gets up to max distinct
+// languages, in order of preference. Regional variants are the same language,
+// so "en-US, en-GB, nl" is "eng, nld".
+func ParseLanguages(header string, min language.Confidence, max int) Strings {
+	tags, _, err := language.ParseAcceptLanguage(header)
+	if err != nil {
+		// A single unknown or malformed entry makes ParseAcceptLanguage()
+		// reject the entire header, so try every entry on its own.
+		type entry struct {
+			tag language.Tag
+			q   float32
+		}
+		var entries []entry
+		for _, e := range strings.Split(header, ",") {
+			t, q, err := language.ParseAcceptLanguage(e)
+			if err == nil && len(t) > 0 {
+				entries = append(entries, entry{t[0], q[0]})
+			}
+		}
+		slices.SortStableFunc(entries, func(a, b entry) int { return cmp.Compare(b.q, a.q) })
+		tags = make([]language.Tag, 0, len(entries))
+		for _, e := range entries {
+			tags = append(tags, e.tag)
+		}
+	}
+
+	var langs Strings
+	for _, t := range tags {
+		base, c := t.Base()
+		if c < min {
+			continue
+		}
+		switch base.String() {
+		case "mul", "und", "zxx", "mis":
+			continue
+		}
+		if base.IsPrivateUse() {
+			continue
+		}
+		if l := base.ISO3(); !slices.Contains(langs, l) {
+			langs = append(langs, l)
+			if len(langs) >= max {
+				break
+			}
+		}
+	}
+	return langs
+}
+
+// SetLanguage sets Language from the Accept-Language header, and Languages
+// with SiteSettings.CollectLanguages.
+//
+// The language in the SiteSettings.LanguageCookie is the language the visitor
+// chose on the site, which is used as the Language instead if it's set. If
+// it's different from the browser's language then that's stored in
+// BrowserLanguage with SiteSettings.CollectBrowserLanguage.
+func (h *Hit) SetLanguage(ss SiteSettings, acceptLanguage, cookie string) {
+	min := ss.MinLanguageConfidence()
+	h.Language = ParseLanguage(acceptLanguage, min)
+	if ss.CollectLanguages {
+		h.Languages = ParseLanguages(acceptLanguage, min, MaxLanguages)
+	}
+	if ss.LanguageCookie == "" {
+		return
+	}
+	chosen := ParseLanguage(cookie, min)
+	if chosen == nil {
+		return
+	}
+	if ss.CollectBrowserLanguage && h.Language != nil && *h.Language != *chosen {
+		h.BrowserLanguage = h.Language
+	}
+	h.Language = chosen
+}
+
 func (h *Hit) cleanPath(ctx context.Context) {
 	h.Path = strings.TrimSpace(h.Path)
 	if h.Event {
@@ -84,7 +389,46 @@ func (h *Hit) cleanPath(ctx context.Context) {
 		return
 	}
 
-	h.Path = "/" + strings.Trim(h.Path, "/")
+	var ss SiteSettings
+	if site := GetSite(ctx); site != nil {
+		ss = site.Settings
+	}
+
+	// At the end, as removing the query parameters below re-encodes the path.
+	if ss.NormalizeEscapes {
+		defer func() { h.Path = normalizeEscapes(h.Path) }()
+	}
+
+	// Before the PathNormalize steps, so that removing the fragment doesn't
+	// remove the route.
+	if ss.HashbangPaths {
+		h.Path = hashRoutePath(h.Path, "#!")
+	}
+	if ss.HashRoutes {
+		h.Path = hashRoutePath(h.Path, "#/")
+	}
+
+	// At the end, after the tracking parameters are removed.
+	defer func() {
+		h.Path = ss.NormalizePath(h.Path)
+
+		// The rewrites can make it longer; /count already applied LongPaths
+		// to the path it got, so paths that are only too long now can't be
+		// rejected and are truncated instead.
+		if len(h.Path) > MaxPathLen {
+			if ss.LongPaths == LongPathsBucket {
+				h.Path = LongPathBucket
+				return
+			}
+			n := MaxPathLen
+			for n > 0 && !utf8.RuneStart(h.Path[n]) {
+				n--
+			}
+			h.Path = h.Path[:n]
+		}
+	}()
+
+	h.Path = "/" + strings.TrimLeft(h.Path, "/")
 
 	// Normalize the path when accessed from e.g. offline storage or internet
 	// archive.
@@ -138,6 +482,16 @@ func (h *Hit) cleanPath(ctx context.Context) {
 		}
 		q.Del("gclid") // AdWords click ID
 
+		if site := GetSite(ctx); site != nil { // Recorded as campaign.
+			for _, p := range site.Settings.CampaignParams {
+				param, _, _ := strings.Cut(p, ":")
+				q.Del(param)
+			}
+			for _, p := range site.Settings.ExperimentParams { // Recorded as ExperimentHash.
+				q.Del(p)
+			}
+		}
+
 		// Some WeChat tracking thing; see e.g:
 		// https://translate.google.com/translate?sl=auto&tl=en&u=https%3A%2F%2Fsheshui.me%2Fblogs%2Fexplain-wechat-nsukey-url
 		// https://translate.google.com/translate?sl=auto&tl=en&u=https%3A%2F%2Fwww.v2ex.com%2Ft%2F312163
@@ -158,8 +512,283 @@ func (h *Hit) cleanPath(ctx context.Context) {
 		q.Del("continueFlag")
 
 		u.RawQuery = q.Encode()
-		h.Path = "/" + strings.Trim(u.String(), "/")
+		h.Path = "/" + strings.TrimLeft(u.String(), "/")
+	}
+}
+
+// hashRoutePath moves the route in a fragment starting with sep ("#!" or "#/")
+// to the path:
+//
+//	/#!/page          → /page
+//	/app/?x=1#!/page  → /app/page?x=1
+//	/app#!/page?y=2   → /app/page?y=2
+func hashRoutePath(p, sep string) string {
+	base, route, ok := strings.Cut(p, sep)
+	if !ok {
+		return p
+	}
+	base, baseQuery, _ := strings.Cut(base, "?")
+	route, routeQuery, _ := strings.Cut(route, "?")
+
+	p = strings.TrimRight(base, "/") + "/" + strings.TrimLeft(route, "/")
+	switch {
+	case baseQuery != "" && routeQuery != "":
+		p += "?" + baseQuery + "&" + routeQuery
+	case baseQuery != "":
+		p += "?" + baseQuery
+	case routeQuery != "":
+		p += "?" + routeQuery
+	}
+	return p
+}
+
+// normalizeEscapes decodes percent-escapes for unreserved characters (RFC 3986
+// section 2.3) and printable non-ASCII characters, and uppercases the hex
+// digits of all other escapes:
+//
+//	/caf%C3%A9   → /café
+//	/%7euser     → /~user
+//	/a%2fb       → /a%2Fb
+//	/a%3Fb%23c   → /a%3Fb%23c
+//
+// Reserved characters, spaces, control characters, and invalid UTF-8 are never
+// decoded, as that would change the meaning of the path or make it hard to
+// read. Invalid escapes such as "%zz" are left as-is.
+func normalizeEscapes(p string) string {
+	if !strings.Contains(p, "%") {
+		return p
 	}
+
+	var (
+		b   strings.Builder
+		buf = make([]byte, 0, utf8.UTFMax)
+	)
+	b.Grow(len(p))
+	for i := 0; i < len(p); i++ {
+		c, ok := unhexEscape(p, i)
+		if !ok {
+			b.WriteByte(p[i])
+			continue
+		}
+
+		if c < utf8.RuneSelf {
+			if isUnreserved(c) {
+				b.WriteByte(c)
+			} else {
+				b.WriteString(strings.ToUpper(p[i : i+3]))
+			}
+			i += 2
+			continue
+		}
+
+		// Collect the escaped bytes that may make up a UTF-8 sequence.
+		buf = append(buf[:0], c)
+		for j := i + 3; len(buf) < utf8.UTFMax; j += 3 {
+			c, ok := unhexEscape(p, j)
+			if !ok || c < utf8.RuneSelf {
+				break
+			}
+			buf = append(buf, c)
+		}
+		r, size := utf8.DecodeRune(buf)
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			b.WriteString(strings.ToUpper(p[i : i+3]))
+			i += 2
+			continue
+		}
+		b.Write(buf[:size])
+		i += size*3 - 1
+	}
+	return b.String()
+}
+
+// unhexEscape decodes the percent-escape at p[i].
+func unhexEscape(p string, i int) (byte, bool) {
+	if i+2 >= len(p) || p[i] != '%' {
+		return 0, false
+	}
+	hi, ok1 := unhex(p[i+1])
+	lo, ok2 := unhex(p[i+2])
+	return hi<<4 | lo, ok1 && ok2
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func isUnreserved(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// setNavType sets NavType from the Sec-Fetch-Site header in FetchSite, or from
+// the referrer if that's not set.
+//
+// The header is "none" for navigations that the user started (typing the URL,
+// a bookmark, etc.), "same-origin" for links on the same site, and "same-site"
+// or "cross-site" for links from elsewhere.
+func (h *Hit) setNavType(site *Site) {
+	switch h.FetchSite {
+	case "none":
+		h.NavType = NavTypeDirect
+	case "same-origin":
+		h.NavType = NavTypeInternal
+	case "same-site", "cross-site":
+		h.NavType = NavTypeExternal
+	default:
+		switch {
+		case h.Ref == "":
+			h.NavType = NavTypeDirect
+		case h.RefURL != nil && h.RefURL.Host != "" && site.IsOwnHost(h.RefURL.Hostname()):
+			h.NavType = NavTypeInternal
+		default:
+			h.NavType = NavTypeExternal
+		}
+	}
+}
+
+// stripIndexFile removes the filename from the path if it's one of files, so
+// that "/dir/index.html?a=b" becomes "/dir/?a=b".
+func stripIndexFile(p string, files []string) string {
+	path, rest := p, ""
+	if i := strings.IndexAny(p, "?#"); i > -1 {
+		path, rest = p[:i], p[i:]
+	}
+	dir, file := path[:strings.LastIndexByte(path, '/')+1], path[strings.LastIndexByte(path, '/')+1:]
+	if !slices.Contains(files, file) {
+		return p
+	}
+	return dir + rest
+}
+
+// setCampaign sets the referrer and campaign from the query parameters.
+//
+// The utm_* parameters take precedence, followed by the site's
+// CampaignParams, followed by some generic names. The CampaignParams are also
+// read from the path if they're not in Query, as they're often added to the
+// link directly.
+func (h *Hit) setCampaign(ctx context.Context, site *Site) error {
+	var (
+		source   = site.Settings.campaignParams("source")
+		campaign = site.Settings.campaignParams("campaign")
+	)
+	var pathQuery url.Values
+	if i := strings.IndexByte(h.Path, '?'); i > -1 && len(site.Settings.CampaignParams) > 0 {
+		pathQuery, _ = url.ParseQuery(h.Path[i+1:])
+	}
+	if h.Query == "" && pathQuery == nil {
+		return nil
+	}
+
+	var q url.Values
+	if h.Query != "" {
+		if h.Query[0] != '?' {
+			h.Query = "?" + h.Query
+		}
+		u, err := url.Parse(h.Query)
+		if err != nil {
+			return errors.Wrap(err, "Hit.setCampaign")
+		}
+		q = u.Query()
+	}
+
+	// Get referral from query
+	if v := firstParam(q, pathQuery, "utm_source", source, "ref", "src", "source"); v != "" {
+		h.Ref = v
+		h.RefURL = nil
+		h.RefScheme = RefSchemeCampaign
+	}
+
+	// Get campaign.
+	if v := firstParam(q, pathQuery, "utm_campaign", campaign, "campaign"); v != "" {
+		c := Campaign{Name: v}
+		err := c.ByName(ctx, c.Name)
+		if err != nil && !zdb.ErrNoRows(err) {
+			return errors.Wrap(err, "Hit.setCampaign")
+		}
+
+		if zdb.ErrNoRows(err) {
+			if h.preview {
+				h.RefScheme = RefSchemeCampaign
+				return nil
+			}
+			err := c.Insert(ctx)
+			if err != nil {
+				return errors.Wrap(err, "Hit.setCampaign")
+			}
+		}
+		h.CampaignID = &c.ID
+		h.RefScheme = RefSchemeCampaign
+	}
+	return nil
+}
+
+// setExperiment sets ExperimentHash from the ExperimentParams in Query or the
+// path. The parameters are sorted by name, so the order in the URL or settings
+// doesn't matter.
+func (h *Hit) setExperiment(site *Site) {
+	if len(site.Settings.ExperimentParams) == 0 {
+		return
+	}
+
+	var q, pathQuery url.Values
+	if h.Query != "" {
+		q, _ = url.ParseQuery(strings.TrimPrefix(h.Query, "?"))
+	}
+	if i := strings.IndexByte(h.Path, '?'); i > -1 {
+		pathQuery, _ = url.ParseQuery(h.Path[i+1:])
+	}
+
+	params := slices.Clone(site.Settings.ExperimentParams)
+	slices.Sort(params)
+	var (
+		mac   = hmac.New(sha256.New, []byte(site.Settings.ExperimentSecret))
+		found bool
+	)
+	for _, p := range params {
+		v := strings.TrimSpace(q.Get(p))
+		if v == "" {
+			v = strings.TrimSpace(pathQuery.Get(p))
+		}
+		if v == "" {
+			continue
+		}
+		found = true
+		mac.Write([]byte(p + "=" + v + "\n"))
+	}
+	if found {
+		h.ExperimentHash = hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+}
+
+// firstParam gets the first non-empty value from q for utm, custom, and
+// generic, in that order. The custom parameters are also read from pathQuery.
+func firstParam(q, pathQuery url.Values, utm string, custom []string, generic ...string) string {
+	if v := strings.TrimSpace(q.Get(utm)); v != "" {
+		return v
+	}
+	for _, c := range custom {
+		if v := strings.TrimSpace(q.Get(c)); v != "" {
+			return v
+		}
+		if v := strings.TrimSpace(pathQuery.Get(c)); v != "" {
+			return v
+		}
+	}
+	for _, c := range generic {
+		if v := strings.TrimSpace(q.Get(c)); v != "" {
+			return v
+		}
+	}
+	return ""
 }
 
 // Defaults sets fields to default values, unless they're already set.
@@ -170,6 +799,16 @@ func (h *Hit) Defaults(ctx context.Context, initial bool) error {
 	if h.CreatedAt.IsZero() {
 		h.CreatedAt = ztime.Now()
 	}
+	h.CreatedAt = site.Settings.RoundTime(h.CreatedAt)
+	if h.Type == "" {
+		h.Type = HitTypePageview
+	}
+	if h.Platform == "" {
+		h.Platform = PlatformWeb
+		if site.Settings.AppUA(h.UserAgentHeader) {
+			h.Platform = PlatformApp
+		}
+	}
 
 	if h.Event {
 		h.Path = strings.TrimLeft(h.Path, "/")
@@ -178,79 +817,122 @@ func (h *Hit) Defaults(ctx context.Context, initial bool) error {
 			h.Path = "(no event name)"
 		}
 	} else {
-		h.cleanPath(ctx)
-	}
-
-	// Set campaign.
-	if !h.Event && h.Query != "" {
-		if h.Query[0] != '?' {
-			h.Query = "?" + h.Query
-		}
-		u, err := url.Parse(h.Query)
+		// Before cleanPath, as that removes the campaign parameters.
+		h.setExperiment(site)
+		err := h.setCampaign(ctx, site)
 		if err != nil {
 			return errors.Wrap(err, "Hit.Defaults")
 		}
-		q := u.Query()
+		h.cleanPath(ctx)
+	}
 
-		// Get referral from query
-		for _, c := range []string{"utm_source", "ref", "src", "source"} {
-			v := strings.TrimSpace(q.Get(c))
-			if v == "" {
-				continue
-			}
+	// Before InternalNavigation, as that removes the referrer.
+	if site.Settings.Collect.Has(CollectNavType) && !h.Event.Bool() {
+		h.setNavType(site)
+	}
 
-			h.Ref = v
-			h.RefURL = nil
-			h.RefScheme = RefSchemeCampaign
-			break
+	if site.Settings.InternalNavigation && !h.Event.Bool() && h.RefScheme == nil && h.RefURL != nil &&
+		h.RefURL.Host != "" && site.IsOwnHost(h.RefURL.Host) {
+		prev := Hit{Path: "/" + h.RefURL.Path}
+		if h.RefURL.RawQuery != "" {
+			prev.Path += "?" + h.RefURL.RawQuery
 		}
+		prev.cleanPath(ctx)
+		h.PrevPath = prev.Path
+		h.Ref, h.RefURL = "", nil
+	}
 
-		// Get campaign.
-		for _, c := range []string{"utm_campaign", "campaign"} {
-			v := strings.TrimSpace(q.Get(c))
-			if v == "" {
-				continue
-			}
-
-			c := Campaign{Name: v}
-			err := c.ByName(ctx, c.Name)
-			if err != nil && !zdb.ErrNoRows(err) {
-				return errors.Wrap(err, "Hit.Defaults")
-			}
-
-			if zdb.ErrNoRows(err) {
-				err := c.Insert(ctx)
-				if err != nil {
-					return errors.Wrap(err, "Hit.Defaults")
-				}
-			}
-			h.CampaignID = &c.ID
-			h.RefScheme = RefSchemeCampaign
+	// After InternalNavigation, as the site itself can be on an internal host.
+	if h.RefScheme == nil && h.RefURL != nil && isInternalRef(h.RefURL) {
+		switch site.Settings.InternalRefs {
+		case InternalRefsGroup:
+			h.Ref, h.RefScheme, h.RefURL = InternalRefLabel, RefSchemeGenerated, nil
+		case InternalRefsDrop:
+			h.Ref, h.RefURL = "", nil
 		}
 	}
 
+	// After InternalNavigation, as that only uses the site's own paths.
+	if h.RefScheme == nil && site.Settings.RefGranularity == RefGranularityNone {
+		h.Ref, h.RefURL = "", nil
+	}
+
 	if h.RefScheme == nil && h.Ref != "" && h.RefURL != nil {
-		if h.RefURL.Scheme == "http" || h.RefURL.Scheme == "https" {
+		scheme := h.RefURL.Scheme // cleanRefURL() removes it.
+		if scheme == "http" || scheme == "https" {
 			h.RefScheme = RefSchemeHTTP
 		} else {
 			h.RefScheme = RefSchemeOther
 		}
+		h.setSourceName(site, scheme) // Before cleanRefURL(), as that changes the host.
 
 		var generated bool
 		h.Ref, generated = cleanRefURL(h.Ref, h.RefURL)
-		if generated {
+		switch {
+		case generated:
 			h.RefScheme = RefSchemeGenerated
+		// Referrers without scheme are kept, as are known apps that are
+		// grouped above.
+		case scheme != "" && !site.Settings.AllowRefScheme(scheme):
+			switch site.Settings.OtherRefSchemes {
+			case OtherRefSchemesGroup:
+				h.Ref, h.RefScheme = OtherRefSchemesLabel, RefSchemeGenerated
+			case OtherRefSchemesDrop:
+				h.Ref, h.RefScheme, h.RefURL, h.SourceName = "", nil, nil, ""
+			}
+		}
+		if !generated && site.Settings.RefGranularity == RefGranularityOrigin {
+			if i := strings.IndexAny(h.Ref, "/?#"); i > -1 {
+				h.Ref = h.Ref[:i]
+			}
+		}
+
+		if h.RefScheme == RefSchemeHTTP && h.RefURL.Host != "" {
+			h.RefDomain = refDomain(h.RefURL.Hostname())
+			if site.Settings.GroupRefDomains && !strings.EqualFold(h.RefDomain, h.RefURL.Hostname()) &&
+				strings.HasPrefix(h.Ref, h.RefURL.Host) {
+				d := h.RefDomain
+				if p := h.RefURL.Port(); p != "" {
+					d += ":" + p
+				}
+				h.Ref = d + h.Ref[len(h.RefURL.Host):]
+			}
+		}
+
+		if h.RefScheme == RefSchemeHTTP && h.RefURL.Host != "" && !site.Settings.AllowedRef(h.RefURL.Hostname()) {
+			h.Ref, h.RefScheme, h.RefURL, h.RefDomain, h.SourceName = OverflowRefLabel, RefSchemeGenerated, nil, "", ""
 		}
 	}
+
+	// After the referrer is processed, as InternalNavigation and NavType
+	// still use the real referrer.
+	if src, ok := site.Settings.AllowedRefSource(h.RefSource); ok {
+		h.Ref, h.RefScheme, h.RefURL, h.RefDomain, h.SourceName = src, RefSchemeCampaign, nil, "", src
+	}
 	h.Ref = strings.TrimRight(h.Ref, "/")
 
-	if initial {
+	if site.Settings.HiddenRefs && h.RefHidden && h.Ref == "" && h.RefScheme == nil && h.PrevPath == "" &&
+		site.Settings.RefGranularity != RefGranularityNone {
+		h.Ref, h.RefScheme = HiddenRefLabel, RefSchemeGenerated
+	}
+
+	if initial || h.preview {
 		return nil
 	}
 
 	// Get or insert path.
 	path := Path{Path: h.Path, Title: h.Title, Event: h.Event}
 	err := path.GetOrInsert(ctx)
+	if errors.Is(err, errTooManyPaths) {
+		h.Path, h.Title, h.Event = OverflowPath, "", false
+		path = Path{Path: h.Path}
+		err = path.GetOrInsert(ctx)
+	}
+	if errors.Is(err, errTooManyEvents) {
+		h.Path, h.Title = OverflowEvent, ""
+		path = Path{Path: h.Path, Event: true}
+		err = path.GetOrInsert(ctx)
+	}
 	if err != nil {
 		return errors.Wrap(err, "Hit.Defaults")
 	}
@@ -259,11 +941,31 @@ func (h *Hit) Defaults(ctx context.Context, initial bool) error {
 	// Get or insert ref.
 	ref := Ref{Ref: h.Ref, RefScheme: h.RefScheme}
 	err = ref.GetOrInsert(ctx)
+	if errors.Is(err, errTooManyRefs) {
+		h.Ref, h.RefScheme, h.RefURL, h.RefDomain = OverflowRefLabel, RefSchemeGenerated, nil, ""
+		ref = Ref{Ref: h.Ref, RefScheme: h.RefScheme}
+		err = ref.GetOrInsert(ctx)
+	}
 	if err != nil {
 		return errors.Wrap(err, "Hit.Defaults")
 	}
 	h.RefID = ref.ID
 
+	// Get or insert previous path.
+	if h.PrevPath != "" {
+		prev := Path{Path: h.PrevPath}
+		err = prev.getOrInsert(ctx, false)
+		if errors.Is(err, errTooManyPaths) {
+			h.PrevPath = OverflowPath
+			prev = Path{Path: h.PrevPath}
+			err = prev.getOrInsert(ctx, false)
+		}
+		if err != nil {
+			return errors.Wrap(err, "Hit.Defaults")
+		}
+		h.PrevPathID = &prev.ID
+	}
+
 	// Get or insert size.
 	if site.Settings.Collect.Has(CollectScreenSize) {
 		var size Size
@@ -276,7 +978,7 @@ func (h *Hit) Defaults(ctx context.Context, initial bool) error {
 
 	// Get or insert browser and system.
 	if site.Settings.Collect.Has(CollectUserAgent) {
-		ua := UserAgent{UserAgent: h.UserAgentHeader}
+		ua := UserAgent{UserAgent: h.UserAgentHeader, Hints: h.ClientHints}
 		err = ua.GetOrInsert(ctx)
 		if err != nil {
 			return errors.Wrap(err, "Hit.Defaults")
@@ -297,6 +999,12 @@ func (h *Hit) Validate(ctx context.Context, initial bool) error {
 	v.Required("created_at", h.CreatedAt)
 	v.UTF8("ref", h.Ref)
 	v.Len("ref", h.Ref, 0, 2048)
+	if h.Type != "" {
+		v.Include("type", h.Type, HitTypes)
+	}
+	if h.Platform != "" {
+		v.Include("platform", h.Platform, Platforms)
+	}
 
 	// Small margin as client's clocks may not be 100% accurate.
 	if h.CreatedAt.After(ztime.Now().Add(5 * time.Second)) {
@@ -330,18 +1038,7 @@ type Hits []Hit
 //
 // This is intended for tests.
 func (h *Hits) TestList(ctx context.Context, siteOnly bool) error {
-	var hh []struct {
-		Hit
-		B    int64      `db:"browser_id"`
-		S    int64      `db:"system_id"`
-		P    string     `db:"path"`
-		T    string     `db:"title"`
-		E    zbool.Bool `db:"event"`
-		R    string     `db:"ref"`
-		Size Floats     `db:"size"`
-	}
-
-	err := zdb.Select(ctx, &hh, `/* Hits.TestList */
+	return errors.Wrap(h.list(ctx, `/* Hits.TestList */
 		select
 			hits.*,
 			browser_id,
@@ -360,9 +1057,49 @@ func (h *Hits) TestList(ctx context.Context, siteOnly bool) error {
 		zdb.P{
 			"site":      MustGetSite(ctx).ID,
 			"site_only": siteOnly,
-		})
+		}), "Hits.TestList")
+}
+
+// ListRange lists all hits for the site in the time range, ordered by ID.
+func (h *Hits) ListRange(ctx context.Context, rng ztime.Range) error {
+	return errors.Wrap(h.list(ctx, `/* Hits.ListRange */
+		select
+			hits.*,
+			browser_id,
+			system_id,
+			paths.path,
+			paths.title,
+			paths.event,
+			refs.ref,
+			sizes.size
+		from hits
+		join paths using (path_id)
+		left join refs  using (ref_id)
+		left join sizes using (size_id)
+		where hits.site_id = :site and hits.created_at >= :start and hits.created_at < :end
+		order by hit_id asc`,
+		zdb.P{
+			"site":  MustGetSite(ctx).ID,
+			"start": rng.Start,
+			"end":   rng.End,
+		}), "Hits.ListRange")
+}
+
+func (h *Hits) list(ctx context.Context, query string, params zdb.P) error {
+	var hh []struct {
+		Hit
+		B    int64      `db:"browser_id"`
+		S    int64      `db:"system_id"`
+		P    string     `db:"path"`
+		T    string     `db:"title"`
+		E    zbool.Bool `db:"event"`
+		R    string     `db:"ref"`
+		Size Floats     `db:"size"`
+	}
+
+	err := zdb.Select(ctx, &hh, query, params)
 	if err != nil {
-		return errors.Wrap(err, "Hits.TestList")
+		return err
 	}
 
 	for _, x := range hh {
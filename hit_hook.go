@@ -0,0 +1,63 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// HitHook is called for every pageview sent to /count, after it's decoded and
+// before it's added to the Memstore.
+//
+// The hook can modify the hit; returning an error drops the pageview, and the
+// error message is sent to the client in the X-Goatcounter header.
+//
+// Hooks need to be compiled in with RegisterHitHook(), and are run in the order
+// they were registered.
+type HitHook func(ctx context.Context, h *Hit) error
+
+type namedHook struct {
+	name string
+	hook HitHook
+}
+
+var (
+	hitHooksMu sync.RWMutex
+	hitHooks   []namedHook
+)
+
+// RegisterHitHook registers a new HitHook with the given name; it will panic if
+// the name is already registered.
+func RegisterHitHook(name string, hook HitHook) {
+	hitHooksMu.Lock()
+	defer hitHooksMu.Unlock()
+	if slices.ContainsFunc(hitHooks, func(h namedHook) bool { return h.name == name }) {
+		panic("RegisterHitHook: already registered: " + name)
+	}
+	hitHooks = append(hitHooks, namedHook{name: name, hook: hook})
+}
+
+// UnregisterHitHook removes the HitHook with the given name, if any.
+func UnregisterHitHook(name string) {
+	hitHooksMu.Lock()
+	defer hitHooksMu.Unlock()
+	hitHooks = slices.DeleteFunc(hitHooks, func(h namedHook) bool { return h.name == name })
+}
+
+// RunHitHooks runs all registered hooks on the hit, stopping at the first one
+// that returns an error.
+func RunHitHooks(ctx context.Context, h *Hit) error {
+	hitHooksMu.RLock()
+	defer hitHooksMu.RUnlock()
+	for _, hh := range hitHooks {
+		if err := hh.hook(ctx, h); err != nil {
+			return fmt.Errorf("hook %q: %w", hh.name, err)
+		}
+	}
+	return nil
+}
@@ -6,8 +6,10 @@ package goatcounter
 
 import (
 	"context"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"zgo.at/errors"
@@ -28,12 +30,20 @@ type HitList struct {
 	// Path name (e.g. /hello.html).
 	Path string `db:"path" json:"path"`
 
+	// Path IDs in this group, if this is a group from the site's group_paths
+	// setting; Path is the group name and PathID the first path in it.
+	PathIDs []int64 `db:"-" json:"path_ids,omitempty"`
+
 	// Is this an event?
 	Event zbool.Bool `db:"event" json:"event"`
 
 	// Page title.
 	Title string `db:"title" json:"title"`
 
+	// Label for events from the site's event_labels setting; blank if there
+	// is no label, in which case the path is displayed.
+	Label string `db:"-" json:"label,omitempty"`
+
 	// Highest visitors per hour or day (depending on daily being set).
 	Max int `json:"max"`
 
@@ -86,6 +96,19 @@ func (h *HitList) SiteTotalUTC(ctx context.Context, rng ztime.Range) error {
 
 type HitLists []HitList
 
+// ListCounts lists the visit count for the top paths in the given time period,
+// without the stats per day. This always uses UTC and the hourly counts, so it
+// can be used for periods shorter than a day.
+func (h *HitLists) ListCounts(ctx context.Context, rng ztime.Range, limit int) error {
+	err := zdb.Select(ctx, h, "load:hit_list.ListCounts", zdb.P{
+		"site":  MustGetSite(ctx).ID,
+		"start": rng.Start,
+		"end":   rng.End,
+		"limit": limit,
+	})
+	return errors.Wrap(err, "HitLists.ListCounts")
+}
+
 // ListPathsLike lists all paths matching the like pattern.
 func (h *HitLists) ListPathsLike(ctx context.Context, search string, matchTitle, matchCase bool) error {
 	err := zdb.Select(ctx, h, "load:hit_list.ListPathsLike", zdb.P{
@@ -108,7 +131,13 @@ func (h *HitLists) List(
 
 	// List the pages for this time period; this gets the path_id, path, title.
 	var more bool
-	{
+	if len(site.Settings.GroupPaths) > 0 || site.Settings.rewriteOnDisplay() || site.Settings.MinVisitors > 0 {
+		var err error
+		more, err = h.listGrouped(ctx, site, rng, pathFilter, exclude, limit)
+		if err != nil {
+			return 0, false, err
+		}
+	} else {
 		err := zdb.Select(ctx, h, "load:hit_list.List-counts", zdb.P{
 			"site":    site.ID,
 			"start":   rng.Start,
@@ -134,17 +163,25 @@ func (h *HitLists) List(
 		return 0, false, nil
 	}
 
-	// Get stats for every page.
 	hh := *h
+	if len(site.Settings.EventLabels) > 0 {
+		for i := range hh {
+			if l, ok := site.Settings.EventLabels[hh[i].Path]; ok && hh[i].Event.Bool() {
+				hh[i].Label = l
+			}
+		}
+	}
+
+	// Get stats for every page.
 	var st []struct {
 		PathID int64     `db:"path_id"`
 		Day    time.Time `db:"day"`
 		Stats  []byte    `db:"stats"`
 	}
 	{
-		paths := make([]int64, len(hh))
+		paths := make([]int64, 0, len(hh))
 		for i := range hh {
-			paths[i] = hh[i].PathID
+			paths = append(paths, hh[i].pathIDs()...)
 		}
 
 		err := zdb.Select(ctx, &st, "load:hit_list.List-stats", zdb.P{
@@ -160,17 +197,29 @@ func (h *HitLists) List(
 
 	// Add the hit_stats.
 	{
+		rows := make(map[int64]int, len(hh))
 		for i := range hh {
-			for _, s := range st {
-				if s.PathID == hh[i].PathID {
-					var y []int
-					zjson.MustUnmarshal(s.Stats, &y)
-					hh[i].Stats = append(hh[i].Stats, HitListStat{
-						Day:    s.Day.Format("2006-01-02"),
-						Hourly: y,
-					})
+			for _, id := range hh[i].pathIDs() {
+				rows[id] = i
+			}
+		}
+		for _, s := range st {
+			i, ok := rows[s.PathID]
+			if !ok {
+				continue
+			}
+			var y []int
+			zjson.MustUnmarshal(s.Stats, &y)
+			day := s.Day.Format("2006-01-02")
+
+			// Another path in the same group; st is ordered by day.
+			if n := len(hh[i].Stats); n > 0 && hh[i].Stats[n-1].Day == day {
+				for j := range y {
+					hh[i].Stats[n-1].Hourly[j] += y[j]
 				}
+				continue
 			}
+			hh[i].Stats = append(hh[i].Stats, HitListStat{Day: day, Hourly: y})
 		}
 	}
 
@@ -187,6 +236,128 @@ func (h *HitLists) List(
 	return totalDisplay, more, nil
 }
 
+// listGrouped gets the paths for List, with paths matching the site's
+// GroupPaths collapsed in to one entry. Paths that are the same after the
+// PathRewrites are also collapsed if they're applied on display, as are all
+// paths below MinVisitors.
+//
+// This needs the counts for all paths in the time period, as we can't know if
+// a path is in the top paths before adding up the group.
+func (h *HitLists) listGrouped(ctx context.Context, site *Site, rng ztime.Range, pathFilter, exclude []int64, limit int) (bool, error) {
+	var counts []struct {
+		Total int `db:"total"`
+		HitList
+	}
+	err := zdb.Select(ctx, &counts, "load:hit_list.List-counts-grouped", zdb.P{
+		"site":   site.ID,
+		"start":  rng.Start,
+		"end":    rng.End,
+		"filter": pathFilter,
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "HitLists.List hit_counts")
+	}
+
+	type row struct {
+		total int
+		HitList
+	}
+	var (
+		rows   = make([]row, 0, len(counts))
+		groups = make(map[string]int)
+	)
+	for _, c := range counts {
+		g, ok := "", false
+		if !c.Event {
+			p := c.Path
+			if site.Settings.rewriteOnDisplay() {
+				p = site.Settings.RewritePath(p)
+			}
+			g, ok = site.Settings.groupPath(p)
+			if !ok && p != c.Path {
+				g, ok = p, true
+			}
+		}
+		if !ok {
+			rows = append(rows, row{c.Total, c.HitList})
+			continue
+		}
+
+		i, ok := groups[g]
+		if !ok {
+			i = len(rows)
+			groups[g] = i
+			rows = append(rows, row{HitList: HitList{PathID: c.PathID, Path: g}})
+		}
+		rows[i].total += c.Total
+		rows[i].PathIDs = append(rows[i].PathIDs, c.PathID)
+	}
+
+	// After grouping, as a group can have enough visitors when the
+	// individual paths don't. Events are kept separate from pageviews.
+	if k := site.Settings.MinVisitors; k > 0 {
+		var (
+			keep  = rows[:0]
+			below = make(map[zbool.Bool]*row)
+		)
+		for _, r := range rows {
+			if r.total >= k {
+				keep = append(keep, r)
+				continue
+			}
+			b, ok := below[r.Event]
+			if !ok {
+				b = &row{HitList: HitList{PathID: r.PathID, Path: BelowThresholdLabel, Event: r.Event}}
+				below[r.Event] = b
+			}
+			b.total += r.total
+			b.PathIDs = append(b.PathIDs, r.pathIDs()...)
+		}
+		rows = keep
+		for _, e := range []zbool.Bool{false, true} {
+			if b, ok := below[e]; ok {
+				rows = append(rows, *b)
+			}
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].total > rows[j].total })
+
+	hh := make(HitLists, 0, limit)
+	more := false
+	for _, r := range rows {
+		if slices.ContainsFunc(r.pathIDs(), func(id int64) bool { return slices.Contains(exclude, id) }) {
+			continue
+		}
+		if len(hh) == limit {
+			more = true
+			break
+		}
+		hh = append(hh, r.HitList)
+	}
+	*h = hh
+	return more, nil
+}
+
+// pathIDs gets all path IDs for this entry.
+func (h HitList) pathIDs() []int64 {
+	if len(h.PathIDs) > 0 {
+		return h.PathIDs
+	}
+	return []int64{h.PathID}
+}
+
+// groupPath gets the entry in GroupPaths that path belongs to; if more than
+// one matches then the most specific (longest) one is used.
+func (ss SiteSettings) groupPath(path string) (string, bool) {
+	var match string
+	for _, g := range ss.GroupPaths {
+		if strings.HasPrefix(path, strings.TrimSuffix(g, "*")) && len(g) > len(match) {
+			match = g
+		}
+	}
+	return match, match != ""
+}
+
 // PathTotals is a special path to indicate this is the "total" overview.
 //
 // Trailing whitespace is trimmed on paths, so this should never conflict.
@@ -416,6 +587,10 @@ type TotalCount struct {
 	// Total number of visitors in UTC. The browser, system, etc, stats are
 	// always in UTC.
 	TotalUTC int `db:"total_utc" json:"total_utc"`
+
+	// The site doesn't collect sessions, so every pageview is counted and
+	// these are the number of pageviews rather than unique visitors.
+	NoSessions bool `db:"-" json:"no_sessions,omitempty"`
 }
 
 // GetTotalCount gets the total number of pageviews for the selected timeview in
@@ -440,6 +615,7 @@ func GetTotalCount(ctx context.Context, rng ztime.Range, pathFilter []int64, noE
 		"no_events": noEvents,
 		"tz":        user.Settings.Timezone.Offset(),
 	})
+	t.NoSessions = !site.Settings.Collect.Has(CollectSession)
 	return t, errors.Wrap(err, "GetTotalCount")
 }
 
@@ -459,7 +635,11 @@ func (h HitLists) Diff(ctx context.Context, rng, prev ztime.Range) ([]float64, e
 
 	paths := make([]int64, 0, len(h))
 	for _, hh := range h {
-		paths = append(paths, hh.PathID)
+		paths = append(paths, hh.pathIDs()...)
+	}
+
+	if slices.ContainsFunc(h, func(hh HitList) bool { return len(hh.PathIDs) > 0 }) {
+		return h.diffGrouped(ctx, rng, prev, paths)
 	}
 
 	var diffs []float64
@@ -473,3 +653,36 @@ func (h HitLists) Diff(ctx context.Context, rng, prev ztime.Range) ([]float64, e
 	})
 	return diffs, errors.Wrap(err, "HitList.DiffTotal")
 }
+
+// diffGrouped gets the Diff for a HitList with groups, adding up the totals
+// for all paths in the group.
+func (h HitLists) diffGrouped(ctx context.Context, rng, prev ztime.Range, paths []int64) ([]float64, error) {
+	var totals []struct {
+		PathID int64 `db:"path_id"`
+		Cur    int   `db:"cur"`
+		Prev   int   `db:"prev"`
+	}
+	err := zdb.Select(ctx, &totals, "load:hit_list.DiffTotal-paths", zdb.P{
+		"site":      MustGetSite(ctx).ID,
+		"start":     rng.Start,
+		"end":       rng.End,
+		"prevstart": prev.Start,
+		"prevend":   prev.End,
+		"paths":     paths,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "HitList.DiffTotal")
+	}
+
+	diffs := make([]float64, 0, len(h))
+	for _, hh := range h {
+		var cur, prev int
+		for _, t := range totals {
+			if slices.Contains(hh.pathIDs(), t.PathID) {
+				cur, prev = cur+t.Cur, prev+t.Prev
+			}
+		}
+		diffs = append(diffs, percentDiff(prev, cur))
+	}
+	return diffs, nil
+}
@@ -187,6 +187,173 @@ func TestHitListsList(t *testing.T) {
 	}
 }
 
+func TestHitListsListGrouped(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	site.Settings.GroupPaths = Strings{"/docs/*", "/docs/v1/api/*", "/docs/v1/*"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := ztime.NewRange(time.Date(2019, 8, 10, 0, 0, 0, 0, time.UTC)).
+		To(time.Date(2019, 8, 17, 23, 59, 59, 0, time.UTC))
+	hit := rng.Start.Add(1 * time.Second)
+
+	var hits []Hit
+	for path, n := range map[string]int{
+		"/docs/v1/intro": 3, "/docs/v1/setup": 1,
+		"/docs/v1/api/x": 2, "/docs/v1/api/y": 1,
+		"/docs/v2/a": 2,
+		"/docs":      1,
+	} {
+		for i := 0; i < n; i++ {
+			hits = append(hits, Hit{Site: site.ID, FirstVisit: true, CreatedAt: hit.Add(time.Duration(i) * 25 * time.Hour), Path: path})
+		}
+	}
+	gctest.StoreHits(ctx, t, false, hits...)
+
+	list := func(exclude []int64, limit int) (HitLists, bool) {
+		t.Helper()
+		var stats HitLists
+		_, more, err := stats.List(ctx, rng, nil, exclude, limit, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats, more
+	}
+	show := func(stats HitLists) string {
+		var b strings.Builder
+		for _, s := range stats {
+			var daily int
+			for _, st := range s.Stats {
+				daily += st.Daily
+			}
+			fmt.Fprintf(&b, "%s %d %d %d\n", s.Path, s.Count, daily, len(s.PathIDs))
+		}
+		return b.String()
+	}
+
+	stats, more := list(nil, 10)
+	want := "/docs/v1/* 4 4 2\n/docs/v1/api/* 3 3 2\n/docs/* 2 2 1\n/docs 1 1 0\n"
+	if have := show(stats); have != want || more {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	diff, err := stats.Diff(ctx, rng, rng)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != len(stats) {
+		t.Errorf("len(diff) = %d", len(diff))
+	}
+
+	// Paging.
+	first, more := list(nil, 2)
+	if have := show(first); have != "/docs/v1/* 4 4 2\n/docs/v1/api/* 3 3 2\n" || !more {
+		t.Errorf("first page: %s %t", have, more)
+	}
+	next, more := list([]int64{first[0].PathID, first[1].PathID}, 2)
+	if have := show(next); have != "/docs/* 2 2 1\n/docs 1 1 0\n" || more {
+		t.Errorf("second page: %s %t", have, more)
+	}
+
+	// Validation.
+	site.Settings.GroupPaths = Strings{"/ok/*", "docs/*", "/docs", "/a*/b*"}
+	err = site.Settings.Validate(ctx)
+	for _, want := range []string{`"docs/*"`, `"/docs"`, `"/a*/b*"`} {
+		if !ztest.ErrorContains(err, want+": must start with / and end with *") {
+			t.Errorf("no error for %s: %v", want, err)
+		}
+	}
+	if ztest.ErrorContains(err, `"/ok/*"`) {
+		t.Errorf("error for /ok/*: %v", err)
+	}
+}
+
+func TestHitListsListRewrite(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	site.Settings.PathRewrites = PathRewrites{{Pattern: `/\d+(/|$)`, Replace: "/:id$1"}}
+	site.Settings.PathRewriteAt = PathRewriteDisplay
+	site.Settings.GroupPaths = Strings{"/docs/*"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := ztime.NewRange(time.Date(2019, 8, 10, 0, 0, 0, 0, time.UTC)).
+		To(time.Date(2019, 8, 17, 23, 59, 59, 0, time.UTC))
+	hit := rng.Start.Add(1 * time.Second)
+
+	var hits []Hit
+	for path, n := range map[string]int{
+		"/user/1/profile": 3, "/user/2/profile": 2, "/user/3": 1,
+		"/docs/1": 1, "/docs/a": 1,
+		"/about": 4,
+	} {
+		for i := 0; i < n; i++ {
+			hits = append(hits, Hit{Site: site.ID, FirstVisit: true, CreatedAt: hit.Add(time.Duration(i) * 25 * time.Hour), Path: path})
+		}
+	}
+	gctest.StoreHits(ctx, t, false, hits...)
+
+	var stats HitLists
+	_, _, err = stats.List(ctx, rng, nil, nil, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for _, s := range stats {
+		fmt.Fprintf(&b, "%s %d %d\n", s.Path, s.Count, len(s.PathIDs))
+	}
+	// The full path is still stored.
+	want := "/user/:id/profile 5 2\n/about 4 0\n/docs/* 2 2\n/user/:id 1 1\n"
+	if have := b.String(); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestHitListsListMinVisitors(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	site.Settings.MinVisitors = 2
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := ztime.NewRange(time.Date(2019, 8, 10, 0, 0, 0, 0, time.UTC)).
+		To(time.Date(2019, 8, 17, 23, 59, 59, 0, time.UTC))
+	hit := rng.Start.Add(1 * time.Second)
+
+	var hits []Hit
+	for path, n := range map[string]int{"/about": 4, "/user": 3, "/docs": 2, "/a": 1, "/b": 1} {
+		for i := 0; i < n; i++ {
+			hits = append(hits, Hit{Site: site.ID, FirstVisit: true, CreatedAt: hit.Add(time.Duration(i) * 25 * time.Hour), Path: path})
+		}
+	}
+	hits = append(hits, Hit{Site: site.ID, FirstVisit: true, CreatedAt: hit, Path: "click", Event: true})
+	gctest.StoreHits(ctx, t, false, hits...)
+
+	var stats HitLists
+	_, _, err = stats.List(ctx, rng, nil, nil, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for _, s := range stats {
+		fmt.Fprintf(&b, "%s %t %d %d\n", s.Path, s.Event, s.Count, len(s.PathIDs))
+	}
+	want := "/about false 4 0\n/user false 3 0\n/docs false 2 0\n(below threshold) false 2 2\n(below threshold) true 1 1\n"
+	if have := b.String(); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
 func TestGetTotalCount(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18 12:00:00")
 	ctx := gctest.DB(t)
@@ -0,0 +1,144 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+)
+
+// SignatureMaxAge is how long a signature from SignPath() is valid.
+const SignatureMaxAge = 10 * time.Minute
+
+// SignPath creates a signature for the path, for SiteSettings.RequireSignature.
+//
+// The signature is "[unix timestamp].[hex HMAC-SHA256]", where the HMAC is over
+// "[unix timestamp]:[path]" with the site's SignatureSecret as the key.
+func SignPath(secret, path string, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return ts + "." + signPath(secret, ts, path)
+}
+
+// SignPathNonce is like SignPath(), but includes a nonce so that the signature
+// can only be used once; see SiteSettings.RequireNonce.
+//
+// The signature is "[unix timestamp].[nonce].[hex HMAC-SHA256]", where the HMAC
+// is over "[unix timestamp]:[nonce]:[path]". The nonce must be between 8 and 64
+// characters, and can only contain ASCII letters, digits, "-", and "_".
+func SignPathNonce(secret, path, nonce string, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return ts + "." + nonce + "." + signPath(secret, ts+":"+nonce, path)
+}
+
+// SignatureNonce gets the nonce from a signature made with SignPathNonce(), or
+// "" if it doesn't have one.
+//
+// This doesn't check if the signature is valid; use VerifyPathSignature() for
+// that.
+func SignatureNonce(sig string) string {
+	if strings.Count(sig, ".") != 2 {
+		return ""
+	}
+	_, sig, _ = strings.Cut(sig, ".")
+	nonce, _, _ := strings.Cut(sig, ".")
+	return nonce
+}
+
+// VerifyPathSignature checks if sig is a valid signature for path that's not
+// older than SignatureMaxAge, with or without a nonce.
+//
+// This doesn't check if the nonce was used before; that's up to the caller.
+func VerifyPathSignature(secret, path, sig string, now time.Time) error {
+	var (
+		parts = strings.Split(sig, ".")
+		ts    = parts[0]
+		mac   = parts[len(parts)-1]
+		msg   = ts
+	)
+	switch len(parts) {
+	default:
+		return errors.New("malformed signature")
+	case 2:
+	case 3:
+		if !validToken(parts[1], 8, 64) {
+			return errors.New("malformed signature")
+		}
+		msg += ":" + parts[1]
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	if !hmac.Equal([]byte(mac), []byte(signPath(secret, msg, path))) {
+		return errors.New("invalid signature")
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > SignatureMaxAge || d < -SignatureMaxAge {
+		return errors.New("expired signature")
+	}
+	return nil
+}
+
+// SignStatsHook creates the X-Goatcounter-Signature header for requests from
+// SiteSettings.StatsHook. This is the same as SignPath(), with the request body
+// as the path; use VerifyPathSignature() to check it.
+func SignStatsHook(secret string, body []byte, t time.Time) string {
+	return SignPath(secret, string(body), t)
+}
+
+// SignSession creates a session token for SiteSettings.EdgeSessions.
+//
+// The token is "[session].[hex HMAC-SHA256]", where the HMAC is over
+// "session:[session]" with the site's EdgeSessionSecret as the key.
+func SignSession(secret, session string) string {
+	return session + "." + signSession(secret, session)
+}
+
+// VerifySessionToken checks if token is a valid token from SignSession(),
+// returning the session.
+//
+// The session must be between 16 and 128 characters, and can only contain
+// ASCII letters, digits, "-", and "_".
+func VerifySessionToken(secret, token string) (string, error) {
+	session, mac, ok := strings.Cut(token, ".")
+	if !ok || !validToken(session, 16, 128) {
+		return "", errors.New("malformed session token")
+	}
+	if !hmac.Equal([]byte(mac), []byte(signSession(secret, session))) {
+		return "", errors.New("invalid session token")
+	}
+	return session, nil
+}
+
+// validToken reports if s is between min and max characters, and only contains
+// ASCII letters, digits, "-", and "_".
+func validToken(s string, min, max int) bool {
+	if len(s) < min || len(s) > max {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func signSession(secret, session string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte("session:" + session))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func signPath(secret, ts, path string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts + ":" + path))
+	return hex.EncodeToString(h.Sum(nil))
+}
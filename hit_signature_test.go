@@ -0,0 +1,122 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/zstd/ztest"
+)
+
+func TestPathSignature(t *testing.T) {
+	var (
+		now = time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+		sig = SignPath("secret", "/page", now)
+	)
+	if want := "1700000000.1da4e4f7104b4639005b57f7675d2d71d00894b1a5400e47d5cd109ff065dc71"; sig != want {
+		t.Errorf("\nhave: %s\nwant: %s", sig, want)
+	}
+
+	tests := []struct {
+		secret, path, sig string
+		now               time.Time
+		wantErr           string
+	}{
+		{"secret", "/page", sig, now, ""},
+		{"secret", "/page", sig, now.Add(SignatureMaxAge), ""},
+		{"secret", "/page", sig, now.Add(-time.Minute), ""},
+
+		{"secret", "/page", sig, now.Add(SignatureMaxAge + time.Second), "expired signature"},
+		{"secret", "/page", sig, now.Add(-SignatureMaxAge - time.Second), "expired signature"},
+		{"other", "/page", sig, now, "invalid signature"},
+		{"secret", "/other", sig, now, "invalid signature"},
+		{"secret", "/page", "1700000001" + sig[10:], now, "invalid signature"},
+		{"secret", "/page", "", now, "malformed signature"},
+		{"secret", "/page", "x." + sig[11:], now, "malformed signature"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			err := VerifyPathSignature(tt.secret, tt.path, tt.sig, tt.now)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Errorf("\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPathSignatureNonce(t *testing.T) {
+	var (
+		now = time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+		sig = SignPathNonce("secret", "/page", "nonce-123", now)
+	)
+	if !strings.HasPrefix(sig, "1700000000.nonce-123.") {
+		t.Errorf("wrong signature: %s", sig)
+	}
+
+	tests := []struct {
+		path, sig string
+		wantNonce string
+		wantErr   string
+	}{
+		{"/page", sig, "nonce-123", ""},
+		{"/page", SignPath("secret", "/page", now), "", ""},
+		{"/page", SignPathNonce("secret", "/page", strings.Repeat("a", 64), now), strings.Repeat("a", 64), ""},
+
+		{"/other", sig, "nonce-123", "invalid signature"},
+		{"/page", strings.Replace(sig, "nonce-123", "nonce-124", 1), "nonce-124", "invalid signature"},
+		{"/page", SignPathNonce("secret", "/page", "short", now), "short", "malformed signature"},
+		{"/page", SignPathNonce("secret", "/page", strings.Repeat("a", 65), now), strings.Repeat("a", 65), "malformed signature"},
+		{"/page", SignPathNonce("secret", "/page", "nonce:123", now), "nonce:123", "malformed signature"},
+		{"/page", "1700000000.a.b.c", "", "malformed signature"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			err := VerifyPathSignature("secret", tt.path, tt.sig, now)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Errorf("\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if n := SignatureNonce(tt.sig); n != tt.wantNonce {
+				t.Errorf("nonce: %q", n)
+			}
+		})
+	}
+}
+
+func TestSessionToken(t *testing.T) {
+	token := SignSession("secret", "0123456789abcdef")
+	if want := "0123456789abcdef.009700a96d1f1a7a19abacd42621338f69bfea9714fa3c0d6785965d4fa0566c"; token != want {
+		t.Errorf("\nhave: %s\nwant: %s", token, want)
+	}
+
+	tests := []struct {
+		secret, token string
+		want, wantErr string
+	}{
+		{"secret", token, "0123456789abcdef", ""},
+		{"secret", SignSession("secret", "AZaz09-_AZaz09-_"), "AZaz09-_AZaz09-_", ""},
+
+		{"other", token, "", "invalid session token"},
+		{"secret", "0123456789abcdee" + token[16:], "", "invalid session token"},
+		{"secret", "0123456789abcdef.", "", "invalid session token"},
+		{"secret", "0123456789abcdef", "", "malformed session token"},
+		{"secret", "", "", "malformed session token"},
+		{"secret", SignSession("secret", "short"), "", "malformed session token"},
+		{"secret", SignSession("secret", "0123456789abcdef:"), "", "malformed session token"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have, err := VerifySessionToken(tt.secret, tt.token)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Errorf("\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if have != tt.want {
+				t.Errorf("have %q; want %q", have, tt.want)
+			}
+		})
+	}
+}
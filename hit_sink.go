@@ -0,0 +1,182 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+)
+
+// HitSink stores pageviews after they're processed by the Memstore.
+//
+// The default is to store them in the hits table; other implementations can be
+// added with RegisterHitSink() and selected with "serve -hit-sink".
+//
+// Note that only the hits table is replaced; the stats tables (hit_counts,
+// ref_counts, etc.) are still updated in the database, so the dashboard will
+// keep working. Features that read the hits table directly, such as the export,
+// won't see pageviews stored elsewhere.
+//
+// RegionSink can be used to send pageviews to a different sink depending on
+// the visitor's country.
+type HitSink interface {
+	// Append a batch of pageviews; this may buffer them until Flush() is
+	// called.
+	Append(ctx context.Context, hits []Hit) error
+
+	// Flush all buffered pageviews to the storage.
+	//
+	// This can return a *PartialFlushError if only some of the pageviews were
+	// stored, so that only the others are retried.
+	Flush(ctx context.Context) error
+
+	// Close the sink; it won't be used after this.
+	Close() error
+}
+
+// PartialFlushError is returned from HitSink.Flush() if some of the pageviews
+// were stored and others weren't.
+type PartialFlushError struct {
+	// Index of the pageviews that weren't stored, in the order they were
+	// appended since the last Flush().
+	Failed []int
+	Err    error
+}
+
+func (e *PartialFlushError) Error() string { return e.Err.Error() }
+func (e *PartialFlushError) Unwrap() error { return e.Err }
+
+// split the appended pageviews in the ones that were stored and the ones that
+// weren't.
+func (e *PartialFlushError) split(hits []Hit) (stored, failed []Hit) {
+	stored, failed = make([]Hit, 0, len(hits)-len(e.Failed)), make([]Hit, 0, len(e.Failed))
+	for i, h := range hits {
+		if slices.Contains(e.Failed, i) {
+			failed = append(failed, h)
+		} else {
+			stored = append(stored, h)
+		}
+	}
+	return stored, failed
+}
+
+var (
+	hitSinksMu sync.Mutex
+	hitSinks   = map[string]func(connect string) (HitSink, error){
+		"sql": func(string) (HitSink, error) { return &sqlSink{}, nil },
+	}
+)
+
+// RegisterHitSink registers a new HitSink with the given name; it will panic if
+// the name is already registered.
+//
+// The open function is called with the part after the ":" in the -hit-sink
+// flag, if any.
+func RegisterHitSink(name string, open func(connect string) (HitSink, error)) {
+	hitSinksMu.Lock()
+	defer hitSinksMu.Unlock()
+	if _, ok := hitSinks[name]; ok {
+		panic("RegisterHitSink: already registered: " + name)
+	}
+	hitSinks[name] = open
+}
+
+// NewHitSink opens a registered HitSink; the spec is as "name" or
+// "name:connect".
+func NewHitSink(spec string) (HitSink, error) {
+	name, connect, _ := strings.Cut(spec, ":")
+
+	hitSinksMu.Lock()
+	open, ok := hitSinks[name]
+	names := make([]string, 0, len(hitSinks))
+	for k := range hitSinks {
+		names = append(names, k)
+	}
+	hitSinksMu.Unlock()
+
+	if !ok {
+		sort.Strings(names)
+		return nil, errors.Errorf("NewHitSink: unknown sink %q; registered sinks are: %s",
+			name, strings.Join(names, ", "))
+	}
+	s, err := open(connect)
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewHitSink %q", name)
+	}
+	return s, nil
+}
+
+// sqlSink inserts pageviews in the hits table.
+type sqlSink struct {
+	mu   sync.Mutex
+	hits []Hit
+}
+
+func (s *sqlSink) Append(ctx context.Context, hits []Hit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits = append(s.hits, hits...)
+	return nil
+}
+
+func (s *sqlSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	hits := s.hits
+	s.hits = nil
+	s.mu.Unlock()
+
+	if len(hits) == 0 {
+		return nil
+	}
+
+	// In a transaction, so that a failed batch can be retried without storing
+	// some pageviews twice.
+	return zdb.TX(ctx, func(ctx context.Context) error {
+		ins := zdb.NewBulkInsert(ctx, "hits", hitColumns)
+		for _, h := range hits {
+			var authed any // A nil *zbool.Bool panics in Value().
+			if h.Authed != nil {
+				authed = *h.Authed
+			}
+			ins.Values(h.Site, h.PathID, h.RefID, h.BrowserID, h.SystemID, h.SizeID,
+				h.Location, h.Language, h.CreatedAt.Round(time.Second), h.Bot, h.Session, h.FirstVisit,
+				h.PrevPathID, h.TLSVersion, h.TLSCipher, h.Type, h.TZOffset, authed,
+				h.PerfTTFB, h.PerfDCL, h.PerfLoad, h.Languages, h.Conn, h.ASN, h.ASNOrg, h.BrowserLanguage, h.Platform, h.BotClass, h.EventValue, h.NavType, h.SourceName, h.SessionThrottled, h.SizeBucket, h.ExperimentHash, h.Weight())
+		}
+		return ins.Finish()
+	})
+}
+
+// hitColumns are the columns that sqlSink inserts.
+var hitColumns = []string{"site_id", "path_id", "ref_id",
+	"browser_id", "system_id", "size_id", "location", "language", "created_at", "bot",
+	"session", "first_visit", "prev_path_id", "tls_version", "tls_cipher", "type", "tz_offset", "authed",
+	"perf_ttfb", "perf_dcl", "perf_load", "languages", "conn", "asn", "asn_org", "browser_language", "platform", "bot_class", "event_value", "nav_type", "source_name", "session_throttled", "size_bucket", "experiment_hash", "sample_weight"}
+
+// flushSize is the approximate size of the pageview when it's inserted, for
+// FlushBatch.Bytes: the length of the strings, and 8 bytes for every column.
+func (h Hit) flushSize() int {
+	n := 8*len(hitColumns) + len(h.Location) + len(h.Type) + len(h.Conn) + len(h.ASNOrg) +
+		len(h.Platform) + len(h.BotClass) + len(h.NavType) + len(h.SourceName) + len(h.SizeBucket) + len(h.ExperimentHash)
+	for _, l := range h.Languages {
+		n += len(l)
+	}
+	if h.Language != nil {
+		n += len(*h.Language)
+	}
+	if h.BrowserLanguage != nil {
+		n += len(*h.BrowserLanguage)
+	}
+	return n
+}
+
+func (s *sqlSink) Close() error { return nil }
@@ -0,0 +1,295 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2/metrics"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// MultiSink writes pageviews to a primary HitSink, and copies them to one or
+// more secondary sinks; for example to store pageviews in the database and in
+// an analytics warehouse.
+//
+// Errors from the primary sink are returned from Append() and Flush() as
+// usual. Every secondary sink has its own backlog that is delivered from a
+// separate goroutine, retrying with an exponential backoff, so a slow or
+// failing secondary sink never blocks the primary sink, the other secondary
+// sinks, or new pageviews.
+//
+// A batch is appended to a secondary sink again when it's retried, so its
+// Flush() should discard the pageviews on errors (as the sql sink does).
+// Pageviews are only passed to the secondary sinks once the primary sink
+// stored them, as the Memstore retries batches that failed; if the primary sink
+// returns a *PartialFlushError then only the stored pageviews are passed on.
+type MultiSink struct {
+	primary   HitSink
+	secondary []*fanoutSink
+}
+
+// SecondarySink is a secondary sink for NewMultiSink().
+type SecondarySink struct {
+	Name string
+	Sink HitSink
+
+	// Maximum number of pageviews to keep while the sink is failing; the
+	// oldest are dropped after this. Default: 100,000.
+	Backlog int
+
+	// Time to wait before the first retry; this is doubled on every failure
+	// up to MaxBackoff. Default: 1 second and 1 minute.
+	Backoff, MaxBackoff time.Duration
+}
+
+// SinkStat is the delivery state of a secondary sink.
+type SinkStat struct {
+	Name      string
+	Healthy   bool      // False if the last delivery failed.
+	Pending   int       // Pageviews waiting to be delivered.
+	Delivered int       // Pageviews delivered.
+	Failures  int       // Failed deliveries.
+	Dropped   int       // Pageviews dropped because the backlog was full.
+	LastError string    // Error from the last failed delivery.
+	RetryAt   time.Time // Time of the next retry, if it's not healthy.
+}
+
+// fanoutSink delivers pageviews to a secondary sink in the background.
+type fanoutSink struct {
+	SecondarySink
+
+	mu       sync.Mutex
+	pending  []Hit       // Appended, but not yet flushed.
+	backlog  []sinkBatch // Flushed, but not yet delivered.
+	inflight bool        // First batch in backlog is being delivered.
+	stat     SinkStat
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+type sinkBatch struct {
+	ctx  context.Context
+	hits []Hit
+}
+
+// NewMultiSink creates a new MultiSink, and starts the delivery for the
+// secondary sinks.
+func NewMultiSink(primary HitSink, secondary ...SecondarySink) *MultiSink {
+	s := &MultiSink{primary: primary, secondary: make([]*fanoutSink, 0, len(secondary))}
+	for _, sec := range secondary {
+		if sec.Backlog < 1 {
+			sec.Backlog = 100_000
+		}
+		if sec.Backoff <= 0 {
+			sec.Backoff = time.Second
+		}
+		if sec.MaxBackoff <= 0 {
+			sec.MaxBackoff = time.Minute
+		}
+		f := &fanoutSink{
+			SecondarySink: sec,
+			stat:          SinkStat{Name: sec.Name, Healthy: true},
+			wake:          make(chan struct{}, 1),
+			stop:          make(chan struct{}),
+			done:          make(chan struct{}),
+		}
+		go f.run()
+		s.secondary = append(s.secondary, f)
+	}
+	return s
+}
+
+func (s *MultiSink) Append(ctx context.Context, hits []Hit) error {
+	for _, f := range s.secondary {
+		f.mu.Lock()
+		f.pending = append(f.pending, hits...)
+		f.mu.Unlock()
+	}
+	return s.primary.Append(ctx, hits)
+}
+
+// Flush the primary sink, and signal the secondary sinks to deliver the
+// pageviews; it doesn't wait for them to be delivered.
+func (s *MultiSink) Flush(ctx context.Context) error {
+	err := s.primary.Flush(ctx)
+	var partial *PartialFlushError
+	for _, f := range s.secondary {
+		if errors.As(err, &partial) {
+			f.mu.Lock()
+			f.pending, _ = partial.split(f.pending)
+			f.mu.Unlock()
+			f.flush(ctx)
+			continue
+		}
+		if err != nil {
+			f.mu.Lock()
+			f.pending = nil
+			f.mu.Unlock()
+			continue
+		}
+		f.flush(ctx)
+	}
+	return err
+}
+
+// Close stops the delivery, makes a last attempt to deliver the backlogs, and
+// closes all sinks.
+func (s *MultiSink) Close() error {
+	errs := errors.NewGroup(10)
+	for _, f := range s.secondary {
+		errs.Append(f.close())
+	}
+	errs.Append(s.primary.Close())
+	return errs.ErrorOrNil()
+}
+
+// Stats gets the delivery state of every secondary sink.
+func (s *MultiSink) Stats() []SinkStat {
+	stats := make([]SinkStat, 0, len(s.secondary))
+	for _, f := range s.secondary {
+		f.mu.Lock()
+		st := f.stat
+		for _, b := range f.backlog {
+			st.Pending += len(b.hits)
+		}
+		f.mu.Unlock()
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+func (f *fanoutSink) flush(ctx context.Context) {
+	f.mu.Lock()
+	if len(f.pending) > 0 {
+		// Delivery happens after the request or cron job is done.
+		f.backlog = append(f.backlog, sinkBatch{ctx: context.WithoutCancel(ctx), hits: f.pending})
+		f.pending = nil
+	}
+
+	keep := 0
+	if f.inflight {
+		keep = 1
+	}
+	var n, dropped int
+	for _, b := range f.backlog {
+		n += len(b.hits)
+	}
+	// Drop the oldest batches, except the one being delivered right now.
+	for n > f.Backlog && len(f.backlog) > keep {
+		d := len(f.backlog[keep].hits)
+		n, dropped = n-d, dropped+d
+		f.backlog = append(f.backlog[:keep], f.backlog[keep+1:]...)
+	}
+	if dropped > 0 {
+		f.stat.Dropped += dropped
+		zlog.Module("hit-sink").Field("sink", f.Name).
+			Errorf("backlog full: dropped %d pageviews (%d in total)", dropped, f.stat.Dropped)
+	}
+	f.mu.Unlock()
+
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (f *fanoutSink) close() error {
+	close(f.stop)
+	<-f.done
+
+	errs := errors.NewGroup(2)
+	err := f.deliver()
+	if err != nil {
+		f.mu.Lock()
+		var n int
+		for _, b := range f.backlog {
+			n += len(b.hits)
+		}
+		f.mu.Unlock()
+		errs.Append(errors.Errorf("MultiSink.Close: %q: %d pageviews not delivered: %w", f.Name, n, err))
+	}
+	errs.Append(f.Sink.Close())
+	return errs.ErrorOrNil()
+}
+
+// run the delivery until the sink is closed, retrying with an exponential
+// backoff on errors.
+func (f *fanoutSink) run() {
+	defer close(f.done)
+	var (
+		retry   <-chan time.Time
+		backoff time.Duration
+	)
+	for {
+		wake := f.wake
+		if retry != nil { // Don't retry early on the next flush.
+			wake = nil
+		}
+		select {
+		case <-f.stop:
+			return
+		case <-wake:
+		case <-retry:
+		}
+
+		retry = nil
+		err := f.deliver()
+		if err != nil {
+			backoff = min(max(backoff*2, f.Backoff), f.MaxBackoff)
+			zlog.Module("hit-sink").Field("sink", f.Name).Field("retry", backoff.String()).Error(err)
+			f.mu.Lock()
+			f.stat.RetryAt = ztime.Now().Add(backoff)
+			f.mu.Unlock()
+			retry = time.After(backoff)
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// deliver the backlog in order, stopping at the first error.
+func (f *fanoutSink) deliver() error {
+	for {
+		f.mu.Lock()
+		if len(f.backlog) == 0 {
+			f.mu.Unlock()
+			return nil
+		}
+		b := f.backlog[0]
+		f.inflight = true
+		f.mu.Unlock()
+
+		m := metrics.Start("hit-sink:" + f.Name)
+		ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+		err := f.Sink.Append(ctx, b.hits)
+		if err == nil {
+			err = f.Sink.Flush(ctx)
+		}
+		cancel()
+		m.Done()
+
+		f.mu.Lock()
+		f.inflight = false
+		if err != nil {
+			f.stat.Healthy, f.stat.LastError = false, err.Error()
+			f.stat.Failures++
+		} else {
+			f.backlog = f.backlog[1:]
+			f.stat.Delivered += len(b.hits)
+			f.stat.Healthy, f.stat.RetryAt = true, time.Time{}
+		}
+		f.mu.Unlock()
+		if err != nil {
+			return errors.Wrapf(err, "MultiSink: delivering %d pageviews to %q", len(b.hits), f.Name)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"zgo.at/errors"
+)
+
+// RegionSink sends pageviews to a different HitSink depending on the visitor's
+// country, for data residency requirements; for example to store pageviews
+// from the EU in a database in the EU.
+//
+// Pageviews with an unknown location or from a country that's not in any
+// region are sent to the default sink.
+//
+// Only the hits are stored per-region: the stats tables are always updated in
+// the main database, so aggregated data (but not individual pageviews) for all
+// regions is stored there, and the dashboard shows the totals for all regions.
+// There is no transaction across the sinks: if one region fails the others are
+// still written and Flush() returns a *PartialFlushError with the pageviews of
+// the regions that failed.
+type RegionSink struct {
+	def       HitSink
+	sinks     map[string]HitSink // Region → sink
+	countries map[string]string  // Country → region
+
+	mu      sync.Mutex
+	n       int               // Pageviews appended since the last Flush().
+	pending map[HitSink][]int // Index of the appended pageviews per sink.
+	failed  map[HitSink]error // Sinks for which Append() failed.
+}
+
+// NewRegionSink creates a new RegionSink; countries is a map of ISO 3166-1
+// alpha-2 country codes to a region in sinks.
+func NewRegionSink(def HitSink, sinks map[string]HitSink, countries map[string]string) (*RegionSink, error) {
+	s := &RegionSink{def: def, sinks: sinks, countries: make(map[string]string, len(countries))}
+	for c, r := range countries {
+		if _, ok := sinks[r]; !ok {
+			return nil, errors.Errorf("NewRegionSink: no sink for region %q (country %q)", r, c)
+		}
+		s.countries[strings.ToUpper(c)] = r
+	}
+	return s, nil
+}
+
+// OpenRegionSink creates a RegionSink from a configuration file, opening all
+// the sinks with NewHitSink().
+//
+// Every line is "sink [region] [sink]" to set the sink for a region, using the
+// same format as NewHitSink(), or "countries [region] [country...]" to set the
+// countries for a region. Blank lines and lines starting with # are ignored.
+// For example:
+//
+//	sink      eu kafka:brokers=kafka.eu.example.com:9092&topic=goatcounter
+//	countries eu AT BE BG CY CZ DE DK EE ES FI FR GR HR HU IE IT LT LU LV MT NL PL PT RO SE SI SK
+func OpenRegionSink(def HitSink, conf []byte) (*RegionSink, error) {
+	var (
+		specs     = make(map[string]string)
+		countries = make(map[string]string)
+		scan      = bufio.NewScanner(bytes.NewReader(conf))
+	)
+	for n := 1; scan.Scan(); n++ {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) < 3 {
+			return nil, errors.Errorf("OpenRegionSink: line %d: need at least 3 fields: %q", n, line)
+		}
+		switch f[0] {
+		case "sink":
+			if len(f) != 3 {
+				return nil, errors.Errorf("OpenRegionSink: line %d: need 3 fields: %q", n, line)
+			}
+			if _, ok := specs[f[1]]; ok {
+				return nil, errors.Errorf("OpenRegionSink: line %d: duplicate region %q", n, f[1])
+			}
+			specs[f[1]] = f[2]
+		case "countries":
+			for _, c := range f[2:] {
+				if len(c) != 2 {
+					return nil, errors.Errorf("OpenRegionSink: line %d: invalid country code %q", n, c)
+				}
+				c = strings.ToUpper(c)
+				if r, ok := countries[c]; ok && r != f[1] {
+					return nil, errors.Errorf("OpenRegionSink: line %d: country %q is already in region %q", n, c, r)
+				}
+				countries[c] = f[1]
+			}
+		default:
+			return nil, errors.Errorf("OpenRegionSink: line %d: unknown keyword %q", n, f[0])
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return nil, errors.Wrap(err, "OpenRegionSink")
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("OpenRegionSink: no sinks")
+	}
+
+	sinks := make(map[string]HitSink, len(specs))
+	for r, spec := range specs {
+		s, err := NewHitSink(spec)
+		if err != nil {
+			for _, s := range sinks {
+				s.Close()
+			}
+			return nil, errors.Wrapf(err, "OpenRegionSink: region %q", r)
+		}
+		sinks[r] = s
+	}
+	rs, err := NewRegionSink(def, sinks, countries)
+	if err != nil {
+		for _, s := range sinks {
+			s.Close()
+		}
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Sink gets the sink for the location, as stored in Hit.Location (e.g. "NL"
+// or "NL-NH").
+func (s *RegionSink) Sink(loc string) HitSink {
+	c, _, _ := strings.Cut(loc, "-")
+	if r, ok := s.countries[strings.ToUpper(c)]; ok {
+		return s.sinks[r]
+	}
+	return s.def
+}
+
+// Append the pageviews to the sinks for their region; errors from the sinks
+// are returned from Flush(), so that the regions that didn't fail can still be
+// stored.
+func (s *RegionSink) Append(ctx context.Context, hits []Hit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil {
+		s.pending, s.failed = make(map[HitSink][]int), make(map[HitSink]error)
+	}
+
+	grouped := make(map[HitSink][]Hit)
+	for _, h := range hits {
+		sink := s.Sink(h.Location)
+		grouped[sink] = append(grouped[sink], h)
+		s.pending[sink] = append(s.pending[sink], s.n)
+		s.n++
+	}
+	for sink, hits := range grouped {
+		if err := sink.Append(ctx, hits); err != nil && s.failed[sink] == nil {
+			s.failed[sink] = err
+		}
+	}
+	return nil
+}
+
+func (s *RegionSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	n, pending, failed := s.n, s.pending, s.failed
+	s.n, s.pending, s.failed = 0, nil, nil
+	s.mu.Unlock()
+
+	var (
+		errs = errors.NewGroup(10)
+		idx  []int
+	)
+	// Only the sinks that got pageviews; a sink can be in all() more than
+	// once, but is only in pending once.
+	for _, sink := range s.all() {
+		p, ok := pending[sink]
+		if !ok {
+			continue
+		}
+		delete(pending, sink)
+
+		err := failed[sink]
+		if err == nil {
+			err = sink.Flush(ctx)
+		}
+		if err != nil {
+			errs.Append(err)
+			idx = append(idx, p...)
+		}
+	}
+
+	err := errs.ErrorOrNil()
+	if err == nil || len(idx) == n {
+		return err
+	}
+	sort.Ints(idx)
+	return &PartialFlushError{Failed: idx, Err: err}
+}
+
+func (s *RegionSink) Close() error {
+	errs := errors.NewGroup(10)
+	for _, sink := range s.all() {
+		errs.Append(sink.Close())
+	}
+	return errs.ErrorOrNil()
+}
+
+// all gets all sinks, with the default sink first and the regions sorted by
+// name.
+func (s *RegionSink) all() []HitSink {
+	regions := make([]string, 0, len(s.sinks))
+	for r := range s.sinks {
+		regions = append(regions, r)
+	}
+	sort.Strings(regions)
+
+	all := append(make([]HitSink, 0, len(s.sinks)+1), s.def)
+	for _, r := range regions {
+		all = append(all, s.sinks[r])
+	}
+	return all
+}
@@ -0,0 +1,602 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+)
+
+type fakeSink struct {
+	mu       sync.Mutex
+	buf      []Hit
+	batches  [][]Hit
+	flushErr error
+	failAt   int // Fail only this Flush() call.
+	flushes  int
+	onFlush  func()
+}
+
+func (s *fakeSink) Append(ctx context.Context, hits []Hit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf = append(s.buf, hits...)
+	return nil
+}
+
+func (s *fakeSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.onFlush != nil {
+		s.onFlush()
+	}
+	s.flushes++
+	if s.flushErr != nil || s.flushes == s.failAt {
+		s.buf = nil
+		if s.flushErr == nil {
+			return errors.New("failAt")
+		}
+		return s.flushErr
+	}
+	s.batches = append(s.batches, s.buf)
+	s.buf = nil
+	return nil
+}
+
+func (s *fakeSink) Close() error { return nil }
+
+func (s *fakeSink) paths() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var p []string
+	for _, b := range s.batches {
+		var bp []string
+		for _, h := range b {
+			bp = append(bp, h.Path)
+		}
+		p = append(p, strings.Join(bp, " "))
+	}
+	return strings.Join(p, " | ")
+}
+
+func TestHitSink(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	sink := &fakeSink{}
+	Memstore.SetSink(sink)
+	t.Cleanup(func() { Memstore.SetSink(nil) })
+
+	t.Run("batch", func(t *testing.T) {
+		Memstore.Append(Hit{Site: site.ID, Path: "/a"}, Hit{Site: site.ID, Path: "/b"})
+		hits, err := Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 2 {
+			t.Fatalf("len(hits) = %d", len(hits))
+		}
+
+		if len(sink.batches) != 1 || len(sink.batches[0]) != 2 {
+			t.Fatalf("%v", sink.batches)
+		}
+		for i, h := range sink.batches[0] {
+			if h.PathID == 0 || h.Path != hits[i].Path { // Should get processed hits.
+				t.Errorf("%d: PathID=%d Path=%q", i, h.PathID, h.Path)
+			}
+		}
+
+		var n int
+		err = zdb.Get(ctx, &n, `select count(*) from hits`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%d rows in hits table", n)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		sink.flushErr = errors.New("oh noes")
+		defer func() { sink.flushErr = nil }()
+
+		Memstore.Append(Hit{Site: site.ID, Path: "/c"})
+		hits, err := Memstore.Persist(ctx)
+		if !ztest.ErrorContains(err, "oh noes") {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if len(hits) != 0 {
+			t.Errorf("len(hits) = %d", len(hits))
+		}
+
+		// Retried on the next Persist().
+		sink.flushErr = nil
+		hits, err = Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 1 || hits[0].Path != "/c" {
+			t.Errorf("%v", hits)
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		Memstore.SetSink(nil)
+		defer Memstore.SetSink(sink)
+
+		gctest.StoreHits(ctx, t, false, Hit{Site: site.ID, Path: "/d"})
+		var n int
+		err := zdb.Get(ctx, &n, `select count(*) from hits`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("%d rows in hits table", n)
+		}
+	})
+}
+
+func TestFlushBatch(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+	t.Cleanup(func() {
+		Memstore.SetSink(nil)
+		Memstore.SetFlushBatch(FlushBatch{})
+	})
+
+	send := func(paths ...string) {
+		for _, p := range paths {
+			Memstore.Append(Hit{Site: site.ID, Path: p})
+		}
+	}
+
+	t.Run("rows", func(t *testing.T) {
+		sink := &fakeSink{failAt: 2}
+		Memstore.SetSink(sink)
+		Memstore.SetFlushBatch(FlushBatch{Rows: 2})
+
+		send("/1", "/2", "/3", "/4", "/5")
+		hits, err := Memstore.Persist(ctx) // Second batch fails.
+		if !ztest.ErrorContains(err, "3 of 5 pageviews not stored") {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if len(hits) != 2 {
+			t.Errorf("len(hits) = %d", len(hits))
+		}
+		if h := sink.paths(); h != "/1 /2" {
+			t.Fatalf("after error: %s", h)
+		}
+
+		send("/6")
+		hits, err = Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 4 {
+			t.Errorf("len(hits) = %d", len(hits))
+		}
+		if h := sink.paths(); h != "/1 /2 | /3 /4 | /5 /6" {
+			t.Errorf("after retry: %s", h)
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		sink := &fakeSink{}
+		Memstore.SetSink(sink)
+		Memstore.SetFlushBatch(FlushBatch{Bytes: 1}) // Every pageview is too large.
+
+		send("/1", "/2", "/3")
+		_, err := Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := sink.paths(); h != "/1 | /2 | /3" {
+			t.Errorf("%s", h)
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		sink := &fakeSink{flushErr: errors.New("oops")}
+		sink.onFlush = func() { send("/new1", "/new2", "/new3") } // Arrive while storing.
+		Memstore.SetSink(sink)
+		Memstore.SetFlushBatch(FlushBatch{})
+		Memstore.SetLimit(MemstoreLimit{Max: 3})
+		defer Memstore.SetLimit(MemstoreLimit{})
+
+		send("/1", "/2", "/3")
+		for i := 0; i < 3; i++ {
+			_, err := Memstore.Persist(ctx)
+			if !ztest.ErrorContains(err, "3 of 3 pageviews not stored") {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if l := Memstore.Len(); l != 3 {
+				t.Fatalf("Len() = %d after %d failures", l, i+1)
+			}
+		}
+
+		sink.flushErr, sink.onFlush = nil, nil
+		_, err := Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := sink.paths(); h != "/1 /2 /3" {
+			t.Errorf("after retry: %s", h)
+		}
+	})
+
+	t.Run("regions", func(t *testing.T) {
+		def, eu := &fakeSink{}, &fakeSink{failAt: 1}
+		sink, err := NewRegionSink(def, map[string]HitSink{"eu": eu}, map[string]string{"NL": "eu"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		Memstore.SetSink(sink)
+		Memstore.SetFlushBatch(FlushBatch{})
+
+		Memstore.Append(Hit{Site: site.ID, Path: "/us", Location: "US"}, Hit{Site: site.ID, Path: "/nl", Location: "NL"})
+		hits, err := Memstore.Persist(ctx) // The eu region fails.
+		if !ztest.ErrorContains(err, "1 of 2 pageviews not stored") {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if len(hits) != 1 || hits[0].Path != "/us" {
+			t.Errorf("hits: %v", hits)
+		}
+
+		hits, err = Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 1 || hits[0].Path != "/nl" {
+			t.Errorf("hits: %v", hits)
+		}
+		if h := def.paths(); h != "/us" {
+			t.Errorf("default: %s", h)
+		}
+		if h := eu.paths(); h != "/nl" {
+			t.Errorf("eu: %s", h)
+		}
+	})
+
+	t.Run("sql", func(t *testing.T) {
+		Memstore.SetSink(nil)
+		Memstore.SetFlushBatch(FlushBatch{Rows: 2})
+
+		gctest.StoreHits(ctx, t, false, Hit{Site: site.ID, Path: "/a"}, Hit{Site: site.ID, Path: "/b"},
+			Hit{Site: site.ID, Path: "/c"})
+		var n int
+		err := zdb.Get(ctx, &n, `select count(*) from hits`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 {
+			t.Errorf("%d rows in hits table", n)
+		}
+	})
+}
+
+func TestPersistHit(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	sink := &fakeSink{}
+	Memstore.SetSink(sink)
+	t.Cleanup(func() { Memstore.SetSink(nil) })
+
+	err := Memstore.PersistHit(ctx, Hit{Site: site.ID, Path: "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.batches) != 1 || len(sink.batches[0]) != 1 || sink.batches[0][0].PathID == 0 {
+		t.Fatalf("%v", sink.batches)
+	}
+
+	// Returned for the stats, but not written again.
+	Memstore.Append(Hit{Site: site.ID, Path: "/b"})
+	hits, err := Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || hits[0].Path != "/a" || hits[1].Path != "/b" {
+		t.Fatalf("%v", hits)
+	}
+	if len(sink.batches) != 2 || len(sink.batches[1]) != 1 {
+		t.Fatalf("%v", sink.batches)
+	}
+	hits, err = Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 0 {
+		t.Fatalf("%v", hits)
+	}
+
+	// Error
+	sink.flushErr = errors.New("oh noes")
+	err = Memstore.PersistHit(ctx, Hit{Site: site.ID, Path: "/c"})
+	if !ztest.ErrorContains(err, "oh noes") {
+		t.Fatalf("wrong error: %v", err)
+	}
+	sink.flushErr, sink.buf = nil, nil
+	hits, err = Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 0 {
+		t.Fatalf("%v", hits)
+	}
+}
+
+func TestNewHitSink(t *testing.T) {
+	var connect string
+	RegisterHitSink("test-sink", func(c string) (HitSink, error) {
+		connect = c
+		if c == "fail" {
+			return nil, errors.New("can't connect")
+		}
+		return &fakeSink{}, nil
+	})
+
+	s, err := NewHitSink("test-sink:localhost:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*fakeSink); !ok || connect != "localhost:9000" {
+		t.Errorf("%T %q", s, connect)
+	}
+
+	_, err = NewHitSink("test-sink:fail")
+	if !ztest.ErrorContains(err, "can't connect") {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	_, err = NewHitSink("nope")
+	if !ztest.ErrorContains(err, `unknown sink "nope"; registered sinks are: sql, test-sink`) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	if _, err := NewHitSink("sql"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRegionSink(t *testing.T) {
+	var (
+		def = &fakeSink{}
+		eu  = &fakeSink{}
+		us  = &fakeSink{}
+	)
+	s, err := NewRegionSink(def, map[string]HitSink{"eu": eu, "us": us},
+		map[string]string{"NL": "eu", "de": "eu", "US": "us"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Append(context.Background(), []Hit{
+		{Path: "/nl", Location: "NL"},
+		{Path: "/de", Location: "DE-BE"},
+		{Path: "/us", Location: "US-CA"},
+		{Path: "/gb", Location: "GB"},
+		{Path: "/unknown", Location: ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := func(s *fakeSink) string {
+		var p []string
+		for _, b := range s.batches {
+			for _, h := range b {
+				p = append(p, h.Path)
+			}
+		}
+		return strings.Join(p, " ")
+	}
+	if h := paths(eu); h != "/nl /de" {
+		t.Errorf("eu: %s", h)
+	}
+	if h := paths(us); h != "/us" {
+		t.Errorf("us: %s", h)
+	}
+	if h := paths(def); h != "/gb /unknown" {
+		t.Errorf("default: %s", h)
+	}
+
+	// Other regions are still flushed if one fails.
+	us.flushErr = errors.New("oh noes")
+	err = s.Append(context.Background(), []Hit{{Path: "/nl2", Location: "NL"}, {Path: "/us2", Location: "US"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Flush(context.Background())
+	if !ztest.ErrorContains(err, "oh noes") {
+		t.Errorf("wrong error: %v", err)
+	}
+	var partial *PartialFlushError
+	if !errors.As(err, &partial) || len(partial.Failed) != 1 || partial.Failed[0] != 1 {
+		t.Errorf("not a partial error for /us2: %#v", err)
+	}
+	if h := paths(eu); h != "/nl /de /nl2" {
+		t.Errorf("eu: %s", h)
+	}
+
+	_, err = NewRegionSink(def, map[string]HitSink{"eu": eu}, map[string]string{"US": "us"})
+	if !ztest.ErrorContains(err, `no sink for region "us"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestOpenRegionSink(t *testing.T) {
+	tests := []struct {
+		conf, wantErr string
+	}{
+		{"# Regions\nsink eu sql\n\ncountries eu nl DE\ncountries eu FR\n", ""},
+		{"", "no sinks"},
+		{"sink eu", "need at least 3 fields"},
+		{"sink eu sql extra", "need 3 fields"},
+		{"sink eu sql\nsink eu sql", `duplicate region "eu"`},
+		{"sink eu sql\ncountries eu NLD", `invalid country code "NLD"`},
+		{"sink eu sql\nsink us sql\ncountries eu NL\ncountries us NL", `country "NL" is already in region "eu"`},
+		{"sink eu sql\ncountries us US", `no sink for region "us"`},
+		{"sink eu nope", `unknown sink "nope"`},
+		{"region eu sql", `unknown keyword "region"`},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			s, err := OpenRegionSink(&fakeSink{}, []byte(tt.conf))
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+			if _, ok := s.Sink("DE-BE").(*fakeSink); ok {
+				t.Error("DE not in eu")
+			}
+			if _, ok := s.Sink("GB").(*fakeSink); !ok {
+				t.Error("GB not in default")
+			}
+		})
+	}
+}
+
+// flakySink fails the first fail flushes, discarding the pageviews as the sql
+// sink does.
+type flakySink struct {
+	fakeSink
+	fail     int
+	attempts int
+}
+
+func (s *flakySink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.fail > 0 {
+		s.fail--
+		s.buf = nil
+		return errors.New("oh noes")
+	}
+	s.batches = append(s.batches, s.buf)
+	s.buf = nil
+	return nil
+}
+
+func TestMultiSink(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		primary = &fakeSink{}
+		healthy = &fakeSink{}
+		failing = &flakySink{fail: 3}
+	)
+	s := NewMultiSink(primary,
+		SecondarySink{Name: "healthy", Sink: healthy},
+		SecondarySink{Name: "failing", Sink: failing, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+
+	paths := func(s *fakeSink) string {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var p []string
+		for _, b := range s.batches {
+			for _, h := range b {
+				p = append(p, h.Path)
+			}
+		}
+		return strings.Join(p, " ")
+	}
+	wait := func(s *fakeSink, want string) {
+		t.Helper()
+		for i := 0; i < 200 && paths(s) != want; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if h := paths(s); h != want {
+			t.Fatalf("\nhave: %s\nwant: %s", h, want)
+		}
+	}
+
+	for _, b := range [][]Hit{{{Path: "/a"}, {Path: "/b"}}, {{Path: "/c"}}, {{Path: "/d"}}} {
+		err := s.Append(ctx, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Flush(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Primary is written right away, and the healthy secondary gets every
+	// batch without waiting for the failing one.
+	if h := paths(primary); h != "/a /b /c /d" {
+		t.Errorf("primary: %s", h)
+	}
+	wait(healthy, "/a /b /c /d")
+
+	// Failing sink gets all batches in order after retrying.
+	wait(&failing.fakeSink, "/a /b /c /d")
+	failing.mu.Lock()
+	if failing.attempts != 6 {
+		t.Errorf("attempts: %d", failing.attempts)
+	}
+	failing.mu.Unlock()
+
+	stats := s.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("%v", stats)
+	}
+	if st := stats[0]; st.Name != "healthy" || !st.Healthy || st.Delivered != 4 || st.Failures != 0 || st.Pending != 0 {
+		t.Errorf("healthy: %+v", st)
+	}
+	if st := stats[1]; st.Name != "failing" || !st.Healthy || st.Delivered != 4 || st.Failures != 3 || st.LastError == "" {
+		t.Errorf("failing: %+v", st)
+	}
+
+	// Backlog is limited while the sink is failing, and the failing sink
+	// doesn't affect the primary.
+	slow := &flakySink{fail: 1_000}
+	s2 := NewMultiSink(primary, SecondarySink{Name: "slow", Sink: slow, Backlog: 2, Backoff: time.Hour})
+	for _, p := range []string{"/e", "/f", "/g"} {
+		err := s2.Append(ctx, []Hit{{Path: p}})
+		if err == nil {
+			err = s2.Flush(ctx)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := paths(primary); h != "/a /b /c /d /e /f /g" {
+		t.Errorf("primary: %s", h)
+	}
+	for i := 0; i < 200; i++ {
+		if st := s2.Stats()[0]; st.Failures > 0 && !st.Healthy {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if st := s2.Stats()[0]; st.Healthy || st.Dropped == 0 || st.Pending > 2 {
+		t.Errorf("slow: %+v", st)
+	}
+
+	err := s2.Close()
+	if !ztest.ErrorContains(err, `"slow": 2 pageviews not delivered`) {
+		t.Errorf("wrong error: %v", err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
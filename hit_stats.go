@@ -6,6 +6,7 @@ package goatcounter
 
 import (
 	"context"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -37,7 +38,12 @@ type HitStats struct {
 	Stats []HitStat `json:"stats"`
 }
 
-func asUTCDate(u *User, t time.Time) string {
+// asUTCDate gets the day t falls on in the stats tables; this is the site's
+// timezone if it has one, or the user's timezone.
+func asUTCDate(ctx context.Context, u *User, t time.Time) string {
+	if z := MustGetSite(ctx).Settings.Timezone; z != nil {
+		return t.In(z.Loc()).Format("2006-01-02")
+	}
 	return t.In(u.Settings.Timezone.Location).Format("2006-01-02")
 }
 
@@ -63,6 +69,29 @@ func (h *HitStats) ListTopRefs(ctx context.Context, rng ztime.Range, pathFilter
 		return errors.Wrap(err, "HitStats.ListAllRefs")
 	}
 
+	if k := site.Settings.MinVisitors; k > 0 {
+		// Sorted by count, so everything after the first entry that's below
+		// the threshold is also below it; replace them all with one entry
+		// on the page where this happens.
+		if i := slices.IndexFunc(h.Stats, func(s HitStat) bool { return s.Count < k }); i > -1 && i < limit {
+			var below int
+			err := zdb.Get(ctx, &below, "load:ref.ListTopRefs-below.sql", zdb.P{
+				"site":       site.ID,
+				"start":      rng.Start,
+				"end":        rng.End,
+				"filter":     pathFilter,
+				"ref":        site.LinkDomain + "%",
+				"has_domain": site.LinkDomain != "",
+				"min":        k,
+			})
+			if err != nil {
+				return errors.Wrap(err, "HitStats.ListAllRefs")
+			}
+			h.Stats = append(h.Stats[:i:i], HitStat{Name: BelowThresholdLabel, Count: below, RefScheme: RefSchemeGenerated})
+			return nil
+		}
+	}
+
 	if len(h.Stats) > limit {
 		h.More = true
 		h.Stats = h.Stats[:len(h.Stats)-1]
@@ -93,8 +122,8 @@ func (h *HitStats) ListBrowsers(ctx context.Context, rng ztime.Range, pathFilter
 	user := MustGetUser(ctx)
 	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListBrowsers", zdb.P{
 		"site":   MustGetSite(ctx).ID,
-		"start":  asUTCDate(user, rng.Start),
-		"end":    asUTCDate(user, rng.End),
+		"start":  asUTCDate(ctx, user, rng.Start),
+		"end":    asUTCDate(ctx, user, rng.End),
 		"filter": pathFilter,
 		"limit":  limit + 1,
 		"offset": offset,
@@ -111,8 +140,8 @@ func (h *HitStats) ListBrowser(ctx context.Context, browser string, rng ztime.Ra
 	user := MustGetUser(ctx)
 	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListBrowser", zdb.P{
 		"site":    MustGetSite(ctx).ID,
-		"start":   asUTCDate(user, rng.Start),
-		"end":     asUTCDate(user, rng.End),
+		"start":   asUTCDate(ctx, user, rng.Start),
+		"end":     asUTCDate(ctx, user, rng.End),
 		"filter":  pathFilter,
 		"browser": browser,
 		"limit":   limit + 1,
@@ -130,8 +159,8 @@ func (h *HitStats) ListSystems(ctx context.Context, rng ztime.Range, pathFilter
 	user := MustGetUser(ctx)
 	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListSystems", zdb.P{
 		"site":   MustGetSite(ctx).ID,
-		"start":  asUTCDate(user, rng.Start),
-		"end":    asUTCDate(user, rng.End),
+		"start":  asUTCDate(ctx, user, rng.Start),
+		"end":    asUTCDate(ctx, user, rng.End),
 		"filter": pathFilter,
 		"limit":  limit + 1,
 		"offset": offset,
@@ -148,8 +177,8 @@ func (h *HitStats) ListSystem(ctx context.Context, system string, rng ztime.Rang
 	user := MustGetUser(ctx)
 	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListSystem", zdb.P{
 		"site":   MustGetSite(ctx).ID,
-		"start":  asUTCDate(user, rng.Start),
-		"end":    asUTCDate(user, rng.End),
+		"start":  asUTCDate(ctx, user, rng.Start),
+		"end":    asUTCDate(ctx, user, rng.End),
 		"filter": pathFilter,
 		"system": system,
 		"limit":  limit + 1,
@@ -176,8 +205,8 @@ func (h *HitStats) ListSizes(ctx context.Context, rng ztime.Range, pathFilter []
 	user := MustGetUser(ctx)
 	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListSizes", zdb.P{
 		"site":   MustGetSite(ctx).ID,
-		"start":  asUTCDate(user, rng.Start),
-		"end":    asUTCDate(user, rng.End),
+		"start":  asUTCDate(ctx, user, rng.Start),
+		"end":    asUTCDate(ctx, user, rng.End),
 		"filter": pathFilter,
 	})
 	if err != nil {
@@ -242,8 +271,8 @@ func (h *HitStats) ListSize(ctx context.Context, id string, rng ztime.Range, pat
 	user := MustGetUser(ctx)
 	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListSize", zdb.P{
 		"site":     MustGetSite(ctx).ID,
-		"start":    asUTCDate(user, rng.Start),
-		"end":      asUTCDate(user, rng.End),
+		"start":    asUTCDate(ctx, user, rng.Start),
+		"end":      asUTCDate(ctx, user, rng.End),
 		"filter":   pathFilter,
 		"min_size": min_size,
 		"max_size": max_size,
@@ -269,8 +298,8 @@ func (h *HitStats) ListLocations(ctx context.Context, rng ztime.Range, pathFilte
 	user := MustGetUser(ctx)
 	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListLocations", zdb.P{
 		"site":   MustGetSite(ctx).ID,
-		"start":  asUTCDate(user, rng.Start),
-		"end":    asUTCDate(user, rng.End),
+		"start":  asUTCDate(ctx, user, rng.Start),
+		"end":    asUTCDate(ctx, user, rng.End),
 		"filter": pathFilter,
 		"limit":  limit + 1,
 		"offset": offset,
@@ -287,8 +316,8 @@ func (h *HitStats) ListLocation(ctx context.Context, country string, rng ztime.R
 	user := MustGetUser(ctx)
 	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListLocation", zdb.P{
 		"site":    MustGetSite(ctx).ID,
-		"start":   asUTCDate(user, rng.Start),
-		"end":     asUTCDate(user, rng.End),
+		"start":   asUTCDate(ctx, user, rng.Start),
+		"end":     asUTCDate(ctx, user, rng.End),
 		"filter":  pathFilter,
 		"country": country,
 		"limit":   limit + 1,
@@ -306,8 +335,8 @@ func (h *HitStats) ListLanguages(ctx context.Context, rng ztime.Range, pathFilte
 	user := MustGetUser(ctx)
 	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListLanguages", zdb.P{
 		"site":   MustGetSite(ctx).ID,
-		"start":  asUTCDate(user, rng.Start),
-		"end":    asUTCDate(user, rng.End),
+		"start":  asUTCDate(ctx, user, rng.Start),
+		"end":    asUTCDate(ctx, user, rng.End),
 		"filter": pathFilter,
 		"limit":  limit + 1,
 		"offset": offset,
@@ -324,8 +353,8 @@ func (h *HitStats) ListCampaigns(ctx context.Context, rng ztime.Range, pathFilte
 	user := MustGetUser(ctx)
 	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListCampaigns", zdb.P{
 		"site":   MustGetSite(ctx).ID,
-		"start":  asUTCDate(user, rng.Start),
-		"end":    asUTCDate(user, rng.End),
+		"start":  asUTCDate(ctx, user, rng.Start),
+		"end":    asUTCDate(ctx, user, rng.End),
 		"filter": pathFilter,
 		"limit":  limit + 1,
 		"offset": offset,
@@ -342,8 +371,8 @@ func (h *HitStats) ListCampaign(ctx context.Context, campaign int64, rng ztime.R
 	user := MustGetUser(ctx)
 	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListCampaign", zdb.P{
 		"site":     MustGetSite(ctx).ID,
-		"start":    asUTCDate(user, rng.Start),
-		"end":      asUTCDate(user, rng.End),
+		"start":    asUTCDate(ctx, user, rng.Start),
+		"end":      asUTCDate(ctx, user, rng.End),
 		"filter":   pathFilter,
 		"campaign": campaign,
 		"limit":    limit + 1,
@@ -355,3 +384,28 @@ func (h *HitStats) ListCampaign(ctx context.Context, campaign int64, rng ztime.R
 	}
 	return errors.Wrap(err, "HitStats.ListCampaign")
 }
+
+// EventValue is the total and average Hit.EventValue for an event.
+type EventValue struct {
+	PathID  int64   `db:"path_id" json:"path_id"`
+	Event   string  `db:"event" json:"event"`
+	Count   int     `db:"count" json:"count"` // Number of events with a value.
+	Total   float64 `db:"total" json:"total"`
+	Average float64 `db:"average" json:"average"`
+}
+
+type EventValues []EventValue
+
+// List the totals and averages of the event values for the given time period,
+// ordered by the total. Bots are excluded unless they're in CountBots.
+func (e *EventValues) List(ctx context.Context, rng ztime.Range, pathFilter []int64, limit int) error {
+	err := zdb.Select(ctx, e, "load:hit_stats.ListEventValues", zdb.P{
+		"site":   MustGetSite(ctx).ID,
+		"bots":   append([]int{0}, Config(ctx).CountBots...),
+		"start":  rng.Start,
+		"end":    rng.End,
+		"filter": pathFilter,
+		"limit":  limit,
+	})
+	return errors.Wrap(err, "EventValues.List")
+}
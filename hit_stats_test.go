@@ -5,6 +5,7 @@
 package goatcounter_test
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 	"time"
@@ -424,3 +425,89 @@ func TestStatsByRef(t *testing.T) {
 		t.Error(d)
 	}
 }
+
+func TestListTopRefsMinVisitors(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	site.Settings.MinVisitors = 2
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hits []Hit
+	for ref, n := range map[string]int{"https://a.example": 3, "https://b.example": 2, "https://c.example": 1, "https://d.example": 1} {
+		for i := 0; i < n; i++ {
+			hits = append(hits, Hit{Path: "/a", Ref: ref, FirstVisit: true})
+		}
+	}
+	gctest.StoreHits(ctx, t, false, hits...)
+
+	rng := ztime.NewRange(ztime.Now().Add(-1 * time.Hour)).To(ztime.Now().Add(1 * time.Hour))
+	list := func(limit, offset int) string {
+		t.Helper()
+		var stats HitStats
+		err := stats.ListTopRefs(ctx, rng, nil, limit, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		for _, s := range stats.Stats {
+			fmt.Fprintf(&b, "%s %d, ", s.Name, s.Count)
+		}
+		return fmt.Sprintf("%s%t", b.String(), stats.More)
+	}
+
+	if h, w := list(10, 0), "a.example 3, b.example 2, (below threshold) 2, false"; h != w {
+		t.Errorf("\nhave: %s\nwant: %s", h, w)
+	}
+
+	// Grouped once, on the page where the threshold is crossed.
+	for _, tt := range []struct {
+		offset int
+		want   string
+	}{
+		{0, "a.example 3, true"},
+		{1, "b.example 2, true"},
+		{2, "(below threshold) 2, false"},
+	} {
+		if h := list(1, tt.offset); h != tt.want {
+			t.Errorf("offset %d\nhave: %s\nwant: %s", tt.offset, h, tt.want)
+		}
+	}
+}
+
+func TestEventValues(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	s := MustGetSite(ctx)
+	s.Settings.CollectEventValue = true
+	err := s.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := func(f float64) *float64 { return &f }
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "order", Event: true, EventValue: v(10)},
+		Hit{Path: "order", Event: true, EventValue: v(30)},
+		Hit{Path: "order", Event: true},
+		Hit{Path: "refund", Event: true, EventValue: v(-5)},
+		Hit{Path: "order", Event: true, EventValue: v(100), Bot: 4},
+		Hit{Path: "/x", EventValue: v(1)},
+	)
+
+	var have EventValues
+	err = have.List(ctx, ztime.NewRange(ztime.Now().Add(-time.Hour)).To(ztime.Now().Add(time.Hour)), nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[
+		{"path_id": 1, "event": "order", "count": 2, "total": 40, "average": 20},
+		{"path_id": 2, "event": "refund", "count": 1, "total": -5, "average": -5}
+	]`
+	if d := ztest.Diff(string(zjson.MustMarshal(have)), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+}
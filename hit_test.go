@@ -5,11 +5,19 @@
 package goatcounter_test
 
 import (
+	"fmt"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"golang.org/x/text/language"
 	. "zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
 	"zgo.at/zstd/ztype"
 )
 
@@ -88,6 +96,247 @@ func TestHitDefaultsRef(t *testing.T) {
 	}
 }
 
+func TestHitDefaultsRefSchemes(t *testing.T) {
+	tests := []struct {
+		in         string
+		schemes    Strings
+		other      string
+		wantRef    string
+		wantScheme string
+	}{
+		{"https://example.com/x", nil, OtherRefSchemesDrop, "example.com/x", "h"},
+		{"http://example.com/x", nil, OtherRefSchemesGroup, "example.com/x", "h"},
+		{"example.com/x", nil, OtherRefSchemesDrop, "example.com/x", "o"},
+		{"", nil, OtherRefSchemesDrop, "", ""},
+
+		{"android-app://com.example.android", nil, OtherRefSchemesKeep, "com.example.android", "o"},
+		{"android-app://com.example.android", nil, OtherRefSchemesGroup, "(app)", "g"},
+		{"chrome-extension://abcdef/page.html", nil, OtherRefSchemesGroup, "(app)", "g"},
+		{"android-app://com.example.android", nil, OtherRefSchemesDrop, "", ""},
+		{"xx://asd", nil, OtherRefSchemesDrop, "", ""},
+		{"android-app://com.example.android", Strings{"https", "android-app"}, OtherRefSchemesDrop, "com.example.android", "o"},
+		{"http://example.com/x", Strings{"https"}, OtherRefSchemesDrop, "", ""},
+
+		// Known apps are still grouped.
+		{"android-app://com.laurencedawson.reddit_sync.pro", nil, OtherRefSchemesDrop, "www.reddit.com", "g"},
+	}
+
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s/%s", tt.in, tt.schemes, tt.other), func(t *testing.T) {
+			site.Settings.RefSchemes, site.Settings.OtherRefSchemes = tt.schemes, tt.other
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := Hit{Path: "/", Ref: tt.in}
+			h.RefURL, _ = url.Parse(tt.in)
+			h.Defaults(ctx, true)
+			if h.Ref != tt.wantRef || ztype.Deref(h.RefScheme, "") != tt.wantScheme {
+				t.Errorf("\nhave: %q %q\nwant: %q %q", h.Ref, ztype.Deref(h.RefScheme, ""), tt.wantRef, tt.wantScheme)
+			}
+		})
+	}
+}
+
+func TestHitDefaultsRefGranularity(t *testing.T) {
+	tests := []struct {
+		granularity, in, query string
+		wantRef, wantScheme    string
+	}{
+		{RefGranularityFull, "https://example.com/private/page?q=1&id=2", "", "example.com/private/page", "h"},
+		{RefGranularityOrigin, "https://example.com/private/page?q=1&id=2", "", "example.com", "h"},
+		{RefGranularityNone, "https://example.com/private/page?q=1&id=2", "", "", ""},
+
+		{RefGranularityFull, "https://example.com:8080/page#frag", "", "example.com:8080/page#frag", "h"},
+		{RefGranularityOrigin, "https://example.com:8080/page#frag", "", "example.com:8080", "h"},
+		{RefGranularityOrigin, "https://example.com?q=1", "", "example.com", "h"},
+		{RefGranularityOrigin, "example.com/page", "", "example.com", "o"},
+		{RefGranularityOrigin, "android-app://com.example.android/path", "", "com.example.android", "o"},
+		{RefGranularityOrigin, "https://t.co/c3MITw38Yq", "", "twitter.com", "h"},
+
+		// Grouped referrers and campaigns are always kept.
+		{RefGranularityOrigin, "https://www.google.com/search?q=private", "", "Google", "g"},
+		{RefGranularityNone, "https://example.com/page", "utm_source=newsletter", "newsletter", "c"},
+		{RefGranularityOrigin, "https://example.com/page", "utm_source=newsletter", "newsletter", "c"},
+	}
+
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s/%s", tt.granularity, tt.in, tt.query), func(t *testing.T) {
+			site.Settings.RefGranularity = tt.granularity
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := Hit{Path: "/", Ref: tt.in, Query: tt.query}
+			h.RefURL, _ = url.Parse(tt.in)
+			h.Defaults(ctx, true)
+			if h.Ref != tt.wantRef || ztype.Deref(h.RefScheme, "") != tt.wantScheme {
+				t.Errorf("\nhave: %q %q\nwant: %q %q", h.Ref, ztype.Deref(h.RefScheme, ""), tt.wantRef, tt.wantScheme)
+			}
+		})
+	}
+}
+
+func TestHitDefaultsRefDomain(t *testing.T) {
+	tests := []struct {
+		in         string
+		group      bool
+		wantRef    string
+		wantDomain string
+	}{
+		{"https://m.example.com/l.php", false, "m.example.com/l.php", "example.com"},
+		{"https://m.example.com/l.php", true, "example.com/l.php", "example.com"},
+		{"https://a.b.example.com:8080/x", true, "example.com:8080/x", "example.com"},
+		{"https://www.example.com", true, "example.com", "example.com"},
+		{"https://example.com/page", true, "example.com/page", "example.com"},
+
+		// Multi-label public suffixes.
+		{"https://news.bbc.co.uk/story", true, "bbc.co.uk/story", "bbc.co.uk"},
+		{"https://a.b.example.co.uk", true, "example.co.uk", "example.co.uk"},
+		{"https://user.github.io/x", true, "user.github.io/x", "user.github.io"},
+		{"https://a.user.github.io", true, "user.github.io", "user.github.io"},
+		{"https://WWW.Example.COM", true, "example.com", "example.com"},
+		{"https://Example.COM", true, "Example.COM", "example.com"},
+
+		// No registered domain.
+		{"https://co.uk", true, "co.uk", "co.uk"},
+		{"http://localhost:8080/x", true, "localhost:8080/x", "localhost"},
+		{"http://127.0.0.1/x", true, "127.0.0.1/x", "127.0.0.1"},
+		{"http://[::1]:8080/x", true, "[::1]:8080/x", "::1"},
+
+		// Only for HTTP referrers.
+		{"https://mail.google.com", true, "Email", ""},
+		{"android-app://com.example.android", true, "com.example.android", ""},
+	}
+
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+	site.Settings.InternalRefs = InternalRefsKeep
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%t", tt.in, tt.group), func(t *testing.T) {
+			site.Settings.GroupRefDomains = tt.group
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := Hit{Ref: tt.in}
+			h.RefURL, _ = url.Parse(tt.in)
+			h.Defaults(ctx, true)
+			if h.Ref != tt.wantRef || h.RefDomain != tt.wantDomain {
+				t.Errorf("\nhave: %q %q\nwant: %q %q", h.Ref, h.RefDomain, tt.wantRef, tt.wantDomain)
+			}
+		})
+	}
+}
+
+func TestHitDefaultsReferrerAllowlist(t *testing.T) {
+	tests := []struct {
+		in        string
+		allowlist Strings
+		wantRef   string
+	}{
+		{"https://example.com/page", Strings{"example.com"}, "example.com/page"},
+		{"https://m.example.com/page", Strings{"example.com"}, "m.example.com/page"},
+		{"https://EXAMPLE.com", Strings{"example.com"}, "EXAMPLE.com"},
+		{"https://news.example.org", Strings{"example.com", "news.example.org"}, "news.example.org"},
+		{"https://example.org/page", Strings{"example.com"}, "(other)"},
+		{"https://example.com.example.org", Strings{"example.com"}, "(other)"},
+		{"https://old.example.org", Strings{"news.example.org"}, "(other)"},
+		{"https://example.org/page", nil, "example.org/page"},
+
+		// Direct traffic and generated referrers.
+		{"", Strings{"example.com"}, ""},
+		{"https://mail.google.com", Strings{"example.com"}, "Email"},
+	}
+
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			site.Settings.ReferrerAllowlist = tt.allowlist
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := Hit{Path: "/", Ref: tt.in}
+			h.RefURL, _ = url.Parse(tt.in)
+			err = h.Defaults(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Ref != tt.wantRef {
+				t.Errorf("\nhave: %q\nwant: %q", h.Ref, tt.wantRef)
+			}
+			if h.Ref == OverflowRefLabel && (h.RefScheme != RefSchemeGenerated || h.RefURL != nil) {
+				t.Errorf("wrong scheme or RefURL not cleared: %#v", h)
+			}
+		})
+	}
+}
+
+func TestHitDefaultsTimeResolution(t *testing.T) {
+	tests := []struct {
+		res, in, want string
+	}{
+		{"", "2020-06-18 12:34:56", "2020-06-18 12:34:56"},
+		{TimeResolutionFull, "2020-06-18 12:34:56", "2020-06-18 12:34:56"},
+
+		{TimeResolutionMinute, "2020-06-18 12:34:56", "2020-06-18 12:34:00"},
+		{TimeResolutionMinute, "2020-06-18 12:34:00", "2020-06-18 12:34:00"},
+		{TimeResolutionMinute, "2020-06-18 23:59:59", "2020-06-18 23:59:00"},
+
+		{TimeResolutionHour, "2020-06-18 12:34:56", "2020-06-18 12:00:00"},
+		{TimeResolutionHour, "2020-06-18 12:00:00", "2020-06-18 12:00:00"},
+		{TimeResolutionHour, "2020-06-18 12:59:59", "2020-06-18 12:00:00"},
+		{TimeResolutionHour, "2020-12-31 23:59:59", "2020-12-31 23:00:00"},
+	}
+
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	for _, tt := range tests {
+		t.Run(tt.res+"/"+tt.in, func(t *testing.T) {
+			site.Settings.TimeResolution = tt.res
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := Hit{Path: "/", CreatedAt: ztime.FromString(tt.in)}
+			err = h.Defaults(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := ztime.FromString(tt.want); !h.CreatedAt.Equal(want) {
+				t.Errorf("\nhave: %s\nwant: %s", h.CreatedAt, want)
+			}
+		})
+	}
+
+	// Order is kept.
+	site.Settings.TimeResolution = TimeResolutionHour
+	var prev time.Time
+	for _, s := range []string{"2020-06-18 11:59:59", "2020-06-18 12:00:00", "2020-06-18 12:00:01", "2020-06-18 13:00:00"} {
+		r := site.Settings.RoundTime(ztime.FromString(s))
+		if r.Before(prev) {
+			t.Errorf("%s rounded to %s, before %s", s, r, prev)
+		}
+		prev = r
+	}
+}
+
 func TestHitDefaultsPath(t *testing.T) {
 	tests := []struct {
 		in       string
@@ -132,3 +381,769 @@ func TestHitDefaultsPath(t *testing.T) {
 		})
 	}
 }
+
+func TestHitDefaultsFragment(t *testing.T) {
+	tests := []struct {
+		in              string
+		strip, hashbang bool
+		wantPath        string
+	}{
+		{"/page#section", false, false, "/page#section"},
+		{"/page#section", true, false, "/page"},
+		{"/page/#section", true, false, "/page"},
+		{"/page?a=b#section", true, false, "/page?a=b"},
+		{"/#section", true, false, "/"},
+
+		{"/#!/foo", false, false, "/#!/foo"},
+		{"/#!/foo", false, true, "/foo"},
+		{"/#!/foo/", false, true, "/foo"},
+		{"/app/#!/foo", false, true, "/app/foo"},
+		{"/app#!foo", false, true, "/app/foo"},
+		{"/app/?a=b#!/foo?c=d", false, true, "/app/foo?a=b&c=d"},
+		{"/#!/", false, true, "/"},
+		{"/page#section", false, true, "/page#section"},
+
+		{"/#!/foo#section", true, true, "/foo"},
+		{"/#!/foo", true, false, "/"},
+	}
+
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%t/%t", tt.in, tt.strip, tt.hashbang), func(t *testing.T) {
+			site.Settings.StripFragment, site.Settings.HashbangPaths = tt.strip, tt.hashbang
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := Hit{Path: tt.in}
+			h.Defaults(ctx, false)
+			if h.Path != tt.wantPath {
+				t.Errorf("\nhave: %q\nwant: %q", h.Path, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestHitDefaultsHashRoutes(t *testing.T) {
+	tests := []struct {
+		in            string
+		strip, routes bool
+		wantPath      string
+	}{
+		// Anchors: counted as the same page if fragments are removed.
+		{"/page#section", false, false, "/page#section"},
+		{"/page#section", true, false, "/page"},
+		{"/page#section", false, true, "/page#section"},
+		{"/page#section", true, true, "/page"},
+
+		// Hash router: the route is kept as the path with HashRoutes.
+		{"/#/page", false, false, "/#/page"},
+		{"/#/page", true, false, "/"},
+		{"/#/page", false, true, "/page"},
+		{"/#/page", true, true, "/page"},
+		{"/app/#/page/", false, true, "/app/page"},
+		{"/app/?a=b#/page?c=d", false, true, "/app/page?a=b&c=d"},
+		{"/#/", false, true, "/"},
+
+		// Hash router with anchors in the route.
+		{"/#/page#section", false, true, "/page#section"},
+		{"/#/page#section", true, true, "/page"},
+		{"/#!/page", false, true, "/#!/page"},
+	}
+
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%t/%t", tt.in, tt.strip, tt.routes), func(t *testing.T) {
+			site.Settings.StripFragment, site.Settings.HashRoutes = tt.strip, tt.routes
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := Hit{Path: tt.in}
+			h.Defaults(ctx, false)
+			if h.Path != tt.wantPath {
+				t.Errorf("\nhave: %q\nwant: %q", h.Path, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestHitDefaultsIndexFiles(t *testing.T) {
+	tests := []struct {
+		in, wantPath string
+	}{
+		{"/index.html", "/"},
+		{"/index.php", "/"},
+		{"/", "/"},
+		{"/dir/index.html", "/dir"},
+		{"/dir/", "/dir"},
+		{"/a/b/c/index.php", "/a/b/c"},
+		{"/dir/index.html?a=b", "/dir/?a=b"},
+		{"/dir/index.html#section", "/dir/#section"},
+
+		{"/dir/default.aspx", "/dir/default.aspx"},
+		{"/dir/index.htm", "/dir/index.htm"},
+		{"/dir/myindex.html", "/dir/myindex.html"},
+		{"/index.html/page", "/index.html/page"},
+		{"/page?file=index.html", "/page?file=index.html"},
+	}
+
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+	site.Settings.IndexFiles = Strings{"index.html", "index.php"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			h := Hit{Path: tt.in}
+			h.Defaults(ctx, false)
+			if h.Path != tt.wantPath {
+				t.Errorf("\nhave: %q\nwant: %q", h.Path, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestHitDefaultsMaxNewPaths(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+
+	site := MustGetSite(ctx)
+	site.Settings.MaxNewPaths = 5
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing paths are always recorded.
+	for _, p := range []string{"/known-1", "/known-2"} {
+		h := Hit{Path: p}
+		err := h.Defaults(ctx, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths := func(from, to int) string {
+		var have string
+		for i := from; i < to; i++ {
+			h := Hit{Path: fmt.Sprintf("/random-%d", i), Title: "x"}
+			err := h.Defaults(ctx, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have += h.Path + " "
+		}
+		return have
+	}
+
+	have := paths(0, 6)
+	want := "/random-0 /random-1 /random-2 /__overflow__ /__overflow__ /__overflow__ "
+	if have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+	for _, p := range []string{"/known-1", "/random-1"} {
+		h := Hit{Path: p, PrevPath: "/random-99"}
+		err := h.Defaults(ctx, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Path != p || h.PrevPath != OverflowPath {
+			t.Errorf("%q: path %q; prev %q", p, h.Path, h.PrevPath)
+		}
+	}
+
+	// Reset the next day.
+	ztime.SetNow(t, "2020-06-19 00:00:01")
+	have = paths(10, 17)
+	want = "/random-10 /random-11 /random-12 /random-13 /random-14 /__overflow__ /__overflow__ "
+	if have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	var n int
+	err = zdb.Get(ctx, &n, `select count(*) from paths where site_id = ?`, site.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 11 {
+		t.Errorf("%d paths", n)
+	}
+}
+
+func TestHitDefaultsMaxNewEvents(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+
+	site := MustGetSite(ctx)
+	site.Settings.MaxNewEvents = 3
+	site.Settings.MaxNewPaths = 2
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hit := func(p string, event bool) Hit {
+		h := Hit{Path: p, Event: zbool.Bool(event)}
+		err := h.Defaults(ctx, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	// Established before the flood.
+	hit("known", true)
+
+	var have string
+	for i := 0; i < 100; i++ {
+		h := hit(fmt.Sprintf("random-%d", i), true)
+		if !h.Event {
+			t.Fatalf("not an event: %v", h)
+		}
+		if i < 4 {
+			have += h.Path + " "
+		}
+	}
+	want := "random-0 random-1 (other events) (other events) "
+	if have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	// Known events keep recording, and paths have their own limit.
+	if h := hit("random-1", true); h.Path != "random-1" {
+		t.Errorf("known event: %q", h.Path)
+	}
+	if h := hit("known", true); h.Path != "known" {
+		t.Errorf("known event: %q", h.Path)
+	}
+	if h := hit("/page", false); h.Path != "/page" {
+		t.Errorf("path: %q", h.Path)
+	}
+
+	// Reset the next day.
+	ztime.SetNow(t, "2020-06-19 00:00:01")
+	if h := hit("random-new", true); h.Path != "random-new" {
+		t.Errorf("next day: %q", h.Path)
+	}
+
+	var n int
+	err = zdb.Get(ctx, &n, `select count(*) from paths where site_id = ? and event = 1`, site.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("%d events", n)
+	}
+}
+
+func TestHitDefaultsMaxNewRefs(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2020-06-18 12:00:00")
+
+	ref := func(r string) Hit {
+		h := Hit{Path: "/", Ref: r}
+		h.RefURL, _ = url.Parse(r)
+		err := h.Defaults(ctx, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	// Known referrers from before the flood.
+	for _, r := range []string{"https://known-1.example.com", "https://known-2.example.com"} {
+		ref(r)
+	}
+
+	site := MustGetSite(ctx)
+	site.Settings.MaxNewRefs = 3
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := func(from, to int) string {
+		var have string
+		for i := from; i < to; i++ {
+			h := ref(fmt.Sprintf("https://spam-%d.example.com", i))
+			have += h.Ref + " "
+		}
+		return have
+	}
+
+	have := refs(0, 6)
+	want := "spam-0.example.com spam-1.example.com spam-2.example.com (other) (other) (other) "
+	if have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+	for _, r := range []string{"https://known-1.example.com", "https://spam-1.example.com"} {
+		h := ref(r)
+		if h.Ref != strings.TrimPrefix(r, "https://") || h.RefScheme != RefSchemeHTTP {
+			t.Errorf("%q: ref %q", r, h.Ref)
+		}
+	}
+	if h := ref("https://spam-99.example.com"); h.RefScheme != RefSchemeGenerated || h.RefURL != nil {
+		t.Errorf("wrong scheme or RefURL not cleared: %#v", h)
+	}
+
+	// Reset the next day.
+	ztime.SetNow(t, "2020-06-19 00:00:01")
+	have = refs(10, 15)
+	want = "spam-10.example.com spam-11.example.com spam-12.example.com (other) (other) "
+	if have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	var n int
+	err = zdb.Get(ctx, &n, `select count(*) from refs where ref != ''`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 9 { // 2 known, 6 spam, and (other)
+		t.Errorf("%d refs", n)
+	}
+}
+
+func TestHitDefaultsInternalNavigation(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	site.LinkDomain = "www.example.com"
+	site.Settings.InternalNavigation = true
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref, wantRef, wantPrev string
+	}{
+		{"https://www.example.com/app/settings", "", "/app/settings"},
+		{"https://example.com/app/?tab=x&utm_source=y", "", "/app/?tab=x"},
+		{"http://EXAMPLE.com", "", "/"},
+		{"https://example.org/app", "example.org/app", ""},
+		{"https://sub.example.com/app", "sub.example.com/app", ""},
+		{"https://news.example.net/?ref=example.com", "news.example.net", ""},
+		{"example.com/app", "example.com/app", ""}, // No scheme, so no host.
+		{"", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			h := Hit{Path: "/app/next", Ref: tt.ref}
+			h.RefURL, _ = url.Parse(tt.ref)
+			err := h.Defaults(ctx, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if h.Ref != tt.wantRef || h.PrevPath != tt.wantPrev {
+				t.Errorf("\nhave: Ref=%q PrevPath=%q\nwant: Ref=%q PrevPath=%q", h.Ref, h.PrevPath, tt.wantRef, tt.wantPrev)
+			}
+			if (tt.wantPrev != "") != (h.PrevPathID != nil) {
+				t.Errorf("PrevPathID: %v", h.PrevPathID)
+			}
+		})
+	}
+
+	t.Run("stored", func(t *testing.T) {
+		gctest.StoreHits(ctx, t, false, Hit{Path: "/app/next", Ref: "https://example.com/app/settings"})
+
+		var prev string
+		err := zdb.Get(ctx, &prev, `select path from paths join hits on hits.prev_path_id = paths.path_id`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prev != "/app/settings" {
+			t.Error(prev)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		site.Settings.InternalNavigation = false
+		ctx := WithSite(ctx, site)
+
+		h := Hit{Path: "/app/next", Ref: "https://www.example.com/app/settings"}
+		h.RefURL, _ = url.Parse(h.Ref)
+		err := h.Defaults(ctx, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Ref != "www.example.com/app/settings" || h.PrevPath != "" {
+			t.Errorf("Ref=%q PrevPath=%q", h.Ref, h.PrevPath)
+		}
+	})
+}
+
+func TestHitDefaultsCampaign(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	site.Settings.CampaignParams = Strings{"pid:source", "partner:campaign", "aff:source"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, query                     string
+		wantPath, wantRef, wantCampaign string
+	}{
+		{"/x", "", "/x", "", ""},
+		{"/x", "pid=p1", "/x", "p1", ""},
+		{"/x?pid=p1&partner=c1", "", "/x", "p1", "c1"},
+		{"/x?keep=1&pid=p1", "", "/x?keep=1", "p1", ""},
+		{"/x", "aff=a1", "/x", "a1", ""},
+		{"/x", "aff=a1&pid=p1", "/x", "p1", ""}, // In the order they were added.
+
+		// utm_* take precedence.
+		{"/x?pid=p1", "utm_source=u1", "/x", "u1", ""},
+		{"/x", "utm_source=u1&pid=p1&utm_campaign=c2&partner=c1", "/x", "u1", "c2"},
+		{"/x", "utm_source=&pid=p1", "/x", "p1", ""},
+
+		// But custom ones over the generic names.
+		{"/x", "ref=r1&pid=p1", "/x", "p1", ""},
+		{"/x", "ref=r1", "/x", "r1", ""},
+		{"/x", "campaign=c3&partner=c1", "/x", "", "c1"},
+		{"/x", "campaign=c3&utm_campaign=c2", "/x", "", "c2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path+"|"+tt.query, func(t *testing.T) {
+			h := Hit{Path: tt.path, Query: tt.query}
+			err := h.Defaults(ctx, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var campaign string
+			if h.CampaignID != nil {
+				err := zdb.Get(ctx, &campaign, `select name from campaigns where campaign_id = ?`, *h.CampaignID)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if h.Path != tt.wantPath || h.Ref != tt.wantRef || campaign != tt.wantCampaign {
+				t.Errorf("\nhave: Path=%q Ref=%q campaign=%q\nwant: Path=%q Ref=%q campaign=%q",
+					h.Path, h.Ref, campaign, tt.wantPath, tt.wantRef, tt.wantCampaign)
+			}
+		})
+	}
+
+	t.Run("validate", func(t *testing.T) {
+		ss := SiteSettings{CampaignParams: Strings{"pid:source", "x", ":source", "y:medium"}}
+		err := ss.Validate(ctx)
+		for _, want := range []string{`"x": not in the form`, `":source": not in the form`, `"y:medium": unknown field "medium"`} {
+			if !ztest.ErrorContains(err, want) {
+				t.Errorf("no %q in error: %v", want, err)
+			}
+		}
+	})
+}
+
+func TestHitDefaultsExperiment(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	site.Settings.ExperimentParams = Strings{"variant", "exp"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(site.Settings.ExperimentSecret) < 16 {
+		t.Fatalf("ExperimentSecret not set: %q", site.Settings.ExperimentSecret)
+	}
+
+	hash := func(t *testing.T, path, query string) string {
+		t.Helper()
+		h := Hit{Path: path, Query: query}
+		err := h.Defaults(ctx, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Path != "/x" {
+			t.Errorf("query not removed from path: %q", h.Path)
+		}
+		return h.ExperimentHash
+	}
+
+	a := hash(t, "/x", "variant=a&exp=signup")
+	if len(a) != 16 {
+		t.Fatalf("wrong hash: %q", a)
+	}
+
+	t.Run("same", func(t *testing.T) {
+		for _, tt := range [][]string{
+			{"/x", "?exp=signup&variant=a"},
+			{"/x", "variant=a&exp=signup&utm_source=x&other=1"},
+			{"/x?variant=a&exp=signup", ""},
+			{"/x?variant=a", "exp=signup"},
+			{"/x?variant=b", "variant=a&exp=signup"}, // Query takes precedence.
+		} {
+			if h := hash(t, tt[0], tt[1]); h != a {
+				t.Errorf("%q %q: %q; want %q", tt[0], tt[1], h, a)
+			}
+		}
+	})
+
+	t.Run("different", func(t *testing.T) {
+		seen := map[string]bool{a: true}
+		for _, q := range []string{"variant=b&exp=signup", "variant=a&exp=pricing", "variant=a", "exp=signup", "variant=signup&exp=a"} {
+			h := hash(t, "/x", q)
+			if h == "" || seen[h] {
+				t.Errorf("%q: hash %q is empty or not unique", q, h)
+			}
+			seen[h] = true
+		}
+	})
+
+	t.Run("absent", func(t *testing.T) {
+		for _, q := range []string{"", "other=1", "variant=&exp=", "variants=a"} {
+			if h := hash(t, "/x", q); h != "" {
+				t.Errorf("%q: %q; want no hash", q, h)
+			}
+		}
+	})
+
+	t.Run("secret", func(t *testing.T) {
+		site.Settings.ExperimentSecret = "a different secret"
+		err := site.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			site.Settings.ExperimentSecret = ""
+			site.Update(ctx)
+		}()
+		if h := hash(t, "/x", "variant=a&exp=signup"); h == a {
+			t.Errorf("same hash with different secret: %q", h)
+		}
+	})
+
+	t.Run("stored", func(t *testing.T) {
+		gctest.StoreHits(ctx, t, false, Hit{Path: "/x", Query: "variant=a&exp=signup", FirstVisit: true})
+
+		var have []string
+		err := zdb.Select(ctx, &have, `select experiment_hash from hits`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(have) != 1 || have[0] == "" {
+			t.Errorf("wrong hashes: %q", have)
+		}
+	})
+}
+
+func TestHitDefaultsRefSource(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	site.Settings.RefSources = Strings{"QR-poster", "flyer"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref, query, refSource         string
+		wantRef, wantScheme, wantName string
+		wantCampaign                  string
+	}{
+		{"https://example.com/page", "", "", "example.com/page", "h", "example.com", ""},
+
+		// Allowed source overrides the referrer and utm_source, but not the
+		// campaign.
+		{"https://example.com/page", "", "flyer", "flyer", "c", "flyer", ""},
+		{"", "", "qr-poster", "QR-poster", "c", "QR-poster", ""},
+		{"", "utm_source=newsletter", " flyer ", "flyer", "c", "flyer", ""},
+		{"", "utm_source=newsletter&utm_campaign=spring", "flyer", "flyer", "c", "flyer", "spring"},
+
+		// Other sources are ignored.
+		{"https://example.com/page", "", "billboard", "example.com/page", "h", "example.com", ""},
+		{"", "utm_source=newsletter", "billboard", "newsletter", "c", "", ""},
+		{"", "", "billboard", "", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref+"|"+tt.query+"|"+tt.refSource, func(t *testing.T) {
+			h := Hit{Path: "/x", Ref: tt.ref, Query: tt.query, RefSource: tt.refSource}
+			h.RefURL, _ = url.Parse(tt.ref)
+			err := h.Defaults(ctx, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var campaign string
+			if h.CampaignID != nil {
+				err := zdb.Get(ctx, &campaign, `select name from campaigns where campaign_id = ?`, *h.CampaignID)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if h.Ref != tt.wantRef || ztype.Deref(h.RefScheme, "") != tt.wantScheme || h.SourceName != tt.wantName || campaign != tt.wantCampaign {
+				t.Errorf("\nhave: Ref=%q scheme=%q name=%q campaign=%q\nwant: Ref=%q scheme=%q name=%q campaign=%q",
+					h.Ref, ztype.Deref(h.RefScheme, ""), h.SourceName, campaign,
+					tt.wantRef, tt.wantScheme, tt.wantName, tt.wantCampaign)
+			}
+		})
+	}
+}
+
+func TestParseLanguage(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{" ", ""},
+		{"*", ""},
+		{"*;q=0.5", ""},
+		{"xx", ""},
+		{"xx-YY, asdf, !!!", ""},
+		{"und, zxx, mis, qaa", ""},
+		{"x-foo", ""},
+
+		{"en-US,en;q=0.5", "eng"},
+		{"*, nl;q=0.5", "nld"},
+		{"en-US,*", "eng"},
+		{"xx, de;q=0.5", "deu"},
+		{"fr;q=0.2, xx, de;q=0.5", "deu"},
+		{"und-419", ""}, // Low confidence
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have := ParseLanguage(tt.in, language.High)
+			if tt.want == "" {
+				if have != nil {
+					t.Errorf("have %q; want nil", *have)
+				}
+				return
+			}
+			if have == nil || *have != tt.want {
+				t.Errorf("have %v; want %q", ztype.Deref(have, "<nil>"), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLanguages(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"", 5, ""},
+		{"*, xx", 5, ""},
+		{"en-US", 5, "eng"},
+		{"en-US, en-GB;q=0.9, en;q=0.8", 5, "eng"},
+		{"en-US, en-GB;q=0.9, nl;q=0.8", 5, "eng, nld"},
+		{"nl;q=0.5, en-US, en-GB;q=0.9", 5, "eng, nld"},
+		{"en-US, *, fr-CA, fr-FR, de", 5, "eng, fra, deu"},
+		{"en, fr, de, nl, es, it, pt", 5, "eng, fra, deu, nld, spa"},
+		{"en, fr, de", 2, "eng, fra"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have := ParseLanguages(tt.in, language.High, tt.max).String()
+			if have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLanguageConfidence(t *testing.T) {
+	tests := []struct {
+		in, confidence, want string
+	}{
+		{"und-419", "", ""},
+		{"und-419", "high", ""},
+		{"und-419", "low", "spa"},
+		{"und-BR", "exact", ""},
+		{"und-BR", "high", "por"},
+		{"und-BR", "low", "por"},
+		{"pt-BR", "exact", "por"},
+		{"und-419, und-BR;q=0.5", "high", "por"},
+		{"und-419, und-BR;q=0.5", "low", "spa"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in+" "+tt.confidence, func(t *testing.T) {
+			ss := SiteSettings{LanguageConfidence: tt.confidence}
+			have := ztype.Deref(ParseLanguage(tt.in, ss.MinLanguageConfidence()), "")
+			if have != tt.want {
+				t.Errorf("have %q; want %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestHitDefaultsNormalizeEscapes(t *testing.T) {
+	tests := []struct {
+		in        string
+		normalize bool
+		wantPath  string
+	}{
+		{"/caf%c3%a9", false, "/caf%c3%a9"},
+		{"/a%2fb", false, "/a%2fb"},
+
+		// Unicode
+		{"/caf%C3%A9", true, "/café"},
+		{"/caf%c3%a9", true, "/café"},
+		{"/café", true, "/café"},
+		{"/%E6%97%A5%E6%9C%AC/%F0%9F%90%90", true, "/日本/🐐"},
+		{"/caf%C3%A9?q=caf%C3%A9", true, "/café?q=café"},
+
+		// Mixed-case escapes
+		{"/a%2fb", true, "/a%2Fb"},
+		{"/a%2Fb", true, "/a%2Fb"},
+		{"/%7euser", true, "/~user"},
+		{"/%41%62c%2D%5f", true, "/Abc-_"},
+		{"/page?a=%2f", true, "/page?a=%2F"},
+
+		// Reserved characters, spaces, and control characters
+		{"/a%3fb%23c", true, "/a%3Fb%23c"},
+		{"/a%25b", true, "/a%25b"},
+		{"/a%20b%0a", true, "/a%20b%0A"},
+		{"/%26%3D%2B%3A%40", true, "/%26%3D%2B%3A%40"},
+		{"/a%C2%A0b", true, "/a%C2%A0b"},
+		{"/a%E2%80%8Bb", true, "/a%E2%80%8Bb"},
+
+		// Invalid escapes or UTF-8
+		{"/a%zz", true, "/a%zz"},
+		{"/a%4", true, "/a%4"},
+		{"/a%c3", true, "/a%C3"},
+		{"/a%c3%28", true, "/a%C3%28"},
+		{"/a%ff%fe", true, "/a%FF%FE"},
+	}
+
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%t", tt.in, tt.normalize), func(t *testing.T) {
+			site.Settings.NormalizeEscapes = tt.normalize
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := Hit{Path: tt.in}
+			h.Defaults(ctx, false)
+			if h.Path != tt.wantPath {
+				t.Errorf("\nhave: %q\nwant: %q", h.Path, tt.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"zgo.at/zstd/zint"
+)
+
+// Parameters for HLL: 2^10 registers use 1K of memory and have a standard
+// error of 1.04/√1024.
+const (
+	hllPrecision = 10
+	hllRegisters = 1 << hllPrecision
+)
+
+// HLLError is the standard error of HLL.Estimate(), as a fraction. About 95%
+// of estimates are within twice this of the real value.
+const HLLError = 1.04 / 32 // 1.04/√hllRegisters
+
+// HLL is a HyperLogLog estimator for the number of distinct values that were
+// added, without storing the values.
+//
+// The zero value is an empty estimator. Estimators can be merged, so the
+// estimate for a range of days is the merge of the estimators for every day.
+type HLL struct {
+	reg []uint8
+}
+
+// Add a value, which should be an evenly distributed hash.
+func (h *HLL) Add(x uint64) {
+	if h.reg == nil {
+		h.reg = make([]uint8, hllRegisters)
+	}
+	var (
+		i = x >> (64 - hllPrecision)
+		// The guard bit limits the rank to 64-hllPrecision+1.
+		r = uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	)
+	h.reg[i] = max(h.reg[i], r)
+}
+
+// AddSession adds a session ID. These are usually random UUIDs, but are mixed
+// anyway to be sure (they're sequential in tests).
+func (h *HLL) AddSession(s zint.Uint128) {
+	h.Add(fmix64(s[0] ^ fmix64(s[1])))
+}
+
+// Merge the values from o in to this estimator.
+func (h *HLL) Merge(o HLL) {
+	if o.reg == nil {
+		return
+	}
+	if h.reg == nil {
+		h.reg = make([]uint8, hllRegisters)
+	}
+	for i, r := range o.reg {
+		h.reg[i] = max(h.reg[i], r)
+	}
+}
+
+// Estimate gets the estimated number of distinct values; see HLLError for the
+// error.
+func (h HLL) Estimate() int {
+	if h.reg == nil {
+		return 0
+	}
+	var (
+		sum   float64
+		zeros int
+		m     = float64(hllRegisters)
+	)
+	for _, r := range h.reg {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 { // Linear counting is more accurate for small values.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(e))
+}
+
+// Formats for HLL.MarshalBinary().
+const (
+	hllDense  = 'd' // Every register as a byte.
+	hllSparse = 's' // Pairs of the register index as an uint16 and the value.
+)
+
+// MarshalBinary encodes the registers, as a list of registers that are set if
+// there are few of them (which is usually the case for small sites).
+func (h HLL) MarshalBinary() ([]byte, error) {
+	var set int
+	for _, r := range h.reg {
+		if r > 0 {
+			set++
+		}
+	}
+	if set*3 >= hllRegisters {
+		return append([]byte{hllDense}, h.reg...), nil
+	}
+
+	b := make([]byte, 1, 1+set*3)
+	b[0] = hllSparse
+	for i, r := range h.reg {
+		if r > 0 {
+			b = binary.BigEndian.AppendUint16(b, uint16(i))
+			b = append(b, r)
+		}
+	}
+	return b, nil
+}
+
+func (h *HLL) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 {
+		*h = HLL{}
+		return nil
+	}
+	reg := make([]uint8, hllRegisters)
+	switch b[0] {
+	case hllDense:
+		if len(b) != 1+hllRegisters {
+			return fmt.Errorf("HLL.UnmarshalBinary: wrong length %d", len(b))
+		}
+		copy(reg, b[1:])
+	case hllSparse:
+		if (len(b)-1)%3 != 0 {
+			return fmt.Errorf("HLL.UnmarshalBinary: wrong length %d", len(b))
+		}
+		for s := b[1:]; len(s) > 0; s = s[3:] {
+			i := binary.BigEndian.Uint16(s)
+			if i >= hllRegisters {
+				return fmt.Errorf("HLL.UnmarshalBinary: register %d out of range", i)
+			}
+			reg[i] = s[2]
+		}
+	default:
+		return fmt.Errorf("HLL.UnmarshalBinary: unknown format %q", b[0])
+	}
+	h.reg = reg
+	return nil
+}
+
+func (h HLL) Value() (driver.Value, error) { return h.MarshalBinary() }
+
+func (h *HLL) Scan(v any) error {
+	switch vv := v.(type) {
+	case []byte:
+		return h.UnmarshalBinary(vv)
+	case string:
+		return h.UnmarshalBinary([]byte(vv))
+	case nil:
+		*h = HLL{}
+		return nil
+	default:
+		return fmt.Errorf("HLL.Scan: unsupported type %T", v)
+	}
+}
+
+// fmix64 is the finalizer from MurmurHash3, which makes every bit of the output
+// depend on every bit of the input.
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
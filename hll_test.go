@@ -0,0 +1,73 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"zgo.at/zstd/zint"
+)
+
+func TestHLL(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 100, 1_000, 10_000, 100_000} {
+		t.Run(fmt.Sprintf("%d", n), func(t *testing.T) {
+			var h HLL
+			for i := 0; i < n; i++ {
+				h.AddSession(zint.Uint128{1, uint64(i)})
+				h.AddSession(zint.Uint128{1, uint64(i)}) // Duplicates aren't counted.
+			}
+
+			// Should be within 2 standard errors for ~95% of inputs; the
+			// inputs are fixed so use 3 to have some margin.
+			have, margin := h.Estimate(), math.Ceil(3*HLLError*float64(n))
+			if math.Abs(float64(have-n)) > margin {
+				t.Errorf("estimate %d for %d is off by more than %.0f", have, n, margin)
+			}
+
+			b, err := h.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var h2 HLL
+			err = h2.UnmarshalBinary(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e := h2.Estimate(); e != have {
+				t.Errorf("estimate after UnmarshalBinary (format %q): %d; want %d", b[0], e, have)
+			}
+		})
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		var a, b, all HLL
+		for i := 0; i < 5_000; i++ {
+			s := zint.Uint128{2, uint64(i)}
+			all.AddSession(s)
+			if i < 3_000 {
+				a.AddSession(s)
+			}
+			if i >= 2_000 {
+				b.AddSession(s)
+			}
+		}
+		a.Merge(b)
+		a.Merge(HLL{})
+		if h, w := a.Estimate(), all.Estimate(); h != w {
+			t.Errorf("merged estimate %d; want %d", h, w)
+		}
+	})
+
+	t.Run("unmarshal errors", func(t *testing.T) {
+		for _, b := range [][]byte{[]byte("d\x01"), []byte("s\x00\x01"), []byte("s\xff\xff\x01"), []byte("x")} {
+			var h HLL
+			if err := h.UnmarshalBinary(b); err == nil {
+				t.Errorf("no error for %q", b)
+			}
+		}
+	})
+}
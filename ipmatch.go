@@ -0,0 +1,101 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// ipMatcher matches IP addresses against a list of addresses and CIDR ranges.
+//
+// Exact addresses are in a map, and ranges are stored sorted without overlap so
+// they can be found with a binary search.
+type ipMatcher struct {
+	exact  map[netip.Addr]string
+	ranges []ipRange
+}
+
+type ipRange struct {
+	prefix netip.Prefix
+	entry  string // Original entry, for messages.
+}
+
+// newIPMatcher creates a new matcher; invalid entries are skipped (these are
+// rejected by SiteSettings.Validate()).
+func newIPMatcher(list []string) *ipMatcher {
+	m := &ipMatcher{exact: make(map[netip.Addr]string, len(list))}
+	for _, e := range list {
+		if strings.ContainsRune(e, '/') {
+			p, err := netip.ParsePrefix(e)
+			if err != nil {
+				continue
+			}
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()).Masked()
+			m.ranges = append(m.ranges, ipRange{prefix: p, entry: e})
+			continue
+		}
+
+		a, err := netip.ParseAddr(e)
+		if err != nil {
+			continue
+		}
+		m.exact[a.Unmap()] = e
+	}
+
+	if len(m.ranges) == 0 {
+		return m
+	}
+
+	// Sort by start address, with the larger range first if they start at the
+	// same address. CIDR ranges either nest or don't overlap at all, so after
+	// this we only need to drop ranges that are contained in the previous one.
+	sort.Slice(m.ranges, func(i, j int) bool {
+		a, b := m.ranges[i].prefix, m.ranges[j].prefix
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c < 0
+		}
+		return a.Bits() < b.Bits()
+	})
+	merged := m.ranges[:1]
+	for _, r := range m.ranges[1:] {
+		last := merged[len(merged)-1].prefix
+		if last.Addr().BitLen() == r.prefix.Addr().BitLen() && last.Contains(r.prefix.Addr()) {
+			continue
+		}
+		merged = append(merged, r)
+	}
+	m.ranges = merged
+	return m
+}
+
+// match reports if ip is in the list, and returns the entry that matched.
+//
+// The ip may have a port, as in net/http.Request.RemoteAddr.
+func (m *ipMatcher) match(ip string) (string, bool) {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		ap, err := netip.ParseAddrPort(ip)
+		if err != nil {
+			return "", false
+		}
+		a = ap.Addr()
+	}
+	a = a.Unmap()
+
+	if e, ok := m.exact[a]; ok {
+		return e, true
+	}
+
+	// Find the last range starting at or before the address.
+	i := sort.Search(len(m.ranges), func(i int) bool {
+		return m.ranges[i].prefix.Addr().Compare(a) > 0
+	})
+	if i > 0 && m.ranges[i-1].prefix.Contains(a) {
+		return m.ranges[i-1].entry, true
+	}
+	return "", false
+}
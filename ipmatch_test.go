@@ -0,0 +1,153 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztest"
+)
+
+func TestIgnoredIP(t *testing.T) {
+	ss := SiteSettings{IgnoreIPs: []string{
+		"1.2.3.4", "2a01::1",
+		"10.0.0.0/8", "10.1.0.0/16", // Nested
+		"192.168.1.7/24", // Host bits set
+		"2001:db8::/32",
+		"not an IP", "1.1.1.1/99", // Invalid entries are skipped.
+	}}
+
+	tests := []struct {
+		ip, want string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{"1.2.3.4:8080", "1.2.3.4"},
+		{"::ffff:1.2.3.4", "1.2.3.4"},
+		{"1.2.3.5", ""},
+		{"2a01::1", "2a01::1"},
+		{"[2a01::1]:443", "2a01::1"},
+		{"2a01::2", ""},
+
+		{"10.0.0.1", "10.0.0.0/8"},
+		{"10.1.2.3", "10.0.0.0/8"},
+		{"10.255.255.255", "10.0.0.0/8"},
+		{"11.0.0.0", ""},
+		{"9.255.255.255", ""},
+		{"192.168.1.200", "192.168.1.7/24"},
+		{"192.168.2.1", ""},
+		{"2001:db8:ffff::1", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+
+		{"", ""},
+		{"not an IP", ""},
+	}
+
+	for _, loaded := range []bool{false, true} {
+		ss := ss
+		if loaded {
+			ss.Defaults(gctest.Context(nil))
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%t/%s", loaded, tt.ip), func(t *testing.T) {
+				have, ok := ss.IgnoredIP(tt.ip)
+				if have != tt.want || ok != (tt.want != "") {
+					t.Errorf("have %q %t; want %q", have, ok, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestIgnoredIPReload(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	load := func() Site {
+		t.Helper()
+		var s Site
+		err := s.ByID(ctx, site.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	site.Settings.IgnoreIPs = []string{"1.2.3.4", "10.0.0.0/8"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := load()
+	if _, ok := s.Settings.IgnoredIP("10.1.1.1"); !ok {
+		t.Error("10.1.1.1 not ignored")
+	}
+
+	site.Settings.IgnoreIPs = []string{"5.6.7.8"}
+	err = site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = load()
+	if _, ok := s.Settings.IgnoredIP("10.1.1.1"); ok {
+		t.Error("10.1.1.1 still ignored after reload")
+	}
+	if _, ok := s.Settings.IgnoredIP("5.6.7.8"); !ok {
+		t.Error("5.6.7.8 not ignored after reload")
+	}
+}
+
+func TestIgnoredIPValidate(t *testing.T) {
+	ctx := gctest.DB(t)
+	Config(ctx).MaxIgnoreIPs = 2
+
+	ss := SiteSettings{IgnoreIPs: []string{"1.2.3.4", "10.0.0.0/8"}}
+	ss.Defaults(ctx)
+	if err := ss.Validate(ctx); err != nil {
+		t.Error(err)
+	}
+
+	ss.IgnoreIPs = append(ss.IgnoreIPs, "5.6.7.8")
+	err := ss.Validate(ctx)
+	if !ztest.ErrorContains(err, "can have at most 2 entries") {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	ss.IgnoreIPs = []string{"10.0.0.0/33"}
+	err = ss.Validate(ctx)
+	if !ztest.ErrorContains(err, `invalid CIDR range: "10.0.0.0/33"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func BenchmarkIgnoredIP(b *testing.B) {
+	list := make([]string, 0, 500)
+	for i := 0; i < 400; i++ {
+		list = append(list, fmt.Sprintf("10.%d.%d.%d", i/250, i%250, i%7))
+	}
+	for i := 0; i < 100; i++ {
+		list = append(list, fmt.Sprintf("172.%d.0.0/16", i))
+	}
+	const ip = "192.168.1.1" // Worst case: not in the list.
+
+	b.Run("linear", func(b *testing.B) { // The previous implementation.
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_ = slices.Contains(list, ip)
+		}
+	})
+	b.Run("matcher", func(b *testing.B) {
+		ss := SiteSettings{IgnoreIPs: list}
+		ss.Defaults(gctest.Context(nil))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			_, _ = ss.IgnoredIP(ip)
+		}
+	})
+}
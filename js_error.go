@@ -0,0 +1,163 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Maximum lengths for JSError fields, in bytes; longer values are truncated.
+const (
+	MaxJSErrorMessage = 1024
+	MaxJSErrorSource  = 512
+)
+
+// JSError is a JavaScript error sent to /count/error, usually from
+// window.onerror.
+type JSError struct {
+	ID        int64     `db:"js_error_id" json:"-"`
+	Site      int64     `db:"site_id" json:"-"`
+	Path      string    `db:"path" json:"p"`
+	Message   string    `db:"message" json:"message"`
+	Source    string    `db:"source" json:"source"`
+	Line      int       `db:"line" json:"line"`
+	Col       int       `db:"col" json:"col"`
+	BrowserID int64     `db:"browser_id" json:"-"`
+	SystemID  int64     `db:"system_id" json:"-"`
+	CreatedAt time.Time `db:"created_at" json:"-"`
+
+	UserAgentHeader string `db:"-" json:"-"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+//
+// Control characters are removed from the message, source, and path, and
+// they're truncated if they're too long.
+func (e *JSError) Defaults(ctx context.Context) error {
+	if e.Site == 0 {
+		e.Site = MustGetSite(ctx).ID
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = ztime.Now()
+	}
+	e.Message = sanitizeJSError(e.Message, MaxJSErrorMessage)
+	e.Source = sanitizeJSError(e.Source, MaxJSErrorSource)
+	e.Path = sanitizeJSError(e.Path, MaxPathLen)
+	e.Line, e.Col = max(e.Line, 0), max(e.Col, 0)
+
+	if e.BrowserID == 0 && e.SystemID == 0 && MustGetSite(ctx).Settings.Collect.Has(CollectUserAgent) {
+		ua := UserAgent{UserAgent: e.UserAgentHeader}
+		err := ua.GetOrInsert(ctx)
+		if err != nil {
+			return errors.Wrap(err, "JSError.Defaults")
+		}
+		e.BrowserID, e.SystemID = ua.BrowserID, ua.SystemID
+	}
+	return nil
+}
+
+// Validate the object.
+func (e *JSError) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", e.Site)
+	v.Required("message", e.Message)
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+func (e *JSError) Insert(ctx context.Context) error {
+	if e.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	err := e.Defaults(ctx)
+	if err != nil {
+		return err
+	}
+	err = e.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	e.ID, err = zdb.InsertID(ctx, "js_error_id",
+		`insert into js_errors (site_id, path, message, source, line, col, browser_id, system_id, created_at) values (?)`,
+		zdb.L{e.Site, e.Path, e.Message, e.Source, e.Line, e.Col, e.BrowserID, e.SystemID, e.CreatedAt})
+	return errors.Wrap(err, "JSError.Insert")
+}
+
+// ListJSErrors lists the most common JavaScript errors in the given time
+// period; the name is the message with the source and position.
+func (h *HitStats) ListJSErrors(ctx context.Context, rng ztime.Range, limit, offset int) (int, error) {
+	var (
+		site = MustGetSite(ctx)
+		st   []struct {
+			Message string `db:"message"`
+			Source  string `db:"source"`
+			Line    int    `db:"line"`
+			Col     int    `db:"col"`
+			Count   int    `db:"count"`
+		}
+		total int
+	)
+	err := zdb.Select(ctx, &st, `/* HitStats.ListJSErrors */
+		select message, source, line, col, count(*) as count
+		from js_errors
+		where site_id = :site and created_at >= :start and created_at <= :end
+		group by message, source, line, col
+		order by count desc, message, source, line, col
+		limit :limit offset :offset`,
+		zdb.P{"site": site.ID, "start": rng.Start, "end": rng.End, "limit": limit + 1, "offset": offset})
+	if err != nil {
+		return 0, errors.Wrap(err, "HitStats.ListJSErrors")
+	}
+	err = zdb.Get(ctx, &total, `select count(*) from js_errors where site_id = :site and created_at >= :start and created_at <= :end`,
+		zdb.P{"site": site.ID, "start": rng.Start, "end": rng.End})
+	if err != nil {
+		return 0, errors.Wrap(err, "HitStats.ListJSErrors")
+	}
+
+	if len(st) > limit {
+		h.More = true
+		st = st[:len(st)-1]
+	}
+	h.Stats = make([]HitStat, 0, len(st))
+	for _, s := range st {
+		name := s.Message
+		if s.Source != "" {
+			name += fmt.Sprintf(" (%s:%d:%d)", s.Source, s.Line, s.Col)
+		}
+		h.Stats = append(h.Stats, HitStat{Name: name, Count: s.Count})
+	}
+	return total, nil
+}
+
+func sanitizeJSError(s string, n int) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(s, ""))
+	s = strings.TrimSpace(s)
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
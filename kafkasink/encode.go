@@ -0,0 +1,149 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package kafkasink
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"slices"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+)
+
+// record is the message published for every pageview.
+type record struct {
+	SiteID     int64     `json:"site_id"`
+	Path       string    `json:"path"`
+	Event      bool      `json:"event"`
+	Bot        int       `json:"bot"`
+	FirstVisit bool      `json:"first_visit"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// nil if omitted or not collected.
+	Title     *string   `json:"title,omitempty"`
+	Ref       *string   `json:"ref,omitempty"`
+	Query     *string   `json:"query,omitempty"`
+	Session   *string   `json:"session,omitempty"`
+	Location  *string   `json:"location,omitempty"`
+	Language  *string   `json:"language,omitempty"`
+	UserAgent *string   `json:"user_agent,omitempty"`
+	Size      []float64 `json:"size,omitempty"`
+}
+
+func newRecord(h goatcounter.Hit, omit []string) record {
+	str := func(field, s string) *string {
+		if s == "" || slices.Contains(omit, field) {
+			return nil
+		}
+		return &s
+	}
+
+	r := record{
+		SiteID:     h.Site,
+		Path:       h.Path,
+		Event:      bool(h.Event),
+		Bot:        h.Bot,
+		FirstVisit: bool(h.FirstVisit),
+		CreatedAt:  h.CreatedAt.UTC(),
+		Title:      str("title", h.Title),
+		Ref:        str("ref", h.Ref),
+		Query:      str("query", h.Query),
+		Location:   str("location", h.Location),
+		UserAgent:  str("user_agent", h.UserAgentHeader),
+	}
+	if !h.Session.IsZero() {
+		r.Session = str("session", h.Session.String())
+	}
+	if h.Language != nil {
+		r.Language = str("language", *h.Language)
+	}
+	if len(h.Size) > 0 && !slices.Contains(omit, "size") {
+		r.Size = h.Size
+	}
+	return r
+}
+
+func encodeJSON(r record) ([]byte, error) { return json.Marshal(r) }
+
+// AvroSchema is the schema for messages with format=avro.
+const AvroSchema = `{
+	"type":      "record",
+	"name":      "Hit",
+	"namespace": "com.goatcounter",
+	"fields": [
+		{"name": "site_id",     "type": "long"},
+		{"name": "path",        "type": "string"},
+		{"name": "event",       "type": "boolean"},
+		{"name": "bot",         "type": "int"},
+		{"name": "first_visit", "type": "boolean"},
+		{"name": "created_at",  "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "title",       "type": ["null", "string"], "default": null},
+		{"name": "ref",         "type": ["null", "string"], "default": null},
+		{"name": "query",       "type": ["null", "string"], "default": null},
+		{"name": "session",     "type": ["null", "string"], "default": null},
+		{"name": "location",    "type": ["null", "string"], "default": null},
+		{"name": "language",    "type": ["null", "string"], "default": null},
+		{"name": "user_agent",  "type": ["null", "string"], "default": null},
+		{"name": "size",        "type": ["null", {"type": "array", "items": "double"}], "default": null}
+	]
+}`
+
+// encodeAvro encodes the record with the Avro binary encoding for AvroSchema.
+//
+// If schemaID isn't 0 it's prefixed with the Confluent wire format header: a 0
+// byte followed by the schema ID as a 4-byte big-endian integer.
+func encodeAvro(r record, schemaID int) []byte {
+	b := make([]byte, 0, 128)
+	if schemaID != 0 {
+		b = append(b, 0)
+		b = binary.BigEndian.AppendUint32(b, uint32(schemaID))
+	}
+
+	// Avro int and long use the zig-zag varint encoding, which is the same as
+	// binary.AppendVarint().
+	str := func(s string) {
+		b = binary.AppendVarint(b, int64(len(s)))
+		b = append(b, s...)
+	}
+	boolean := func(v bool) {
+		if v {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	}
+	nullStr := func(s *string) {
+		if s == nil {
+			b = binary.AppendVarint(b, 0)
+			return
+		}
+		b = binary.AppendVarint(b, 1)
+		str(*s)
+	}
+
+	b = binary.AppendVarint(b, r.SiteID)
+	str(r.Path)
+	boolean(r.Event)
+	b = binary.AppendVarint(b, int64(r.Bot))
+	boolean(r.FirstVisit)
+	b = binary.AppendVarint(b, r.CreatedAt.UnixMilli())
+	for _, s := range []*string{r.Title, r.Ref, r.Query, r.Session, r.Location, r.Language, r.UserAgent} {
+		nullStr(s)
+	}
+	if r.Size == nil {
+		b = binary.AppendVarint(b, 0)
+	} else {
+		// Arrays are encoded as blocks of items, ending with an empty block.
+		b = binary.AppendVarint(b, 1)
+		b = binary.AppendVarint(b, int64(len(r.Size)))
+		for _, f := range r.Size {
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+		}
+		b = binary.AppendVarint(b, 0)
+	}
+	return b
+}
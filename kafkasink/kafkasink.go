@@ -0,0 +1,304 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+// Package kafkasink publishes pageviews to a Kafka topic.
+//
+// It registers the "kafka" HitSink, which can be used with:
+//
+//	goatcounter serve -hit-sink 'kafka:brokers=localhost:9092&topic=goatcounter'
+//
+// The options are:
+//
+//	brokers   Comma-separated list of brokers. Required.
+//	topic     Topic to publish to. Required.
+//	format    "json" (default) or "avro"; see AvroSchema for the Avro schema.
+//	schema_id Prefix Avro messages with this schema ID in the Confluent wire
+//	          format, for use with a schema registry.
+//	omit      Comma-separated list of fields to leave out (e.g. "session,location").
+//	          Can be any field except site_id, path, event, bot, first_visit, and
+//	          created_at.
+//	db        Also store pageviews in the hits table if "true".
+//	backlog   Maximum number of pageviews to keep if the brokers can't be
+//	          reached; the oldest are dropped after this. Default: 100000.
+//	batch     Maximum number of pageviews per request. Default: 1000.
+//
+// Messages are published in the background, and failures are retried until
+// they succeed or are dropped from the backlog; this never blocks recording
+// pageviews.
+package kafkasink
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zlog"
+)
+
+func init() {
+	goatcounter.RegisterHitSink("kafka", Open)
+}
+
+// producer writes messages to Kafka; this is a *kafka.Writer outside of tests.
+type producer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type config struct {
+	format     string
+	schemaID   int
+	omit       []string
+	backlog    int
+	batch      int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// Fields that can be omitted.
+var omittable = []string{"title", "ref", "query", "session", "location", "language", "user_agent", "size"}
+
+// Open the sink; connect is the options in the URL query string format.
+func Open(connect string) (goatcounter.HitSink, error) {
+	opts, err := url.ParseQuery(connect)
+	if err != nil {
+		return nil, errors.Wrap(err, "kafkasink.Open")
+	}
+
+	c := config{format: "json", backlog: 100_000, batch: 1000, backoff: time.Second, maxBackoff: time.Minute}
+	var brokers []string
+	var topic string
+	var db bool
+	for k := range opts {
+		v := opts.Get(k)
+		switch k {
+		case "brokers":
+			brokers = strings.Split(v, ",")
+		case "topic":
+			topic = v
+		case "format":
+			c.format = v
+		case "schema_id":
+			c.schemaID, err = strconv.Atoi(v)
+		case "omit":
+			c.omit = strings.Split(v, ",")
+		case "db":
+			db, err = strconv.ParseBool(v)
+		case "backlog":
+			c.backlog, err = strconv.Atoi(v)
+		case "batch":
+			c.batch, err = strconv.Atoi(v)
+		default:
+			return nil, errors.Errorf("kafkasink.Open: unknown option %q", k)
+		}
+		if err != nil {
+			return nil, errors.Errorf("kafkasink.Open: invalid value for %q: %q", k, v)
+		}
+	}
+	if len(brokers) == 0 || brokers[0] == "" {
+		return nil, errors.New("kafkasink.Open: brokers is required")
+	}
+	if topic == "" {
+		return nil, errors.New("kafkasink.Open: topic is required")
+	}
+
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{}, // Key is the site ID.
+		BatchSize:    c.batch,
+		BatchTimeout: 10 * time.Millisecond,
+		MaxAttempts:  1, // We retry ourselves.
+		RequiredAcks: kafka.RequireAll,
+	}
+	s, err := newSink(w, c)
+	if err != nil {
+		return nil, err
+	}
+	if db {
+		s.db, err = goatcounter.NewHitSink("sql")
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+type sink struct {
+	w      producer
+	db     goatcounter.HitSink // Also store in the database if set.
+	c      config
+	encode func(record) ([]byte, error)
+
+	mu       sync.Mutex
+	pending  []kafka.Message // Appended, but not yet flushed.
+	backlog  []kafka.Message // Flushed, but not yet published.
+	inflight int             // Number of messages at the start of backlog being published.
+	dropped  int
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSink(w producer, c config) (*sink, error) {
+	s := &sink{w: w, c: c, wake: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+	switch c.format {
+	case "json":
+		s.encode = encodeJSON
+	case "avro":
+		s.encode = func(r record) ([]byte, error) { return encodeAvro(r, c.schemaID), nil }
+	default:
+		return nil, errors.Errorf("kafkasink.Open: unknown format %q; must be \"json\" or \"avro\"", c.format)
+	}
+	for _, f := range c.omit {
+		if !slices.Contains(omittable, f) {
+			return nil, errors.Errorf("kafkasink.Open: can't omit %q; must be one of %s",
+				f, strings.Join(omittable, ", "))
+		}
+	}
+	if c.backlog < 1 || c.batch < 1 {
+		return nil, errors.New("kafkasink.Open: backlog and batch must be 1 or greater")
+	}
+
+	go s.run()
+	return s, nil
+}
+
+func (s *sink) Append(ctx context.Context, hits []goatcounter.Hit) error {
+	msgs := make([]kafka.Message, 0, len(hits))
+	for _, h := range hits {
+		v, err := s.encode(newRecord(h, s.c.omit))
+		if err != nil {
+			return errors.Wrap(err, "kafkasink.Append")
+		}
+		msgs = append(msgs, kafka.Message{
+			Key:   []byte(strconv.FormatInt(h.Site, 10)),
+			Value: v,
+			Time:  h.CreatedAt,
+		})
+	}
+
+	s.mu.Lock()
+	s.pending = append(s.pending, msgs...)
+	s.mu.Unlock()
+
+	if s.db != nil {
+		return s.db.Append(ctx, hits)
+	}
+	return nil
+}
+
+// Flush adds the pending messages to the backlog and signals the publisher;
+// it doesn't wait for them to be published.
+func (s *sink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	s.backlog = append(s.backlog, s.pending...)
+	s.pending = nil
+	if over := len(s.backlog) - s.c.backlog; over > 0 {
+		// Drop the oldest messages, except those being published right now.
+		n := min(over, len(s.backlog)-s.inflight)
+		s.backlog = append(s.backlog[:s.inflight], s.backlog[s.inflight+n:]...)
+		s.dropped += n
+		zlog.Module("kafka").Errorf("backlog full: dropped %d pageviews (%d in total)", n, s.dropped)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	if s.db != nil {
+		return s.db.Flush(ctx)
+	}
+	return nil
+}
+
+// Close stops the publisher and makes a last attempt to publish the backlog.
+func (s *sink) Close() error {
+	close(s.stop)
+	<-s.done
+
+	errs := errors.NewGroup(3)
+	err := s.publish()
+	if err != nil {
+		s.mu.Lock()
+		errs.Append(errors.Errorf("kafkasink.Close: %d pageviews not published: %w", len(s.backlog), err))
+		s.mu.Unlock()
+	}
+	errs.Append(s.w.Close())
+	if s.db != nil {
+		errs.Append(s.db.Close())
+	}
+	return errs.ErrorOrNil()
+}
+
+// run the publisher until the sink is closed, retrying with an exponential
+// backoff on errors.
+func (s *sink) run() {
+	defer close(s.done)
+	var (
+		retry   <-chan time.Time
+		backoff time.Duration
+	)
+	for {
+		wake := s.wake
+		if retry != nil { // Don't retry early on the next flush.
+			wake = nil
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-wake:
+		case <-retry:
+		}
+
+		retry = nil
+		err := s.publish()
+		if err != nil {
+			backoff = min(max(backoff*2, s.c.backoff), s.c.maxBackoff)
+			zlog.Module("kafka").Field("retry", backoff.String()).Error(err)
+			retry = time.After(backoff)
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// publish the backlog in batches, stopping at the first error.
+func (s *sink) publish() error {
+	for {
+		s.mu.Lock()
+		n := min(len(s.backlog), s.c.batch)
+		batch := s.backlog[:n]
+		s.inflight = n
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := s.w.WriteMessages(ctx, batch...)
+		cancel()
+
+		s.mu.Lock()
+		s.inflight = 0
+		if err == nil {
+			s.backlog = s.backlog[n:]
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return errors.Wrapf(err, "kafkasink: publishing %d pageviews", n)
+		}
+	}
+}
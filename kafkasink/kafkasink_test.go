@@ -0,0 +1,258 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package kafkasink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztest"
+)
+
+// fakeProducer records the batches instead of sending them to a broker.
+type fakeProducer struct {
+	mu       sync.Mutex
+	fail     int // Fail this many writes.
+	attempts int
+	batches  [][]kafka.Message
+	closed   bool
+}
+
+func (p *fakeProducer) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts++
+	if p.fail > 0 {
+		p.fail--
+		return errors.New("broker not available")
+	}
+	p.batches = append(p.batches, append([]kafka.Message(nil), msgs...))
+	return nil
+}
+
+func (p *fakeProducer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+// wait until f returns true.
+func (p *fakeProducer) wait(t *testing.T, f func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		p.mu.Lock()
+		ok := f()
+		p.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
+
+func testSink(t *testing.T, p *fakeProducer, c config) *sink {
+	t.Helper()
+	if c.format == "" {
+		c.format = "json"
+	}
+	if c.backlog == 0 {
+		c.backlog = 100
+	}
+	if c.batch == 0 {
+		c.batch = 100
+	}
+	c.backoff, c.maxBackoff = time.Millisecond, 5*time.Millisecond
+	s, err := newSink(p, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func hits(n int) []goatcounter.Hit {
+	hits := make([]goatcounter.Hit, 0, n)
+	for i := 0; i < n; i++ {
+		hits = append(hits, goatcounter.Hit{
+			Site:      int64(i%2 + 1),
+			Path:      fmt.Sprintf("/%d", i),
+			Location:  "NZ",
+			Session:   zint.Uint128{1, 2},
+			CreatedAt: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC),
+		})
+	}
+	return hits
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		connect, wantErr string
+	}{
+		{"topic=x", "brokers is required"},
+		{"brokers=localhost:9092", "topic is required"},
+		{"brokers=localhost:9092&topic=x&format=xml", `unknown format "xml"`},
+		{"brokers=localhost:9092&topic=x&omit=path", `can't omit "path"`},
+		{"brokers=localhost:9092&topic=x&batch=x", `invalid value for "batch"`},
+		{"brokers=localhost:9092&topic=x&backlog=0", "must be 1 or greater"},
+		{"brokers=localhost:9092&topic=x&asd=1", `unknown option "asd"`},
+		{"brokers=localhost:9092,localhost:9093&topic=x&format=avro&omit=session,location", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.connect, func(t *testing.T) {
+			s, err := Open(tt.connect)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if s != nil {
+				s.Close()
+			}
+		})
+	}
+}
+
+func TestSink(t *testing.T) {
+	p := &fakeProducer{}
+	s := testSink(t, p, config{batch: 2, omit: []string{"location"}})
+
+	ctx := context.Background()
+	if err := s.Append(ctx, hits(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing should be published until Flush.
+	time.Sleep(10 * time.Millisecond)
+	p.mu.Lock()
+	if p.attempts != 0 {
+		t.Fatalf("published before Flush: %d", p.attempts)
+	}
+	p.mu.Unlock()
+
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	p.wait(t, func() bool { return len(p.batches) == 2 })
+
+	if len(p.batches[0]) != 2 || len(p.batches[1]) != 1 {
+		t.Fatalf("wrong batch sizes: %d and %d", len(p.batches[0]), len(p.batches[1]))
+	}
+	m := p.batches[1][0]
+	if string(m.Key) != "1" {
+		t.Errorf("key: %q", m.Key)
+	}
+	var r map[string]any
+	if err := json.Unmarshal(m.Value, &r); err != nil {
+		t.Fatal(err)
+	}
+	have := fmt.Sprintf("%v", r)
+	want := "map[bot:0 created_at:2023-06-01T12:00:00Z event:false first_visit:false path:/2 session:1-2 site_id:1]"
+	if have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.closed {
+		t.Error("producer not closed")
+	}
+}
+
+func TestSinkRetry(t *testing.T) {
+	p := &fakeProducer{fail: 3}
+	s := testSink(t, p, config{})
+	defer s.Close()
+
+	ctx := context.Background()
+	s.Append(ctx, hits(5))
+	s.Flush(ctx)
+	p.wait(t, func() bool { return len(p.batches) == 1 })
+
+	if p.attempts != 4 {
+		t.Errorf("attempts: %d", p.attempts)
+	}
+	if len(p.batches[0]) != 5 {
+		t.Errorf("batch size: %d", len(p.batches[0]))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.backlog) != 0 {
+		t.Errorf("backlog not empty: %d", len(s.backlog))
+	}
+}
+
+func TestSinkBacklog(t *testing.T) {
+	p := &fakeProducer{fail: 1_000_000}
+	s := testSink(t, p, config{backlog: 3})
+
+	ctx := context.Background()
+	s.Append(ctx, hits(5))
+	s.Flush(ctx)
+
+	s.mu.Lock()
+	if s.dropped != 2 {
+		t.Errorf("dropped: %d", s.dropped)
+	}
+	if len(s.backlog) != 3 {
+		t.Errorf("backlog: %d", len(s.backlog))
+	}
+	s.mu.Unlock()
+
+	err := s.Close()
+	if !ztest.ErrorContains(err, "3 pageviews not published: kafkasink: publishing 3 pageviews: broker not available") {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	// Oldest pageviews are dropped first.
+	p.fail = 0
+	if err := s.publish(); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, m := range p.batches[0] {
+		var r record
+		json.Unmarshal(m.Value, &r)
+		paths = append(paths, r.Path)
+	}
+	if fmt.Sprintf("%v", paths) != "[/2 /3 /4]" {
+		t.Errorf("wrong paths: %v", paths)
+	}
+}
+
+func TestEncodeAvro(t *testing.T) {
+	title := "x"
+	tests := []struct {
+		in       record
+		schemaID int
+		want     []byte
+	}{
+		{
+			record{SiteID: 1, Path: "/a", FirstVisit: true, CreatedAt: time.UnixMilli(1)},
+			0,
+			[]byte{2, 4, '/', 'a', 0, 0, 1, 2, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			record{SiteID: 1, Path: "/a", Bot: 150, CreatedAt: time.UnixMilli(1), Title: &title, Size: []float64{1}},
+			42,
+			[]byte{0, 0, 0, 0, 42, 2, 4, '/', 'a', 0, 0xac, 0x02, 0, 2, 2, 2, 'x', 0, 0, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have := encodeAvro(tt.in, tt.schemaID)
+			if fmt.Sprintf("%v", have) != fmt.Sprintf("%v", tt.want) {
+				t.Errorf("\nhave: %v\nwant: %v", have, tt.want)
+			}
+		})
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/oschwald/geoip2-golang"
 	"zgo.at/errors"
@@ -18,21 +20,72 @@ import (
 	"zgo.at/zlog"
 )
 
-var geodb *geoip2.Reader
+// GeoLookup looks up locations by IP address.
+type GeoLookup interface {
+	// Lookup the location of an IP address. The Region and City will be blank
+	// if the database doesn't have this information.
+	Lookup(ip net.IP) (GeoRecord, error)
+
+	// Names gets the English country and region name for the given codes.
+	Names(country, region string) (countryName, regionName string)
+}
+
+// GeoCountryLookup is a GeoLookup that can look up just the country, which is
+// cheaper than decoding the full record.
+type GeoCountryLookup interface {
+	GeoLookup
+
+	// LookupCountry is like Lookup, but only sets the Country and
+	// CountryName.
+	LookupCountry(ip net.IP) (GeoRecord, error)
+}
+
+// lookupCountry looks up only the country if g supports it, or does a full
+// lookup and clears the region and city.
+func lookupCountry(g GeoLookup, ip net.IP) (GeoRecord, error) {
+	if c, ok := g.(GeoCountryLookup); ok {
+		return c.LookupCountry(ip)
+	}
+	loc, err := g.Lookup(ip)
+	return GeoRecord{Country: loc.Country, CountryName: loc.CountryName}, err
+}
+
+// GeoRecord is a location as returned by a GeoLookup.
+type GeoRecord struct {
+	Country     string // ISO-3166-1 code, e.g. "US".
+	CountryName string
+	Region      string // ISO-3166-2 subdivision code without country, e.g. "TX".
+	RegionName  string
+	City        string
+}
+
+// Supported formats for InitGeoDB().
+const (
+	GeoFormatMaxMind = "maxmind"
+	GeoFormatDBIP    = "dbip"
+)
+
+// GeoFormats lists all supported formats.
+var GeoFormats = []string{GeoFormatMaxMind, GeoFormatDBIP}
+
+var geodb GeoLookup
 
 // InitGeoDB sets up the geoDB database located at the given path.
 //
-// The database can be the "Countries" or "Cities" version.
+// The format is one of GeoFormats, and can be either the "Countries" or
+// "Cities" version. An empty format defaults to GeoFormatMaxMind.
 //
-// It will use the embeded "Countries" database if path is an empty string.
-func InitGeoDB(path string) {
-	var err error
-
+// It will use the embeded MaxMind "Countries" database if path is an empty
+// string.
+//
+// The database can be replaced later with GeoUpdate.
+func InitGeoDB(path, format string) {
 	if path != "" {
-		geodb, err = geoip2.Open(path)
+		l, err := NewGeoLookup(path, format)
 		if err != nil {
 			panic(err)
 		}
+		geodb = newGeoSwap(l)
 		GeoDB = nil // Save some memory.
 		return
 	}
@@ -45,10 +98,122 @@ func InitGeoDB(path string) {
 	if err != nil {
 		panic(err)
 	}
-	geodb, err = geoip2.FromBytes(d)
+	db, err := geoip2.FromBytes(d)
 	if err != nil {
 		panic(err)
 	}
+	geodb = newGeoSwap(maxmindDB{db})
+}
+
+// NewGeoLookup opens the database at path in the given format.
+func NewGeoLookup(path, format string) (GeoLookup, error) {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewGeoLookup")
+	}
+	l, err := newGeoLookup(db, format)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "NewGeoLookup")
+	}
+	return l, nil
+}
+
+func newGeoLookup(db *geoip2.Reader, format string) (GeoLookup, error) {
+	switch format {
+	case "", GeoFormatMaxMind:
+		return maxmindDB{db}, nil
+	case GeoFormatDBIP:
+		return dbipDB{db}, nil
+	default:
+		return nil, errors.Errorf("unknown format %q; supported formats are: %s",
+			format, strings.Join(GeoFormats, ", "))
+	}
+}
+
+// MaxMind GeoIP2/GeoLite2 databases.
+type maxmindDB struct{ db *geoip2.Reader }
+
+func (m maxmindDB) Lookup(ip net.IP) (GeoRecord, error) {
+	loc, err := m.db.City(ip)
+	if err != nil {
+		return GeoRecord{}, err
+	}
+	r := GeoRecord{
+		Country:     loc.Country.IsoCode,
+		CountryName: loc.Country.Names["en"],
+		City:        loc.City.Names["en"],
+	}
+	if len(loc.Subdivisions) > 0 {
+		r.Region, r.RegionName = loc.Subdivisions[0].IsoCode, loc.Subdivisions[0].Names["en"]
+	}
+	return r, nil
+}
+
+func (m maxmindDB) LookupCountry(ip net.IP) (GeoRecord, error) {
+	loc, err := m.db.Country(ip)
+	if err != nil {
+		return GeoRecord{}, err
+	}
+	return GeoRecord{Country: loc.Country.IsoCode, CountryName: loc.Country.Names["en"]}, nil
+}
+
+func (m maxmindDB) Names(country, region string) (string, string) {
+	return findGeoName(m.db, m.db.Metadata().DatabaseType == "City", country, region)
+}
+
+// DB-IP databases in the mmdb format.
+//
+// These use the same layout as MaxMind, but the free "lite" versions don't
+// have any subdivision codes; we only record the country for those.
+type dbipDB struct{ db *geoip2.Reader }
+
+func (m dbipDB) Lookup(ip net.IP) (GeoRecord, error) {
+	var loc struct {
+		City struct {
+			Names map[string]string `maxminddb:"names"`
+		} `maxminddb:"city"`
+		Country struct {
+			ISOCode string            `maxminddb:"iso_code"`
+			Names   map[string]string `maxminddb:"names"`
+		} `maxminddb:"country"`
+		Subdivisions []struct {
+			ISOCode string            `maxminddb:"iso_code"`
+			Names   map[string]string `maxminddb:"names"`
+		} `maxminddb:"subdivisions"`
+	}
+	err := m.db.DB().Lookup(ip, &loc)
+	if err != nil {
+		return GeoRecord{}, err
+	}
+	r := GeoRecord{
+		Country:     loc.Country.ISOCode,
+		CountryName: loc.Country.Names["en"],
+		City:        loc.City.Names["en"],
+	}
+	if len(loc.Subdivisions) > 0 && loc.Subdivisions[0].ISOCode != "" {
+		r.Region, r.RegionName = loc.Subdivisions[0].ISOCode, loc.Subdivisions[0].Names["en"]
+	}
+	return r, nil
+}
+
+func (m dbipDB) LookupCountry(ip net.IP) (GeoRecord, error) {
+	var loc struct {
+		Country struct {
+			ISOCode string            `maxminddb:"iso_code"`
+			Names   map[string]string `maxminddb:"names"`
+		} `maxminddb:"country"`
+	}
+	err := m.db.DB().Lookup(ip, &loc)
+	if err != nil {
+		return GeoRecord{}, err
+	}
+	return GeoRecord{Country: loc.Country.ISOCode, CountryName: loc.Country.Names["en"]}, nil
+}
+
+func (m dbipDB) Names(country, region string) (string, string) {
+	// "DBIP-City-Lite", "DBIP-Location (compat=City)", etc.
+	return findGeoName(m.db, strings.Contains(m.db.Metadata().DatabaseType, "City"), country, region)
 }
 
 type Location struct {
@@ -75,7 +240,7 @@ func (l *Location) ByCode(ctx context.Context, code string) error {
 	if zdb.ErrNoRows(err) {
 		l.ISO3166_2 = code
 		l.Country, l.Region, _ = strings.Cut(code, "-")
-		l.CountryName, l.RegionName = findGeoName(l.Country, l.Region)
+		l.CountryName, l.RegionName = geodb.Names(l.Country, l.Region)
 		err = l.insert(ctx)
 	}
 	if err != nil {
@@ -86,25 +251,151 @@ func (l *Location) ByCode(ctx context.Context, code string) error {
 	return nil
 }
 
+// ErrGeoReserved is returned from Location.Lookup() for private, loopback,
+// link-local, and other reserved IP addresses, which aren't in the GeoIP
+// database; see SetGeoLookupPrivate().
+var ErrGeoReserved = errors.New("reserved IP address")
+
+var geoLookupPrivate atomic.Bool
+
+// SetGeoLookupPrivate sets if private and reserved IP addresses are looked up
+// in the GeoIP database. This is off by default, as they're not in the
+// databases from MaxMind or DB-IP; it's only useful for custom databases.
+func SetGeoLookupPrivate(lookup bool) { geoLookupPrivate.Store(lookup) }
+
+// reservedNets are the reserved ranges that don't have a net.IP method.
+var reservedNets = func() []*net.IPNet {
+	nets := []string{
+		"100.64.0.0/10",   // Shared address space (carrier-grade NAT); RFC 6598
+		"192.0.0.0/24",    // IETF protocol assignments; RFC 6890
+		"192.0.2.0/24",    // Documentation (TEST-NET-1); RFC 5737
+		"198.18.0.0/15",   // Benchmarking; RFC 2544
+		"198.51.100.0/24", // Documentation (TEST-NET-2); RFC 5737
+		"203.0.113.0/24",  // Documentation (TEST-NET-3); RFC 5737
+		"240.0.0.0/4",     // Reserved, and 255.255.255.255 broadcast; RFC 1112
+		"2001:db8::/32",   // Documentation; RFC 3849
+	}
+	r := make([]*net.IPNet, 0, len(nets))
+	for _, n := range nets {
+		_, n, err := net.ParseCIDR(n)
+		if err != nil {
+			panic(err)
+		}
+		r = append(r, n)
+	}
+	return r
+}()
+
+// reservedIP reports if ip is in a private, loopback, link-local, or other
+// reserved range. Invalid IPs aren't reserved.
+func reservedIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() {
+		return true
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrGeoBusy is returned from Location.Lookup() if there are too many
+// concurrent lookups; see SetGeoConcurrency().
+var ErrGeoBusy = errors.New("too many concurrent geo lookups")
+
+type geoLimit struct {
+	sem  chan struct{}
+	wait time.Duration
+}
+
+var geoLimiter atomic.Pointer[geoLimit]
+
+// SetGeoConcurrency limits the number of concurrent lookups in the GeoIP
+// database to n, so a spike in pageviews doesn't pile up on the database.
+//
+// Lookups wait up to wait for a free slot; after that they fail with
+// ErrGeoBusy and the location is recorded as unknown. A wait of 0 fails right
+// away. There is no limit if n is 0, which is the default.
+func SetGeoConcurrency(n int, wait time.Duration) {
+	if n <= 0 {
+		geoLimiter.Store(nil)
+		return
+	}
+	geoLimiter.Store(&geoLimit{sem: make(chan struct{}, n), wait: wait})
+}
+
+// acquireGeo gets a slot for a geo lookup; the returned function releases it.
+func acquireGeo() (func(), error) {
+	l := geoLimiter.Load()
+	if l == nil {
+		return func() {}, nil
+	}
+	release := func() { <-l.sem }
+
+	select {
+	case l.sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if l.wait <= 0 {
+		return nil, ErrGeoBusy
+	}
+
+	t := time.NewTimer(l.wait)
+	defer t.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return release, nil
+	case <-t.C:
+		return nil, ErrGeoBusy
+	}
+}
+
 // Lookup a location by IPv4 or IPv6 address.
 //
 // This will insert a row in the locations table if one doesn't exist yet.
 func (l *Location) Lookup(ctx context.Context, ip string) error {
+	return l.lookup(ctx, ip, false)
+}
+
+// LookupCountry is like Lookup(), but only looks up the country.
+func (l *Location) LookupCountry(ctx context.Context, ip string) error {
+	return l.lookup(ctx, ip, true)
+}
+
+func (l *Location) lookup(ctx context.Context, ip string, countryOnly bool) error {
 	if geodb == nil {
 		panic("Location.Lookup: geo.Init not called")
 	}
 
-	loc, err := geodb.City(net.ParseIP(ip))
+	addr := net.ParseIP(ip)
+	if !geoLookupPrivate.Load() && reservedIP(addr) {
+		return errors.Wrap(ErrGeoReserved, "Location.Lookup")
+	}
+
+	release, err := acquireGeo()
 	if err != nil {
 		return errors.Wrap(err, "Location.Lookup")
 	}
-	l.Country = loc.Country.IsoCode
-	l.CountryName = loc.Country.Names["en"]
-	if len(loc.Subdivisions) > 0 {
-		l.Region, l.RegionName = loc.Subdivisions[0].IsoCode, loc.Subdivisions[0].Names["en"]
+	var loc GeoRecord
+	if countryOnly {
+		loc, err = lookupCountry(geodb, addr)
+	} else {
+		loc, err = geodb.Lookup(addr)
+	}
+	release()
+	if err != nil {
+		return errors.Wrap(err, "Location.Lookup")
 	}
+	l.Country, l.CountryName = loc.Country, loc.CountryName
+	l.Region, l.RegionName = loc.Region, loc.RegionName
 
-	l.ISO3166_2 = loc.Country.IsoCode
+	l.ISO3166_2 = loc.Country
 	if l.Region != "" {
 		l.ISO3166_2 += "-" + l.Region
 	}
@@ -136,6 +427,16 @@ func (l Location) LookupIP(ctx context.Context, ip string) string {
 	return l.ISO3166_2
 }
 
+// LookupCountryIP is a shorthand for LookupCountry(); returns "" on errors
+// ("unknown").
+func (l Location) LookupCountryIP(ctx context.Context, ip string) string {
+	err := l.LookupCountry(ctx, ip)
+	if err != nil {
+		return ""
+	}
+	return l.ISO3166_2
+}
+
 func (l *Location) insert(ctx context.Context) (err error) {
 	l.ID, err = zdb.InsertID(ctx, "location_id",
 		`insert into locations (country, region, country_name, region_name) values (?, ?, ?, ?)`,
@@ -170,9 +471,8 @@ func (l *Locations) ListCountries(ctx context.Context) error {
 // (Countries is much faster, ~100ms) which is not a great worst case scenario,
 // but in most cases it should be (much) faster, and this should get called
 // extremely infrequently anyway, if ever.
-func findGeoName(country, region string) (string, string) {
-	hasRegions := geodb.Metadata().DatabaseType == "City"
-	iter := geodb.DB().Data()
+func findGeoName(db *geoip2.Reader, hasRegions bool, country, region string) (string, string) {
+	iter := db.DB().Data()
 	for iter.Next() {
 		var r struct {
 			Country struct {
@@ -0,0 +1,152 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowGeo records the number of concurrent lookups; it always returns an error
+// so Location.Lookup() doesn't need the database.
+type slowGeo struct {
+	cur, max, calls atomic.Int64
+}
+
+func (g *slowGeo) Lookup(net.IP) (GeoRecord, error) {
+	g.calls.Add(1)
+	n := g.cur.Add(1)
+	for {
+		m := g.max.Load()
+		if n <= m || g.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	g.cur.Add(-1)
+	return GeoRecord{}, errors.New("not found")
+}
+
+func (g *slowGeo) Names(string, string) (string, string) { return "", "" }
+
+func TestSetGeoConcurrency(t *testing.T) {
+	tests := []struct {
+		n        int
+		wait     time.Duration
+		wantMax  int64
+		allCalls bool
+	}{
+		{0, 0, 50, true},
+		{4, time.Second, 4, true},
+		{4, 0, 4, false},
+		{1, time.Millisecond, 1, false},
+	}
+
+	prev := geodb
+	defer func() { geodb = prev; SetGeoConcurrency(0, 0) }()
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			g := &slowGeo{}
+			geodb = g
+			SetGeoConcurrency(tt.n, tt.wait)
+
+			var (
+				wg   sync.WaitGroup
+				busy atomic.Int64
+				now  = make(chan struct{})
+			)
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-now
+					err := (&Location{}).Lookup(context.Background(), "1.2.3.4")
+					if errors.Is(err, ErrGeoBusy) {
+						busy.Add(1)
+					}
+				}()
+			}
+			close(now)
+			wg.Wait()
+
+			if m := g.max.Load(); m > tt.wantMax || (tt.n == 0 && m < 2) {
+				t.Errorf("max concurrent lookups: %d; want at most %d", m, tt.wantMax)
+			}
+			if c, b := g.calls.Load(), busy.Load(); c+b != 50 || (c == 50) != tt.allCalls {
+				t.Errorf("%d lookups and %d busy", c, b)
+			}
+		})
+	}
+}
+
+func BenchmarkGeoConcurrency(b *testing.B) {
+	defer SetGeoConcurrency(0, 0)
+	SetGeoConcurrency(8, time.Second)
+
+	b.SetParallelism(8)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			release, err := acquireGeo()
+			if err != nil {
+				b.Fatal(err)
+			}
+			release()
+		}
+	})
+}
+
+func TestLookupReserved(t *testing.T) {
+	tests := []struct {
+		ip       string
+		reserved bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.1.1", true},
+		{"172.16.0.1", true},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"169.254.1.1", true},
+		{"100.64.1.1", true},
+		{"203.0.113.5", true},
+		{"2001:db8::1", true},
+		{"0.0.0.0", true},
+
+		{"1.2.3.4", false},
+		{"51.171.91.33", false},
+		{"172.32.0.1", false},
+		{"2a00:1450:4001::1", false},
+		{"not an ip", false},
+	}
+
+	prev := geodb
+	defer func() { geodb = prev; SetGeoLookupPrivate(false) }()
+
+	for _, lookupPrivate := range []bool{false, true} {
+		SetGeoLookupPrivate(lookupPrivate)
+		for _, tt := range tests {
+			t.Run(tt.ip, func(t *testing.T) {
+				g := &slowGeo{}
+				geodb = g
+
+				err := (&Location{}).Lookup(context.Background(), tt.ip)
+				skip := tt.reserved && !lookupPrivate
+				if have := errors.Is(err, ErrGeoReserved); have != skip {
+					t.Errorf("ErrGeoReserved: %t; want %t (%v)", have, skip, err)
+				}
+				if have := g.calls.Load(); have != map[bool]int64{true: 0, false: 1}[skip] {
+					t.Errorf("%d lookups", have)
+				}
+			})
+		}
+	}
+}
@@ -5,7 +5,13 @@
 package goatcounter_test
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
 	"testing"
 
 	. "zgo.at/goatcounter/v2"
@@ -64,6 +70,233 @@ func TestLocations(t *testing.T) {
 	run()
 }
 
+func TestGeoLookup(t *testing.T) {
+	names := func(en string) map[string]any { return map[string]any{"names": map[string]any{"en": en}} }
+
+	maxmind := writeMMDB(t, "GeoLite2-City", map[string]map[string]any{
+		"1.2.3.0/24": {
+			"country":      map[string]any{"iso_code": "NL", "names": map[string]any{"en": "Netherlands"}},
+			"subdivisions": []any{map[string]any{"iso_code": "NH", "names": map[string]any{"en": "North Holland"}}},
+			"city":         names("Amsterdam"),
+		},
+		"5.6.0.0/16": {
+			"country": map[string]any{"iso_code": "ID", "names": map[string]any{"en": "Indonesia"}},
+		},
+	})
+	dbip := writeMMDB(t, "DBIP-City-Lite", map[string]map[string]any{
+		"1.2.3.0/24": { // Lite version: no subdivision code.
+			"country":      map[string]any{"iso_code": "NL", "names": map[string]any{"en": "Netherlands"}},
+			"subdivisions": []any{names("North Holland")},
+			"city":         names("Amsterdam"),
+		},
+		"5.6.0.0/16": {
+			"country":      map[string]any{"iso_code": "ID", "names": map[string]any{"en": "Indonesia"}},
+			"subdivisions": []any{map[string]any{"iso_code": "BA", "names": map[string]any{"en": "Bali"}}},
+			"city":         names("Denpasar"),
+		},
+	})
+
+	tests := []struct {
+		path, format, ip string
+		want             GeoRecord
+	}{
+		{maxmind, GeoFormatMaxMind, "1.2.3.4", GeoRecord{"NL", "Netherlands", "NH", "North Holland", "Amsterdam"}},
+		{maxmind, GeoFormatMaxMind, "5.6.7.8", GeoRecord{"ID", "Indonesia", "", "", ""}},
+		{maxmind, "", "9.9.9.9", GeoRecord{}},
+
+		{dbip, GeoFormatDBIP, "1.2.3.4", GeoRecord{"NL", "Netherlands", "", "", "Amsterdam"}},
+		{dbip, GeoFormatDBIP, "5.6.7.8", GeoRecord{"ID", "Indonesia", "BA", "Bali", "Denpasar"}},
+		{dbip, GeoFormatDBIP, "9.9.9.9", GeoRecord{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.ip, func(t *testing.T) {
+			db, err := NewGeoLookup(tt.path, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have, err := db.Lookup(net.ParseIP(tt.ip))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have != tt.want {
+				t.Errorf("\nhave: %#v\nwant: %#v", have, tt.want)
+			}
+
+			have, err = db.(GeoCountryLookup).LookupCountry(net.ParseIP(tt.ip))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (GeoRecord{Country: tt.want.Country, CountryName: tt.want.CountryName}); have != want {
+				t.Errorf("country\nhave: %#v\nwant: %#v", have, want)
+			}
+		})
+	}
+
+	t.Run("names", func(t *testing.T) {
+		db, err := NewGeoLookup(dbip, GeoFormatDBIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, r := db.Names("ID", "BA"); c != "Indonesia" || r != "Bali" {
+			t.Errorf("%q %q", c, r)
+		}
+		if c, r := db.Names("NL", ""); c != "Netherlands" || r != "" {
+			t.Errorf("%q %q", c, r)
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := NewGeoLookup(maxmind, "ip2location")
+		if !ztest.ErrorContains(err, `unknown format "ip2location"`) {
+			t.Error(err)
+		}
+	})
+}
+
+// writeMMDB writes a minimal IPv4-only MaxMind DB file with the given networks.
+//
+// Only the types we need are supported: strings, maps, and arrays.
+func writeMMDB(t *testing.T, dbType string, networks map[string]map[string]any) string {
+	t.Helper()
+
+	var encode func(b *bytes.Buffer, v any)
+	ctrl := func(b *bytes.Buffer, typ byte, size int) {
+		first, ext := typ<<5, []byte(nil)
+		if typ > 7 { // Extended type: stored in the byte after the control byte.
+			first, ext = 0, []byte{typ - 7}
+		}
+		var sz []byte
+		switch {
+		case size < 29:
+			first |= byte(size)
+		case size < 285:
+			first, sz = first|29, []byte{byte(size - 29)}
+		default:
+			first, sz = first|30, binary.BigEndian.AppendUint16(nil, uint16(size-285))
+		}
+		b.WriteByte(first)
+		b.Write(ext)
+		b.Write(sz)
+	}
+	encode = func(b *bytes.Buffer, v any) {
+		switch vv := v.(type) {
+		case string:
+			ctrl(b, 2, len(vv))
+			b.WriteString(vv)
+		case uint32:
+			ctrl(b, 6, 4)
+			b.Write(binary.BigEndian.AppendUint32(nil, vv))
+		case map[string]any:
+			ctrl(b, 7, len(vv))
+			keys := make([]string, 0, len(vv))
+			for k := range vv {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				encode(b, k)
+				encode(b, vv[k])
+			}
+		case []any:
+			ctrl(b, 11, len(vv))
+			for _, e := range vv {
+				encode(b, e)
+			}
+		default:
+			t.Fatalf("writeMMDB: unsupported type %T", v)
+		}
+	}
+
+	// Build the search tree; leaves point to an offset in the data section.
+	type node struct {
+		child [2]*node
+		data  [2]int
+	}
+	var (
+		root = &node{data: [2]int{-1, -1}}
+		data = new(bytes.Buffer)
+	)
+	cidrs := make([]string, 0, len(networks))
+	for c := range networks {
+		cidrs = append(cidrs, c)
+	}
+	sort.Strings(cidrs)
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		off := data.Len()
+		encode(data, networks[c])
+
+		ones, _ := n.Mask.Size()
+		ip, cur := n.IP.To4(), root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - i%8)) & 1
+			if i == ones-1 {
+				cur.data[bit] = off
+				break
+			}
+			if cur.child[bit] == nil {
+				cur.child[bit] = &node{data: [2]int{-1, -1}}
+			}
+			cur = cur.child[bit]
+		}
+	}
+
+	var nodes []*node
+	var walk func(n *node)
+	walk = func(n *node) {
+		nodes = append(nodes, n)
+		for _, c := range n.child {
+			if c != nil {
+				walk(c)
+			}
+		}
+	}
+	walk(root)
+	index := make(map[*node]int, len(nodes))
+	for i, n := range nodes {
+		index[n] = i
+	}
+
+	out := new(bytes.Buffer)
+	for _, n := range nodes {
+		for i := range n.child {
+			rec := len(nodes) // Empty.
+			switch {
+			case n.child[i] != nil:
+				rec = index[n.child[i]]
+			case n.data[i] >= 0:
+				rec = len(nodes) + 16 + n.data[i]
+			}
+			out.Write([]byte{byte(rec >> 16), byte(rec >> 8), byte(rec)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xAB\xCD\xEFMaxMind.com")
+	encode(out, map[string]any{
+		"binary_format_major_version": uint32(2),
+		"binary_format_minor_version": uint32(0),
+		"build_epoch":                 uint32(0),
+		"database_type":               dbType,
+		"description":                 map[string]any{},
+		"ip_version":                  uint32(4),
+		"languages":                   []any{"en"},
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint32(24),
+	})
+
+	path := filepath.Join(t.TempDir(), dbType+".mmdb")
+	err := os.WriteFile(path, out.Bytes(), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
 func BenchmarkLocationsByCode(b *testing.B) {
 	ctx := gctest.DB(b)
 
@@ -0,0 +1,278 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"zgo.at/errors"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// GeoUpdate downloads a new GeoIP database on a schedule, and uses it once it's
+// downloaded and verified.
+type GeoUpdate struct {
+	// URL to download the database from; "{license_key}" is replaced with Key.
+	// This can be a mmdb file, a gzip-compressed mmdb file, or a tar.gz with a
+	// mmdb file, as MaxMind and DB-IP use.
+	URL string
+	Key string
+
+	// Write the database to this path, so it's used after a restart; it's only
+	// kept in memory if this is empty.
+	Path   string
+	Format string // One of GeoFormats; see InitGeoDB().
+
+	Every   time.Duration // Time between updates.
+	Retries int           // Number of retries if a download fails.
+	Backoff time.Duration // Wait before the first retry; doubled after every retry.
+
+	Client *http.Client // http.DefaultClient if nil.
+}
+
+// maxGeoSize is the maximum size of the (uncompressed) GeoIP database.
+const maxGeoSize = 1 << 30
+
+// GeoUpdateStatus is the status of the GeoIP database updates.
+type GeoUpdateStatus struct {
+	Updated time.Time `json:"updated,omitempty"`  // Last successful update.
+	Error   string    `json:"error,omitempty"`    // Last error; not cleared on success.
+	ErrorAt time.Time `json:"error_at,omitempty"` // When Error happened.
+}
+
+var (
+	geoUpdateEnabled atomic.Bool
+	geoUpdateMu      sync.Mutex
+	geoUpdateStatus  GeoUpdateStatus
+)
+
+// GeoUpdateInfo gets the status of the GeoIP database updates; ok is false if
+// updates aren't enabled.
+func GeoUpdateInfo() (s GeoUpdateStatus, ok bool) {
+	geoUpdateMu.Lock()
+	defer geoUpdateMu.Unlock()
+	return geoUpdateStatus, geoUpdateEnabled.Load()
+}
+
+// Start updates the database every u.Every until the context is cancelled. The
+// first update is right away if there's no database at u.Path yet.
+func (u GeoUpdate) Start(ctx context.Context) {
+	geoUpdateEnabled.Store(true)
+	go func() {
+		if _, err := os.Stat(u.Path); u.Path == "" || err != nil {
+			_ = u.Update(ctx)
+		}
+
+		t := time.NewTicker(u.Every)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				_ = u.Update(ctx)
+			}
+		}
+	}()
+}
+
+// Update downloads the database, retrying u.Retries times with backoff if it
+// fails. The error is from the last attempt.
+func (u GeoUpdate) Update(ctx context.Context) error {
+	l := zlog.Module("geodb-update")
+	wait := u.Backoff
+	for i := 0; ; i++ {
+		err := u.Download(ctx)
+		geoUpdateMu.Lock()
+		if err == nil {
+			geoUpdateStatus.Updated = ztime.Now()
+		} else {
+			geoUpdateStatus.Error, geoUpdateStatus.ErrorAt = err.Error(), ztime.Now()
+		}
+		geoUpdateMu.Unlock()
+		if err == nil {
+			l.Printf("updated GeoIP database from %s", u.redactedURL())
+			return nil
+		}
+		if i >= u.Retries {
+			l.Errorf("giving up after %d attempts: %s", i+1, err)
+			return err
+		}
+
+		l.Printf("attempt %d failed, retrying in %s: %s", i+1, wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// Download the database once and use it if it's valid. The database at u.Path
+// is replaced atomically, and never with a partial or invalid file.
+func (u GeoUpdate) Download(ctx context.Context) error {
+	client := u.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.ReplaceAll(u.URL, "{license_key}", u.Key), nil)
+	if err != nil {
+		return errors.Wrap(err, "GeoUpdate.Download")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// The error includes the URL, which may have the key.
+		if u.Key != "" {
+			return errors.Errorf("GeoUpdate.Download: %s", strings.ReplaceAll(err.Error(), u.Key, "[key]"))
+		}
+		return errors.Wrap(err, "GeoUpdate.Download")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("GeoUpdate.Download: %s", resp.Status)
+	}
+
+	d, err := readGeoDB(io.LimitReader(resp.Body, maxGeoSize+1))
+	if err != nil {
+		return errors.Wrap(err, "GeoUpdate.Download")
+	}
+
+	db, err := geoip2.FromBytes(d)
+	if err != nil {
+		return errors.Wrap(err, "GeoUpdate.Download: invalid database")
+	}
+	lookup, err := newGeoLookup(db, u.Format)
+	if err != nil {
+		return errors.Wrap(err, "GeoUpdate.Download")
+	}
+	if _, err := lookup.Lookup(net.ParseIP("1.1.1.1")); err != nil {
+		return errors.Wrap(err, "GeoUpdate.Download: invalid database")
+	}
+
+	if u.Path != "" {
+		err := writeFileAtomic(u.Path, d)
+		if err != nil {
+			return errors.Wrap(err, "GeoUpdate.Download")
+		}
+	}
+	swapGeoDB(lookup)
+	return nil
+}
+
+func (u GeoUpdate) redactedURL() string {
+	if u.Key == "" {
+		return u.URL
+	}
+	return strings.ReplaceAll(u.URL, "{license_key}", "[key]")
+}
+
+// readGeoDB reads a mmdb file, which may be compressed with gzip or in a
+// tar.gz.
+func readGeoDB(r io.Reader) ([]byte, error) {
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > maxGeoSize {
+		return nil, errors.Errorf("larger than %d bytes", maxGeoSize)
+	}
+	if !bytes.HasPrefix(d, []byte{0x1f, 0x8b}) {
+		return d, nil
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(d))
+	if err != nil {
+		return nil, err
+	}
+	d, err = io.ReadAll(io.LimitReader(gz, maxGeoSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > maxGeoSize {
+		return nil, errors.Errorf("larger than %d bytes", maxGeoSize)
+	}
+	if len(d) < 262 || string(d[257:262]) != "ustar" {
+		return d, nil
+	}
+
+	t := tar.NewReader(bytes.NewReader(d))
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return nil, errors.New("no .mmdb file in the archive")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg && strings.HasSuffix(h.Name, ".mmdb") {
+			return io.ReadAll(t)
+		}
+	}
+}
+
+// writeFileAtomic writes to a temporary file in the same directory and renames
+// it, so the file at path is always complete.
+func writeFileAtomic(path string, d []byte) error {
+	fp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name()) // Fails after the rename, which is fine.
+
+	if _, err := fp.Write(d); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), path)
+}
+
+// geoSwap is a GeoLookup that can be replaced while it's in use.
+type geoSwap struct{ p atomic.Pointer[GeoLookup] }
+
+func newGeoSwap(l GeoLookup) *geoSwap {
+	s := &geoSwap{}
+	s.p.Store(&l)
+	return s
+}
+
+func (s *geoSwap) Lookup(ip net.IP) (GeoRecord, error) { return (*s.p.Load()).Lookup(ip) }
+func (s *geoSwap) LookupCountry(ip net.IP) (GeoRecord, error) {
+	return lookupCountry(*s.p.Load(), ip)
+}
+func (s *geoSwap) Names(country, region string) (string, string) {
+	return (*s.p.Load()).Names(country, region)
+}
+
+// swapGeoDB replaces the GeoIP database.
+func swapGeoDB(l GeoLookup) {
+	if s, ok := geodb.(*geoSwap); ok {
+		s.p.Store(&l)
+		return
+	}
+	geodb = newGeoSwap(l) // Only if it wasn't set up with InitGeoDB().
+}
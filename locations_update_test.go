@@ -0,0 +1,151 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+)
+
+func TestGeoUpdate(t *testing.T) {
+	ctx := gctest.DB(t)
+	t.Cleanup(func() { InitGeoDB("", "") })
+
+	mmdb, err := os.ReadFile(writeMMDB(t, "GeoLite2-City", map[string]map[string]any{
+		"1.2.3.0/24": {"country": map[string]any{"iso_code": "NL", "names": map[string]any{"en": "Netherlands"}}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var targz bytes.Buffer
+	{
+		gz := gzip.NewWriter(&targz)
+		tw := tar.NewWriter(gz)
+		tw.WriteHeader(&tar.Header{Name: "GeoLite2-City_20240301/COPYRIGHT.txt", Mode: 0o644, Size: 2})
+		tw.Write([]byte("hi"))
+		tw.WriteHeader(&tar.Header{Name: "GeoLite2-City_20240301/GeoLite2-City.mmdb", Mode: 0o644, Size: int64(len(mmdb))})
+		tw.Write(mmdb)
+		tw.Close()
+		gz.Close()
+	}
+
+	var (
+		body     []byte
+		fail     atomic.Int64 // Fail this many requests.
+		requests atomic.Int64
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Query().Get("license_key") != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		if fail.Add(-1) >= 0 {
+			w.WriteHeader(503)
+			return
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	lookup := func(t *testing.T, want string) {
+		t.Helper()
+		ctx := NewContext(zdb.MustGetDB(ctx)) // Reset cache.
+		if have := (Location{}).LookupIP(ctx, "1.2.3.4"); have != want {
+			t.Errorf("have %q; want %q", have, want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "geo.mmdb")
+	u := GeoUpdate{
+		URL:     srv.URL + "/db?license_key={license_key}",
+		Key:     "secret",
+		Path:    path,
+		Retries: 2,
+		Backoff: time.Millisecond,
+	}
+
+	t.Run("success", func(t *testing.T) {
+		for _, b := range [][]byte{mmdb, targz.Bytes()} {
+			InitGeoDB("", "")
+			lookup(t, "AU") // Built-in database.
+			body = b
+			err := u.Download(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			lookup(t, "NL")
+
+			have, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(have, mmdb) {
+				t.Error("wrong file written")
+			}
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		InitGeoDB("", "")
+		body = mmdb
+		requests.Store(0)
+		fail.Store(2)
+		err := u.Update(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := requests.Load(); r != 3 {
+			t.Errorf("%d requests", r)
+		}
+		lookup(t, "NL")
+
+		requests.Store(0)
+		fail.Store(3)
+		err = u.Update(context.Background())
+		if !ztest.ErrorContains(err, "503 Service Unavailable") {
+			t.Fatal(err)
+		}
+		if r := requests.Load(); r != 3 {
+			t.Errorf("%d requests", r)
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		InitGeoDB("", "")
+		os.Remove(path)
+
+		var gz bytes.Buffer
+		w := gzip.NewWriter(&gz)
+		w.Write([]byte("not a database"))
+		w.Close()
+
+		for _, b := range [][]byte{[]byte("not a database"), gz.Bytes(), mmdb[:len(mmdb)/2], targz.Bytes()[:100]} {
+			body = b
+			err := u.Download(context.Background())
+			if err == nil {
+				t.Fatal("err is nil")
+			}
+			lookup(t, "AU")
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("file written: %v", err)
+			}
+		}
+	})
+}
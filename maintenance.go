@@ -0,0 +1,18 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import "sync/atomic"
+
+var maintenance atomic.Bool
+
+// SetMaintenance enables or disables maintenance mode for the instance.
+//
+// In maintenance mode new pageviews are rejected, so nothing is lost to failed
+// writes when the database is unavailable; the dashboard keeps working.
+func SetMaintenance(on bool) { maintenance.Store(on) }
+
+// Maintenance reports if maintenance mode is enabled.
+func Maintenance() bool { return maintenance.Load() }
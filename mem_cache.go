@@ -0,0 +1,207 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"zgo.at/goatcounter/v2/metrics"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// MemCache is an in-memory cache with entries for sessions, IPs, etc. that's
+// evicted by EvictMemCaches(), so that all of them have the same policy.
+type MemCache interface {
+	// Len gets the number of entries.
+	Len() int
+
+	// Evict removes entries that weren't used in the last ttl.
+	//
+	// Caches may keep entries for longer if that's needed to be correct, such
+	// as the nonces of signatures that are still valid.
+	Evict(now time.Time, ttl time.Duration)
+}
+
+// MemCacheStat is the size of a MemCache.
+type MemCacheStat struct {
+	Name   string
+	Len    int
+	TTL    time.Duration
+	Pruned int // Number of entries evicted since the start.
+}
+
+type memCache struct {
+	name   string
+	c      MemCache
+	ttl    time.Duration
+	pruned int
+}
+
+var memCaches struct {
+	mu      sync.Mutex
+	evictMu sync.Mutex // Only one EvictMemCaches() at a time.
+	caches  []*memCache
+	ttl     time.Duration
+	budget  int
+	stop    chan struct{}
+}
+
+// RegisterMemCache adds a cache that's evicted by EvictMemCaches(); ttl is the
+// default TTL for the entries.
+func RegisterMemCache(name string, c MemCache, ttl time.Duration) {
+	memCaches.mu.Lock()
+	defer memCaches.mu.Unlock()
+	memCaches.caches = append(memCaches.caches, &memCache{name: name, c: c, ttl: ttl})
+}
+
+// SetMemCachePolicy sets the TTL for the entries of all caches, and the
+// maximum number of entries for all caches combined.
+//
+// The TTL overrides the default from RegisterMemCache() if it's not 0. If
+// there are more than budget entries after evicting the expired ones then the
+// TTLs are halved until it fits; 0 means there is no limit.
+func SetMemCachePolicy(ttl time.Duration, budget int) {
+	memCaches.mu.Lock()
+	defer memCaches.mu.Unlock()
+	memCaches.ttl, memCaches.budget = ttl, budget
+}
+
+// StartMemCacheJanitor runs EvictMemCaches() in the background every
+// interval, stopping the janitor that was started before (if any).
+//
+// The closure returned stops the janitor, and waits for it to finish.
+func StartMemCacheJanitor(interval time.Duration) func() {
+	memCaches.mu.Lock()
+	defer memCaches.mu.Unlock()
+	if memCaches.stop != nil {
+		close(memCaches.stop)
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	memCaches.stop = stop
+
+	go func() {
+		defer close(done)
+		defer zlog.Recover()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				m := metrics.Start("memcache:evict")
+				EvictMemCaches(ztime.Now())
+				m.Done()
+			}
+		}
+	}()
+
+	return func() {
+		memCaches.mu.Lock()
+		if memCaches.stop == stop {
+			close(stop)
+			memCaches.stop = nil
+		}
+		memCaches.mu.Unlock()
+		<-done
+	}
+}
+
+// EvictMemCaches removes expired entries from all caches.
+//
+// This is run in the background by StartMemCacheJanitor(), rather than when
+// adding entries. Every cache is locked only while evicting its own entries,
+// so that adding entries to the other caches isn't blocked.
+func EvictMemCaches(now time.Time) {
+	memCaches.evictMu.Lock()
+	defer memCaches.evictMu.Unlock()
+
+	memCaches.mu.Lock()
+	var (
+		caches = slices.Clone(memCaches.caches)
+		ttls   = make([]time.Duration, len(caches))
+		budget = memCaches.budget
+	)
+	for i, c := range caches {
+		ttls[i] = memCacheTTL(c)
+	}
+	memCaches.mu.Unlock()
+
+	pruned := make([]int, len(caches))
+	evict := func(div time.Duration) {
+		for i, c := range caches {
+			n := c.c.Len()
+			c.c.Evict(now, ttls[i]/div)
+			pruned[i] += max(n-c.c.Len(), 0)
+		}
+	}
+	defer func() {
+		memCaches.mu.Lock()
+		defer memCaches.mu.Unlock()
+		for i, c := range caches {
+			c.pruned += pruned[i]
+		}
+	}()
+
+	evict(1)
+	if budget == 0 || memCacheLen(caches) <= budget {
+		return
+	}
+
+	zlog.Module("memcache").Printf("%d entries is more than the budget of %d; evicting entries early",
+		memCacheLen(caches), budget)
+	for i := 1; i <= 10 && memCacheLen(caches) > budget; i++ {
+		evict(1 << i)
+	}
+	if memCacheLen(caches) > budget {
+		evict(math.MaxInt64) // TTL of 0: evict everything.
+	}
+}
+
+// ListMemCaches gets the sizes of all caches, sorted by name.
+func ListMemCaches() []MemCacheStat {
+	memCaches.mu.Lock()
+	defer memCaches.mu.Unlock()
+
+	l := make([]MemCacheStat, 0, len(memCaches.caches))
+	for _, c := range memCaches.caches {
+		l = append(l, MemCacheStat{Name: c.name, Len: c.c.Len(), TTL: memCacheTTL(c), Pruned: c.pruned})
+	}
+	slices.SortFunc(l, func(a, b MemCacheStat) int { return strings.Compare(a.Name, b.Name) })
+	return l
+}
+
+func memCacheTTL(c *memCache) time.Duration {
+	if memCaches.ttl > 0 {
+		return memCaches.ttl
+	}
+	return c.ttl
+}
+
+// memCacheTTLFor gets the TTL for the cache with this name, or 0 if there is
+// no cache with this name.
+func memCacheTTLFor(name string) time.Duration {
+	memCaches.mu.Lock()
+	defer memCaches.mu.Unlock()
+	for _, c := range memCaches.caches {
+		if c.name == name {
+			return memCacheTTL(c)
+		}
+	}
+	return 0
+}
+
+func memCacheLen(caches []*memCache) int {
+	var n int
+	for _, c := range caches {
+		n += c.c.Len()
+	}
+	return n
+}
@@ -0,0 +1,165 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMemCache map[string]time.Time
+
+func (c testMemCache) Len() int { return len(c) }
+func (c testMemCache) Evict(now time.Time, ttl time.Duration) {
+	for k, t := range c {
+		if !t.After(now.Add(-ttl)) {
+			delete(c, k)
+		}
+	}
+}
+
+// syncMemCache is a testMemCache that can be used from the janitor.
+type syncMemCache struct {
+	mu sync.Mutex
+	c  testMemCache
+}
+
+func (c *syncMemCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.c.Len()
+}
+func (c *syncMemCache) Evict(now time.Time, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.Evict(now, ttl)
+}
+func (c *syncMemCache) set(k string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c[k] = t
+}
+func (c *syncMemCache) has(k string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.c[k]
+	return ok
+}
+
+func TestMemCache(t *testing.T) {
+	defer func(c []*memCache) {
+		memCaches.caches = c
+		SetMemCachePolicy(0, 0)
+	}(memCaches.caches)
+
+	now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	setup := func(ttl time.Duration, budget int) (testMemCache, testMemCache) {
+		memCaches.caches = nil
+		SetMemCachePolicy(ttl, budget)
+		a, b := make(testMemCache), make(testMemCache)
+		RegisterMemCache("a", a, time.Hour)
+		RegisterMemCache("b", b, 10*time.Minute)
+		for i := 0; i < 10; i++ {
+			a[fmt.Sprintf("a%d", i)] = now.Add(-time.Duration(i*10) * time.Minute)
+			b[fmt.Sprintf("b%d", i)] = now.Add(-time.Duration(i) * time.Minute)
+		}
+		return a, b
+	}
+	have := func() string { return fmt.Sprintf("%v", ListMemCaches()) }
+
+	t.Run("ttl", func(t *testing.T) {
+		a, b := setup(0, 0)
+		EvictMemCaches(now)
+		if len(a) != 6 || len(b) != 10 {
+			t.Error(have())
+		}
+		EvictMemCaches(now.Add(5 * time.Minute))
+		if len(a) != 6 || len(b) != 5 {
+			t.Error(have())
+		}
+		if h, w := have(), "[{a 6 1h0m0s 4} {b 5 10m0s 5}]"; h != w {
+			t.Errorf("\nhave: %s\nwant: %s", h, w)
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		a, b := setup(5*time.Minute, 0)
+		EvictMemCaches(now)
+		if len(a) != 1 || len(b) != 5 {
+			t.Error(have())
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		a, b := setup(0, 8)
+		EvictMemCaches(now)
+		if len(a)+len(b) > 8 {
+			t.Error(have())
+		}
+		if _, ok := a["a0"]; !ok {
+			t.Errorf("newest entry evicted: %s", have())
+		}
+		if _, ok := b["b9"]; ok {
+			t.Errorf("oldest entry not evicted: %s", have())
+		}
+
+		// Everything is evicted if halving the TTL isn't enough.
+		a, b = setup(0, 1)
+		EvictMemCaches(now)
+		if len(a)+len(b) != 0 {
+			t.Error(have())
+		}
+	})
+
+	t.Run("janitor", func(t *testing.T) {
+		memCaches.caches = nil
+		SetMemCachePolicy(0, 5)
+		c := &syncMemCache{c: make(testMemCache)}
+		RegisterMemCache("c", c, time.Minute)
+
+		wait := func(f func() bool) bool {
+			for i := 0; i < 200; i++ {
+				if f() {
+					return true
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			return false
+		}
+
+		c.set("old", time.Now().Add(-time.Hour))
+		c.set("new", time.Now())
+		stop := StartMemCacheJanitor(10 * time.Millisecond)
+		defer stop()
+
+		if !wait(func() bool { return !c.has("old") }) {
+			t.Fatal("stale entry not evicted")
+		}
+		if !c.has("new") {
+			t.Fatal("new entry evicted")
+		}
+
+		// Budget caps the growth, even if nothing expired.
+		for i := 0; i < 100; i++ {
+			c.set(fmt.Sprintf("e%d", i), time.Now())
+		}
+		if !wait(func() bool { return c.Len() <= 5 }) {
+			t.Fatalf("more entries than the budget: %s", have())
+		}
+		if s := ListMemCaches()[0]; s.Pruned < 96 {
+			t.Errorf("pruned: %d", s.Pruned)
+		}
+
+		// Nothing is evicted after it's stopped.
+		stop()
+		c.set("old", time.Now().Add(-time.Hour))
+		time.Sleep(50 * time.Millisecond)
+		if !c.has("old") {
+			t.Error("evicted after stop")
+		}
+	})
+}
@@ -6,14 +6,12 @@ package goatcounter
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/url"
 	"slices"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,7 +23,6 @@ import (
 	"zgo.at/zstd/zcrypto"
 	"zgo.at/zstd/zint"
 	"zgo.at/zstd/ztime"
-	"zgo.at/zstd/ztype"
 	"zgo.at/zvalidate"
 )
 
@@ -58,31 +55,76 @@ func (h *hash) UnmarshalText(v []byte) error {
 }
 
 type ms struct {
-	hitMu sync.RWMutex
-	hits  []Hit
+	hitMu   sync.RWMutex
+	hits    []Hit
+	synced  []Hit // Written by PersistHit() since the last Persist().
+	limit   MemstoreLimit
+	dropped int // Dropped since the last Persist(), because of the limit.
+
+	// Persist() and PersistHit() can run at the same time, but processHit()
+	// and the sinks expect to be called from one goroutine.
+	persistMu sync.Mutex
+	batch     FlushBatch
 
 	sessionMu     sync.RWMutex
 	sessions      map[hash]zint.Uint128               // Hash → sessionID
 	sessionHashes map[zint.Uint128]hash               // sessionID → hash
 	sessionPaths  map[zint.Uint128]map[int64]struct{} // SessionID → path_id
 	sessionSeen   map[zint.Uint128]int64              // SessionID → lastseen
+	sessionMin    map[zint.Uint128]int64              // SessionID → SiteSettings.SessionMinInterval
+	sessionRate   map[int64]sessionWindow             // SiteID → new sessions; see SiteSettings.SessionRateLimit
+	sessionMoved  map[zint.Uint128]struct{}           // SessionID → moved from the previous salt
 	curSalt       []byte
 	prevSalt      []byte
 	saltRotated   time.Time
+	saltGrace     time.Duration
+	hasher        SessionHasher
+	overflowKey   []byte // See Overflow.SetKey(); stored with the sessions.
+
+	activeMu     sync.Mutex
+	active       map[activePage]map[zint.Uint128]time.Time // Page → sessionID → last seen
+	activeAt     map[zint.Uint128]activeSession            // SessionID → page
+	activeWindow time.Duration
+
+	sinkMu sync.Mutex
+	sink   HitSink
 
 	testHook bool
 }
 
 var Memstore ms
 
+// SessionTimeout is the default time after which a session ends if there are
+// no new pageviews; this can be changed with SetMemCachePolicy().
+const SessionTimeout = 4 * time.Hour
+
+func init() { RegisterMemCache("sessions", memstoreSessions{&Memstore}, SessionTimeout) }
+
+// memstoreSessions is the MemCache for the sessions in the memstore.
+type memstoreSessions struct{ m *ms }
+
+func (s memstoreSessions) Len() int                               { return s.m.SessionsLen() }
+func (s memstoreSessions) Evict(now time.Time, ttl time.Duration) { s.m.EvictSessions(now, ttl) }
+
+// sessionWindow is the number of new sessions for a site in the minute that
+// started at start (as a Unix timestamp).
+type sessionWindow struct {
+	start int64
+	n     int
+}
+
 type storedSession struct {
 	Sessions    map[hash]zint.Uint128               `json:"sessions"`
 	Hashes      map[zint.Uint128]hash               `json:"hashes"`
 	Paths       map[zint.Uint128]map[int64]struct{} `json:"paths"`
 	Seen        map[zint.Uint128]int64              `json:"seen"`
+	Min         map[zint.Uint128]int64              `json:"min,omitempty"`
+	Moved       map[zint.Uint128]struct{}           `json:"moved,omitempty"`
 	CurSalt     []byte                              `json:"cur_salt"`
 	PrevSalt    []byte                              `json:"prev_salt"`
 	SaltRotated time.Time                           `json:"salt_rotated"`
+	Hasher      string                              `json:"hasher"` // SessionHasher.ID()
+	OverflowKey []byte                              `json:"overflow_key,omitempty"`
 }
 
 func (m *ms) Reset() {
@@ -93,10 +135,17 @@ func (m *ms) Reset() {
 	m.sessionHashes = make(map[zint.Uint128]hash)
 	m.sessionPaths = make(map[zint.Uint128]map[int64]struct{})
 	m.sessionSeen = make(map[zint.Uint128]int64)
+	m.sessionMin = make(map[zint.Uint128]int64)
+	m.sessionRate = make(map[int64]sessionWindow)
+	m.sessionMoved = make(map[zint.Uint128]struct{})
 	m.curSalt = []byte(zcrypto.Secret256())
 	m.prevSalt = []byte(zcrypto.Secret256())
 	m.saltRotated = ztime.Now()
 	TestSeqSession = zint.Uint128{TestSession[0], TestSession[1] + 1}
+
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+	m.active, m.activeAt = nil, nil
 }
 
 // TestInit is like Init(), but enables the test hook to return sequential UUIDs
@@ -136,6 +185,22 @@ func (m *ms) Init(db zdb.DB) error {
 		zlog.Errorf("Memstore.Init: %w", err)
 		return nil
 	}
+	// Independent of the hasher, so the Overflow from the previous run can
+	// still be read.
+	if len(stored.OverflowKey) > 0 {
+		m.overflowKey = stored.OverflowKey
+		if m.limit.Overflow != nil {
+			m.limit.Overflow.SetKey(m.overflowKey)
+		}
+	}
+	if stored.Hasher == "" {
+		stored.Hasher = SessionHashSHA256
+	}
+	if stored.Hasher != m.hasher.ID() {
+		// The hashes won't match, so start over with new salts.
+		zlog.Print("Memstore.Init: session hash algorithm or pepper changed; starting new sessions")
+		return nil
+	}
 
 	if stored.Sessions != nil {
 		m.sessions = stored.Sessions
@@ -149,6 +214,12 @@ func (m *ms) Init(db zdb.DB) error {
 	if stored.Seen != nil {
 		m.sessionSeen = stored.Seen
 	}
+	if stored.Min != nil {
+		m.sessionMin = stored.Min
+	}
+	if stored.Moved != nil {
+		m.sessionMoved = stored.Moved
+	}
 	if len(stored.CurSalt) > 0 {
 		m.curSalt = stored.CurSalt
 	}
@@ -170,10 +241,14 @@ func (m *ms) StoreSessions(db zdb.DB) {
 		Sessions:    m.sessions,
 		Paths:       m.sessionPaths,
 		Seen:        m.sessionSeen,
+		Min:         m.sessionMin,
+		Moved:       m.sessionMoved,
 		Hashes:      m.sessionHashes,
 		CurSalt:     m.curSalt,
 		PrevSalt:    m.prevSalt,
 		SaltRotated: m.saltRotated,
+		Hasher:      m.hasher.ID(),
+		OverflowKey: m.overflowKey,
 	})
 	if err != nil {
 		zlog.Error(err)
@@ -189,8 +264,123 @@ func (m *ms) StoreSessions(db zdb.DB) {
 
 func (m *ms) Append(hits ...Hit) {
 	m.hitMu.Lock()
+	defer m.hitMu.Unlock()
+	m.add(hits)
+}
+
+// requeue puts pageviews that couldn't be stored back in memory, before the
+// pageviews that were added since, so they're retried on the next Persist().
+//
+// They count toward MemstoreLimit.Max like any other pageview, but as they're
+// already processed they're always kept; pageviews that were added since and
+// no longer fit are moved to the Overflow or dropped as in Append(). Persist()
+// never takes more than Max pageviews from memory (not counting merged ones),
+// so this never grows beyond that.
+func (m *ms) requeue(retry []Hit) {
+	m.hitMu.Lock()
+	defer m.hitMu.Unlock()
+
+	hits := m.hits
+	m.hits = append(make([]Hit, 0, len(retry)+len(hits)), retry...)
+	m.add(hits)
+}
+
+// add pageviews to memory, up to MemstoreLimit.Max; hitMu must be held.
+func (m *ms) add(hits []Hit) {
+	if m.limit.Max <= 0 {
+		m.hits = append(m.hits, hits...)
+		return
+	}
+
+	var over []Hit
+	for _, h := range hits {
+		// Merged hits are already deleted from the database, so always keep
+		// them.
+		if h.noProcess || len(m.hits) < m.limit.Max {
+			m.hits = append(m.hits, h)
+		} else {
+			over = append(over, h)
+		}
+	}
+	if len(over) == 0 {
+		return
+	}
+
+	if m.limit.Overflow != nil {
+		n, err := m.limit.Overflow.Push(over)
+		if err != nil {
+			zlog.Module("memstore").Error(err)
+		}
+		over = over[n:]
+	}
+	if len(over) == 0 {
+		return
+	}
+
+	m.dropped += len(over)
+	if m.limit.Drop == DropOld {
+		drop := len(over)
+		keep := m.hits[:0]
+		for _, h := range m.hits {
+			if drop > 0 && !h.noProcess {
+				drop--
+				continue
+			}
+			keep = append(keep, h)
+		}
+		m.hits = append(keep, over[min(drop, len(over)):]...)
+	}
+}
+
+// SetLimit sets the maximum number of pageviews to keep in memory; the default
+// is no limit.
+//
+// The previous MemstoreLimit.Overflow is not closed. The key for the Overflow
+// is set, and stored with the sessions in StoreSessions() so that the Overflow
+// can still be read after a restart.
+func (m *ms) SetLimit(l MemstoreLimit) {
+	m.hitMu.Lock()
+	defer m.hitMu.Unlock()
+	if l.Overflow != nil {
+		m.sessionMu.Lock()
+		if m.overflowKey == nil {
+			m.overflowKey = []byte(zcrypto.Secret256())
+		}
+		l.Overflow.SetKey(m.overflowKey)
+		m.sessionMu.Unlock()
+	}
+	m.limit = l
+}
+
+// Overflow gets the MemstoreLimit.Overflow, which may be nil.
+func (m *ms) Overflow() *Overflow {
+	m.hitMu.Lock()
+	defer m.hitMu.Unlock()
+	return m.limit.Overflow
+}
+
+// drain moves pageviews from the overflow back to memory, as long as they fit.
+func (m *ms) drain() {
+	m.hitMu.Lock()
+	defer m.hitMu.Unlock()
+
+	o := m.limit.Overflow
+	if o == nil || o.Len() == 0 {
+		return
+	}
+	n := m.limit.Max - len(m.hits)
+	if m.limit.Drain > 0 {
+		n = min(n, m.limit.Drain)
+	}
+	if n <= 0 {
+		return
+	}
+
+	hits, err := o.Pop(n)
+	if err != nil {
+		zlog.Module("memstore").Error(err)
+	}
 	m.hits = append(m.hits, hits...)
-	m.hitMu.Unlock()
 }
 
 func (m *ms) SessionsLen() int {
@@ -231,60 +421,210 @@ func isRefspam(host string) bool {
 }
 
 func (m *ms) Persist(ctx context.Context) ([]Hit, error) {
-	if m.Len() == 0 {
-		return nil, nil
-	}
+	m.drain()
+
+	m.persistMu.Lock()
+	defer m.persistMu.Unlock()
 
 	m.hitMu.Lock()
+	if len(m.hits) == 0 && len(m.synced) == 0 {
+		m.hitMu.Unlock()
+		return nil, nil
+	}
 	hits := make([]Hit, len(m.hits))
 	copy(hits, m.hits)
 	m.hits = make([]Hit, 0, 16)
+	synced := m.synced
+	m.synced = nil
+	dropped, max := m.dropped, m.limit.Max
+	m.dropped = 0
 	m.hitMu.Unlock()
 
+	if dropped > 0 {
+		zlog.Module("memstore").Errorf("dropped %d pageviews as more than %d were waiting to be persisted",
+			dropped, max)
+	}
+
 	newHits := make([]Hit, 0, len(hits))
-	ins := zdb.NewBulkInsert(ctx, "hits", []string{"site_id", "path_id", "ref_id",
-		"browser_id", "system_id", "size_id", "location", "language", "created_at", "bot",
-		"session", "first_visit"})
 	for _, h := range hits {
-		if m.processHit(ctx, &h) {
+		if m.processHit(ctx, &h) == "" {
 			// Don't return hits that failed validation; otherwise cron will try to
 			// insert them.
 			newHits = append(newHits, h)
+			m.trackActive(h)
+		}
+	}
+	if len(newHits) == 0 {
+		return synced, nil
+	}
+
+	sink := m.Sink()
+	stored := synced
+	for _, b := range m.batch.split(newHits) {
+		err := sink.Append(ctx, b)
+		if err == nil {
+			err = sink.Flush(ctx)
+		}
+		if err != nil {
+			// Retry this batch and the ones after it on the next Persist();
+			// they're already processed, and the batches before it are stored
+			// so they're not sent again. If the sink stored part of this batch
+			// then only the rest is retried.
+			retry := newHits[len(stored)-len(synced):]
+			var partial *PartialFlushError
+			if errors.As(err, &partial) {
+				ok, failed := partial.split(b)
+				stored = append(stored, ok...)
+				retry = append(failed, retry[len(b):]...)
+			}
+			for i := range retry {
+				retry[i].noProcess = true
+			}
+			m.requeue(retry)
+			return stored, fmt.Errorf("Memstore.Persist: %d of %d pageviews not stored: %w",
+				len(retry), len(newHits), err)
+		}
+		stored = append(stored, b...)
+	}
+	return stored, nil
+}
 
-			ins.Values(h.Site, h.PathID, h.RefID, h.BrowserID, h.SystemID, h.SizeID,
-				h.Location, h.Language, h.CreatedAt.Round(time.Second), h.Bot, h.Session, h.FirstVisit)
+// FlushBatch is the maximum size of the batches that Persist() writes to the
+// sink; larger batches are split and written one after the other, so that a
+// large backlog (e.g. after the database was unavailable for a while) isn't
+// written in one huge transaction.
+//
+// If a batch fails then it's retried on the next Persist(), together with all
+// batches after it.
+type FlushBatch struct {
+	Rows  int // Maximum number of pageviews; 0 is unlimited.
+	Bytes int // Maximum approximate size in bytes; 0 is unlimited.
+}
+
+// split hits in batches; every batch has at least one pageview.
+func (b FlushBatch) split(hits []Hit) [][]Hit {
+	if b.Rows <= 0 && b.Bytes <= 0 {
+		return [][]Hit{hits}
+	}
+	var (
+		batches     [][]Hit
+		start, size int
+	)
+	for i, h := range hits {
+		s := h.flushSize()
+		if i > start && ((b.Rows > 0 && i-start >= b.Rows) || (b.Bytes > 0 && size+s > b.Bytes)) {
+			batches = append(batches, hits[start:i])
+			start, size = i, 0
 		}
+		size += s
+	}
+	return append(batches, hits[start:])
+}
+
+// SetFlushBatch sets the maximum size of the batches that Persist() writes to
+// the sink; the default is to write everything in one batch.
+func (m *ms) SetFlushBatch(b FlushBatch) {
+	m.persistMu.Lock()
+	defer m.persistMu.Unlock()
+	m.batch = b
+}
+
+// PersistHit processes the hit and writes it to the sink right away, rather
+// than adding it to the memstore and waiting for Persist(); see
+// GlobalConfig.SyncCount.
+//
+// The hit is returned from the next Persist() so that it's included in the
+// stats. Hits that aren't recorded, such as referrer spam, aren't an error.
+func (m *ms) PersistHit(ctx context.Context, h Hit) error {
+	m.persistMu.Lock()
+	defer m.persistMu.Unlock()
+
+	if m.processHit(ctx, &h) != "" {
+		return nil
+	}
+
+	sink := m.Sink()
+	err := sink.Append(ctx, []Hit{h})
+	if err == nil {
+		err = sink.Flush(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("Memstore.PersistHit: %w", err)
 	}
 
-	return newHits, ins.Finish()
+	m.trackActive(h)
+	m.hitMu.Lock()
+	m.synced = append(m.synced, h)
+	m.hitMu.Unlock()
+	return nil
+}
+
+// SetSink sets the HitSink that Persist() writes to; the default is to insert
+// in the hits table if this is nil.
+//
+// The previous sink is not closed.
+func (m *ms) SetSink(s HitSink) {
+	m.sinkMu.Lock()
+	defer m.sinkMu.Unlock()
+	m.sink = s
 }
 
-func (m *ms) processHit(ctx context.Context, h *Hit) bool {
+// Sink gets the current HitSink.
+func (m *ms) Sink() HitSink {
+	m.sinkMu.Lock()
+	defer m.sinkMu.Unlock()
+	if m.sink == nil {
+		m.sink = &sqlSink{}
+	}
+	return m.sink
+}
+
+// Preview processes the hit in the same way as Persist(), but without storing
+// anything or tracking the session.
+//
+// It returns the hit as it would be stored, and the reason it wouldn't be
+// stored (or "" if it would be).
+func (m *ms) Preview(ctx context.Context, h Hit) (Hit, string) {
+	h.preview = true
+	reason := m.processHit(ctx, &h)
+	h.preview = false
+	return h, reason
+}
+
+// processHit prepares the hit for storing; the return value is the reason it
+// shouldn't be stored, or "" if it should be.
+func (m *ms) processHit(ctx context.Context, h *Hit) string {
 	defer zlog.Recover(func(l zlog.Log) zlog.Log { return l.Field("hit", fmt.Sprintf("%#v", h)) })
 
 	l := zlog.Module("memstore")
 
 	if h.noProcess {
-		return true
-	}
-
-	// Ignore spammers.
-	h.RefURL, _ = url.Parse(h.Ref)
-	if h.RefURL != nil {
-		if isRefspam(h.RefURL.Host) {
-			l.Debugf("refspam ignored: %q", h.RefURL.Host)
-			return false
-		}
+		return ""
 	}
 
 	var site Site
 	err := site.ByID(ctx, h.Site)
 	if err != nil {
 		l.Field("hit", fmt.Sprintf("%#v", h)).Error(err)
-		return false
+		return "unknown site"
 	}
 	ctx = WithSite(ctx, &site)
 
+	// Ignore spammers.
+	h.RefURL, _ = url.Parse(h.Ref)
+	if h.RefURL != nil {
+		switch {
+		// Before the spam check, as that includes localhost.
+		case Config(ctx).LocalRefs && isLocalRef(h.RefURL):
+			h.Ref, h.RefScheme, h.RefURL = LocalRefLabel, RefSchemeGenerated, nil
+		case site.Settings.InternalRefs != InternalRefsKeep && isInternalRef(h.RefURL):
+			// Grouped or dropped in Hit.Defaults().
+		case isRefspam(h.RefURL.Host):
+			l.Debugf("refspam ignored: %q", h.RefURL.Host)
+			return fmt.Sprintf("referrer %q is on the spam list", h.RefURL.Host)
+		}
+	}
+
 	if !site.Settings.Collect.Has(CollectReferrer) {
 		h.Query = ""
 		h.Ref = ""
@@ -294,23 +634,53 @@ func (m *ms) processHit(ctx context.Context, h *Hit) bool {
 
 	err = h.Defaults(ctx, false)
 	if err != nil {
-		if errors.As(err, ztype.Ptr(&zvalidate.Validator{})) {
+		var vErr *zvalidate.Validator
+		if errors.As(err, &vErr) {
 			l.Field("hit", fmt.Sprintf("%#v", h)).Error(err)
-		} else {
-			l.Field("hit", fmt.Sprintf("%#v", h)).Debug(err)
+			return "not valid: " + vErr.Error()
 		}
-		return false
+		l.Field("hit", fmt.Sprintf("%#v", h)).Debug(err)
+		return "error processing the pageview"
 	}
 
-	if h.Session.IsZero() && site.Settings.Collect.Has(CollectSession) {
-		h.Session, h.FirstVisit = m.session(ctx, site.ID, h.PathID, h.UserSessionID, h.UserAgentHeader, h.RemoteAddr)
-	}
-
-	if !site.Settings.Collect.Has(CollectSession) {
+	if site.Settings.Collect.Has(CollectSession) && !h.Anonymous {
+		if h.Session.IsZero() && !h.preview {
+			h.Session, h.FirstVisit, h.SessionThrottled = m.session(ctx, site.ID, h.PathID, h.UserSessionID, h.UserAgentHeader, h.RemoteAddr)
+		}
+	} else {
+		// Don't calculate any session hash at all; every pageview is counted
+		// as a "first visit", so the visit counts are just the pageviews. The
+		// dashboard and TotalCount.NoSessions label them as pageviews, and the
+		// visitors in ExportAggregate() and the country uniques are left out.
 		h.Session = zint.Uint128{}
+		h.UserSessionID = ""
 		h.FirstVisit = true
 	}
 
+	if site.Settings.CollectExternalOnly && !h.Anonymous {
+		if h.HasExternalRef(site) {
+			if h.Location == "" && site.Settings.Collect.Has(CollectLocation) {
+				var l Location
+				h.Location = l.LookupIP(ctx, h.RemoteAddr)
+			}
+			if h.ASN == 0 && site.Settings.Collect.Has(CollectASN) {
+				a := LookupASN(h.RemoteAddr)
+				h.ASN, h.ASNOrg = a.Number, a.Org
+			}
+			if h.Language == nil && (h.AcceptLanguage != "" || h.CookieLanguage != "") {
+				h.SetLanguage(site.Settings, h.AcceptLanguage, h.CookieLanguage)
+			}
+		} else {
+			h.Location = ""
+			h.Language, h.Languages, h.BrowserLanguage = nil, nil, nil
+			h.ASN, h.ASNOrg = 0, ""
+		}
+	}
+
+	if h.Bot != 0 && h.BotClass == "" { // Before the User-Agent is removed.
+		h.BotClass = GetBotClass(ctx, h.Bot, h.UserAgentHeader)
+	}
+
 	if !site.Settings.Collect.Has(CollectScreenSize) {
 		h.Size = nil
 	}
@@ -320,11 +690,29 @@ func (m *ms) processHit(ctx context.Context, h *Hit) bool {
 		h.SystemID = 0
 	}
 	if !site.Settings.Collect.Has(CollectLanguage) {
-		h.Language = nil
+		h.Language, h.Languages, h.BrowserLanguage = nil, nil, nil
 	}
 	if !site.Settings.Collect.Has(CollectLocation) {
 		h.Location = ""
 	}
+	if !site.Settings.Collect.Has(CollectTLS) {
+		h.TLSVersion, h.TLSCipher = 0, 0
+	}
+	if !site.Settings.Collect.Has(CollectPerf) {
+		h.PerfTTFB, h.PerfDCL, h.PerfLoad = nil, nil, nil
+	}
+	if !site.Settings.Collect.Has(CollectConnection) {
+		h.Conn = ""
+	}
+	if !site.Settings.Collect.Has(CollectSizeBucket) {
+		h.SizeBucket = ""
+	}
+	if !site.Settings.CollectEventValue || !h.Event.Bool() {
+		h.EventValue = nil
+	}
+	if !site.Settings.Collect.Has(CollectASN) {
+		h.ASN, h.ASNOrg = 0, ""
+	}
 	if strings.ContainsRune(h.Location, '-') {
 		trim := !site.Settings.Collect.Has(CollectLocationRegion)
 		if !trim && len(site.Settings.CollectRegions) > 0 {
@@ -341,16 +729,29 @@ func (m *ms) processHit(ctx context.Context, h *Hit) bool {
 	}
 
 	if h.Ignore() {
-		return false
+		return "ignored path"
 	}
 
-	err = h.Validate(ctx, false)
+	// The path and ref aren't inserted for previews, so there are no IDs to
+	// check.
+	err = h.Validate(ctx, h.preview)
 	if err != nil {
 		l.Field("hit", fmt.Sprintf("%#v", h)).Error(err)
-		return false
+		return "not valid: " + err.Error()
 	}
 
-	return true
+	return ""
+}
+
+// SetSessionHasher sets the hash used for sessions.
+//
+// This must be called before Init(), and can't be changed afterwards: stored
+// sessions are discarded in Init() if the algorithm or pepper changed, so the
+// hash is always the same for a salt.
+func (m *ms) SetSessionHasher(h SessionHasher) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	m.hasher = h
 }
 
 func (m *ms) GetSalt() (cur []byte, prev []byte) {
@@ -359,37 +760,81 @@ func (m *ms) GetSalt() (cur []byte, prev []byte) {
 	return m.curSalt, m.prevSalt
 }
 
+// SaltRotation is how often the salt for the session hashes is rotated.
+const SaltRotation = 4 * time.Hour
+
+// SetSaltGrace sets how long the previous salt is still used after it's
+// rotated, so that visitors who were active just before the rotation keep
+// their session. The default is SaltRotation.
+func (m *ms) SetSaltGrace(d time.Duration) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	m.saltGrace = d
+}
+
 func (m *ms) RefreshSalt() {
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
 
-	if m.saltRotated.Add(4 * time.Hour).After(ztime.Now()) {
+	if m.saltRotated.Add(SaltRotation).After(ztime.Now()) {
 		return
 	}
 
 	m.prevSalt = m.curSalt[:]
 	m.curSalt = []byte(zcrypto.Secret256())
+	m.saltRotated = ztime.Now()
+
+	// Sessions are only carried over to the next salt once, so they never last
+	// longer than two rotations.
+	for sID := range m.sessionMoved {
+		m.deleteSession(sID)
+	}
+	clear(m.sessionMoved)
 }
 
+// EvictSessions removes sessions that weren't seen in the last ttl.
+//
 // For 10k sessions this takes about 5ms on my laptop; that's a small enough
 // delay to not overly worry about (there are rarely more than a few hundred
 // sessions at a time).
-func (m *ms) EvictSessions() {
+func (m *ms) EvictSessions(now time.Time, ttl time.Duration) {
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
 
-	ev := ztime.Now().Add(-4 * time.Hour).Unix()
+	ev := now.Add(-ttl).Unix()
 	for sID, seen := range m.sessionSeen {
 		if seen > ev {
 			continue
 		}
+		if min := m.sessionMin[sID]; min > 0 && seen > now.Unix()-min {
+			continue
+		}
 
-		hash := m.sessionHashes[sID]
-		delete(m.sessions, hash)
-		delete(m.sessionPaths, sID)
-		delete(m.sessionSeen, sID)
-		delete(m.sessionHashes, sID)
+		m.deleteSession(sID)
 	}
+	for siteID, w := range m.sessionRate {
+		if w.start < now.Unix()-60 {
+			delete(m.sessionRate, siteID)
+		}
+	}
+}
+
+func (m *ms) deleteSession(sID zint.Uint128) {
+	delete(m.sessions, m.sessionHashes[sID])
+	delete(m.sessionPaths, sID)
+	delete(m.sessionSeen, sID)
+	delete(m.sessionHashes, sID)
+	delete(m.sessionMin, sID)
+	delete(m.sessionMoved, sID)
+}
+
+// inSaltGrace reports if the previous salt can still be used.
+func (m *ms) inSaltGrace() bool {
+	g := m.saltGrace
+	if g == 0 {
+		g = SaltRotation
+	}
+	return m.saltRotated.Add(g).After(ztime.Now())
 }
 
 // SessionID gets a new UUID4 session ID.
@@ -401,36 +846,52 @@ func (m *ms) SessionID() zint.Uint128 {
 	return UUID()
 }
 
-func (m *ms) session(ctx context.Context, siteID, pathID int64, userSessionID, ua, remoteAddr string) (zint.Uint128, zbool.Bool) {
+// session gets the session ID for this visitor.
+//
+// The hash uses the site ID rather than the Host header, so a visitor is in
+// the same session on the site's code subdomain and custom domain.
+//
+// If more than SiteSettings.SessionRateLimit new sessions were started in the
+// current minute no session is started, and the pageview isn't counted as a
+// visitor; throttled is set so these can be reviewed later.
+func (m *ms) session(ctx context.Context, siteID, pathID int64, userSessionID, ua, remoteAddr string) (id zint.Uint128, first, throttled zbool.Bool) {
 	sessionHash := hash{userSessionID}
 
 	if userSessionID == "" {
-		h := sha256.New()
-		h.Write(append(append(append(m.curSalt, ua...), remoteAddr...), strconv.FormatInt(siteID, 10)...))
-		sessionHash = hash{string(h.Sum(nil))}
+		m.sessionMu.RLock()
+		sessionHash = hash{string(m.hasher.Hash(m.curSalt, ua, remoteAddr, siteID))}
+		m.sessionMu.RUnlock()
 	}
 
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
 
 	id, ok := m.sessions[sessionHash]
-	if !ok && userSessionID == "" { // Try previous hash
-		h := sha256.New()
-		h.Write(append(append(append(m.prevSalt, ua...), remoteAddr...), strconv.FormatInt(siteID, 10)...))
-		prev := hash{string(h.Sum(nil))}
+	if !ok && userSessionID == "" && m.inSaltGrace() { // Try previous hash
+		prev := hash{string(m.hasher.Hash(m.prevSalt, ua, remoteAddr, siteID))}
 		id, ok = m.sessions[prev]
 		if ok {
-			sessionHash = prev
+			// Store it with the current hash, so it's still found after the
+			// grace period; it's removed on the next rotation.
+			delete(m.sessions, prev)
+			m.sessions[sessionHash] = id
+			m.sessionHashes[id] = sessionHash
+			m.sessionMoved[id] = struct{}{}
 		}
 	}
 
 	if ok { // Existing session
 		m.sessionSeen[id] = ztime.Now().Unix()
+		m.setSessionMin(ctx, id)
 		_, seenPath := m.sessionPaths[id][pathID]
 		if !seenPath {
 			m.sessionPaths[id][pathID] = struct{}{}
 		}
-		return id, zbool.Bool(!seenPath)
+		return id, zbool.Bool(!seenPath), false
+	}
+
+	if m.throttleSession(ctx, siteID) {
+		return zint.Uint128{}, false, true
 	}
 
 	// New session
@@ -439,5 +900,43 @@ func (m *ms) session(ctx context.Context, siteID, pathID int64, userSessionID, u
 	m.sessionPaths[id] = map[int64]struct{}{pathID: struct{}{}}
 	m.sessionSeen[id] = ztime.Now().Unix()
 	m.sessionHashes[id] = sessionHash
-	return id, true
+	m.setSessionMin(ctx, id)
+	return id, true, false
+}
+
+// throttleSession reports if a new session for this site would exceed
+// SiteSettings.SessionRateLimit, and counts it if it doesn't.
+//
+// This only keeps the count for the current minute, so it uses a fixed amount
+// of memory per site regardless of the number of visitors.
+func (m *ms) throttleSession(ctx context.Context, siteID int64) bool {
+	limit := MustGetSite(ctx).Settings.SessionRateLimit
+	if limit <= 0 {
+		return false
+	}
+	if m.sessionRate == nil {
+		m.sessionRate = make(map[int64]sessionWindow)
+	}
+
+	now := ztime.Now().Unix()
+	w := m.sessionRate[siteID]
+	if w.start != now-now%60 {
+		w = sessionWindow{start: now - now%60}
+	}
+	if w.n >= limit {
+		return true
+	}
+	w.n++
+	m.sessionRate[siteID] = w
+	return false
+}
+
+// setSessionMin records SiteSettings.SessionMinInterval for the session, so
+// EvictSessions() can keep it.
+func (m *ms) setSessionMin(ctx context.Context, id zint.Uint128) {
+	if min := MustGetSite(ctx).Settings.SessionMinInterval; min > 0 {
+		m.sessionMin[id] = int64(min)
+	} else {
+		delete(m.sessionMin, id)
+	}
 }
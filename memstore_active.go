@@ -0,0 +1,134 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"time"
+
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztime"
+)
+
+// DefaultActiveWindow is the default for SetActiveWindow().
+const DefaultActiveWindow = 5 * time.Minute
+
+// maxActive is the maximum number of sessions that are tracked for Active();
+// sessions after that aren't counted until others expire.
+const maxActive = 100_000
+
+func init() { RegisterMemCache("active", memstoreActive{&Memstore}, DefaultActiveWindow) }
+
+// memstoreActive is the MemCache for the active sessions in the memstore.
+type memstoreActive struct{ m *ms }
+
+func (s memstoreActive) Len() int {
+	s.m.activeMu.Lock()
+	defer s.m.activeMu.Unlock()
+	return len(s.m.activeAt)
+}
+
+// Evict removes sessions that weren't seen in the window, or in the ttl if
+// that's shorter.
+func (s memstoreActive) Evict(now time.Time, ttl time.Duration) {
+	s.m.activeMu.Lock()
+	defer s.m.activeMu.Unlock()
+	s.m.evictActive(now.Add(-min(ttl, s.m.activeFor())))
+}
+
+type activePage struct {
+	siteID int64
+	path   string
+}
+
+type activeSession struct {
+	page activePage
+	seen time.Time
+}
+
+// SetActiveWindow sets how long a session is counted as active on a page after
+// its last pageview; see Active(). The default is DefaultActiveWindow.
+func (m *ms) SetActiveWindow(d time.Duration) {
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+	m.activeWindow = d
+}
+
+func (m *ms) activeFor() time.Duration {
+	if m.activeWindow == 0 {
+		return DefaultActiveWindow
+	}
+	return m.activeWindow
+}
+
+// Active gets the number of sessions whose last pageview was for this path in
+// the active window, and the length of the window.
+//
+// This only includes pageviews that were persisted, so it lags by up to the
+// persist interval. Events, bots, and pageviews without a session aren't
+// counted.
+func (m *ms) Active(siteID int64, path string) (int, time.Duration) {
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+
+	var (
+		w     = m.activeFor()
+		after = ztime.Now().Add(-w)
+		n     int
+	)
+	for _, seen := range m.active[activePage{siteID: siteID, path: path}] {
+		if seen.After(after) {
+			n++
+		}
+	}
+	return n, w
+}
+
+// trackActive records the page that the session is on.
+func (m *ms) trackActive(h Hit) {
+	if h.Session.IsZero() || h.Bot != 0 || h.Event.Bool() || !h.isPageview() || h.preview {
+		return
+	}
+
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+	if m.active == nil {
+		m.active = make(map[activePage]map[zint.Uint128]time.Time)
+		m.activeAt = make(map[zint.Uint128]activeSession)
+	}
+
+	page := activePage{siteID: h.Site, path: h.Path}
+	prev, ok := m.activeAt[h.Session]
+	switch {
+	case ok && prev.seen.After(h.CreatedAt): // Already has a later pageview.
+		return
+	case !ok && len(m.activeAt) >= maxActive:
+		return
+	case ok && prev.page != page:
+		m.deleteActive(prev.page, h.Session)
+	}
+
+	if m.active[page] == nil {
+		m.active[page] = make(map[zint.Uint128]time.Time)
+	}
+	m.active[page][h.Session] = h.CreatedAt
+	m.activeAt[h.Session] = activeSession{page: page, seen: h.CreatedAt}
+}
+
+// evictActive removes all sessions that weren't seen after the given time.
+func (m *ms) evictActive(after time.Time) {
+	for id, s := range m.activeAt {
+		if !s.seen.After(after) {
+			m.deleteActive(s.page, id)
+			delete(m.activeAt, id)
+		}
+	}
+}
+
+func (m *ms) deleteActive(page activePage, id zint.Uint128) {
+	delete(m.active[page], id)
+	if len(m.active[page]) == 0 {
+		delete(m.active, page)
+	}
+}
@@ -0,0 +1,484 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/json"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/zint"
+)
+
+// Values for MemstoreLimit.Drop.
+const (
+	DropNew = "new" // Drop new pageviews.
+	DropOld = "old" // Drop the oldest pageviews in the memstore to make room.
+)
+
+// DropPolicies lists all valid values for MemstoreLimit.Drop.
+var DropPolicies = []string{DropNew, DropOld}
+
+// MemstoreLimit limits the number of pageviews kept in the Memstore between
+// calls to Persist().
+type MemstoreLimit struct {
+	// Maximum number of pageviews in memory; 0 is unlimited.
+	Max int
+
+	// What to do with pageviews if both the memory and Overflow are full; one
+	// of the Drop* constants. The default is DropNew.
+	Drop string
+
+	// Write pageviews that don't fit in memory to this queue, rather than
+	// dropping them; nil to always drop them.
+	Overflow *Overflow
+
+	// Maximum number of pageviews to move from the Overflow back to memory on
+	// every Persist(), so a large backlog doesn't get persisted all at once;
+	// 0 means up to Max.
+	Drain int
+}
+
+// Overflow is a bounded on-disk ring buffer of pageviews, used by the Memstore
+// if there are more than MemstoreLimit.Max pageviews.
+//
+// The file starts with a header with the position of the oldest pageview, the
+// number of bytes in use, and the number of pageviews. This is followed by
+// the data area with the pageviews as JSON, each prefixed with the length as a
+// 4-byte integer. Records that don't fit at the end of the data area wrap
+// around to the start.
+//
+// The fields that can identify the visitor (IP address, User-Agent, etc.) are
+// encrypted; see SetKey().
+type Overflow struct {
+	mu    sync.Mutex
+	fp    *os.File
+	aead  cipher.AEAD
+	size  int64 // Size of the data area.
+	head  int64 // Offset of the oldest record in the data area.
+	used  int64 // Number of bytes in use.
+	count int   // Number of records.
+}
+
+const (
+	overflowMagic  = "gcoflow1"
+	overflowHeader = int64(len(overflowMagic) + 8*4) // magic, size, head, used, count
+)
+
+// OpenOverflow opens the overflow file at path, creating it if it doesn't
+// exist, with room for size bytes of pageviews.
+//
+// Pageviews in an existing file are kept; if the size changed then the oldest
+// pageviews are dropped if they don't fit any more.
+func OpenOverflow(path string, size int64) (*Overflow, error) {
+	if size < 1024 {
+		return nil, errors.Errorf("OpenOverflow: size must be at least 1024 bytes, not %d", size)
+	}
+
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "OpenOverflow")
+	}
+	o := &Overflow{fp: fp, size: size}
+	o.setKey([]byte(zcrypto.Secret256()))
+
+	st, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, errors.Wrap(err, "OpenOverflow")
+	}
+	if st.Size() == 0 {
+		return o, errors.Wrap(o.writeHeader(), "OpenOverflow")
+	}
+
+	err = o.readHeader()
+	if err != nil {
+		fp.Close()
+		return nil, errors.Wrapf(err, "OpenOverflow %q", path)
+	}
+	if o.size != size {
+		hits, err := o.pop(o.count)
+		if err != nil {
+			fp.Close()
+			return nil, errors.Wrapf(err, "OpenOverflow %q", path)
+		}
+
+		// Keep the newest pageviews that fit.
+		var (
+			start = len(hits)
+			used  int64
+		)
+		for ; start > 0; start-- {
+			rec, err := overflowRecord(hits[start-1])
+			if err != nil || used+int64(len(rec)) > size {
+				break
+			}
+			used += int64(len(rec))
+		}
+
+		o.size, o.head, o.used, o.count = size, 0, 0, 0
+		err = fp.Truncate(overflowHeader)
+		if err == nil {
+			_, err = o.push(hits[start:])
+		}
+		if err == nil {
+			err = o.writeHeader()
+		}
+		if err != nil {
+			fp.Close()
+			return nil, errors.Wrapf(err, "OpenOverflow %q", path)
+		}
+	}
+	return o, nil
+}
+
+// SetKey sets the key to encrypt the fields that can identify the visitor with;
+// the default is a random key.
+//
+// Pageviews that were written with a different key are still returned by
+// Pop(), but as anonymous pageviews without these fields.
+func (o *Overflow) SetKey(key []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.setKey(key)
+}
+
+func (o *Overflow) setKey(key []byte) {
+	k := sha256.Sum256(key)
+	b, err := aes.NewCipher(k[:])
+	if err != nil {
+		panic(err) // Only for invalid key sizes.
+	}
+	o.aead, err = cipher.NewGCM(b)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Len gets the number of pageviews in the overflow.
+func (o *Overflow) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.count
+}
+
+// Push adds pageviews to the overflow, until it's full; it returns the number
+// of pageviews that were added.
+func (o *Overflow) Push(hits []Hit) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	recs := make([]overflowHit, 0, len(hits))
+	for _, h := range hits {
+		r, err := o.seal(h)
+		if err != nil {
+			return 0, errors.Wrap(err, "Overflow.Push")
+		}
+		recs = append(recs, r)
+	}
+	n, err := o.push(recs)
+	if err != nil {
+		return n, errors.Wrap(err, "Overflow.Push")
+	}
+	if n > 0 {
+		err = o.writeHeader()
+	}
+	return n, errors.Wrap(err, "Overflow.Push")
+}
+
+// Pop removes and returns up to n of the oldest pageviews.
+func (o *Overflow) Pop(n int) ([]Hit, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	recs, err := o.pop(n)
+	hits := make([]Hit, 0, len(recs))
+	for _, r := range recs {
+		hits = append(hits, o.open(r))
+	}
+	if err != nil {
+		o.writeHeader() // Still need to store the records that were removed.
+		return hits, errors.Wrap(err, "Overflow.Pop")
+	}
+	if len(hits) > 0 {
+		err = o.writeHeader()
+	}
+	return hits, errors.Wrap(err, "Overflow.Pop")
+}
+
+// Close the file; any pageviews are kept for the next OpenOverflow().
+func (o *Overflow) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.fp.Close()
+}
+
+func (o *Overflow) push(hits []overflowHit) (int, error) {
+	for i, h := range hits {
+		rec, err := overflowRecord(h)
+		if err != nil {
+			return i, err
+		}
+		if int64(len(rec)) > o.size-o.used {
+			return i, nil
+		}
+
+		err = o.writeAt(rec, (o.head+o.used)%o.size)
+		if err != nil {
+			return i, err
+		}
+		o.used += int64(len(rec))
+		o.count++
+	}
+	return len(hits), nil
+}
+
+// overflowRecord encodes the hit as a record: the length as a 4-byte integer,
+// followed by the JSON.
+func overflowRecord(h overflowHit) ([]byte, error) {
+	d, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return append(binary.BigEndian.AppendUint32(make([]byte, 0, len(d)+4), uint32(len(d))), d...), nil
+}
+
+func (o *Overflow) pop(n int) ([]overflowHit, error) {
+	n = min(n, o.count)
+	hits := make([]overflowHit, 0, n)
+	l := make([]byte, 4)
+	for i := 0; i < n; i++ {
+		err := o.readAt(l, o.head)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return hits, o.corrupt("file is truncated")
+			}
+			return hits, err
+		}
+		recLen := 4 + int64(binary.BigEndian.Uint32(l))
+		if recLen > o.used {
+			return hits, o.corrupt("record length %d larger than %d bytes in use", recLen, o.used)
+		}
+
+		d := make([]byte, recLen-4)
+		err = o.readAt(d, (o.head+4)%o.size)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return hits, o.corrupt("file is truncated")
+			}
+			return hits, err
+		}
+		o.head = (o.head + recLen) % o.size
+		o.used -= recLen
+		o.count--
+
+		var h overflowHit
+		err = json.Unmarshal(d, &h)
+		if err != nil {
+			return hits, o.corrupt("%s", err)
+		}
+		hits = append(hits, h)
+	}
+	if o.count == 0 {
+		o.head = 0
+	}
+	return hits, nil
+}
+
+// corrupt discards everything; there is no way to find the start of the next
+// record.
+func (o *Overflow) corrupt(msg string, args ...any) error {
+	err := fmt.Errorf("corrupt file; discarding %d pageviews: "+msg, append([]any{o.count}, args...)...)
+	o.head, o.used, o.count = 0, 0, 0
+	return err
+}
+
+// Read or write at offset in the data area, wrapping around to the start if
+// needed.
+func (o *Overflow) readAt(b []byte, off int64) error {
+	n := min(int64(len(b)), o.size-off)
+	_, err := o.fp.ReadAt(b[:n], overflowHeader+off)
+	if err == nil && n < int64(len(b)) {
+		_, err = o.fp.ReadAt(b[n:], overflowHeader)
+	}
+	return err
+}
+
+func (o *Overflow) writeAt(b []byte, off int64) error {
+	n := min(int64(len(b)), o.size-off)
+	_, err := o.fp.WriteAt(b[:n], overflowHeader+off)
+	if err == nil && n < int64(len(b)) {
+		_, err = o.fp.WriteAt(b[n:], overflowHeader)
+	}
+	return err
+}
+
+func (o *Overflow) writeHeader() error {
+	b := make([]byte, 0, overflowHeader)
+	b = append(b, overflowMagic...)
+	for _, v := range []int64{o.size, o.head, o.used, int64(o.count)} {
+		b = binary.BigEndian.AppendUint64(b, uint64(v))
+	}
+	_, err := o.fp.WriteAt(b, 0)
+	return err
+}
+
+func (o *Overflow) readHeader() error {
+	b := make([]byte, overflowHeader)
+	_, err := o.fp.ReadAt(b, 0)
+	if errors.Is(err, io.EOF) {
+		return errors.New("not an overflow file")
+	}
+	if err != nil {
+		return err
+	}
+	if string(b[:len(overflowMagic)]) != overflowMagic {
+		return errors.New("not an overflow file")
+	}
+	b = b[len(overflowMagic):]
+	o.size = int64(binary.BigEndian.Uint64(b))
+	o.head = int64(binary.BigEndian.Uint64(b[8:]))
+	o.used = int64(binary.BigEndian.Uint64(b[16:]))
+	o.count = int(binary.BigEndian.Uint64(b[24:]))
+	if o.size <= 0 || o.head < 0 || o.head >= o.size || o.used < 0 || o.used > o.size || o.count < 0 {
+		return errors.New("invalid header")
+	}
+	return nil
+}
+
+// overflowHit is a Hit as stored in the Overflow; Hit can't be used directly
+// as most fields aren't in the JSON.
+//
+// Every field of Hit that's set before the memstore processes it should be in
+// either overflowHit or overflowPrivate; TestOverflowFields checks this.
+type overflowHit struct {
+	Site            int64        `json:"site"`
+	PathID          int64        `json:"path_id,omitempty"`
+	RefID           int64        `json:"ref_id,omitempty"`
+	Session         zint.Uint128 `json:"session,omitempty"`
+	Path            string       `json:"path,omitempty"`
+	Title           string       `json:"title,omitempty"`
+	Ref             string       `json:"ref,omitempty"`
+	RefScheme       *string      `json:"ref_scheme,omitempty"`
+	Event           zbool.Bool   `json:"event,omitempty"`
+	Size            Floats       `json:"size,omitempty"`
+	Query           string       `json:"query,omitempty"`
+	Bot             int          `json:"bot,omitempty"`
+	Type            string       `json:"type,omitempty"`
+	TZOffset        *int         `json:"tz_offset,omitempty"`
+	Authed          *zbool.Bool  `json:"authed,omitempty"`
+	PerfTTFB        *int         `json:"perf_ttfb,omitempty"`
+	PerfDCL         *int         `json:"perf_dcl,omitempty"`
+	PerfLoad        *int         `json:"perf_load,omitempty"`
+	Conn            string       `json:"conn,omitempty"`
+	SizeBucket      string       `json:"size_bucket,omitempty"`
+	Platform        string       `json:"platform,omitempty"`
+	EventValue      *float64     `json:"event_value,omitempty"`
+	FetchSite       string       `json:"fetch_site,omitempty"`
+	ASN             uint32       `json:"asn,omitempty"`
+	ASNOrg          string       `json:"asn_org,omitempty"`
+	Location        string       `json:"location,omitempty"`
+	Language        *string      `json:"language,omitempty"`
+	Languages       Strings      `json:"languages,omitempty"`
+	BrowserLanguage *string      `json:"browser_language,omitempty"`
+	FirstVisit      zbool.Bool   `json:"first_visit,omitempty"`
+	CreatedAt       time.Time    `json:"created_at"`
+	TLSVersion      uint16       `json:"tls_version,omitempty"`
+	TLSCipher       uint16       `json:"tls_cipher,omitempty"`
+	PrevPath        string       `json:"prev_path,omitempty"`
+	Anonymous       bool         `json:"anonymous,omitempty"`
+	RefHidden       bool         `json:"ref_hidden,omitempty"`
+	RefSource       string       `json:"ref_source,omitempty"`
+	ClientHints     ClientHints  `json:"client_hints"`
+	ServerClient    bool         `json:"server_client,omitempty"`
+	TruncatedFrom   int          `json:"truncated_from,omitempty"`
+	SampleWeight    int          `json:"sample_weight,omitempty"`
+
+	// overflowPrivate, encrypted with the nonce prepended.
+	Private []byte `json:"private,omitempty"`
+}
+
+// overflowPrivate are the fields of a Hit that can identify the visitor.
+type overflowPrivate struct {
+	RemoteAddr      string `json:"remote_addr,omitempty"`
+	UserAgentHeader string `json:"user_agent,omitempty"`
+	UserSessionID   string `json:"user_session_id,omitempty"`
+	AcceptLanguage  string `json:"accept_language,omitempty"`
+	CookieLanguage  string `json:"cookie_language,omitempty"`
+}
+
+func (o *Overflow) seal(h Hit) (overflowHit, error) {
+	r := overflowHit{
+		Site: h.Site, PathID: h.PathID, RefID: h.RefID, Session: h.Session,
+		Path: h.Path, Title: h.Title, Ref: h.Ref, RefScheme: h.RefScheme,
+		Event: h.Event, Size: h.Size, Query: h.Query, Bot: h.Bot, Type: h.Type,
+		TZOffset: h.TZOffset, Authed: h.Authed,
+		PerfTTFB: h.PerfTTFB, PerfDCL: h.PerfDCL, PerfLoad: h.PerfLoad, Conn: h.Conn, SizeBucket: h.SizeBucket, Platform: h.Platform, EventValue: h.EventValue, FetchSite: h.FetchSite, ASN: h.ASN, ASNOrg: h.ASNOrg,
+		Location: h.Location, Language: h.Language, Languages: h.Languages, BrowserLanguage: h.BrowserLanguage, FirstVisit: h.FirstVisit,
+		CreatedAt: h.CreatedAt, TLSVersion: h.TLSVersion, TLSCipher: h.TLSCipher,
+		PrevPath:  h.PrevPath,
+		Anonymous: h.Anonymous, RefHidden: h.RefHidden, RefSource: h.RefSource, ClientHints: h.ClientHints,
+		ServerClient: h.ServerClient, TruncatedFrom: h.TruncatedFrom, SampleWeight: h.SampleWeight,
+	}
+
+	p := overflowPrivate{RemoteAddr: h.RemoteAddr, UserAgentHeader: h.UserAgentHeader,
+		UserSessionID: h.UserSessionID, AcceptLanguage: h.AcceptLanguage, CookieLanguage: h.CookieLanguage}
+	if p == (overflowPrivate{}) {
+		return r, nil
+	}
+	d, err := json.Marshal(p)
+	if err != nil {
+		return r, err
+	}
+	nonce := make([]byte, o.aead.NonceSize(), o.aead.NonceSize()+len(d)+o.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return r, err
+	}
+	r.Private = o.aead.Seal(nonce, nonce, d, nil)
+	return r, nil
+}
+
+func (o *Overflow) open(r overflowHit) Hit {
+	h := Hit{
+		Site: r.Site, PathID: r.PathID, RefID: r.RefID, Session: r.Session,
+		Path: r.Path, Title: r.Title, Ref: r.Ref, RefScheme: r.RefScheme,
+		Event: r.Event, Size: r.Size, Query: r.Query, Bot: r.Bot, Type: r.Type,
+		TZOffset: r.TZOffset, Authed: r.Authed,
+		PerfTTFB: r.PerfTTFB, PerfDCL: r.PerfDCL, PerfLoad: r.PerfLoad, Conn: r.Conn, SizeBucket: r.SizeBucket, Platform: r.Platform, EventValue: r.EventValue, FetchSite: r.FetchSite, ASN: r.ASN, ASNOrg: r.ASNOrg,
+		Location: r.Location, Language: r.Language, Languages: r.Languages, BrowserLanguage: r.BrowserLanguage, FirstVisit: r.FirstVisit,
+		CreatedAt: r.CreatedAt, TLSVersion: r.TLSVersion, TLSCipher: r.TLSCipher,
+		PrevPath:  r.PrevPath,
+		Anonymous: r.Anonymous, RefHidden: r.RefHidden, RefSource: r.RefSource, ClientHints: r.ClientHints,
+		ServerClient: r.ServerClient, TruncatedFrom: r.TruncatedFrom, SampleWeight: r.SampleWeight,
+	}
+	if len(r.Private) == 0 {
+		return h
+	}
+
+	var p overflowPrivate
+	ns := o.aead.NonceSize()
+	d, err := o.aead.Open(nil, r.Private[:min(ns, len(r.Private))], r.Private[min(ns, len(r.Private)):], nil)
+	if err == nil {
+		err = json.Unmarshal(d, &p)
+	}
+	if err != nil { // Written with a different key.
+		h.Anonymous = true
+		return h
+	}
+	h.RemoteAddr, h.UserAgentHeader, h.UserSessionID = p.RemoteAddr, p.UserAgentHeader, p.UserSessionID
+	h.AcceptLanguage, h.CookieLanguage = p.AcceptLanguage, p.CookieLanguage
+	return h
+}
@@ -0,0 +1,99 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestOverflowFields checks that everything in Hit survives the Overflow, so
+// that adding a field to Hit doesn't silently lose it for pageviews that got
+// spilled to disk.
+func TestOverflowFields(t *testing.T) {
+	// Set in the handler before Memstore.Append(), or (re)set from the other
+	// fields when the pageview is processed.
+	skip := map[string]bool{
+		"ID": true, "PrevPathID": true, "SizeID": true, "BrowserID": true,
+		"SystemID": true, "CampaignID": true, "BotClass": true,
+		"NavType": true, "SourceName": true, "ExperimentHash": true,
+		"SessionThrottled": true, "Webdriver": true, "DwellMs": true,
+		"RefURL": true, "Random": true, "Signature": true, "RequestID": true,
+		"RefDomain": true, "Canonical": true,
+	}
+
+	stored := make(map[string]bool)
+	for _, typ := range []reflect.Type{reflect.TypeOf(overflowHit{}), reflect.TypeOf(overflowPrivate{})} {
+		for i := 0; i < typ.NumField(); i++ {
+			stored[typ.Field(i).Name] = true
+		}
+	}
+
+	var h Hit
+	hv := reflect.ValueOf(&h).Elem()
+	for i := 0; i < hv.NumField(); i++ {
+		f := hv.Type().Field(i)
+		if !f.IsExported() || skip[f.Name] {
+			continue
+		}
+		if !stored[f.Name] {
+			t.Errorf("Hit.%s not in overflowHit or overflowPrivate", f.Name)
+		}
+		fillValue(hv.Field(i))
+	}
+
+	o := &Overflow{}
+	o.setKey([]byte("key"))
+	r, err := o.seal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := reflect.ValueOf(o.open(r))
+	for i := 0; i < hv.NumField(); i++ {
+		f := hv.Type().Field(i)
+		if !f.IsExported() || skip[f.Name] {
+			continue
+		}
+		if a, b := hv.Field(i).Interface(), have.Field(i).Interface(); !reflect.DeepEqual(a, b) {
+			t.Errorf("Hit.%s: %#v; want %#v", f.Name, b, a)
+		}
+	}
+}
+
+func fillValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillValue(v.Elem())
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillValue(v.Index(0))
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			fillValue(v.Index(i))
+		}
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			v.Set(reflect.ValueOf(time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				fillValue(v.Field(i))
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+)
+
+func overflowHits(from, to int) []Hit {
+	hits := make([]Hit, 0, to-from)
+	for i := from; i < to; i++ {
+		hits = append(hits, Hit{
+			Site:            1,
+			Path:            fmt.Sprintf("/%d", i),
+			UserAgentHeader: "test",
+			CreatedAt:       time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC),
+		})
+	}
+	return hits
+}
+
+func overflowPaths(hits []Hit) string {
+	var s string
+	for _, h := range hits {
+		s += h.Path + " "
+	}
+	return s
+}
+
+func TestOverflow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overflow")
+	o, err := OpenOverflow(path, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.SetKey([]byte("key"))
+
+	n, err := o.Push(overflowHits(0, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n == 100 || o.Len() != n {
+		t.Fatalf("n=%d; Len()=%d", n, o.Len())
+	}
+	full := n
+
+	// Wrap around a few times.
+	next := full
+	for i := 0; i < 5; i++ {
+		hits, err := o.Pop(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 3 {
+			t.Fatalf("popped %d", len(hits))
+		}
+		n, err := o.Push(overflowHits(next, next+3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 {
+			t.Fatalf("pushed %d", n)
+		}
+		next += 3
+	}
+
+	// Reopen with the same size.
+	err = o.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(d, []byte(`"test"`)) {
+		t.Error("User-Agent stored in plain text")
+	}
+	o, err = OpenOverflow(path, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.SetKey([]byte("key"))
+	hits, err := o.Pop(full + 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := overflowPaths(overflowHits(15, next))
+	if have := overflowPaths(hits); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+	if h := hits[0]; h.UserAgentHeader != "test" || h.Site != 1 || !h.CreatedAt.Equal(time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("%#v", h)
+	}
+	if o.Len() != 0 {
+		t.Errorf("Len(): %d", o.Len())
+	}
+
+	// Can't decrypt with a different key.
+	o.Push(overflowHits(0, 1))
+	o.SetKey([]byte("other"))
+	hits, err = o.Pop(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := hits[0]; h.UserAgentHeader != "" || !h.Anonymous || h.Path != "/0" {
+		t.Errorf("%#v", h)
+	}
+
+	// Keep the newest that fit if the size is reduced.
+	o.Push(overflowHits(0, full))
+	o.Close()
+	o, err = OpenOverflow(path, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Len() != full {
+		t.Errorf("Len(): %d", o.Len())
+	}
+	n, _ = o.Push(overflowHits(full, 100))
+	last := full + n
+	o.Close()
+	_, err = OpenOverflow(path, 1000)
+	if !ztest.ErrorContains(err, "at least 1024 bytes") {
+		t.Fatal(err)
+	}
+	o, err = OpenOverflow(path, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, err = o.Pop(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = overflowPaths(overflowHits(last-len(hits), last))
+	if have := overflowPaths(hits); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+	if len(hits) < full-2 || len(hits) > full {
+		t.Errorf("len: %d; full: %d", len(hits), full)
+	}
+	o.Close()
+
+	err = os.WriteFile(path, []byte("not an overflow file; some other data"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenOverflow(path, 1024)
+	if !ztest.ErrorContains(err, "not an overflow file") {
+		t.Fatal(err)
+	}
+}
+
+func TestMemstoreOverflow(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	o, err := OpenOverflow(filepath.Join(t.TempDir(), "overflow"), 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	Memstore.SetLimit(MemstoreLimit{Max: 10, Overflow: o, Drain: 4})
+	defer Memstore.SetLimit(MemstoreLimit{})
+
+	var persisted int
+	persist := func() {
+		t.Helper()
+		hits, err := Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		persisted += len(hits)
+	}
+	count := func() int {
+		t.Helper()
+		var n int
+		err := zdb.Get(ctx, &n, `select count(*) from hits`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// Burst over the limit.
+	for i := 0; i < 50; i++ {
+		Memstore.Append(gen(ctx))
+	}
+	if Memstore.Len() != 10 || o.Len() != 40 {
+		t.Fatalf("memory: %d; disk: %d", Memstore.Len(), o.Len())
+	}
+
+	// Nothing is drained while the memory is full.
+	persist()
+	if persisted != 10 || o.Len() != 40 || Memstore.Len() != 0 {
+		t.Fatalf("persisted: %d; memory: %d; disk: %d", persisted, Memstore.Len(), o.Len())
+	}
+
+	// Drain at most 4 at a time.
+	persist()
+	if persisted != 14 || o.Len() != 36 {
+		t.Fatalf("persisted: %d; memory: %d; disk: %d", persisted, Memstore.Len(), o.Len())
+	}
+	for i := 0; i < 10; i++ {
+		Memstore.Append(gen(ctx))
+	}
+	persist()
+	if persisted != 24 || o.Len() != 36 {
+		t.Fatalf("persisted: %d; memory: %d; disk: %d", persisted, Memstore.Len(), o.Len())
+	}
+
+	for i := 0; i < 9; i++ {
+		persist()
+	}
+	if persisted != 60 || o.Len() != 0 {
+		t.Fatalf("persisted: %d; memory: %d; disk: %d", persisted, Memstore.Len(), o.Len())
+	}
+	if c := count(); c != 60 {
+		t.Fatalf("count: %d", c)
+	}
+}
+
+func TestMemstoreDrop(t *testing.T) {
+	tests := []struct {
+		drop   string
+		hasOvf bool
+		want   string
+	}{
+		{DropNew, false, "/0 /1 /2 "},
+		{DropOld, false, "/7 /8 /9 "},
+		{DropNew, true, "/0 /1 /2 "},
+		{DropOld, true, "/1 /2 /9 "},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%t", tt.drop, tt.hasOvf), func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			l := MemstoreLimit{Max: 3, Drop: tt.drop}
+			if tt.hasOvf {
+				o, err := OpenOverflow(filepath.Join(t.TempDir(), "overflow"), 1400)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer o.Close()
+				l.Overflow = o
+			}
+			Memstore.SetLimit(l)
+			defer Memstore.SetLimit(MemstoreLimit{})
+
+			hits := overflowHits(0, 10)
+			for i := range hits {
+				hits[i].Site = MustGetSite(ctx).ID
+			}
+			Memstore.Append(hits...)
+			if Memstore.Len() != 3 {
+				t.Fatalf("Len(): %d", Memstore.Len())
+			}
+
+			have, err := Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p := overflowPaths(have); p != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", p, tt.want)
+			}
+			if tt.hasOvf && l.Overflow.Len() == 0 {
+				t.Error("nothing in overflow")
+			}
+		})
+	}
+}
@@ -6,13 +6,19 @@ package goatcounter_test
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/zdb"
 	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztest"
 	"zgo.at/zstd/ztime"
+	"zgo.at/zstd/ztype"
 )
 
 func TestMemstore(t *testing.T) {
@@ -160,3 +166,517 @@ func TestMemstoreCollect(t *testing.T) {
 		})
 	}
 }
+
+func TestMemstoreNoSessions(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	site.Settings.Collect ^= CollectSession
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+	Memstore.Append(
+		Hit{Site: site.ID, CreatedAt: now, Path: "/a", UserAgentHeader: "test", RemoteAddr: "1.1.1.1"},
+		Hit{Site: site.ID, CreatedAt: now, Path: "/a", UserAgentHeader: "test", RemoteAddr: "1.1.1.1"},
+		Hit{Site: site.ID, CreatedAt: now, Path: "/b", UserSessionID: "xxx"},
+	)
+	hits, err := Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := Memstore.SessionsLen(); n != 0 {
+		t.Errorf("SessionsLen() = %d", n)
+	}
+	if len(hits) != 3 {
+		t.Fatalf("len(hits) = %d", len(hits))
+	}
+	for _, h := range hits {
+		if !h.Session.IsZero() || !h.FirstVisit.Bool() {
+			t.Errorf("Session=%s; FirstVisit=%t", h.Session, h.FirstVisit)
+		}
+	}
+
+	err = cron.UpdateStats(ctx, site, site.ID, hits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, err := GetTotalCount(ctx, ztime.NewRange(now.Add(-time.Hour)).To(now.Add(time.Hour)), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total.Total != 3 || !total.NoSessions {
+		t.Errorf("total = %d; NoSessions = %t", total.Total, total.NoSessions)
+	}
+}
+
+func TestMemstoreCollectExternalOnly(t *testing.T) {
+	tests := []struct {
+		linkDomain string
+		want       []string
+	}{
+		{"example.com", []string{
+			`/a "www.arp242.net/x" IE eng`,
+			`/a "Google" IE eng`,
+			`/a "newsletter" IE eng`,
+			`/a "example.com/other"  <nil>`,
+			`/a "www.example.com/other"  <nil>`,
+			`/a "example.com.evil.org/x" IE eng`,
+			`/a "example.community/x" IE eng`,
+			`/a ""  <nil>`,
+		}},
+		// Can't tell internal navigation apart; only campaigns are external.
+		{"", []string{
+			`/a "www.arp242.net/x"  <nil>`,
+			`/a "Google"  <nil>`,
+			`/a "newsletter" IE eng`,
+			`/a "example.com/other"  <nil>`,
+			`/a "www.example.com/other"  <nil>`,
+			`/a "example.com.evil.org/x"  <nil>`,
+			`/a "example.community/x"  <nil>`,
+			`/a ""  <nil>`,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.linkDomain, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := MustGetSite(ctx)
+			site.LinkDomain = tt.linkDomain
+			site.Settings.Collect |= CollectLanguage
+			site.Settings.CollectExternalOnly = true
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hit := func(ref, query string) Hit {
+				return Hit{Site: site.ID, Path: "/a", Ref: ref, Query: query,
+					RemoteAddr: "51.171.91.33", AcceptLanguage: "en-US,en;q=0.5"}
+			}
+			Memstore.Append(
+				hit("https://www.arp242.net/x", ""),
+				hit("https://www.google.com/search", ""),
+				hit("", "utm_source=newsletter"),
+				hit("https://example.com/other", ""),
+				hit("https://www.example.com/other", ""),
+				hit("https://example.com.evil.org/x", ""),
+				hit("https://example.community/x", ""),
+				hit("", ""),
+			)
+			hits, err := Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var have []string
+			for _, h := range hits {
+				have = append(have, fmt.Sprintf("%s %q %s %v", h.Path, h.Ref, h.Location, ztype.Deref(h.Language, "<nil>")))
+			}
+			if d := ztest.Diff(strings.Join(have, "\n"), strings.Join(tt.want, "\n")); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestMemstoreSaltGrace(t *testing.T) {
+	tests := []struct {
+		name      string
+		grace     time.Duration
+		after     time.Duration // Time after the rotation for the second pageview.
+		wantFirst bool
+	}{
+		{"within grace", time.Minute, 30 * time.Second, false},
+		{"beyond grace", time.Minute, 2 * time.Minute, true},
+		{"default", 0, 3 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			site := MustGetSite(ctx)
+			Memstore.SetSaltGrace(tt.grace)
+			t.Cleanup(func() { Memstore.SetSaltGrace(0) })
+
+			ztime.SetNow(t, "2020-06-18 12:00:00")
+			Memstore.Reset()
+
+			send := func(at time.Time) Hit {
+				t.Helper()
+				ztime.SetNow(t, at.Format("2006-01-02 15:04:05"))
+				Memstore.Append(Hit{Site: site.ID, Path: "/a", UserAgentHeader: "test", RemoteAddr: "1.1.1.1", CreatedAt: at})
+				hits, err := Memstore.Persist(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(hits) != 1 {
+					t.Fatalf("len(hits) = %d", len(hits))
+				}
+				return hits[0]
+			}
+
+			rotate := ztime.FromString("2020-06-18 12:00:00").Add(SaltRotation)
+			first := send(rotate.Add(-time.Second))
+
+			ztime.SetNow(t, rotate.Format("2006-01-02 15:04:05"))
+			Memstore.RefreshSalt()
+			if cur, prev := Memstore.GetSalt(); string(cur) == string(prev) {
+				t.Fatal("salt not rotated")
+			}
+
+			second := send(rotate.Add(tt.after))
+			if bool(second.FirstVisit) != tt.wantFirst {
+				t.Errorf("FirstVisit=%t; want %t (sessions %s and %s)", second.FirstVisit, tt.wantFirst,
+					first.Session, second.Session)
+			}
+			if !tt.wantFirst && second.Session != first.Session {
+				t.Errorf("different session: %s and %s", first.Session, second.Session)
+			}
+
+			// Still the same session after the grace period, as it's now
+			// stored with the current salt.
+			if !tt.wantFirst {
+				third := send(rotate.Add(tt.after + SaltRotation - time.Minute))
+				if third.FirstVisit || third.Session != first.Session {
+					t.Errorf("new session after the grace period: %s %t", third.Session, third.FirstVisit)
+				}
+
+				// But not carried over to the salt after that.
+				next := rotate.Add(tt.after + SaltRotation)
+				ztime.SetNow(t, next.Format("2006-01-02 15:04:05"))
+				Memstore.RefreshSalt()
+				fourth := send(next.Add(time.Second))
+				if !fourth.FirstVisit || fourth.Session == first.Session {
+					t.Errorf("same session after two rotations: %s %t", fourth.Session, fourth.FirstVisit)
+				}
+			}
+		})
+	}
+}
+
+func TestMemstoreLocalRefs(t *testing.T) {
+	refs := []string{
+		"http://localhost:8080/index.html",
+		"http://localhost/",
+		"https://stats.localhost/x",
+		"http://127.0.0.1:8000",
+		"http://[::1]:8000/x",
+		"file:///home/martin/site/index.html",
+		"https://example.com/x",
+		"",
+	}
+	tests := []struct {
+		localRefs bool
+		want      []string
+	}{
+		// localhost is on the spam list, but not with a port.
+		{false, []string{
+			`"localhost:8080/index.html"`,
+			`"127.0.0.1:8000"`,
+			`"[::1]:8000/x"`,
+			`"home/martin/site/index.html"`,
+			`"example.com/x"`,
+			`""`,
+		}},
+		{true, []string{
+			`"(local)"`,
+			`"(local)"`,
+			`"(local)"`,
+			`"(local)"`,
+			`"(local)"`,
+			`"(local)"`,
+			`"example.com/x"`,
+			`""`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%t", tt.localRefs), func(t *testing.T) {
+			ctx := gctest.DB(t)
+			Config(ctx).LocalRefs = tt.localRefs
+
+			site := MustGetSite(ctx)
+			site.Settings.InternalRefs = InternalRefsKeep
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range refs {
+				Memstore.Append(Hit{Site: site.ID, Path: "/a", Ref: r})
+			}
+			hits, err := Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var have []string
+			for _, h := range hits {
+				have = append(have, fmt.Sprintf("%q", h.Ref))
+			}
+			if d := ztest.Diff(strings.Join(have, "\n"), strings.Join(tt.want, "\n")); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestMemstoreInternalRefs(t *testing.T) {
+	refs := []string{
+		"http://192.168.1.10/admin",
+		"http://10.0.0.5:8080/x",
+		"https://172.16.3.4/",
+		"http://[fd00::1]/x",
+		"http://169.254.1.1/x",
+		"http://localhost/",
+		"http://localhost:3000/",
+		"https://printer.local/status",
+		"https://wiki.corp.internal/page",
+		"https://example.com/x",
+		"https://172.32.0.1/x",
+		"http://8.8.8.8/x",
+	}
+	tests := []struct {
+		setting string
+		want    []string
+	}{
+		{InternalRefsGroup, []string{
+			`"(internal)"`, `"(internal)"`, `"(internal)"`, `"(internal)"`, `"(internal)"`,
+			`"(internal)"`, `"(internal)"`, `"(internal)"`, `"(internal)"`,
+			`"example.com/x"`, `"172.32.0.1/x"`, `"8.8.8.8/x"`,
+		}},
+		{InternalRefsDrop, []string{
+			`""`, `""`, `""`, `""`, `""`, `""`, `""`, `""`, `""`,
+			`"example.com/x"`, `"172.32.0.1/x"`, `"8.8.8.8/x"`,
+		}},
+		// localhost is on the spam list, but not with a port.
+		{InternalRefsKeep, []string{
+			`"192.168.1.10/admin"`, `"10.0.0.5:8080/x"`, `"172.16.3.4"`, `"[fd00::1]/x"`, `"169.254.1.1/x"`,
+			`"localhost:3000"`, `"printer.local/status"`, `"wiki.corp.internal/page"`,
+			`"example.com/x"`, `"172.32.0.1/x"`, `"8.8.8.8/x"`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.setting, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := MustGetSite(ctx)
+			site.Settings.InternalRefs = tt.setting
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range refs {
+				Memstore.Append(Hit{Site: site.ID, Path: "/a", Ref: r})
+			}
+			hits, err := Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var have []string
+			for _, h := range hits {
+				have = append(have, fmt.Sprintf("%q", h.Ref))
+			}
+			if d := ztest.Diff(strings.Join(have, "\n"), strings.Join(tt.want, "\n")); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestMemstoreSessionMinInterval(t *testing.T) {
+	tests := []struct {
+		name      string
+		min       int
+		after     time.Duration
+		wantFirst bool
+	}{
+		{"disabled", 0, 10 * time.Second, true},
+		{"within interval", 60, 10 * time.Second, false},
+		{"after interval", 60, 90 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gctest.DB(t)
+			site := MustGetSite(ctx)
+			site.Settings.SessionMinInterval = tt.min
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ztime.SetNow(t, "2020-06-18 12:00:00")
+			Memstore.Reset()
+
+			send := func(at time.Time) Hit {
+				t.Helper()
+				ztime.SetNow(t, at.Format("2006-01-02 15:04:05"))
+				Memstore.Append(Hit{Site: site.ID, Path: "/a", UserAgentHeader: "test", RemoteAddr: "1.1.1.1", CreatedAt: at})
+				hits, err := Memstore.Persist(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(hits) != 1 {
+					t.Fatalf("len(hits) = %d", len(hits))
+				}
+				return hits[0]
+			}
+
+			// Evict everything after every pageview, as if the memory budget
+			// is exceeded.
+			start := ztime.FromString("2020-06-18 12:00:00")
+			first := send(start)
+			for i := 1; i <= 5; i++ {
+				Memstore.EvictSessions(start.Add(time.Duration(i)*time.Second), 0)
+				if h := send(start.Add(time.Duration(i) * time.Second)); tt.min > 0 && (h.FirstVisit || h.Session != first.Session) {
+					t.Fatalf("new session after %ds: %s %t", i, h.Session, h.FirstVisit)
+				}
+			}
+
+			last := start.Add(5 * time.Second)
+			Memstore.EvictSessions(last.Add(tt.after), 0)
+			h := send(last.Add(tt.after))
+			if bool(h.FirstVisit) != tt.wantFirst {
+				t.Errorf("FirstVisit=%t; want %t", h.FirstVisit, tt.wantFirst)
+			}
+			if tt.wantFirst == (h.Session == first.Session) {
+				t.Errorf("session: %s; first: %s", h.Session, first.Session)
+			}
+		})
+	}
+}
+
+func TestMemstoreActive(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+	Memstore.SetActiveWindow(5 * time.Minute)
+	t.Cleanup(func() { Memstore.SetActiveWindow(0) })
+
+	send := func(at string, hits ...Hit) {
+		t.Helper()
+		ztime.SetNow(t, at)
+		for i := range hits {
+			hits[i].Site, hits[i].CreatedAt = site.ID, ztime.Now()
+			if hits[i].UserAgentHeader == "" {
+				hits[i].UserAgentHeader = "test"
+			}
+		}
+		Memstore.Append(hits...)
+		_, err := Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	active := func(path string) int {
+		t.Helper()
+		n, w := Memstore.Active(site.ID, path)
+		if w != 5*time.Minute {
+			t.Errorf("window: %s", w)
+		}
+		return n
+	}
+
+	send("2020-06-18 12:00:00",
+		Hit{Path: "/a", RemoteAddr: "1.1.1.1"},
+		Hit{Path: "/a", RemoteAddr: "1.1.1.1"}, // Same session.
+		Hit{Path: "/a", RemoteAddr: "2.2.2.2"},
+		Hit{Path: "/b", RemoteAddr: "3.3.3.3"},
+		Hit{Path: "/a", RemoteAddr: "4.4.4.4", Bot: 150},
+		Hit{Path: "/a", RemoteAddr: "5.5.5.5", Event: true})
+	if a, b := active("/a"), active("/b"); a != 2 || b != 1 {
+		t.Errorf("/a: %d; /b: %d", a, b)
+	}
+	if n, _ := Memstore.Active(site.ID+1, "/a"); n != 0 {
+		t.Errorf("other site: %d", n)
+	}
+
+	// Moved to another page.
+	send("2020-06-18 12:03:00", Hit{Path: "/b", RemoteAddr: "2.2.2.2"})
+	if a, b := active("/a"), active("/b"); a != 1 || b != 2 {
+		t.Errorf("/a: %d; /b: %d", a, b)
+	}
+
+	// Expired out of the window; only counted again on the next pageview.
+	ztime.SetNow(t, "2020-06-18 12:06:00")
+	if a, b := active("/a"), active("/b"); a != 0 || b != 1 {
+		t.Errorf("/a: %d; /b: %d", a, b)
+	}
+	EvictMemCaches(ztime.Now())
+	send("2020-06-18 12:07:00", Hit{Path: "/a", RemoteAddr: "1.1.1.1"})
+	if a, b := active("/a"), active("/b"); a != 1 || b != 1 {
+		t.Errorf("/a: %d; /b: %d", a, b)
+	}
+}
+
+func TestMemstoreSessionRateLimit(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+	site.Settings.SessionRateLimit = 3
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ztime.SetNow(t, "2020-06-18 12:00:10")
+	Memstore.Reset()
+
+	// Every pageview is from a different IP, so it's a new session.
+	send := func(n int, ip int) []Hit {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			Memstore.Append(Hit{Site: site.ID, Path: "/a", UserAgentHeader: "test",
+				RemoteAddr: fmt.Sprintf("1.1.1.%d", ip+i), CreatedAt: ztime.Now()})
+		}
+		hits, err := Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hits
+	}
+	count := func(hits []Hit) (first, throttled int) {
+		for _, h := range hits {
+			if h.FirstVisit {
+				first++
+			}
+			if h.SessionThrottled {
+				throttled++
+			}
+		}
+		return first, throttled
+	}
+
+	hits := send(10, 0)
+	if len(hits) != 10 {
+		t.Fatalf("len(hits) = %d", len(hits))
+	}
+	if f, th := count(hits); f != 3 || th != 7 {
+		t.Errorf("first=%d throttled=%d; want 3 and 7", f, th)
+	}
+	for _, h := range hits[3:] {
+		if !h.Session.IsZero() {
+			t.Errorf("throttled hit has session %s", h.Session)
+		}
+	}
+
+	// Existing sessions aren't affected.
+	if f, th := count(send(1, 0)); f != 0 || th != 0 {
+		t.Errorf("existing session: first=%d throttled=%d", f, th)
+	}
+
+	// Reset in the next minute.
+	ztime.SetNow(t, "2020-06-18 12:01:00")
+	if f, th := count(send(5, 100)); f != 3 || th != 2 {
+		t.Errorf("next minute: first=%d throttled=%d; want 3 and 2", f, th)
+	}
+
+	var total int
+	err = zdb.Get(ctx, &total, `select count(*) from hits where session_throttled = 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 9 {
+		t.Errorf("stored %d throttled hits; want 9", total)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"zgo.at/errors"
+)
+
+var monitors atomic.Pointer[[]string]
+
+func init() {
+	m := parseMonitors(MonitorsDB)
+	monitors.Store(&m)
+}
+
+// LoadMonitors replaces the list of uptime monitor User-Agents with the list
+// from path, so new monitors can be added without a new release. The file has
+// one case-insensitive substring per line; empty lines and lines starting with
+// # are ignored. The embedded list in MonitorsDB is used if path is "".
+func LoadMonitors(path string) error {
+	d := MonitorsDB
+	if path != "" {
+		var err error
+		d, err = os.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "LoadMonitors")
+		}
+	}
+	m := parseMonitors(d)
+	if len(m) == 0 {
+		return errors.Errorf("LoadMonitors: no entries in %q", path)
+	}
+	monitors.Store(&m)
+	return nil
+}
+
+// IsMonitor reports if the User-Agent is from an uptime monitor, and returns
+// the entry that matched.
+func IsMonitor(ua string) (string, bool) {
+	if ua == "" {
+		return "", false
+	}
+	ua = strings.ToLower(ua)
+	for _, m := range *monitors.Load() {
+		if strings.Contains(ua, m) {
+			return m, true
+		}
+	}
+	return "", false
+}
+
+func parseMonitors(d []byte) []string {
+	var m []string
+	for _, line := range bytes.Split(d, []byte("\n")) {
+		l := strings.ToLower(strings.TrimSpace(string(line)))
+		if l != "" && l[0] != '#' {
+			m = append(m, l)
+		}
+	}
+	return m
+}
@@ -0,0 +1,70 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/zstd/ztest"
+)
+
+func TestIsMonitor(t *testing.T) {
+	t.Cleanup(func() { LoadMonitors("") })
+
+	tests := []struct {
+		ua   string
+		want bool
+	}{
+		{"", false},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0", false},
+		{"Pingdom.com_bot_version_1.4_(http://www.pingdom.com/)", true},
+		{"Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)", true},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 StatusCake", true},
+		{"uptime-kuma/1.23.11", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ua, func(t *testing.T) {
+			if _, have := IsMonitor(tt.ua); have != tt.want {
+				t.Errorf("have %t; want %t", have, tt.want)
+			}
+		})
+	}
+
+	t.Run("load", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "monitors.txt")
+		err := os.WriteFile(path, []byte("# Comment\n\n  MyMonitor  \n"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = LoadMonitors(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, ok := IsMonitor("Go-http-client (mymonitor/1.0)"); !ok || m != "mymonitor" {
+			t.Errorf("%q %t", m, ok)
+		}
+		if _, ok := IsMonitor("UptimeRobot/2.0"); ok {
+			t.Error("still using the built-in list")
+		}
+
+		os.WriteFile(path, []byte("# Comment\n"), 0o644)
+		err = LoadMonitors(path)
+		if !ztest.ErrorContains(err, "no entries") {
+			t.Error(err)
+		}
+		err = LoadMonitors(filepath.Join(t.TempDir(), "nonexistent"))
+		if err == nil {
+			t.Error("err is nil")
+		}
+
+		LoadMonitors("")
+		if _, ok := IsMonitor("UptimeRobot/2.0"); !ok {
+			t.Error("built-in list not restored")
+		}
+	})
+}
@@ -13,6 +13,7 @@ import (
 	"zgo.at/zdb"
 	"zgo.at/zlog"
 	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/ztime"
 )
 
 type Path struct {
@@ -43,6 +44,13 @@ func (p *Path) ByID(ctx context.Context, id int64) error {
 }
 
 func (p *Path) GetOrInsert(ctx context.Context) error {
+	return p.getOrInsert(ctx, true)
+}
+
+// getOrInsert is like GetOrInsert(), but optionally doesn't count the title
+// towards updating the path's title; used for the previous path of a hit,
+// where we don't know the title.
+func (p *Path) getOrInsert(ctx context.Context, withTitle bool) error {
 	site := MustGetSite(ctx)
 	title := p.Title
 	k := strconv.FormatInt(site.ID, 10) + p.Path
@@ -51,12 +59,14 @@ func (p *Path) GetOrInsert(ctx context.Context) error {
 		*p = c.(Path)
 		cachePaths(ctx).Touch(k, zcache.DefaultExpiration)
 
-		err := p.updateTitle(ctx, p.Title, title)
-		if err != nil {
-			zlog.Fields(zlog.F{
-				"path_id": p.ID,
-				"title":   title,
-			}).Error(err)
+		if withTitle {
+			err := p.updateTitle(ctx, p.Title, title)
+			if err != nil {
+				zlog.Fields(zlog.F{
+					"path_id": p.ID,
+					"title":   title,
+				}).Error(err)
+			}
 		}
 		return nil
 	}
@@ -75,17 +85,27 @@ func (p *Path) GetOrInsert(ctx context.Context) error {
 		return errors.Errorf("Path.GetOrInsert select: %w", err)
 	}
 	if err == nil {
-		err := p.updateTitle(ctx, p.Title, title)
-		if err != nil {
-			zlog.Fields(zlog.F{
-				"path_id": p.ID,
-				"title":   title,
-			}).Error(err)
+		if withTitle {
+			err := p.updateTitle(ctx, p.Title, title)
+			if err != nil {
+				zlog.Fields(zlog.F{
+					"path_id": p.ID,
+					"title":   title,
+				}).Error(err)
+			}
 		}
 		cachePaths(ctx).SetDefault(k, *p)
 		return nil
 	}
 
+	if p.Event && site.Settings.MaxNewEvents > 0 {
+		if !allowNewEvent(ctx, site, p.Path) {
+			return errTooManyEvents
+		}
+	} else if !allowNewPath(ctx, site, p.Path) {
+		return errTooManyPaths
+	}
+
 	// Insert new row.
 	p.ID, err = zdb.InsertID(ctx, "path_id",
 		`insert into paths (site_id, path, title, event) values (?, ?, ?, ?)`,
@@ -98,6 +118,64 @@ func (p *Path) GetOrInsert(ctx context.Context) error {
 	return nil
 }
 
+// errTooManyPaths is returned by getOrInsert() for new paths if the site
+// already added SiteSettings.MaxNewPaths new paths today.
+var errTooManyPaths = errors.New("too many new paths today")
+
+// errTooManyEvents is returned by getOrInsert() for new event names if the
+// site already added SiteSettings.MaxNewEvents new event names today.
+var errTooManyEvents = errors.New("too many new events today")
+
+// allowNewPath reports if a new path can be added for the site, and counts it
+// if it can.
+//
+// The count is kept in memory per site per day (in UTC), so it starts from 0
+// again on restart.
+func allowNewPath(ctx context.Context, site *Site, path string) bool {
+	max := site.Settings.MaxNewPaths
+	if max <= 0 || path == OverflowPath {
+		return true
+	}
+
+	k := strconv.FormatInt(site.ID, 10) + ztime.Now().UTC().Format("-2006-01-02")
+	c := cacheNewPaths(ctx)
+	_ = c.Add(k, 0, zcache.DefaultExpiration) // Error if it already exists.
+	n, err := c.IncrementInt(k, 1)
+	if err != nil {
+		zlog.Error(err)
+		return true
+	}
+	if n == max+1 {
+		zlog.Fields(zlog.F{"site": site.ID}).Printf(
+			"more than %d new paths today; recording new paths as %s until tomorrow", max, OverflowPath)
+	}
+	return n <= max
+}
+
+// allowNewEvent is like allowNewPath(), but for event names with
+// SiteSettings.MaxNewEvents. Events are counted separately from paths, and
+// don't count towards MaxNewPaths if MaxNewEvents is set.
+func allowNewEvent(ctx context.Context, site *Site, name string) bool {
+	max := site.Settings.MaxNewEvents
+	if max <= 0 || name == OverflowEvent {
+		return true
+	}
+
+	k := strconv.FormatInt(site.ID, 10) + ztime.Now().UTC().Format("-2006-01-02") + "-event"
+	c := cacheNewPaths(ctx)
+	_ = c.Add(k, 0, zcache.DefaultExpiration) // Error if it already exists.
+	n, err := c.IncrementInt(k, 1)
+	if err != nil {
+		zlog.Error(err)
+		return true
+	}
+	if n == max+1 {
+		zlog.Fields(zlog.F{"site": site.ID}).Printf(
+			"more than %d new events today; recording new events as %s until tomorrow", max, OverflowEvent)
+	}
+	return n <= max
+}
+
 func (p Path) updateTitle(ctx context.Context, currentTitle, newTitle string) error {
 	if newTitle == currentTitle {
 		return nil
@@ -0,0 +1,102 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Values for SiteSettings.PathNormalize.
+const (
+	PathStepLowercase     = "lowercase"      // Lowercase the path, but not the query or fragment.
+	PathStepTrailingSlash = "trailing_slash" // Remove slashes from the end.
+	PathStepIndex         = "index"          // Remove the SiteSettings.IndexFiles.
+	PathStepFragment      = "fragment"       // Remove the fragment.
+	PathStepQuery         = "query"          // Remove query parameters that aren't in SiteSettings.QueryAllowlist.
+	PathStepRewrite       = "rewrite"        // Apply the SiteSettings.PathRewrites, unless PathRewriteAt is display.
+)
+
+// PathSteps lists all valid values for SiteSettings.PathNormalize.
+var PathSteps = []string{PathStepLowercase, PathStepTrailingSlash, PathStepIndex,
+	PathStepFragment, PathStepQuery, PathStepRewrite}
+
+// DefaultPathNormalize is used if SiteSettings.PathNormalize is empty. The
+// index and rewrite steps do nothing unless IndexFiles or PathRewrites are set,
+// so this only removes trailing slashes by default.
+var DefaultPathNormalize = Strings{PathStepIndex, PathStepTrailingSlash, PathStepRewrite}
+
+// PathNormalizeSteps gets the normalization steps that are applied, in order.
+//
+// This is PathNormalize or DefaultPathNormalize, with PathStepFragment added
+// at the start if the deprecated StripFragment is set.
+func (ss SiteSettings) PathNormalizeSteps() Strings {
+	steps := ss.PathNormalize
+	if len(steps) == 0 {
+		steps = DefaultPathNormalize
+	}
+	if ss.StripFragment && !slices.Contains(steps, PathStepFragment) {
+		steps = append(Strings{PathStepFragment}, steps...)
+	}
+	return steps
+}
+
+// NormalizePath applies the PathNormalizeSteps to the path, in order. The order
+// matters: for example "/page/#section" becomes "/page" if the fragment is
+// removed first, and "/page/" if the trailing slash is removed first.
+func (ss SiteSettings) NormalizePath(path string) string {
+	for _, s := range ss.PathNormalizeSteps() {
+		switch s {
+		case PathStepLowercase:
+			p, rest := splitPathRest(path)
+			path = strings.ToLower(p) + rest
+		case PathStepTrailingSlash:
+			path = "/" + strings.Trim(path, "/")
+		case PathStepIndex:
+			if len(ss.IndexFiles) > 0 {
+				path = stripIndexFile(path, ss.IndexFiles)
+			}
+		case PathStepFragment:
+			path, _, _ = strings.Cut(path, "#")
+		case PathStepQuery:
+			path = allowQuery(path, ss.QueryAllowlist)
+		case PathStepRewrite:
+			if ss.RewriteOnCount() {
+				path = ss.RewritePath(path)
+			}
+		}
+	}
+	return path
+}
+
+// splitPathRest splits the path in the path and the query and fragment.
+func splitPathRest(p string) (string, string) {
+	if i := strings.IndexAny(p, "?#"); i > -1 {
+		return p[:i], p[i:]
+	}
+	return p, ""
+}
+
+// allowQuery removes all query parameters that aren't in allow.
+func allowQuery(p string, allow []string) string {
+	p, frag, hasFrag := strings.Cut(p, "#")
+	p, query, hasQuery := strings.Cut(p, "?")
+	if hasQuery {
+		q, _ := url.ParseQuery(query)
+		for k := range q {
+			if !slices.Contains(allow, k) {
+				q.Del(k)
+			}
+		}
+		if e := q.Encode(); e != "" {
+			p += "?" + e
+		}
+	}
+	if hasFrag {
+		p += "#" + frag
+	}
+	return p
+}
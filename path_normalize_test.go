@@ -0,0 +1,115 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+)
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		steps    Strings
+		in, want string
+	}{
+		// Defaults.
+		{nil, "/page/", "/page"},
+		{nil, "/page/#section", "/page/#section"},
+		{nil, "/Page", "/Page"},
+		{nil, "/dir/index.html", "/dir"},
+		{nil, "/user/42", "/user/:id"},
+
+		{Strings{"lowercase"}, "/Page/About?Q=X#Top", "/page/about?Q=X#Top"},
+		{Strings{"query"}, "/page?id=1&sort=asc&b=2#x", "/page?id=1#x"},
+		{Strings{"query"}, "/page?sort=asc", "/page"},
+		{Strings{}, "/page/", "/page"}, // Empty is the default.
+
+		// Order matters.
+		{Strings{"fragment", "trailing_slash"}, "/page/#section", "/page"},
+		{Strings{"trailing_slash", "fragment"}, "/page/#section", "/page/"},
+
+		{Strings{"index", "trailing_slash"}, "/dir/index.html", "/dir"},
+		{Strings{"trailing_slash", "index"}, "/dir/index.html", "/dir/"},
+
+		{Strings{"lowercase", "rewrite"}, "/User/42", "/user/:id"},
+		{Strings{"rewrite", "lowercase"}, "/User/42", "/user/42"},
+
+		{Strings{"query", "rewrite"}, "/user/42?id=1", "/user/42?id=1"},
+		{Strings{"rewrite", "query"}, "/user/42?id=1", "/user/42?id=1"},
+		{Strings{"query", "rewrite"}, "/user/42?ref=x", "/user/:id"},
+		{Strings{"rewrite", "query"}, "/user/42?ref=x", "/user/42"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.steps, tt.in), func(t *testing.T) {
+			ss := SiteSettings{
+				PathNormalize:  tt.steps,
+				IndexFiles:     Strings{"index.html"},
+				QueryAllowlist: Strings{"id"},
+				PathRewrites: PathRewrites{
+					{`^/user/\d+$`, "/user/:id"},
+				},
+			}
+			have := ss.NormalizePath(tt.in)
+			if have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestHitDefaultsPathNormalize(t *testing.T) {
+	tests := []struct {
+		steps    Strings
+		strip    bool
+		in, want string
+	}{
+		{nil, false, "/Page/?utm_source=x", "/Page"},
+		{Strings{"lowercase", "trailing_slash"}, false, "/Page/?utm_source=x", "/page"},
+		{Strings{"lowercase"}, false, "/Page/", "/page/"},
+		{Strings{"query", "trailing_slash"}, false, "/page/?a=b", "/page"},
+		{Strings{"trailing_slash", "query"}, false, "/page/?a=b", "/page/"},
+
+		// StripFragment adds the fragment step at the start.
+		{Strings{"trailing_slash"}, true, "/page/#section", "/page"},
+		{Strings{"trailing_slash", "fragment"}, true, "/page/#section", "/page/"},
+	}
+
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.steps, tt.in), func(t *testing.T) {
+			site.Settings.PathNormalize, site.Settings.StripFragment = tt.steps, tt.strip
+			err := site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := Hit{Path: tt.in}
+			h.Defaults(ctx, false)
+			if h.Path != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", h.Path, tt.want)
+			}
+		})
+	}
+
+	t.Run("validate", func(t *testing.T) {
+		site.Settings.PathNormalize = Strings{"lowercase", "uppercase", "lowercase"}
+		err := site.Update(ctx)
+		if err == nil {
+			t.Fatal("no error")
+		}
+		for _, want := range []string{"must be one of", `"lowercase": listed more than once`} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("\nhave: %s\nwant: %s", err, want)
+			}
+		}
+	})
+}
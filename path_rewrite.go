@@ -0,0 +1,115 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Values for SiteSettings.PathRewriteAt.
+const (
+	PathRewriteCount   = "count"   // Rewrite the path before it's stored.
+	PathRewriteDisplay = "display" // Store the full path, and rewrite it in the list of pages.
+)
+
+type (
+	// PathRewrite replaces Pattern with Replace in paths; Replace can refer to
+	// groups in the pattern with $1, ${name}, etc.
+	PathRewrite struct {
+		Pattern string
+		Replace string
+	}
+
+	// PathRewrites is a list of rewrites, which are applied in order.
+	//
+	// The text format is one rewrite per line, as "pattern -> replace".
+	PathRewrites []PathRewrite
+)
+
+// pathRewriteSep separates the pattern and replacement in the text format;
+// whitespace around it is ignored.
+const pathRewriteSep = "->"
+
+func (p PathRewrites) String() string {
+	b := new(strings.Builder)
+	for i, r := range p {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(r.Pattern + " " + pathRewriteSep + " " + r.Replace)
+	}
+	return b.String()
+}
+
+func (p PathRewrites) MarshalText() ([]byte, error) { return []byte(p.String()), nil }
+
+func (p *PathRewrites) UnmarshalText(v []byte) error {
+	var rw PathRewrites
+	for i, line := range strings.Split(string(v), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		pat, repl, ok := strings.Cut(line, pathRewriteSep)
+		if !ok {
+			return fmt.Errorf("line %d: no %q in %q", i+1, pathRewriteSep, line)
+		}
+		rw = append(rw, PathRewrite{Pattern: strings.TrimSpace(pat), Replace: strings.TrimSpace(repl)})
+	}
+	*p = rw
+	return nil
+}
+
+// pathRewriter is the compiled version of PathRewrites.
+type pathRewriter struct {
+	re   []*regexp.Regexp
+	repl []string
+}
+
+// newPathRewriter compiles the rewrites; invalid patterns are skipped, as they
+// should be caught by SiteSettings.Validate().
+func newPathRewriter(p PathRewrites) *pathRewriter {
+	rw := &pathRewriter{re: make([]*regexp.Regexp, 0, len(p)), repl: make([]string, 0, len(p))}
+	for _, r := range p {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			continue
+		}
+		rw.re, rw.repl = append(rw.re, re), append(rw.repl, r.Replace)
+	}
+	return rw
+}
+
+func (rw *pathRewriter) rewrite(path string) string {
+	for i, re := range rw.re {
+		path = re.ReplaceAllString(path, rw.repl[i])
+	}
+	return path
+}
+
+// RewritePath applies the PathRewrites to the path.
+func (ss SiteSettings) RewritePath(path string) string {
+	if len(ss.PathRewrites) == 0 {
+		return path
+	}
+	rw := ss.pathRewriter
+	if rw == nil { // Not loaded from the database.
+		rw = newPathRewriter(ss.PathRewrites)
+	}
+	return rw.rewrite(path)
+}
+
+// RewriteOnCount reports if the PathRewrites should be applied in /count.
+func (ss SiteSettings) RewriteOnCount() bool {
+	return len(ss.PathRewrites) > 0 && ss.PathRewriteAt != PathRewriteDisplay
+}
+
+// rewriteOnDisplay reports if the PathRewrites should be applied when listing
+// the pages.
+func (ss SiteSettings) rewriteOnDisplay() bool {
+	return len(ss.PathRewrites) > 0 && ss.PathRewriteAt == PathRewriteDisplay
+}
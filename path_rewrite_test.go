@@ -0,0 +1,93 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"reflect"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/zstd/ztest"
+)
+
+func TestPathRewritesText(t *testing.T) {
+	tests := []struct {
+		in, wantErr string
+		want        PathRewrites
+	}{
+		{"", "", nil},
+		{`^/user/\d+/ -> /user/:id/`, "", PathRewrites{{`^/user/\d+/`, "/user/:id/"}}},
+		{"  ^/a  ->  /b  \n\n^/c -> \n", "", PathRewrites{{"^/a", "/b"}, {"^/c", ""}}},
+		{"^/a -> /b\n^/c", `line 2: no "->" in "^/c"`, nil},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var have PathRewrites
+			err := have.UnmarshalText([]byte(tt.in))
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Fatalf("\nhave: %#v\nwant: %#v", have, tt.want)
+			}
+
+			// Round-trip.
+			var again PathRewrites
+			err = again.UnmarshalText([]byte(have.String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(again, have) {
+				t.Errorf("round-trip\nhave: %#v\nwant: %#v", again, have)
+			}
+		})
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	ss := SiteSettings{PathRewrites: PathRewrites{
+		{`/\d+(/|$)`, "/:id$1"},
+		{`^/(en|de|fr)/`, "/"},
+		{`^/blog/(?P<slug>[a-z-]+)\.html$`, "/blog/${slug}"},
+		{`(`, "invalid; skipped"},
+	}}
+
+	// Compiled when loaded from the database.
+	v, err := ss.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded SiteSettings
+	err = loaded.Scan(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in, want string
+	}{
+		{"/", "/"},
+		{"/user/12345/profile", "/user/:id/profile"},
+		{"/user/12345", "/user/:id"},
+		{"/order/1/item/2", "/order/:id/item/:id"},
+		{"/user/12a/profile", "/user/12a/profile"},
+		// Rules are applied in order, each to the result of the previous one.
+		{"/de/user/42/profile", "/user/:id/profile"},
+		{"/en/blog/hello-world.html", "/blog/hello-world"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			for _, s := range []SiteSettings{ss, loaded} {
+				have := s.RewritePath(tt.in)
+				if have != tt.want {
+					t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+// Package proxyproto reads the PROXY protocol header that TCP load balancers
+// such as HAProxy or AWS NLB send at the start of a connection, to get the
+// client address.
+//
+// Both the text (v1) and binary (v2) formats are supported; see:
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+)
+
+var (
+	sigV1 = []byte("PROXY ")
+	sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ErrNoHeader is returned if the connection doesn't start with a PROXY protocol
+// header.
+var ErrNoHeader = errors.New("proxyproto: no PROXY protocol header")
+
+// MalformedError is returned for invalid PROXY protocol headers.
+type MalformedError struct{ msg string }
+
+func (e MalformedError) Error() string { return "proxyproto: malformed header: " + e.msg }
+
+func malformed(msg string, args ...any) error {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	return MalformedError{msg}
+}
+
+// ReadHeader reads the PROXY protocol header from r.
+//
+// The returned address is the source address from the header, which is nil
+// for v1 "UNKNOWN" and v2 "LOCAL" headers, or for address families other than
+// IPv4 and IPv6; the address of the connection should be used in those cases.
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	if b, err := r.Peek(len(sigV1)); err == nil && bytes.Equal(b, sigV1) {
+		return readV1(r)
+	}
+	if b, err := r.Peek(len(sigV2)); err == nil && bytes.Equal(b, sigV2) {
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+// The v1 header is at most 107 bytes, including the CRLF.
+const maxV1 = 107
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= maxV1 {
+			return nil, malformed("v1 header is longer than %d bytes", maxV1)
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, malformed("v1 header doesn't end with CRLF")
+	}
+
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 {
+		return nil, malformed("v1 header has %d fields instead of 6", len(f))
+	}
+	if f[1] != "TCP4" && f[1] != "TCP6" {
+		return nil, malformed("unknown v1 protocol %q", f[1])
+	}
+
+	src, err := netip.ParseAddr(f[2])
+	if err != nil || src.Zone() != "" || src.Is4() != (f[1] == "TCP4") {
+		return nil, malformed("invalid %s source address %q", f[1], f[2])
+	}
+	dst, err := netip.ParseAddr(f[3])
+	if err != nil || dst.Zone() != "" || dst.Is4() != (f[1] == "TCP4") {
+		return nil, malformed("invalid %s destination address %q", f[1], f[3])
+	}
+	srcPort, err := parsePort(f[4])
+	if err != nil {
+		return nil, malformed("invalid source port %q", f[4])
+	}
+	if _, err := parsePort(f[5]); err != nil {
+		return nil, malformed("invalid destination port %q", f[5])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, srcPort)), nil
+}
+
+// parsePort parses a v1 port, which is a decimal number without leading zeros.
+func parsePort(s string) (uint16, error) {
+	if len(s) > 1 && s[0] == '0' {
+		return 0, strconv.ErrSyntax
+	}
+	n, err := strconv.ParseUint(s, 10, 16)
+	return uint16(n), err
+}
+
+// Commands and address families in the v2 header.
+const (
+	cmdLocal = 0x0
+	cmdProxy = 0x1
+
+	famUnspec = 0x0
+	famInet   = 0x1
+	famInet6  = 0x2
+	famUnix   = 0x3
+)
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if v := head[12] >> 4; v != 2 {
+		return nil, malformed("unknown v2 version %d", v)
+	}
+	cmd, fam := head[12]&0xf, head[13]>>4
+	if cmd != cmdLocal && cmd != cmdProxy {
+		return nil, malformed("unknown v2 command %d", cmd)
+	}
+	if fam > famUnix {
+		return nil, malformed("unknown v2 address family %d", fam)
+	}
+	if proto := head[13] & 0xf; proto > 2 {
+		return nil, malformed("unknown v2 transport protocol %d", proto)
+	}
+
+	// The addresses are followed by optional TLVs, which are skipped.
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if cmd == cmdLocal {
+		return nil, nil
+	}
+
+	switch fam {
+	case famInet:
+		if len(body) < 12 {
+			return nil, malformed("v2 IPv4 address block is %d bytes", len(body))
+		}
+		src := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[8:]))), nil
+	case famInet6:
+		if len(body) < 36 {
+			return nil, malformed("v2 IPv6 address block is %d bytes", len(body))
+		}
+		src := netip.AddrFrom16([16]byte(body[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[32:]))), nil
+	default: // famUnspec, famUnix
+		return nil, nil
+	}
+}
+
+// Listener wraps a net.Listener to read the PROXY protocol header on new
+// connections; RemoteAddr() on the connection is the client address from the
+// header.
+//
+// The header is read on the first Read() or RemoteAddr() call, rather than in
+// Accept(), so that slow clients don't block accepting new connections.
+// Connections without a valid header fail on the first Read().
+type Listener struct {
+	net.Listener
+
+	// Only read the header from connections from these addresses; other
+	// connections are used as-is. The header is read from all connections if
+	// this is empty.
+	Trusted []netip.Prefix
+
+	// Time to wait for the header; the default is 10 seconds.
+	Timeout time.Duration
+}
+
+// Accept waits for the next connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	t := l.Timeout
+	if t == 0 {
+		t = 10 * time.Second
+	}
+	return &Conn{Conn: c, r: bufio.NewReader(c), timeout: t}, nil
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	if len(l.Trusted) == 0 {
+		return true
+	}
+	a, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, p := range l.Trusted {
+		if p.Contains(a.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from the Listener.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remote, c.err = ReadHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+// Read reads data from the connection, after the header.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr gets the client address from the header, or the address of the
+// connection if the header doesn't have one.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
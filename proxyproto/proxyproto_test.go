@@ -0,0 +1,187 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func v2(verCmd, famProto byte, body []byte) string {
+	h := append([]byte{}, sigV2...)
+	h = append(h, verCmd, famProto)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(body)))
+	return string(append(h, body...))
+}
+
+func TestReadHeader(t *testing.T) {
+	var (
+		ipv4 = []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x01, 0xbb}
+		ipv6 = append(append(netip.MustParseAddr("2001:db8::1").AsSlice(),
+			netip.MustParseAddr("2001:db8::2").AsSlice()...), 0x30, 0x39, 0x01, 0xbb)
+	)
+
+	tests := []struct {
+		in, want, wantErr string
+	}{
+		// v1
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\nGET /", "192.0.2.1:12345", ""},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\nGET /", "[2001:db8::1]:12345", ""},
+		{"PROXY UNKNOWN\r\nGET /", "", ""},
+		{"PROXY UNKNOWN 192.0.2.1 198.51.100.1 12345 443\r\nGET /", "", ""},
+
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\nGET /", "", "doesn't end with CRLF"},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 12345\r\nGET /", "", "5 fields"},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 12345 443\r\nGET /", "", "unknown v1 protocol"},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 12345 443\r\nGET /", "", "invalid TCP4 source"},
+		{"PROXY TCP6 192.0.2.1 2001:db8::2 12345 443\r\nGET /", "", "invalid TCP6 source"},
+		{"PROXY TCP4 192.0.2.1 example.com 12345 443\r\nGET /", "", "invalid TCP4 destination"},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 123456 443\r\nGET /", "", "invalid source port"},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 012 443\r\nGET /", "", "invalid source port"},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 12345 -1\r\nGET /", "", "invalid destination port"},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 12345 443 " + strings.Repeat("x", 100) + "\r\n", "", "longer than 107"},
+		{"PROXY TCP4 192.0.2.1", "", "unexpected EOF"},
+
+		// v2
+		{v2(0x21, 0x11, ipv4) + "GET /", "192.0.2.1:12345", ""},
+		{v2(0x21, 0x12, ipv4) + "GET /", "192.0.2.1:12345", ""},
+		{v2(0x21, 0x21, ipv6) + "GET /", "[2001:db8::1]:12345", ""},
+		{v2(0x21, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0xff)) + "GET /", "192.0.2.1:12345", ""}, // TLV
+		{v2(0x20, 0x00, nil) + "GET /", "", ""},                                                 // LOCAL
+		{v2(0x20, 0x11, ipv4) + "GET /", "", ""},                                                // LOCAL
+		{v2(0x21, 0x00, nil) + "GET /", "", ""},                                                 // UNSPEC
+		{v2(0x21, 0x31, make([]byte, 216)) + "GET /", "", ""},                                   // UNIX
+
+		{v2(0x11, 0x11, ipv4), "", "unknown v2 version 1"},
+		{v2(0x22, 0x11, ipv4), "", "unknown v2 command 2"},
+		{v2(0x21, 0x41, ipv4), "", "unknown v2 address family 4"},
+		{v2(0x21, 0x13, ipv4), "", "unknown v2 transport protocol 3"},
+		{v2(0x21, 0x11, ipv4[:8]), "", "IPv4 address block is 8 bytes"},
+		{v2(0x21, 0x21, ipv4), "", "IPv6 address block is 12 bytes"},
+		{v2(0x21, 0x11, ipv4)[:20], "", "unexpected EOF"},
+		{v2(0x21, 0x11, ipv4)[:10], "", "no PROXY protocol header"},
+
+		// No header.
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "", "no PROXY protocol header"},
+		{"", "", "no PROXY protocol header"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.in))
+			addr, err := ReadHeader(r)
+			if !errorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+
+			var have string
+			if addr != nil {
+				have = addr.String()
+			}
+			if have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "GET /" {
+				t.Errorf("rest: %q", rest)
+			}
+		})
+	}
+}
+
+func errorContains(err error, want string) bool {
+	if err == nil {
+		return want == ""
+	}
+	return want != "" && strings.Contains(err.Error(), want)
+}
+
+func TestListener(t *testing.T) {
+	start := func(t *testing.T, trusted ...netip.Prefix) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.RemoteAddr)
+		})}
+		go srv.Serve(&Listener{Listener: ln, Trusted: trusted})
+		t.Cleanup(func() { srv.Close() })
+		return ln.Addr().String()
+	}
+	send := func(t *testing.T, addr, header string) (string, int) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "%sGET / HTTP/1.0\r\nHost: example.com\r\n\r\n", header)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b), resp.StatusCode
+	}
+
+	t.Run("trusted", func(t *testing.T) {
+		addr := start(t)
+
+		have, _ := send(t, addr, "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n")
+		if have != "192.0.2.1:12345" {
+			t.Errorf("v1: %q", have)
+		}
+
+		have, _ = send(t, addr, v2(0x21, 0x21, append(append(netip.MustParseAddr("2001:db8::1").AsSlice(),
+			netip.MustParseAddr("2001:db8::2").AsSlice()...), 0x30, 0x39, 0x01, 0xbb)))
+		if have != "[2001:db8::1]:12345" {
+			t.Errorf("v2: %q", have)
+		}
+
+		have, _ = send(t, addr, "PROXY UNKNOWN\r\n")
+		if !strings.HasPrefix(have, "127.0.0.1:") {
+			t.Errorf("unknown: %q", have)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		addr := start(t)
+		for _, h := range []string{"", "PROXY TCP4 192.0.2.1\r\n"} {
+			have, code := send(t, addr, h)
+			if code != 400 {
+				t.Errorf("%q: %d %q", h, code, have)
+			}
+		}
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		addr := start(t, netip.MustParsePrefix("192.0.2.0/24"))
+
+		// Connections from other addresses are used as-is.
+		have, _ := send(t, addr, "")
+		if !strings.HasPrefix(have, "127.0.0.1:") {
+			t.Errorf("%q", have)
+		}
+
+		// So the header isn't parsed, and is an invalid request.
+		have, code := send(t, addr, "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n")
+		if code != 400 {
+			t.Errorf("%d %q", code, have)
+		}
+	})
+}
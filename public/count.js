@@ -14,7 +14,7 @@
 		try         { var set = JSON.parse(s.dataset.goatcounterSettings) }
 		catch (err) { console.error('invalid JSON in data-goatcounter-settings: ' + err) }
 		for (var k in set)
-			if (['no_onload', 'no_events', 'allow_local', 'allow_frame', 'path', 'title', 'referrer', 'event'].indexOf(k) > -1)
+			if (['no_onload', 'no_events', 'allow_local', 'allow_frame', 'dwell', 'path', 'title', 'referrer', 'event', 'signature'].indexOf(k) > -1)
 				window.goatcounter[k] = set[k]
 	}
 
@@ -30,6 +30,7 @@
 			s: [window.screen.width, window.screen.height, (window.devicePixelRatio || 1)],
 			b: is_bot(),
 			q: location.search,
+			dwell_ms: vars.dwell_ms,
 		}
 
 		var rcb, pcb, tcb  // Save callbacks to apply later.
@@ -131,6 +132,8 @@
 		if (data.p === null)  // null from user callback.
 			return
 		data.rnd = Math.random().toString(36).substr(2, 5)  // Browsers don't always listen to Cache-Control.
+		if (goatcounter.signature)
+			data.sig = goatcounter.signature
 
 		for(const k in data) {
 			if(Array.isArray(data[k])) {
@@ -154,6 +157,28 @@
 		fetch(url, { body: JSON.stringify(data), method: 'POST' })
 	}
 
+	// Count once the page has been visible for goatcounter.dwell milliseconds,
+	// sending how long it was visible; time in the background doesn't count.
+	var count_after_dwell = function() {
+		var visible = 0, since = null, timer
+		var check = function() {
+			clearTimeout(timer)
+			if (since !== null)
+				visible += Date.now() - since
+			since = null
+			if ('visibilityState' in document && document.visibilityState !== 'visible')
+				return
+			if (visible >= goatcounter.dwell) {
+				document.removeEventListener('visibilitychange', check)
+				return goatcounter.count({dwell_ms: visible})
+			}
+			since = Date.now()
+			timer = setTimeout(check, goatcounter.dwell - visible)
+		}
+		document.addEventListener('visibilitychange', check)
+		check()
+	}
+
 	// Get a query parameter.
 	window.goatcounter.get_query = function(name) {
 		var s = location.search.substr(1).split('&')
@@ -240,7 +265,9 @@
 			// 1. Page is visible, count request.
 			// 2. Page is not yet visible; wait until it switches to 'visible' and count.
 			// See #487
-			if (!('visibilityState' in document) || document.visibilityState === 'visible')
+			if (goatcounter.dwell)
+				count_after_dwell()
+			else if (!('visibilityState' in document) || document.visibilityState === 'visible')
 				goatcounter.count()
 			else {
 				var f = function(e) {
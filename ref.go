@@ -6,12 +6,16 @@ package goatcounter
 
 import (
 	"context"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
 
+	"golang.org/x/net/publicsuffix"
 	"zgo.at/errors"
 	"zgo.at/zcache"
 	"zgo.at/zdb"
+	"zgo.at/zlog"
 	"zgo.at/zstd/ztime"
 	"zgo.at/zstd/ztype"
 )
@@ -139,6 +143,10 @@ func (r *Ref) GetOrInsert(ctx context.Context) error {
 		return errors.Wrap(err, "Ref.GetOrInsert get")
 	}
 
+	if !allowNewRef(ctx, r) {
+		return errTooManyRefs
+	}
+
 	r.ID, err = zdb.InsertID(ctx, "ref_id",
 		`insert into refs (ref, ref_scheme) values (?, ?)`,
 		r.Ref, r.RefScheme)
@@ -150,6 +158,92 @@ func (r *Ref) GetOrInsert(ctx context.Context) error {
 	return nil
 }
 
+// errTooManyRefs is returned by GetOrInsert() for new referrers if the site
+// already added SiteSettings.MaxNewRefs new referrers today.
+var errTooManyRefs = errors.New("too many new referrers today")
+
+// allowNewRef reports if a new referrer can be added for the site in the
+// context, and counts it if it can. Generated referrers are always allowed.
+//
+// The count is kept in memory per site per day (in UTC), so it starts from 0
+// again on restart.
+func allowNewRef(ctx context.Context, r *Ref) bool {
+	site := GetSite(ctx)
+	if site == nil || site.Settings.MaxNewRefs <= 0 || r.RefScheme == RefSchemeGenerated {
+		return true
+	}
+	max := site.Settings.MaxNewRefs
+
+	k := strconv.FormatInt(site.ID, 10) + ztime.Now().UTC().Format("-2006-01-02")
+	c := cacheNewRefs(ctx)
+	_ = c.Add(k, 0, zcache.DefaultExpiration) // Error if it already exists.
+	n, err := c.IncrementInt(k, 1)
+	if err != nil {
+		zlog.Error(err)
+		return true
+	}
+	if n == max+1 {
+		zlog.Fields(zlog.F{"site": site.ID}).Printf(
+			"more than %d new referrers today; recording new referrers as %s until tomorrow", max, OverflowRefLabel)
+	}
+	return n <= max
+}
+
+// refDomain gets the registered domain for a host from the public suffix list,
+// e.g. "example.co.uk" for "www.news.example.co.uk". The host is returned as-is
+// if it's an IP address or there is no registered domain.
+func refDomain(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if _, err := netip.ParseAddr(host); err == nil {
+		return host
+	}
+	d, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return d
+}
+
+// isLocalRef reports if the referrer is a file:// URL or a http(s) URL on
+// localhost or a loopback address.
+func isLocalRef(refURL *url.URL) bool {
+	switch refURL.Scheme {
+	case "file":
+		return true
+	case "http", "https":
+		host := refURL.Hostname()
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return true
+		}
+		a, err := netip.ParseAddr(host)
+		return err == nil && a.IsLoopback()
+	}
+	return false
+}
+
+// isInternalRef reports if the referrer is a http(s) URL on localhost, a
+// private, loopback, or link-local address, or a .local or .internal domain.
+//
+// The host isn't resolved, so internal hosts with a public name aren't
+// detected.
+func isInternalRef(refURL *url.URL) bool {
+	if refURL.Scheme != "http" && refURL.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(strings.TrimSuffix(refURL.Hostname(), "."))
+	for _, tld := range []string{"localhost", "local", "internal"} {
+		if host == tld || strings.HasSuffix(host, "."+tld) {
+			return true
+		}
+	}
+	a, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	a = a.Unmap()
+	return a.IsPrivate() || a.IsLoopback() || a.IsLinkLocalUnicast() || a.IsUnspecified()
+}
+
 func cleanRefURL(ref string, refURL *url.URL) (string, bool) {
 	// I'm not sure where these links are generated, but there are *a lot* of
 	// them.
@@ -0,0 +1,86 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	gohash "hash"
+	"strconv"
+
+	"golang.org/x/crypto/blake2b"
+	"zgo.at/errors"
+)
+
+// Algorithms for SessionHasher.
+const (
+	SessionHashSHA256  = "sha256"
+	SessionHashBLAKE2b = "blake2b"
+)
+
+// SessionHashes lists all valid values for SessionHasher.Alg.
+var SessionHashes = []string{SessionHashSHA256, SessionHashBLAKE2b}
+
+// SessionHasher creates the hash of the salt, User-Agent, IP address, and site
+// that's used to recognize sessions.
+//
+// The Pepper is an optional secret that's added to all hashes (as the HMAC key
+// for SHA-256, or the BLAKE2b key). Unlike the salt it's never stored, so
+// hashes can't be recreated from the database alone.
+type SessionHasher struct {
+	Alg    string
+	Pepper []byte
+}
+
+// NewSessionHasher creates a new SessionHasher, using SHA-256 if alg is "".
+func NewSessionHasher(alg string, pepper []byte) (SessionHasher, error) {
+	switch alg {
+	case "":
+		alg = SessionHashSHA256
+	case SessionHashSHA256:
+	case SessionHashBLAKE2b:
+		if len(pepper) > blake2b.Size {
+			return SessionHasher{}, errors.Errorf("NewSessionHasher: pepper can be at most %d bytes for %s",
+				blake2b.Size, alg)
+		}
+	default:
+		return SessionHasher{}, errors.Errorf("NewSessionHasher: unknown algorithm %q", alg)
+	}
+	return SessionHasher{Alg: alg, Pepper: pepper}, nil
+}
+
+// Hash the session values.
+func (s SessionHasher) Hash(salt []byte, ua, remoteAddr string, siteID int64) []byte {
+	var h gohash.Hash
+	switch {
+	case s.Alg == SessionHashBLAKE2b:
+		h, _ = blake2b.New256(s.Pepper) // Only errors if the key is too long.
+	case len(s.Pepper) > 0:
+		h = hmac.New(sha256.New, s.Pepper)
+	default:
+		h = sha256.New()
+	}
+	h.Write(salt)
+	h.Write([]byte(ua))
+	h.Write([]byte(remoteAddr))
+	h.Write([]byte(strconv.FormatInt(siteID, 10)))
+	return h.Sum(nil)
+}
+
+// ID identifies the algorithm and pepper, without revealing the pepper; this is
+// stored with the sessions, so we know if the hashes are still valid.
+func (s SessionHasher) ID() string {
+	alg := s.Alg
+	if alg == "" {
+		alg = SessionHashSHA256
+	}
+	if len(s.Pepper) == 0 {
+		return alg
+	}
+	h := hmac.New(sha256.New, s.Pepper)
+	h.Write([]byte("goatcounter session pepper"))
+	return alg + ":" + hex.EncodeToString(h.Sum(nil)[:8])
+}
@@ -0,0 +1,129 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+)
+
+func TestSessionHasher(t *testing.T) {
+	salt := []byte("salt")
+	hash := func(t *testing.T, alg, pepper string) string {
+		t.Helper()
+		h, err := NewSessionHasher(alg, []byte(pepper))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := h.Hash(salt, "Mozilla/5.0", "127.0.0.1", 1)
+		if b := h.Hash(salt, "Mozilla/5.0", "127.0.0.1", 1); !bytes.Equal(a, b) {
+			t.Fatalf("not stable: %x %x", a, b)
+		}
+		return hex.EncodeToString(a)
+	}
+
+	// Same as it always was, so sessions still work after an upgrade.
+	want := sha256.Sum256([]byte("saltMozilla/5.0127.0.0.11"))
+	if have := hash(t, "", ""); have != hex.EncodeToString(want[:]) {
+		t.Errorf("default hash changed: %s", have)
+	}
+	if hash(t, "", "") != hash(t, SessionHashSHA256, "") {
+		t.Error("default isn't sha256")
+	}
+
+	seen := make(map[string]string)
+	for _, alg := range SessionHashes {
+		for _, pepper := range []string{"", "pepper", "other pepper"} {
+			h := hash(t, alg, pepper)
+			if len(h) != 64 {
+				t.Errorf("%s %q: length %d", alg, pepper, len(h))
+			}
+			if prev, ok := seen[h]; ok {
+				t.Errorf("%s %q: same hash as %s", alg, pepper, prev)
+			}
+			seen[h] = alg + " " + pepper
+		}
+	}
+
+	// Different input gives a different hash with the same pepper.
+	h, _ := NewSessionHasher(SessionHashBLAKE2b, []byte("pepper"))
+	if bytes.Equal(h.Hash(salt, "Mozilla/5.0", "127.0.0.1", 1), h.Hash(salt, "Mozilla/5.0", "127.0.0.1", 2)) {
+		t.Error("same hash for different sites")
+	}
+
+	_, err := NewSessionHasher("md5", nil)
+	if !ztest.ErrorContains(err, "unknown algorithm") {
+		t.Error(err)
+	}
+	_, err = NewSessionHasher(SessionHashBLAKE2b, []byte(strings.Repeat("x", 65)))
+	if !ztest.ErrorContains(err, "at most 64 bytes") {
+		t.Error(err)
+	}
+}
+
+func TestMemstoreSessionHasher(t *testing.T) {
+	ctx := gctest.DB(t)
+	db := zdb.MustGetDB(ctx)
+	t.Cleanup(func() { Memstore.SetSessionHasher(SessionHasher{}) })
+
+	send := func() Hit {
+		t.Helper()
+		Memstore.Append(Hit{Site: 1, Path: "/a", UserAgentHeader: "Mozilla/5.0", RemoteAddr: "127.0.0.1"})
+		hits, err := Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 1 {
+			t.Fatalf("%d hits", len(hits))
+		}
+		return hits[0]
+	}
+	restart := func(h SessionHasher) {
+		t.Helper()
+		Memstore.StoreSessions(db)
+		Memstore.SetSessionHasher(h)
+		err := Memstore.Init(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// New sessions are a first visit, as it's always the same path.
+	if !send().FirstVisit {
+		t.Fatal("not a first visit")
+	}
+
+	// Same algorithm and pepper: session is kept after a restart.
+	restart(SessionHasher{})
+	if send().FirstVisit {
+		t.Error("new session with the same hasher")
+	}
+
+	// Different pepper: new session.
+	h, _ := NewSessionHasher(SessionHashSHA256, []byte("pepper"))
+	restart(h)
+	if !send().FirstVisit {
+		t.Error("same session after changing the pepper")
+	}
+	restart(h)
+	if send().FirstVisit {
+		t.Error("new session with the same pepper")
+	}
+
+	// Different algorithm: new session.
+	h, _ = NewSessionHasher(SessionHashBLAKE2b, []byte("pepper"))
+	restart(h)
+	if !send().FirstVisit {
+		t.Error("same session after changing the algorithm")
+	}
+}
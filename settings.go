@@ -5,9 +5,13 @@
 package goatcounter
 
 import (
+	"bytes"
 	"context"
 	"database/sql/driver"
 	"fmt"
+	"net/netip"
+	"regexp"
+	"regexp/syntax"
 	"slices"
 	"sort"
 	"strconv"
@@ -15,11 +19,16 @@ import (
 	"time"
 	"unicode"
 
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/text/language"
+	"zgo.at/errors"
 	"zgo.at/json"
 	"zgo.at/tz"
 	"zgo.at/z18n"
+	"zgo.at/zstd/zcrypto"
 	"zgo.at/zstd/zint"
 	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztime"
 	"zgo.at/zvalidate"
 )
 
@@ -40,6 +49,13 @@ const (
 	CollectLocationRegion                // 32
 	CollectLanguage                      // 64
 	CollectSession                       // 128
+	CollectTLS                           // 256
+	CollectPerf                          // 512
+	CollectConnection                    // 1024
+	CollectASN                           // 2048
+	CollectNavType                       // 4096
+	CollectCountryUniques                // 8192
+	CollectSizeBucket                    // 16384
 )
 
 // UserSettings.EmailReport values.
@@ -70,6 +86,405 @@ type (
 		Collect        zint.Bitflag16 `json:"collect"`
 		CollectRegions Strings        `json:"collect_regions"`
 		AllowEmbed     Strings        `json:"allow_embed"`
+
+		// Only collect location and language for pageviews with an
+		// external referrer, skipping the lookup for direct visits and
+		// internal navigation.
+		CollectExternalOnly bool `json:"collect_external_only"`
+
+		// Delete pageviews after this many days, while keeping the stats on
+		// the dashboard until DataRetention. This removes the session and
+		// other data of every pageview, without losing long-term trends. 0
+		// means pageviews are kept until DataRetention.
+		SessionRetention int `json:"session_retention"`
+
+		// Don't record pageviews if the User-Agent header contains one of
+		// these strings (case-insensitive), e.g. "HeadlessChrome" or "curl".
+		// This is in addition to the bot detection.
+		BlockUserAgentSubstrings Strings `json:"block_user_agent_substrings"`
+
+		// Record pageviews as PlatformApp if the User-Agent header contains
+		// one of these strings (case-insensitive) and the platform isn't
+		// sent, for in-app webviews and native SDKs with a custom User-Agent.
+		AppUserAgentSubstrings Strings `json:"app_user_agent_substrings"`
+
+		// Don't record pageviews for paths that match one of these regular
+		// expressions, e.g. `\.(php|asp|env)$` for vulnerability scanners.
+		// With DenyPathsBot they're recorded as BotScanner instead.
+		DenyPathRegexps Lines `json:"deny_path_regexps"`
+		DenyPathsBot    bool  `json:"deny_paths_bot"`
+
+		// Flag pageviews from uptime monitors such as Pingdom or UptimeRobot
+		// as BotMonitor; see LoadMonitors().
+		FlagMonitors bool `json:"flag_monitors"`
+
+		// Flag pageviews from the networks of hosting providers as
+		// BotDatacenter; see DatacenterASNs. This requires an ASN database.
+		FlagDatacenter bool `json:"flag_datacenter"`
+
+		// What to do with pageviews that have Hit.Webdriver set; one of the
+		// Webdriver* constants.
+		Webdriver string `json:"webdriver"`
+
+		// Minimum confidence for the language from the Accept-Language
+		// header: "exact", "high", or "low".
+		LanguageConfidence string `json:"language_confidence"`
+
+		// Also store all distinct languages from the Accept-Language header
+		// in Hit.Languages (up to MaxLanguages), instead of only the first.
+		// This does nothing if CollectLanguage is off.
+		CollectLanguages bool `json:"collect_languages"`
+
+		// Cookie with the language the visitor chose on the site (e.g. "nl"
+		// or "pt-BR"), which is used for Hit.Language instead of the
+		// Accept-Language header if it's sent. With CollectBrowserLanguage
+		// the language from the Accept-Language header is also stored in
+		// Hit.BrowserLanguage if it's different. This does nothing if
+		// CollectLanguage is off.
+		LanguageCookie         string `json:"language_cookie"`
+		CollectBrowserLanguage bool   `json:"collect_browser_language"`
+
+		// Record referrers from the site's own domain (LinkDomain) as the
+		// previous path instead of as a referrer; this is mostly useful for
+		// single-page apps, where every route change sends the previous route
+		// as the referrer.
+		InternalNavigation bool `json:"internal_navigation"`
+
+		// Use the page in the Referer header as the path if a pageview
+		// doesn't have one, such as navigator.sendBeacon() with an empty
+		// body. The Referer must be for the LinkDomain or the host the
+		// pageview was sent to.
+		PathFromReferer bool `json:"path_from_referer"`
+
+		// Record pageviews without a path as this path, such as "/(no
+		// path)", if PathFromReferer can't get it from the Referer; they're
+		// rejected if it's empty.
+		DefaultPath string `json:"default_path"`
+
+		// Which to use for fields that are in both the query parameters and
+		// the body of a /count request; one of the CountPrecedence*
+		// constants. Fields that are in only one of them are always used.
+		CountPrecedence string `json:"count_precedence"`
+
+		// Use the "canonical" field from the client as the path, such as the
+		// <link rel="canonical"> of a page. It must be a path or a URL for
+		// the LinkDomain or the host in the Referer, and canonicals that
+		// aren't are ignored.
+		CanonicalPaths bool `json:"canonical_paths"`
+
+		// Only collect the location, language, and session if this cookie is
+		// sent; pageviews without it are still counted, but anonymously.
+		ConsentCookie ConsentCookie `json:"consent_cookie"`
+
+		// Set a cookie with a random visitor token from /count that's kept
+		// for this many days, and use it instead of the IP and User-Agent to
+		// get the session; 0 disables it. Sessions are still evicted after
+		// SessionTimeout without pageviews, after which the token starts a
+		// new session.
+		VisitorCookie int `json:"visitor_cookie"`
+
+		// Don't record pageviews sent over plain HTTP.
+		RequireHTTPS bool `json:"require_https"`
+
+		// How much the X-Goatcounter and X-Goatcounter-Code headers on
+		// /count explain; one of the DebugHeaders* constants.
+		DebugHeaders string `json:"debug_headers"`
+
+		// Request User-Agent client hints with Accept-CH, and prefer them over
+		// the User-Agent header for the browser and system.
+		ClientHints bool `json:"client_hints"`
+
+		// Extra query parameters to record as campaign fields, as
+		// "param:field" (e.g. "pid:source"). These are used if the utm_*
+		// parameter for the field isn't set.
+		CampaignParams Strings `json:"campaign_params"`
+
+		// Query parameters with the experiment assignment (e.g. "variant")
+		// to store as Hit.ExperimentHash, a hash of the values salted with
+		// ExperimentSecret. This allows correlating pageviews in the same
+		// experiment group; the parameters are removed from the path.
+		ExperimentParams Strings `json:"experiment_params"`
+		ExperimentSecret string  `json:"experiment_secret"`
+
+		// Timezone to assign pageviews to days in for the browser, system,
+		// location, language, size, and campaign stats; UTC if nil. Stats
+		// with hours are stored in UTC and shifted to the user's timezone
+		// when displayed.
+		Timezone *tz.Zone `json:"timezone,omitempty"`
+
+		// Email the site's admins if the pageviews spike or drop.
+		Alert Alert `json:"alert"`
+
+		// POST the pageview totals to a URL every few hours.
+		StatsHook StatsHook `json:"stats_hook"`
+
+		// Accept these values for the "b" parameter from clients, in addition
+		// to the count.js values (>=150).
+		ClientBots BotRange `json:"client_bots"`
+
+		// Show paths starting with these prefixes as one entry in the list of
+		// pages (e.g. "/docs/v1/*"); the full path is still stored.
+		GroupPaths Strings `json:"group_paths"`
+
+		// Only accept pageviews with a valid signature from SignPath(), made
+		// with SignatureSecret; this needs to be generated on the server for
+		// every page.
+		RequireSignature bool   `json:"require_signature"`
+		SignatureSecret  string `json:"signature_secret"`
+
+		// Only accept signatures with a nonce from SignPathNonce(). Nonces
+		// are always checked if they're in the signature; every nonce can
+		// only be used once.
+		RequireNonce bool `json:"require_nonce"`
+
+		// Only accept pageviews with the RequireHeader header set to
+		// RequireHeaderValue. This isn't a security measure like
+		// RequireSignature as anyone can copy the header from the page, but it
+		// stops casual scraping of the endpoint.
+		RequireHeader      string `json:"require_header"`
+		RequireHeaderValue string `json:"require_header_value"`
+
+		// Don't record pageviews that were sent before the page was visible
+		// for this many milliseconds, as reported in Hit.DwellMs. Pageviews
+		// without it are recorded, unless RequireDwell is set. Events are
+		// always recorded.
+		MinDwellMs   int  `json:"min_dwell_ms"`
+		RequireDwell bool `json:"require_dwell"`
+
+		// Accept pageviews from server-side clients that authenticate with an
+		// API key with the count permission, or a signature if
+		// RequireSignature is set. These skip the checks that only make sense
+		// for browsers, such as the User-Agent bot detection, EmptyUA,
+		// FlagDatacenter, RequireHeader, RequireDwell, and EdgeSessions.
+		ServerClients bool `json:"server_clients"`
+
+		// Only accept pageviews with a session token from SignSession() in
+		// the X-Goatcounter-Session header, made with EdgeSessionSecret,
+		// and use that as the session instead of the IP and User-Agent.
+		EdgeSessions      bool   `json:"edge_sessions"`
+		EdgeSessionSecret string `json:"edge_session_secret"`
+
+		// Always continue the session if it was seen less than this many
+		// seconds ago, even if it would have been evicted because of the
+		// memory limits; this way a single visitor can't start new sessions
+		// faster than this. Sessions still end after SessionTimeout. 0
+		// disables it.
+		SessionMinInterval int `json:"session_min_interval"`
+
+		// Maximum number of new sessions per minute; pageviews that would
+		// start a session beyond this are stored without a session and
+		// aren't counted as visitors, and are marked with
+		// Hit.SessionThrottled. This limits how much the visitor counts can
+		// be inflated by rotating IPs or User-Agents. 0 disables it.
+		SessionRateLimit int `json:"session_rate_limit"`
+
+		// Store referrers with the registered domain instead of the full
+		// host, so that "m.example.co.uk/page" is stored as
+		// "example.co.uk/page".
+		GroupRefDomains bool `json:"group_ref_domains"`
+
+		// Friendly names for referrer hosts, in addition to (and taking
+		// precedence over) DefaultSourceNames; see Hit.SourceName.
+		SourceNames SourceNames `json:"source_names"`
+
+		// Only store referrers from these domains, and OverflowRefLabel for
+		// all other referrers; all referrers are stored if it's empty. This
+		// matches the host or the registered domain, so "example.com" also
+		// includes "m.example.com".
+		ReferrerAllowlist Strings `json:"referrer_allowlist"`
+
+		// What to do with referrers on localhost, private addresses, and
+		// .local or .internal domains; one of the InternalRefs* constants.
+		// Default: InternalRefsGroup.
+		InternalRefs string `json:"internal_refs"`
+
+		// Values that clients can send as Hit.RefSource to override the
+		// referrer; other values are ignored.
+		RefSources Strings `json:"ref_sources"`
+
+		// Referrer schemes to store as-is; what happens to referrers with
+		// other schemes, such as "android-app://", depends on
+		// OtherRefSchemes, which is one of the OtherRefSchemes* constants.
+		// Referrers without a scheme are always kept.
+		RefSchemes      Strings `json:"ref_schemes"`
+		OtherRefSchemes string  `json:"other_ref_schemes"`
+
+		// How much of the referrer to store; one of the RefGranularity*
+		// constants. This doesn't affect campaigns or referrers that are
+		// grouped, such as "Google".
+		RefGranularity string `json:"ref_granularity"`
+
+		// Show paths and referrers with fewer than this many visitors in the
+		// selected period as one BelowThresholdLabel entry in the dashboard,
+		// API, and aggregated export, so that low-traffic entries can't be
+		// tied to individual visitors. This is applied when reading the
+		// stats; all pageviews are still stored. 0 disables it.
+		MinVisitors int `json:"min_visitors"`
+
+		// Round the time of pageviews down to this before storing them; one of
+		// the TimeResolution* constants. This doesn't affect the charts, which
+		// are per hour at most, but exports have less detail.
+		TimeResolution string `json:"time_resolution"`
+
+		// Record pageviews without a referrer as HiddenRefLabel instead of
+		// as direct visits if the request suggests the referrer was removed,
+		// such as links from HTTPS to HTTP pages.
+		HiddenRefs bool `json:"hidden_refs"`
+
+		// Remove the fragment ("#section") from paths.
+		//
+		// Deprecated: add PathStepFragment to PathNormalize instead; this adds
+		// it at the start if it's not in there.
+		StripFragment bool `json:"strip_fragment"`
+
+		// Use the hashbang route as the path, so that "/app/#!/page" is
+		// stored as "/app/page".
+		HashbangPaths bool `json:"hashbang_paths"`
+
+		// Use the route in "#/" fragments as the path, so that "/app/#/page"
+		// is stored as "/app/page"; this is for apps that use the fragment
+		// for routing, and can be combined with StripFragment to remove
+		// other fragments.
+		HashRoutes bool `json:"hash_routes"`
+
+		// Decode percent-escapes in paths that don't need to be escaped, and
+		// uppercase the remaining ones, so that "/caf%C3%A9" and "/café" are
+		// the same path.
+		NormalizeEscapes bool `json:"normalize_escapes"`
+
+		// Remove these filenames from the end of paths, so that
+		// "/dir/index.html" is stored as "/dir", with PathStepIndex.
+		IndexFiles Strings `json:"index_files"`
+
+		// Steps to normalize paths, in order; these are the PathStep*
+		// constants. DefaultPathNormalize is used if this is empty. See
+		// NormalizePath().
+		PathNormalize Strings `json:"path_normalize"`
+
+		// Query parameters to keep with PathStepQuery; all others are
+		// removed.
+		QueryAllowlist Strings `json:"query_allowlist"`
+
+		// What to do with paths longer than MaxPathLen; one of the
+		// LongPaths* constants.
+		LongPaths string `json:"long_paths"`
+
+		// Report the length of truncated paths to the client, so that the
+		// embed can be fixed; see Hit.TruncatedFrom.
+		ReportTruncation bool `json:"report_truncation"`
+
+		// Record new paths as OverflowPath once this many new paths were
+		// added today (in UTC), so that bots requesting random URLs don't
+		// fill the list of pages; known paths are still recorded as usual.
+		// 0 means no limit.
+		MaxNewPaths int `json:"max_new_paths"`
+
+		// Record new referrers as OverflowRefLabel once this many new
+		// referrers were added today (in UTC), so that referrer spam doesn't
+		// fill the list of referrers; known referrers are still recorded as
+		// usual. 0 means no limit.
+		MaxNewRefs int `json:"max_new_refs"`
+
+		// Record new event names as OverflowEvent once this many new event
+		// names were added today (in UTC), so that a buggy client sending
+		// random event names doesn't fill the list of events; known events
+		// are still recorded as usual. Events don't count towards MaxNewPaths
+		// if this is set. 0 means no limit.
+		MaxNewEvents int `json:"max_new_events"`
+
+		// Record only one in SampleRate pageviews for paths that were seen
+		// more than SampleThreshold times in the current hour; pageviews for
+		// other paths are always recorded, so pages with little traffic are
+		// still fully counted. 0 means no sampling.
+		//
+		// The recorded pageviews get a Hit.SampleWeight of SampleRate, so the
+		// stats are scaled up to about the real number; this isn't done for
+		// the HyperLogLog country uniques, which can only count sessions.
+		SampleRate      int `json:"sample_rate"`
+		SampleThreshold int `json:"sample_threshold"`
+
+		// Reject pageviews with a type that's not in HitTypes, instead of
+		// recording them as a pageview.
+		RejectUnknownTypes bool `json:"reject_unknown_types"`
+
+		// Send a 204 No Content instead of the GIF to /count requests from
+		// bots and prefetches.
+		BotNoContent bool `json:"bot_no_content"`
+
+		// Rewrite paths with these regular expressions, e.g. to collapse
+		// "/user/12345/profile" to "/user/:id/profile". PathRewriteAt is
+		// when they're applied; one of the PathRewrite* constants.
+		PathRewrites  PathRewrites `json:"path_rewrites"`
+		PathRewriteAt string       `json:"path_rewrite_at"`
+
+		// Process pageviews as usual, but show them in the test mode log
+		// instead of storing them. It's disabled after TestModeMinutes;
+		// TestModeUntil is set when it's enabled.
+		TestMode        bool      `json:"test_mode"`
+		TestModeMinutes int       `json:"test_mode_minutes"`
+		TestModeUntil   time.Time `json:"test_mode_until"`
+
+		// Record the "auth" parameter from clients as Hit.Authed, to compare
+		// logged-in and anonymous visitors.
+		RecordAuth bool `json:"record_auth"`
+
+		// Record the "value" parameter for events as Hit.EventValue, such as
+		// an order total; pageviews with a value are rejected.
+		CollectEventValue bool `json:"collect_event_value"`
+
+		// Labels to display for event names; see EventLabels. At most
+		// MaxEventLabels.
+		EventLabels EventLabels `json:"event_labels"`
+
+		// Use the settings of this site, for example for a staging site that
+		// should behave the same as production. Settings in MirrorOverrides
+		// are kept from this site, by their JSON name (e.g. "ignore_ips").
+		// The secrets and test mode are never mirrored.
+		MirrorFrom      int64   `json:"mirror_from"`
+		MirrorOverrides Strings `json:"mirror_overrides"`
+
+		ignoreIPs    *ipMatcher       // Built from IgnoreIPs on load.
+		pathRewriter *pathRewriter    // Built from PathRewrites on load.
+		denyPaths    []*regexp.Regexp // Built from DenyPathRegexps on load.
+	}
+
+	// ConsentCookie is the cookie a site sets once a visitor consents to data
+	// collection.
+	//
+	// It's disabled if the Name is empty; if Value is empty any value other
+	// than "" is accepted.
+	ConsentCookie struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	// Alert sends an email if the number of pageviews in the last 10 minutes
+	// is more than Spike percent above or Drop percent below the average over
+	// the previous Window hours.
+	//
+	// It's disabled if both Spike and Drop are 0.
+	Alert struct {
+		Spike  int `json:"spike"`
+		Drop   int `json:"drop"`
+		Window int `json:"window"`
+	}
+
+	// StatsHook sends the totals for the last Interval hours to URL as a JSON
+	// POST request, with the X-Goatcounter-Signature header signed with Secret
+	// (see SignStatsHook()). Nothing is sent if there are no pageviews.
+	//
+	// It's disabled if URL is empty.
+	StatsHook struct {
+		URL        string  `json:"url"`
+		Secret     string  `json:"secret"`
+		Interval   int     `json:"interval"`   // In hours.
+		Dimensions Strings `json:"dimensions"` // Values from StatsHookDimensions.
+	}
+
+	// BotRange is a range of bot values; it's disabled if Min is 0.
+	BotRange struct {
+		Min int `json:"min"`
+		Max int `json:"max"`
 	}
 
 	// UserSettings are all user preferences.
@@ -298,21 +713,177 @@ func defaultWidgetSettings(ctx context.Context) map[string]WidgetSettings {
 			},
 			"key": WidgetSetting{Hidden: true},
 		},
+		"errors": map[string]WidgetSetting{
+			"limit": WidgetSetting{
+				Type:  "number",
+				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
+				Help:  z18n.T(ctx, "widget-setting/help/page-size-errors|Number of errors to load"),
+				Value: float64(6),
+				Validate: func(v *zvalidate.Validator, val any) {
+					v.Range("limit", int64(val.(float64)), 1, 20)
+				},
+			},
+		},
+		"countryuniques": map[string]WidgetSetting{
+			"limit": WidgetSetting{
+				Type:  "number",
+				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
+				Help:  z18n.T(ctx, "widget-setting/help/page-size-countries|Number of countries to load"),
+				Value: float64(6),
+				Validate: func(v *zvalidate.Validator, val any) {
+					v.Range("limit", int64(val.(float64)), 1, 20)
+				},
+			},
+		},
 	}
 }
 
 func (ss SiteSettings) String() string               { return string(zjson.MustMarshal(ss)) }
 func (ss SiteSettings) Value() (driver.Value, error) { return json.Marshal(ss) }
 func (ss *SiteSettings) Scan(v any) error {
+	var err error
 	switch vv := v.(type) {
 	case []byte:
-		return json.Unmarshal(vv, ss)
+		err = json.Unmarshal(vv, ss)
 	case string:
-		return json.Unmarshal([]byte(vv), ss)
+		err = json.Unmarshal([]byte(vv), ss)
 	default:
 		return fmt.Errorf("SiteSettings.Scan: unsupported type: %T", v)
 	}
+	ss.ignoreIPs = newIPMatcher(ss.IgnoreIPs)
+	ss.pathRewriter = newPathRewriter(ss.PathRewrites)
+	ss.denyPaths = compileDenyPaths(ss.DenyPathRegexps)
+	return err
+}
+
+// Settings that are never exported with Export(): the secrets, and the test
+// mode state. Nested settings are separated with a ".".
+var exportOmit = []string{"secret", "signature_secret", "edge_session_secret", "experiment_secret",
+	"test_mode_until", "stats_hook.secret"}
+
+// Export the settings as an indented JSON document with sorted keys, which can
+// be applied to a site with Import().
+func (ss SiteSettings) Export() ([]byte, error) {
+	j, err := json.Marshal(ss)
+	if err != nil {
+		return nil, errors.Wrap(err, "SiteSettings.Export")
+	}
+	var m map[string]any
+	err = json.Unmarshal(j, &m)
+	if err != nil {
+		return nil, errors.Wrap(err, "SiteSettings.Export")
+	}
+	for _, k := range exportOmit {
+		obj, key := m, k
+		if p, c, ok := strings.Cut(k, "."); ok {
+			obj, _ = m[p].(map[string]any)
+			key = c
+		}
+		delete(obj, key)
+	}
+	j, err = json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return nil, errors.Wrap(err, "SiteSettings.Export")
+	}
+	return append(j, '\n'), nil
+}
+
+// Import a JSON document from Export() over the current settings.
+//
+// Settings that aren't in the document are kept as they are, and unknown
+// settings are an error. This doesn't validate anything; that's done when the
+// site is saved with Site.Insert() or Site.Update().
+func (ss *SiteSettings) Import(doc []byte) error {
+	d := json.NewDecoder(bytes.NewReader(doc))
+	d.DisallowUnknownFields()
+	err := d.Decode(ss)
+	if err != nil {
+		return errors.Wrap(err, "SiteSettings.Import")
+	}
+	if d.More() {
+		return errors.New("SiteSettings.Import: more than one JSON document")
+	}
+	ss.ignoreIPs = newIPMatcher(ss.IgnoreIPs)
+	ss.pathRewriter = newPathRewriter(ss.PathRewrites)
+	ss.denyPaths = compileDenyPaths(ss.DenyPathRegexps)
+	return nil
+}
+
+// IgnoredIP reports if the IP address is in the IgnoreIPs list, and returns the
+// entry that matched.
+func (ss SiteSettings) IgnoredIP(ip string) (string, bool) {
+	if len(ss.IgnoreIPs) == 0 {
+		return "", false
+	}
+	m := ss.ignoreIPs
+	if m == nil { // Not loaded from the database.
+		m = newIPMatcher(ss.IgnoreIPs)
+	}
+	return m.match(ip)
+}
+
+// DeniedPath reports if the path matches one of the DenyPathRegexps, and
+// returns the entry that matched.
+func (ss SiteSettings) DeniedPath(path string) (string, bool) {
+	if len(ss.DenyPathRegexps) == 0 {
+		return "", false
+	}
+	re := ss.denyPaths
+	if re == nil { // Not loaded from the database.
+		re = compileDenyPaths(ss.DenyPathRegexps)
+	}
+	for _, r := range re {
+		if r.MatchString(path) {
+			return r.String(), true
+		}
+	}
+	return "", false
+}
+
+// compileDenyPaths compiles the DenyPathRegexps; invalid patterns are skipped,
+// as they should be caught by SiteSettings.Validate().
+func compileDenyPaths(pats Lines) []*regexp.Regexp {
+	re := make([]*regexp.Regexp, 0, len(pats))
+	for _, p := range pats {
+		r, err := regexp.Compile(p)
+		if err != nil {
+			continue
+		}
+		re = append(re, r)
+	}
+	return re
+}
+
+// BlockedUA reports if the User-Agent contains one of the strings in
+// BlockUserAgentSubstrings, and returns the entry that matched.
+func (ss SiteSettings) BlockedUA(ua string) (string, bool) {
+	if len(ss.BlockUserAgentSubstrings) == 0 || ua == "" {
+		return "", false
+	}
+	ua = strings.ToLower(ua)
+	for _, b := range ss.BlockUserAgentSubstrings {
+		if strings.Contains(ua, strings.ToLower(b)) {
+			return b, true
+		}
+	}
+	return "", false
 }
+
+// AppUA reports if the User-Agent contains one of the strings in
+// AppUserAgentSubstrings.
+func (ss SiteSettings) AppUA(ua string) bool {
+	if len(ss.AppUserAgentSubstrings) == 0 || ua == "" {
+		return false
+	}
+	ua = strings.ToLower(ua)
+	for _, a := range ss.AppUserAgentSubstrings {
+		if strings.Contains(ua, strings.ToLower(a)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (ss UserSettings) String() string               { return string(zjson.MustMarshal(ss)) }
 func (ss UserSettings) Value() (driver.Value, error) { return json.Marshal(ss) }
 func (ss *UserSettings) Scan(v any) error {
@@ -345,6 +916,9 @@ func (ss *SiteSettings) Defaults(ctx context.Context) {
 	if ss.Public == "" {
 		ss.Public = "private"
 	}
+	if ss.Public == "secret" && ss.Secret == "" { // Secret192 as it's at most 40 characters.
+		ss.Secret = zcrypto.Secret192()
+	}
 	if ss.Collect == 0 {
 		ss.Collect = CollectReferrer | CollectUserAgent | CollectScreenSize | CollectLocation | CollectLocationRegion | CollectSession
 	}
@@ -354,26 +928,267 @@ func (ss *SiteSettings) Defaults(ctx context.Context) {
 	if ss.CollectRegions == nil {
 		ss.CollectRegions = []string{"US", "RU", "CN"}
 	}
+	if ss.Alert.Window == 0 {
+		ss.Alert.Window = 24
+	}
+	if ss.StatsHook.Interval == 0 {
+		ss.StatsHook.Interval = 1
+	}
+	if ss.StatsHook.Dimensions == nil {
+		ss.StatsHook.Dimensions = Strings{"paths"}
+	}
+	if ss.StatsHook.Enabled() && ss.StatsHook.Secret == "" {
+		ss.StatsHook.Secret = zcrypto.Secret256()
+	}
+	if ss.LanguageConfidence == "" {
+		ss.LanguageConfidence = "high"
+	}
+	if ss.LongPaths == "" {
+		ss.LongPaths = LongPathsReject
+	}
+	if ss.Webdriver == "" {
+		ss.Webdriver = WebdriverIgnore
+	}
+	if ss.RefSchemes == nil {
+		ss.RefSchemes = Strings{"http", "https"}
+	}
+	for i := range ss.RefSchemes {
+		ss.RefSchemes[i] = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(ss.RefSchemes[i]), "://"))
+	}
+	if ss.OtherRefSchemes == "" {
+		ss.OtherRefSchemes = OtherRefSchemesKeep
+	}
+	if ss.InternalRefs == "" {
+		ss.InternalRefs = InternalRefsGroup
+	}
+	if ss.RefGranularity == "" {
+		ss.RefGranularity = RefGranularityFull
+	}
+	if ss.CountPrecedence == "" {
+		ss.CountPrecedence = CountPrecedenceBody
+	}
+	if ss.DebugHeaders == "" {
+		ss.DebugHeaders = DebugHeadersFull
+	}
+	if ss.TimeResolution == "" {
+		ss.TimeResolution = TimeResolutionFull
+	}
+	if ss.PathRewriteAt == "" {
+		ss.PathRewriteAt = PathRewriteCount
+	}
+	if ss.RequireSignature && ss.SignatureSecret == "" {
+		ss.SignatureSecret = zcrypto.Secret256()
+	}
+	if ss.EdgeSessions && ss.EdgeSessionSecret == "" {
+		ss.EdgeSessionSecret = zcrypto.Secret256()
+	}
+	if len(ss.ExperimentParams) > 0 && ss.ExperimentSecret == "" {
+		ss.ExperimentSecret = zcrypto.Secret256()
+	}
+	if ss.TestModeMinutes == 0 {
+		ss.TestModeMinutes = 60
+	}
+	switch {
+	case !ss.TestMode:
+		ss.TestModeUntil = time.Time{}
+	case ss.TestModeUntil.IsZero():
+		ss.TestModeUntil = ztime.Now().Add(time.Duration(ss.TestModeMinutes) * time.Minute).Truncate(time.Second)
+	case !ss.InTestMode(): // Expired.
+		ss.TestMode, ss.TestModeUntil = false, time.Time{}
+	}
+	if ss.Timezone != nil && ss.Timezone.String() == tz.UTC.String() { // Same as not setting it.
+		ss.Timezone = nil
+	}
+	ss.ignoreIPs = newIPMatcher(ss.IgnoreIPs)
+	ss.pathRewriter = newPathRewriter(ss.PathRewrites)
+	ss.denyPaths = compileDenyPaths(ss.DenyPathRegexps)
 }
 
 func (ss *SiteSettings) Validate(ctx context.Context) error {
 	v := NewValidate(ctx)
 
 	v.Include("public", ss.Public, []string{"private", "secret", "public"})
+	v.Include("language_confidence", ss.LanguageConfidence, []string{"exact", "high", "low"})
+	v.Include("long_paths", ss.LongPaths, []string{LongPathsReject, LongPathsTruncate, LongPathsBucket})
+	v.Include("webdriver", ss.Webdriver, []string{WebdriverIgnore, WebdriverBot, WebdriverDrop})
+	if ss.MaxNewPaths != 0 {
+		v.Range("max_new_paths", int64(ss.MaxNewPaths), 1, 0)
+	}
+	if ss.MaxNewRefs != 0 {
+		v.Range("max_new_refs", int64(ss.MaxNewRefs), 1, 0)
+	}
+	if ss.MaxNewEvents != 0 {
+		v.Range("max_new_events", int64(ss.MaxNewEvents), 1, 0)
+	}
+	if ss.SampleRate != 0 {
+		v.Range("sample_rate", int64(ss.SampleRate), 1, 0)
+	}
+	v.Range("session_min_interval", int64(ss.SessionMinInterval), 0, int64(SessionTimeout/time.Second))
+	v.Range("session_rate_limit", int64(ss.SessionRateLimit), 0, 0)
+	v.Range("sample_threshold", int64(ss.SampleThreshold), 0, 0)
+	v.Include("path_rewrite_at", ss.PathRewriteAt, []string{PathRewriteCount, PathRewriteDisplay})
+	v.Include("other_ref_schemes", ss.OtherRefSchemes, []string{OtherRefSchemesKeep, OtherRefSchemesGroup, OtherRefSchemesDrop})
+	if ss.DefaultPath != "" && !strings.HasPrefix(ss.DefaultPath, "/") {
+		v.Append("default_path", "must start with a /")
+	}
+	v.Include("internal_refs", ss.InternalRefs, []string{InternalRefsKeep, InternalRefsGroup, InternalRefsDrop})
+	v.Include("ref_granularity", ss.RefGranularity, []string{RefGranularityFull, RefGranularityOrigin, RefGranularityNone})
+	v.Range("min_visitors", int64(ss.MinVisitors), 0, 0)
+	v.Include("count_precedence", ss.CountPrecedence, []string{CountPrecedenceBody, CountPrecedenceQuery})
+	v.Include("debug_headers", ss.DebugHeaders, []string{DebugHeadersFull, DebugHeadersMinimal, DebugHeadersOff})
+	v.Include("time_resolution", ss.TimeResolution, []string{TimeResolutionFull, TimeResolutionMinute, TimeResolutionHour})
+	for _, d := range ss.ReferrerAllowlist {
+		v.Domain("referrer_allowlist", d)
+	}
+	for _, r := range ss.RefSchemes {
+		if !validScheme(r) {
+			v.Append("ref_schemes", fmt.Sprintf("%q: not a valid scheme", r))
+		}
+	}
+	v.Range("test_mode_minutes", int64(ss.TestModeMinutes), 1, 7*24*60)
+	for _, o := range ss.MirrorOverrides {
+		if !validMirrorOverride(o) {
+			v.Append("mirror_overrides", fmt.Sprintf("%q: not a setting that can be mirrored", o))
+		}
+	}
+	for h, n := range ss.SourceNames {
+		if h == "" || n == "" {
+			v.Append("source_names", fmt.Sprintf("%q -> %q: host and name must be set", h, n))
+		}
+	}
+	if len(ss.EventLabels) > MaxEventLabels {
+		v.Append("event_labels", fmt.Sprintf("can have at most %d entries", MaxEventLabels))
+	}
+	for n, l := range ss.EventLabels {
+		if n == "" || l == "" {
+			v.Append("event_labels", fmt.Sprintf("%q -> %q: name and label must be set", n, l))
+		}
+	}
+	for _, r := range ss.PathRewrites {
+		if _, err := syntax.Parse(r.Pattern, syntax.Perl); err != nil {
+			msg := err.Error()
+			if sErr, ok := err.(*syntax.Error); ok {
+				msg = sErr.Code.String()
+			}
+			v.Append("path_rewrites", fmt.Sprintf("%q: %s", r.Pattern, msg))
+		}
+	}
+	for _, p := range ss.DenyPathRegexps {
+		if _, err := syntax.Parse(p, syntax.Perl); err != nil {
+			msg := err.Error()
+			if sErr, ok := err.(*syntax.Error); ok {
+				msg = sErr.Code.String()
+			}
+			v.Append("deny_path_regexps", fmt.Sprintf("%q: %s", p, msg))
+		}
+	}
 	if ss.Public == "secret" {
 		v.Len("secret", ss.Secret, 8, 40)
 		v.Contains("secret", ss.Secret, []*unicode.RangeTable{zvalidate.AlphaNumeric}, nil)
 	}
 
+	if ss.RequireSignature {
+		v.Len("signature_secret", ss.SignatureSecret, 16, 0)
+	}
+	if ss.EdgeSessions {
+		v.Len("edge_session_secret", ss.EdgeSessionSecret, 16, 0)
+	}
+	if len(ss.ExperimentParams) > 0 {
+		v.Len("experiment_secret", ss.ExperimentSecret, 16, 0)
+	}
+	if ss.MinDwellMs != 0 {
+		v.Range("min_dwell_ms", int64(ss.MinDwellMs), 1, MaxPerf)
+	}
+	if ss.RequireDwell && ss.MinDwellMs == 0 {
+		v.Append("require_dwell", "requires a minimum dwell time")
+	}
+	if ss.RequireHeader != "" {
+		if !httpguts.ValidHeaderFieldName(ss.RequireHeader) {
+			v.Append("require_header", "not a valid header name")
+		}
+		v.Required("require_header_value", ss.RequireHeaderValue)
+	}
+
 	if ss.DataRetention > 0 {
 		v.Range("data_retention", int64(ss.DataRetention), 31, 0)
 	}
+	if ss.SessionRetention != 0 {
+		v.Range("session_retention", int64(ss.SessionRetention), 1, 0)
+		if ss.DataRetention > 0 && ss.SessionRetention > ss.DataRetention {
+			v.Append("session_retention", "can't be longer than the data retention")
+		}
+	}
 
 	if len(ss.IgnoreIPs) > 0 {
+		if m := Config(ctx).MaxIgnoreIPs; m > 0 && len(ss.IgnoreIPs) > m {
+			v.Append("ignore_ips", fmt.Sprintf("can have at most %d entries", m))
+		}
 		for _, ip := range ss.IgnoreIPs {
+			if strings.ContainsRune(ip, '/') {
+				if _, err := netip.ParsePrefix(ip); err != nil {
+					v.Append("ignore_ips", fmt.Sprintf("invalid CIDR range: %q", ip))
+				}
+				continue
+			}
 			v.IP("ignore_ips", ip)
 		}
 	}
+	if ss.Alert.Enabled() {
+		v.Range("alert.spike", int64(ss.Alert.Spike), 0, 10000)
+		v.Range("alert.drop", int64(ss.Alert.Drop), 0, 100)
+		v.Range("alert.window", int64(ss.Alert.Window), 1, 168)
+	}
+	if ss.StatsHook.Enabled() {
+		v.URL("stats_hook.url", ss.StatsHook.URL)
+		v.Len("stats_hook.secret", ss.StatsHook.Secret, 16, 0)
+		v.Range("stats_hook.interval", int64(ss.StatsHook.Interval), 1, 168)
+		for _, d := range ss.StatsHook.Dimensions {
+			v.Include("stats_hook.dimensions", d, StatsHookDimensions)
+		}
+	}
+	if ss.ClientBots.Min != 0 || ss.ClientBots.Max != 0 {
+		v.Range("client_bots.min", int64(ss.ClientBots.Min), ClientBotMin, ClientBotMax)
+		v.Range("client_bots.max", int64(ss.ClientBots.Max), int64(ss.ClientBots.Min), ClientBotMax)
+	}
+	if ss.VisitorCookie != 0 {
+		v.Range("visitor_cookie", int64(ss.VisitorCookie), 1, 400) // Chrome caps it at 400 days.
+	}
+	if ss.ConsentCookie.Value != "" {
+		v.Required("consent_cookie.name", ss.ConsentCookie.Name)
+	}
+	if ss.ConsentCookie.Name != "" && !validCookieName(ss.ConsentCookie.Name) {
+		v.Append("consent_cookie.name", "not a valid cookie name")
+	}
+	if ss.LanguageCookie != "" && !validCookieName(ss.LanguageCookie) {
+		v.Append("language_cookie", "not a valid cookie name")
+	}
+	for _, p := range ss.CampaignParams {
+		param, field, ok := strings.Cut(p, ":")
+		if !ok || param == "" {
+			v.Append("campaign_params", fmt.Sprintf("%q: not in the form param:field", p))
+			continue
+		}
+		if !slices.Contains(CampaignFields, field) {
+			v.Append("campaign_params", fmt.Sprintf("%q: unknown field %q; must be one of %s",
+				p, field, strings.Join(CampaignFields, ", ")))
+		}
+	}
+	for i, s := range ss.PathNormalize {
+		v.Include("path_normalize", s, PathSteps)
+		if slices.Contains(ss.PathNormalize[:i], s) {
+			v.Append("path_normalize", fmt.Sprintf("%q: listed more than once", s))
+		}
+	}
+	for _, f := range ss.IndexFiles {
+		if f == "" || strings.ContainsAny(f, "/?#") {
+			v.Append("index_files", fmt.Sprintf("%q: must be a filename without /, ?, or #", f))
+		}
+	}
+	for _, g := range ss.GroupPaths {
+		if !strings.HasPrefix(g, "/") || !strings.HasSuffix(g, "*") || strings.Count(g, "*") > 1 {
+			v.Append("group_paths", fmt.Sprintf("%q: must start with / and end with *", g))
+		}
+	}
 	if len(ss.AllowEmbed) > 0 {
 		for _, d := range ss.AllowEmbed {
 			if d == "*" {
@@ -387,6 +1202,227 @@ func (ss *SiteSettings) Validate(ctx context.Context) error {
 	return v.ErrorOrNil()
 }
 
+// InTestMode reports if TestMode is enabled and not expired.
+func (ss SiteSettings) InTestMode() bool {
+	return ss.TestMode && ztime.Now().Before(ss.TestModeUntil)
+}
+
+// Enabled reports if the consent cookie is configured.
+func (c ConsentCookie) Enabled() bool { return c.Name != "" }
+
+// Accepted reports if the cookie value means the visitor consented.
+func (c ConsentCookie) Accepted(value string) bool {
+	if c.Value == "" {
+		return value != ""
+	}
+	return value == c.Value
+}
+
+// MinLanguageConfidence gets the LanguageConfidence setting; this is
+// language.High if it's not set.
+func (ss SiteSettings) MinLanguageConfidence() language.Confidence {
+	switch ss.LanguageConfidence {
+	case "exact":
+		return language.Exact
+	case "low":
+		return language.Low
+	default:
+		return language.High
+	}
+}
+
+// Enabled reports if the alert is enabled.
+func (a Alert) Enabled() bool { return a.Spike > 0 || a.Drop > 0 }
+
+// StatsHookDimensions are the valid values for StatsHook.Dimensions. Only the
+// stats that are stored per hour are supported.
+var StatsHookDimensions = []string{"paths", "refs"}
+
+// Enabled reports if the stats hook is enabled.
+func (h StatsHook) Enabled() bool { return h.URL != "" }
+
+// Values for SiteSettings.OtherRefSchemes.
+const (
+	OtherRefSchemesKeep  = "keep"  // Store the referrer as-is.
+	OtherRefSchemesGroup = "group" // Store the referrer as OtherRefSchemesLabel.
+	OtherRefSchemesDrop  = "drop"  // Don't store the referrer.
+)
+
+// Values for SiteSettings.InternalRefs.
+const (
+	InternalRefsKeep  = "keep"  // Store the referrer as-is.
+	InternalRefsGroup = "group" // Store the referrer as InternalRefLabel.
+	InternalRefsDrop  = "drop"  // Don't store the referrer.
+)
+
+// Values for SiteSettings.TimeResolution.
+const (
+	TimeResolutionFull   = "full"   // Store the time as-is.
+	TimeResolutionMinute = "minute" // Round down to the minute.
+	TimeResolutionHour   = "hour"   // Round down to the hour.
+)
+
+// RoundTime rounds t down to the TimeResolution.
+func (ss SiteSettings) RoundTime(t time.Time) time.Time {
+	switch ss.TimeResolution {
+	case TimeResolutionMinute:
+		return t.Truncate(time.Minute)
+	case TimeResolutionHour:
+		return t.Truncate(time.Hour)
+	}
+	return t
+}
+
+// Values for SiteSettings.RefGranularity.
+const (
+	RefGranularityFull   = "full"   // Store the full referrer, with the path and query.
+	RefGranularityOrigin = "origin" // Store only the host, without the path, query, and fragment.
+	RefGranularityNone   = "none"   // Don't store the referrer.
+)
+
+// Values for SiteSettings.CountPrecedence.
+const (
+	CountPrecedenceBody  = "body"  // Use the JSON or form body.
+	CountPrecedenceQuery = "query" // Use the query parameters.
+)
+
+// Values for SiteSettings.DebugHeaders.
+const (
+	DebugHeadersFull    = "full"    // Explain why a pageview wasn't recorded or what was changed.
+	DebugHeadersMinimal = "minimal" // Only "ignored" or "error" if a pageview wasn't recorded.
+	DebugHeadersOff     = "off"     // Don't send the headers.
+)
+
+// OtherRefSchemesLabel is the referrer that's stored for referrers with
+// OtherRefSchemesGroup.
+const OtherRefSchemesLabel = "(app)"
+
+// HiddenRefLabel is the referrer that's stored for empty referrers that were
+// likely removed; see SiteSettings.HiddenRefs.
+const HiddenRefLabel = "(referrer hidden)"
+
+// LocalRefLabel is the referrer that's stored for referrers from localhost and
+// file:// with GlobalConfig.LocalRefs.
+const LocalRefLabel = "(local)"
+
+// InternalRefLabel is the referrer that's stored for referrers on internal
+// hosts with SiteSettings.InternalRefs.
+const InternalRefLabel = "(internal)"
+
+// OverflowRefLabel is the referrer that's stored for new referrers once a site
+// reaches SiteSettings.MaxNewRefs for the day, and for referrers that aren't in
+// the SiteSettings.ReferrerAllowlist.
+const OverflowRefLabel = "(other)"
+
+// BelowThresholdLabel is the path or referrer that's shown for all entries with
+// fewer than SiteSettings.MinVisitors visitors.
+const BelowThresholdLabel = "(below threshold)"
+
+// AllowRefScheme reports if referrers with this scheme are stored as-is; the
+// scheme must be lower-case.
+func (ss SiteSettings) AllowRefScheme(scheme string) bool {
+	if ss.OtherRefSchemes == "" || ss.OtherRefSchemes == OtherRefSchemesKeep {
+		return true
+	}
+	if len(ss.RefSchemes) == 0 {
+		return scheme == "http" || scheme == "https"
+	}
+	return slices.Contains(ss.RefSchemes, scheme)
+}
+
+// AllowedRef reports if referrers from this host are stored as-is with the
+// ReferrerAllowlist.
+func (ss SiteSettings) AllowedRef(host string) bool {
+	if len(ss.ReferrerAllowlist) == 0 {
+		return true
+	}
+	d := refDomain(host)
+	for _, a := range ss.ReferrerAllowlist {
+		if strings.EqualFold(a, d) || strings.EqualFold(a, strings.TrimSuffix(host, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedRefSource reports if src is in RefSources, and returns it as it's
+// written there; this is case-insensitive.
+func (ss SiteSettings) AllowedRefSource(src string) (string, bool) {
+	src = strings.TrimSpace(src)
+	if src == "" {
+		return "", false
+	}
+	for _, s := range ss.RefSources {
+		if strings.EqualFold(s, src) {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// validScheme reports if s is a valid URL scheme, as in RFC 3986 section 3.1.
+func validScheme(s string) bool {
+	if s == "" || s[0] < 'a' || s[0] > 'z' {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// MaxPathLen is the maximum length of a path in bytes.
+const MaxPathLen = 2048
+
+// Values for SiteSettings.Webdriver.
+const (
+	WebdriverIgnore = "ignore" // Record as usual.
+	WebdriverBot    = "bot"    // Flag as BotWebdriver.
+	WebdriverDrop   = "drop"   // Don't record the pageview.
+)
+
+// Values for SiteSettings.LongPaths.
+const (
+	LongPathsReject   = "reject"   // Don't record the pageview.
+	LongPathsTruncate = "truncate" // Truncate the path to MaxPathLen.
+	LongPathsBucket   = "bucket"   // Record as LongPathBucket.
+)
+
+// LongPathBucket is the path that's stored for long paths with
+// LongPathsBucket.
+const LongPathBucket = "/__long__"
+
+// OverflowPath is the path that's stored for new paths once a site reaches
+// SiteSettings.MaxNewPaths for the day.
+const OverflowPath = "/__overflow__"
+
+// OverflowEvent is the event name that's stored for new events once a site
+// reaches SiteSettings.MaxNewEvents for the day.
+const OverflowEvent = "(other events)"
+
+// Values clients can set in BotRange. Lower values are reserved for the
+// backend detection in isbot, BotWebdriver, BotScanner, BotDatacenter,
+// BotMonitor, and BotEmptyUA, and 150 and higher for count.js.
+const (
+	ClientBotMin = 100
+	ClientBotMax = 149
+)
+
+// Has reports if v is inside the range.
+func (b BotRange) Has(v int) bool { return b.Min > 0 && v >= b.Min && v <= b.Max }
+
+// validCookieName reports if s is a valid cookie name (a "token" in RFC 6265).
+func validCookieName(s string) bool {
+	for _, c := range s {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
 func (ss SiteSettings) CanView(token string) bool {
 	return ss.Public == "public" || (ss.Public == "secret" && token == ss.Secret)
 }
@@ -405,7 +1441,7 @@ func (ss SiteSettings) CollectFlags(ctx context.Context) []CollectFlag {
 	return []CollectFlag{
 		{
 			Label: z18n.T(ctx, "data-collect/label/sessions|Sessions"),
-			Help:  z18n.T(ctx, "data-collect/help/sessions|Track unique visitors for up to 8 hours; if you disable this then someone pressing e.g. F5 to reload the page will just show as 2 pageviews instead of 1"),
+			Help:  z18n.T(ctx, "data-collect/help/sessions|Track unique visitors for up to 8 hours; if you disable this then someone pressing e.g. F5 to reload the page will just show as 2 pageviews instead of 1, and no unique visitors are reported"),
 			Flag:  CollectSession,
 		},
 		{
@@ -438,6 +1474,41 @@ func (ss SiteSettings) CollectFlags(ctx context.Context) []CollectFlag {
 			Help:  z18n.T(ctx, "data-collect/help/language|Supported languages from Accept-Language"),
 			Flag:  CollectLanguage,
 		},
+		{
+			Label: z18n.T(ctx, "data-collect/label/tls|TLS"),
+			Help:  z18n.T(ctx, "data-collect/help/tls|TLS version and cipher suite of the connection; not collected by default."),
+			Flag:  CollectTLS,
+		},
+		{
+			Label: z18n.T(ctx, "data-collect/label/perf|Load times"),
+			Help:  z18n.T(ctx, "data-collect/help/perf|Page load times sent by the client (ttfb, dcl, and load); not collected by default."),
+			Flag:  CollectPerf,
+		},
+		{
+			Label: z18n.T(ctx, "data-collect/label/connection|Connection type"),
+			Help:  z18n.T(ctx, "data-collect/help/connection|Effective connection type sent by the client (slow-2g, 2g, 3g, or 4g); not collected by default."),
+			Flag:  CollectConnection,
+		},
+		{
+			Label: z18n.T(ctx, "data-collect/label/size-bucket|Screen size bucket"),
+			Help:  z18n.T(ctx, "data-collect/help/size-bucket|Coarse screen size sent by the client (sm, md, lg, or xl), which identifies visitors much less than the exact screen size; not collected by default."),
+			Flag:  CollectSizeBucket,
+		},
+		{
+			Label: z18n.T(ctx, "data-collect/label/asn|Network (ASN)"),
+			Help:  z18n.T(ctx, "data-collect/help/asn|Number and name of the network (autonomous system) of the IP address; requires an ASN database and is not collected by default."),
+			Flag:  CollectASN,
+		},
+		{
+			Label: z18n.T(ctx, "data-collect/label/nav-type|Navigation type"),
+			Help:  z18n.T(ctx, "data-collect/help/nav-type|Direct visit, internal link, or external link, from the Sec-Fetch-Site header or the referrer; not collected by default."),
+			Flag:  CollectNavType,
+		},
+		{
+			Label: z18n.T(ctx, "data-collect/label/country-uniques|Estimated unique visitors per country"),
+			Help:  z18n.T(ctx, "data-collect/help/country-uniques|Estimate the unique visitors per country per day from the sessions, without storing anything per visitor; requires the session and country. Not collected by default."),
+			Flag:  CollectCountryUniques,
+		},
 	}
 }
 
@@ -14,6 +14,7 @@ import (
 
 	"zgo.at/errors"
 	"zgo.at/guru"
+	"zgo.at/zcache"
 	"zgo.at/zdb"
 	"zgo.at/zstd/zcrypto"
 	"zgo.at/zstd/znet"
@@ -65,12 +66,22 @@ type Site struct {
 	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
 	UpdatedAt  *time.Time `db:"updated_at" json:"updated_at"`
 	FirstHitAt time.Time  `db:"first_hit_at" json:"first_hit_at"`
+
+	// The site's own settings if Settings are mirrored from another site;
+	// these are what's stored by Update().
+	ownSettings *SiteSettings
 }
 
 // ClearCache clears the  cache for this site.
 func (s Site) ClearCache(ctx context.Context, full bool) {
 	cacheSites(ctx).Delete(strconv.FormatInt(s.ID, 10))
 
+	// Sites that mirror the settings of this site need to be reloaded too.
+	cacheSites(ctx).DeleteFunc(func(_ string, it zcache.Item) (bool, bool) {
+		ss, ok := it.Object.(*Site)
+		return ok && ss.Settings.MirrorFrom != 0, false
+	})
+
 	// TODO: be more selective about this.
 	if full {
 		cachePaths(ctx).Flush()
@@ -125,6 +136,9 @@ func (s *Site) Validate(ctx context.Context) error {
 
 	v.Sub("settings", "", s.Settings.Validate(ctx))
 	v.Sub("user_defaults", "", s.UserDefaults.Validate(ctx))
+	if err := s.validateMirror(ctx, &v); err != nil {
+		return err
+	}
 
 	// TODO: compat with older requirements, otherwise various update functions
 	// will error out.
@@ -201,17 +215,43 @@ func (s *Site) Update(ctx context.Context) error {
 		return err
 	}
 
+	// Don't store the mirrored settings as the site's own; only the settings
+	// that aren't mirrored are changed.
+	set := s.Settings
+	if s.ownSettings != nil {
+		set, err = mergeMirror(*s.ownSettings, s.Settings)
+		if err != nil {
+			return errors.Wrap(err, "Site.Update")
+		}
+	}
+
 	err = zdb.Exec(ctx,
 		`update sites set settings=?, user_defaults=?, cname=?, link_domain=?, updated_at=? where site_id=?`,
-		s.Settings, s.UserDefaults, s.Cname, s.LinkDomain, s.UpdatedAt, s.ID)
+		set, s.UserDefaults, s.Cname, s.LinkDomain, s.UpdatedAt, s.ID)
 	if err != nil {
 		return errors.Wrap(err, "Site.Update")
 	}
 
+	if s.ownSettings != nil {
+		if set.MirrorFrom == 0 {
+			s.Settings, s.ownSettings = set, nil
+		} else {
+			s.ownSettings = &set
+		}
+	}
 	s.ClearCache(ctx, false)
 	return nil
 }
 
+// storedSettings gets the settings as they're stored for this site, without
+// the settings that are mirrored from another site.
+func (s Site) storedSettings() SiteSettings {
+	if s.ownSettings != nil {
+		return *s.ownSettings
+	}
+	return s.Settings
+}
+
 func (s *Site) UpdateParent(ctx context.Context, newParent *int64) error {
 	if s.ID == 0 {
 		return errors.New("ID == 0")
@@ -406,6 +446,9 @@ func (s *Site) ByIDState(ctx context.Context, id int64, state string) error {
 	if err != nil {
 		return errors.Wrapf(err, "Site.ByIDState %d", id)
 	}
+	if err := s.mirrorSettings(ctx); err != nil {
+		return err
+	}
 	cacheSites(ctx).SetDefault(k, s)
 	return nil
 }
@@ -433,6 +476,9 @@ func (s *Site) ByHost(ctx context.Context, host string) error {
 		if err != nil {
 			return errors.Wrap(err, "site.ByHost: from custom domain")
 		}
+		if err := s.mirrorSettings(ctx); err != nil {
+			return err
+		}
 		cacheSitesHost(ctx).Set(strconv.FormatInt(s.ID, 10), host, s)
 		return nil
 	}
@@ -449,6 +495,9 @@ func (s *Site) ByHost(ctx context.Context, host string) error {
 	if err != nil {
 		return errors.Wrap(err, "site.ByHost: from code")
 	}
+	if err := s.mirrorSettings(ctx); err != nil {
+		return err
+	}
 	cacheSitesHost(ctx).Set(strconv.FormatInt(s.ID, 10), host, s)
 	return nil
 }
@@ -510,6 +559,20 @@ func (s Site) URL(ctx context.Context) string {
 		s.Code, Config(ctx).Domain, Config(ctx).Port)
 }
 
+// CountURL gets the URL to the /count endpoint, for the embed code.
+func (s Site) CountURL(ctx context.Context) string {
+	return s.URL(ctx) + Config(ctx).CountPrefix + "/count"
+}
+
+// CountJSURL gets the URL to load count.js from, for the embed code. This is
+// countDomain, or the site's URL with the CountPrefix if that's set.
+func (s Site) CountJSURL(ctx context.Context, countDomain string) string {
+	if p := Config(ctx).CountPrefix; p != "" {
+		return s.URL(ctx) + p + "/count.js"
+	}
+	return "//" + countDomain + "/count.js"
+}
+
 // LinkDomainURL creates a valid url to the configured LinkDomain.
 func (s Site) LinkDomainURL(withProto bool, paths ...string) string {
 	if s.LinkDomain == "" {
@@ -523,6 +586,17 @@ func (s Site) LinkDomainURL(withProto bool, paths ...string) string {
 	return strings.TrimRight(s.LinkDomain, "/") + path.Join(paths...)
 }
 
+// IsOwnHost reports if host is the same as the configured LinkDomain, ignoring
+// any "www." prefix.
+func (s Site) IsOwnHost(host string) bool {
+	d := s.LinkDomainURL(false)
+	if d == "" {
+		return false
+	}
+	d, _, _ = strings.Cut(d, "/")
+	return strings.EqualFold(strings.TrimPrefix(host, "www."), strings.TrimPrefix(d, "www."))
+}
+
 // IDOrParent gets this site's ID or the parent ID if that's set.
 func (s Site) IDOrParent() int64 {
 	if s.Parent != nil {
@@ -535,7 +609,7 @@ func (s Site) IDOrParent() int64 {
 // user intact.
 func (s Site) DeleteAll(ctx context.Context) error {
 	return zdb.TX(ctx, func(ctx context.Context) error {
-		for _, t := range append(statTables, "campaign_stats", "hit_counts", "ref_counts", "hits", "paths") {
+		for _, t := range append(statTables, "campaign_stats", "country_uniques", "hit_counts", "ref_counts", "hits", "js_errors", "paths") {
 			err := zdb.Exec(ctx, `delete from `+t+` where site_id=:id`, zdb.P{"id": s.ID})
 			if err != nil {
 				return errors.Wrap(err, "Site.DeleteAll: delete "+t)
@@ -562,7 +636,7 @@ func (s Site) DeleteOlderThan(ctx context.Context, days int) error {
 			return errors.Wrap(err, "Site.DeleteOlderThan: get paths")
 		}
 
-		for _, t := range append(statTables, "campaign_stats") {
+		for _, t := range append(statTables, "campaign_stats", "country_uniques") {
 			err := zdb.Exec(ctx, `delete from `+t+` where site_id=$1 and day < `+ival, s.ID)
 			if err != nil {
 				return errors.Wrap(err, "Site.DeleteOlderThan: delete "+t)
@@ -582,6 +656,10 @@ func (s Site) DeleteOlderThan(ctx context.Context, days int) error {
 		if err != nil {
 			return errors.Wrap(err, "Site.DeleteOlderThan: delete hits")
 		}
+		err = zdb.Exec(ctx, `delete from js_errors where site_id=$1 and created_at < `+ival, s.ID)
+		if err != nil {
+			return errors.Wrap(err, "Site.DeleteOlderThan: delete js_errors")
+		}
 
 		if len(pathIDs) > 0 {
 			var remainPath []int64
@@ -605,6 +683,21 @@ func (s Site) DeleteOlderThan(ctx context.Context, days int) error {
 	})
 }
 
+// DeleteHitsOlderThan deletes all pageviews for this site that are older than
+// the given number of days, but keeps the stats; see
+// SiteSettings.SessionRetention.
+//
+// The stats are updated when the pageviews are persisted, so they're never
+// deleted before they're counted.
+func (s Site) DeleteHitsOlderThan(ctx context.Context, days int) error {
+	if days < 1 {
+		return errors.Errorf("days must be at least 1: %d", days)
+	}
+	err := zdb.Exec(ctx, `/* Site.DeleteHitsOlderThan */
+		delete from hits where site_id=$1 and created_at < `+interval(ctx, days), s.ID)
+	return errors.Wrap(err, "Site.DeleteHitsOlderThan")
+}
+
 // Sites is a list of sites.
 type Sites []Site
 
@@ -0,0 +1,388 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/zjson"
+)
+
+// Settings precedence for Site.Merge().
+const (
+	MergeKeepSettings   = "target" // Keep the target site's settings.
+	MergeSourceSettings = "source" // Use the source site's settings.
+)
+
+// MergeBatch is the number of hits moved in one transaction in Site.Merge().
+var MergeBatch = 5_000
+
+// mergeStats are the stats tables Site.Merge() adds to the target; the keys are
+// the unique constraint without site_id and path_id. hit_stats is done
+// separately, as the stats are a JSON array.
+var mergeStats = []struct {
+	table string
+	keys  []string
+	count string
+}{
+	{"hit_counts", []string{"hour"}, "total"},
+	{"ref_counts", []string{"ref_id", "hour"}, "total"},
+	{"browser_stats", []string{"browser_id", "day"}, "count"},
+	{"system_stats", []string{"system_id", "day"}, "count"},
+	{"location_stats", []string{"day", "location"}, "count"},
+	{"size_stats", []string{"day", "width"}, "count"},
+	{"language_stats", []string{"day", "language"}, "count"},
+	{"campaign_stats", []string{"campaign_id", "ref", "day"}, "count"},
+}
+
+// Merge all pageviews from the site src in to this site, and delete src.
+//
+// Paths and campaigns are matched by name, and created on this site if they
+// don't exist yet. The stats are added to this site's stats, so the totals are
+// the sum of both sites. Every session in src gets a new ID, so they never
+// clash with sessions on this site.
+//
+// The settings are kept as they are with MergeKeepSettings, or replaced with
+// the src settings with MergeSourceSettings.
+//
+// Everything is done in smaller transactions rather than one big one. Data is
+// removed from src in the same transaction as it's added here, so if this gets
+// interrupted it can be run again to continue where it left off.
+func (s *Site) Merge(ctx context.Context, src *Site, settings string) error {
+	switch {
+	case s.ID == 0 || src.ID == 0:
+		return errors.New("Site.Merge: ID == 0")
+	case s.ID == src.ID:
+		return errors.New("Site.Merge: can't merge a site in to itself")
+	case s.State != StateActive || src.State != StateActive:
+		return errors.New("Site.Merge: both sites must be active")
+	case settings != MergeKeepSettings && settings != MergeSourceSettings:
+		return errors.Errorf("Site.Merge: invalid value for settings: %q", settings)
+	}
+	var n int
+	err := zdb.Get(ctx, &n, `select count(*) from sites where parent = ?`, src.ID)
+	if err != nil {
+		return errors.Wrap(err, "Site.Merge")
+	}
+	if n > 0 {
+		return errors.Errorf("Site.Merge: site %d has %d linked sites", src.ID, n)
+	}
+
+	l := zlog.Module("merge").Fields(zlog.F{"site": s.ID, "src": src.ID})
+
+	paths, err := s.mergePaths(ctx, src)
+	if err != nil {
+		return errors.Wrap(err, "Site.Merge")
+	}
+	campaigns, err := s.mergeCampaigns(ctx, src)
+	if err != nil {
+		return errors.Wrap(err, "Site.Merge")
+	}
+	l.Debugf("%d paths, %d campaigns", len(paths), len(campaigns))
+
+	for srcPath, dstPath := range paths {
+		err := zdb.TX(ctx, func(ctx context.Context) error {
+			return s.mergePathStats(ctx, src, srcPath, dstPath)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Site.Merge: stats for path %d", srcPath)
+		}
+	}
+
+	var moved int
+	for {
+		n, err := s.mergeHits(ctx, src, paths, campaigns)
+		if err != nil {
+			return errors.Wrap(err, "Site.Merge")
+		}
+		if n == 0 {
+			break
+		}
+		moved += n
+		l.Debugf("moved %d hits", moved)
+	}
+
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `update js_errors set site_id=$1 where site_id=$2`, s.ID, src.ID)
+		if err != nil {
+			return err
+		}
+		err = s.mergeCountryUniques(ctx, src)
+		if err != nil {
+			return err
+		}
+		if settings == MergeSourceSettings {
+			s.Settings, s.ownSettings = src.storedSettings(), nil
+			err := s.Update(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		if src.FirstHitAt.Before(s.FirstHitAt) {
+			err := zdb.Exec(ctx, `update sites set first_hit_at=$1 where site_id=$2`, src.FirstHitAt, s.ID)
+			if err != nil {
+				return err
+			}
+			s.FirstHitAt = src.FirstHitAt
+		}
+		if src.ReceivedData && !s.ReceivedData {
+			err := s.UpdateReceivedData(ctx)
+			if err != nil {
+				return err
+			}
+			s.ReceivedData = true
+		}
+		return src.Delete(ctx, false)
+	})
+	if err != nil {
+		return errors.Wrap(err, "Site.Merge")
+	}
+
+	s.ClearCache(ctx, true)
+	l.Printf("merged %d hits", moved)
+	return nil
+}
+
+// mergePaths gets a mapping of src path IDs to path IDs on this site, creating
+// the paths that don't exist here yet.
+func (s Site) mergePaths(ctx context.Context, src *Site) (map[int64]int64, error) {
+	var srcPaths []Path
+	err := zdb.Select(ctx, &srcPaths, `select * from paths where site_id=? order by path_id`, src.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "mergePaths")
+	}
+
+	m := make(map[int64]int64, len(srcPaths))
+	for _, p := range srcPaths {
+		var id int64
+		err := zdb.Get(ctx, &id, `select path_id from paths where site_id=? and lower(path)=lower(?) limit 1`,
+			s.ID, p.Path)
+		if zdb.ErrNoRows(err) {
+			id, err = zdb.InsertID(ctx, "path_id",
+				`insert into paths (site_id, path, title, event) values (?, ?, ?, ?)`,
+				s.ID, p.Path, p.Title, p.Event)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "mergePaths %q", p.Path)
+		}
+		m[p.ID] = id
+	}
+	return m, nil
+}
+
+// mergeCampaigns gets a mapping of src campaign IDs to campaign IDs on this
+// site, creating the campaigns that don't exist here yet. The campaign_stats
+// for src are changed to use the campaign on this site.
+func (s Site) mergeCampaigns(ctx context.Context, src *Site) (map[int64]int64, error) {
+	var srcCampaigns []Campaign
+	err := zdb.Select(ctx, &srcCampaigns, `select * from campaigns where site_id=? order by campaign_id`, src.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "mergeCampaigns")
+	}
+
+	m := make(map[int64]int64, len(srcCampaigns))
+	for _, c := range srcCampaigns {
+		var id int64
+		err := zdb.TX(ctx, func(ctx context.Context) error {
+			err := zdb.Get(ctx, &id, `select campaign_id from campaigns where site_id=? and lower(name)=lower(?) limit 1`,
+				s.ID, c.Name)
+			if zdb.ErrNoRows(err) {
+				id, err = zdb.InsertID(ctx, "campaign_id",
+					`insert into campaigns (site_id, name) values (?, ?)`, s.ID, c.Name)
+			}
+			if err != nil {
+				return err
+			}
+			return zdb.Exec(ctx, `update campaign_stats set campaign_id=? where site_id=? and campaign_id=?`,
+				id, src.ID, c.ID)
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "mergeCampaigns %q", c.Name)
+		}
+		m[c.ID] = id
+	}
+	return m, nil
+}
+
+// mergePathStats adds the stats for srcPath to dstPath on this site, and
+// deletes them from src.
+func (s Site) mergePathStats(ctx context.Context, src *Site, srcPath, dstPath int64) error {
+	for _, t := range mergeStats {
+		cols := strings.Join(t.keys, ", ")
+		err := zdb.Exec(ctx, `insert into `+t.table+` (site_id, path_id, `+cols+`, `+t.count+`)
+			select ?, ?, `+cols+`, `+t.count+` from `+t.table+` where site_id=? and path_id=?
+			on conflict (site_id, path_id, `+cols+`) do update set
+				`+t.count+` = `+t.table+`.`+t.count+` + excluded.`+t.count,
+			s.ID, dstPath, src.ID, srcPath)
+		if err != nil {
+			return errors.Wrap(err, t.table)
+		}
+		err = zdb.Exec(ctx, `delete from `+t.table+` where site_id=? and path_id=?`, src.ID, srcPath)
+		if err != nil {
+			return errors.Wrap(err, t.table)
+		}
+	}
+
+	var stats []struct {
+		Day   string `db:"day"`
+		Stats []byte `db:"stats"`
+	}
+	err := zdb.Select(ctx, &stats, `select day, stats from hit_stats where site_id=? and path_id=?`,
+		src.ID, srcPath)
+	if err != nil {
+		return errors.Wrap(err, "hit_stats")
+	}
+	for _, st := range stats {
+		day := st.Day
+		if len(day) > 10 { // PostgreSQL returns a timestamp.
+			day = day[:10]
+		}
+		var add, have []int
+		zjson.MustUnmarshal(st.Stats, &add)
+		var ex []string
+		err := zdb.Select(ctx, &ex, `select stats from hit_stats where site_id=? and path_id=? and day=?`,
+			s.ID, dstPath, day)
+		if err != nil {
+			return errors.Wrap(err, "hit_stats")
+		}
+		if len(ex) > 0 {
+			zjson.MustUnmarshal([]byte(ex[0]), &have)
+		}
+		if len(have) < len(add) {
+			have = append(have, make([]int, len(add)-len(have))...)
+		}
+		for i := range add {
+			have[i] += add[i]
+		}
+
+		err = zdb.Exec(ctx, `insert into hit_stats (site_id, path_id, day, stats) values (?, ?, ?, ?)
+			on conflict (site_id, path_id, day) do update set stats = excluded.stats`,
+			s.ID, dstPath, day, zjson.MustMarshal(have))
+		if err != nil {
+			return errors.Wrap(err, "hit_stats")
+		}
+	}
+	return errors.Wrap(zdb.Exec(ctx, `delete from hit_stats where site_id=? and path_id=?`, src.ID, srcPath),
+		"hit_stats")
+}
+
+// mergeHits moves up to MergeBatch hits from src to this site, returning the
+// number of hits that were moved.
+func (s Site) mergeHits(ctx context.Context, src *Site, paths, campaigns map[int64]int64) (int, error) {
+	var n int
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		var hits []struct {
+			ID         int64        `db:"hit_id"`
+			PathID     int64        `db:"path_id"`
+			PrevPathID *int64       `db:"prev_path_id"`
+			CampaignID *int64       `db:"campaign"`
+			Session    zint.Uint128 `db:"session"`
+		}
+		err := zdb.Select(ctx, &hits, `select hit_id, path_id, prev_path_id, campaign, session from hits
+			where site_id=? order by hit_id limit ?`, src.ID, MergeBatch)
+		if err != nil {
+			return err
+		}
+		n = len(hits)
+
+		// Group the hits with the same new values, so it's one update per
+		// session rather than one per hit.
+		type key struct {
+			path, prev, campaign int64
+			session              zint.Uint128
+		}
+		var (
+			order   []key
+			grouped = make(map[key][]int64)
+		)
+		for _, h := range hits {
+			var k key
+			k.path = paths[h.PathID]
+			if k.path == 0 {
+				return errors.Errorf("hit %d: unknown path_id %d", h.ID, h.PathID)
+			}
+			if h.PrevPathID != nil {
+				k.prev = paths[*h.PrevPathID]
+			}
+			if h.CampaignID != nil {
+				k.campaign = campaigns[*h.CampaignID]
+			}
+			if !h.Session.IsZero() {
+				k.session = mergeSession(src.ID, h.Session)
+			}
+			if _, ok := grouped[k]; !ok {
+				order = append(order, k)
+			}
+			grouped[k] = append(grouped[k], h.ID)
+		}
+
+		for _, k := range order {
+			var prev, campaign any
+			if k.prev > 0 {
+				prev = k.prev
+			}
+			if k.campaign > 0 {
+				campaign = k.campaign
+			}
+			var (
+				query = `update hits set site_id=?, path_id=?, prev_path_id=?, campaign=?`
+				args  = []any{s.ID, k.path, prev, campaign}
+			)
+			if !k.session.IsZero() {
+				query += `, session=?`
+				args = append(args, k.session)
+			}
+			err := zdb.Exec(ctx, query+` where hit_id in (?)`, append(args, grouped[k])...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return n, errors.Wrap(err, "mergeHits")
+}
+
+// mergeSession gets a new session ID for a session from the site src. This is
+// always the same for the same session, so a session that's split over several
+// batches stays one session.
+func mergeSession(src int64, session zint.Uint128) zint.Uint128 {
+	h := sha256.Sum256(append(strconv.AppendInt(nil, src, 10), session.Bytes()...))
+	return zint.Uint128{binary.BigEndian.Uint64(h[:8]), binary.BigEndian.Uint64(h[8:16])}
+}
+
+// mergeCountryUniques merges the estimators from src in to this site; the
+// estimators for src are removed when the site is deleted.
+func (s *Site) mergeCountryUniques(ctx context.Context, src *Site) error {
+	var rows []struct {
+		Day      string `db:"day"`
+		Location string `db:"location"`
+		HLL      HLL    `db:"hll"`
+	}
+	err := zdb.Select(ctx, &rows, `select day, location, hll from country_uniques where site_id = ?`, src.ID)
+	if err != nil {
+		return errors.Wrap(err, "mergeCountryUniques")
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	u := make(map[CountryDay]*HLL, len(rows))
+	for i := range rows {
+		day := rows[i].Day
+		if len(day) > 10 { // PostgreSQL returns a timestamp.
+			day = day[:10]
+		}
+		u[CountryDay{Day: day, Country: rows[i].Location}] = &rows[i].HLL
+	}
+	return StoreCountryUniques(ctx, s.ID, u)
+}
@@ -0,0 +1,233 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestSiteMerge(t *testing.T) {
+	tables := []string{"hits", "hit_counts", "ref_counts", "hit_stats", "browser_stats", "system_stats",
+		"location_stats", "size_stats", "language_stats", "campaign_stats", "js_errors"}
+
+	// Number of rows for every table, and the totals.
+	count := func(t *testing.T, ctx context.Context, site int64) map[string]int {
+		t.Helper()
+		c := make(map[string]int)
+		for _, tbl := range tables {
+			var n int
+			err := zdb.Get(ctx, &n, `select count(*) from `+tbl+` where site_id=?`, site)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c[tbl] = n
+		}
+		var total, ref int
+		zdb.Get(ctx, &total, `select coalesce(sum(total), 0) from hit_counts where site_id=?`, site)
+		zdb.Get(ctx, &ref, `select coalesce(sum(total), 0) from ref_counts where site_id=?`, site)
+		c["total"], c["ref_total"] = total, ref
+		return c
+	}
+
+	setup := func(t *testing.T) (context.Context, *Site, *Site) {
+		ctx := gctest.DB(t)
+		ztime.SetNow(t, "2020-06-18 12:00:00")
+		dst := MustGetSite(ctx)
+		src := MustGetSite(gctest.Site(ctx, t, nil, nil))
+
+		ua := "Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0"
+		now := ztime.Now()
+		gctest.StoreHits(ctx, t, false,
+			Hit{Site: dst.ID, Path: "/a", FirstVisit: true, UserAgentHeader: ua, CreatedAt: now},
+			Hit{Site: dst.ID, Path: "/b", FirstVisit: true, UserAgentHeader: ua, CreatedAt: now.Add(-24 * time.Hour)})
+		gctest.StoreHits(ctx, t, false,
+			Hit{Site: src.ID, Path: "/a", FirstVisit: true, UserAgentHeader: ua, CreatedAt: now, Ref: "https://example.com"},
+			Hit{Site: src.ID, Path: "/A", FirstVisit: true, UserAgentHeader: ua, CreatedAt: now},
+			Hit{Site: src.ID, Path: "/c", FirstVisit: true, UserAgentHeader: ua, CreatedAt: now.Add(-48 * time.Hour),
+				Query: "utm_campaign=foo"},
+		)
+		return ctx, dst, src
+	}
+
+	sum := func(a, b map[string]int) map[string]int {
+		s := make(map[string]int)
+		for k := range a {
+			s[k] = a[k] + b[k]
+		}
+		return s
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		ctx, dst, src := setup(t)
+
+		want := sum(count(t, ctx, dst.ID), count(t, ctx, src.ID))
+		wantStats := statsTotal(t, ctx, dst.ID) + statsTotal(t, ctx, src.ID)
+
+		err := dst.Merge(ctx, src, MergeKeepSettings)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		have := count(t, ctx, dst.ID)
+		if have["hits"] != want["hits"] || have["total"] != want["total"] || have["ref_total"] != want["ref_total"] {
+			t.Errorf("\nhave: %v\nwant: %v", have, want)
+		}
+		if have := statsTotal(t, ctx, dst.ID); have != wantStats {
+			t.Errorf("hit_stats: have %d; want %d", have, wantStats)
+		}
+		for k, v := range count(t, ctx, src.ID) {
+			if v != 0 {
+				t.Errorf("%s: %d rows left for source", k, v)
+			}
+		}
+
+		var paths []string
+		err = zdb.Select(ctx, &paths, `select path from paths where site_id=? order by path`, dst.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(paths, " ") != "/a /b /c" {
+			t.Errorf("paths: %v", paths)
+		}
+
+		var sessions int
+		err = zdb.Get(ctx, &sessions, `select count(distinct session) from hits where site_id=?`, dst.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sessions != 2 {
+			t.Errorf("sessions: %d", sessions)
+		}
+
+		var campaign string
+		err = zdb.Get(ctx, &campaign, `select name from campaigns
+			join campaign_stats using (campaign_id) where campaign_stats.site_id=?`, dst.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if campaign != "foo" {
+			t.Errorf("campaign: %q", campaign)
+		}
+
+		var s Site
+		err = s.ByID(ctx, src.ID)
+		if !zdb.ErrNoRows(err) {
+			t.Errorf("source not deleted: %v", err)
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		ctx, dst, src := setup(t)
+		defer func(b int) { MergeBatch = b }(MergeBatch)
+		MergeBatch = 1
+
+		want := sum(count(t, ctx, dst.ID), count(t, ctx, src.ID))
+
+		// Hit with a path that doesn't exist, so it fails after moving the
+		// other hits.
+		err := zdb.Exec(ctx, `insert into hits (site_id, path_id, browser_id, system_id, created_at)
+			values (?, 9999, 1, 1, ?)`, src.ID, ztime.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dst.Merge(ctx, src, MergeKeepSettings)
+		if !ztest.ErrorContains(err, "unknown path_id 9999") {
+			t.Fatal(err)
+		}
+		if c := count(t, ctx, src.ID); c["hits"] != 1 {
+			t.Errorf("hits left for source: %d", c["hits"])
+		}
+
+		err = zdb.Exec(ctx, `delete from hits where path_id=9999`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dst.Merge(ctx, src, MergeKeepSettings)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		have := count(t, ctx, dst.ID)
+		if have["hits"] != want["hits"] || have["total"] != want["total"] || have["ref_total"] != want["ref_total"] {
+			t.Errorf("\nhave: %v\nwant: %v", have, want)
+		}
+	})
+
+	t.Run("settings", func(t *testing.T) {
+		ctx, dst, src := setup(t)
+		src.Settings.Public = "public"
+		err := src.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = dst.Merge(ctx, src, MergeSourceSettings)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var s Site
+		err = s.ByID(ctx, dst.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Settings.Public != "public" {
+			t.Errorf("settings not copied: %q", s.Settings.Public)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		ctx, dst, src := setup(t)
+
+		err := dst.Merge(ctx, dst, MergeKeepSettings)
+		if !ztest.ErrorContains(err, "in to itself") {
+			t.Error(err)
+		}
+		err = dst.Merge(ctx, src, "both")
+		if !ztest.ErrorContains(err, "invalid value") {
+			t.Error(err)
+		}
+
+		err = (&Site{Parent: &src.ID, Code: "child"}).Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dst.Merge(ctx, src, MergeKeepSettings)
+		if !ztest.ErrorContains(err, "linked sites") {
+			t.Error(err)
+		}
+	})
+}
+
+// statsTotal gets the sum of all hit_stats for a site.
+func statsTotal(t *testing.T, ctx context.Context, site int64) int {
+	t.Helper()
+	var stats []string
+	err := zdb.Select(ctx, &stats, `select stats from hit_stats where site_id=?`, site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for _, s := range stats {
+		var h []int
+		if err := json.Unmarshal([]byte(s), &h); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range h {
+			n += c
+		}
+	}
+	return n
+}
@@ -0,0 +1,191 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zvalidate"
+)
+
+var errMirrorCycle = errors.New("mirror_from creates a cycle")
+
+// Settings that are never mirrored with SiteSettings.MirrorFrom: everything
+// that's never exported, the mirror settings themselves, and the test mode.
+var mirrorOmit = append([]string{"mirror_from", "mirror_overrides", "test_mode", "test_mode_minutes"}, exportOmit...)
+
+// mirrorSettings sets the site's settings to the settings of the site in
+// MirrorFrom, keeping the ones in MirrorOverrides and mirrorOmit. The site's
+// own settings are kept in ownSettings.
+//
+// The source site can mirror another site, in which case the settings are
+// resolved in order. A source site that's deleted is ignored, using the
+// site's own settings from there on.
+func (s *Site) mirrorSettings(ctx context.Context) error {
+	if s.Settings.MirrorFrom == 0 {
+		return nil
+	}
+	chain, err := mirrorChain(ctx, s.ID, s.Settings.MirrorFrom)
+	if err != nil {
+		return errors.Wrapf(err, "Site.mirrorSettings %d", s.ID)
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+
+	set := chain[len(chain)-1]
+	for i := len(chain) - 2; i >= 0; i-- {
+		set, err = mergeMirror(set, chain[i])
+		if err != nil {
+			return errors.Wrapf(err, "Site.mirrorSettings %d", s.ID)
+		}
+	}
+	own := s.Settings
+	s.Settings, err = mergeMirror(set, own)
+	if err != nil {
+		return errors.Wrapf(err, "Site.mirrorSettings %d", s.ID)
+	}
+	s.ownSettings = &own
+	return nil
+}
+
+// mirrorChain gets the stored settings of all sites that the site mirrors,
+// starting with from.
+func mirrorChain(ctx context.Context, siteID, from int64) ([]SiteSettings, error) {
+	var (
+		seen  = []int64{siteID}
+		chain []SiteSettings
+	)
+	for from != 0 {
+		if slices.Contains(seen, from) {
+			return nil, errMirrorCycle
+		}
+		seen = append(seen, from)
+
+		var set SiteSettings
+		err := zdb.Get(ctx, &set, `select settings from sites where site_id=$1 and state=$2`,
+			from, StateActive)
+		if zdb.ErrNoRows(err) {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "mirrorChain")
+		}
+		chain = append(chain, set)
+		from = set.MirrorFrom
+	}
+	return chain, nil
+}
+
+// mergeMirror gets the settings from src, except for the ones in mirrorOmit
+// and own.MirrorOverrides, which are kept from own.
+func mergeMirror(src, own SiteSettings) (SiteSettings, error) {
+	var srcM, ownM map[string]json.RawMessage
+	if err := unmarshalSettings(src, &srcM); err != nil {
+		return own, err
+	}
+	if err := unmarshalSettings(own, &ownM); err != nil {
+		return own, err
+	}
+
+	for _, k := range append(slices.Clone(mirrorOmit), own.MirrorOverrides...) {
+		p, c, nested := strings.Cut(k, ".")
+		if !nested {
+			srcM[k] = ownM[k]
+			continue
+		}
+
+		if srcM[p] == nil || ownM[p] == nil {
+			continue
+		}
+		var srcObj, ownObj map[string]json.RawMessage
+		if err := json.Unmarshal(srcM[p], &srcObj); err != nil {
+			return own, err
+		}
+		if err := json.Unmarshal(ownM[p], &ownObj); err != nil {
+			return own, err
+		}
+		srcObj[c] = ownObj[c]
+		j, err := json.Marshal(srcObj)
+		if err != nil {
+			return own, err
+		}
+		srcM[p] = j
+	}
+
+	j, err := json.Marshal(srcM)
+	if err != nil {
+		return own, err
+	}
+	var set SiteSettings
+	err = set.Scan(j)
+	return set, err
+}
+
+func unmarshalSettings(ss SiteSettings, m *map[string]json.RawMessage) error {
+	j, err := json.Marshal(ss)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, m)
+}
+
+// settingNames gets the JSON names of all top-level settings.
+func settingNames() []string {
+	var m map[string]json.RawMessage
+	if err := unmarshalSettings(SiteSettings{}, &m); err != nil {
+		panic(err) // Should never happen.
+	}
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// validateMirror checks that MirrorFrom is a site in the same account, and
+// that it doesn't create a cycle.
+func (s *Site) validateMirror(ctx context.Context, v *zvalidate.Validator) error {
+	from := s.Settings.MirrorFrom
+	if from == 0 {
+		return nil
+	}
+	if from == s.ID {
+		v.Append("settings.mirror_from", "cannot be the site itself")
+		return nil
+	}
+
+	var src Site
+	err := zdb.Get(ctx, &src, `select * from sites where site_id=$1 and state=$2`, from, StateActive)
+	if zdb.ErrNoRows(err) {
+		v.Append("settings.mirror_from", "site doesn't exist")
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Site.validateMirror")
+	}
+	if s.ID == 0 && s.Parent == nil || src.IDOrParent() != s.IDOrParent() {
+		v.Append("settings.mirror_from", "must be a site in the same account")
+		return nil
+	}
+
+	_, err = mirrorChain(ctx, s.ID, from)
+	if errors.Is(err, errMirrorCycle) {
+		v.Append("settings.mirror_from", "site mirrors the settings of this site")
+		return nil
+	}
+	return err
+}
+
+// validMirrorOverride reports if the setting can be in MirrorOverrides.
+func validMirrorOverride(k string) bool {
+	return !slices.Contains(mirrorOmit, k) && slices.Contains(settingNames(), k)
+}
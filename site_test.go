@@ -5,13 +5,17 @@
 package goatcounter_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	. "zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
 	"zgo.at/zvalidate"
 )
 
@@ -80,6 +84,81 @@ func TestSiteValidate(t *testing.T) {
 			},
 			map[string][]string{"code": {"already exists"}},
 		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{ClientBots: BotRange{Min: 100, Max: 119}}},
+			nil,
+			nil,
+		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{ClientBots: BotRange{Min: 5, Max: 20}}},
+			nil,
+			map[string][]string{"settings.client_bots.min": {"must be 100 or higher"}},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{ClientBots: BotRange{Min: 120, Max: 160}}},
+			nil,
+			map[string][]string{"settings.client_bots.max": {"must be 149 or lower"}},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{PathRewrites: PathRewrites{
+				{Pattern: `^/user/\d+/`, Replace: "/user/:id/"},
+				{Pattern: `^/post/(\d+`, Replace: "/post/:id"},
+			}}},
+			nil,
+			map[string][]string{"settings.path_rewrites": {`"^/post/(\\d+": missing closing )`}},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{DenyPathRegexps: Lines{
+				`\.(php|asp|env)$`,
+				`^/wp-(admin|login`,
+			}}},
+			nil,
+			map[string][]string{"settings.deny_path_regexps": {`"^/wp-(admin|login": missing closing )`}},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{RequireHeader: "X My Embed"}},
+			nil,
+			map[string][]string{
+				"settings.require_header":       {"not a valid header name"},
+				"settings.require_header_value": {"must be set"},
+			},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{ReferrerAllowlist: Strings{"example.com", "not a domain"}}},
+			nil,
+			map[string][]string{"settings.referrer_allowlist": {"must be a valid domain: need at least 2 labels"}},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{IndexFiles: Strings{"index.html", "docs/index.html"}}},
+			nil,
+			map[string][]string{"settings.index_files": {`"docs/index.html": must be a filename without /, ?, or #`}},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{RefGranularity: "path"}},
+			nil,
+			map[string][]string{"settings.ref_granularity": {"must be one of ‘full, origin, none’"}},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{MaxNewPaths: -1}},
+			nil,
+			map[string][]string{"settings.max_new_paths": {"must be 1 or higher"}},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{SampleRate: -1, SampleThreshold: -1}},
+			nil,
+			map[string][]string{
+				"settings.sample_rate":      {"must be 1 or higher"},
+				"settings.sample_threshold": {"must be 0 or higher"},
+			},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Settings: SiteSettings{RefSchemes: Strings{"HTTPS://", "android app"}, OtherRefSchemes: "x"}},
+			nil,
+			map[string][]string{
+				"settings.ref_schemes":       {`"android app": not a valid scheme`},
+				"settings.other_ref_schemes": {"must be one of ‘keep, group, drop’"},
+			},
+		},
 	}
 
 	for i, tt := range tests {
@@ -107,3 +186,326 @@ func TestSiteValidate(t *testing.T) {
 		})
 	}
 }
+
+// Make sure that all secrets are omitted from the export, including ones that
+// are added later.
+func TestSiteSettingsExportSecrets(t *testing.T) {
+	var (
+		ss      SiteSettings
+		secrets []string
+		walk    func(v reflect.Value, prefix string)
+	)
+	walk = func(v reflect.Value, prefix string) {
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			switch {
+			case f.Type.Kind() == reflect.Struct:
+				walk(v.Field(i), prefix+name+".")
+			case f.Type.Kind() == reflect.String && strings.HasSuffix(name, "secret"):
+				v.Field(i).SetString("hunter2")
+				secrets = append(secrets, prefix+name)
+			}
+		}
+	}
+	walk(reflect.ValueOf(&ss).Elem(), "")
+	if len(secrets) < 5 {
+		t.Fatalf("found only %d secrets: %v", len(secrets), secrets)
+	}
+
+	doc, err := ss.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(doc, []byte("hunter2")) {
+		t.Errorf("secret in export; found secrets: %v\n%s", secrets, doc)
+	}
+}
+
+func TestSiteSettingsExport(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	site.Settings.IgnoreIPs = Strings{"1.1.1.1", "10.0.0.0/8"}
+	site.Settings.Collect.Clear(CollectLocationRegion)
+	site.Settings.GroupPaths = Strings{"/docs/*"}
+	site.Settings.PathRewrites = PathRewrites{{Pattern: `^/user/\d+`, Replace: "/user/:id"}}
+	site.Settings.IndexFiles = Strings{"index.html"}
+	site.Settings.RequireSignature = true
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := site.Settings.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{`"secret"`, `"signature_secret"`, `"edge_session_secret"`, `"test_mode_until"`} {
+		if bytes.Contains(doc, []byte(k)) {
+			t.Errorf("%s in export:\n%s", k, doc)
+		}
+	}
+
+	// Re-import to a new site.
+	var s Site
+	err = s.Settings.Import(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Code = "imported"
+	err = s.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Site
+	err = got.ByID(ctx, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc2, err := got.Settings.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := ztest.Diff(string(doc2), string(doc)); d != "" {
+		t.Error(d)
+	}
+	if got.Settings.SignatureSecret == "" || got.Settings.SignatureSecret == site.Settings.SignatureSecret {
+		t.Errorf("signature secret not regenerated: %q", got.Settings.SignatureSecret)
+	}
+	if _, ok := got.Settings.IgnoredIP("10.1.2.3"); !ok {
+		t.Error("IgnoreIPs not applied")
+	}
+
+	// Importing over the existing settings keeps the secrets.
+	secret := site.Settings.SignatureSecret
+	err = site.Settings.Import(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if site.Settings.SignatureSecret != secret {
+		t.Errorf("secret changed: %q", site.Settings.SignatureSecret)
+	}
+
+	// Errors.
+	err = site.Settings.Import([]byte(`{"ignore_ipz": []}`))
+	if !ztest.ErrorContains(err, `unknown field "ignore_ipz"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+	err = site.Settings.Import([]byte(`{"data_retention": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = site.Update(ctx)
+	if !ztest.ErrorContains(err, "data_retention") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestSiteMirror(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	prod := MustGetSite(ctx)
+	prod.Settings.IgnoreIPs = Strings{"10.0.0.0/8"}
+	prod.Settings.IndexFiles = Strings{"index.html"}
+	prod.Settings.StripFragment = true
+	prod.Settings.RequireSignature = true
+	err := prod.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staging := Site{Code: "stage", Parent: &prod.ID}
+	staging.Settings.MirrorFrom = prod.ID
+	staging.Settings.MirrorOverrides = Strings{"index_files"}
+	staging.Settings.IndexFiles = Strings{"index.php"}
+	staging.Settings.RequireSignature = true
+	err = staging.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(id int64) Site {
+		t.Helper()
+		var s Site
+		err := s.ByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	t.Run("mirrored", func(t *testing.T) {
+		s := get(staging.ID)
+		if _, ok := s.Settings.IgnoredIP("10.1.2.3"); !ok {
+			t.Errorf("IgnoreIPs not mirrored: %v", s.Settings.IgnoreIPs)
+		}
+		if !s.Settings.StripFragment {
+			t.Error("StripFragment not mirrored")
+		}
+		if have := s.Settings.IndexFiles.String(); have != "index.php" {
+			t.Errorf("override not kept: %q", have)
+		}
+		if s.Settings.SignatureSecret == "" || s.Settings.SignatureSecret == prod.Settings.SignatureSecret {
+			t.Errorf("signature secret mirrored: %q", s.Settings.SignatureSecret)
+		}
+		if s.Settings.MirrorFrom != prod.ID {
+			t.Errorf("MirrorFrom: %d", s.Settings.MirrorFrom)
+		}
+	})
+
+	t.Run("propagate", func(t *testing.T) {
+		get(staging.ID) // Make sure it's cached.
+
+		prod := get(prod.ID)
+		prod.Settings.StripFragment = false
+		prod.Settings.IgnoreIPs = Strings{"192.168.0.0/16"}
+		err := prod.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := get(staging.ID)
+		if s.Settings.StripFragment {
+			t.Error("StripFragment not updated")
+		}
+		if _, ok := s.Settings.IgnoredIP("192.168.1.1"); !ok {
+			t.Errorf("IgnoreIPs not updated: %v", s.Settings.IgnoreIPs)
+		}
+	})
+
+	t.Run("test mode", func(t *testing.T) {
+		prod := get(prod.ID)
+		prod.Settings.TestMode = false
+		prod.Settings.TestModeMinutes = 10
+		err := prod.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := get(staging.ID)
+		s.Settings.TestMode = true
+		s.Settings.TestModeMinutes = 30
+		err = s.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s = get(staging.ID)
+		if !s.Settings.InTestMode() || s.Settings.TestModeMinutes != 30 {
+			t.Errorf("test mode mirrored: %t %d", s.Settings.TestMode, s.Settings.TestModeMinutes)
+		}
+		if get(prod.ID).Settings.TestMode {
+			t.Error("test mode set on the source site")
+		}
+
+		s.Settings.TestMode = false
+		err = s.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		s := get(staging.ID)
+		s.Settings.IndexFiles = Strings{"default.htm"}
+		err := s.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Mirrored settings aren't stored as the site's own.
+		var stored SiteSettings
+		err = zdb.Get(ctx, &stored, `select settings from sites where site_id=$1`, staging.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored.IgnoreIPs) != 0 || stored.StripFragment {
+			t.Errorf("mirrored settings stored: %v %t", stored.IgnoreIPs, stored.StripFragment)
+		}
+		if have := stored.IndexFiles.String(); have != "default.htm" {
+			t.Errorf("override not stored: %q", have)
+		}
+		if have := get(staging.ID).Settings.IndexFiles.String(); have != "default.htm" {
+			t.Errorf("override not updated: %q", have)
+		}
+	})
+
+	t.Run("chain", func(t *testing.T) {
+		dev := Site{Code: "devel", Parent: &prod.ID}
+		dev.Settings.MirrorFrom = staging.ID
+		err := dev.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := get(dev.ID)
+		if _, ok := s.Settings.IgnoredIP("192.168.1.1"); !ok {
+			t.Errorf("IgnoreIPs not mirrored: %v", s.Settings.IgnoreIPs)
+		}
+		if have := s.Settings.IndexFiles.String(); have != "default.htm" {
+			t.Errorf("IndexFiles: %q", have)
+		}
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		s := get(staging.ID)
+		s.Settings.MirrorFrom = 0
+		err := s.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := s.Settings.IgnoredIP("192.168.1.1"); ok {
+			t.Errorf("mirrored IgnoreIPs kept: %v", s.Settings.IgnoreIPs)
+		}
+		s = get(staging.ID)
+		if len(s.Settings.IgnoreIPs) != 0 || s.Settings.IndexFiles.String() != "default.htm" {
+			t.Errorf("not the own settings: %v %v", s.Settings.IgnoreIPs, s.Settings.IndexFiles)
+		}
+
+		s.Settings.MirrorFrom = prod.ID
+		err = s.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		tests := []struct {
+			mirror    int64
+			overrides Strings
+			want      string
+		}{
+			{staging.ID, nil, "mirror_from: site mirrors the settings of this site"},
+			{prod.ID, nil, "mirror_from: cannot be the site itself"},
+			{9999, nil, "mirror_from: site doesn't exist"},
+			{0, Strings{"ignore_ipz"}, `mirror_overrides: "ignore_ipz": not a setting that can be mirrored`},
+			{0, Strings{"secret"}, `mirror_overrides: "secret": not a setting that can be mirrored`},
+		}
+		for _, tt := range tests {
+			t.Run("", func(t *testing.T) {
+				prod := get(prod.ID)
+				prod.Settings.MirrorFrom = tt.mirror
+				prod.Settings.MirrorOverrides = tt.overrides
+				err := prod.Update(ctx)
+				if !ztest.ErrorContains(err, tt.want) {
+					t.Errorf("wrong error\nhave: %v\nwant: %s", err, tt.want)
+				}
+			})
+		}
+
+		other := Site{Code: "other"}
+		err := other.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.Settings.MirrorFrom = prod.ID
+		err = other.Update(ctx)
+		if !ztest.ErrorContains(err, "mirror_from: must be a site in the same account") {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// SourceNames maps referrer hosts to a friendly name, such as "t.co" to
+// "Twitter". The host can also be an app package for "android-app://"
+// referrers, such as "com.google.android.gm".
+//
+// The text format is one mapping per line, as "host -> name".
+type SourceNames map[string]string
+
+// DefaultSourceNames is used for hosts that aren't in SiteSettings.SourceNames.
+var DefaultSourceNames = SourceNames{
+	"t.co":                   "Twitter",
+	"twitter.com":            "Twitter",
+	"x.com":                  "Twitter",
+	"com.twitter.android":    "Twitter",
+	"facebook.com":           "Facebook",
+	"fb.me":                  "Facebook",
+	"com.facebook.katana":    "Facebook",
+	"instagram.com":          "Instagram",
+	"com.instagram.android":  "Instagram",
+	"linkedin.com":           "LinkedIn",
+	"lnkd.in":                "LinkedIn",
+	"com.linkedin.android":   "LinkedIn",
+	"reddit.com":             "Reddit",
+	"com.reddit.frontpage":   "Reddit",
+	"youtube.com":            "YouTube",
+	"youtu.be":               "YouTube",
+	"pinterest.com":          "Pinterest",
+	"news.ycombinator.com":   "Hacker News",
+	"lobste.rs":              "Lobsters",
+	"bsky.app":               "Bluesky",
+	"threads.net":            "Threads",
+	"t.me":                   "Telegram",
+	"org.telegram.messenger": "Telegram",
+	"com.whatsapp":           "WhatsApp",
+	"com.slack":              "Slack",
+	"com.discord":            "Discord",
+
+	"mail.google.com":              "Gmail",
+	"com.google.android.gm":        "Gmail",
+	"outlook.live.com":             "Outlook",
+	"outlook.office.com":           "Outlook",
+	"com.microsoft.office.outlook": "Outlook",
+	"mail.yahoo.com":               "Yahoo Mail",
+	"mail.proton.me":               "Proton Mail",
+
+	"google.com": "Google",
+	"com.google.android.googlequicksearchbox": "Google",
+	"bing.com":         "Bing",
+	"duckduckgo.com":   "DuckDuckGo",
+	"search.brave.com": "Brave Search",
+	"yandex.ru":        "Yandex",
+	"baidu.com":        "Baidu",
+}
+
+// sourceNameSep separates the host and name in the text format; whitespace
+// around it is ignored.
+const sourceNameSep = "->"
+
+func (s SourceNames) String() string {
+	hosts := make([]string, 0, len(s))
+	for h := range s {
+		hosts = append(hosts, h)
+	}
+	slices.Sort(hosts)
+
+	b := new(strings.Builder)
+	for i, h := range hosts {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(h + " " + sourceNameSep + " " + s[h])
+	}
+	return b.String()
+}
+
+func (s SourceNames) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+func (s *SourceNames) UnmarshalText(v []byte) error {
+	n := make(SourceNames)
+	for i, line := range strings.Split(string(v), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		host, name, ok := strings.Cut(line, sourceNameSep)
+		if !ok {
+			return fmt.Errorf("line %d: no %q in %q", i+1, sourceNameSep, line)
+		}
+		n[strings.ToLower(strings.TrimSpace(host))] = strings.TrimSpace(name)
+	}
+	*s = n
+	return nil
+}
+
+// SourceName gets the friendly name for a referrer host from SourceNames and
+// DefaultSourceNames, in that order. Both the host and the registered domain
+// are looked up, so "mobile.twitter.com" is found as "twitter.com".
+//
+// Hosts that aren't in either are returned as the registered domain if
+// domain is set (for http and https referrers), or as-is otherwise.
+func (ss SiteSettings) SourceName(host string, domain bool) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return ""
+	}
+	keys := []string{host}
+	if domain {
+		if d := refDomain(host); d != host {
+			keys = append(keys, d)
+		}
+	}
+	for _, m := range []SourceNames{ss.SourceNames, DefaultSourceNames} {
+		for _, k := range keys {
+			if n, ok := m[k]; ok {
+				return n
+			}
+		}
+	}
+	// Group all "google.co.nz", "google.nl", etc. as in cleanRefURL().
+	if d := keys[len(keys)-1]; domain && strings.HasPrefix(d, "google.") {
+		return DefaultSourceNames["google.com"]
+	}
+	return keys[len(keys)-1]
+}
+
+// setSourceName sets SourceName from the referrer host, or from the referrer
+// up to the first "/" if there is no host (e.g. "com.Slack").
+func (h *Hit) setSourceName(site *Site, scheme string) {
+	host := h.RefURL.Hostname()
+	if host == "" {
+		host, _, _ = strings.Cut(h.Ref, "/")
+	}
+	h.SourceName = site.Settings.SourceName(host, scheme == "http" || scheme == "https")
+}
@@ -0,0 +1,89 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+)
+
+func TestHitDefaultsSourceName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		// Mapped hosts.
+		{"https://t.co/c3MITw38Yq", "Twitter"},
+		{"https://mobile.twitter.com/user", "Twitter"},
+		{"https://mail.google.com/mail/u/0", "Gmail"},
+		{"https://www.google.co.nz/search", "Google"},
+		{"https://news.ycombinator.com/item?id=1", "Hacker News"},
+
+		// App packages.
+		{"android-app://com.google.android.gm", "Gmail"},
+		{"android-app://com.google.android.gm/", "Gmail"},
+		{"android-app://org.telegram.messenger", "Telegram"},
+		{"com.Slack", "Slack"},
+		{"android-app://com.example.app", "com.example.app"},
+
+		// Unmapped hosts are the registered domain.
+		{"https://www.news.example.co.uk/page", "example.co.uk"},
+		{"https://example.com", "example.com"},
+		{"http://127.0.0.1:8080/x", "127.0.0.1"},
+
+		// Site settings take precedence.
+		{"https://blog.example.org/post", "Our blog"},
+		{"https://lnkd.in/abc", "LinkedIn (site)"},
+
+		{"", ""},
+	}
+
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+	site.Settings.InternalRefs = InternalRefsKeep
+	err := site.Settings.SourceNames.UnmarshalText([]byte("blog.example.org -> Our blog\n\n  LNKD.in->LinkedIn (site)  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			h := Hit{Path: "/", Ref: tt.in}
+			h.RefURL, _ = url.Parse(tt.in)
+			err := h.Defaults(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.SourceName != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", h.SourceName, tt.want)
+			}
+		})
+	}
+
+	t.Run("text", func(t *testing.T) {
+		if h, w := site.Settings.SourceNames.String(), "blog.example.org -> Our blog\nlnkd.in -> LinkedIn (site)"; h != w {
+			t.Errorf("\nhave: %q\nwant: %q", h, w)
+		}
+
+		var s SourceNames
+		err := s.UnmarshalText([]byte("t.co Twitter"))
+		if err == nil || !strings.Contains(err.Error(), `line 1: no "->"`) {
+			t.Errorf("wrong error: %v", err)
+		}
+
+		site.Settings.SourceNames = SourceNames{"t.co": ""}
+		err = site.Update(ctx)
+		if err == nil || !strings.Contains(err.Error(), "host and name must be set") {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
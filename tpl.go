@@ -160,8 +160,8 @@ func init() {
 		// 	to your actual site in the examples below. This will be done automatically if
 		// 	you view the docs linked from your site in the top-right corner.</p>
 		// {{end}}
-		t = template.Must(t.New("code").Parse(`&lt;script data-goatcounter="{{.SiteURL}}/count"` + "\n" +
-			`        async src="//{{.CountDomain}}/count.js"&gt;&lt;/script&gt;`))
+		t = template.Must(t.New("code").Parse(`&lt;script data-goatcounter="{{.CountURL}}"` + "\n" +
+			`        async src="{{.CountJSURL}}"&gt;&lt;/script&gt;`))
 		t = template.Must(t.New("sh_header").Parse(`#!/bin/sh` + "\n" +
 			`token="[your api token]"` + "\n" +
 			`api="https://[my code].goatcounter.com/api/v0"` + "\n" +
@@ -208,11 +208,14 @@ func init() {
 			{href: "campaigns", label: "Track campaigns?"},
 			{href: "countjs-versions", label: "count.js versions and SRI"},
 			{href: "countjs-host", label: "Host count.js somewhere else?"},
-			{href: "frame", label: "Embed GoatCounter in a frame?"}}},
+			{href: "frame", label: "Embed GoatCounter in a frame?"},
+			{href: "signature", label: "Prevent others from sending pageviews?"},
+			{href: "edge-sessions", label: "Calculate sessions on a CDN edge?"}}},
 		{label: "Other", items: []x{
 			// TODO: add "adblock" page
 			// TODO: add "campiagns page"; link in "settings_main".
 			{href: "export", label: "Export format"},
+			{href: "stats-hook", label: "Stats webhook"},
 			{href: "api", label: "API"},
 			{href: "faq", label: "FAQ"},
 			{href: "translating", label: "Translating GoatCounter"}}},
@@ -113,3 +113,21 @@ func (l Strings) MarshalText() ([]byte, error) {
 	v, err := l.Value()
 	return []byte(fmt.Sprintf("%s", v)), err
 }
+
+// Lines stores a slice of []string as one string per line, for values that can
+// contain commas or spaces, such as regular expressions. Blank lines are
+// ignored.
+type Lines []string
+
+func (l Lines) String() string               { return strings.Join(l, "\n") }
+func (l Lines) MarshalText() ([]byte, error) { return []byte(l.String()), nil }
+func (l *Lines) UnmarshalText(v []byte) error {
+	var lines []string
+	for _, line := range strings.Split(string(v), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	*l = lines
+	return nil
+}
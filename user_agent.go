@@ -6,6 +6,9 @@ package goatcounter
 
 import (
 	"context"
+	"net/http"
+	"strconv"
+	"strings"
 
 	"zgo.at/errors"
 	"zgo.at/gadget"
@@ -16,17 +19,18 @@ import (
 
 type UserAgent struct {
 	UserAgent string
+	Hints     ClientHints // Preferred over the User-Agent if set.
 	Isbot     uint8
 	BrowserID int64
 	SystemID  int64
 }
 
 func (p *UserAgent) GetOrInsert(ctx context.Context) error {
-	shortUA := gadget.ShortenUA(p.UserAgent)
-	c, ok := cacheUA(ctx).Get(p.UserAgent)
+	shortUA, hints := gadget.ShortenUA(p.UserAgent), p.Hints.key()
+	c, ok := cacheUA(ctx).Get(p.UserAgent + hints)
 	if ok {
 		*p = c.(UserAgent)
-		cacheUA(ctx).Touch(shortUA, zcache.DefaultExpiration)
+		cacheUA(ctx).Touch(shortUA+hints, zcache.DefaultExpiration)
 		return nil
 	}
 
@@ -35,6 +39,12 @@ func (p *UserAgent) GetOrInsert(ctx context.Context) error {
 		browser Browser
 		system  System
 	)
+	if name, version := p.Hints.browser(); name != "" {
+		ua.BrowserName, ua.BrowserVersion = name, version
+	}
+	if name, version := p.Hints.system(); name != "" {
+		ua.OSName, ua.OSVersion = name, version
+	}
 
 	err := browser.GetOrInsert(ctx, ua.BrowserName, ua.BrowserVersion)
 	if err != nil {
@@ -50,10 +60,137 @@ func (p *UserAgent) GetOrInsert(ctx context.Context) error {
 
 	p.Isbot = uint8(isbot.UserAgent(p.UserAgent))
 
-	cacheUA(ctx).SetDefault(shortUA, *p)
+	cacheUA(ctx).SetDefault(shortUA+hints, *p)
 	return nil
 }
 
+// ClientHints are the User-Agent client hints sent by Chromium-based browsers.
+//
+// Sec-CH-UA and Sec-CH-UA-Platform are sent by default; the others are only
+// sent after opting in with the Accept-CH header.
+//
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Client_hints
+type ClientHints struct {
+	Brands          string // Sec-CH-UA
+	Platform        string // Sec-CH-UA-Platform
+	PlatformVersion string // Sec-CH-UA-Platform-Version
+}
+
+// AcceptClientHints is the value for the Accept-CH header to request all the
+// hints we use.
+const AcceptClientHints = "Sec-CH-UA, Sec-CH-UA-Platform, Sec-CH-UA-Platform-Version"
+
+// ClientHintsFromHeader gets the client hints from the request headers.
+func ClientHintsFromHeader(h http.Header) ClientHints {
+	return ClientHints{
+		Brands:          h.Get("Sec-CH-UA"),
+		Platform:        unquoteHint(h.Get("Sec-CH-UA-Platform")),
+		PlatformVersion: unquoteHint(h.Get("Sec-CH-UA-Platform-Version")),
+	}
+}
+
+func (c ClientHints) IsZero() bool { return c == ClientHints{} }
+
+// key for the cache; this is "" if there are no hints.
+func (c ClientHints) key() string {
+	if c.IsZero() {
+		return ""
+	}
+	return "\x00" + c.Brands + "\x00" + c.Platform + "\x00" + c.PlatformVersion
+}
+
+// Brands that are less specific than any other brand in the list; e.g. Chrome
+// sends both "Chromium" and "Google Chrome".
+var genericBrands = map[string]struct{}{"Chromium": {}}
+
+// Rename brands to what gadget.ParseUA() uses.
+var brandNames = map[string]string{
+	"Google Chrome":  "Chrome",
+	"Microsoft Edge": "Edge",
+}
+
+// browser gets the browser name and major version from the Sec-CH-UA brand
+// list, which looks like:
+//
+//	"Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99"
+//
+// The "Not-A.Brand" is a "GREASE" value to make sure servers don't rely on the
+// exact format or order; it's different every time.
+func (c ClientHints) browser() (string, string) {
+	var name, version, generic, genericVersion string
+	for _, b := range strings.Split(c.Brands, ",") {
+		n, v, _ := strings.Cut(b, ";")
+		n = unquoteHint(n)
+		v = strings.TrimSpace(v)
+		if !strings.HasPrefix(v, "v=") {
+			continue
+		}
+		v = unquoteHint(v[2:])
+		if n == "" || isGreaseBrand(n) {
+			continue
+		}
+		if _, ok := genericBrands[n]; ok {
+			generic, genericVersion = n, v
+			continue
+		}
+		if r, ok := brandNames[n]; ok {
+			n = r
+		}
+		name, version = n, v
+		break
+	}
+	if name == "" {
+		return generic, genericVersion
+	}
+	return name, version
+}
+
+// system gets the OS name and version, in the same format as
+// gadget.ParseUA().
+func (c ClientHints) system() (string, string) {
+	name := c.Platform
+	switch name {
+	case "", "Unknown":
+		return "", ""
+	case "Chrome OS", "Chromium OS":
+		return "Chrome OS", ""
+	case "Linux":
+		return name, ""
+	}
+	if c.PlatformVersion == "" { // Not opted in; the User-Agent is better.
+		return "", ""
+	}
+
+	major, minor, _ := strings.Cut(c.PlatformVersion, ".")
+	minor, _, _ = strings.Cut(minor, ".")
+
+	switch name {
+	case "Windows":
+		// https://learn.microsoft.com/en-us/microsoft-edge/web-platform/how-to-detect-win11
+		// 1-10 are all Windows 10, and 0 is 7, 8, or 8.1; we can't tell which.
+		n, err := strconv.Atoi(major)
+		switch {
+		case err != nil || n == 0:
+			return "", "" // Use the User-Agent.
+		case n >= 13:
+			return name, "11"
+		default:
+			return name, "10"
+		}
+	case "macOS":
+		return name, major + "." + minor
+	}
+	return name, major
+}
+
+func isGreaseBrand(b string) bool {
+	return strings.Contains(b, "Not") && strings.Contains(b, "Brand")
+}
+
+func unquoteHint(s string) string {
+	return strings.Trim(strings.TrimSpace(s), `"`)
+}
+
 type Browser struct {
 	ID      int64  `db:"browser_id"`
 	Name    string `db:"name"`
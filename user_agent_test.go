@@ -94,3 +94,69 @@ func TestUserAgentGetOrInsert(t *testing.T) {
 		`)
 	}
 }
+
+func TestUserAgentClientHints(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	const (
+		win  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+		edge = win + " Edg/124.0.0.0"
+		mac  = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+		ff   = "Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0"
+	)
+	tests := []struct {
+		ua                  string
+		hints               ClientHints
+		wantBrowser, wantOS string
+	}{
+		{win, ClientHints{}, "Chrome 124", "Windows 10"},
+		{win, ClientHints{
+			Brands:          `"Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99"`,
+			Platform:        "Windows",
+			PlatformVersion: "15.0.0",
+		}, "Chrome 124", "Windows 11"},
+		{edge, ClientHints{
+			Brands:          `"Microsoft Edge";v="124", "Not-A.Brand";v="99", "Chromium";v="124"`,
+			Platform:        "Windows",
+			PlatformVersion: "10.0.0",
+		}, "Edge 124", "Windows 10"},
+		{win, ClientHints{ // Windows 7/8/8.1: can't tell which, so use the UA.
+			Brands:          `"Not/A)Brand";v="8", "Chromium";v="124"`,
+			Platform:        "Windows",
+			PlatformVersion: "0.3.0",
+		}, "Chromium 124", "Windows 10"},
+		{mac, ClientHints{ // No Platform-Version: use the UA.
+			Brands:   `"Google Chrome";v="124", "Chromium";v="124", "Not-A.Brand";v="24"`,
+			Platform: "macOS",
+		}, "Chrome 124", "macOS 10.15"},
+		{mac, ClientHints{
+			Brands:          `"Google Chrome";v="124", "Chromium";v="124", "Not-A.Brand";v="24"`,
+			Platform:        "macOS",
+			PlatformVersion: "14.4.1",
+		}, "Chrome 124", "macOS 14.4"},
+		{ff, ClientHints{Brands: `garbage`, Platform: "Unknown"}, "Firefox 79", "Linux "},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			ua := UserAgent{UserAgent: tt.ua, Hints: tt.hints}
+			err := ua.GetOrInsert(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var browser, system string
+			err = zdb.Get(ctx, &browser, `select name || ' ' || version from browsers where browser_id = $1`, ua.BrowserID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = zdb.Get(ctx, &system, `select name || ' ' || version from systems where system_id = $1`, ua.SystemID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if browser != tt.wantBrowser || system != tt.wantOS {
+				t.Errorf("\nhave: %q %q\nwant: %q %q", browser, system, tt.wantBrowser, tt.wantOS)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+type CountryUniques struct {
+	id     int
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+
+	Limit int
+	Total int
+	Stats goatcounter.HitStats
+}
+
+func (w CountryUniques) Name() string { return "countryuniques" }
+func (w CountryUniques) Type() string { return "hchart" }
+func (w CountryUniques) Label(ctx context.Context) string {
+	return z18n.T(ctx, "label/country-uniques|Unique visitors per country")
+}
+func (w *CountryUniques) SetHTML(h template.HTML)             { w.html = h }
+func (w CountryUniques) HTML() template.HTML                  { return w.html }
+func (w *CountryUniques) SetErr(h error)                      { w.err = h }
+func (w CountryUniques) Err() error                           { return w.err }
+func (w CountryUniques) ID() int                              { return w.id }
+func (w CountryUniques) Settings() goatcounter.WidgetSettings { return w.s }
+
+func (w *CountryUniques) SetSettings(s goatcounter.WidgetSettings) {
+	w.s = s
+	if x := s["limit"].Value; x != nil {
+		w.Limit = int(x.(float64))
+	}
+}
+
+// GetData ignores the path filter, as the estimates are for the entire site.
+func (w *CountryUniques) GetData(ctx context.Context, a Args) (more bool, err error) {
+	w.Total, err = w.Stats.ListCountryUniques(ctx, a.Rng, w.Limit, a.Offset)
+	w.loaded = true
+	return w.Stats.More, err
+}
+
+func (w CountryUniques) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	header := z18n.T(ctx, "header/country-uniques|Unique visitors per country (estimated, %(margin) margin of error)",
+		fmt.Sprintf("±%.0f%%", 2*goatcounter.HLLError*100))
+
+	return "_dashboard_hchart.gohtml", struct {
+		Context     context.Context
+		ID          int
+		RowsOnly    bool
+		HasSubMenu  bool
+		Loaded      bool
+		Err         error
+		IsCollected bool
+		Header      string
+		TotalUTC    int
+
+		Stats goatcounter.HitStats
+	}{ctx, w.id, shared.RowsOnly, false, w.loaded, w.err, isCol(ctx, goatcounter.CollectCountryUniques) && isCol(ctx, goatcounter.CollectSession),
+		header, w.Total, w.Stats}
+}
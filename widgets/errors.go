@@ -0,0 +1,67 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+type Errors struct {
+	id     int
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+
+	Limit int
+	Total int
+	Stats goatcounter.HitStats
+}
+
+func (w Errors) Name() string { return "errors" }
+func (w Errors) Type() string { return "hchart" }
+func (w Errors) Label(ctx context.Context) string {
+	return z18n.T(ctx, "label/js-errors|JavaScript errors")
+}
+func (w *Errors) SetHTML(h template.HTML)             { w.html = h }
+func (w Errors) HTML() template.HTML                  { return w.html }
+func (w *Errors) SetErr(h error)                      { w.err = h }
+func (w Errors) Err() error                           { return w.err }
+func (w Errors) ID() int                              { return w.id }
+func (w Errors) Settings() goatcounter.WidgetSettings { return w.s }
+
+func (w *Errors) SetSettings(s goatcounter.WidgetSettings) {
+	w.s = s
+	if x := s["limit"].Value; x != nil {
+		w.Limit = int(x.(float64))
+	}
+}
+
+func (w *Errors) GetData(ctx context.Context, a Args) (more bool, err error) {
+	w.Total, err = w.Stats.ListJSErrors(ctx, a.Rng, w.Limit, a.Offset)
+	w.loaded = true
+	return w.Stats.More, err
+}
+
+func (w Errors) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	return "_dashboard_hchart.gohtml", struct {
+		Context     context.Context
+		ID          int
+		RowsOnly    bool
+		HasSubMenu  bool
+		Loaded      bool
+		Err         error
+		IsCollected bool
+		Header      string
+		TotalUTC    int
+
+		Stats goatcounter.HitStats
+	}{ctx, w.id, shared.RowsOnly, false, w.loaded, w.err, true, w.Label(ctx),
+		w.Total, w.Stats}
+}
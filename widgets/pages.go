@@ -176,6 +176,7 @@ func (w Pages) RenderHTML(ctx context.Context, shared SharedData) (string, any)
 		Total        int
 		TotalEvents  int
 		MorePages    bool
+		NoSessions   bool
 
 		Style    string
 		Refs     goatcounter.HitStats
@@ -185,7 +186,7 @@ func (w Pages) RenderHTML(ctx context.Context, shared SharedData) (string, any)
 		ctx, shared.Site, shared.User,
 		w.id, w.loaded, w.err, w.Pages, shared.Args.Rng, shared.Args.Daily,
 		shared.Args.ForcedDaily, 1, w.Max,
-		w.Display, shared.Total, shared.TotalEvents, w.More,
+		w.Display, shared.Total, shared.TotalEvents, w.More, !isCol(ctx, goatcounter.CollectSession),
 		w.Style, w.Refs, shared.Args.ShowRefs,
 		w.Diff,
 	}
@@ -91,11 +91,12 @@ func (w TotalPages) RenderHTML(ctx context.Context, shared SharedData) (string,
 
 		Total       int
 		TotalEvents int
+		NoSessions  bool
 
 		Style string
 	}{ctx, shared.Site, shared.User, w.id, w.loaded, w.err,
 		w.Align, w.NoEvents,
 		w.Total, shared.Args.Daily, w.Max,
-		shared.Total, shared.TotalEvents,
+		shared.Total, shared.TotalEvents, !isCol(ctx, goatcounter.CollectSession),
 		w.Style}
 }
@@ -139,6 +139,8 @@ func ListAllWidgets() List {
 		NewWidget("systems", 0),
 		NewWidget("toprefs", 0),
 		NewWidget("campaigns", 0),
+		NewWidget("errors", 0),
+		NewWidget("countryuniques", 0),
 		NewWidget("totalpages", 0),
 	}
 }
@@ -156,6 +158,8 @@ func NewWidget(name string, id int) Widget {
 		return &TopRefs{id: id}
 	case "campaigns":
 		return &Campaigns{id: id}
+	case "errors":
+		return &Errors{id: id}
 	case "browsers":
 		return &Browsers{id: id}
 	case "systems":
@@ -166,6 +170,8 @@ func NewWidget(name string, id int) Widget {
 		return &Locations{id: id}
 	case "languages":
 		return &Languages{id: id}
+	case "countryuniques":
+		return &CountryUniques{id: id}
 	}
 	zlog.Errorf("unknown widget: %q", name)
 	return &Dummy{}